@@ -0,0 +1,227 @@
+package category
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/bluele/gcache"
+	"github.com/bruceluk/dnsproxy/internal/domaintrie"
+)
+
+// MapCategorizer is a [Categorizer] backed by a static mapping of domains to
+// their categories.  A domain has the categories of itself and all its parent
+// domains.  The mapping is stored in a compact suffix trie, so that it's
+// suitable for lists with millions of domains.
+type MapCategorizer struct {
+	trie *domaintrie.Trie
+
+	// sets are the distinct lists of categories the values of trie refer to.
+	sets [][]string
+}
+
+// type check
+var _ Categorizer = (*MapCategorizer)(nil)
+
+// NewMapCategorizer returns a new *MapCategorizer using domains, which maps
+// lowercased domain names without trailing dots to their categories.  The
+// category lists of domains must not be modified after calling this function.
+func NewMapCategorizer(domains map[string][]string) (c *MapCategorizer) {
+	c = &MapCategorizer{}
+
+	b := domaintrie.NewBuilder()
+	setIdxs := map[string]uint32{}
+	for host, cats := range domains {
+		key := strings.Join(cats, ",")
+		idx, ok := setIdxs[key]
+		if !ok {
+			idx = uint32(len(c.sets))
+			c.sets = append(c.sets, cats)
+			setIdxs[key] = idx
+		}
+
+		b.Add(host, idx)
+	}
+
+	c.trie = b.Build()
+
+	return c
+}
+
+// ReadMapCategorizer reads the mapping of domains to categories from r and
+// returns a new *MapCategorizer using it.  Each non-empty line not starting
+// with '#' contains a domain and a comma-separated list of its categories
+// separated by whitespace, e.g.:
+//
+//	casino.example gambling,adult
+func ReadMapCategorizer(r io.Reader) (c *MapCategorizer, err error) {
+	domains := map[string][]string{}
+
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || fields[0][0] == '#' {
+			continue
+		} else if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want 2 fields, got %d", lineNum, len(fields))
+		}
+
+		host := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		domains[host] = append(domains[host], strings.Split(fields[1], ",")...)
+	}
+
+	err = s.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading categories: %w", err)
+	}
+
+	return NewMapCategorizer(domains), nil
+}
+
+// Categories implements the [Categorizer] interface for *MapCategorizer.
+func (c *MapCategorizer) Categories(_ context.Context, host string) (cats []string, err error) {
+	for _, idx := range c.trie.AppendMatches(nil, host) {
+		cats = append(cats, c.sets[idx]...)
+	}
+
+	return cats, nil
+}
+
+// FalsePositiveRate returns the measured false-positive rate of the Bloom
+// filter, which rejects most of the domains without categories before looking
+// them up in the mapping.  The filter is sized for the mapping on creation, so
+// the rate stays the same as the lists grow between reloads.
+func (c *MapCategorizer) FalsePositiveRate() (rate float64) {
+	return c.trie.FalsePositiveRate()
+}
+
+// Size returns the approximate memory footprint of the mapping in bytes.
+func (c *MapCategorizer) Size() (n int) {
+	n = c.trie.Size()
+	for _, cats := range c.sets {
+		for _, cat := range cats {
+			n += len(cat)
+		}
+	}
+
+	return n
+}
+
+// HTTPCategorizer is a [Categorizer] that queries a remote HTTP API.  For each
+// domain it sends a GET request with the "domain" query parameter to the
+// configured URL and expects a JSON object with the "categories" array of
+// strings in response.
+type HTTPCategorizer struct {
+	client *http.Client
+	url    *url.URL
+}
+
+// type check
+var _ Categorizer = (*HTTPCategorizer)(nil)
+
+// NewHTTPCategorizer returns a new *HTTPCategorizer querying apiURL.  If client
+// is nil, [http.DefaultClient] is used.
+func NewHTTPCategorizer(apiURL string, client *http.Client) (c *HTTPCategorizer, err error) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing api url: %w", err)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &HTTPCategorizer{
+		client: client,
+		url:    u,
+	}, nil
+}
+
+// maxRespSize is the maximum size of a response of the categorization API.
+const maxRespSize = 64 * 1024
+
+// Categories implements the [Categorizer] interface for *HTTPCategorizer.
+func (c *HTTPCategorizer) Categories(ctx context.Context, host string) (cats []string, err error) {
+	u := *c.url
+	q := u.Query()
+	q.Set("domain", host)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set(httphdr.Accept, "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting categories: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	data := &struct {
+		Categories []string `json:"categories"`
+	}{}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxRespSize)).Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	return data.Categories, nil
+}
+
+// CachedCategorizer is a [Categorizer] that caches the successful results of
+// another one.
+type CachedCategorizer struct {
+	categorizer Categorizer
+	cache       gcache.Cache
+	ttl         time.Duration
+}
+
+// type check
+var _ Categorizer = (*CachedCategorizer)(nil)
+
+// NewCachedCategorizer returns a new *CachedCategorizer caching up to size
+// results of c for ttl.
+func NewCachedCategorizer(c Categorizer, size int, ttl time.Duration) (cc *CachedCategorizer) {
+	return &CachedCategorizer{
+		categorizer: c,
+		cache:       gcache.New(size).LRU().Build(),
+		ttl:         ttl,
+	}
+}
+
+// Categories implements the [Categorizer] interface for *CachedCategorizer.
+func (c *CachedCategorizer) Categories(ctx context.Context, host string) (cats []string, err error) {
+	if v, getErr := c.cache.Get(host); getErr == nil {
+		return v.([]string), nil
+	}
+
+	cats, err = c.categorizer.Categories(ctx, host)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	err = c.cache.SetWithExpire(host, cats, c.ttl)
+	if err != nil {
+		// Shouldn't happen, since we don't set a serialization function.
+		panic(fmt.Errorf("category cache: setting item: %w", err))
+	}
+
+	return cats, nil
+}
@@ -0,0 +1,296 @@
+// Package category implements blocking of DNS requests by the categories of
+// the requested domains, such as "adult" or "gambling", as determined by a
+// pluggable categorization service.
+package category
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// Categorizer determines the categories of domains.
+type Categorizer interface {
+	// Categories returns the categories of the domain host.  host is
+	// lowercased and has no trailing dot.  It returns nil if the domain has
+	// no known categories.
+	Categories(ctx context.Context, host string) (cats []string, err error)
+}
+
+// defaultTimeout is the default timeout for categorizing a single domain.
+const defaultTimeout = 1 * time.Second
+
+// ClientCategories are the categories blocked for the clients within a subnet.
+type ClientCategories struct {
+	// Subnet is the subnet of the clients.  It must be valid.
+	Subnet netip.Prefix
+
+	// Blocked are the categories blocked for the clients.  An empty list
+	// disables blocking for them.
+	Blocked []string
+}
+
+// Config is the configuration of a [Filter].
+type Config struct {
+	// Categorizer determines the categories of the requested domains.  It
+	// must not be nil.
+	Categorizer Categorizer
+
+	// MessageConstructor is used to build the responses to the blocked
+	// requests.  If nil, the responses are built with plain response codes.
+	MessageConstructor proxy.MessageConstructor
+
+	// Clients are the per-client blocked categories.  The entry with the most
+	// specific subnet containing the client's address is used.
+	Clients []*ClientCategories
+
+	// DefaultBlocked are the categories blocked for the clients not matching
+	// any of Clients.
+	DefaultBlocked []string
+
+	// Timeout is the maximum duration of categorizing a single domain.  If
+	// not positive, a default value of 1s is used.
+	Timeout time.Duration
+
+	// FailClosed makes the requests fail with SERVFAIL when the categorizer
+	// fails.  Otherwise, such requests are processed as usual.
+	FailClosed bool
+
+	// CheckCNAMEs makes [Filter.HandleResponse] also block the responses with
+	// the CNAME records targeting the domains of the blocked categories, so
+	// that the trackers hidden behind first-party CNAMEs are blocked as well.
+	CheckCNAMEs bool
+}
+
+// clientBlocked is the set of the categories blocked for a subnet.
+type clientBlocked struct {
+	blocked *container.MapSet[string]
+	subnet  netip.Prefix
+}
+
+// Filter blocks the requests for the domains of the blocked categories.  It's
+// safe for concurrent use.
+type Filter struct {
+	categorizer    Categorizer
+	messages       proxy.MessageConstructor
+	defaultBlocked *container.MapSet[string]
+
+	// clients are sorted from the most specific subnet to the least specific
+	// one.
+	clients []*clientBlocked
+
+	timeout     time.Duration
+	failClosed  bool
+	checkCNAMEs bool
+}
+
+// New returns a new properly initialized *Filter.  c must not be nil.
+func New(c *Config) (f *Filter, err error) {
+	if c.Categorizer == nil {
+		return nil, errors.Error("no categorizer")
+	}
+
+	f = &Filter{
+		categorizer:    c.Categorizer,
+		messages:       c.MessageConstructor,
+		defaultBlocked: container.NewMapSet(c.DefaultBlocked...),
+		timeout:        c.Timeout,
+		failClosed:     c.FailClosed,
+		checkCNAMEs:    c.CheckCNAMEs,
+	}
+
+	if f.timeout <= 0 {
+		f.timeout = defaultTimeout
+	}
+
+	for i, cc := range c.Clients {
+		if cc == nil || !cc.Subnet.IsValid() {
+			return nil, fmt.Errorf("clients at index %d: bad subnet", i)
+		}
+
+		f.clients = append(f.clients, &clientBlocked{
+			blocked: container.NewMapSet(cc.Blocked...),
+			subnet:  cc.Subnet.Masked(),
+		})
+	}
+
+	slices.SortStableFunc(f.clients, func(a, b *clientBlocked) (res int) {
+		return b.subnet.Bits() - a.subnet.Bits()
+	})
+
+	return f, nil
+}
+
+// blockedFor returns the set of the categories blocked for the client with
+// addr.
+func (f *Filter) blockedFor(addr netip.Addr) (blocked *container.MapSet[string]) {
+	addr = addr.Unmap()
+	for _, c := range f.clients {
+		if c.subnet.Contains(addr) {
+			return c.blocked
+		}
+	}
+
+	return f.defaultBlocked
+}
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Filter)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Filter.  It sets the [proxy.KeyCategory] value of dctx for the blocked
+// requests.
+func (f *Filter) HandleBefore(_ *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	blocked := f.blockedFor(dctx.Addr.Addr())
+	if blocked.Len() == 0 || len(dctx.Req.Question) == 0 {
+		return nil
+	}
+
+	host := normalizeHost(dctx.Req.Question[0].Name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	cat, err := f.blockedCategory(ctx, blocked, host)
+	if err != nil {
+		return f.handleFailure(dctx, host, err)
+	} else if cat == "" {
+		return nil
+	}
+
+	proxy.SetValue(dctx, proxy.KeyCategory, cat)
+
+	return &proxy.BeforeRequestError{
+		Err:      fmt.Errorf("category: %q is in blocked category %q", host, cat),
+		Response: f.newResp(dctx.Req, dns.RcodeNameError),
+	}
+}
+
+// HandleResponse replaces the response in dctx with NXDOMAIN if any of its
+// CNAME records targets a domain of a blocked category.  It does nothing unless
+// [Config.CheckCNAMEs] is set.  It's intended to be used as
+// [proxy.ResponseHandler], and [proxy.Config.HandleCachedResponses] should be
+// set to check the cached responses as well.
+func (f *Filter) HandleResponse(dctx *proxy.DNSContext, err error) {
+	if !f.checkCNAMEs || err != nil || dctx.Res == nil {
+		return
+	}
+
+	blocked := f.blockedFor(dctx.Addr.Addr())
+	if blocked.Len() == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	checked := container.NewMapSet[string]()
+	for _, rr := range dctx.Res.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+
+		host := normalizeHost(cname.Target)
+		if checked.Has(host) {
+			continue
+		}
+
+		checked.Add(host)
+
+		cat, catErr := f.blockedCategory(ctx, blocked, host)
+		if catErr != nil {
+			f.handleResponseFailure(dctx, host, catErr)
+
+			return
+		} else if cat != "" {
+			log.Debug("category: cname target %q is in blocked category %q", host, cat)
+
+			proxy.SetValue(dctx, proxy.KeyCategory, cat)
+			dctx.Res = f.newResp(dctx.Req, dns.RcodeNameError)
+
+			return
+		}
+	}
+}
+
+// blockedCategory returns the first category of host contained in blocked, if
+// any.
+func (f *Filter) blockedCategory(
+	ctx context.Context,
+	blocked *container.MapSet[string],
+	host string,
+) (cat string, err error) {
+	cats, err := f.categorizer.Categories(ctx, host)
+	if err != nil {
+		// Don't wrap the error, since it's wrapped by the callers.
+		return "", err
+	}
+
+	for _, cat = range cats {
+		if blocked.Has(cat) {
+			return cat, nil
+		}
+	}
+
+	return "", nil
+}
+
+// normalizeHost returns the lowercased name without the trailing dot.
+func normalizeHost(name string) (host string) {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// handleFailure handles the failure to categorize host.
+func (f *Filter) handleFailure(dctx *proxy.DNSContext, host string, err error) (resErr error) {
+	if !f.failClosed {
+		log.Info("category: categorizing %q: %s; passing", host, err)
+
+		return nil
+	}
+
+	return &proxy.BeforeRequestError{
+		Err:      fmt.Errorf("category: categorizing %q: %w", host, err),
+		Response: f.newResp(dctx.Req, dns.RcodeServerFailure),
+	}
+}
+
+// handleResponseFailure handles the failure to categorize the CNAME target
+// host of the response in dctx.
+func (f *Filter) handleResponseFailure(dctx *proxy.DNSContext, host string, err error) {
+	if !f.failClosed {
+		log.Info("category: categorizing cname target %q: %s; passing", host, err)
+
+		return
+	}
+
+	log.Debug("category: categorizing cname target %q: %s", host, err)
+
+	dctx.Res = f.newResp(dctx.Req, dns.RcodeServerFailure)
+}
+
+// newResp returns a new response to req with code.
+func (f *Filter) newResp(req *dns.Msg, code int) (resp *dns.Msg) {
+	if f.messages != nil {
+		switch code {
+		case dns.RcodeNameError:
+			return f.messages.NewMsgNXDOMAIN(req)
+		case dns.RcodeServerFailure:
+			return f.messages.NewMsgSERVFAIL(req)
+		}
+	}
+
+	resp = (&dns.Msg{}).SetRcode(req, code)
+	resp.RecursionAvailable = true
+
+	return resp
+}
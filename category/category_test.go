@@ -0,0 +1,274 @@
+package category
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCategorizer is a [Categorizer] for tests.
+type testCategorizer struct {
+	onCategories func(ctx context.Context, host string) (cats []string, err error)
+}
+
+// type check
+var _ Categorizer = (*testCategorizer)(nil)
+
+// Categories implements the [Categorizer] interface for *testCategorizer.
+func (c *testCategorizer) Categories(ctx context.Context, host string) (cats []string, err error) {
+	return c.onCategories(ctx, host)
+}
+
+// newTestContext returns a new *proxy.DNSContext for an A request for name
+// from addr.
+func newTestContext(name, addr string) (dctx *proxy.DNSContext) {
+	return &proxy.DNSContext{
+		Req:  (&dns.Msg{}).SetQuestion(name, dns.TypeA),
+		Addr: netip.MustParseAddrPort(addr),
+	}
+}
+
+// requireRcode checks that err is a [proxy.BeforeRequestError] with a response
+// having rcode.
+func requireRcode(t *testing.T, err error, rcode int) {
+	t.Helper()
+
+	befErr := &proxy.BeforeRequestError{}
+	require.ErrorAs(t, err, &befErr)
+
+	assert.Equal(t, rcode, befErr.Response.Rcode)
+}
+
+func TestFilter_HandleBefore(t *testing.T) {
+	c, err := ReadMapCategorizer(strings.NewReader(`
+# Test categories.
+casino.example gambling
+adult.example  adult,gambling
+`))
+	require.NoError(t, err)
+
+	f, err := New(&Config{
+		Categorizer: c,
+		Clients: []*ClientCategories{{
+			Subnet:  netip.MustParsePrefix("192.168.0.0/16"),
+			Blocked: []string{"adult", "gambling"},
+		}, {
+			Subnet:  netip.MustParsePrefix("192.168.1.0/24"),
+			Blocked: nil,
+		}},
+		DefaultBlocked: []string{"gambling"},
+	})
+	require.NoError(t, err)
+
+	const (
+		kid    = "192.168.0.1:53"
+		parent = "192.168.1.1:53"
+		other  = "203.0.113.1:53"
+	)
+
+	dctx := newTestContext("www.adult.example.", kid)
+	requireRcode(t, f.HandleBefore(nil, dctx), dns.RcodeNameError)
+
+	cat, _ := proxy.Value(dctx, proxy.KeyCategory)
+	assert.Equal(t, "adult", cat)
+
+	requireRcode(t, f.HandleBefore(nil, newTestContext("casino.example.", other)), dns.RcodeNameError)
+
+	assert.NoError(t, f.HandleBefore(nil, newTestContext("adult.example.", parent)))
+	assert.NoError(t, f.HandleBefore(nil, newTestContext("news.example.", kid)))
+}
+
+func TestFilter_HandleBefore_failure(t *testing.T) {
+	const errTest errors.Error = "test error"
+
+	c := &testCategorizer{
+		onCategories: func(_ context.Context, _ string) (cats []string, err error) {
+			return nil, errTest
+		},
+	}
+
+	conf := &Config{
+		Categorizer:    c,
+		DefaultBlocked: []string{"adult"},
+	}
+
+	open, err := New(conf)
+	require.NoError(t, err)
+
+	assert.NoError(t, open.HandleBefore(nil, newTestContext("example.", "192.0.2.1:53")))
+
+	conf.FailClosed = true
+	closed, err := New(conf)
+	require.NoError(t, err)
+
+	hErr := closed.HandleBefore(nil, newTestContext("example.", "192.0.2.1:53"))
+	requireRcode(t, hErr, dns.RcodeServerFailure)
+	assert.ErrorIs(t, hErr, errTest)
+}
+
+func TestFilter_HandleResponse(t *testing.T) {
+	c := NewMapCategorizer(map[string][]string{
+		"tracker.example": {"tracking"},
+	})
+
+	f, err := New(&Config{
+		Categorizer:    c,
+		DefaultBlocked: []string{"tracking"},
+		CheckCNAMEs:    true,
+	})
+	require.NoError(t, err)
+
+	// newResp returns a response to an A request for name from a client with
+	// the CNAME record targeting target, if not empty.
+	newResp := func(name, target string) (dctx *proxy.DNSContext) {
+		dctx = newTestContext(name, "192.0.2.1:53")
+		dctx.Res = (&dns.Msg{}).SetReply(dctx.Req)
+		if target != "" {
+			dctx.Res.Answer = append(dctx.Res.Answer, &dns.CNAME{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeCNAME,
+					Class:  dns.ClassINET,
+				},
+				Target: target,
+			})
+		}
+
+		dctx.Res.Answer = append(dctx.Res.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+			},
+			A: netip.MustParseAddr("192.0.2.2").AsSlice(),
+		})
+
+		return dctx
+	}
+
+	testCases := []struct {
+		name      string
+		target    string
+		wantRcode int
+	}{{
+		name:      "cloaked",
+		target:    "Metrics.Tracker.Example.",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		name:      "not_blocked",
+		target:    "cdn.example.",
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "no_cname",
+		target:    "",
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := newResp("metrics.site.example.", tc.target)
+			f.HandleResponse(dctx, nil)
+
+			assert.Equal(t, tc.wantRcode, dctx.Res.Rcode)
+		})
+	}
+}
+
+func TestHTTPCategorizer(t *testing.T) {
+	var reqNum int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqNum++
+		assert.Equal(t, "casino.example", r.URL.Query().Get("domain"))
+
+		_, _ = w.Write([]byte(`{"categories":["gambling"]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	hc, err := NewHTTPCategorizer(srv.URL+"/check", srv.Client())
+	require.NoError(t, err)
+
+	c := NewCachedCategorizer(hc, 10, time.Minute)
+
+	for range 2 {
+		cats, catErr := c.Categories(context.Background(), "casino.example")
+		require.NoError(t, catErr)
+
+		assert.Equal(t, []string{"gambling"}, cats)
+	}
+
+	assert.Equal(t, 1, reqNum)
+}
+
+func TestReloadingCategorizer(t *testing.T) {
+	const host = "casino.example"
+
+	testErr := errors.Error("test error")
+
+	lists := []string{"casino.example gambling", "", "casino.example gambling,adult"}
+	failNext := false
+	load := func(_ context.Context) (c *MapCategorizer, err error) {
+		if failNext {
+			failNext = false
+
+			return nil, testErr
+		}
+
+		c, err = ReadMapCategorizer(strings.NewReader(lists[0]))
+		lists = lists[1:]
+
+		return c, err
+	}
+
+	c := NewReloadingCategorizer(load)
+	ctx := context.Background()
+
+	cats, err := c.Categories(ctx, host)
+	require.NoError(t, err)
+
+	assert.Empty(t, cats)
+	assert.Equal(t, RefreshStatus{}, c.Status())
+
+	require.NoError(t, c.Refresh(ctx))
+
+	cats, err = c.Categories(ctx, host)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"gambling"}, cats)
+
+	st := c.Status()
+	assert.Equal(t, uint64(1), st.Generation)
+	assert.NoError(t, st.LastError)
+	assert.False(t, st.LastRefresh.IsZero())
+
+	failNext = true
+	require.ErrorIs(t, c.Refresh(ctx), testErr)
+
+	// The failed refresh keeps the previous mapping.
+	cats, err = c.Categories(ctx, host)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"gambling"}, cats)
+
+	st = c.Status()
+	assert.Equal(t, uint64(1), st.Generation)
+	assert.ErrorIs(t, st.LastError, testErr)
+
+	require.NoError(t, c.Refresh(ctx))
+	require.NoError(t, c.Refresh(ctx))
+
+	cats, err = c.Categories(ctx, host)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"gambling", "adult"}, cats)
+	assert.Equal(t, uint64(3), c.Status().Generation)
+}
@@ -0,0 +1,132 @@
+package category
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Loader builds a new mapping of domains to categories, e.g. from a refreshed
+// list.
+type Loader func(ctx context.Context) (c *MapCategorizer, err error)
+
+// FileLoader returns a [Loader] reading the mapping from the file at path in
+// the format of [ReadMapCategorizer].
+func FileLoader(path string) (l Loader) {
+	return func(_ context.Context) (c *MapCategorizer, err error) {
+		// #nosec G304 -- Trust the path explicitly given by the user.
+		f, err := os.Open(path)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, err
+		}
+		defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+		return ReadMapCategorizer(f)
+	}
+}
+
+// RefreshStatus is the status of the refreshes of a [ReloadingCategorizer].
+type RefreshStatus struct {
+	// LastRefresh is the time of the last refresh attempt.  It's zero if there
+	// were no attempts yet.
+	LastRefresh time.Time
+
+	// LastError is the error of the last refresh attempt.  It's nil if the
+	// attempt succeeded.
+	LastError error
+
+	// Generation is the number of the mapping currently in use.  It's
+	// incremented each time a refreshed mapping is swapped in and is zero
+	// until the first successful refresh.
+	Generation uint64
+}
+
+// generation is a mapping of domains to categories along with its number.
+type generation struct {
+	categorizer *MapCategorizer
+	num         uint64
+}
+
+// ReloadingCategorizer is a [Categorizer] backed by a mapping of domains to
+// categories, which is rebuilt on [ReloadingCategorizer.Refresh].  The new
+// mapping is built without blocking [ReloadingCategorizer.Categories] and then
+// swapped in atomically, so that the requests are never delayed by rebuilding
+// a large list.
+type ReloadingCategorizer struct {
+	// refreshMu serializes the refreshes.
+	refreshMu *sync.Mutex
+
+	current *atomic.Pointer[generation]
+	status  *atomic.Pointer[RefreshStatus]
+	load    Loader
+}
+
+// type check
+var _ Categorizer = (*ReloadingCategorizer)(nil)
+
+// NewReloadingCategorizer returns a new *ReloadingCategorizer using load to
+// build the mappings.  It has no categories until the first successful
+// refresh.  load must not be nil.
+func NewReloadingCategorizer(load Loader) (c *ReloadingCategorizer) {
+	c = &ReloadingCategorizer{
+		refreshMu: &sync.Mutex{},
+		current:   &atomic.Pointer[generation]{},
+		status:    &atomic.Pointer[RefreshStatus]{},
+		load:      load,
+	}
+
+	c.current.Store(&generation{
+		categorizer: NewMapCategorizer(nil),
+		num:         0,
+	})
+	c.status.Store(&RefreshStatus{})
+
+	return c
+}
+
+// Categories implements the [Categorizer] interface for *ReloadingCategorizer.
+func (c *ReloadingCategorizer) Categories(ctx context.Context, host string) (cats []string, err error) {
+	return c.current.Load().categorizer.Categories(ctx, host)
+}
+
+// Refresh builds a new mapping and swaps it in.  If building fails, the
+// current mapping is kept.  It's safe for concurrent use, but the concurrent
+// refreshes are performed one after another.
+func (c *ReloadingCategorizer) Refresh(ctx context.Context) (err error) {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	cur := c.current.Load()
+	st := &RefreshStatus{
+		LastRefresh: time.Now(),
+		Generation:  cur.num,
+	}
+	defer func() { c.status.Store(st) }()
+
+	mc, err := c.load(ctx)
+	if err != nil {
+		st.LastError = fmt.Errorf("loading categories: %w", err)
+
+		return st.LastError
+	}
+
+	st.Generation = cur.num + 1
+	c.current.Store(&generation{
+		categorizer: mc,
+		num:         st.Generation,
+	})
+
+	return nil
+}
+
+// Status returns the status of the refreshes.  It doesn't wait for the
+// refresh in progress, if any.
+func (c *ReloadingCategorizer) Status() (s RefreshStatus) {
+	return *c.status.Load()
+}
@@ -2,6 +2,7 @@ package fastip
 
 import (
 	"encoding/binary"
+	"math"
 	"net/netip"
 	"time"
 )
@@ -17,20 +18,31 @@ const (
 // useless boolean as an integer.
 type cacheEntry struct {
 	// status is 1 if the item is timed out.
-	status      int
+	status int
+
+	// latencyMsec is the moving average of the latencies of the successful
+	// pings in milliseconds.
 	latencyMsec uint
+
+	// samples is the number of the successful pings averaged in latencyMsec.
+	// It's kept for the failed items, so that the history isn't lost.
+	samples uint
 }
 
+// maxSamples is the maximum number of the samples stored in a cache entry.
+const maxSamples = math.MaxUint16
+
 // packCacheEntry packs the cache entry and the TTL to bytes in the following
 // order:
 //
 //   - expire   [4]byte  (Unix time, seconds),
 //   - status   byte     (0 for ok, 1 for timed out),
-//   - latency  [2]byte  (milliseconds).
+//   - latency  [2]byte  (milliseconds),
+//   - samples  [2]byte.
 func packCacheEntry(ent *cacheEntry, ttl uint32) (d []byte) {
 	expire := uint32(time.Now().Unix()) + ttl
 
-	d = make([]byte, 4+1+2)
+	d = make([]byte, 4+1+2+2)
 	binary.BigEndian.PutUint32(d, expire)
 	i := 4
 
@@ -38,6 +50,9 @@ func packCacheEntry(ent *cacheEntry, ttl uint32) (d []byte) {
 	i++
 
 	binary.BigEndian.PutUint16(d[i:], uint16(ent.latencyMsec))
+	i += 2
+
+	binary.BigEndian.PutUint16(d[i:], uint16(min(ent.samples, maxSamples)))
 	// i += 2
 
 	return d
@@ -52,6 +67,11 @@ func unpackCacheEntry(data []byte) (ent *cacheEntry) {
 		return nil
 	}
 
+	return unpackStaleCacheEntry(data)
+}
+
+// unpackStaleCacheEntry unpacks bytes to cache entry regardless of its TTL.
+func unpackStaleCacheEntry(data []byte) (ent *cacheEntry) {
 	ent = &cacheEntry{}
 	i := 4
 
@@ -59,6 +79,9 @@ func unpackCacheEntry(data []byte) (ent *cacheEntry) {
 	i++
 
 	ent.latencyMsec = uint(binary.BigEndian.Uint16(data[i:]))
+	i += 2
+
+	ent.samples = uint(binary.BigEndian.Uint16(data[i:]))
 	// i += 2
 
 	return ent
@@ -75,7 +98,19 @@ func (f *FastestAddr) cacheFind(ip netip.Addr) (ent *cacheEntry) {
 	return unpackCacheEntry(val)
 }
 
-// cacheAddFailure stores unsuccessful attempt in cache.
+// cacheFindStale finds entry in the cache for the given IP address, even if
+// it's expired.  Returns nil if nothing is found.
+func (f *FastestAddr) cacheFindStale(ip netip.Addr) (ent *cacheEntry) {
+	val := f.ipCache.Get(ip.AsSlice())
+	if val == nil {
+		return nil
+	}
+
+	return unpackStaleCacheEntry(val)
+}
+
+// cacheAddFailure stores unsuccessful attempt in cache.  The averaged latency
+// of the previous successful attempts is kept.
 func (f *FastestAddr) cacheAddFailure(ip netip.Addr) {
 	ent := cacheEntry{
 		status: 1,
@@ -84,29 +119,163 @@ func (f *FastestAddr) cacheAddFailure(ip netip.Addr) {
 	f.ipCacheLock.Lock()
 	defer f.ipCacheLock.Unlock()
 
-	if f.cacheFind(ip) == nil {
-		f.cacheAdd(&ent, ip, fastestAddrCacheTTLSec)
+	if f.cacheFind(ip) != nil {
+		return
+	}
+
+	if prev := f.cacheFindStale(ip); prev != nil {
+		ent.latencyMsec, ent.samples = prev.latencyMsec, prev.samples
 	}
+
+	f.cacheAdd(&ent, ip, fastestAddrCacheTTLSec)
 }
 
-// cacheAddSuccessful stores a successful ping result in the cache.  Replaces
-// previous result if our latency is lower.
+// cacheAddSuccessful stores a successful ping result in the cache.  The
+// latency is averaged with the ones of the previous successful attempts, even
+// the expired ones, according to f.SampleWindow.
 func (f *FastestAddr) cacheAddSuccessful(ip netip.Addr, latency uint) {
 	ent := cacheEntry{
 		latencyMsec: latency,
+		samples:     1,
 	}
 
 	f.ipCacheLock.Lock()
 	defer f.ipCacheLock.Unlock()
 
-	entCached := f.cacheFind(ip)
-	if entCached == nil || entCached.status != 0 || entCached.latencyMsec > latency {
-		f.cacheAdd(&ent, ip, fastestAddrCacheTTLSec)
+	if prev := f.cacheFindStale(ip); prev != nil && prev.samples > 0 {
+		ent.samples = min(prev.samples+1, maxSamples)
+		ent.latencyMsec = movingAverage(prev.latencyMsec, latency, ent.samples, f.SampleWindow)
 	}
+
+	f.cacheAdd(&ent, ip, fastestAddrCacheTTLSec)
+}
+
+// movingAverage returns the average latency avg updated with the latency of
+// the samples-th sample.  The first window samples are averaged equally, and
+// the following ones are averaged exponentially with the weight of 1/window,
+// so that the latest samples matter more.
+func movingAverage(avg, latency, samples, window uint) (res uint) {
+	n := float64(max(min(samples, window), 1))
+	diff := float64(latency) - float64(avg)
+
+	return uint(math.Round(float64(avg) + diff/n))
 }
 
 // cacheAdd adds a new entry to the cache.
 func (f *FastestAddr) cacheAdd(ent *cacheEntry, ip netip.Addr, ttl uint32) {
 	val := packCacheEntry(ent, ttl)
 	f.ipCache.Set(ip.AsSlice(), val)
+	f.ipCacheKeys.Add(ip)
+	delete(f.ipCacheHits, ip)
+}
+
+// cacheMarkHit marks the entry of ip as found in the cache for host, so that
+// it's re-pinged before it expires.
+func (f *FastestAddr) cacheMarkHit(ip netip.Addr, host string) {
+	f.ipCacheLock.Lock()
+	defer f.ipCacheLock.Unlock()
+
+	if f.ipCacheKeys.Has(ip) {
+		f.ipCacheHits[ip] = host
+	}
+}
+
+// CacheEntry is an entry of the cache of the ping results.
+type CacheEntry struct {
+	// Expire is the time the entry expires at.
+	Expire time.Time
+
+	// Addr is the pinged address.
+	Addr netip.Addr
+
+	// Latency is the average latency of the successful pings.
+	Latency time.Duration
+
+	// Samples is the number of the successful pings averaged in Latency.
+	Samples uint
+
+	// Failed is true if the address couldn't be pinged.
+	Failed bool
+}
+
+// CacheEntries returns the entries of the cache of the ping results, which
+// haven't expired yet.  It's intended to inspect the cache and to transfer it to
+// another instance using [FastestAddr.RestoreCache].
+func (f *FastestAddr) CacheEntries() (ents []*CacheEntry) {
+	f.ipCacheLock.Lock()
+	defer f.ipCacheLock.Unlock()
+
+	f.ipCacheKeys.Range(func(ip netip.Addr) (cont bool) {
+		val := f.ipCache.Get(ip.AsSlice())
+		if val == nil {
+			return true
+		}
+
+		ent := unpackCacheEntry(val)
+		if ent == nil {
+			return true
+		}
+
+		ents = append(ents, &CacheEntry{
+			Expire:  time.Unix(int64(binary.BigEndian.Uint32(val)), 0),
+			Addr:    ip,
+			Latency: time.Duration(ent.latencyMsec) * time.Millisecond,
+			Samples: ent.samples,
+			Failed:  ent.status != 0,
+		})
+
+		return true
+	})
+
+	return ents
+}
+
+// RestoreCache adds ents to the cache of the ping results, replacing the
+// existing entries for the same addresses.  The expired entries are skipped.
+func (f *FastestAddr) RestoreCache(ents []*CacheEntry) {
+	f.ipCacheLock.Lock()
+	defer f.ipCacheLock.Unlock()
+
+	now := time.Now()
+	for _, e := range ents {
+		if !e.Expire.After(now) || !e.Addr.IsValid() {
+			continue
+		}
+
+		ent := &cacheEntry{
+			latencyMsec: uint(e.Latency.Milliseconds()),
+			samples:     e.Samples,
+		}
+		if e.Failed {
+			ent.status = 1
+		} else {
+			// The entries saved without the number of samples still have one.
+			ent.samples = max(ent.samples, 1)
+		}
+
+		f.cacheAdd(ent, e.Addr, uint32(e.Expire.Unix()-now.Unix()))
+	}
+}
+
+// CacheDelete removes the entry of ip from the cache of the ping results, so
+// that ip is pinged again the next time it's resolved.
+func (f *FastestAddr) CacheDelete(ip netip.Addr) {
+	f.ipCacheLock.Lock()
+	defer f.ipCacheLock.Unlock()
+
+	// Del doesn't call OnDelete, so clear the tracking manually.
+	f.ipCache.Del(ip.AsSlice())
+	f.ipCacheKeys.Delete(ip)
+	delete(f.ipCacheHits, ip)
+}
+
+// CacheFlush removes all the entries from the cache of the ping results.
+func (f *FastestAddr) CacheFlush() {
+	f.ipCacheLock.Lock()
+	defer f.ipCacheLock.Unlock()
+
+	// Clear doesn't call OnDelete, so clear the tracking manually.
+	f.ipCache.Clear()
+	f.ipCacheKeys.Clear()
+	clear(f.ipCacheHits)
 }
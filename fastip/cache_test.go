@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCacheAdd(t *testing.T) {
@@ -85,6 +86,51 @@ func TestCacheAddFailureNoOverwrite(t *testing.T) {
 	assert.Equal(t, uint(11), ent.latencyMsec)
 }
 
+func TestFastestAddr_cacheAddSuccessful_average(t *testing.T) {
+	f := NewFastestAddr()
+	f.SampleWindow = 4
+
+	ip := netip.MustParseAddr("1.1.1.1")
+	for _, lat := range []uint{10, 20, 30, 40} {
+		f.cacheAddSuccessful(ip, lat)
+	}
+
+	ent := f.cacheFind(ip)
+	require.NotNil(t, ent)
+
+	assert.Equal(t, uint(25), ent.latencyMsec)
+	assert.Equal(t, uint(4), ent.samples)
+
+	// A single slow ping doesn't outweigh the history.
+	f.cacheAddSuccessful(ip, 425)
+
+	ent = f.cacheFind(ip)
+	require.NotNil(t, ent)
+
+	assert.Equal(t, uint(125), ent.latencyMsec)
+	assert.Equal(t, uint(5), ent.samples)
+
+	// The history survives the failures and the expiration.
+	f.cacheAdd(&cacheEntry{status: 1, latencyMsec: 125, samples: 5}, ip, 0)
+	f.cacheAddFailure(ip)
+
+	ent = f.cacheFind(ip)
+	require.NotNil(t, ent)
+
+	assert.Equal(t, 1, ent.status)
+	assert.Equal(t, uint(125), ent.latencyMsec)
+
+	f.cacheAdd(&cacheEntry{status: 1, latencyMsec: 125, samples: 5}, ip, 0)
+	f.cacheAddSuccessful(ip, 25)
+
+	ent = f.cacheFind(ip)
+	require.NotNil(t, ent)
+
+	assert.Equal(t, 0, ent.status)
+	assert.Equal(t, uint(100), ent.latencyMsec)
+	assert.Equal(t, uint(6), ent.samples)
+}
+
 // TODO(ameshkov): Actually test something.
 func TestCache(_ *testing.T) {
 	f := NewFastestAddr()
@@ -102,3 +148,67 @@ func TestCache(_ *testing.T) {
 
 	f.cacheAdd(&ent, netip.MustParseAddr("2.2.2.2"), fastestAddrCacheTTLSec)
 }
+
+func TestFastestAddr_CacheEntries(t *testing.T) {
+	f := NewFastestAddr()
+
+	expire := time.Now().Add(time.Hour).Truncate(time.Second)
+	ok := &CacheEntry{
+		Expire:  expire,
+		Addr:    netip.MustParseAddr("192.0.2.1"),
+		Latency: 10 * time.Millisecond,
+		Samples: 3,
+	}
+	failed := &CacheEntry{
+		Expire: expire,
+		Addr:   netip.MustParseAddr("2001:db8::1"),
+		Failed: true,
+	}
+
+	f.RestoreCache([]*CacheEntry{ok, failed, {
+		Expire: time.Now().Add(-time.Second),
+		Addr:   netip.MustParseAddr("192.0.2.2"),
+	}})
+
+	assert.ElementsMatch(t, []*CacheEntry{ok, failed}, f.CacheEntries())
+
+	t.Run("evicted", func(t *testing.T) {
+		ent := &cacheEntry{latencyMsec: 1}
+		for i := range 1 << 13 {
+			ip := netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})
+			f.cacheAdd(ent, ip, fastestAddrCacheTTLSec)
+		}
+
+		ents := f.CacheEntries()
+		require.NotEmpty(t, ents)
+
+		assert.Equal(t, f.ipCache.Stats().Count, f.ipCacheKeys.Len())
+		assert.Len(t, ents, f.ipCacheKeys.Len())
+	})
+}
+
+func TestFastestAddr_CacheDelete(t *testing.T) {
+	f := NewFastestAddr()
+
+	ip1 := netip.MustParseAddr("192.0.2.1")
+	ip2 := netip.MustParseAddr("192.0.2.2")
+
+	f.cacheAddSuccessful(ip1, 10)
+	f.cacheAddSuccessful(ip2, 20)
+	f.cacheMarkHit(ip1, "example.org.")
+
+	f.CacheDelete(ip1)
+	assert.Nil(t, f.cacheFind(ip1))
+	assert.NotNil(t, f.cacheFind(ip2))
+	assert.Empty(t, f.ipCacheHits)
+
+	ents := f.CacheEntries()
+	require.Len(t, ents, 1)
+
+	assert.Equal(t, ip2, ents[0].Addr)
+
+	f.CacheFlush()
+	assert.Nil(t, f.cacheFind(ip2))
+	assert.Empty(t, f.CacheEntries())
+	assert.Zero(t, f.ipCacheKeys.Len())
+}
@@ -4,10 +4,12 @@
 package fastip
 
 import (
+	"context"
 	"net"
 	"net/netip"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/golibs/cache"
@@ -22,66 +24,199 @@ import (
 // operations to finish.
 const DefaultPingWaitTimeout = 1 * time.Second
 
+// DefaultSampleWindow is the default value of [FastestAddr.SampleWindow].
+const DefaultSampleWindow = 8
+
 // FastestAddr provides methods to determine the fastest network addresses.
 type FastestAddr struct {
-	// pinger is the dialer with predefined timeout for pinging TCP connections.
+	// pinger is the dialer of the default TCP prober with predefined timeout.
 	pinger *net.Dialer
 
-	// ipCacheLock protects ipCache.
+	// ipCacheLock protects ipCache, ipCacheKeys, and pingStats.
 	ipCacheLock *sync.Mutex
 
+	// icmpSeq is the sequence number of the last ICMP echo request.
+	icmpSeq *atomic.Uint32
+
 	// ipCache caches fastest IP addresses.
 	ipCache cache.Cache
 
+	// ipCacheKeys are the addresses stored in ipCache, since it can't be
+	// iterated over.
+	ipCacheKeys *container.MapSet[netip.Addr]
+
+	// pingStats are the statistics of the pings of the addresses stored in
+	// ipCache.
+	pingStats map[netip.Addr]*pingStat
+
+	// ipCacheHits are the hosts the addresses were last found in ipCache for
+	// since they were added.  Only these addresses are re-pinged before their
+	// entries expire.
+	ipCacheHits map[netip.Addr]string
+
+	// refreshCancel stops re-pinging the cached addresses.  It's nil if
+	// re-pinging isn't started.
+	refreshCancel context.CancelFunc
+
+	// refreshDone is closed once re-pinging the cached addresses is stopped.
+	refreshDone chan struct{}
+
 	// pingPorts are the ports to ping on.
 	pingPorts []uint
 
+	// testLatencies are the latencies of dialing the addresses in the test
+	// mode.  It's nil in the normal mode.  See [NewTestFastestAddr].
+	testLatencies map[netip.Addr]time.Duration
+
 	// PingWaitTimeout is the timeout for waiting all the resolved addresses to
-	// be pinged.  Any ping results received after that moment are cached, but
-	// won't be used.  It should be configured right after the FastestAddr
-	// initialization since it isn't protected for concurrent usage.
+	// be pinged.  The pings still in progress at that moment are canceled.  It
+	// should be configured right after the FastestAddr initialization since it
+	// isn't protected for concurrent usage.
 	PingWaitTimeout time.Duration
+
+	// Prober checks the reachability of each of the ping ports of the
+	// addresses when PingMode pings the TCP ports.  It's a [*TCPProber] by
+	// default.  It should be configured right after the FastestAddr
+	// initialization since it isn't protected for concurrent usage.
+	Prober Prober
+
+	// PortsByDomain are the ports to ping the addresses of the domains on
+	// instead of the default ones, 80 and 443, when PingMode uses TCP.  The
+	// keys are lowercased domain names without the trailing dot, either exact
+	// ones, like "example.com", or wildcards matching all the subdomains, like
+	// "*.example.com".  The exact domain takes precedence over the wildcards,
+	// and the closer wildcard over the farther one.  The values must not be
+	// empty.  It should be configured right after the FastestAddr
+	// initialization since it isn't protected for concurrent usage.
+	PortsByDomain map[string][]uint16
+
+	// PreferIPv6Within is the latency margin within which an IPv6 address is
+	// chosen over a faster IPv4 one, in the spirit of Happy Eyeballs, see RFC
+	// 8305.  Zero disables the preference.  It should be configured right
+	// after the FastestAddr initialization since it isn't protected for
+	// concurrent usage.
+	PreferIPv6Within time.Duration
+
+	// Metrics collects the statistics of the fastest address selection.  It
+	// must not be nil.  It should be configured right after the FastestAddr
+	// initialization since it isn't protected for concurrent usage.
+	Metrics Metrics
+
+	// RefreshInterval is the interval of re-pinging the cached addresses in
+	// use before their entries expire, see [FastestAddr.Start].  It should be
+	// less than the cache TTL, which is 10 minutes.  It should be configured
+	// right after the FastestAddr initialization since it isn't protected for
+	// concurrent usage.
+	RefreshInterval time.Duration
+
+	// RefreshConcurrency is the maximum number of the addresses re-pinged at
+	// once.  If not positive, [DefaultRefreshConcurrency] is used.  It should
+	// be configured right after the FastestAddr initialization since it isn't
+	// protected for concurrent usage.
+	RefreshConcurrency int
+
+	// PingMode defines how the addresses are pinged.  It should be configured
+	// right after the FastestAddr initialization since it isn't protected for
+	// concurrent usage.
+	PingMode PingMode
+
+	// SampleWindow is the number of the latest successful pings of an address
+	// its latency is averaged over.  The latencies of the first SampleWindow
+	// pings are averaged equally, and the following ones are averaged
+	// exponentially, so that a single slow ping doesn't make the address look
+	// slow.  1 means only the latest ping is used.  It should be configured
+	// right after the FastestAddr initialization since it isn't protected for
+	// concurrent usage.
+	SampleWindow uint
+
+	// Strategy defines how the address is chosen among the pinged ones.  It
+	// should be configured right after the FastestAddr initialization since it
+	// isn't protected for concurrent usage.
+	Strategy Strategy
+
+	// StrategyWindow is the maximum difference between the latency of an
+	// address and the lowest one for the address to be chosen by the
+	// strategies other than [StrategyFastest].  It should be configured right
+	// after the FastestAddr initialization since it isn't protected for
+	// concurrent usage.
+	StrategyWindow time.Duration
+
+	// CachePersistPath is the path to the file the cache of the ping results
+	// is saved to by [FastestAddr.Flush] and restored from by
+	// [FastestAddr.Load].  If empty, the cache isn't persisted.  It should be
+	// configured right after the FastestAddr initialization since it isn't
+	// protected for concurrent usage.
+	CachePersistPath string
 }
 
 // NewFastestAddr initializes a new instance of *FastestAddr.
 func NewFastestAddr() (f *FastestAddr) {
-	return &FastestAddr{
-		ipCacheLock: &sync.Mutex{},
-		ipCache: cache.New(cache.Config{
-			MaxSize:   64 * 1024,
-			EnableLRU: true,
-		}),
+	f = &FastestAddr{
+		ipCacheLock:     &sync.Mutex{},
+		icmpSeq:         &atomic.Uint32{},
+		ipCacheKeys:     container.NewMapSet[netip.Addr](),
+		pingStats:       map[netip.Addr]*pingStat{},
+		ipCacheHits:     map[netip.Addr]string{},
 		pingPorts:       []uint{80, 443},
 		PingWaitTimeout: DefaultPingWaitTimeout,
+		SampleWindow:    DefaultSampleWindow,
+		StrategyWindow:  DefaultStrategyWindow,
+		Metrics:         EmptyMetrics{},
 		pinger:          &net.Dialer{Timeout: pingTCPTimeout},
 	}
+
+	f.Prober = &TCPProber{Dialer: f.pinger}
+
+	f.ipCache = cache.New(cache.Config{
+		MaxSize:   64 * 1024,
+		EnableLRU: true,
+		// The items are only evicted within cacheAdd, so ipCacheLock is
+		// locked.
+		OnDelete: func(key, _ []byte) {
+			ip, _ := netip.AddrFromSlice(key)
+			f.ipCacheKeys.Delete(ip)
+			delete(f.pingStats, ip)
+			delete(f.ipCacheHits, ip)
+		},
+	})
+
+	return f
 }
 
 // ExchangeFastest queries each specified upstream and returns the response with
 // the fastest IP address.  The fastest IP address is considered to be the first
-// one successfully dialed and other addresses are removed from the answer.
+// one successfully dialed, unless f.Strategy chooses another one, and other
+// addresses are removed from the answer.
 func (f *FastestAddr) ExchangeFastest(
 	req *dns.Msg,
 	ups []upstream.Upstream,
 ) (resp *dns.Msg, u upstream.Upstream, err error) {
-	replies, err := upstream.ExchangeAll(ups, req)
+	var replies []upstream.ExchangeAllResult
+	if f.isTestMode() {
+		replies, err = exchangeAllTest(ups, req)
+	} else {
+		replies, err = upstream.ExchangeAll(ups, req)
+	}
+
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// Keep the order of the addresses to make the results reproducible.
+	var ips []netip.Addr
 	ipSet := container.NewMapSet[netip.Addr]()
 	for _, r := range replies {
 		for _, rr := range r.Resp.Answer {
 			ip := ipFromRR(rr)
-			if ip.IsValid() && !ip.IsUnspecified() {
+			if ip.IsValid() && !ip.IsUnspecified() && !ipSet.Has(ip) {
 				ipSet.Add(ip)
+				ips = append(ips, ip)
 			}
 		}
 	}
 
-	ips := ipSet.Values()
 	host := strings.ToLower(req.Question[0].Name)
-	if pingRes := f.pingAll(host, ips); pingRes != nil {
+	if pingRes := f.pingAll(context.Background(), host, ips); pingRes != nil {
 		return f.prepareReply(pingRes, replies)
 	}
 
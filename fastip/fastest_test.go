@@ -3,6 +3,7 @@ package fastip
 import (
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/bruceluk/dnsproxy/upstream"
@@ -84,6 +85,75 @@ func TestFastestAddr_ExchangeFastest(t *testing.T) {
 	})
 }
 
+func TestNewTestFastestAddr(t *testing.T) {
+	var (
+		ip1 = netip.MustParseAddr("192.0.2.1")
+		ip2 = netip.MustParseAddr("192.0.2.2")
+		ip3 = netip.MustParseAddr("192.0.2.3")
+	)
+
+	testCases := []struct {
+		latencies map[netip.Addr]time.Duration
+		name      string
+		want      netip.Addr
+		wantUps   int
+	}{{
+		latencies: map[netip.Addr]time.Duration{
+			ip1: 30 * time.Millisecond,
+			ip2: 10 * time.Millisecond,
+			ip3: 20 * time.Millisecond,
+		},
+		name:    "fastest",
+		want:    ip2,
+		wantUps: 1,
+	}, {
+		latencies: map[netip.Addr]time.Duration{
+			ip2: 10 * time.Millisecond,
+			ip3: 10 * time.Millisecond,
+		},
+		name:    "tie",
+		want:    ip2,
+		wantUps: 1,
+	}, {
+		latencies: map[netip.Addr]time.Duration{
+			ip1: 2 * DefaultPingWaitTimeout,
+			ip3: 20 * time.Millisecond,
+		},
+		name:    "timeout",
+		want:    ip3,
+		wantUps: 1,
+	}, {
+		latencies: nil,
+		name:      "unreachable",
+		want:      ip1,
+		wantUps:   0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ups := []upstream.Upstream{&testAUpstream{
+				recs: []*dns.A{newTestRec(t, ip1)},
+			}, &testAUpstream{
+				recs: []*dns.A{newTestRec(t, ip2), newTestRec(t, ip3)},
+			}}
+
+			f := NewTestFastestAddr(tc.latencies)
+
+			// Run several times to make sure that both pinging and caching
+			// give the same results.
+			for range 3 {
+				resp, u, err := f.ExchangeFastest(newTestReq(t), ups)
+				require.NoError(t, err)
+
+				assert.Same(t, ups[tc.wantUps], u)
+
+				require.NotEmpty(t, resp.Answer)
+				assert.Equal(t, tc.want.AsSlice(), []byte(resp.Answer[0].(*dns.A).A))
+			}
+		})
+	}
+}
+
 // testAUpstream is a mock err upstream structure for tests.
 type errUpstream struct {
 	err      error
@@ -0,0 +1,229 @@
+package fastip
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pingICMPTimeout is the timeout for waiting an ICMP echo reply.  It's the
+// same as pingTCPTimeout for the same reasons.
+const pingICMPTimeout = pingTCPTimeout
+
+// Protocol numbers of ICMP and ICMPv6 as required by [icmp.ParseMessage].
+const (
+	protoICMP   = 1
+	protoICMPv6 = 58
+)
+
+// PingMode defines how the resolved addresses are pinged.
+type PingMode uint8
+
+const (
+	// PingModeTCP probes the ports 80 and 443 of the addresses with
+	// [FastestAddr.Prober], which dials them over TCP by default.
+	PingModeTCP PingMode = iota
+
+	// PingModeICMP sends the ICMP echo requests to the addresses.  It uses a
+	// raw socket if permitted, and an unprivileged ICMP datagram socket
+	// otherwise, which is only supported on Linux and macOS.
+	PingModeICMP
+
+	// PingModeBoth uses both the TCP dialing and the ICMP echo requests, and
+	// the first successful result of any of them is used.
+	PingModeBoth
+)
+
+// String implements the [fmt.Stringer] interface for PingMode.
+func (m PingMode) String() (s string) {
+	switch m {
+	case PingModeTCP:
+		return "tcp"
+	case PingModeICMP:
+		return "icmp"
+	case PingModeBoth:
+		return "both"
+	default:
+		return fmt.Sprintf("!bad_ping_mode_%d", uint8(m))
+	}
+}
+
+// ParsePingMode parses the ping mode from its string representation as
+// returned by [PingMode.String].
+func ParsePingMode(s string) (m PingMode, err error) {
+	for m = PingModeTCP; m <= PingModeBoth; m++ {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+
+	return PingModeTCP, fmt.Errorf("unknown ping mode %q", s)
+}
+
+// usesTCP returns true if m dials the TCP ports.
+func (m PingMode) usesTCP() (ok bool) {
+	return m != PingModeICMP
+}
+
+// usesICMP returns true if m sends the ICMP echo requests.
+func (m PingMode) usesICMP() (ok bool) {
+	return m == PingModeICMP || m == PingModeBoth
+}
+
+// pingDoICMP sends the result of pinging addr with an ICMP echo request into
+// resCh.  The pinging is canceled with ctx.
+func (f *FastestAddr) pingDoICMP(
+	ctx context.Context,
+	host string,
+	addr netip.Addr,
+	resCh chan *pingResult,
+) {
+	log.Debug("pingDoICMP: %s: pinging %s", host, addr)
+
+	seq := uint16(f.icmpSeq.Add(1))
+
+	start := time.Now()
+	err := icmpEcho(ctx, addr, seq, pingICMPTimeout)
+	elapsed := time.Since(start)
+
+	f.reportPing(ctx, host, netip.AddrPortFrom(addr, 0), elapsed, err, resCh)
+}
+
+// listenICMP returns the connection to send the ICMP echo requests to the
+// addresses of the family of addr.  It tries to open a raw socket first, and
+// falls back to an unprivileged datagram one.  unprivileged is true for the
+// latter.
+func listenICMP(addr netip.Addr) (conn *icmp.PacketConn, unprivileged bool, err error) {
+	rawNet, udpNet, laddr := "ip4:icmp", "udp4", "0.0.0.0"
+	if addr.Is6() {
+		rawNet, udpNet, laddr = "ip6:ipv6-icmp", "udp6", "::"
+	}
+
+	conn, err = icmp.ListenPacket(rawNet, laddr)
+	if err == nil {
+		return conn, false, nil
+	}
+
+	log.Debug("fastip: opening raw icmp socket: %s; trying unprivileged", err)
+
+	conn, udpErr := icmp.ListenPacket(udpNet, laddr)
+	if udpErr != nil {
+		return nil, false, errors.Join(err, udpErr)
+	}
+
+	return conn, true, nil
+}
+
+// icmpEcho sends the ICMP echo request with seq to addr and waits for the reply
+// for timeout or until ctx is canceled.
+func icmpEcho(ctx context.Context, addr netip.Addr, seq uint16, timeout time.Duration) (err error) {
+	addr = addr.Unmap()
+
+	conn, unprivileged, err := listenICMP(addr)
+	if err != nil {
+		return fmt.Errorf("listening: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	var dst net.Addr = &net.IPAddr{IP: addr.AsSlice()}
+	if unprivileged {
+		dst = &net.UDPAddr{IP: addr.AsSlice()}
+	}
+
+	var reqType, respType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	proto := protoICMP
+	if addr.Is6() {
+		reqType, respType, proto = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, protoICMPv6
+	}
+
+	// The kernel replaces the identifier of the unprivileged sockets, so the
+	// replies are matched by the sequence number and the data.
+	data := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	req := &icmp.Message{
+		Type: reqType,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: int(seq), Data: data},
+	}
+
+	b, err := req.Marshal(nil)
+	if err != nil {
+		return fmt.Errorf("marshaling request: %w", err)
+	}
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	// Interrupt the reading once ctx is canceled.
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	_, err = conn.WriteTo(b, dst)
+	if err != nil {
+		return fmt.Errorf("writing request: %w", err)
+	}
+
+	return readEchoReply(conn, addr, proto, respType, int(seq), data)
+}
+
+// readEchoReply reads from conn until it receives the ICMP echo reply with seq
+// and data from addr.
+func readEchoReply(
+	conn *icmp.PacketConn,
+	addr netip.Addr,
+	proto int,
+	respType icmp.Type,
+	seq int,
+	data []byte,
+) (err error) {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, rErr := conn.ReadFrom(buf)
+		if rErr != nil {
+			return fmt.Errorf("reading reply: %w", rErr)
+		}
+
+		if peerAddr(peer) != addr {
+			continue
+		}
+
+		msg, pErr := icmp.ParseMessage(proto, buf[:n])
+		if pErr != nil || msg.Type != respType {
+			continue
+		}
+
+		echo, ok := msg.Body.(*icmp.Echo)
+		if ok && echo.Seq == seq && bytes.Equal(echo.Data, data) {
+			return nil
+		}
+	}
+}
+
+// peerAddr returns the IP address of peer as returned by the reads from the
+// ICMP connections.
+func peerAddr(peer net.Addr) (addr netip.Addr) {
+	var ip net.IP
+	switch peer := peer.(type) {
+	case *net.IPAddr:
+		ip = peer.IP
+	case *net.UDPAddr:
+		ip = peer.IP
+	default:
+		return netip.Addr{}
+	}
+
+	addr, _ = netip.AddrFromSlice(ip)
+
+	return addr.Unmap()
+}
@@ -0,0 +1,83 @@
+package fastip
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePingMode(t *testing.T) {
+	for _, m := range []PingMode{PingModeTCP, PingModeICMP, PingModeBoth} {
+		got, err := ParsePingMode(m.String())
+		require.NoError(t, err)
+
+		assert.Equal(t, m, got)
+	}
+
+	_, err := ParsePingMode("udp")
+	assert.Error(t, err)
+}
+
+// requireICMP skips t if the ICMP echo requests can't be sent to ip.
+func requireICMP(t *testing.T, ip netip.Addr) {
+	t.Helper()
+
+	conn, _, err := listenICMP(ip)
+	if err != nil {
+		t.Skipf("icmp isn't permitted: %s", err)
+	}
+
+	require.NoError(t, conn.Close())
+}
+
+func TestFastestAddr_PingAll_icmp(t *testing.T) {
+	ip := netutil.IPv4Localhost()
+	requireICMP(t, ip)
+
+	t.Run("icmp", func(t *testing.T) {
+		f := NewFastestAddr()
+		f.PingMode = PingModeICMP
+
+		res := f.pingAll(context.Background(), "", []netip.Addr{ip, ip})
+		require.NotNil(t, res)
+
+		assert.True(t, res.success)
+		assert.Equal(t, netip.AddrPortFrom(ip, 0), res.addrPort)
+		assertCaching(t, f, ip, 0)
+	})
+
+	t.Run("both_tcp_dropped", func(t *testing.T) {
+		f := NewFastestAddr()
+		f.PingMode = PingModeBoth
+		f.pingPorts = []uint{getFreePort(t)}
+
+		res := f.pingAll(context.Background(), "", []netip.Addr{ip, ip})
+		require.NotNil(t, res)
+
+		assert.True(t, res.success)
+		assert.Zero(t, res.addrPort.Port())
+		assertCaching(t, f, ip, 0)
+	})
+}
+
+func TestFastestAddr_PingAll_icmpTestMode(t *testing.T) {
+	fast := netip.MustParseAddr("192.0.2.1")
+	slow := netip.MustParseAddr("192.0.2.2")
+
+	f := NewTestFastestAddr(map[netip.Addr]time.Duration{
+		fast: 10 * time.Millisecond,
+		slow: 20 * time.Millisecond,
+	})
+	f.PingMode = PingModeICMP
+
+	res := f.pingAll(context.Background(), "", []netip.Addr{slow, fast})
+	require.NotNil(t, res)
+
+	assert.True(t, res.success)
+	assert.Equal(t, netip.AddrPortFrom(fast, 0), res.addrPort)
+}
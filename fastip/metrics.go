@@ -0,0 +1,42 @@
+package fastip
+
+import (
+	"net/netip"
+	"time"
+)
+
+// Metrics collects the statistics of the fastest address selection.  Its
+// methods must be safe for concurrent use.  host is empty for the pings of the
+// cached addresses re-pinged in background, see [FastestAddr.Start].
+type Metrics interface {
+	// ObserveCacheLookup is called for each address looked up in the cache
+	// while choosing the fastest address for host.  hit is true if a result
+	// for the address was found.
+	ObserveCacheLookup(host string, hit bool)
+
+	// ObservePingsScheduled is called with the number of the pings scheduled
+	// while choosing the fastest address for host, if any.  Each ping is
+	// performed by a separate goroutine.
+	ObservePingsScheduled(host string, n int)
+
+	// ObservePing is called with the result of each ping of addr resolved for
+	// host, which took latency.  ok is false if the ping failed.  The pings
+	// canceled since the fastest address is already chosen aren't observed.
+	ObservePing(host string, addr netip.Addr, latency time.Duration, ok bool)
+}
+
+// EmptyMetrics is the implementation of the [Metrics] interface that does
+// nothing.
+type EmptyMetrics struct{}
+
+// type check
+var _ Metrics = EmptyMetrics{}
+
+// ObserveCacheLookup implements the [Metrics] interface for EmptyMetrics.
+func (EmptyMetrics) ObserveCacheLookup(_ string, _ bool) {}
+
+// ObservePingsScheduled implements the [Metrics] interface for EmptyMetrics.
+func (EmptyMetrics) ObservePingsScheduled(_ string, _ int) {}
+
+// ObservePing implements the [Metrics] interface for EmptyMetrics.
+func (EmptyMetrics) ObservePing(_ string, _ netip.Addr, _ time.Duration, _ bool) {}
@@ -0,0 +1,119 @@
+package fastip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// persistedEntry is the serialized form of a cache entry.
+type persistedEntry struct {
+	// Expire is the time the entry expires at.
+	Expire time.Time `json:"expire"`
+
+	// Addr is the pinged address.
+	Addr netip.Addr `json:"addr"`
+
+	// LatencyMsec is the average latency of the successful pings in
+	// milliseconds.
+	LatencyMsec int64 `json:"latency_msec"`
+
+	// Samples is the number of the successful pings averaged in LatencyMsec.
+	Samples uint `json:"samples"`
+
+	// Failed is true if the address couldn't be pinged.
+	Failed bool `json:"failed"`
+}
+
+// Load restores the cache of the ping results from the file at
+// f.CachePersistPath, if it's set.  A missing file isn't an error, and the
+// entries expired since they've been flushed are skipped, so that the restored
+// ones live only for the rest of their original TTL.
+func (f *FastestAddr) Load() (err error) {
+	if f.CachePersistPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.CachePersistPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	var persisted []*persistedEntry
+	err = json.Unmarshal(data, &persisted)
+	if err != nil {
+		return fmt.Errorf("decoding fastip cache: %w", err)
+	}
+
+	ents := make([]*CacheEntry, 0, len(persisted))
+	for _, p := range persisted {
+		ents = append(ents, &CacheEntry{
+			Expire:  p.Expire,
+			Addr:    p.Addr,
+			Latency: time.Duration(p.LatencyMsec) * time.Millisecond,
+			Samples: p.Samples,
+			Failed:  p.Failed,
+		})
+	}
+
+	f.RestoreCache(ents)
+
+	log.Debug("fastip: loaded %d cache entries", len(ents))
+
+	return nil
+}
+
+// Flush writes the cache of the ping results to the file at
+// f.CachePersistPath, if it's set.  The expired entries aren't written.
+func (f *FastestAddr) Flush() (err error) {
+	if f.CachePersistPath == "" {
+		return nil
+	}
+
+	ents := f.CacheEntries()
+	persisted := make([]*persistedEntry, 0, len(ents))
+	for _, e := range ents {
+		persisted = append(persisted, &persistedEntry{
+			Expire:      e.Expire,
+			Addr:        e.Addr,
+			LatencyMsec: e.Latency.Milliseconds(),
+			Samples:     e.Samples,
+			Failed:      e.Failed,
+		})
+	}
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return fmt.Errorf("encoding fastip cache: %w", err)
+	}
+
+	path := f.CachePersistPath
+
+	// Write the file atomically, so that a crash in the middle of flushing
+	// doesn't spoil the previously flushed cache.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	_, err = tmp.Write(data)
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("writing fastip cache: %w", err), os.Remove(tmp.Name()))
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package fastip
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFastestAddr_Flush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fastip.json")
+
+	src := NewFastestAddr()
+	src.CachePersistPath = path
+
+	expire := time.Now().Add(time.Hour)
+	src.RestoreCache([]*CacheEntry{{
+		Expire:  expire,
+		Addr:    netip.MustParseAddr("192.0.2.1"),
+		Latency: 10 * time.Millisecond,
+	}, {
+		Expire: expire,
+		Addr:   netip.MustParseAddr("2001:db8::1"),
+		Failed: true,
+	}})
+
+	require.NoError(t, src.Flush())
+
+	dst := NewFastestAddr()
+	dst.CachePersistPath = path
+	require.NoError(t, dst.Load())
+
+	assert.ElementsMatch(t, src.CacheEntries(), dst.CacheEntries())
+
+	t.Run("expired", func(t *testing.T) {
+		data := []byte(`[{` +
+			`"expire":"2000-01-01T00:00:00Z",` +
+			`"addr":"192.0.2.2",` +
+			`"latency_msec":1,` +
+			`"failed":false` +
+			`}]`)
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+
+		f := NewFastestAddr()
+		f.CachePersistPath = path
+		require.NoError(t, f.Load())
+
+		assert.Empty(t, f.CacheEntries())
+	})
+
+	t.Run("no_file", func(t *testing.T) {
+		f := NewFastestAddr()
+		f.CachePersistPath = filepath.Join(t.TempDir(), "missing.json")
+
+		assert.NoError(t, f.Load())
+		assert.Empty(t, f.CacheEntries())
+	})
+
+	t.Run("no_path", func(t *testing.T) {
+		f := NewFastestAddr()
+
+		assert.NoError(t, f.Flush())
+		assert.NoError(t, f.Load())
+	})
+}
@@ -1,63 +1,147 @@
 package fastip
 
 import (
+	"context"
 	"net/netip"
+	"strings"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 )
 
-// pingTCPTimeout is a TCP connection timeout.  It's higher than pingWaitTimeout
-// since the slower connections will be cached anyway.
+// pingTCPTimeout is a timeout of probing a single port.  The probing is also
+// canceled once the pinging is over, so it only matters when PingWaitTimeout is
+// higher.
 const pingTCPTimeout = 4 * time.Second
 
-// pingResult is the result of dialing the address.
+// pingResult is the result of pinging the address.
 type pingResult struct {
 	// addrPort is the address-port pair the result is related to.
 	addrPort netip.AddrPort
 
-	// latency is the duration of dialing process in milliseconds.
+	// latency is the duration of pinging process in milliseconds.
 	latency uint
 
-	// success is true when the dialing succeeded.
+	// success is true when the pinging succeeded.
 	success bool
 }
 
-// schedulePings returns the result with the fastest IP address from the cache,
-// if it's found, and starts pinging other IPs which are not cached or outdated.
-// Returns scheduled flag which indicates that some goroutines have been
-// scheduled.
+// schedulePings returns the successful results for the IP addresses found in
+// the cache, and starts pinging other IPs which are not cached or outdated.
+// The TCP pings are sent to ports.  pings is the number of the scheduled
+// pings, each sending its result into resCh.  The pings are canceled with ctx.
 func (f *FastestAddr) schedulePings(
+	ctx context.Context,
 	resCh chan *pingResult,
 	ips []netip.Addr,
 	host string,
-) (pr *pingResult, scheduled bool) {
+	ports []uint,
+) (cached []*pingResult, pings int) {
 	for _, ip := range ips {
-		cached := f.cacheFind(ip)
-		if cached == nil {
-			scheduled = true
-			for _, port := range f.pingPorts {
-				go f.pingDoTCP(host, netip.AddrPortFrom(ip, uint16(port)), resCh)
-			}
+		ent := f.cacheFind(ip)
+		f.Metrics.ObserveCacheLookup(host, ent != nil)
+		if ent == nil {
+			pings += f.pingsPerAddr(ports)
+			f.schedulePing(ctx, resCh, ip, host, ports)
 
 			continue
 		}
 
-		if cached.status == 0 && (pr == nil || cached.latencyMsec < pr.latency) {
-			pr = &pingResult{
+		if f.RefreshInterval > 0 {
+			f.cacheMarkHit(ip, host)
+		}
+
+		if ent.status == 0 {
+			cached = append(cached, &pingResult{
 				addrPort: netip.AddrPortFrom(ip, 0),
-				latency:  cached.latencyMsec,
+				latency:  ent.latencyMsec,
 				success:  true,
+			})
+		}
+	}
+
+	if pings > 0 {
+		f.Metrics.ObservePingsScheduled(host, pings)
+	}
+
+	return cached, pings
+}
+
+// schedulePing starts pinging ip according to the ping mode.  The TCP pings are
+// sent to ports.  The pings are canceled with ctx.
+func (f *FastestAddr) schedulePing(
+	ctx context.Context,
+	resCh chan *pingResult,
+	ip netip.Addr,
+	host string,
+	ports []uint,
+) {
+	if f.PingMode.usesTCP() {
+		for _, port := range ports {
+			addrPort := netip.AddrPortFrom(ip, uint16(port))
+			if f.isTestMode() {
+				f.pingTest(ctx, host, addrPort, resCh)
+			} else {
+				go f.pingDoProbe(ctx, host, addrPort, resCh)
 			}
 		}
 	}
 
-	return pr, scheduled
+	if f.PingMode.usesICMP() {
+		if f.isTestMode() {
+			f.pingTest(ctx, host, netip.AddrPortFrom(ip, 0), resCh)
+		} else {
+			go f.pingDoICMP(ctx, host, ip, resCh)
+		}
+	}
 }
 
-// pingAll pings all ips concurrently and returns as soon as the fastest one is
-// found or the timeout is exceeded.
-func (f *FastestAddr) pingAll(host string, ips []netip.Addr) (pr *pingResult) {
+// pingsPerAddr returns the number of the pings of a single address according
+// to the ping mode, where the TCP pings are sent to ports.
+func (f *FastestAddr) pingsPerAddr(ports []uint) (n int) {
+	if f.PingMode.usesTCP() {
+		n += len(ports)
+	}
+
+	if f.PingMode.usesICMP() {
+		n++
+	}
+
+	return n
+}
+
+// portsFor returns the ports to ping the addresses of host on, which is a
+// lowercased FQDN.  The ports of the exact domain in PortsByDomain are used
+// first, then the ones of the closest wildcard domain, and then the default
+// ones.
+func (f *FastestAddr) portsFor(host string) (ports []uint) {
+	if len(f.PortsByDomain) == 0 {
+		return f.pingPorts
+	}
+
+	name := strings.TrimSuffix(host, ".")
+	byDomain, ok := f.PortsByDomain[name]
+	for !ok && name != "" {
+		_, name, _ = strings.Cut(name, ".")
+		byDomain, ok = f.PortsByDomain["*."+name]
+	}
+
+	if !ok {
+		return f.pingPorts
+	}
+
+	ports = make([]uint, 0, len(byDomain))
+	for _, p := range byDomain {
+		ports = append(ports, uint(p))
+	}
+
+	return ports
+}
+
+// pingAll pings all ips concurrently and returns as soon as the address is
+// chosen according to f.Strategy, the timeout is exceeded, or ctx is canceled.
+// The pings still in progress are canceled on return.
+func (f *FastestAddr) pingAll(ctx context.Context, host string, ips []netip.Addr) (pr *pingResult) {
 	ipN := len(ips)
 	switch ipN {
 	case 0:
@@ -69,9 +153,14 @@ func (f *FastestAddr) pingAll(host string, ips []netip.Addr) (pr *pingResult) {
 		}
 	}
 
-	resCh := make(chan *pingResult, ipN*len(f.pingPorts))
-	pr, scheduled := f.schedulePings(resCh, ips, host)
-	if !scheduled {
+	ctx, cancel := context.WithTimeout(ctx, f.PingWaitTimeout)
+	defer cancel()
+
+	ports := f.portsFor(host)
+	resCh := make(chan *pingResult, ipN*f.pingsPerAddr(ports))
+	cached, pings := f.schedulePings(ctx, resCh, ips, host, ports)
+	if pings == 0 {
+		pr = f.choose(cached)
 		if pr != nil {
 			log.Debug("fastip: pingAll: %s: return cached response: %s", host, pr.addrPort)
 		} else {
@@ -81,28 +170,34 @@ func (f *FastestAddr) pingAll(host string, ips []netip.Addr) (pr *pingResult) {
 		return pr
 	}
 
-	res := f.firstSuccessRes(resCh, host)
-	if res == nil {
-		// In case of timeout return cached or nil.
-		return pr
-	}
-
-	if pr == nil || res.latency <= pr.latency {
-		// Cache wasn't found or is worse than res.
-		return res
+	var results []*pingResult
+	if f.isTestMode() {
+		results = f.testResults(resCh, host)
+	} else {
+		results = f.collectResults(ctx, resCh, host, pings)
 	}
 
-	// Return cached result.
-	return pr
+	// Prefer the fresh results over the cached ones with the same latency.
+	return f.choose(append(results, cached...))
 }
 
-// firstSuccessRes waits and returns the first successful ping result or nil in
-// case of timeout.
-func (f *FastestAddr) firstSuccessRes(resCh chan *pingResult, host string) (res *pingResult) {
-	after := time.After(f.PingWaitTimeout)
-	for {
+// collectResults waits for the successful results of the pings from resCh and
+// returns them.  For [StrategyFastest], it returns the first one, or the IPv6
+// one received within f.PreferIPv6Within after the first IPv4 one.  For other
+// strategies, it waits for f.StrategyWindow and f.PreferIPv6Within after the
+// first one to collect the results with the close latency, unless all the
+// pings are already over.  results are nil when ctx is done before any
+// success.
+func (f *FastestAddr) collectResults(
+	ctx context.Context,
+	resCh chan *pingResult,
+	host string,
+	pings int,
+) (results []*pingResult) {
+	var windowCh <-chan time.Time
+	for ; pings > 0; pings-- {
 		select {
-		case res = <-resCh:
+		case res := <-resCh:
 			log.Debug(
 				"fastip: pingAll: %s: got result for %s status %v",
 				host,
@@ -114,31 +209,118 @@ func (f *FastestAddr) firstSuccessRes(resCh chan *pingResult, host string) (res
 				continue
 			}
 
-			return res
-		case <-after:
-			log.Debug("fastip: pingAll: %s: pinging timed out", host)
+			if f.Strategy == StrategyFastest {
+				if f.PreferIPv6Within > 0 && res.addrPort.Addr().Unmap().Is4() {
+					res = f.waitIPv6Res(ctx, resCh, host, res)
+				}
+
+				return []*pingResult{res}
+			}
 
-			return nil
+			results = append(results, res)
+			if windowCh == nil {
+				// Account for the IPv6 addresses, which are preferred even if
+				// they're slower.
+				window := time.NewTimer(f.StrategyWindow + f.PreferIPv6Within)
+				defer window.Stop()
+
+				windowCh = window.C
+			}
+		case <-windowCh:
+			return results
+		case <-ctx.Done():
+			if len(results) == 0 {
+				log.Debug("fastip: pingAll: %s: pinging timed out: %s", host, context.Cause(ctx))
+			}
+
+			return results
 		}
 	}
+
+	return results
 }
 
-// pingDoTCP sends the result of dialing the specified address into resCh.
-func (f *FastestAddr) pingDoTCP(host string, addrPort netip.AddrPort, resCh chan *pingResult) {
-	log.Debug("pingDoTCP: %s: connecting to %s", host, addrPort)
+// waitIPv6Res waits for a successful ping result of an IPv6 address for
+// PreferIPv6Within after the IPv4 one, res, has been received, and returns the
+// former, if any, or res otherwise.
+func (f *FastestAddr) waitIPv6Res(
+	ctx context.Context,
+	resCh chan *pingResult,
+	host string,
+	res *pingResult,
+) (pr *pingResult) {
+	timer := time.NewTimer(f.PreferIPv6Within)
+	defer timer.Stop()
 
-	start := time.Now()
-	conn, err := f.pinger.Dial("tcp", addrPort.String())
-	elapsed := time.Since(start)
+	for {
+		select {
+		case pr = <-resCh:
+			if pr.success && !pr.addrPort.Addr().Unmap().Is4() {
+				log.Debug("fastip: pingAll: %s: preferring %s to %s", host, pr.addrPort, res.addrPort)
 
-	success := err == nil
-	if success {
-		if cErr := conn.Close(); cErr != nil {
-			log.Debug("fastip: closing tcp connection: %s", cErr)
+				return pr
+			}
+		case <-timer.C:
+			return res
+		case <-ctx.Done():
+			return res
 		}
 	}
+}
+
+// faster returns true if a is considered faster than b, which accounts for
+// PreferIPv6Within.
+func (f *FastestAddr) faster(a, b *pingResult) (ok bool) {
+	return f.rankLatency(a) < f.rankLatency(b)
+}
+
+// rankLatency returns the latency of res in milliseconds used to compare it
+// with the other results.  The latency of IPv4 addresses is increased by
+// PreferIPv6Within.
+func (f *FastestAddr) rankLatency(res *pingResult) (latency uint) {
+	if res.addrPort.Addr().Unmap().Is4() {
+		return res.latency + uint(f.PreferIPv6Within.Milliseconds())
+	}
+
+	return res.latency
+}
+
+// pingDoProbe sends the result of probing the specified address with f.Prober
+// into resCh.  The probing is canceled with ctx.
+func (f *FastestAddr) pingDoProbe(
+	ctx context.Context,
+	host string,
+	addrPort netip.AddrPort,
+	resCh chan *pingResult,
+) {
+	probeCtx, cancel := context.WithTimeout(ctx, pingTCPTimeout)
+	defer cancel()
+
+	elapsed, err := f.Prober.Probe(probeCtx, host, addrPort)
+	f.reportPing(ctx, host, addrPort, elapsed, err, resCh)
+}
+
+// reportPing sends the result of pinging addrPort, which took elapsed and
+// failed with err, if not nil, into resCh and caches it.  The port is zero for
+// the ICMP pings.  The failures caused by canceling ctx are only logged, since
+// they say nothing about the address.
+func (f *FastestAddr) reportPing(
+	ctx context.Context,
+	host string,
+	addrPort netip.AddrPort,
+	elapsed time.Duration,
+	err error,
+	resCh chan *pingResult,
+) {
+	success := err == nil
+	if !success && ctx.Err() != nil {
+		log.Debug("fastip: ping: %s: canceled pinging %s: %s", host, addrPort, err)
+
+		return
+	}
 
 	latency := uint(elapsed.Milliseconds())
+	f.Metrics.ObservePing(host, addrPort.Addr(), elapsed, success)
 
 	resCh <- &pingResult{
 		addrPort: addrPort,
@@ -147,12 +329,13 @@ func (f *FastestAddr) pingDoTCP(host string, addrPort netip.AddrPort, resCh chan
 	}
 
 	addr := addrPort.Addr().Unmap()
+	f.statsAdd(addr, success)
 	if success {
-		log.Debug("fastip: pingDoTCP: %s: elapsed %s ms on %s", host, elapsed, addrPort)
+		log.Debug("fastip: ping: %s: elapsed %s ms on %s", host, elapsed, addrPort)
 		f.cacheAddSuccessful(addr, latency)
 	} else {
 		log.Debug(
-			"fastip: pingDoTCP: %s: failed to connect to %s, elapsed %s ms: %v",
+			"fastip: ping: %s: failed to ping %s, elapsed %s ms: %v",
 			host,
 			addrPort,
 			elapsed,
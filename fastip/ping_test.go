@@ -1,6 +1,7 @@
 package fastip
 
 import (
+	"context"
 	"net"
 	"net/netip"
 	"runtime"
@@ -18,6 +19,9 @@ import (
 // unit is the convenient alias for struct{}.
 type unit = struct{}
 
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
 func TestFastestAddr_PingAll_timeout(t *testing.T) {
 	t.Run("isolated", func(t *testing.T) {
 		f := NewFastestAddr()
@@ -30,7 +34,7 @@ func TestFastestAddr_PingAll_timeout(t *testing.T) {
 		}
 
 		ip := netutil.IPv4Localhost()
-		res := f.pingAll("", []netip.Addr{ip, ip})
+		res := f.pingAll(context.Background(), "", []netip.Addr{ip, ip})
 		require.Nil(t, res)
 
 		waitCh <- unit{}
@@ -52,7 +56,7 @@ func TestFastestAddr_PingAll_timeout(t *testing.T) {
 			return nil
 		}
 
-		res := f.pingAll("", []netip.Addr{ip1, ip2})
+		res := f.pingAll(context.Background(), "", []netip.Addr{ip1, ip2})
 		require.NotNil(t, res)
 
 		assert.True(t, res.success)
@@ -83,7 +87,7 @@ func TestFastestAddr_PingAll_cache(t *testing.T) {
 		f := NewFastestAddr()
 		f.cacheAddFailure(ip)
 
-		res := f.pingAll("", []netip.Addr{ip, ip})
+		res := f.pingAll(context.Background(), "", []netip.Addr{ip, ip})
 		require.Nil(t, res)
 	})
 
@@ -93,7 +97,7 @@ func TestFastestAddr_PingAll_cache(t *testing.T) {
 		f := NewFastestAddr()
 		f.cacheAddSuccessful(ip, lat)
 
-		res := f.pingAll("", []netip.Addr{ip, ip})
+		res := f.pingAll(context.Background(), "", []netip.Addr{ip, ip})
 		require.NotNil(t, res)
 		assert.True(t, res.success)
 		assert.Equal(t, lat, res.latency)
@@ -125,7 +129,7 @@ func TestFastestAddr_PingAll_cache(t *testing.T) {
 			return nil
 		}
 
-		res := f.pingAll("", ips)
+		res := f.pingAll(context.Background(), "", ips)
 		require.NotNil(t, res)
 
 		assert.True(t, res.success)
@@ -151,7 +155,7 @@ func TestFastestAddr_PingAll(t *testing.T) {
 
 	t.Run("single", func(t *testing.T) {
 		f := NewFastestAddr()
-		res := f.pingAll("", []netip.Addr{ip})
+		res := f.pingAll(context.Background(), "", []netip.Addr{ip})
 		require.NotNil(t, res)
 
 		assert.True(t, res.success)
@@ -188,7 +192,7 @@ func TestFastestAddr_PingAll(t *testing.T) {
 		}
 
 		ips := []netip.Addr{ip, ip}
-		res := f.pingAll("", ips)
+		res := f.pingAll(context.Background(), "", ips)
 		ctrlCh <- unit{}
 
 		require.NotNil(t, res)
@@ -200,8 +204,51 @@ func TestFastestAddr_PingAll(t *testing.T) {
 		assertCaching(t, f, ip, 0)
 	})
 
+	t.Run("cancel", func(t *testing.T) {
+		fastPort := listen(t, ip)
+		slowPort := listen(t, ip)
+
+		slow := netip.MustParseAddr("127.0.0.2")
+		canceledCh := make(chan unit)
+
+		f := NewFastestAddr()
+		f.PingWaitTimeout = pingTCPTimeout
+		f.pingPorts = []uint{fastPort, slowPort}
+		f.pinger.ControlContext = func(
+			ctx context.Context,
+			_ string,
+			address string,
+			_ syscall.RawConn,
+		) (err error) {
+			if netip.MustParseAddrPort(address).Addr() != slow {
+				return nil
+			}
+
+			<-ctx.Done()
+			canceledCh <- unit{}
+
+			return ctx.Err()
+		}
+
+		res := f.pingAll(context.Background(), "", []netip.Addr{slow, ip})
+		require.NotNil(t, res)
+
+		assert.Equal(t, ip, res.addrPort.Addr())
+
+		// Both dials of the slow address must be canceled as soon as the fast
+		// one succeeds.
+		for range f.pingPorts {
+			testutil.RequireReceive(t, canceledCh, testTimeout)
+		}
+
+		assertCaching(t, f, ip, 0)
+		assert.Never(t, func() bool {
+			return f.cacheFind(slow) != nil
+		}, testTimeout/10, testTimeout/100)
+	})
+
 	t.Run("zero", func(t *testing.T) {
-		res := NewFastestAddr().pingAll("", nil)
+		res := NewFastestAddr().pingAll(context.Background(), "", nil)
 		require.Nil(t, res)
 	})
 
@@ -211,7 +258,7 @@ func TestFastestAddr_PingAll(t *testing.T) {
 		f := NewFastestAddr()
 		f.pingPorts = []uint{port}
 
-		res := f.pingAll("test", []netip.Addr{ip, ip})
+		res := f.pingAll(context.Background(), "test", []netip.Addr{ip, ip})
 		require.Nil(t, res)
 
 		assertCaching(t, f, ip, 1)
@@ -239,3 +286,178 @@ func getFreePort(t *testing.T) (port uint) {
 
 	return port
 }
+
+// testProber is a [Prober] for tests.
+type testProber struct {
+	onProbe func(host string, addrPort netip.AddrPort) (latency time.Duration, err error)
+}
+
+// type check
+var _ Prober = (*testProber)(nil)
+
+// Probe implements the [Prober] interface for *testProber.
+func (p *testProber) Probe(
+	_ context.Context,
+	host string,
+	addrPort netip.AddrPort,
+) (latency time.Duration, err error) {
+	return p.onProbe(host, addrPort)
+}
+
+func TestFastestAddr_PingAll_prober(t *testing.T) {
+	ip1 := netip.MustParseAddr("192.0.2.1")
+	ip2 := netip.MustParseAddr("192.0.2.2")
+
+	const host = "example.org."
+
+	f := NewFastestAddr()
+	f.pingPorts = []uint{443}
+	f.Prober = &testProber{
+		onProbe: func(h string, addrPort netip.AddrPort) (latency time.Duration, err error) {
+			assert.Equal(t, host, h)
+			assert.Equal(t, uint16(443), addrPort.Port())
+
+			if addrPort.Addr() == ip1 {
+				return 0, assert.AnError
+			}
+
+			return 10 * time.Millisecond, nil
+		},
+	}
+
+	res := f.pingAll(context.Background(), host, []netip.Addr{ip1, ip2})
+	require.NotNil(t, res)
+
+	assert.True(t, res.success)
+	assert.Equal(t, ip2, res.addrPort.Addr())
+	assert.Equal(t, uint(10), res.latency)
+
+	assertCaching(t, f, ip2, 0)
+}
+
+func TestFastestAddr_PingAll_preferIPv6(t *testing.T) {
+	const host = "example.org."
+
+	ip4 := netip.MustParseAddr("192.0.2.1")
+	ip6 := netip.MustParseAddr("2001:db8::1")
+	ips := []netip.Addr{ip4, ip6}
+
+	testCases := []struct {
+		want   netip.Addr
+		name   string
+		within time.Duration
+		lat6   time.Duration
+	}{{
+		want:   ip4,
+		name:   "disabled",
+		within: 0,
+		lat6:   11 * time.Millisecond,
+	}, {
+		want:   ip6,
+		name:   "within",
+		within: 2 * time.Millisecond,
+		lat6:   11 * time.Millisecond,
+	}, {
+		want:   ip4,
+		name:   "beyond",
+		within: 2 * time.Millisecond,
+		lat6:   13 * time.Millisecond,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := NewTestFastestAddr(map[netip.Addr]time.Duration{
+				ip4: 10 * time.Millisecond,
+				ip6: tc.lat6,
+			})
+			f.PingMode = PingModeICMP
+			f.PreferIPv6Within = tc.within
+
+			// The second time, both results are taken from the cache.
+			for range 2 {
+				res := f.pingAll(context.Background(), host, ips)
+				require.NotNil(t, res)
+
+				assert.Equal(t, tc.want, res.addrPort.Addr())
+			}
+		})
+	}
+}
+
+func TestFastestAddr_waitIPv6Res(t *testing.T) {
+	f := NewFastestAddr()
+	f.PreferIPv6Within = testTimeout
+
+	res4 := &pingResult{
+		addrPort: netip.MustParseAddrPort("192.0.2.1:443"),
+		success:  true,
+	}
+	res6 := &pingResult{
+		addrPort: netip.MustParseAddrPort("[2001:db8::1]:443"),
+		success:  true,
+	}
+	failed6 := &pingResult{
+		addrPort: netip.MustParseAddrPort("[2001:db8::2]:443"),
+	}
+
+	t.Run("ipv6", func(t *testing.T) {
+		resCh := make(chan *pingResult, 2)
+		resCh <- failed6
+		resCh <- res6
+
+		pr := f.waitIPv6Res(context.Background(), resCh, "", res4)
+		assert.Same(t, res6, pr)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		resCh := make(chan *pingResult, 1)
+		resCh <- failed6
+
+		pr := f.waitIPv6Res(ctx, resCh, "", res4)
+		assert.Same(t, res4, pr)
+	})
+}
+
+func TestFastestAddr_portsFor(t *testing.T) {
+	f := NewFastestAddr()
+	f.PortsByDomain = map[string][]uint16{
+		"example.com":       {8080},
+		"*.example.com":     {8443},
+		"*.sub.example.com": {9443, 9444},
+	}
+
+	testCases := []struct {
+		name string
+		host string
+		want []uint
+	}{{
+		name: "exact",
+		host: "example.com.",
+		want: []uint{8080},
+	}, {
+		name: "wildcard",
+		host: "a.b.example.com.",
+		want: []uint{8443},
+	}, {
+		name: "closer_wildcard",
+		host: "a.sub.example.com.",
+		want: []uint{9443, 9444},
+	}, {
+		name: "wildcard_parent",
+		host: "sub.example.com.",
+		want: []uint{8443},
+	}, {
+		name: "default",
+		host: "example.org.",
+		want: []uint{80, 443},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, f.portsFor(tc.host))
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package fastip
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Prober checks the reachability of an address.
+type Prober interface {
+	// Probe checks if addrPort, resolved for host, is reachable and returns
+	// the time it took.  host is the lowercased FQDN of the request.  ctx is
+	// canceled when the result isn't needed anymore.  It must be safe for
+	// concurrent use.
+	Probe(ctx context.Context, host string, addrPort netip.AddrPort) (latency time.Duration, err error)
+}
+
+// TCPProber is a [Prober] that dials the TCP port of the address.  It's the
+// default one.
+type TCPProber struct {
+	// Dialer is used to dial the address.  It must not be nil.
+	Dialer *net.Dialer
+
+	// TLSPorts are the ports to complete the TLS handshake on, if ProbeTLS is
+	// true.  If empty, it's only port 443.
+	TLSPorts []uint16
+
+	// ProbeTLS makes the prober also complete the TLS handshake with the
+	// server name set to the host on TLSPorts, and measure the latency
+	// including it.  The bare TCP connection doesn't prove the server actually
+	// serves HTTPS, since middleboxes may accept it and reset it later.  The
+	// certificate of the server isn't verified, only the handshake itself.
+	// Other ports are only dialed.
+	ProbeTLS bool
+}
+
+// type check
+var _ Prober = (*TCPProber)(nil)
+
+// Probe implements the [Prober] interface for *TCPProber.
+func (p *TCPProber) Probe(
+	ctx context.Context,
+	host string,
+	addrPort netip.AddrPort,
+) (latency time.Duration, err error) {
+	log.Debug("fastip: probe: %s: connecting to %s", host, addrPort)
+
+	start := time.Now()
+	conn, err := p.Dialer.DialContext(ctx, "tcp", addrPort.String())
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return time.Since(start), err
+	}
+
+	if p.isTLSPort(addrPort.Port()) {
+		conn, err = handshakeTLS(ctx, conn, host)
+	}
+	latency = time.Since(start)
+
+	if cErr := conn.Close(); cErr != nil {
+		log.Debug("fastip: closing tcp connection: %s", cErr)
+	}
+
+	// Don't wrap the error since it's informative enough as is.
+	return latency, err
+}
+
+// isTLSPort returns true if the TLS handshake should be completed on port.
+func (p *TCPProber) isTLSPort(port uint16) (ok bool) {
+	if !p.ProbeTLS {
+		return false
+	} else if len(p.TLSPorts) == 0 {
+		return port == 443
+	}
+
+	return slices.Contains(p.TLSPorts, port)
+}
+
+// handshakeTLS completes the TLS handshake over conn with the server name set
+// to host, if it's not empty.  tlsConn is the connection to close, even if err
+// is not nil.
+func handshakeTLS(ctx context.Context, conn net.Conn, host string) (tlsConn net.Conn, err error) {
+	c := tls.Client(conn, &tls.Config{
+		ServerName: strings.TrimSuffix(host, "."),
+		// #nosec G402 -- Only the ability to complete the handshake is checked,
+		// the connection isn't used to transfer any data.
+		InsecureSkipVerify: true,
+	})
+
+	err = c.HandshakeContext(ctx)
+	if err != nil {
+		return c, fmt.Errorf("tls handshake: %w", err)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,75 @@
+package fastip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPProber_Probe_tls(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+
+	tlsAddr := netip.MustParseAddrPort(srv.Listener.Addr().String())
+
+	// resetter imitates a middlebox accepting the connections and resetting
+	// them right away.
+	resetter, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, resetter.Close)
+
+	go func() {
+		for {
+			conn, aErr := resetter.Accept()
+			if aErr != nil {
+				return
+			}
+
+			_ = conn.Close()
+		}
+	}()
+
+	resetAddr := netip.MustParseAddrPort(resetter.Addr().String())
+
+	ctx := context.Background()
+
+	t.Run("tcp", func(t *testing.T) {
+		p := &TCPProber{Dialer: &net.Dialer{}}
+
+		_, pErr := p.Probe(ctx, "example.org.", resetAddr)
+		assert.NoError(t, pErr)
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		p := &TCPProber{
+			Dialer:   &net.Dialer{},
+			TLSPorts: []uint16{tlsAddr.Port(), resetAddr.Port()},
+			ProbeTLS: true,
+		}
+
+		latency, pErr := p.Probe(ctx, "example.org.", tlsAddr)
+		require.NoError(t, pErr)
+
+		assert.Positive(t, latency)
+
+		_, pErr = p.Probe(ctx, "example.org.", resetAddr)
+		assert.Error(t, pErr)
+	})
+
+	t.Run("other_port", func(t *testing.T) {
+		p := &TCPProber{
+			Dialer:   &net.Dialer{},
+			ProbeTLS: true,
+		}
+
+		_, pErr := p.Probe(ctx, "example.org.", resetAddr)
+		assert.NoError(t, pErr)
+	})
+}
@@ -0,0 +1,318 @@
+package fastip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/maps"
+)
+
+// DefaultMetricsMaxHosts is the default maximum number of the hosts and the
+// addresses [PrometheusMetrics] keep the separate series for.
+const DefaultMetricsMaxHosts = 1000
+
+// metricsNamespace is the prefix of the names of the metrics.
+const metricsNamespace = "dnsproxy_fastip_"
+
+// latencyBuckets are the upper bounds of the buckets of the ping latency
+// histograms in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// histogram is a cumulative histogram of the ping latencies.
+type histogram struct {
+	// counts are the numbers of the observations falling into each of
+	// [latencyBuckets].  They aren't cumulative.
+	counts []uint64
+
+	// sum is the sum of all the observations in seconds.
+	sum float64
+
+	// count is the number of all the observations.
+	count uint64
+}
+
+// observe adds the observation v in seconds to h.
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+
+	if i, _ := slices.BinarySearch(latencyBuckets, v); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+
+	h.sum += v
+	h.count++
+}
+
+// hostMetrics are the metrics of the fastest address selection for a single
+// host or for all of them.
+type hostMetrics struct {
+	latency   histogram
+	failures  uint64
+	hits      uint64
+	misses    uint64
+	scheduled uint64
+}
+
+// PrometheusMetrics is the implementation of the [Metrics] interface, which
+// serves the collected metrics over HTTP in the Prometheus text format.  Along
+// with the aggregated metrics, it keeps the separate series for each host and
+// the failure counters for each address, up to a limit, since the number of
+// the hosts isn't bounded.
+type PrometheusMetrics struct {
+	// mu protects all the fields below.
+	mu *sync.Mutex
+
+	// total are the aggregated metrics.
+	total *hostMetrics
+
+	// hosts are the metrics of each host.
+	hosts map[string]*hostMetrics
+
+	// addrFailures are the numbers of the failed pings of each address.
+	addrFailures map[netip.Addr]uint64
+
+	// maxHosts is the maximum number of the elements in hosts and
+	// addrFailures each.
+	maxHosts int
+}
+
+// NewPrometheusMetrics returns a new properly initialized *PrometheusMetrics.
+// maxHosts is the maximum number of the hosts and the addresses to keep the
+// separate series for, the ones observed after reaching it only contribute to
+// the aggregated metrics.  If maxHosts is negative, [DefaultMetricsMaxHosts] is
+// used.  If it's zero, only the aggregated metrics are collected.
+func NewPrometheusMetrics(maxHosts int) (m *PrometheusMetrics) {
+	if maxHosts < 0 {
+		maxHosts = DefaultMetricsMaxHosts
+	}
+
+	return &PrometheusMetrics{
+		mu:           &sync.Mutex{},
+		total:        &hostMetrics{},
+		hosts:        map[string]*hostMetrics{},
+		addrFailures: map[netip.Addr]uint64{},
+		maxHosts:     maxHosts,
+	}
+}
+
+// hostLocked returns the metrics of host, or nil if the limit is reached or
+// host is empty.  m.mu must be locked.
+func (m *PrometheusMetrics) hostLocked(host string) (hm *hostMetrics) {
+	if host == "" {
+		return nil
+	}
+
+	hm, ok := m.hosts[host]
+	if !ok && len(m.hosts) < m.maxHosts {
+		hm = &hostMetrics{}
+		m.hosts[host] = hm
+	}
+
+	return hm
+}
+
+// type check
+var _ Metrics = (*PrometheusMetrics)(nil)
+
+// ObserveCacheLookup implements the [Metrics] interface for
+// *PrometheusMetrics.
+func (m *PrometheusMetrics) ObserveCacheLookup(host string, hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, hm := range []*hostMetrics{m.total, m.hostLocked(host)} {
+		if hm == nil {
+			continue
+		} else if hit {
+			hm.hits++
+		} else {
+			hm.misses++
+		}
+	}
+}
+
+// ObservePingsScheduled implements the [Metrics] interface for
+// *PrometheusMetrics.
+func (m *PrometheusMetrics) ObservePingsScheduled(host string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.total.scheduled += uint64(n)
+	if hm := m.hostLocked(host); hm != nil {
+		hm.scheduled += uint64(n)
+	}
+}
+
+// ObservePing implements the [Metrics] interface for *PrometheusMetrics.
+func (m *PrometheusMetrics) ObservePing(
+	host string,
+	addr netip.Addr,
+	latency time.Duration,
+	ok bool,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !ok {
+		_, known := m.addrFailures[addr]
+		if known || len(m.addrFailures) < m.maxHosts {
+			m.addrFailures[addr]++
+		}
+	}
+
+	for _, hm := range []*hostMetrics{m.total, m.hostLocked(host)} {
+		if hm == nil {
+			continue
+		} else if ok {
+			hm.latency.observe(latency.Seconds())
+		} else {
+			hm.failures++
+		}
+	}
+}
+
+// type check
+var _ http.Handler = (*PrometheusMetrics)(nil)
+
+// ServeHTTP implements the [http.Handler] interface for *PrometheusMetrics.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	err := m.WriteText(w)
+	if err != nil {
+		log.Debug("fastip: writing metrics: %s", err)
+	}
+}
+
+// WriteText writes the collected metrics to w in the Prometheus text format.
+func (m *PrometheusMetrics) WriteText(w io.Writer) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	hosts := maps.Keys(m.hosts)
+	slices.Sort(hosts)
+
+	writeHistogram(bw, "ping_duration_seconds", "Latency of the successful pings.", "", m.total)
+	writeCounter(bw, "ping_failures_total", "Number of the failed pings.", "", m.total.failures)
+	writeCounter(bw, "cache_hits_total", "Number of the addresses found in the cache.", "", m.total.hits)
+	writeCounter(bw, "cache_misses_total", "Number of the addresses missing from the cache.", "", m.total.misses)
+	writeCounter(bw, "pings_scheduled_total", "Number of the scheduled pings.", "", m.total.scheduled)
+
+	writeHeader(bw, "host_ping_duration_seconds", "Latency of the successful pings by host.", "histogram")
+	for _, host := range hosts {
+		writeHistogram(bw, "host_ping_duration_seconds", "", labelPair("host", host), m.hosts[host])
+	}
+
+	for _, c := range []struct {
+		get  func(hm *hostMetrics) (v uint64)
+		name string
+		help string
+	}{{
+		get:  func(hm *hostMetrics) (v uint64) { return hm.failures },
+		name: "host_ping_failures_total",
+		help: "Number of the failed pings by host.",
+	}, {
+		get:  func(hm *hostMetrics) (v uint64) { return hm.hits },
+		name: "host_cache_hits_total",
+		help: "Number of the addresses found in the cache by host.",
+	}, {
+		get:  func(hm *hostMetrics) (v uint64) { return hm.misses },
+		name: "host_cache_misses_total",
+		help: "Number of the addresses missing from the cache by host.",
+	}, {
+		get:  func(hm *hostMetrics) (v uint64) { return hm.scheduled },
+		name: "host_pings_scheduled_total",
+		help: "Number of the scheduled pings by host.",
+	}} {
+		writeHeader(bw, c.name, c.help, "counter")
+		for _, host := range hosts {
+			writeCounter(bw, c.name, "", labelPair("host", host), c.get(m.hosts[host]))
+		}
+	}
+
+	addrs := maps.Keys(m.addrFailures)
+	slices.SortFunc(addrs, netip.Addr.Compare)
+
+	writeHeader(bw, "addr_ping_failures_total", "Number of the failed pings by address.", "counter")
+	for _, addr := range addrs {
+		writeCounter(bw, "addr_ping_failures_total", "", labelPair("addr", addr.String()), m.addrFailures[addr])
+	}
+
+	return bw.Flush()
+}
+
+// writeHeader writes the HELP and TYPE lines of the metric with name to w.
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s%s %s\n", metricsNamespace, name, help)
+	_, _ = fmt.Fprintf(w, "# TYPE %s%s %s\n", metricsNamespace, name, typ)
+}
+
+// writeCounter writes the counter with name, labels, and value v to w.  The
+// header is only written if help isn't empty.
+func writeCounter(w *bufio.Writer, name, help, labels string, v uint64) {
+	if help != "" {
+		writeHeader(w, name, help, "counter")
+	}
+
+	_, _ = fmt.Fprintf(w, "%s%s%s %d\n", metricsNamespace, name, braced(labels), v)
+}
+
+// writeHistogram writes the latency histogram of hm with name and labels to w.
+// The header is only written if help isn't empty.
+func writeHistogram(w *bufio.Writer, name, help, labels string, hm *hostMetrics) {
+	if help != "" {
+		writeHeader(w, name, help, "histogram")
+	}
+
+	h := &hm.latency
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	var cum uint64
+	for i, le := range latencyBuckets {
+		if h.counts != nil {
+			cum += h.counts[i]
+		}
+
+		le := strconv.FormatFloat(le, 'g', -1, 64)
+		_, _ = fmt.Fprintf(w, "%s%s_bucket{%s%sle=%q} %d\n", metricsNamespace, name, labels, sep, le, cum)
+	}
+
+	_, _ = fmt.Fprintf(w, "%s%s_bucket{%s%sle=\"+Inf\"} %d\n", metricsNamespace, name, labels, sep, h.count)
+	_, _ = fmt.Fprintf(w, "%s%s_sum%s %g\n", metricsNamespace, name, braced(labels), h.sum)
+	_, _ = fmt.Fprintf(w, "%s%s_count%s %d\n", metricsNamespace, name, braced(labels), h.count)
+}
+
+// labelValueReplacer escapes the label values as required by the Prometheus
+// text format.
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPair returns the label with name and value formatted for the Prometheus
+// text format.
+func labelPair(name, value string) (s string) {
+	return name + `="` + labelValueReplacer.Replace(value) + `"`
+}
+
+// braced returns labels in braces, or an empty string if there are none.
+func braced(labels string) (s string) {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels + "}"
+}
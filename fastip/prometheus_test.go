@@ -0,0 +1,92 @@
+package fastip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	const host = "example.org."
+
+	fast := netip.MustParseAddr("192.0.2.1")
+	dead := netip.MustParseAddr("192.0.2.2")
+	ips := []netip.Addr{dead, fast}
+
+	t.Run("per_host", func(t *testing.T) {
+		m := NewPrometheusMetrics(-1)
+
+		f := NewTestFastestAddr(map[netip.Addr]time.Duration{fast: 10 * time.Millisecond})
+		f.PingMode = PingModeICMP
+		f.Metrics = m
+
+		// The second time, both results are taken from the cache.
+		for range 2 {
+			res := f.pingAll(context.Background(), host, ips)
+			require.NotNil(t, res)
+
+			assert.Equal(t, fast, res.addrPort.Addr())
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		rw := httptest.NewRecorder()
+		m.ServeHTTP(rw, r)
+		require.Equal(t, http.StatusOK, rw.Code)
+
+		assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rw.Header().Get("Content-Type"))
+
+		body := rw.Body.String()
+		for _, line := range []string{
+			`dnsproxy_fastip_ping_duration_seconds_bucket{le="0.005"} 0`,
+			`dnsproxy_fastip_ping_duration_seconds_bucket{le="0.01"} 1`,
+			`dnsproxy_fastip_ping_duration_seconds_bucket{le="+Inf"} 1`,
+			`dnsproxy_fastip_ping_duration_seconds_sum 0.01`,
+			`dnsproxy_fastip_ping_duration_seconds_count 1`,
+			`dnsproxy_fastip_ping_failures_total 1`,
+			`dnsproxy_fastip_cache_hits_total 2`,
+			`dnsproxy_fastip_cache_misses_total 2`,
+			`dnsproxy_fastip_pings_scheduled_total 2`,
+			`dnsproxy_fastip_host_ping_duration_seconds_bucket{host="example.org.",le="0.01"} 1`,
+			`dnsproxy_fastip_host_ping_duration_seconds_count{host="example.org."} 1`,
+			`dnsproxy_fastip_host_ping_failures_total{host="example.org."} 1`,
+			`dnsproxy_fastip_host_cache_hits_total{host="example.org."} 2`,
+			`dnsproxy_fastip_host_cache_misses_total{host="example.org."} 2`,
+			`dnsproxy_fastip_host_pings_scheduled_total{host="example.org."} 2`,
+			`dnsproxy_fastip_addr_ping_failures_total{addr="192.0.2.2"} 1`,
+		} {
+			assert.Contains(t, body, line+"\n")
+		}
+	})
+
+	t.Run("aggregated_only", func(t *testing.T) {
+		m := NewPrometheusMetrics(0)
+		m.ObservePing(host, dead, 0, false)
+		m.ObserveCacheLookup(host, false)
+
+		b := &strings.Builder{}
+		require.NoError(t, m.WriteText(b))
+
+		assert.Contains(t, b.String(), "dnsproxy_fastip_ping_failures_total 1\n")
+		assert.Contains(t, b.String(), "dnsproxy_fastip_cache_misses_total 1\n")
+		assert.NotContains(t, b.String(), host)
+		assert.NotContains(t, b.String(), dead.String())
+	})
+
+	t.Run("escaping", func(t *testing.T) {
+		m := NewPrometheusMetrics(-1)
+		m.ObservePingsScheduled("bad\"host\\\n", 1)
+
+		b := &strings.Builder{}
+		require.NoError(t, m.WriteText(b))
+
+		want := `dnsproxy_fastip_host_pings_scheduled_total{host="bad\"host\\\n"} 1` + "\n"
+		assert.Contains(t, b.String(), want)
+	})
+}
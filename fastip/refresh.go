@@ -0,0 +1,208 @@
+package fastip
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// DefaultRefreshConcurrency is the default maximum number of the addresses
+// re-pinged at once, see [FastestAddr.RefreshConcurrency].
+const DefaultRefreshConcurrency = 16
+
+// Start starts re-pinging the cached addresses in background each
+// RefreshInterval, so that the entries of the addresses in use are replaced
+// before they expire and the fastest address is always chosen from the cache.
+// Only the addresses found in the cache since they were last pinged are
+// re-pinged.  It does nothing if RefreshInterval isn't positive.  Start and
+// [FastestAddr.Close] must not be called concurrently.
+func (f *FastestAddr) Start() {
+	if f.RefreshInterval <= 0 || f.refreshCancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.refreshCancel = cancel
+	f.refreshDone = make(chan struct{})
+
+	go f.refreshLoop(ctx, f.refreshDone)
+}
+
+// Close stops re-pinging the cached addresses and waits for the pings in
+// progress to finish.  It does nothing if re-pinging isn't started.  It always
+// returns nil.
+func (f *FastestAddr) Close() (err error) {
+	if f.refreshCancel == nil {
+		return nil
+	}
+
+	f.refreshCancel()
+	<-f.refreshDone
+
+	f.refreshCancel, f.refreshDone = nil, nil
+
+	return nil
+}
+
+// refreshLoop re-pings the cached addresses each RefreshInterval until ctx is
+// canceled, after which it closes done.  It's intended to be used as a
+// goroutine.
+func (f *FastestAddr) refreshLoop(ctx context.Context, done chan<- struct{}) {
+	defer log.OnPanic("fastip: refreshing")
+	defer close(done)
+
+	ticker := time.NewTicker(f.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.refresh(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh re-pings the addresses which cache entries expire within
+// RefreshInterval and have been used since they were cached, at most
+// RefreshConcurrency of them at once.
+func (f *FastestAddr) refresh(ctx context.Context) {
+	hosts := f.refreshCandidates(time.Now().Add(f.RefreshInterval))
+	if len(hosts) == 0 {
+		return
+	}
+
+	log.Debug("fastip: refreshing %d addresses", len(hosts))
+
+	concurrency := f.RefreshConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultRefreshConcurrency
+	}
+
+	sema := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	for ip, host := range hosts {
+		if f.isTestMode() {
+			f.refreshAddr(ctx, ip, host)
+
+			continue
+		}
+
+		select {
+		case sema <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer log.OnPanic("fastip: refreshing address")
+			defer wg.Done()
+			defer func() { <-sema }()
+
+			f.refreshAddr(ctx, ip, host)
+		}()
+	}
+}
+
+// refreshCandidates returns the addresses which cache entries expire before
+// deadline and have been found in the cache since they were added, mapped to
+// the hosts they were last found for.
+func (f *FastestAddr) refreshCandidates(deadline time.Time) (hosts map[netip.Addr]string) {
+	f.ipCacheLock.Lock()
+	defer f.ipCacheLock.Unlock()
+
+	hosts = map[netip.Addr]string{}
+	for ip, host := range f.ipCacheHits {
+		val := f.ipCache.Get(ip.AsSlice())
+		if val == nil || unpackCacheEntry(val) == nil {
+			// The expired entry is pinged again once requested, so there is
+			// no need to track it.
+			delete(f.ipCacheHits, ip)
+		} else if time.Unix(int64(binary.BigEndian.Uint32(val)), 0).Before(deadline) {
+			hosts[ip] = host
+		}
+	}
+
+	return hosts
+}
+
+// refreshAddr pings ip, which was last found in the cache for host, and
+// replaces its cache entry with the result.  The entry is left as is if no ping
+// succeeded within PingWaitTimeout and not all of them failed.
+func (f *FastestAddr) refreshAddr(ctx context.Context, ip netip.Addr, host string) {
+	ctx, cancel := context.WithTimeout(ctx, f.PingWaitTimeout)
+	defer cancel()
+
+	ports := f.portsFor(host)
+	n := f.pingsPerAddr(ports)
+	resCh := make(chan *pingResult, n)
+
+	f.Metrics.ObservePingsScheduled(host, n)
+	f.schedulePing(ctx, resCh, ip, host, ports)
+
+	var ent *cacheEntry
+	if f.isTestMode() {
+		ent = f.refreshTestRes(resCh, n)
+	} else {
+		ent = refreshRes(ctx, resCh, n)
+	}
+
+	if ent == nil {
+		log.Debug("fastip: refreshing %s: no result", ip)
+
+		return
+	}
+
+	f.ipCacheLock.Lock()
+	defer f.ipCacheLock.Unlock()
+
+	f.cacheAdd(ent, ip, fastestAddrCacheTTLSec)
+}
+
+// refreshRes returns the cache entry for the first successful result of the n
+// pings from resCh, the failed entry if all of them failed, or nil if ctx is
+// done before either.
+func refreshRes(ctx context.Context, resCh chan *pingResult, n int) (ent *cacheEntry) {
+	for range n {
+		select {
+		case res := <-resCh:
+			if res.success {
+				return &cacheEntry{latencyMsec: res.latency}
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	return &cacheEntry{status: 1}
+}
+
+// refreshTestRes is the version of [refreshRes] used in the test mode, where
+// resCh contains the results of all the n pings and the ones with the latency
+// exceeding the wait timeout are considered timed out.
+func (f *FastestAddr) refreshTestRes(resCh chan *pingResult, n int) (ent *cacheEntry) {
+	timeout := uint(f.PingWaitTimeout.Milliseconds())
+	failed := 0
+	for range n {
+		res := <-resCh
+		if !res.success {
+			failed++
+		} else if res.latency <= timeout && (ent == nil || res.latency < ent.latencyMsec) {
+			ent = &cacheEntry{latencyMsec: res.latency}
+		}
+	}
+
+	if ent == nil && failed == n {
+		ent = &cacheEntry{status: 1}
+	}
+
+	return ent
+}
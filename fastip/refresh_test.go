@@ -0,0 +1,86 @@
+package fastip
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFastestAddr_refresh(t *testing.T) {
+	const host = "example.org."
+
+	used := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("192.0.2.2")
+	unused := netip.MustParseAddr("192.0.2.3")
+
+	f := NewTestFastestAddr(map[netip.Addr]time.Duration{
+		used:   10 * time.Millisecond,
+		other:  20 * time.Millisecond,
+		unused: 30 * time.Millisecond,
+	})
+	f.RefreshInterval = time.Minute
+
+	ctx := context.Background()
+
+	require.NotNil(t, f.pingAll(ctx, host, []netip.Addr{used, other}))
+	require.NotNil(t, f.pingAll(ctx, host, []netip.Addr{unused, other}))
+
+	// Only the addresses found in the cache since they were pinged are
+	// refreshed.
+	require.NotNil(t, f.pingAll(ctx, host, []netip.Addr{used, other}))
+
+	// The entries don't expire within the interval yet.
+	assert.Empty(t, f.refreshCandidates(time.Now().Add(f.RefreshInterval)))
+
+	deadline := time.Now().Add(fastestAddrCacheTTLSec * time.Second)
+	assert.Equal(t, map[netip.Addr]string{
+		used:  host,
+		other: host,
+	}, f.refreshCandidates(deadline))
+
+	f.testLatencies[used] = 5 * time.Millisecond
+	delete(f.testLatencies, other)
+
+	f.RefreshInterval = fastestAddrCacheTTLSec * time.Second
+	f.refresh(ctx)
+
+	ent := f.cacheFind(used)
+	require.NotNil(t, ent)
+
+	assert.Equal(t, 0, ent.status)
+	assert.Equal(t, uint(5), ent.latencyMsec)
+
+	ent = f.cacheFind(other)
+	require.NotNil(t, ent)
+
+	assert.Equal(t, 1, ent.status)
+
+	ent = f.cacheFind(unused)
+	require.NotNil(t, ent)
+
+	assert.Equal(t, uint(30), ent.latencyMsec)
+
+	// The refreshed entries need to be used again to be refreshed.
+	assert.Empty(t, f.refreshCandidates(deadline.Add(time.Minute)))
+}
+
+func TestFastestAddr_Start(t *testing.T) {
+	f := NewTestFastestAddr(nil)
+
+	f.Start()
+	assert.Nil(t, f.refreshCancel)
+	require.NoError(t, f.Close())
+
+	f.RefreshInterval = time.Millisecond
+
+	f.Start()
+	assert.NotNil(t, f.refreshCancel)
+	require.NoError(t, f.Close())
+
+	assert.Nil(t, f.refreshCancel)
+	require.NoError(t, f.Close())
+}
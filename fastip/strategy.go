@@ -0,0 +1,175 @@
+package fastip
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"time"
+)
+
+// DefaultStrategyWindow is the default value of [FastestAddr.StrategyWindow].
+const DefaultStrategyWindow = 20 * time.Millisecond
+
+// Strategy defines how the address is chosen among the pinged ones.
+type Strategy uint8
+
+const (
+	// StrategyFastest chooses the address with the lowest latency.
+	StrategyFastest Strategy = iota
+
+	// StrategyWeightedRandom randomly chooses one of the addresses with the
+	// latency within [FastestAddr.StrategyWindow] of the lowest one, the
+	// faster addresses are chosen more often.  It distributes the load among
+	// the addresses, which are almost equally fast.
+	StrategyWeightedRandom
+
+	// StrategyLowestLoss chooses the address with the lowest ratio of the
+	// failed pings among the ones with the latency within
+	// [FastestAddr.StrategyWindow] of the lowest one, the ties are resolved in
+	// favor of the faster address.
+	StrategyLowestLoss
+)
+
+// String implements the [fmt.Stringer] interface for Strategy.
+func (s Strategy) String() (str string) {
+	switch s {
+	case StrategyFastest:
+		return "fastest"
+	case StrategyWeightedRandom:
+		return "weighted_random"
+	case StrategyLowestLoss:
+		return "lowest_loss"
+	default:
+		return fmt.Sprintf("!bad_strategy_%d", uint8(s))
+	}
+}
+
+// ParseStrategy parses the strategy from its string representation as
+// returned by [Strategy.String].
+func ParseStrategy(str string) (s Strategy, err error) {
+	for s = StrategyFastest; s <= StrategyLowestLoss; s++ {
+		if s.String() == str {
+			return s, nil
+		}
+	}
+
+	return StrategyFastest, fmt.Errorf("unknown strategy %q", str)
+}
+
+// pingStat is the statistics of the pings of a single address.
+type pingStat struct {
+	total  uint
+	failed uint
+}
+
+// lossRatio returns the ratio of the failed pings.
+func (s *pingStat) lossRatio() (r float64) {
+	if s == nil || s.total == 0 {
+		return 0
+	}
+
+	return float64(s.failed) / float64(s.total)
+}
+
+// statsAdd records the result of a ping of ip.
+func (f *FastestAddr) statsAdd(ip netip.Addr, success bool) {
+	f.ipCacheLock.Lock()
+	defer f.ipCacheLock.Unlock()
+
+	s := f.pingStats[ip]
+	if s == nil {
+		s = &pingStat{}
+		f.pingStats[ip] = s
+	}
+
+	s.total++
+	if !success {
+		s.failed++
+	}
+}
+
+// choose returns the result chosen among the successful results cands
+// according to f.Strategy, or nil if cands is empty.  The latencies are
+// compared accounting for f.PreferIPv6Within, and the ties are resolved in
+// favor of the result that goes first in cands.
+func (f *FastestAddr) choose(cands []*pingResult) (res *pingResult) {
+	for _, c := range cands {
+		if res == nil || f.faster(c, res) {
+			res = c
+		}
+	}
+
+	if res == nil || f.Strategy == StrategyFastest {
+		return res
+	}
+
+	limit := f.rankLatency(res) + uint(f.StrategyWindow.Milliseconds())
+	near := make([]*pingResult, 0, len(cands))
+	indices := map[netip.Addr]int{}
+	for _, c := range cands {
+		if f.rankLatency(c) > limit {
+			continue
+		}
+
+		// The same address may be reached on several ports, so only keep its
+		// fastest result.
+		addr := c.addrPort.Addr()
+		if i, ok := indices[addr]; !ok {
+			indices[addr] = len(near)
+			near = append(near, c)
+		} else if c.latency < near[i].latency {
+			near[i] = c
+		}
+	}
+
+	switch f.Strategy {
+	case StrategyWeightedRandom:
+		return f.weightedRandom(near)
+	case StrategyLowestLoss:
+		return f.lowestLoss(near)
+	default:
+		return res
+	}
+}
+
+// weightedRandom returns a random result from cands, which must not be empty,
+// with the probability inversely proportional to its latency.
+func (f *FastestAddr) weightedRandom(cands []*pingResult) (res *pingResult) {
+	weights := make([]float64, len(cands))
+	sum := 0.0
+	for i, c := range cands {
+		// Add a millisecond to avoid dividing by zero.
+		weights[i] = 1 / float64(f.rankLatency(c)+1)
+		sum += weights[i]
+	}
+
+	// #nosec G404 -- The choice doesn't need to be cryptographically secure.
+	r := rand.Float64() * sum
+	for i, w := range weights {
+		if r < w {
+			return cands[i]
+		}
+
+		r -= w
+	}
+
+	return cands[len(cands)-1]
+}
+
+// lowestLoss returns the result from cands, which must not be empty, with the
+// lowest ratio of the failed pings of its address, the ties are resolved in
+// favor of the lower latency.
+func (f *FastestAddr) lowestLoss(cands []*pingResult) (res *pingResult) {
+	f.ipCacheLock.Lock()
+	defer f.ipCacheLock.Unlock()
+
+	var resLoss float64
+	for _, c := range cands {
+		loss := f.pingStats[c.addrPort.Addr().Unmap()].lossRatio()
+		if res == nil || loss < resLoss || (loss == resLoss && f.faster(c, res)) {
+			res, resLoss = c, loss
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,87 @@
+package fastip
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFastestAddr_choose(t *testing.T) {
+	var (
+		addr1 = netip.MustParseAddr("192.0.2.1")
+		addr2 = netip.MustParseAddr("192.0.2.2")
+		addr3 = netip.MustParseAddr("192.0.2.3")
+	)
+
+	newRes := func(addr netip.Addr, port uint16, latency uint) (res *pingResult) {
+		return &pingResult{
+			addrPort: netip.AddrPortFrom(addr, port),
+			latency:  latency,
+			success:  true,
+		}
+	}
+
+	cands := []*pingResult{
+		newRes(addr1, 80, 15),
+		newRes(addr1, 443, 12),
+		newRes(addr2, 443, 10),
+		newRes(addr3, 443, 100),
+	}
+
+	t.Run("fastest", func(t *testing.T) {
+		f := NewFastestAddr()
+
+		assert.Nil(t, f.choose(nil))
+		assert.Same(t, cands[2], f.choose(cands))
+	})
+
+	t.Run("weighted_random", func(t *testing.T) {
+		f := NewFastestAddr()
+		f.Strategy = StrategyWeightedRandom
+
+		chosen := map[netip.Addr]int{}
+		for range 1000 {
+			res := f.choose(cands)
+			require.NotNil(t, res)
+
+			chosen[res.addrPort.Addr()]++
+		}
+
+		assert.Positive(t, chosen[addr1])
+		assert.Positive(t, chosen[addr2])
+		assert.Zero(t, chosen[addr3])
+	})
+
+	t.Run("lowest_loss", func(t *testing.T) {
+		f := NewFastestAddr()
+		f.Strategy = StrategyLowestLoss
+
+		// Without statistics, the fastest address wins.
+		assert.Same(t, cands[2], f.choose(cands))
+
+		f.statsAdd(addr1, true)
+		f.statsAdd(addr2, true)
+		f.statsAdd(addr2, false)
+		f.statsAdd(addr3, true)
+
+		assert.Same(t, cands[1], f.choose(cands))
+
+		// The slow address is out of the window regardless of its loss.
+		f.StrategyWindow = 0
+		assert.Same(t, cands[2], f.choose(cands))
+	})
+}
+
+func TestParseStrategy(t *testing.T) {
+	for s := StrategyFastest; s <= StrategyLowestLoss; s++ {
+		got, err := ParseStrategy(s.String())
+		require.NoError(t, err)
+
+		assert.Equal(t, s, got)
+	}
+
+	_, err := ParseStrategy("random")
+	assert.Error(t, err)
+}
@@ -0,0 +1,112 @@
+package fastip
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// errTestUnreachable is returned by the pings of the addresses missing from
+// the latencies table in the test mode.
+const errTestUnreachable errors.Error = "unreachable in test mode"
+
+// NewTestFastestAddr returns a new *FastestAddr in the deterministic test mode,
+// which is intended for unit testing the code using the fastest address
+// algorithm.  It doesn't dial anything and instead takes the latency of dialing
+// each address from latencies.  The addresses missing from latencies are
+// considered unreachable.  The upstreams are queried and the addresses are
+// pinged synchronously, in order, and the address is chosen according to
+// Strategy, accounting for PreferIPv6Within, among the ones with the latency
+// not exceeding PingWaitTimeout, the ties are resolved in favor of the address
+// that goes first in the responses.
+// The results are cached the same way as in the normal mode.  latencies is
+// copied.
+func NewTestFastestAddr(latencies map[netip.Addr]time.Duration) (f *FastestAddr) {
+	f = NewFastestAddr()
+	f.testLatencies = maps.Clone(latencies)
+	if f.testLatencies == nil {
+		f.testLatencies = map[netip.Addr]time.Duration{}
+	}
+
+	return f
+}
+
+// isTestMode returns true if f is in the deterministic test mode.
+func (f *FastestAddr) isTestMode() (ok bool) {
+	return f.testLatencies != nil
+}
+
+// pingTest sends the result of the simulated dialing of the specified address
+// into resCh.  It's used in the test mode instead of [FastestAddr.pingDoProbe].
+func (f *FastestAddr) pingTest(
+	ctx context.Context,
+	host string,
+	addrPort netip.AddrPort,
+	resCh chan *pingResult,
+) {
+	var err error
+	latency, ok := f.testLatencies[addrPort.Addr().Unmap()]
+	if !ok {
+		err = errTestUnreachable
+	}
+
+	f.reportPing(ctx, host, addrPort, latency, err, resCh)
+}
+
+// testResults returns the successful ping results with the latency not
+// exceeding the wait timeout from resCh in the order of pinging.  resCh must
+// contain all the results of the scheduled pings.  It's used in the test mode
+// instead of [FastestAddr.collectResults].
+func (f *FastestAddr) testResults(resCh chan *pingResult, host string) (results []*pingResult) {
+	timeout := uint(f.PingWaitTimeout.Milliseconds())
+	for {
+		select {
+		case pr := <-resCh:
+			if pr.success && pr.latency <= timeout {
+				results = append(results, pr)
+			}
+		default:
+			if len(results) == 0 {
+				log.Debug("fastip: pingAll: %s: pinging timed out", host)
+			}
+
+			return results
+		}
+	}
+}
+
+// exchangeAllTest is the synchronous version of [upstream.ExchangeAll] used in
+// the test mode.  The results are in the order of ups.
+func exchangeAllTest(
+	ups []upstream.Upstream,
+	req *dns.Msg,
+) (res []upstream.ExchangeAllResult, err error) {
+	if len(ups) == 0 {
+		return nil, upstream.ErrNoUpstreams
+	}
+
+	var errs []error
+	for _, u := range ups {
+		resp, exchErr := u.Exchange(req.Copy())
+		if exchErr != nil {
+			errs = append(errs, exchErr)
+		} else if resp == nil {
+			errs = append(errs, upstream.ErrNoReply)
+		} else {
+			res = append(res, upstream.ExchangeAllResult{Resp: resp, Upstream: u})
+		}
+	}
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("all upstreams failed: %w", errors.Join(errs...))
+	}
+
+	return res, nil
+}
@@ -0,0 +1,171 @@
+package idn
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// HomoglyphPolicy is the way of handling the requests for domain names mixing
+// several scripts.
+type HomoglyphPolicy uint8
+
+// HomoglyphPolicy values.
+const (
+	// HomoglyphPolicyNone makes the handler ignore the scripts of the names.
+	HomoglyphPolicyNone HomoglyphPolicy = iota
+
+	// HomoglyphPolicyFlag makes the handler log such requests and report
+	// them to [Config.OnFlag].
+	HomoglyphPolicyFlag
+
+	// HomoglyphPolicyBlock makes the handler respond to such requests with
+	// NXDOMAIN.
+	HomoglyphPolicyBlock
+)
+
+// String implements the [fmt.Stringer] interface for HomoglyphPolicy.
+func (p HomoglyphPolicy) String() (s string) {
+	switch p {
+	case HomoglyphPolicyNone:
+		return "none"
+	case HomoglyphPolicyFlag:
+		return "flag"
+	case HomoglyphPolicyBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("!bad_homoglyph_policy_%d", uint8(p))
+	}
+}
+
+// ParseHomoglyphPolicy parses the homoglyph policy from its textual
+// representation.
+func ParseHomoglyphPolicy(s string) (p HomoglyphPolicy, err error) {
+	switch s {
+	case "", "none":
+		return HomoglyphPolicyNone, nil
+	case "flag":
+		return HomoglyphPolicyFlag, nil
+	case "block":
+		return HomoglyphPolicyBlock, nil
+	default:
+		return HomoglyphPolicyNone, fmt.Errorf("unknown homoglyph policy %q", s)
+	}
+}
+
+// Config is the configuration of a [Handler].
+type Config struct {
+	// MessageConstructor is used to build the responses to the blocked
+	// requests.  If nil, the responses are built with plain response codes.
+	MessageConstructor proxy.MessageConstructor
+
+	// OnFlag, if not nil, is called for each request with a name mixing
+	// several scripts, unless the policy is [HomoglyphPolicyNone].  label is
+	// the first offending label in the Unicode form.
+	OnFlag func(dctx *proxy.DNSContext, n Names, label string)
+
+	// Homoglyph is the policy for the names mixing several scripts.
+	Homoglyph HomoglyphPolicy
+}
+
+// Handler normalizes the question names of the requests to the A-label form
+// and applies the homoglyph policy.  It's safe for concurrent use.
+type Handler struct {
+	messages  proxy.MessageConstructor
+	onFlag    func(dctx *proxy.DNSContext, n Names, label string)
+	homoglyph HomoglyphPolicy
+}
+
+// New returns a new properly initialized *Handler.  c must not be nil.
+func New(c *Config) (h *Handler) {
+	return &Handler{
+		messages:  c.MessageConstructor,
+		onFlag:    c.OnFlag,
+		homoglyph: c.Homoglyph,
+	}
+}
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Handler)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Handler.  Question names containing raw non-ASCII characters are replaced
+// with their A-label forms, so that the following handlers and the upstreams
+// only see the ASCII names.  Names that can't be converted are passed as is.
+func (h *Handler) HandleBefore(_ *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	req := dctx.Req
+	if len(req.Question) == 0 {
+		return nil
+	}
+
+	q := &req.Question[0]
+	n, err := Normalize(q.Name)
+	if err != nil {
+		log.Debug("idn: normalizing %q: %s; passing", q.Name, err)
+
+		return nil
+	} else if !n.IsIDN() {
+		return nil
+	}
+
+	if !isASCII(q.Name) {
+		q.Name = n.ASCII
+	}
+
+	log.Debug("idn: request for %s (%s)", n.ASCII, n.Unicode)
+
+	return h.checkHomoglyph(dctx, n)
+}
+
+// checkHomoglyph applies the homoglyph policy to the request for n.
+func (h *Handler) checkHomoglyph(dctx *proxy.DNSContext, n Names) (err error) {
+	if h.homoglyph == HomoglyphPolicyNone {
+		return nil
+	}
+
+	label := MixedScript(n.Unicode)
+	if label == "" {
+		return nil
+	}
+
+	log.Info("idn: %s (%s) mixes scripts in label %q", n.ASCII, n.Unicode, label)
+
+	if h.onFlag != nil {
+		h.onFlag(dctx, n, label)
+	}
+
+	if h.homoglyph != HomoglyphPolicyBlock {
+		return nil
+	}
+
+	return &proxy.BeforeRequestError{
+		Err:      fmt.Errorf("idn: %s (%s) mixes scripts in label %q", n.ASCII, n.Unicode, label),
+		Response: h.newResp(dctx.Req),
+	}
+}
+
+// isASCII returns true if s contains only printable ASCII characters and no
+// escapes.
+func isASCII(s string) (ok bool) {
+	for i := range len(s) {
+		if c := s[i]; c == '\\' || c < ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newResp returns a new NXDOMAIN response to req.
+func (h *Handler) newResp(req *dns.Msg) (resp *dns.Msg) {
+	if h.messages != nil {
+		return h.messages.NewMsgNXDOMAIN(req)
+	}
+
+	resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+	resp.RecursionAvailable = true
+
+	return resp
+}
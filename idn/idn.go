@@ -0,0 +1,124 @@
+// Package idn implements normalization of internationalized domain names in
+// DNS requests and detection of the names mixing several scripts, which are
+// often used for homoglyph attacks.
+package idn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// profile is the IDNA profile used for the conversions.  It's not too strict,
+// since DNS names in the wild often violate the registration rules.
+var profile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(false),
+	idna.StrictDomainName(false),
+)
+
+// Names are the forms of a domain name.
+type Names struct {
+	// ASCII is the lowercased name with the internationalized labels in the
+	// A-label (Punycode) form.
+	ASCII string
+
+	// Unicode is the lowercased name with the internationalized labels in
+	// the U-label form.
+	Unicode string
+}
+
+// IsIDN returns true if the name has any internationalized labels.
+func (n Names) IsIDN() (ok bool) {
+	return n.ASCII != n.Unicode
+}
+
+// Normalize returns the forms of the domain name, which may be given in
+// either form.  name is expected to be in the presentation format of package
+// github.com/miekg/dns, so non-ASCII bytes may be escaped as \DDD.  The
+// trailing dot, if any, is preserved.
+func Normalize(name string) (n Names, err error) {
+	if name == "." {
+		return Names{ASCII: name, Unicode: name}, nil
+	}
+
+	name, err = unescape(name)
+	if err != nil {
+		return Names{}, err
+	}
+
+	fqdn := strings.HasSuffix(name, ".")
+	name = strings.TrimSuffix(name, ".")
+
+	ascii, err := profile.ToASCII(name)
+	if err != nil {
+		return Names{}, fmt.Errorf("converting to ascii: %w", err)
+	}
+
+	// Don't use the error since ascii is validated already.
+	uni, _ := profile.ToUnicode(ascii)
+
+	if fqdn {
+		ascii, uni = ascii+".", uni+"."
+	}
+
+	return Names{
+		ASCII:   strings.ToLower(ascii),
+		Unicode: strings.ToLower(uni),
+	}, nil
+}
+
+// ToUnicode returns the Unicode form of the domain name or name itself if it
+// can't be converted.
+func ToUnicode(name string) (uni string) {
+	n, err := Normalize(name)
+	if err != nil {
+		return name
+	}
+
+	return n.Unicode
+}
+
+// unescape replaces the \DDD escapes of bytes in name with the bytes
+// themselves and returns an error if the result isn't valid UTF-8.  Other
+// escapes are left as is.
+func unescape(name string) (res string, err error) {
+	if !strings.Contains(name, `\`) {
+		return name, nil
+	}
+
+	b := &strings.Builder{}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c != '\\' || i+1 == len(name) {
+			b.WriteByte(c)
+
+			continue
+		}
+
+		if i+3 < len(name) {
+			n, convErr := strconv.ParseUint(name[i+1:i+4], 10, 8)
+			if convErr == nil && n >= utf8.RuneSelf {
+				b.WriteByte(byte(n))
+				i += 3
+
+				continue
+			}
+		}
+
+		// Keep the escaped character as is, so that an escaped backslash
+		// isn't mistaken for the start of another escape.
+		b.WriteString(name[i : i+2])
+		i++
+	}
+
+	res = b.String()
+	if !utf8.ValidString(res) {
+		return "", fmt.Errorf("name %q is not valid utf-8", name)
+	}
+
+	return res, nil
+}
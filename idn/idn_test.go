@@ -0,0 +1,154 @@
+package idn
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalize(t *testing.T) {
+	testCases := []struct {
+		name    string
+		in      string
+		ascii   string
+		unicode string
+	}{{
+		name:    "ascii",
+		in:      "WWW.Example.COM.",
+		ascii:   "www.example.com.",
+		unicode: "www.example.com.",
+	}, {
+		name:    "a_label",
+		in:      "xn--bcher-kva.example.",
+		ascii:   "xn--bcher-kva.example.",
+		unicode: "bücher.example.",
+	}, {
+		name:    "u_label",
+		in:      "Bücher.example",
+		ascii:   "xn--bcher-kva.example",
+		unicode: "bücher.example",
+	}, {
+		name:    "escaped",
+		in:      `b\195\188cher.example.`,
+		ascii:   "xn--bcher-kva.example.",
+		unicode: "bücher.example.",
+	}, {
+		name:    "root",
+		in:      ".",
+		ascii:   ".",
+		unicode: ".",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := Normalize(tc.in)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.ascii, n.ASCII)
+			assert.Equal(t, tc.unicode, n.Unicode)
+		})
+	}
+
+	_, err := Normalize(`bad\255.example.`)
+	assert.Error(t, err)
+}
+
+func TestMixedScript(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		want string
+	}{{
+		name: "latin",
+		in:   "bücher.example",
+		want: "",
+	}, {
+		name: "cyrillic",
+		in:   "пример.рф",
+		want: "",
+	}, {
+		name: "japanese",
+		in:   "日本語のサイトabc.example",
+		want: "",
+	}, {
+		name: "digits_and_hyphens",
+		in:   "пример-123.example",
+		want: "",
+	}, {
+		name: "latin_cyrillic",
+		// The "а" is Cyrillic.
+		in:   "www.pаypal.com",
+		want: "pаypal",
+	}, {
+		name: "greek_latin",
+		in:   "gοοgle.com",
+		want: "gοοgle",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, MixedScript(tc.in))
+		})
+	}
+}
+
+func TestHandler_HandleBefore(t *testing.T) {
+	newCtx := func(name string) (dctx *proxy.DNSContext) {
+		return &proxy.DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion(name, dns.TypeA),
+			Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+	}
+
+	// The "а" is Cyrillic.
+	const spoofed = "pаypal.com."
+
+	t.Run("rewrite", func(t *testing.T) {
+		h := New(&Config{})
+
+		dctx := newCtx("Bücher.example.")
+		require.NoError(t, h.HandleBefore(nil, dctx))
+
+		assert.Equal(t, "xn--bcher-kva.example.", dctx.Req.Question[0].Name)
+
+		dctx = newCtx("XN--Bcher-kva.example.")
+		require.NoError(t, h.HandleBefore(nil, dctx))
+
+		// Names already in the ASCII form are kept as is.
+		assert.Equal(t, "XN--Bcher-kva.example.", dctx.Req.Question[0].Name)
+	})
+
+	t.Run("flag", func(t *testing.T) {
+		var flagged []string
+		h := New(&Config{
+			OnFlag: func(_ *proxy.DNSContext, _ Names, label string) {
+				flagged = append(flagged, label)
+			},
+			Homoglyph: HomoglyphPolicyFlag,
+		})
+
+		require.NoError(t, h.HandleBefore(nil, newCtx(spoofed)))
+		require.NoError(t, h.HandleBefore(nil, newCtx("bücher.example.")))
+
+		assert.Equal(t, []string{"pаypal"}, flagged)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		h := New(&Config{
+			Homoglyph: HomoglyphPolicyBlock,
+		})
+
+		err := h.HandleBefore(nil, newCtx(spoofed))
+
+		befErr := &proxy.BeforeRequestError{}
+		require.ErrorAs(t, err, &befErr)
+
+		assert.Equal(t, dns.RcodeNameError, befErr.Response.Rcode)
+
+		assert.NoError(t, h.HandleBefore(nil, newCtx("example.com.")))
+	})
+}
@@ -0,0 +1,114 @@
+package idn
+
+import (
+	"strings"
+	"unicode"
+)
+
+// scriptSet is a set of Unicode scripts as a bit mask of indexes in
+// [knownScripts].
+type scriptSet uint64
+
+// knownScripts are the scripts recognized by [MixedScript].  The characters of
+// the other scripts are all considered to be of a single unknown script.
+var knownScripts = []*unicode.RangeTable{
+	unicode.Latin,
+	unicode.Greek,
+	unicode.Cyrillic,
+	unicode.Armenian,
+	unicode.Hebrew,
+	unicode.Arabic,
+	unicode.Devanagari,
+	unicode.Bengali,
+	unicode.Thai,
+	unicode.Georgian,
+	unicode.Hangul,
+	unicode.Hiragana,
+	unicode.Katakana,
+	unicode.Bopomofo,
+	unicode.Han,
+}
+
+// Script bits used to define the allowed combinations.
+const (
+	scriptLatin    scriptSet = 1 << 0
+	scriptHangul   scriptSet = 1 << 10
+	scriptHiragana scriptSet = 1 << 11
+	scriptKatakana scriptSet = 1 << 12
+	scriptBopomofo scriptSet = 1 << 13
+	scriptHan      scriptSet = 1 << 14
+
+	// scriptUnknown is the bit of the scripts not in knownScripts.
+	scriptUnknown scriptSet = 1 << 63
+)
+
+// allowedCombos are the combinations of scripts commonly used together, as
+// recommended by the Highly Restrictive level of Unicode Technical Standard
+// #39.
+var allowedCombos = []scriptSet{
+	scriptLatin | scriptHan | scriptHiragana | scriptKatakana,
+	scriptLatin | scriptHan | scriptBopomofo,
+	scriptLatin | scriptHan | scriptHangul,
+}
+
+// scriptOf returns the script of r.  ok is false if r is of the Common or
+// Inherited script, such as digits and hyphens, which can be mixed with any
+// other script.
+func scriptOf(r rune) (s scriptSet, ok bool) {
+	if r < 0x80 {
+		if unicode.IsLetter(r) {
+			return scriptLatin, true
+		}
+
+		return 0, false
+	}
+
+	if unicode.In(r, unicode.Common, unicode.Inherited) {
+		return 0, false
+	}
+
+	for i, tbl := range knownScripts {
+		if unicode.Is(tbl, r) {
+			return 1 << i, true
+		}
+	}
+
+	return scriptUnknown, true
+}
+
+// isSingleScript returns true if set contains at most a single script or one
+// of the allowed combinations.
+func isSingleScript(set scriptSet) (ok bool) {
+	if set&(set-1) == 0 {
+		return true
+	}
+
+	for _, combo := range allowedCombos {
+		if set&^combo == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MixedScript returns the first label of the Unicode form of a domain name
+// that mixes characters of several scripts, for example Latin and Cyrillic,
+// and doesn't fall into one of the combinations commonly used together, like
+// the Japanese one.  It returns an empty string if there are no such labels.
+func MixedScript(uni string) (label string) {
+	for _, l := range strings.Split(uni, ".") {
+		var set scriptSet
+		for _, r := range l {
+			if s, ok := scriptOf(r); ok {
+				set |= s
+			}
+		}
+
+		if !isSingleScript(set) {
+			return l
+		}
+	}
+
+	return ""
+}
@@ -9,6 +9,7 @@ import (
 	"net/netip"
 	"net/url"
 	"slices"
+	"syscall"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
@@ -42,13 +43,19 @@ const (
 // [NetworkTCP] or [NetworkUDP].
 type DialHandler func(ctx context.Context, network Network, addr string) (conn net.Conn, err error)
 
+// ControlFunc sets the options of the dialed sockets, see
+// [net.Dialer.Control].
+type ControlFunc = func(network, address string, c syscall.RawConn) (err error)
+
 // ResolveDialContext returns a DialHandler that uses addresses resolved from u
-// using resolver.  u must not be nil.
+// using resolver.  control is used for the dialed sockets, if not nil.  u must
+// not be nil.
 func ResolveDialContext(
 	u *url.URL,
 	timeout time.Duration,
 	r Resolver,
 	preferV6 bool,
+	control ControlFunc,
 ) (h DialHandler, err error) {
 	defer func() { err = errors.Annotate(err, "dialing %q: %w", u.Host) }()
 
@@ -87,12 +94,13 @@ func ResolveDialContext(
 		addrs = append(addrs, netip.AddrPortFrom(ip, port).String())
 	}
 
-	return NewDialContext(timeout, addrs...), nil
+	return NewDialContext(timeout, control, addrs...), nil
 }
 
 // NewDialContext returns a DialHandler that dials addrs and returns the first
-// successful connection.  At least a single addr should be specified.
-func NewDialContext(timeout time.Duration, addrs ...string) (h DialHandler) {
+// successful connection.  control is used for the dialed sockets, if not nil.
+// At least a single addr should be specified.
+func NewDialContext(timeout time.Duration, control ControlFunc, addrs ...string) (h DialHandler) {
 	l := len(addrs)
 	if l == 0 {
 		log.Debug("bootstrap: no addresses to dial")
@@ -104,6 +112,7 @@ func NewDialContext(timeout time.Duration, addrs ...string) (h DialHandler) {
 
 	dialer := &net.Dialer{
 		Timeout: timeout,
+		Control: control,
 	}
 
 	return func(ctx context.Context, network Network, _ string) (conn net.Conn, err error) {
@@ -100,6 +100,7 @@ func TestResolveDialContext(t *testing.T) {
 				testTimeout,
 				bootstrap.ParallelResolver{r},
 				tc.preferIPv6,
+				nil,
 			)
 			require.NoError(t, err)
 
@@ -132,6 +133,7 @@ func TestResolveDialContext(t *testing.T) {
 			testTimeout,
 			bootstrap.ParallelResolver{r},
 			false,
+			nil,
 		)
 		require.NoError(t, err)
 
@@ -148,6 +150,7 @@ func TestResolveDialContext(t *testing.T) {
 			testTimeout,
 			nil,
 			false,
+			nil,
 		)
 		testutil.AssertErrorMsg(t, errMsg, err)
 
@@ -160,6 +163,7 @@ func TestResolveDialContext(t *testing.T) {
 			testTimeout,
 			nil,
 			false,
+			nil,
 		)
 		assert.ErrorIs(t, err, bootstrap.ErrNoResolvers)
 		assert.Nil(t, dialContext)
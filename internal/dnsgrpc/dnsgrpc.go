@@ -0,0 +1,175 @@
+// Package dnsgrpc implements the wire format of DNS-over-gRPC, which is shared
+// by the upstream and the listener.
+//
+// The service is defined by dns.proto in this directory: a single unary method
+// taking and returning a message with the DNS message in the wire format.  The
+// messages are exchanged over HTTP/2 as described by the gRPC protocol, so that
+// the implementation is interoperable with the regular gRPC clients and
+// servers, but doesn't depend on the gRPC libraries.
+//
+// See https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md.
+package dnsgrpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+const (
+	// Path is the HTTP/2 path of the Query method.
+	Path = "/dnsproxy.v1.DNS/Query"
+
+	// ContentType is the content type of the gRPC requests and responses.
+	ContentType = "application/grpc"
+
+	// HdrStatus is the name of the trailer with the gRPC status code.
+	HdrStatus = "Grpc-Status"
+
+	// HdrMessage is the name of the trailer with the gRPC status message.
+	HdrMessage = "Grpc-Message"
+)
+
+// Status is a gRPC status code.
+type Status uint8
+
+// String implements the [fmt.Stringer] interface for Status.  It returns the
+// decimal code as it's sent in [HdrStatus].
+func (s Status) String() (str string) { return strconv.Itoa(int(s)) }
+
+// The gRPC status codes used by the services.
+const (
+	StatusOK                 Status = 0
+	StatusUnknown            Status = 2
+	StatusInvalidArgument    Status = 3
+	StatusNotFound           Status = 5
+	StatusAlreadyExists      Status = 6
+	StatusFailedPrecondition Status = 9
+	StatusUnimplemented      Status = 12
+	StatusInternal           Status = 13
+	StatusUnavailable        Status = 14
+	StatusUnauthenticated    Status = 16
+)
+
+const (
+	// frameHdrLen is the length of the header of a length-prefixed message:
+	// the compression flag and the big-endian length.
+	frameHdrLen = 1 + 4
+
+	// maxMsgLen is the maximum length of a DNS message.
+	maxMsgLen = 0xffff
+
+	// fieldData is the protobuf key of the data field of the message, that is
+	// its number 1 with the length-delimited wire type.
+	fieldData = 1<<3 | wireBytes
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// AppendFrame appends the length-prefixed gRPC message containing the DNS
+// message msg to b and returns the result.
+func AppendFrame(b, msg []byte) (res []byte) {
+	fieldHdr := binary.AppendUvarint([]byte{fieldData}, uint64(len(msg)))
+
+	res = append(b, 0)
+	res = binary.BigEndian.AppendUint32(res, uint32(len(fieldHdr)+len(msg)))
+	res = append(res, fieldHdr...)
+
+	return append(res, msg...)
+}
+
+// ReadFrame reads a single length-prefixed gRPC message from r and returns the
+// DNS message within it.  It returns [io.EOF] if r has no more messages.
+func ReadFrame(r io.Reader) (msg []byte, err error) {
+	hdr := make([]byte, frameHdrLen)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	if hdr[0] != 0 {
+		return nil, errors.Error("compressed messages are not supported")
+	}
+
+	// Allow some room for the protobuf overhead.
+	l := binary.BigEndian.Uint32(hdr[1:])
+	if l > maxMsgLen+binary.MaxVarintLen64+1 {
+		return nil, fmt.Errorf("message length %d is too large", l)
+	}
+
+	buf := make([]byte, l)
+	_, err = io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading message: %w", err)
+	}
+
+	return decodeMessage(buf)
+}
+
+// decodeMessage returns the data field of the protobuf message b.  The unknown
+// fields are skipped.
+func decodeMessage(b []byte) (data []byte, err error) {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.Error("bad field key")
+		}
+
+		b = b[n:]
+
+		var val []byte
+		val, b, err = cutField(b, key&7)
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %w", key>>3, err)
+		}
+
+		if key == fieldData {
+			data = val
+		}
+	}
+
+	return data, nil
+}
+
+// cutField splits b into the value of the field of wireType and the rest of
+// it.  The value is only returned for the length-delimited fields.
+func cutField(b []byte, wireType uint64) (val, rest []byte, err error) {
+	var n int
+	switch wireType {
+	case wireVarint:
+		_, n = binary.Uvarint(b)
+	case wireFixed64:
+		n = 8
+	case wireFixed32:
+		n = 4
+	case wireBytes:
+		l, ln := binary.Uvarint(b)
+		if ln <= 0 || l > uint64(len(b)-ln) {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+
+		return b[ln : ln+int(l)], b[ln+int(l):], nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported wire type %d", wireType)
+	}
+
+	if n <= 0 || n > len(b) {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+
+	return nil, b[n:], nil
+}
@@ -0,0 +1,76 @@
+package dnsgrpc_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/internal/dnsgrpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFrame(t *testing.T) {
+	msg := bytes.Repeat([]byte{0xab}, 300)
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		want       []byte
+		data       []byte
+	}{{
+		name:       "valid",
+		wantErrMsg: "",
+		want:       msg,
+		data:       dnsgrpc.AppendFrame(nil, msg),
+	}, {
+		name:       "unknown_fields",
+		wantErrMsg: "",
+		want:       []byte{1, 2},
+		// Field 2 as varint 150, field 3 as fixed32, field 1, and field 4 as
+		// varint 0.
+		data: []byte{0, 0, 0, 0, 14, 0x10, 0x96, 0x01, 0x1d, 0, 0, 0, 0, 0x0a, 0x02, 1, 2, 0x20, 0},
+	}, {
+		name:       "compressed",
+		wantErrMsg: "compressed messages are not supported",
+		want:       nil,
+		data:       []byte{1, 0, 0, 0, 0},
+	}, {
+		name:       "truncated",
+		wantErrMsg: "reading message: unexpected EOF",
+		want:       nil,
+		data:       []byte{0, 0, 0, 0, 4, 0x0a},
+	}, {
+		name:       "bad_length",
+		wantErrMsg: "field 1: unexpected EOF",
+		want:       nil,
+		data:       []byte{0, 0, 0, 0, 2, 0x0a, 0x05},
+	}, {
+		name:       "too_large",
+		wantErrMsg: "message length 16777216 is too large",
+		want:       nil,
+		data:       []byte{0, 1, 0, 0, 0},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := dnsgrpc.ReadFrame(bytes.NewReader(tc.data))
+			if tc.wantErrMsg != "" {
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+
+	t.Run("eof", func(t *testing.T) {
+		_, err := dnsgrpc.ReadFrame(bytes.NewReader(nil))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
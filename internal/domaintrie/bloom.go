@@ -0,0 +1,101 @@
+package domaintrie
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// bloomBitsPerKey is the number of filter bits per key, which gives the
+	// false-positive rate of about 1% with bloomHashes hash functions.
+	bloomBitsPerKey = 10
+
+	// bloomHashes is the number of hash functions of the filter.
+	bloomHashes = 7
+
+	// bloomMinBits is the minimum number of filter bits.
+	bloomMinBits = 64
+)
+
+// bloomFilter is a Bloom filter of the domain names having values in a
+// [Trie].  It's used to quickly reject the domains not matching any of them.
+type bloomFilter struct {
+	// rejected is the number of lookups rejected by the filter.
+	rejected *atomic.Uint64
+
+	// falsePositives is the number of lookups passed by the filter, but not
+	// matching anything.
+	falsePositives *atomic.Uint64
+
+	bits []uint64
+	seed maphash.Seed
+	mask uint64
+}
+
+// newBloomFilter returns a new empty filter sized for n keys.  The size is
+// rounded up to a power of two.
+func newBloomFilter(n int) (f *bloomFilter) {
+	size := uint64(max(n*bloomBitsPerKey, bloomMinBits))
+	size = 1 << bits.Len64(size-1)
+
+	return &bloomFilter{
+		rejected:       &atomic.Uint64{},
+		falsePositives: &atomic.Uint64{},
+		bits:           make([]uint64, size/64),
+		seed:           maphash.MakeSeed(),
+		mask:           size - 1,
+	}
+}
+
+// hashes returns the two base hashes of key for the double hashing.
+func (f *bloomFilter) hashes(key string) (h1, h2 uint64) {
+	h := maphash.String(f.seed, key)
+
+	// Make the second hash odd, so that it's coprime with the size.
+	return h, bits.RotateLeft64(h, 32) | 1
+}
+
+// add adds key to f.
+func (f *bloomFilter) add(key string) {
+	h1, h2 := f.hashes(key)
+	for i := range uint64(bloomHashes) {
+		bit := (h1 + i*h2) & f.mask
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain returns false if key has definitely not been added to f.
+func (f *bloomFilter) mayContain(key string) (ok bool) {
+	h1, h2 := f.hashes(key)
+	for i := range uint64(bloomHashes) {
+		bit := (h1 + i*h2) & f.mask
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mayMatch returns false if neither domain nor any of its parent domains has
+// been added to f.
+func (f *bloomFilter) mayMatch(domain string) (ok bool) {
+	for rest := domain; rest != ""; {
+		if f.mayContain(rest) {
+			return true
+		}
+
+		_, rest, _ = strings.Cut(rest, ".")
+	}
+
+	f.rejected.Add(1)
+
+	return false
+}
+
+// size returns the size of f in bytes.
+func (f *bloomFilter) size() (n int) {
+	return len(f.bits) * 8
+}
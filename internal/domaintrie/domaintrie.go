@@ -0,0 +1,249 @@
+// Package domaintrie implements a compact read-only suffix trie of domain
+// names, which is suitable for large domain lists.
+package domaintrie
+
+import (
+	"math"
+	"slices"
+	"strings"
+)
+
+// NoValue is the value reserved to mark the nodes without values.  It can't be
+// added to a trie.
+const NoValue uint32 = math.MaxUint32
+
+// builderNode is a mutable node of a [Builder].
+type builderNode struct {
+	children map[string]*builderNode
+	value    uint32
+}
+
+// newBuilderNode returns a new *builderNode without value.
+func newBuilderNode() (n *builderNode) {
+	return &builderNode{
+		children: map[string]*builderNode{},
+		value:    NoValue,
+	}
+}
+
+// Builder builds a [Trie].  It isn't safe for concurrent use.
+type Builder struct {
+	root *builderNode
+}
+
+// NewBuilder returns a new empty *Builder.
+func NewBuilder() (b *Builder) {
+	return &Builder{
+		root: newBuilderNode(),
+	}
+}
+
+// Add sets value for domain, which must be a non-empty domain name without the
+// trailing dot, in the same case the lookups will be performed in.  value must
+// not be [NoValue].  Adding the same domain again replaces its value.
+func (b *Builder) Add(domain string, value uint32) {
+	n := b.root
+	for rest := domain; rest != ""; {
+		var label string
+		label, rest = lastLabel(rest)
+
+		child, ok := n.children[label]
+		if !ok {
+			child = newBuilderNode()
+			n.children[label] = child
+		}
+
+		n = child
+	}
+
+	n.value = value
+}
+
+// queueItem is a node of a [Builder] queued for laying out along with its
+// domain name.
+type queueItem struct {
+	node   *builderNode
+	domain string
+}
+
+// Build returns a new *Trie with the domains added to b.  The Bloom filter of
+// the trie is sized for the number of the domains.  b may be reused afterwards.
+func (b *Builder) Build() (t *Trie) {
+	t = &Trie{
+		nodes: []node{{value: b.root.value}},
+	}
+
+	labels := &strings.Builder{}
+	labelOffs := map[string]uint32{}
+
+	var domains []string
+
+	// Lay out the nodes in breadth-first order, so that the children of each
+	// node are contiguous and their index in the queue is the same as the one
+	// in t.nodes.
+	queue := []queueItem{{node: b.root}}
+	for i := 0; i < len(queue); i++ {
+		bn := queue[i].node
+		keys := make([]string, 0, len(bn.children))
+		for k := range bn.children {
+			keys = append(keys, k)
+		}
+
+		slices.Sort(keys)
+
+		t.nodes[i].firstChild = uint32(len(t.nodes))
+		t.nodes[i].numChildren = uint32(len(keys))
+
+		for _, k := range keys {
+			child := bn.children[k]
+			t.nodes = append(t.nodes, node{
+				labelOff: internLabel(labels, labelOffs, k),
+				labelLen: uint32(len(k)),
+				value:    child.value,
+			})
+
+			domain := joinLabel(k, queue[i].domain)
+			if child.value != NoValue {
+				domains = append(domains, domain)
+			}
+
+			queue = append(queue, queueItem{node: child, domain: domain})
+		}
+	}
+
+	t.labels = labels.String()
+	t.filter = newBloomFilter(len(domains))
+	for _, d := range domains {
+		t.filter.add(d)
+	}
+
+	return t
+}
+
+// joinLabel returns the subdomain of parent with label.
+func joinLabel(label, parent string) (domain string) {
+	if parent == "" {
+		return label
+	}
+
+	return label + "." + parent
+}
+
+// internLabel returns the offset of label within labels, writing it there if
+// it's not in offs yet.
+func internLabel(labels *strings.Builder, offs map[string]uint32, label string) (off uint32) {
+	off, ok := offs[label]
+	if !ok {
+		off = uint32(labels.Len())
+		_, _ = labels.WriteString(label)
+		offs[label] = off
+	}
+
+	return off
+}
+
+// node is a node of a [Trie].  Its label is stored within the shared label
+// table of the trie.
+type node struct {
+	labelOff    uint32
+	labelLen    uint32
+	firstChild  uint32
+	numChildren uint32
+	value       uint32
+}
+
+// nodeSize is the size of a [node] in bytes.
+const nodeSize = 5 * 4
+
+// Trie is a read-only suffix trie of domain names, each of which has a value.
+// The nodes are stored in a single slice and the labels are interned, so that
+// the common labels like "com" are stored once.  Lookups take time
+// proportional to the number of labels in the domain name, and most of the
+// domains not matching anything are rejected by a Bloom filter without walking
+// the trie.  It's safe for concurrent use.
+type Trie struct {
+	filter *bloomFilter
+	labels string
+	nodes  []node
+}
+
+// AppendMatches appends the values of domain and all its parent domains, from
+// the most specific one to the least specific one, to vals and returns the
+// result.
+func (t *Trie) AppendMatches(vals []uint32, domain string) (res []uint32) {
+	res = vals
+	if !t.filter.mayMatch(domain) {
+		return res
+	}
+
+	start := len(res)
+
+	idx := uint32(0)
+	for rest := domain; rest != ""; {
+		var label string
+		label, rest = lastLabel(rest)
+
+		var ok bool
+		idx, ok = t.child(idx, label)
+		if !ok {
+			break
+		}
+
+		if v := t.nodes[idx].value; v != NoValue {
+			res = append(res, v)
+		}
+	}
+
+	if len(res) == start {
+		t.filter.falsePositives.Add(1)
+	}
+
+	slices.Reverse(res[start:])
+
+	return res
+}
+
+// child returns the index of the child of the node at idx with label.
+func (t *Trie) child(idx uint32, label string) (childIdx uint32, ok bool) {
+	n := t.nodes[idx]
+	children := t.nodes[n.firstChild : n.firstChild+n.numChildren]
+
+	i, ok := slices.BinarySearchFunc(children, label, func(c node, l string) (res int) {
+		return strings.Compare(t.labels[c.labelOff:c.labelOff+c.labelLen], l)
+	})
+
+	return n.firstChild + uint32(i), ok
+}
+
+// Len returns the number of nodes in t.
+func (t *Trie) Len() (n int) {
+	return len(t.nodes)
+}
+
+// Size returns the approximate memory footprint of t in bytes.
+func (t *Trie) Size() (n int) {
+	return len(t.nodes)*nodeSize + len(t.labels) + t.filter.size()
+}
+
+// FalsePositiveRate returns the measured false-positive rate of the Bloom
+// filter of t, that is the share of the lookups not matching anything, which
+// the filter failed to reject.  It's zero if there were no such lookups.
+func (t *Trie) FalsePositiveRate() (rate float64) {
+	fp := t.filter.falsePositives.Load()
+	total := fp + t.filter.rejected.Load()
+	if total == 0 {
+		return 0
+	}
+
+	return float64(fp) / float64(total)
+}
+
+// lastLabel splits domain into its last label and the rest of it.
+func lastLabel(domain string) (label, rest string) {
+	i := strings.LastIndexByte(domain, '.')
+	if i < 0 {
+		return domain, ""
+	}
+
+	return domain[i+1:], domain[:i]
+}
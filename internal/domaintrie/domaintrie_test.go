@@ -0,0 +1,129 @@
+package domaintrie_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/internal/domaintrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrie_AppendMatches(t *testing.T) {
+	b := domaintrie.NewBuilder()
+	b.Add("example", 0)
+	b.Add("sub.example", 1)
+	b.Add("deep.sub.example", 2)
+	b.Add("other.example", 3)
+	b.Add("example.org", 4)
+
+	// Replace the value.
+	b.Add("other.example", 5)
+
+	tr := b.Build()
+
+	testCases := []struct {
+		name   string
+		domain string
+		want   []uint32
+	}{{
+		name:   "exact",
+		domain: "sub.example",
+		want:   []uint32{1, 0},
+	}, {
+		name:   "deepest",
+		domain: "a.deep.sub.example",
+		want:   []uint32{2, 1, 0},
+	}, {
+		name:   "replaced",
+		domain: "other.example",
+		want:   []uint32{5, 0},
+	}, {
+		name:   "intermediate",
+		domain: "www.org",
+		want:   nil,
+	}, {
+		name:   "tld",
+		domain: "org",
+		want:   nil,
+	}, {
+		name:   "unknown",
+		domain: "example.net",
+		want:   nil,
+	}, {
+		name:   "empty",
+		domain: "",
+		want:   nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tr.AppendMatches(nil, tc.domain))
+		})
+	}
+
+	// Check that the values are appended to the given slice.
+	assert.Equal(t, []uint32{42, 1, 0}, tr.AppendMatches([]uint32{42}, "sub.example"))
+}
+
+func TestTrie_Size(t *testing.T) {
+	b := domaintrie.NewBuilder()
+	for i := range 1000 {
+		b.Add(fmt.Sprintf("host%d.example.com", i), uint32(i))
+	}
+
+	tr := b.Build()
+
+	// The root, "com", "example", and a node for each host.
+	assert.Equal(t, 1003, tr.Len())
+
+	// The labels "com" and "example" are stored once, and the filter has 10
+	// bits per domain rounded up to a power of two.
+	const filterSize = 16384 / 8
+	assert.Less(t, tr.Size(), 1003*20+1000*len("host999")+len("comexample")+filterSize)
+}
+
+func TestTrie_FalsePositiveRate(t *testing.T) {
+	b := domaintrie.NewBuilder()
+	for i := range 1000 {
+		b.Add(fmt.Sprintf("host%d.example.com", i), uint32(i))
+	}
+
+	tr := b.Build()
+	assert.Zero(t, tr.FalsePositiveRate())
+
+	// The matching lookups aren't counted.
+	for i := range 1000 {
+		require.Len(t, tr.AppendMatches(nil, fmt.Sprintf("www.host%d.example.com", i)), 1)
+	}
+
+	assert.Zero(t, tr.FalsePositiveRate())
+
+	for i := range 10_000 {
+		require.Empty(t, tr.AppendMatches(nil, fmt.Sprintf("other%d.example.com", i)))
+	}
+
+	// Each lookup checks the domain itself and its two parent domains, and the
+	// expected rate is well below 1% for each of them.
+	rate := tr.FalsePositiveRate()
+	assert.Positive(t, rate)
+	assert.Less(t, rate, 0.05)
+}
+
+func BenchmarkTrie_AppendMatches(b *testing.B) {
+	bld := domaintrie.NewBuilder()
+	for i := range 100_000 {
+		bld.Add(fmt.Sprintf("host%d.example.com", i), uint32(i))
+	}
+
+	tr := bld.Build()
+	vals := make([]uint32, 0, 4)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		vals = tr.AppendMatches(vals[:0], "www.host99999.example.com")
+	}
+
+	assert.Len(b, vals, 1)
+}
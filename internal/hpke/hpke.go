@@ -0,0 +1,283 @@
+// Package hpke implements the base mode of Hybrid Public Key Encryption for
+// the cipher suites used by Oblivious DNS over HTTPS, using only the standard
+// library.
+//
+// See RFC 9180.
+package hpke
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// KEM is the identifier of a key encapsulation mechanism.
+type KEM uint16
+
+// KEMX25519HKDFSHA256 is DHKEM(X25519, HKDF-SHA256), the only supported KEM.
+const KEMX25519HKDFSHA256 KEM = 0x0020
+
+// KDF is the identifier of a key derivation function.
+type KDF uint16
+
+// KDFHKDFSHA256 is HKDF-SHA256, the only supported KDF.
+const KDFHKDFSHA256 KDF = 0x0001
+
+// AEAD is the identifier of an authenticated encryption with associated data
+// algorithm.
+type AEAD uint16
+
+// The supported AEADs.
+const (
+	AEADAES128GCM AEAD = 0x0001
+	AEADAES256GCM AEAD = 0x0002
+)
+
+// KeySize returns the length of the key of a, Nk.  It returns zero if a isn't
+// supported.
+func (a AEAD) KeySize() (n int) {
+	switch a {
+	case AEADAES128GCM:
+		return 16
+	case AEADAES256GCM:
+		return 32
+	default:
+		return 0
+	}
+}
+
+// New returns the AEAD of a with key.
+func (a AEAD) New(key []byte) (aead cipher.AEAD, err error) {
+	if a.KeySize() == 0 {
+		return nil, ErrUnsupported
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating aead: %w", err)
+	}
+
+	return aead, nil
+}
+
+// NonceSize returns the length of the nonce of a, Nn.
+func (a AEAD) NonceSize() (n int) { return 12 }
+
+// HashSize is the output length of the supported KDF, Nh.
+const HashSize = sha256.Size
+
+// ErrUnsupported is returned when the cipher suite isn't supported.
+const ErrUnsupported errors.Error = "unsupported cipher suite"
+
+// Suite is an HPKE cipher suite.
+type Suite struct {
+	KEM  KEM
+	KDF  KDF
+	AEAD AEAD
+}
+
+// Supported returns true if s is supported by this package.
+func (s Suite) Supported() (ok bool) {
+	return s.KEM == KEMX25519HKDFSHA256 && s.KDF == KDFHKDFSHA256 && s.AEAD.KeySize() != 0
+}
+
+// id returns the suite_id of s used in the key schedule.
+func (s Suite) id() (id []byte) {
+	id = append([]byte("HPKE"), 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(id[4:], uint16(s.KEM))
+	binary.BigEndian.PutUint16(id[6:], uint16(s.KDF))
+	binary.BigEndian.PutUint16(id[8:], uint16(s.AEAD))
+
+	return id
+}
+
+// kemID returns the suite_id of the KEM of s.
+func (s Suite) kemID() (id []byte) {
+	return binary.BigEndian.AppendUint16([]byte("KEM"), uint16(s.KEM))
+}
+
+// Context is the encryption context established by [SetupBaseS] or
+// [SetupBaseR].  It isn't safe for concurrent use.
+type Context struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	suiteID        []byte
+	seq            uint64
+}
+
+// SetupBaseS establishes the sender's context for the recipient's public key
+// pkR, which is a raw X25519 key, and info.  enc is the encapsulated key to be
+// sent to the recipient.
+func SetupBaseS(s Suite, pkR, info []byte) (enc []byte, c *Context, err error) {
+	if !s.Supported() {
+		return nil, nil, ErrUnsupported
+	}
+
+	pk, err := ecdh.X25519().NewPublicKey(pkR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("recipient key: %w", err)
+	}
+
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating ephemeral key: %w", err)
+	}
+
+	dh, err := skE.ECDH(pk)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encapsulating: %w", err)
+	}
+
+	enc = skE.PublicKey().Bytes()
+	c, err = s.keySchedule(s.sharedSecret(dh, enc, pkR), info)
+
+	return enc, c, err
+}
+
+// SetupBaseR establishes the recipient's context for the encapsulated key enc
+// received from the sender, the recipient's private key skR, and info.
+func SetupBaseR(s Suite, enc []byte, skR *ecdh.PrivateKey, info []byte) (c *Context, err error) {
+	if !s.Supported() {
+		return nil, ErrUnsupported
+	}
+
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, fmt.Errorf("encapsulated key: %w", err)
+	}
+
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, fmt.Errorf("decapsulating: %w", err)
+	}
+
+	return s.keySchedule(s.sharedSecret(dh, enc, skR.PublicKey().Bytes()), info)
+}
+
+// sharedSecret returns the KEM shared secret for the Diffie-Hellman result dh,
+// the encapsulated key enc, and the recipient's public key pkR.
+func (s Suite) sharedSecret(dh, enc, pkR []byte) (secret []byte) {
+	kemID := s.kemID()
+	kemCtx := append(append([]byte{}, enc...), pkR...)
+	prk := labeledExtract(kemID, nil, "eae_prk", dh)
+
+	return labeledExpand(kemID, prk, "shared_secret", kemCtx, HashSize)
+}
+
+// keySchedule derives the context from the shared secret in the base mode.
+func (s Suite) keySchedule(sharedSecret, info []byte) (c *Context, err error) {
+	suiteID := s.id()
+	schedCtx := []byte{0}
+	schedCtx = append(schedCtx, labeledExtract(suiteID, nil, "psk_id_hash", nil)...)
+	schedCtx = append(schedCtx, labeledExtract(suiteID, nil, "info_hash", info)...)
+
+	secret := labeledExtract(suiteID, sharedSecret, "secret", nil)
+	key := labeledExpand(suiteID, secret, "key", schedCtx, s.AEAD.KeySize())
+
+	aead, err := s.AEAD.New(key)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return &Context{
+		aead:           aead,
+		baseNonce:      labeledExpand(suiteID, secret, "base_nonce", schedCtx, s.AEAD.NonceSize()),
+		exporterSecret: labeledExpand(suiteID, secret, "exp", schedCtx, HashSize),
+		suiteID:        suiteID,
+	}, nil
+}
+
+// Seal encrypts and authenticates pt with aad.
+func (c *Context) Seal(aad, pt []byte) (ct []byte) {
+	ct = c.aead.Seal(nil, c.nextNonce(), pt, aad)
+
+	return ct
+}
+
+// Open decrypts and authenticates ct with aad.
+func (c *Context) Open(aad, ct []byte) (pt []byte, err error) {
+	pt, err = c.aead.Open(nil, c.nextNonce(), ct, aad)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return pt, nil
+}
+
+// Export derives a secret of length l from the context and exporterCtx.
+func (c *Context) Export(exporterCtx []byte, l int) (secret []byte) {
+	return labeledExpand(c.suiteID, c.exporterSecret, "sec", exporterCtx, l)
+}
+
+// nextNonce returns the nonce for the current sequence number and increments
+// the latter.
+func (c *Context) nextNonce() (nonce []byte) {
+	nonce = append([]byte{}, c.baseNonce...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+	for i, b := range seq {
+		nonce[len(nonce)-len(seq)+i] ^= b
+	}
+
+	c.seq++
+
+	return nonce
+}
+
+// Extract is the HKDF-Extract function of the supported KDF.
+func Extract(salt, ikm []byte) (prk []byte) {
+	h := hmac.New(sha256.New, salt)
+	_, _ = h.Write(ikm)
+
+	return h.Sum(nil)
+}
+
+// Expand is the HKDF-Expand function of the supported KDF.  l must not be
+// greater than 255*[HashSize].
+func Expand(prk, info []byte, l int) (okm []byte) {
+	okm = make([]byte, 0, l+HashSize)
+	var t []byte
+	for i := byte(1); len(okm) < l; i++ {
+		h := hmac.New(sha256.New, prk)
+		_, _ = h.Write(t)
+		_, _ = h.Write(info)
+		_, _ = h.Write([]byte{i})
+		t = h.Sum(nil)
+		okm = append(okm, t...)
+	}
+
+	return okm[:l]
+}
+
+// labeledExtract is the LabeledExtract function for suiteID.
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) (prk []byte) {
+	labeled := append([]byte("HPKE-v1"), suiteID...)
+	labeled = append(labeled, label...)
+
+	return Extract(salt, append(labeled, ikm...))
+}
+
+// labeledExpand is the LabeledExpand function for suiteID.
+func labeledExpand(suiteID, prk []byte, label string, info []byte, l int) (okm []byte) {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(l))
+	labeled = append(labeled, "HPKE-v1"...)
+	labeled = append(labeled, suiteID...)
+	labeled = append(labeled, label...)
+
+	return Expand(prk, append(labeled, info...), l)
+}
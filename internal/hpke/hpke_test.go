@@ -0,0 +1,106 @@
+package hpke_test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/internal/hpke"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSuite is the cipher suite of the test vectors.
+var testSuite = hpke.Suite{
+	KEM:  hpke.KEMX25519HKDFSHA256,
+	KDF:  hpke.KDFHKDFSHA256,
+	AEAD: hpke.AEADAES128GCM,
+}
+
+// mustHex decodes s or fails t.
+func mustHex(t *testing.T, s string) (b []byte) {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+
+	return b
+}
+
+// TestSetupBaseR checks the recipient against the test vector from RFC 9180,
+// Appendix A.1.1.
+func TestSetupBaseR(t *testing.T) {
+	skR, err := ecdh.X25519().NewPrivateKey(mustHex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	require.NoError(t, err)
+
+	enc := mustHex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+	info := mustHex(t, "4f6465206f6e2061204772656369616e2055726e")
+
+	c, err := hpke.SetupBaseR(testSuite, enc, skR, info)
+	require.NoError(t, err)
+
+	pt, err := c.Open(
+		[]byte("Count-0"),
+		mustHex(t, "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Beauty is truth, truth beauty", string(pt))
+
+	testCases := []struct {
+		name    string
+		ctx     []byte
+		wantHex string
+	}{{
+		name:    "empty",
+		ctx:     nil,
+		wantHex: "3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee",
+	}, {
+		name:    "zero",
+		ctx:     []byte{0},
+		wantHex: "2e8f0b54673c7029649d4eb9d5e33bf1872cf76d623ff164ac185da9e88c21a5",
+	}, {
+		name:    "text",
+		ctx:     []byte("TestContext"),
+		wantHex: "e9e43065102c3836401bed8c3c3c75ae46be1639869391d62c61f1ec7af54931",
+	}}
+
+	for _, tc := range testCases {
+		t.Run("export_"+tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantHex, hex.EncodeToString(c.Export(tc.ctx, 32)))
+		})
+	}
+}
+
+func TestSetupBaseS(t *testing.T) {
+	for _, aead := range []hpke.AEAD{hpke.AEADAES128GCM, hpke.AEADAES256GCM} {
+		s := hpke.Suite{KEM: hpke.KEMX25519HKDFSHA256, KDF: hpke.KDFHKDFSHA256, AEAD: aead}
+
+		skR, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		info := []byte("info")
+		enc, sender, err := hpke.SetupBaseS(s, skR.PublicKey().Bytes(), info)
+		require.NoError(t, err)
+
+		recipient, err := hpke.SetupBaseR(s, enc, skR, info)
+		require.NoError(t, err)
+
+		for _, msg := range []string{"first", "second"} {
+			var pt []byte
+			pt, err = recipient.Open([]byte("aad"), sender.Seal([]byte("aad"), []byte(msg)))
+			require.NoError(t, err)
+
+			assert.Equal(t, msg, string(pt))
+		}
+
+		assert.Equal(t, sender.Export([]byte("ctx"), 16), recipient.Export([]byte("ctx"), 16))
+
+		_, err = recipient.Open([]byte("other"), sender.Seal([]byte("aad"), []byte("msg")))
+		assert.Error(t, err)
+	}
+
+	_, _, err := hpke.SetupBaseS(hpke.Suite{KEM: 0x0010}, nil, nil)
+	assert.ErrorIs(t, err, hpke.ErrUnsupported)
+}
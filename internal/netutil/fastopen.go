@@ -0,0 +1,103 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// fastOpenQueueLen is the maximum number of the pending TCP Fast Open requests
+// of a listening socket, which haven't completed the three-way handshake yet.
+const fastOpenQueueLen = 256
+
+// ListenConfigFastOpen returns the [net.ListenConfig] like [ListenConfig], but
+// also enabling TCP Fast Open on the TCP sockets, if it's supported, see
+// [Capabilities].
+func ListenConfigFastOpen() (lc *net.ListenConfig) {
+	lc = ListenConfig()
+	lc.Control = withFastOpen(lc.Control, setFastOpenListen)
+
+	return lc
+}
+
+// ListenControlFastOpen returns a [net.ListenConfig.Control] function enabling
+// TCP Fast Open on the TCP sockets.  control is nil if TCP Fast Open isn't
+// supported, see [Capabilities].
+func ListenControlFastOpen() (control func(network, address string, c syscall.RawConn) (err error)) {
+	return withFastOpen(nil, setFastOpenListen)
+}
+
+// DialControlFastOpen returns a [net.Dialer.Control] function calling control,
+// if it's not nil, and then enabling TCP Fast Open on the TCP sockets, if it's
+// supported, see [Capabilities].  The data of the first write to the
+// connection is then sent within the SYN, if the server supports it.
+func DialControlFastOpen(
+	control func(network, address string, c syscall.RawConn) (err error),
+) (wrapped func(network, address string, c syscall.RawConn) (err error)) {
+	return withFastOpen(control, setFastOpenConnect)
+}
+
+// withFastOpen returns a control function calling control, if it's not nil,
+// and then enabling TCP Fast Open on the TCP sockets with set.  control itself
+// is returned if TCP Fast Open isn't supported.
+func withFastOpen(
+	control func(network, address string, c syscall.RawConn) (err error),
+	set func(fd uintptr) (err error),
+) (wrapped func(network, address string, c syscall.RawConn) (err error)) {
+	if !Capabilities().FastOpen {
+		return control
+	}
+
+	return func(network, address string, c syscall.RawConn) (err error) {
+		if control != nil {
+			err = control(network, address, c)
+			if err != nil {
+				// Don't wrap the error since it's informative enough as is.
+				return err
+			}
+		}
+
+		if !strings.HasPrefix(network, "tcp") {
+			return nil
+		}
+
+		var opErr error
+		err = c.Control(func(fd uintptr) {
+			opErr = set(fd)
+		})
+		if opErr != nil {
+			opErr = fmt.Errorf("setting TCP_FASTOPEN: %w", opErr)
+		}
+
+		return errors.WithDeferred(opErr, err)
+	}
+}
+
+// FastOpenUsed returns true if the data within the SYN of conn was accepted.
+// conn is unwrapped if it's a [*tls.Conn].  It's only meaningful after the
+// first response has been received on the dialed connection, and right after
+// the connection has been accepted.
+func FastOpenUsed(conn net.Conn) (ok bool) {
+	if nc, isWrapper := conn.(interface{ NetConn() (c net.Conn) }); isWrapper {
+		conn = nc.NetConn()
+	}
+
+	sc, isSyscallConn := conn.(syscall.Conn)
+	if !isSyscallConn {
+		return false
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	_ = raw.Control(func(fd uintptr) {
+		ok = fastOpenUsed(fd)
+	})
+
+	return ok
+}
@@ -0,0 +1,28 @@
+//go:build linux
+
+package netutil
+
+import "golang.org/x/sys/unix"
+
+// tcpiOptSYNData is the flag of the tcpi_options field of the TCP_INFO socket
+// option, which is set when the data within the SYN has been accepted.
+const tcpiOptSYNData = 0x20
+
+// setFastOpenListen enables TCP Fast Open on the listening socket fd.
+func setFastOpenListen(fd uintptr) (err error) {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueueLen)
+}
+
+// setFastOpenConnect makes the connecting socket fd send the data of the first
+// write within the SYN.
+func setFastOpenConnect(fd uintptr) (err error) {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+}
+
+// fastOpenUsed returns true if the data within the SYN of the connected socket
+// fd has been accepted.
+func fastOpenUsed(fd uintptr) (ok bool) {
+	info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+
+	return err == nil && info.Options&tcpiOptSYNData != 0
+}
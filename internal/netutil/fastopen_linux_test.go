@@ -0,0 +1,65 @@
+//go:build linux
+
+package netutil_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/internal/netutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestListenConfigFastOpen(t *testing.T) {
+	if !netutil.Capabilities().FastOpen {
+		t.Skip("tcp fast open isn't supported")
+	}
+
+	l, err := netutil.ListenConfigFastOpen().Listen(context.Background(), "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	raw, err := l.(syscall.Conn).SyscallConn()
+	require.NoError(t, err)
+
+	var qlen int
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		qlen, opErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN)
+	})
+	require.NoError(t, err)
+	require.NoError(t, opErr)
+
+	assert.Positive(t, qlen)
+
+	go func() {
+		conn, aErr := l.Accept()
+		if aErr != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	d := &net.Dialer{Control: netutil.DialControlFastOpen(nil)}
+	conn, err := d.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	// The connect is deferred until the first write with TCP Fast Open.
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, "ping", string(buf))
+}
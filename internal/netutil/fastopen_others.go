@@ -0,0 +1,22 @@
+//go:build !linux
+
+package netutil
+
+import "github.com/AdguardTeam/golibs/errors"
+
+// setFastOpenListen returns an error, since TCP Fast Open is only enabled on
+// Linux.
+func setFastOpenListen(_ uintptr) (err error) {
+	return errors.ErrUnsupported
+}
+
+// setFastOpenConnect returns an error, since TCP Fast Open is only enabled on
+// Linux.
+func setFastOpenConnect(_ uintptr) (err error) {
+	return errors.ErrUnsupported
+}
+
+// fastOpenUsed returns false, since TCP Fast Open is only enabled on Linux.
+func fastOpenUsed(_ uintptr) (ok bool) {
+	return false
+}
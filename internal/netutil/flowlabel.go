@@ -0,0 +1,35 @@
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// ListenControlFlowLabel returns a [net.ListenConfig.Control] function making
+// the kernel set a stable flow label on the outgoing packets of the IPv6 UDP
+// sockets, so that the queuing disciplines and the ECMP routers keep the
+// packets of the same flow together.  control is nil if the flow labels aren't
+// supported, see [Capabilities].
+func ListenControlFlowLabel() (control func(network, address string, c syscall.RawConn) (err error)) {
+	if !Capabilities().FlowLabel {
+		return nil
+	}
+
+	return func(network, _ string, c syscall.RawConn) (err error) {
+		if network != "udp6" {
+			return nil
+		}
+
+		var opErr error
+		err = c.Control(func(fd uintptr) {
+			opErr = setFlowLabel(fd)
+		})
+		if opErr != nil {
+			opErr = fmt.Errorf("setting IPV6_AUTOFLOWLABEL: %w", opErr)
+		}
+
+		return errors.WithDeferred(opErr, err)
+	}
+}
@@ -0,0 +1,47 @@
+//go:build linux
+
+package netutil_test
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/internal/netutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestListenControlFlowLabel(t *testing.T) {
+	if !netutil.Capabilities().FlowLabel {
+		t.Skip("ipv6 flow labels aren't supported")
+	}
+
+	lc := &net.ListenConfig{Control: netutil.ListenControlFlowLabel()}
+	conn, err := lc.ListenPacket(context.Background(), "udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("ipv6 isn't available: %s", err)
+	}
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	require.NoError(t, err)
+
+	var val int
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		val, opErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_AUTOFLOWLABEL)
+	})
+	require.NoError(t, err)
+	require.NoError(t, opErr)
+
+	assert.Equal(t, 1, val)
+
+	// The IPv4 sockets are left as is.
+	conn, err = lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+}
@@ -0,0 +1,54 @@
+package netutil
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// maxBindAttempts is the maximum number of random ports tried to bind a socket
+// to before giving up.
+const maxBindAttempts = 16
+
+// PortRangeControl returns a [net.Dialer.Control] function binding the UDP
+// sockets to a random local port from first to last inclusive, after calling
+// next, if it's not nil.  The ports already in use are skipped.  The sockets of
+// other networks are left as is.  first must not be greater than last.
+func PortRangeControl(
+	first uint16,
+	last uint16,
+	next func(network, address string, c syscall.RawConn) (err error),
+) (control func(network, address string, c syscall.RawConn) (err error)) {
+	return func(network, address string, c syscall.RawConn) (err error) {
+		if next != nil {
+			err = next(network, address, c)
+			if err != nil {
+				// Don't wrap the error since it's informative enough as is.
+				return err
+			}
+		}
+
+		if !strings.HasPrefix(network, "udp") {
+			return nil
+		}
+
+		var bindErr error
+		err = c.Control(func(fd uintptr) {
+			for range maxBindAttempts {
+				port := first + uint16(rand.N(uint32(last-first)+1))
+				bindErr = bindPort(fd, network, port)
+				if !errors.Is(bindErr, errAddrInUse) {
+					break
+				}
+			}
+		})
+		if bindErr != nil {
+			bindErr = fmt.Errorf("binding to port from %d to %d: %w", first, last, bindErr)
+		}
+
+		return errors.WithDeferred(bindErr, err)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package netutil
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// errAddrInUse is the error returned when binding to a port in use.
+const errAddrInUse = unix.EADDRINUSE
+
+// bindPort binds fd of network to port on the unspecified address.
+func bindPort(fd uintptr, network string, port uint16) (err error) {
+	if strings.HasSuffix(network, "6") {
+		return unix.Bind(int(fd), &unix.SockaddrInet6{Port: int(port)})
+	}
+
+	return unix.Bind(int(fd), &unix.SockaddrInet4{Port: int(port)})
+}
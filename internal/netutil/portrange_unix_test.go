@@ -0,0 +1,42 @@
+//go:build unix
+
+package netutil_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/internal/netutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortRangeControl(t *testing.T) {
+	const first, last = 41000, 41999
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, pc.Close)
+
+	d := &net.Dialer{Control: netutil.PortRangeControl(first, last, netutil.DialControl(0, 34))}
+
+	for range 10 {
+		conn, dialErr := d.Dial("udp", pc.LocalAddr().String())
+		require.NoError(t, dialErr)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		assert.GreaterOrEqual(t, port, first)
+		assert.LessOrEqual(t, port, last)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	// The sockets of other networks aren't bound.
+	conn, err := d.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+}
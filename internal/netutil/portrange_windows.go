@@ -0,0 +1,21 @@
+//go:build windows
+
+package netutil
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// errAddrInUse is the error returned when binding to a port in use.
+const errAddrInUse = windows.WSAEADDRINUSE
+
+// bindPort binds fd of network to port on the unspecified address.
+func bindPort(fd uintptr, network string, port uint16) (err error) {
+	if strings.HasSuffix(network, "6") {
+		return windows.Bind(windows.Handle(fd), &windows.SockaddrInet6{Port: int(port)})
+	}
+
+	return windows.Bind(windows.Handle(fd), &windows.SockaddrInet4{Port: int(port)})
+}
@@ -0,0 +1,53 @@
+package netutil
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SocketCapabilities describes the optional socket options supported by the
+// platform.  The listeners and dialers of this module don't set the
+// unsupported options instead of failing.
+type SocketCapabilities struct {
+	// ReusePort is true if the SO_REUSEPORT socket option is supported.
+	ReusePort bool
+
+	// PktInfo is true if the destination address of the received UDP packets
+	// can be requested, e.g. with the IP_PKTINFO socket option.
+	PktInfo bool
+
+	// FreeBind is true if the sockets can be bound to the nonlocal addresses,
+	// e.g. with the IP_FREEBIND socket option.
+	FreeBind bool
+
+	// FastOpen is true if the TCP_FASTOPEN socket option is supported.
+	FastOpen bool
+
+	// FlowLabel is true if the kernel can be asked to set a stable flow label
+	// on the outgoing IPv6 packets of a socket, e.g. with the
+	// IPV6_AUTOFLOWLABEL socket option.
+	FlowLabel bool
+}
+
+// String implements the [fmt.Stringer] interface for SocketCapabilities.
+func (c SocketCapabilities) String() (s string) {
+	return fmt.Sprintf(
+		"reuseport=%t pktinfo=%t freebind=%t fastopen=%t flowlabel=%t",
+		c.ReusePort,
+		c.PktInfo,
+		c.FreeBind,
+		c.FastOpen,
+		c.FlowLabel,
+	)
+}
+
+// probeCapabilitiesOnce probes the socket options only once, since those don't
+// change while the process is running.
+var probeCapabilitiesOnce = sync.OnceValue(probeCapabilities)
+
+// Capabilities returns the socket options supported by the platform.  The
+// options are probed on a temporary socket on the first call.  It's safe for
+// concurrent use.
+func Capabilities() (caps SocketCapabilities) {
+	return probeCapabilitiesOnce()
+}
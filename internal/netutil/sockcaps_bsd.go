@@ -0,0 +1,16 @@
+//go:build unix && !linux
+
+package netutil
+
+import "golang.org/x/sys/unix"
+
+// These are the socket options probed by [probeCapabilities] on BSD-like
+// systems.  Binding to nonlocal addresses and TCP Fast Open either require
+// privileges or aren't supported consistently there, so those aren't probed.
+// The flow labels of IPv6 packets aren't configurable per socket there.
+const (
+	pktInfoOpt   = unix.IP_RECVDSTADDR
+	freeBindOpt  = 0
+	fastOpenOpt  = 0
+	flowLabelOpt = 0
+)
@@ -0,0 +1,13 @@
+//go:build linux
+
+package netutil
+
+import "golang.org/x/sys/unix"
+
+// These are the socket options probed by [probeCapabilities] on Linux.
+const (
+	pktInfoOpt   = unix.IP_PKTINFO
+	freeBindOpt  = unix.IP_FREEBIND
+	fastOpenOpt  = unix.TCP_FASTOPEN
+	flowLabelOpt = unix.IPV6_AUTOFLOWLABEL
+)
@@ -0,0 +1,29 @@
+//go:build linux
+
+package netutil_test
+
+import (
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/internal/netutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapabilities(t *testing.T) {
+	caps := netutil.Capabilities()
+
+	// SO_REUSEPORT and IP_PKTINFO are supported by all the kernels supported
+	// by Go.
+	assert.True(t, caps.ReusePort)
+	assert.True(t, caps.PktInfo)
+	assert.Equal(t, caps, netutil.Capabilities())
+}
+
+func TestSocketCapabilities_String(t *testing.T) {
+	caps := netutil.SocketCapabilities{
+		ReusePort: true,
+		FastOpen:  true,
+	}
+
+	assert.Equal(t, "reuseport=true pktinfo=false freebind=false fastopen=true flowlabel=false", caps.String())
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package netutil
+
+import "golang.org/x/sys/unix"
+
+// probeCapabilities returns the socket options, which can be set on a newly
+// created socket.
+func probeCapabilities() (caps SocketCapabilities) {
+	return SocketCapabilities{
+		ReusePort: probeSockopt(unix.AF_INET, unix.SOCK_STREAM, unix.SOL_SOCKET, unix.SO_REUSEPORT),
+		PktInfo:   probeSockopt(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_IP, pktInfoOpt),
+		FreeBind: freeBindOpt != 0 &&
+			probeSockopt(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_IP, freeBindOpt),
+		FastOpen: fastOpenOpt != 0 &&
+			probeSockopt(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP, fastOpenOpt),
+		FlowLabel: flowLabelOpt != 0 &&
+			probeSockopt(unix.AF_INET6, unix.SOCK_DGRAM, unix.IPPROTO_IPV6, flowLabelOpt),
+	}
+}
+
+// probeSockopt returns true if the socket option opt at level can be set to 1
+// on a socket of family and type typ.
+func probeSockopt(family, typ, level, opt int) (ok bool) {
+	fd, err := unix.Socket(family, typ, 0)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = unix.Close(fd) }()
+
+	return unix.SetsockoptInt(fd, level, opt, 1) == nil
+}
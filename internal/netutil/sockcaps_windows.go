@@ -0,0 +1,9 @@
+//go:build windows
+
+package netutil
+
+// probeCapabilities returns no socket options, since the listeners on Windows
+// use none of them.
+func probeCapabilities() (caps SocketCapabilities) {
+	return SocketCapabilities{}
+}
@@ -0,0 +1,98 @@
+package netutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// MaxDSCP is the maximum value of a Differentiated Services Code Point, which
+// occupies six bits.
+const MaxDSCP = 1<<6 - 1
+
+// DialControl returns a [net.Dialer.Control] function setting the SO_MARK
+// socket option to mark and the DSCP field of the outgoing packets to dscp.
+// The zero values aren't set, and if both are zero, control is nil.  dscp must
+// not be greater than [MaxDSCP].  SO_MARK is only supported on Linux, and
+// setting it usually requires the CAP_NET_ADMIN capability.
+//
+// Failing to set the options doesn't fail the dial, since the connection is
+// still usable, but the first failure is logged.  Use [ValidateDialControl] to
+// check the options beforehand.
+func DialControl(
+	mark uint32,
+	dscp uint8,
+) (control func(network, address string, c syscall.RawConn) (err error)) {
+	if mark == 0 && dscp == 0 {
+		return nil
+	}
+
+	warnOnce := &sync.Once{}
+
+	return func(network, _ string, c syscall.RawConn) (err error) {
+		var opErr error
+		err = c.Control(func(fd uintptr) {
+			opErr = setSockopts(fd, network, mark, dscp)
+		})
+		if opErr != nil {
+			warnOnce.Do(func() {
+				log.Info("netutil: warning: dialing %s: %s", network, opErr)
+			})
+		}
+
+		return err
+	}
+}
+
+// ValidateDialControl returns an error if the socket options set by the
+// function returned from [DialControl] with the same arguments can't be set on
+// this system.
+func ValidateDialControl(mark uint32, dscp uint8) (err error) {
+	if mark == 0 && dscp == 0 {
+		return nil
+	}
+
+	lc := &net.ListenConfig{
+		Control: func(network, _ string, c syscall.RawConn) (err error) {
+			var opErr error
+			err = c.Control(func(fd uintptr) {
+				opErr = setSockopts(fd, network, mark, dscp)
+			})
+
+			return errors.WithDeferred(opErr, err)
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	return conn.Close()
+}
+
+// setSockopts sets the SO_MARK socket option to mark and the DSCP to dscp on
+// the socket fd of network, skipping the zero values.
+func setSockopts(fd uintptr, network string, mark uint32, dscp uint8) (err error) {
+	if mark != 0 {
+		err = setMark(fd, mark)
+		if err != nil {
+			return fmt.Errorf("setting SO_MARK: %w", err)
+		}
+	}
+
+	if dscp != 0 {
+		err = setDSCP(fd, network, dscp)
+		if err != nil {
+			return fmt.Errorf("setting dscp: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build linux
+
+package netutil
+
+import "golang.org/x/sys/unix"
+
+// setMark sets the SO_MARK socket option of fd to mark.
+func setMark(fd uintptr, mark uint32) (err error) {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+}
+
+// setFlowLabel makes the kernel set a flow label derived from the flow on the
+// outgoing packets of the IPv6 socket fd.
+func setFlowLabel(fd uintptr) (err error) {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_AUTOFLOWLABEL, 1)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package netutil
+
+import "github.com/AdguardTeam/golibs/errors"
+
+// setMark returns an error, since SO_MARK is only supported on Linux.
+func setMark(_ uintptr, _ uint32) (err error) {
+	return errors.ErrUnsupported
+}
+
+// setFlowLabel returns an error, since the flow labels are only set on Linux.
+func setFlowLabel(_ uintptr) (err error) {
+	return errors.ErrUnsupported
+}
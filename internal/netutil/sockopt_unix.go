@@ -0,0 +1,20 @@
+//go:build unix
+
+package netutil
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDSCP sets the DSCP field of the packets sent through fd of network to
+// dscp.  The two least significant bits of the traffic class are left for ECN.
+func setDSCP(fd uintptr, network string, dscp uint8) (err error) {
+	tos := int(dscp) << 2
+	if strings.HasSuffix(network, "6") {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+	}
+
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+}
@@ -0,0 +1,48 @@
+//go:build unix
+
+package netutil_test
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/internal/netutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDialControl(t *testing.T) {
+	assert.Nil(t, netutil.DialControl(0, 0))
+
+	const dscp = 34
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	d := &net.Dialer{Control: netutil.DialControl(0, dscp)}
+	conn, err := d.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	require.NoError(t, err)
+
+	var tos int
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		tos, opErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+	})
+	require.NoError(t, err)
+	require.NoError(t, opErr)
+
+	assert.Equal(t, dscp<<2, tos)
+}
+
+func TestValidateDialControl(t *testing.T) {
+	assert.NoError(t, netutil.ValidateDialControl(0, 0))
+	assert.NoError(t, netutil.ValidateDialControl(0, 34))
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package netutil
+
+import "github.com/AdguardTeam/golibs/errors"
+
+// setDSCP returns an error, since Windows ignores the DSCP set by the
+// applications without the QoS policies.
+func setDSCP(_ uintptr, _ string, _ uint8) (err error) {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,394 @@
+// Package odoh implements the message format of Oblivious DNS over HTTPS, which
+// hides the client's identity from the resolver by encrypting the queries to
+// the target resolver's public key and relaying them through an oblivious
+// proxy.
+//
+// See RFC 9230.
+package odoh
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/bruceluk/dnsproxy/internal/hpke"
+)
+
+const (
+	// ContentType is the content type of the oblivious queries and responses.
+	ContentType = "application/oblivious-dns-message"
+
+	// ConfigsPath is the well-known path of the target's configurations.
+	ConfigsPath = "/.well-known/odohconfigs"
+
+	// ParamTargetHost is the query parameter of the proxy's URL with the host
+	// of the target.
+	ParamTargetHost = "targethost"
+
+	// ParamTargetPath is the query parameter of the proxy's URL with the path
+	// of the target's DNS endpoint.
+	ParamTargetPath = "targetpath"
+)
+
+const (
+	// configVersion is the only supported version of the configurations.
+	configVersion uint16 = 0x0001
+
+	// msgTypeQuery is the type of the oblivious queries.
+	msgTypeQuery uint8 = 0x01
+
+	// msgTypeResponse is the type of the oblivious responses.
+	msgTypeResponse uint8 = 0x02
+
+	// paddingBlock is the block size the plaintext queries are padded to, see
+	// RFC 8467.
+	paddingBlock = 128
+)
+
+// HPKE labels used to derive the secrets.
+const (
+	labelQuery    = "odoh query"
+	labelResponse = "odoh response"
+	labelKeyID    = "odoh key id"
+	labelKey      = "odoh key"
+	labelNonce    = "odoh nonce"
+)
+
+const (
+	// ErrNoConfig is returned when there are no supported configurations.
+	ErrNoConfig errors.Error = "no supported configurations"
+
+	// ErrKeyID is returned when the key ID of a query doesn't match the
+	// configuration.
+	ErrKeyID errors.Error = "key id mismatch"
+
+	// errShort is returned when a message is truncated.
+	errShort errors.Error = "message is too short"
+)
+
+// Config is a target's configuration, ObliviousDoHConfigContents.
+type Config struct {
+	// PublicKey is the target's raw public key.
+	PublicKey []byte
+
+	// Suite is the HPKE cipher suite of the target.
+	Suite hpke.Suite
+}
+
+// contents returns the serialized contents of c.
+func (c *Config) contents() (b []byte) {
+	b = binary.BigEndian.AppendUint16(b, uint16(c.Suite.KEM))
+	b = binary.BigEndian.AppendUint16(b, uint16(c.Suite.KDF))
+	b = binary.BigEndian.AppendUint16(b, uint16(c.Suite.AEAD))
+
+	return appendVec16(b, c.PublicKey)
+}
+
+// KeyID returns the identifier of the target's key, which is derived from c.
+func (c *Config) KeyID() (id []byte) {
+	return hpke.Expand(hpke.Extract(nil, c.contents()), []byte(labelKeyID), hpke.HashSize)
+}
+
+// MarshalConfigs returns the serialized ObliviousDoHConfigs containing confs.
+func MarshalConfigs(confs ...*Config) (b []byte) {
+	var list []byte
+	for _, c := range confs {
+		list = binary.BigEndian.AppendUint16(list, configVersion)
+		list = appendVec16(list, c.contents())
+	}
+
+	return appendVec16(nil, list)
+}
+
+// ParseConfigs returns the configurations with the supported version and
+// cipher suite from the serialized ObliviousDoHConfigs b in the order of the
+// target's preference.  It returns [ErrNoConfig] if there are none.
+func ParseConfigs(b []byte) (confs []*Config, err error) {
+	list, rest, err := readVec16(b)
+	if err != nil {
+		return nil, fmt.Errorf("reading configs: %w", err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(rest))
+	}
+
+	for len(list) > 0 {
+		if len(list) < 2 {
+			return nil, errShort
+		}
+
+		version := binary.BigEndian.Uint16(list)
+
+		var contents []byte
+		contents, list, err = readVec16(list[2:])
+		if err != nil {
+			return nil, fmt.Errorf("reading config: %w", err)
+		} else if version != configVersion {
+			continue
+		}
+
+		c, parseErr := parseContents(contents)
+		if parseErr != nil {
+			return nil, fmt.Errorf("reading config contents: %w", parseErr)
+		} else if c.Suite.Supported() {
+			confs = append(confs, c)
+		}
+	}
+
+	if len(confs) == 0 {
+		return nil, ErrNoConfig
+	}
+
+	return confs, nil
+}
+
+// parseContents parses the serialized ObliviousDoHConfigContents.
+func parseContents(b []byte) (c *Config, err error) {
+	if len(b) < 6 {
+		return nil, errShort
+	}
+
+	c = &Config{
+		Suite: hpke.Suite{
+			KEM:  hpke.KEM(binary.BigEndian.Uint16(b)),
+			KDF:  hpke.KDF(binary.BigEndian.Uint16(b[2:])),
+			AEAD: hpke.AEAD(binary.BigEndian.Uint16(b[4:])),
+		},
+	}
+
+	c.PublicKey, _, err = readVec16(b[6:])
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// QueryContext is the client's state needed to decrypt the response to a query
+// encrypted with [EncryptQuery].
+type QueryContext struct {
+	hctx  *hpke.Context
+	plain []byte
+	suite hpke.Suite
+}
+
+// EncryptQuery encrypts the DNS message msg to the target of c and returns the
+// serialized ObliviousDoHMessage.
+func EncryptQuery(c *Config, msg []byte) (data []byte, qctx *QueryContext, err error) {
+	enc, hctx, err := hpke.SetupBaseS(c.Suite, c.PublicKey, []byte(labelQuery))
+	if err != nil {
+		return nil, nil, fmt.Errorf("setting up hpke: %w", err)
+	}
+
+	padLen := paddingBlock - len(msg)%paddingBlock
+	plain := appendVec16(appendVec16(nil, msg), make([]byte, padLen))
+
+	keyID := c.KeyID()
+	ct := hctx.Seal(messageAAD(msgTypeQuery, keyID), plain)
+	data = marshalMessage(msgTypeQuery, keyID, append(enc, ct...))
+
+	return data, &QueryContext{hctx: hctx, plain: plain, suite: c.Suite}, nil
+}
+
+// DecryptResponse decrypts the serialized ObliviousDoHMessage data containing
+// the response to the query of q and returns the DNS message.
+func (q *QueryContext) DecryptResponse(data []byte) (msg []byte, err error) {
+	nonce, ct, err := parseMessage(data, msgTypeResponse)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	plain, err := openResponse(q.hctx, q.suite, q.plain, nonce, ct)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting response: %w", err)
+	}
+
+	return unpad(plain)
+}
+
+// ResponseContext is the target's state needed to encrypt the response to a
+// query decrypted with [DecryptQuery].
+type ResponseContext struct {
+	hctx  *hpke.Context
+	plain []byte
+	suite hpke.Suite
+}
+
+// DecryptQuery decrypts the serialized ObliviousDoHMessage data with the
+// target's configuration c and private key sk and returns the DNS message.  It
+// returns [ErrKeyID] if the query is encrypted to another key.
+func DecryptQuery(
+	c *Config,
+	sk *ecdh.PrivateKey,
+	data []byte,
+) (msg []byte, rctx *ResponseContext, err error) {
+	keyID, encrypted, err := parseMessage(data, msgTypeQuery)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, nil, err
+	} else if !bytes.Equal(keyID, c.KeyID()) {
+		return nil, nil, ErrKeyID
+	}
+
+	encLen := len(c.PublicKey)
+	if len(encrypted) < encLen {
+		return nil, nil, errShort
+	}
+
+	hctx, err := hpke.SetupBaseR(c.Suite, encrypted[:encLen], sk, []byte(labelQuery))
+	if err != nil {
+		return nil, nil, fmt.Errorf("setting up hpke: %w", err)
+	}
+
+	plain, err := hctx.Open(messageAAD(msgTypeQuery, keyID), encrypted[encLen:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("decrypting query: %w", err)
+	}
+
+	msg, err = unpad(plain)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, nil, err
+	}
+
+	return msg, &ResponseContext{hctx: hctx, plain: plain, suite: c.Suite}, nil
+}
+
+// EncryptResponse encrypts the DNS message msg responding to the query of r and
+// returns the serialized ObliviousDoHMessage.
+func (r *ResponseContext) EncryptResponse(msg []byte) (data []byte, err error) {
+	nonce := make([]byte, max(r.suite.AEAD.KeySize(), r.suite.AEAD.NonceSize()))
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	aead, aeadNonce, err := responseKey(r.hctx, r.suite, r.plain, nonce)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	plain := appendVec16(appendVec16(nil, msg), nil)
+	ct := aead.Seal(nil, aeadNonce, plain, messageAAD(msgTypeResponse, nonce))
+
+	return marshalMessage(msgTypeResponse, nonce, ct), nil
+}
+
+// openResponse decrypts the encrypted response ct using the HPKE context of
+// the query, its plaintext, and the response nonce.
+func openResponse(
+	hctx *hpke.Context,
+	suite hpke.Suite,
+	queryPlain []byte,
+	nonce []byte,
+	ct []byte,
+) (plain []byte, err error) {
+	aead, aeadNonce, err := responseKey(hctx, suite, queryPlain, nonce)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return aead.Open(nil, aeadNonce, ct, messageAAD(msgTypeResponse, nonce))
+}
+
+// responseKey derives the AEAD and its nonce to encrypt the response from the
+// HPKE context of the query, its plaintext, and the response nonce.
+func responseKey(
+	hctx *hpke.Context,
+	suite hpke.Suite,
+	queryPlain []byte,
+	nonce []byte,
+) (aead cipher.AEAD, aeadNonce []byte, err error) {
+	keySize := suite.AEAD.KeySize()
+	secret := hctx.Export([]byte(labelResponse), keySize)
+	salt := appendVec16(append([]byte{}, queryPlain...), nonce)
+	prk := hpke.Extract(salt, secret)
+
+	aead, err = suite.AEAD.New(hpke.Expand(prk, []byte(labelKey), keySize))
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, nil, err
+	}
+
+	return aead, hpke.Expand(prk, []byte(labelNonce), suite.AEAD.NonceSize()), nil
+}
+
+// messageAAD returns the additional authenticated data of a message of type
+// typ with the key ID or the response nonce.
+func messageAAD(typ uint8, keyID []byte) (aad []byte) {
+	return appendVec16([]byte{typ}, keyID)
+}
+
+// marshalMessage returns the serialized ObliviousDoHMessage.
+func marshalMessage(typ uint8, keyID, encrypted []byte) (b []byte) {
+	return appendVec16(appendVec16([]byte{typ}, keyID), encrypted)
+}
+
+// parseMessage parses the serialized ObliviousDoHMessage b of type typ.
+func parseMessage(b []byte, typ uint8) (keyID, encrypted []byte, err error) {
+	if len(b) < 1 {
+		return nil, nil, errShort
+	} else if b[0] != typ {
+		return nil, nil, fmt.Errorf("message type: got %d, want %d", b[0], typ)
+	}
+
+	keyID, rest, err := readVec16(b[1:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading key id: %w", err)
+	}
+
+	encrypted, rest, err = readVec16(rest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading encrypted message: %w", err)
+	} else if len(rest) > 0 {
+		return nil, nil, fmt.Errorf("%d trailing bytes", len(rest))
+	}
+
+	return keyID, encrypted, nil
+}
+
+// unpad returns the DNS message of the serialized
+// ObliviousDoHMessagePlaintext b.
+func unpad(b []byte) (msg []byte, err error) {
+	msg, rest, err := readVec16(b)
+	if err != nil {
+		return nil, fmt.Errorf("reading dns message: %w", err)
+	}
+
+	padding, rest, err := readVec16(rest)
+	if err != nil {
+		return nil, fmt.Errorf("reading padding: %w", err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(rest))
+	} else if bytes.Count(padding, []byte{0}) != len(padding) {
+		return nil, errors.Error("non-zero padding")
+	}
+
+	return msg, nil
+}
+
+// appendVec16 appends v prefixed with its 16-bit length to b.
+func appendVec16(b, v []byte) (res []byte) {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(v))), v...)
+}
+
+// readVec16 reads a vector prefixed with its 16-bit length from b.
+func readVec16(b []byte) (v, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, errShort
+	}
+
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, errShort
+	}
+
+	return b[2 : 2+n], b[2+n:], nil
+}
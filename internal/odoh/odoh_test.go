@@ -0,0 +1,95 @@
+package odoh_test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/internal/hpke"
+	"github.com/bruceluk/dnsproxy/internal/odoh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConfig returns a new configuration of the target with the specified
+// AEAD and its private key.
+func newTestConfig(t *testing.T, aead hpke.AEAD) (c *odoh.Config, sk *ecdh.PrivateKey) {
+	t.Helper()
+
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	return &odoh.Config{
+		PublicKey: sk.PublicKey().Bytes(),
+		Suite: hpke.Suite{
+			KEM:  hpke.KEMX25519HKDFSHA256,
+			KDF:  hpke.KDFHKDFSHA256,
+			AEAD: aead,
+		},
+	}, sk
+}
+
+func TestParseConfigs(t *testing.T) {
+	c128, _ := newTestConfig(t, hpke.AEADAES128GCM)
+	c256, _ := newTestConfig(t, hpke.AEADAES256GCM)
+	unsupported, _ := newTestConfig(t, 0x0003)
+
+	confs, err := odoh.ParseConfigs(odoh.MarshalConfigs(unsupported, c256, c128))
+	require.NoError(t, err)
+
+	assert.Equal(t, []*odoh.Config{c256, c128}, confs)
+
+	_, err = odoh.ParseConfigs(odoh.MarshalConfigs(unsupported))
+	assert.ErrorIs(t, err, odoh.ErrNoConfig)
+
+	// Replace the version of the only configuration with an unknown one.
+	data := odoh.MarshalConfigs(c128)
+	binary.BigEndian.PutUint16(data[2:], 0xff03)
+
+	_, err = odoh.ParseConfigs(data)
+	assert.ErrorIs(t, err, odoh.ErrNoConfig)
+
+	_, err = odoh.ParseConfigs(data[:len(data)-1])
+	assert.Error(t, err)
+}
+
+func TestEncryptQuery(t *testing.T) {
+	for _, aead := range []hpke.AEAD{hpke.AEADAES128GCM, hpke.AEADAES256GCM} {
+		c, sk := newTestConfig(t, aead)
+
+		query, qctx, err := odoh.EncryptQuery(c, []byte("query"))
+		require.NoError(t, err)
+
+		msg, rctx, err := odoh.DecryptQuery(c, sk, query)
+		require.NoError(t, err)
+
+		assert.Equal(t, "query", string(msg))
+
+		resp, err := rctx.EncryptResponse([]byte("response"))
+		require.NoError(t, err)
+
+		msg, err = qctx.DecryptResponse(resp)
+		require.NoError(t, err)
+
+		assert.Equal(t, "response", string(msg))
+
+		// The response to another query can't be decrypted.
+		_, otherCtx, err := odoh.EncryptQuery(c, []byte("query"))
+		require.NoError(t, err)
+
+		_, err = otherCtx.DecryptResponse(resp)
+		assert.Error(t, err)
+	}
+}
+
+func TestDecryptQuery_keyID(t *testing.T) {
+	c, _ := newTestConfig(t, hpke.AEADAES128GCM)
+	rotated, sk := newTestConfig(t, hpke.AEADAES128GCM)
+
+	query, _, err := odoh.EncryptQuery(c, []byte("query"))
+	require.NoError(t, err)
+
+	_, _, err = odoh.DecryptQuery(rotated, sk, query)
+	assert.ErrorIs(t, err, odoh.ErrKeyID)
+}
@@ -3,7 +3,9 @@ package main
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"net/http"
@@ -12,20 +14,36 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/osutil"
 	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/bruceluk/dnsproxy/fastip"
+	"github.com/bruceluk/dnsproxy/idn"
 	proxynetutil "github.com/bruceluk/dnsproxy/internal/netutil"
 	"github.com/bruceluk/dnsproxy/internal/version"
+	"github.com/bruceluk/dnsproxy/mgmt"
+	"github.com/bruceluk/dnsproxy/mirror"
+	"github.com/bruceluk/dnsproxy/plugin"
+	"github.com/bruceluk/dnsproxy/profile"
 	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/bruceluk/dnsproxy/quota"
+	"github.com/bruceluk/dnsproxy/rdnss"
+	"github.com/bruceluk/dnsproxy/rpz"
+	"github.com/bruceluk/dnsproxy/slo"
+	"github.com/bruceluk/dnsproxy/tunnel"
 	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/bruceluk/dnsproxy/zone"
 	goFlags "github.com/jessevdk/go-flags"
+	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 )
 
@@ -57,12 +75,49 @@ type Options struct {
 	// basic authentication information.
 	HTTPSUserinfo string `yaml:"https-userinfo" long:"https-userinfo" description:"If set, all DoH queries are required to have this basic authentication information."`
 
+	// TrustedProxies are the CIDRs of the reverse proxies allowed to set the
+	// real client address for DoH requests via the HTTP headers, such as
+	// X-Forwarded-For or Forwarded.
+	TrustedProxies []string `yaml:"trusted-proxy" long:"trusted-proxy" description:"CIDR of a reverse proxy allowed to pass the real client address for DoH requests in X-Forwarded-For, Forwarded, and similar headers.  Can be specified multiple times (default: any address)"`
+
+	// ClientAddrProxies are the CIDRs of the chained proxies allowed to pass
+	// the original client address in an EDNS0 option.
+	ClientAddrProxies []string `yaml:"client-addr-proxy" long:"client-addr-proxy" description:"CIDR of a chained dnsproxy instance allowed to pass the original client address in an EDNS0 option.  Can be specified multiple times (default: none)"`
+
+	// ForwardClientAddr makes the proxy pass the client address to the
+	// upstreams in an EDNS0 option.
+	ForwardClientAddr bool `yaml:"forward-client-addr" long:"forward-client-addr" description:"If specified, pass the client address to the upstreams in an EDNS0 option.  Only use with trusted upstreams, such as other dnsproxy instances" optional:"yes" optional-value:"true"`
+
 	// DNSCryptConfigPath is the path to the DNSCrypt configuration file.
 	DNSCryptConfigPath string `yaml:"dnscrypt-config" short:"g" long:"dnscrypt-config" description:"Path to a file with DNSCrypt configuration. You can generate one using https://github.com/ameshkov/dnscrypt"`
 
 	// EDNSAddr is the custom EDNS Client Address to send.
 	EDNSAddr string `yaml:"edns-addr" long:"edns-addr" description:"Send EDNS Client Address"`
 
+	// EDNSSubnetLenIPv4 is the length of the IPv4 subnet of the client sent in
+	// the EDNS Client Subnet option.
+	EDNSSubnetLenIPv4 int `yaml:"edns-subnet-len-ipv4" long:"edns-subnet-len-ipv4" description:"Length of the IPv4 subnet of the client sent in the EDNS Client Subnet option" default:"24"`
+
+	// EDNSSubnetLenIPv6 is the length of the IPv6 subnet of the client sent in
+	// the EDNS Client Subnet option.
+	EDNSSubnetLenIPv6 int `yaml:"edns-subnet-len-ipv6" long:"edns-subnet-len-ipv6" description:"Length of the IPv6 subnet of the client sent in the EDNS Client Subnet option" default:"56"`
+
+	// EDNSClientPolicies is the list of per-client EDNS Client Subnet policies
+	// in the POLICY:SUBNET format.
+	EDNSClientPolicies []string `yaml:"edns-client-policies" long:"edns-client-policy" description:"Per-client EDNS Client Subnet policy in the POLICY:SUBNET format, where POLICY is one of default, strip, truncate, or pass.  Can be specified multiple times."`
+
+	// AddrPreferences is the list of per-client preferences of the address
+	// families in responses in the PREFERENCE:SUBNET format.
+	AddrPreferences []string `yaml:"addr-preferences" long:"addr-preference" description:"Per-client preference of the address families in responses in the PREFERENCE:SUBNET format, where PREFERENCE is one of default, prefer-ipv4, prefer-ipv6, ipv4-only, or ipv6-only.  Can be specified multiple times."`
+
+	// AddrShuffle is the mode of changing the order of the address records in
+	// responses.
+	AddrShuffle string `yaml:"addr-shuffle" long:"addr-shuffle" description:"Change the order of the A and AAAA records in responses, including the cached ones.  One of none, round-robin, or random.  Default: none"`
+
+	// VirtualResolvers is the list of DNS-over-TLS and DNS-over-HTTPS virtual
+	// resolvers in the SERVERNAME|CERT|KEY|UPSTREAM[|UPSTREAM...] format.
+	VirtualResolvers []string `yaml:"virtual-resolvers" long:"virtual-resolver" description:"DNS-over-TLS and DNS-over-HTTPS resolver selected by the TLS server name or the HTTP host in the SERVERNAME|CERT|KEY|UPSTREAM[|UPSTREAM...] format.  Empty CERT and KEY mean the --tls-crt and --tls-key ones.  Can be specified multiple times."`
+
 	// ListenAddrs is the list of server's listen addresses.
 	ListenAddrs []string `yaml:"listen-addrs" short:"l" long:"listen" description:"Listening addresses"`
 
@@ -72,6 +127,13 @@ type Options struct {
 	// HTTPSListenPorts are the ports server listens on for DNS-over-HTTPS.
 	HTTPSListenPorts []int `yaml:"https-port" short:"s" long:"https-port" description:"Listening ports for DNS-over-HTTPS"`
 
+	// HTTPListenPorts are the ports server listens on for DNS-over-HTTPS
+	// without TLS.
+	HTTPListenPorts []int `yaml:"http-port" long:"http-port" description:"Listening ports for DNS-over-HTTPS without TLS.  Only use behind a trusted reverse proxy terminating TLS"`
+
+	// GRPCListenPorts are the ports server listens on for DNS-over-gRPC.
+	GRPCListenPorts []int `yaml:"grpc-port" long:"grpc-port" description:"Listening ports for DNS-over-gRPC, over TLS if the certificate is set"`
+
 	// TLSListenPorts are the ports server listens on for DNS-over-TLS.
 	TLSListenPorts []int `yaml:"tls-port" short:"t" long:"tls-port" description:"Listening ports for DNS-over-TLS"`
 
@@ -81,6 +143,10 @@ type Options struct {
 	// DNSCryptListenPorts are the ports server listens on for DNSCrypt.
 	DNSCryptListenPorts []int `yaml:"dnscrypt-port" short:"y" long:"dnscrypt-port" description:"Listening ports for DNSCrypt"`
 
+	// ListenRebindInterval is the interval of checking the listen addresses
+	// to rebind the listeners once they reappear.  Zero disables checking.
+	ListenRebindInterval timeutil.Duration `yaml:"listen-rebind-interval" long:"listen-rebind-interval" description:"Interval of checking the listening addresses in a human-readable form to rebind the plain DNS listeners once the addresses reappear on the interfaces.  Zero disables checking"`
+
 	// Upstreams is the list of DNS upstream servers.
 	Upstreams []string `yaml:"upstream" short:"u" long:"upstream" description:"An upstream to be used (can be specified multiple times). You can also specify path to a file with the list of servers" optional:"false"`
 
@@ -90,6 +156,22 @@ type Options struct {
 	// Fallbacks is the list of fallback DNS upstream servers.
 	Fallbacks []string `yaml:"fallback" short:"f" long:"fallback" description:"Fallback resolvers to use when regular ones are unavailable, can be specified multiple times. You can also specify path to a file with the list of servers"`
 
+	// UpstreamGroups are the named groups of upstreams the requests are routed
+	// to by UpstreamRoutes.  It's only configurable in the YAML file.
+	UpstreamGroups []*upstreamGroupOptions `yaml:"upstream-groups" no-flag:"true"`
+
+	// UpstreamRoutes route the requests to UpstreamGroups.  It's only
+	// configurable in the YAML file.
+	UpstreamRoutes []*upstreamRouteOptions `yaml:"upstream-routes" no-flag:"true"`
+
+	// SecondaryZones are the zones served locally as a secondary nameserver.
+	// It's only configurable in the YAML file.
+	SecondaryZones []*secondaryZoneOptions `yaml:"secondary-zones" no-flag:"true"`
+
+	// RootFallback makes the proxy resolve the requests iteratively from the
+	// root servers when all the upstreams fail.
+	RootFallback bool `yaml:"root-fallback" long:"root-fallback" description:"If specified, resolve A, AAAA, CNAME, and PTR requests iteratively from the root servers when all the upstreams fail" optional:"yes" optional-value:"true"`
+
 	// PrivateRDNSUpstreams are upstreams to use for reverse DNS lookups of
 	// private addresses, including the requests for authority records, such as
 	// SOA and NS.
@@ -100,6 +182,9 @@ type Options struct {
 	// Well-Known Prefix.  This option can be specified multiple times.
 	DNS64Prefix []string `yaml:"dns64-prefix" long:"dns64-prefix" description:"Prefix used to handle DNS64. If not specified, dnsproxy uses the 'Well-Known Prefix' 64:ff9b::.  Can be specified multiple times" required:"false"`
 
+	// DNS64Exclude defines the DNS64 exclusion ranges.
+	DNS64Exclude []string `yaml:"dns64-exclude" long:"dns64-exclude" description:"DNS64 exclusion range.  AAAA answers within the IPv6 ranges are ignored, and A answers within the IPv4 ones aren't synthesized.  Default: ::ffff:0:0/96.  Can be specified multiple times"`
+
 	// PrivateSubnets is the list of private subnets to determine private
 	// addresses.
 	PrivateSubnets []string `yaml:"private-subnets" long:"private-subnets" description:"Private subnets to use for reverse DNS lookups of private addresses" required:"false"`
@@ -111,10 +196,86 @@ type Options struct {
 	// go-flags doesn't support text unmarshalers.
 	BogusNXDomain []string `yaml:"bogus-nxdomain" long:"bogus-nxdomain" description:"Transform the responses containing at least a single IP that matches specified addresses and CIDRs into NXDOMAIN.  Can be specified multiple times."`
 
+	// Plugins are the command lines of the external plugin processes.
+	Plugins []string `yaml:"plugins" long:"plugin" description:"Command line of an external filtering plugin process.  Can be specified multiple times."`
+
+	// RPZFiles are the response policy zones loaded from files in the format
+	// of "<zone>:<path>".
+	RPZFiles []string `yaml:"rpz-file" long:"rpz-file" description:"Response policy zone to load from a file in the format <zone>:<path>.  Can be specified multiple times."`
+
+	// RPZPrimaries are the response policy zones transferred from the primary
+	// servers in the format of "<zone>@<address>".
+	RPZPrimaries []string `yaml:"rpz-primary" long:"rpz-primary" description:"Response policy zone to transfer from a primary server in the format <zone>@<ip:port>.  Can be specified multiple times."`
+
+	// RPZRefreshInterval is the interval of refreshing the response policy
+	// zones.
+	RPZRefreshInterval timeutil.Duration `yaml:"rpz-refresh-interval" long:"rpz-refresh-interval" description:"Interval of reloading or transferring the response policy zones in a human-readable form.  Zero disables refreshing" default:"1h"`
+
+	// IDNHomoglyph is the policy for the requests for internationalized domain
+	// names mixing several scripts.
+	IDNHomoglyph string `yaml:"idn-homoglyph" long:"idn-homoglyph" description:"Policy for the internationalized domain names mixing several scripts: none, flag, or block" default:"none"`
+
+	// TLSSessionCache is the path to the file to persist the TLS sessions of
+	// the encrypted upstreams to.
+	TLSSessionCache string `yaml:"tls-session-cache" long:"tls-session-cache" description:"Path to the file to persist the TLS sessions of the encrypted upstreams to, so that they are resumed after restarts"`
+
+	// DNSCryptCache is the path to the file to persist the certificates and
+	// the shared keys of the DNSCrypt upstreams to.
+	DNSCryptCache string `yaml:"dnscrypt-cache" long:"dnscrypt-cache" description:"Path to the file to persist the certificates and the shared keys of the DNSCrypt upstreams to, so that they aren't fetched again after restarts"`
+
+	// StateFile is the path to the file to persist the runtime state of the
+	// proxy to.
+	StateFile string `yaml:"state-file" long:"state-file" description:"Path to the file to save the cache, the upstream statistics, and the rate limiter state to on shutdown and to restore them from on start"`
+
 	// Timeout for outbound DNS queries to remote upstream servers in a
 	// human-readable form.  Default is 10s.
 	Timeout timeutil.Duration `yaml:"timeout" long:"timeout" description:"Timeout for outbound DNS queries to remote upstream servers in a human-readable form" default:"10s"`
 
+	// SpoofWindow is the time to keep reading from the sockets of the plain
+	// UDP upstreams after the first response to detect the spoofed ones.
+	SpoofWindow timeutil.Duration `yaml:"spoof-window" long:"spoof-window" description:"Time to wait for a different response with the same ID after the first one from plain UDP upstreams to detect spoofing, in a human-readable form (default: disabled)"`
+
+	// SpoofPreferLater makes the plain UDP upstreams return the later of the
+	// different responses.
+	SpoofPreferLater bool `yaml:"spoof-prefer-later" long:"spoof-prefer-later" description:"If specified, wait for the whole spoof window and use the later of the different responses, which delays all UDP responses" optional:"yes" optional-value:"true"`
+
+	// UDPPoolSize is the maximum number of the UDP sockets reused across the
+	// queries to each plain UDP upstream.
+	UDPPoolSize int `yaml:"udp-pool-size" long:"udp-pool-size" description:"Maximum number of UDP sockets kept open and reused across the queries to each plain UDP upstream instead of a socket per query, which reduces the ephemeral port and conntrack usage.  Not used with --spoof-window.  Default: 0 (disabled)"`
+
+	// HedgeRequests makes the proxy hedge the requests to the slow upstreams.
+	HedgeRequests bool `yaml:"hedge" long:"hedge" description:"If specified, also send the request to another upstream if the chosen one hasn't responded within the 95th percentile of its latency, in the load-balancing mode only" optional:"yes" optional-value:"true"`
+
+	// UpstreamMark is the SO_MARK set on the sockets of the upstreams.
+	UpstreamMark uint32 `yaml:"upstream-mark" long:"upstream-mark" description:"SO_MARK to set on the sockets of the upstreams for the policy routing, Linux only.  Default: 0 (not set)"`
+
+	// UpstreamDSCP is the DSCP set on the packets sent to the upstreams.
+	UpstreamDSCP uint8 `yaml:"upstream-dscp" long:"upstream-dscp" description:"DSCP to set on the packets sent to the upstreams for QoS, between 0 and 63.  Default: 0 (not set)"`
+
+	// UpstreamMaxIdleConns is the maximum number of the idle connections kept
+	// by each DNS-over-TLS and DNS-over-HTTPS upstream.
+	UpstreamMaxIdleConns int `yaml:"upstream-max-idle-conns" long:"upstream-max-idle-conns" description:"Maximum number of the idle connections kept for reuse by each DNS-over-TLS and DNS-over-HTTPS upstream.  Default: unlimited for DNS-over-TLS and 2 for DNS-over-HTTPS"`
+
+	// TCPFastOpen enables TCP Fast Open on the TCP and TLS listeners and for
+	// the TCP connections to the upstreams.
+	TCPFastOpen bool `yaml:"tcp-fast-open" long:"tcp-fast-open" description:"If specified, enable TCP Fast Open on the TCP and TLS listeners and for the TCP connections to the upstreams, where the platform supports it" optional:"yes" optional-value:"true"`
+
+	// QUICFlowLabels makes the kernel set stable flow labels on the IPv6
+	// packets of the DNS-over-QUIC and DNS-over-HTTP/3 listeners.
+	QUICFlowLabels bool `yaml:"quic-flow-labels" long:"quic-flow-labels" description:"If specified, set stable flow labels on the IPv6 packets sent by the DNS-over-QUIC and DNS-over-HTTP/3 listeners, where the platform supports it" optional:"yes" optional-value:"true"`
+
+	// DNSSECSignKeys are the paths to the zone signing keys generated by
+	// dnssec-keygen without the extensions.
+	DNSSECSignKeys []string `yaml:"dnssec-sign-key" long:"dnssec-sign-key" description:"Zone signing key to sign the locally generated responses within its zone with, as the path to the .key and .private files generated by dnssec-keygen without the extensions.  Can be specified multiple times"`
+
+	// DNSSECSignValidity is the validity period of the signatures made with
+	// DNSSECSignKeys.
+	DNSSECSignValidity timeutil.Duration `yaml:"dnssec-sign-validity" long:"dnssec-sign-validity" description:"Validity period of the signatures made with --dnssec-sign-key, in a human-readable form.  Default: 24h"`
+
+	// UpstreamPortRange is the range of the local ports of the UDP sockets of
+	// the upstreams.
+	UpstreamPortRange string `yaml:"upstream-port-range" long:"upstream-port-range" description:"Range of the local ports to bind the UDP sockets of the plain upstreams to, e.g. 40000-49999, with at least 1024 ports.  Default: any ephemeral port"`
+
 	// CacheMinTTL is the minimum TTL value for caching DNS entries, in seconds.
 	// It overrides the TTL value from the upstream server, if the one is less.
 	CacheMinTTL uint32 `yaml:"cache-min-ttl" long:"cache-min-ttl" description:"Minimum TTL value for DNS entries, in seconds. Capped at 3600. Artificially extending TTLs should only be done with careful consideration."`
@@ -124,9 +285,42 @@ type Options struct {
 	// greater.
 	CacheMaxTTL uint32 `yaml:"cache-max-ttl" long:"cache-max-ttl" description:"Maximum TTL value for DNS entries, in seconds."`
 
+	// CacheNegativeMinTTL is the minimum TTL value for caching NXDOMAIN and
+	// NODATA responses, in seconds.
+	CacheNegativeMinTTL uint32 `yaml:"cache-negative-min-ttl" long:"cache-negative-min-ttl" description:"Minimum TTL value for NXDOMAIN and NODATA responses, which is otherwise derived from the SOA record as RFC 2308 describes, in seconds."`
+
+	// CacheNegativeMaxTTL is the maximum TTL value for caching NXDOMAIN and
+	// NODATA responses, in seconds.
+	CacheNegativeMaxTTL uint32 `yaml:"cache-negative-max-ttl" long:"cache-negative-max-ttl" description:"Maximum TTL value for NXDOMAIN and NODATA responses, in seconds.  Default: 0 (no limit)"`
+
 	// CacheSizeBytes is the cache size in bytes.  Default is 64k.
 	CacheSizeBytes int `yaml:"cache-size" long:"cache-size" description:"Cache size (in bytes). Default: 64k"`
 
+	// CacheLowWatermark is the cache size in bytes the eviction shrinks the
+	// cache to once it's full.
+	CacheLowWatermark int `yaml:"cache-low-watermark" long:"cache-low-watermark" description:"Cache size (in bytes) to evict the items down to once the cache is full, the expired ones first. Default: 7/8 of --cache-size"`
+
+	// CacheCompressMinSize is the minimum size of a cached response in bytes to
+	// store it compressed.  Zero disables compression.
+	CacheCompressMinSize int `yaml:"cache-compress-min-size" long:"cache-compress-min-size" description:"Minimum size of a cached response (in bytes) to store it compressed, which fits more responses into the cache. Default: 0 (disabled)"`
+
+	// CacheServeStale is the maximum time the expired cached responses are
+	// served for when the upstreams fail.  Zero disables serving them.
+	CacheServeStale timeutil.Duration `yaml:"cache-serve-stale" long:"cache-serve-stale" description:"Maximum time to serve the expired cached responses for when the upstreams fail, in a human-readable form.  Default: 0 (disabled)"`
+
+	// CacheStaleTTL is the TTL of the stale responses.
+	CacheStaleTTL timeutil.Duration `yaml:"cache-stale-ttl" long:"cache-stale-ttl" description:"TTL of the stale responses served with --cache-serve-stale, in a human-readable form.  Default: 30s"`
+
+	// ZeroTTLFloor is the minimum TTL the zero TTLs of the responses for
+	// ZeroTTLFloorDomains are raised to.
+	ZeroTTLFloor timeutil.Duration `yaml:"zero-ttl-floor" long:"zero-ttl-floor" description:"Minimum TTL to raise the zero TTLs in the responses for --zero-ttl-floor-domain to, in a human-readable form.  Default: 0 (zero TTLs are honored)"`
+
+	// ZeroTTLFloorJitter is the maximum random time added to ZeroTTLFloor.
+	ZeroTTLFloorJitter timeutil.Duration `yaml:"zero-ttl-floor-jitter" long:"zero-ttl-floor-jitter" description:"Maximum random time added to --zero-ttl-floor, in a human-readable form.  Default: 0"`
+
+	// ZeroTTLFloorDomains are the domains which zero TTLs are raised.
+	ZeroTTLFloorDomains []string `yaml:"zero-ttl-floor-domain" long:"zero-ttl-floor-domain" description:"Raise the zero TTLs in the responses for this domain and its subdomains to --zero-ttl-floor.  Can be specified multiple times"`
+
 	// Ratelimit is the maximum number of requests per second.
 	Ratelimit int `yaml:"ratelimit" short:"r" long:"ratelimit" description:"Ratelimit (requests per second)"`
 
@@ -138,6 +332,52 @@ type Options struct {
 	// rate limiting requests.
 	RatelimitSubnetLenIPv6 int `yaml:"ratelimit-subnet-len-ipv6" long:"ratelimit-subnet-len-ipv6" description:"Ratelimit subnet length for IPv6." default:"56"`
 
+	// QuotaHourly is the maximum number of requests from a client per hour.
+	QuotaHourly uint64 `yaml:"quota-hourly" long:"quota-hourly" description:"Maximum number of requests from a single client per hour. Default: 0 (unlimited)"`
+
+	// QuotaDaily is the maximum number of requests from a client per day.
+	QuotaDaily uint64 `yaml:"quota-daily" long:"quota-daily" description:"Maximum number of requests from a single client per UTC day. Default: 0 (unlimited)"`
+
+	// QuotaAction is the behavior for the requests of the clients over their
+	// quota.
+	QuotaAction string `yaml:"quota-action" long:"quota-action" description:"Behavior for the requests of the clients over their quota: refuse or throttle" default:"refuse"`
+
+	// QuotaThrottle is the number of requests per second processed for a
+	// client over its quota with the throttle action.
+	QuotaThrottle int `yaml:"quota-throttle" long:"quota-throttle" description:"Requests per second processed for a client over its quota with the throttle action" default:"1"`
+
+	// QuotaFile is the path to the file to persist the usage of the quotas
+	// to.
+	QuotaFile string `yaml:"quota-file" long:"quota-file" description:"Path to the file to persist the usage of the quotas to, so that it isn't reset after restarts"`
+
+	// TunnelAction is the behavior for the queries of the clients and domains
+	// considered DNS tunneling.  If empty, the detection is disabled.
+	TunnelAction string `yaml:"tunnel-action" long:"tunnel-action" description:"Enable the detection of likely DNS tunneling with the behavior for the offending client and domain pairs: log, throttle, or block"`
+
+	// TunnelMaxLabelLen is the maximum length of a label in the queried
+	// names not considered DNS tunneling.
+	TunnelMaxLabelLen int `yaml:"tunnel-max-label-len" long:"tunnel-max-label-len" description:"Maximum length of a label in the queried names not considered DNS tunneling, 0 to disable" default:"50"`
+
+	// TunnelMinEntropy is the entropy of the subdomains considered DNS
+	// tunneling.
+	TunnelMinEntropy float64 `yaml:"tunnel-min-entropy" long:"tunnel-min-entropy" description:"Shannon entropy in bits per character of the long subdomains considered DNS tunneling, 0 to disable" default:"4"`
+
+	// TunnelMaxTXT is the maximum number of TXT and NULL queries from a client
+	// per minute not considered DNS tunneling.
+	TunnelMaxTXT uint64 `yaml:"tunnel-max-txt" long:"tunnel-max-txt" description:"Maximum number of TXT and NULL requests from a single client per minute not considered DNS tunneling, 0 to disable" default:"100"`
+
+	// TunnelThrottle is the number of requests per second processed for an
+	// offending client and domain pair with the throttle action.
+	TunnelThrottle int `yaml:"tunnel-throttle" long:"tunnel-throttle" description:"Requests per second processed for an offending client and domain pair with the throttle action" default:"1"`
+
+	// TLSHandshakeRatelimit is the maximum number of new TLS handshakes per
+	// second from a single subnet on DoT and DoH listeners.
+	TLSHandshakeRatelimit int `yaml:"tls-handshake-ratelimit" long:"tls-handshake-ratelimit" description:"Maximum number of new TLS handshakes per second from a single subnet on DoT and DoH listeners"`
+
+	// TLSHandshakeRatelimitAllowlist is the list of addresses and subnets
+	// excluded from the TLS handshake rate limiting.
+	TLSHandshakeRatelimitAllowlist []string `yaml:"tls-handshake-ratelimit-allowlist" long:"tls-handshake-ratelimit-allowlist" description:"Addresses and CIDRs excluded from the TLS handshake ratelimit.  Can be specified multiple times."`
+
 	// UDPBufferSize is the size of the UDP buffer in bytes.  A value <= 0 will
 	// use the system default.
 	UDPBufferSize int `yaml:"udp-buf-size" long:"udp-buf-size" description:"Set the size of the UDP buffer in bytes. A value <= 0 will use the system default."`
@@ -145,6 +385,99 @@ type Options struct {
 	// MaxGoRoutines is the maximum number of goroutines.
 	MaxGoRoutines uint `yaml:"max-go-routines" long:"max-go-routines" description:"Set the maximum number of go routines. A zero value will not not set a maximum."`
 
+	// CrashLogSize is the number of the latest crash reports kept.  Zero
+	// disables recovering the panics.
+	CrashLogSize int `yaml:"crash-log-size" long:"crash-log-size" description:"Recover the panics occurred while handling the requests and keep this number of the latest crash reports.  Zero disables the recovery"`
+
+	// PoisonQueryThreshold is the number of crashes caused by the identical
+	// requests after which they are refused.
+	PoisonQueryThreshold uint `yaml:"poison-query-threshold" long:"poison-query-threshold" description:"Refuse the requests identical to the ones that caused this number of crashes, requires --crash-log-size.  Zero disables the quarantine"`
+
+	// ProbeInterval is the interval of probing the upstreams in background.
+	// Zero disables probing.
+	ProbeInterval timeutil.Duration `yaml:"probe-interval" long:"probe-interval" description:"Interval of probing all the upstreams in background to keep their latency statistics fresh in a human-readable form.  Zero disables probing"`
+
+	// ProbeDomain is the domain name requested to probe the upstreams.
+	ProbeDomain string `yaml:"probe-domain" long:"probe-domain" description:"Domain name to request when probing the upstreams.  Default: the root name servers are requested"`
+
+	// HedgeBudget is the maximum share of the requests that may be hedged.
+	HedgeBudget float64 `yaml:"hedge-budget" long:"hedge-budget" description:"Maximum share of the requests that may be hedged, from 0 to 1.  Default: 0.1"`
+
+	// ServFailBackoff is the time the requests for a failed question aren't
+	// sent to the upstreams for.  Zero disables the suppression.
+	ServFailBackoff timeutil.Duration `yaml:"servfail-backoff" long:"servfail-backoff" description:"Answer the requests for a question failed to be resolved with SERVFAIL for this time in a human-readable form, doubling it with each consecutive failure.  Zero disables it"`
+
+	// ServFailBackoffMax is the maximum time the requests for a failed question
+	// aren't sent to the upstreams for.
+	ServFailBackoffMax timeutil.Duration `yaml:"servfail-backoff-max" long:"servfail-backoff-max" description:"Maximum time to answer the requests for a failed question with SERVFAIL in a human-readable form.  Default: 5m"`
+
+	// AnomalyWindow is the length of the sliding window the per-client request
+	// statistics are collected over.  Zero disables the collection.
+	AnomalyWindow timeutil.Duration `yaml:"anomaly-window" long:"anomaly-window" description:"Collect the per-client statistics of the requested types and NXDOMAIN responses over the sliding window of this length in a human-readable form to detect the anomalous clients.  Zero disables it"`
+
+	// AnomalyThreshold is the anomaly score reaching which a client is logged.
+	AnomalyThreshold float64 `yaml:"anomaly-threshold" long:"anomaly-threshold" description:"Log the clients, which anomaly score within --anomaly-window reaches this value, from 0 to 1.  Zero disables it"`
+
+	// HealthCheckInterval is the interval of probing the health of the
+	// upstreams.  Zero disables the health checks.
+	HealthCheckInterval timeutil.Duration `yaml:"health-check-interval" long:"health-check-interval" description:"Interval of probing the health of all the upstreams with the requests for the root SOA record in a human-readable form.  The failing upstreams aren't used until they pass a probe.  Zero disables it"`
+
+	// HealthCheckFailures is the number of the consecutive failures after
+	// which an upstream is ejected.
+	HealthCheckFailures uint `yaml:"health-check-failures" long:"health-check-failures" description:"Number of the consecutive failed requests or probes after which an upstream isn't used.  Default: 3"`
+
+	// EjectionBackoff is the time an ejected upstream isn't probed for.
+	EjectionBackoff timeutil.Duration `yaml:"ejection-backoff" long:"ejection-backoff" description:"Time to wait before probing a failing upstream in a human-readable form, doubling it with each failed probe.  Default: 10s"`
+
+	// EjectionBackoffMax is the maximum time an ejected upstream isn't probed
+	// for.
+	EjectionBackoffMax timeutil.Duration `yaml:"ejection-backoff-max" long:"ejection-backoff-max" description:"Maximum time to wait before probing a failing upstream in a human-readable form.  Default: 5m"`
+
+	// SLOLatencyP95 is the threshold for the 95th percentile of the request
+	// latency.  Zero disables the objective.
+	SLOLatencyP95 timeutil.Duration `yaml:"slo-latency-p95" long:"slo-latency-p95" description:"Alert when the 95th percentile of the request latency exceeds this value in a human-readable form"`
+
+	// SLOErrorRatio is the threshold for the ratio of failed requests.  Zero
+	// disables the objective.
+	SLOErrorRatio float64 `yaml:"slo-error-ratio" long:"slo-error-ratio" description:"Alert when the ratio of failed requests exceeds this value, between 0 and 1"`
+
+	// SLOWindow is the sliding window the objectives are evaluated over.
+	SLOWindow timeutil.Duration `yaml:"slo-window" long:"slo-window" description:"Sliding window to evaluate the SLO thresholds over in a human-readable form" default:"1m"`
+
+	// SLOWebhook is the URL the SLO alerts are posted to.
+	SLOWebhook string `yaml:"slo-webhook" long:"slo-webhook" description:"URL to post the SLO alerts to as JSON"`
+
+	// Mirror is the URL of the sink to copy the sampled queries and responses
+	// to.
+	Mirror string `yaml:"mirror" long:"mirror" description:"URL of the sink to copy the queries and responses to, for example udp://127.0.0.1:5353 or unix:///run/ids.sock"`
+
+	// MirrorSample is the share of the requests to mirror.
+	MirrorSample float64 `yaml:"mirror-sample" long:"mirror-sample" description:"Share of the requests to mirror, between 0 and 1.  Zero means all requests"`
+
+	// RDNSSInterface is the name of the network interface to announce the
+	// proxy as the IPv6 DNS server on.  Empty string disables the
+	// announcement.
+	RDNSSInterface string `yaml:"rdnss-interface" long:"rdnss-interface" description:"Network interface to announce the proxy as the IPv6 DNS server on with the router advertisements"`
+
+	// RDNSSAddrs are the IPv6 addresses of the proxy to announce.
+	RDNSSAddrs []string `yaml:"rdnss-addr" long:"rdnss-addr" description:"IPv6 address to announce, can be specified multiple times.  By default, the addresses of the interface are used"`
+
+	// RDNSSDHCPv6 defines if the addresses should also be announced with the
+	// stateless DHCPv6.
+	RDNSSDHCPv6 bool `yaml:"rdnss-dhcpv6" long:"rdnss-dhcpv6" description:"If specified, also announce the addresses with the stateless DHCPv6" optional:"yes" optional-value:"true"`
+
+	// MgmtAddr is the address to serve the management API on.  Empty string
+	// disables the API.
+	MgmtAddr string `yaml:"mgmt-addr" long:"mgmt-addr" description:"Address to serve the management API on, for example 127.0.0.1:8053"`
+
+	// MgmtGRPCAddr is the address to serve the management API over gRPC on.
+	// Empty string disables it.
+	MgmtGRPCAddr string `yaml:"mgmt-grpc-addr" long:"mgmt-grpc-addr" description:"Address to serve the management API over gRPC on, for example 127.0.0.1:8054"`
+
+	// MgmtToken is the bearer token required by the management API.  It's
+	// required if the API is served on a non-loopback address.
+	MgmtToken string `yaml:"mgmt-token" long:"mgmt-token" description:"Bearer token required by the management API.  Required to serve it on a non-loopback address"`
+
 	// TLSMinVersion is the minimum allowed version of TLS.
 	TLSMinVersion float32 `yaml:"tls-min-version" long:"tls-min-version" description:"Minimum TLS version, for example 1.0" optional:"yes"`
 
@@ -158,6 +491,86 @@ type Options struct {
 	// Version, if true, prints the program version, and exits.
 	Version bool `yaml:"version" long:"version" description:"Prints the program version"`
 
+	// GenProfile, if set, is the kind of the device profile to print instead
+	// of running the server.
+	GenProfile string `yaml:"gen-profile" long:"gen-profile" description:"Print the profile for the devices to use the proxy and exit.  One of apple-doh, apple-dot, or android"`
+
+	// ProfileServerName is the hostname of the proxy used in the device
+	// profile.
+	ProfileServerName string `yaml:"profile-server-name" long:"profile-server-name" description:"Hostname of the proxy for --gen-profile.  If not set, the first DNS name of the --tls-crt certificate is used"`
+
+	// UpstreamMode is the upstream mode used unless AllServers or
+	// FastestAddress is set.
+	UpstreamMode string `yaml:"upstream-mode" long:"upstream-mode" description:"Order to try the upstreams in.  One of load_balance, round_robin, lowest_rtt, consistent_hash, weighted, or staggered.  Ignored with --all-servers and --fastest-addr.  Default: load_balance"`
+
+	// UpstreamWeights are the static weights of the upstreams for the weighted
+	// upstream mode.
+	UpstreamWeights []string `yaml:"upstream-weight" long:"upstream-weight" description:"Weight of the upstream with --upstream-mode=weighted in the address=weight form, where the address is the one of -u.  The other upstreams have the weight of 1.  Can be specified multiple times"`
+
+	// StaggerUpstreams is the maximum number of the upstreams a request is
+	// sent to in the staggered upstream mode.
+	StaggerUpstreams int `yaml:"stagger-upstreams" long:"stagger-upstreams" description:"Maximum number of the fastest upstreams to send a request to with --upstream-mode=staggered.  Default: all"`
+
+	// StaggerDelay is the delay between sending the request to the upstreams
+	// in the staggered upstream mode.
+	StaggerDelay timeutil.Duration `yaml:"stagger-delay" long:"stagger-delay" description:"Delay before sending a request to the next upstream with --upstream-mode=staggered if none has responded yet in a human-readable form.  Default: 100ms"`
+
+	// RacePolicy is the policy of choosing the response when the upstreams
+	// queried in parallel return different responses.
+	RacePolicy string `yaml:"race-policy" long:"race-policy" description:"Response to use when the upstreams queried with --all-servers disagree.  One of first, majority, or priority.  Default: first"`
+
+	// FastestPingMode defines how the addresses are pinged with
+	// FastestAddress.
+	FastestPingMode string `yaml:"fastest-ping-mode" long:"fastest-ping-mode" description:"How to ping the addresses with --fastest-addr.  One of tcp, icmp, or both.  Default: tcp"`
+
+	// FastestSampleWindow is the number of the latest pings of an address its
+	// latency is averaged over with FastestAddress.
+	FastestSampleWindow uint `yaml:"fastest-sample-window" long:"fastest-sample-window" description:"Number of the latest successful pings of an address its latency is averaged over with --fastest-addr.  Default: 8"`
+
+	// FastestStrategy defines how the address is chosen among the pinged ones
+	// with FastestAddress.
+	FastestStrategy string `yaml:"fastest-strategy" long:"fastest-strategy" description:"How to choose the address with --fastest-addr.  One of fastest, weighted_random, or lowest_loss.  Default: fastest"`
+
+	// FastestStrategyWindow is the maximum latency difference from the fastest
+	// address for the addresses chosen by FastestStrategy.
+	FastestStrategyWindow timeutil.Duration `yaml:"fastest-strategy-window" long:"fastest-strategy-window" description:"Maximum latency difference from the fastest address for the addresses chosen by --fastest-strategy in a human-readable form.  Default: 20ms"`
+
+	// FastestCacheFile is the path to the file to persist the ping results of
+	// FastestAddress to.
+	FastestCacheFile string `yaml:"fastest-cache-file" long:"fastest-cache-file" description:"Path to the file to save the ping results of --fastest-addr to and to restore them from on start"`
+
+	// FastestCacheFlushInterval is the interval of writing the ping results to
+	// FastestCacheFile.
+	FastestCacheFlushInterval timeutil.Duration `yaml:"fastest-cache-flush-interval" long:"fastest-cache-flush-interval" description:"Interval of saving the ping results to --fastest-cache-file in a human-readable form.  Zero means saving only on shutdown" default:"5m"`
+
+	// FastestPorts are the ports to ping the addresses of the domains on with
+	// FastestAddress, in the "domain=port,port" form.
+	FastestPorts []string `yaml:"fastest-ports" long:"fastest-ports" description:"Ports to ping the addresses of the domain on with --fastest-addr instead of 80 and 443, in the domain=port,port form, where the domain may be a wildcard like *.example.com.  Can be specified multiple times"`
+
+	// FastestDomains are the domains resolved choosing the fastest address
+	// even without FastestAddress.
+	FastestDomains []string `yaml:"fastest-domain" long:"fastest-domain" description:"Choose the fastest address for this domain and its subdomains even without --fastest-addr.  Can be specified multiple times"`
+
+	// FastestExcludeDomains are the domains resolved without choosing the
+	// fastest address with FastestAddress.
+	FastestExcludeDomains []string `yaml:"fastest-exclude-domain" long:"fastest-exclude-domain" description:"Don't choose the fastest address for this domain and its subdomains with --fastest-addr.  Can be specified multiple times"`
+
+	// FastestProbeTLS makes FastestAddress complete the TLS handshake when
+	// pinging port 443.
+	FastestProbeTLS bool `yaml:"fastest-probe-tls" long:"fastest-probe-tls" description:"If specified, complete the TLS handshake with the queried host when pinging port 443 with --fastest-addr" optional:"yes" optional-value:"true"`
+
+	// FastestPreferIPv6Within is the latency margin within which an IPv6
+	// address is preferred with FastestAddress.
+	FastestPreferIPv6Within timeutil.Duration `yaml:"fastest-prefer-ipv6-within" long:"fastest-prefer-ipv6-within" description:"Choose an IPv6 address with --fastest-addr if it's slower than the fastest IPv4 one by no more than this margin in a human-readable form"`
+
+	// FastestRefreshInterval is the interval of re-pinging the cached addresses
+	// in use with FastestAddress.  Zero disables re-pinging.
+	FastestRefreshInterval timeutil.Duration `yaml:"fastest-refresh-interval" long:"fastest-refresh-interval" description:"Interval of re-pinging the addresses in use with --fastest-addr in background before their results expire in a human-readable form.  Zero disables it"`
+
+	// FastestRefreshConcurrency is the maximum number of the addresses
+	// re-pinged at once.
+	FastestRefreshConcurrency int `yaml:"fastest-refresh-concurrency" long:"fastest-refresh-concurrency" description:"Maximum number of the addresses re-pinged at once with --fastest-refresh-interval.  Default: 16"`
+
 	// Verbose controls the verbosity of the output.
 	Verbose bool `yaml:"verbose" short:"v" long:"verbose" description:"Verbose output (optional)" optional:"yes" optional-value:"true"`
 
@@ -171,6 +584,30 @@ type Options struct {
 	// It enables HTTP/3 support for both the DoH upstreams and the DoH server.
 	HTTP3 bool `yaml:"http3" long:"http3" description:"Enable HTTP/3 support" optional:"yes" optional-value:"false"`
 
+	// HTTP3AltSvc makes the DoH upstreams switch to HTTP/3 once the servers
+	// advertise it in the Alt-Svc header.
+	HTTP3AltSvc bool `yaml:"http3-alt-svc" long:"http3-alt-svc" description:"If specified, switch the DoH upstreams to HTTP/3 once the servers advertise it in the Alt-Svc header and fall back to HTTP/2 if QUIC is blocked" optional:"yes" optional-value:"true"`
+
+	// NormalizeUpstreamQueries makes the upstreams normalize the queries
+	// before sending them.
+	NormalizeUpstreamQueries bool `yaml:"normalize-upstream-queries" long:"normalize-upstream-queries" description:"If specified, remove the client-specific EDNS options and flags from the queries sent to the upstreams" optional:"yes" optional-value:"true"`
+
+	// UpstreamNoCompression disables the compression of domain names in the
+	// queries sent to the upstreams.  It implies NormalizeUpstreamQueries.
+	UpstreamNoCompression bool `yaml:"upstream-no-compression" long:"upstream-no-compression" description:"If specified, normalize the queries sent to the upstreams and don't compress the domain names in them" optional:"yes" optional-value:"true"`
+
+	// DisableDoQ0RTT makes the DNS-over-QUIC upstreams not send the queries in
+	// the 0-RTT data.
+	DisableDoQ0RTT bool `yaml:"doq-disable-0rtt" long:"doq-disable-0rtt" description:"If specified, don't send the queries to the DNS-over-QUIC upstreams in the 0-RTT data, which can be replayed, and wait for the handshake instead" optional:"yes" optional-value:"true"`
+
+	// EDNSFallback makes the upstreams retry the queries without EDNS if they
+	// don't support it.
+	EDNSFallback bool `yaml:"edns-fallback" long:"edns-fallback" description:"If specified, retry the queries without EDNS when the upstreams respond with FORMERR or NOTIMP to the ones with it, and keep sending the queries without EDNS to such upstreams for an hour" optional:"yes" optional-value:"true"`
+
+	// WarmUp makes the server establish the connections to all the upstreams
+	// on start.
+	WarmUp bool `yaml:"warm-up" long:"warm-up" description:"If specified, establish the connections to all the upstreams on start, so that the first requests don't wait for the bootstrapping and handshakes" optional:"yes" optional-value:"true"`
+
 	// AllServers makes server to query all configured upstream servers in
 	// parallel.
 	AllServers bool `yaml:"all-servers" long:"all-servers" description:"If specified, parallel queries to all configured upstream servers are enabled" optional:"yes" optional-value:"true"`
@@ -185,12 +622,59 @@ type Options struct {
 	// already expired.
 	CacheOptimistic bool `yaml:"cache-optimistic" long:"cache-optimistic" description:"If specified, optimistic DNS cache is enabled" optional:"yes" optional-value:"true"`
 
+	// CachePrefetchHits is the number of cache hits after which a response is
+	// refreshed before it expires.
+	CachePrefetchHits uint `yaml:"cache-prefetch-hits" long:"cache-prefetch-hits" description:"Refresh the cached responses hit this many times when less than 10% of their TTL or 30 seconds remain.  Zero disables prefetching"`
+
+	// CachePrefetchMaxConcurrent is the maximum number of the prefetches
+	// running at once.
+	CachePrefetchMaxConcurrent uint `yaml:"cache-prefetch-max-concurrent" long:"cache-prefetch-max-concurrent" description:"Maximum number of the prefetches running at once" default:"10"`
+
+	// CacheFile is the path to the file to persist the cache to.
+	CacheFile string `yaml:"cache-file" long:"cache-file" description:"Path to the file to persist the cache to, so that the cached responses survive restarts"`
+
+	// CacheFileMaxSize is the size of the cache file in bytes, after which
+	// it's rewritten.
+	CacheFileMaxSize int `yaml:"cache-file-max-size" long:"cache-file-max-size" description:"Size of the cache file (in bytes) after which it's rewritten with the most recently used responses. Default: 4 times --cache-size"`
+
+	// CacheAggressiveNSEC makes the server synthesize the NXDOMAIN responses
+	// from the cached NSEC and NSEC3 records of the validated responses.
+	CacheAggressiveNSEC bool `yaml:"cache-aggressive-nsec" long:"cache-aggressive-nsec" description:"If specified, synthesize NXDOMAIN responses from the cached NSEC and NSEC3 records of the responses validated with --dnssec-validate" optional:"yes" optional-value:"true"`
+
+	// ResolveSVCBAliases makes the server follow the AliasMode SVCB and HTTPS
+	// records and add the records of their targets to the responses.
+	ResolveSVCBAliases bool `yaml:"resolve-svcb-aliases" long:"resolve-svcb-aliases" description:"If specified, follow the AliasMode SVCB and HTTPS records and add the records of their targets to the responses" optional:"yes" optional-value:"true"`
+
+	// DNSSECValidate makes the server validate the DNSSEC signatures of the
+	// upstream responses.
+	DNSSECValidate bool `yaml:"dnssec-validate" long:"dnssec-validate" description:"If specified, validate the DNSSEC signatures of the upstream responses and reply with SERVFAIL to the bogus ones" optional:"yes" optional-value:"true"`
+
+	// DNSSECTrustAnchors are the DS records of the trusted keys in the
+	// presentation format.
+	DNSSECTrustAnchors []string `yaml:"dnssec-trust-anchor" long:"dnssec-trust-anchor" description:"DS record of the trusted key in the presentation format, e.g. '. IN DS 20326 8 2 E06D...'.  Can be specified multiple times.  Default: the root zone keys"`
+
+	// DNSSECNegativeTrustAnchors are the domains, the responses for which
+	// aren't validated.
+	DNSSECNegativeTrustAnchors []string `yaml:"dnssec-nta" long:"dnssec-nta" description:"Domain, the responses for which and for its subdomains aren't validated.  Can be specified multiple times."`
+
 	// Cache controls whether DNS responses are cached or not.
 	Cache bool `yaml:"cache" long:"cache" description:"If specified, DNS cache is enabled" optional:"yes" optional-value:"true"`
 
 	// RefuseAny makes the server to refuse requests of type ANY.
 	RefuseAny bool `yaml:"refuse-any" long:"refuse-any" description:"If specified, refuse ANY requests" optional:"yes" optional-value:"true"`
 
+	// BlockCanaryDomains makes the server respond with NXDOMAIN to the
+	// requests for the canary domains of the browsers and operating systems.
+	BlockCanaryDomains bool `yaml:"block-canary-domains" long:"block-canary-domains" description:"If specified, respond with NXDOMAIN to the canary domains, such as use-application-dns.net, to prevent the clients from bypassing the proxy with their own encrypted DNS" optional:"yes" optional-value:"true"`
+
+	// SelfHostname is the hostname of the proxy itself, the requests for which
+	// are answered with its addresses and encrypted endpoints.
+	SelfHostname string `yaml:"self-hostname" long:"self-hostname" description:"Hostname of the proxy itself.  The requests for it are answered with the listen addresses and the encrypted endpoints, and the ones for _dns.resolver.arpa are answered for the Discovery of Designated Resolvers"`
+
+	// SelfAddrs are the IP addresses to answer the requests for SelfHostname
+	// with instead of the listen addresses.
+	SelfAddrs []string `yaml:"self-addr" long:"self-addr" description:"IP address to answer the requests for the self hostname with instead of the listen addresses.  Can be specified multiple times."`
+
 	// EnableEDNSSubnet uses EDNS Client Subnet extension.
 	EnableEDNSSubnet bool `yaml:"edns" long:"edns" description:"Use EDNS Client Subnet extension" optional:"yes" optional-value:"true"`
 
@@ -208,6 +692,12 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "stamp" {
+		runStamp(os.Args[2:])
+
+		os.Exit(0)
+	}
+
 	options := &Options{}
 
 	for _, arg := range os.Args {
@@ -246,6 +736,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	if options.GenProfile != "" {
+		genProfile(options)
+
+		os.Exit(0)
+	}
+
 	run(options)
 }
 
@@ -270,13 +766,36 @@ func run(options *Options) {
 	log.Info("Starting dnsproxy %s", version.Version())
 
 	// Prepare the proxy server and its configuration.
-	conf := createProxyConfig(options)
+	sessions, err := upstream.NewTLSSessionCache(0, options.TLSSessionCache)
+	if err != nil {
+		log.Fatalf("creating tls session cache: %s", err)
+	}
+
+	resolvers, err := upstream.NewDNSCryptCache(options.DNSCryptCache)
+	if err != nil {
+		log.Fatalf("creating dnscrypt cache: %s", err)
+	}
+
+	conf, upsOpts := createProxyConfig(options, sessions, resolvers)
+	plugins := initPlugins(conf, options)
+	policyZones := initRPZ(conf, options)
+	initIDN(conf, options)
+	initTunnel(conf, options)
+	quotas := initQuota(conf, options)
+	initSLO(conf, options)
+	mir := initMirror(conf, options)
+	zones := initZones(conf, options)
+	svc := initMgmt(conf, options, upsOpts, policyZones)
+
+	validateProxyConfig(conf)
 
 	dnsProxy, err := proxy.New(conf)
 	if err != nil {
 		log.Fatalf("creating proxy: %s", err)
 	}
 
+	loadState(dnsProxy, options.StateFile)
+
 	// Add extra handler if needed.
 	if options.IPv6Disabled {
 		ipv6Configuration := ipv6Configuration{ipv6Disabled: options.IPv6Disabled}
@@ -293,15 +812,184 @@ func run(options *Options) {
 		log.Fatalf("cannot start the DNS proxy due to %s", err)
 	}
 
+	mgmtSrvs := runMgmt(svc, dnsProxy, options)
+	announcer := startRDNSS(options)
+	stopRPZ := refreshRPZ(policyZones, options.RPZRefreshInterval.Duration)
+
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChannel
 
+	stopRDNSS(announcer)
+	stopRPZ()
+
+	for _, srv := range mgmtSrvs {
+		err = srv.Shutdown(ctx)
+		if err != nil {
+			log.Error("stopping management api: %s", err)
+		}
+	}
+
 	// Stopping the proxy.
 	err = dnsProxy.Shutdown(ctx)
 	if err != nil {
 		log.Fatalf("cannot stop the DNS proxy due to %s", err)
 	}
+
+	saveState(dnsProxy, options.StateFile)
+
+	closeZones(zones)
+
+	for _, p := range plugins {
+		err = p.Close()
+		if err != nil {
+			log.Error("closing plugin: %s", err)
+		}
+	}
+
+	if mir != nil {
+		err = mir.Close()
+		if err != nil {
+			log.Error("closing mirror: %s", err)
+		}
+	}
+
+	err = sessions.Save()
+	if err != nil {
+		log.Error("saving tls sessions: %s", err)
+	}
+
+	err = resolvers.Save()
+	if err != nil {
+		log.Error("saving dnscrypt resolvers: %s", err)
+	}
+
+	if quotas != nil {
+		err = quotas.Save()
+		if err != nil {
+			log.Error("saving quota usage: %s", err)
+		}
+	}
+}
+
+// startRDNSS starts announcing the proxy as the IPv6 DNS server, if an
+// interface is configured.
+func startRDNSS(options *Options) (a *rdnss.Announcer) {
+	if options.RDNSSInterface == "" {
+		return nil
+	}
+
+	addrs := make([]netip.Addr, 0, len(options.RDNSSAddrs))
+	for i, s := range options.RDNSSAddrs {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			log.Fatalf("rdnss: address at index %d: %s", i, err)
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	a, err := rdnss.New(&rdnss.Config{
+		Interface: options.RDNSSInterface,
+		Addrs:     addrs,
+		DHCPv6:    options.RDNSSDHCPv6,
+	})
+	if err != nil {
+		log.Fatalf("rdnss: %s", err)
+	}
+
+	err = a.Start()
+	if err != nil {
+		log.Fatalf("rdnss: %s", err)
+	}
+
+	return a
+}
+
+// stopRDNSS withdraws the announcement started by [startRDNSS], if any.
+func stopRDNSS(a *rdnss.Announcer) {
+	if a == nil {
+		return
+	}
+
+	err := a.Close()
+	if err != nil {
+		log.Error("stopping rdnss: %s", err)
+	}
+}
+
+// loadState restores the runtime state of p from the file at path, if it's set
+// and the file exists.
+func loadState(p *proxy.Proxy, path string) {
+	if path == "" {
+		return
+	}
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		log.Error("opening state file: %s", err)
+
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	err = p.ImportState(f)
+	if err != nil {
+		log.Error("importing state: %s", err)
+
+		return
+	}
+
+	log.Info("restored state from %s", path)
+}
+
+// saveState writes the runtime state of p to the file at path, if it's set.
+func saveState(p *proxy.Proxy, path string) {
+	if path == "" {
+		return
+	}
+
+	// Write the file atomically, since a partial state is rejected anyway.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		log.Error("creating temporary state file: %s", err)
+
+		return
+	}
+
+	err = p.ExportState(tmp)
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		log.Error("saving state: %s", errors.WithDeferred(err, os.Remove(tmp.Name())))
+	}
+}
+
+// validateProxyConfig logs all the problems of conf and exits if any of them
+// are errors.
+func validateProxyConfig(conf *proxy.Config) {
+	probs := proxy.ConfigProblems{}
+	if !errors.As(conf.Validate(), &probs) {
+		return
+	}
+
+	for _, p := range probs {
+		if p.Severity == proxy.SeverityWarning {
+			log.Info("config: %s", p)
+		} else {
+			log.Error("config: %s", p)
+		}
+	}
+
+	if probs.HasErrors() {
+		log.Fatalf("config: %d problems found", len(probs))
+	}
 }
 
 // runPprof runs pprof server on localhost:6060 if it's enabled in the options.
@@ -335,33 +1023,77 @@ func runPprof(options *Options) {
 	}()
 }
 
-// createProxyConfig creates proxy.Config from the command line arguments
-func createProxyConfig(options *Options) (conf *proxy.Config) {
+// createProxyConfig creates proxy.Config from the command line arguments.
+// sessions is shared by the encrypted upstreams and resolvers is shared by the
+// DNSCrypt ones.  upsOpts are the options of the general upstreams.
+func createProxyConfig(
+	options *Options,
+	sessions *upstream.TLSSessionCache,
+	resolvers *upstream.DNSCryptCache,
+) (conf *proxy.Config, upsOpts *upstream.Options) {
 	conf = &proxy.Config{
 		RatelimitSubnetLenIPv4: options.RatelimitSubnetLenIPv4,
 		RatelimitSubnetLenIPv6: options.RatelimitSubnetLenIPv6,
+		TLSHandshakeRatelimit:  options.TLSHandshakeRatelimit,
+
+		Ratelimit:         options.Ratelimit,
+		CacheEnabled:      options.Cache,
+		CacheSizeBytes:    options.CacheSizeBytes,
+		CacheLowWatermark: options.CacheLowWatermark,
+		CacheMinTTL:       options.CacheMinTTL,
+		CacheMaxTTL:       options.CacheMaxTTL,
+		CacheOptimistic:   options.CacheOptimistic,
+		RefuseAny:         options.RefuseAny,
+		HTTP3:             options.HTTP3,
+
+		CacheNegativeMinTTL: options.CacheNegativeMinTTL,
+		CacheNegativeMaxTTL: options.CacheNegativeMaxTTL,
+
+		ResolveSVCBAliases:   options.ResolveSVCBAliases,
+		CacheCompressMinSize: options.CacheCompressMinSize,
+		CacheAggressiveNSEC:  options.CacheAggressiveNSEC,
+		CacheServeStale:      options.CacheServeStale.Duration,
+		CacheStaleTTL:        options.CacheStaleTTL.Duration,
+		ZeroTTLFloor:         options.ZeroTTLFloor.Duration,
+		ZeroTTLFloorJitter:   options.ZeroTTLFloorJitter.Duration,
+		ZeroTTLFloorDomains:  options.ZeroTTLFloorDomains,
+
+		CachePrefetchHits:          options.CachePrefetchHits,
+		CachePrefetchMaxConcurrent: options.CachePrefetchMaxConcurrent,
+
+		CacheFile:        options.CacheFile,
+		CacheFileMaxSize: options.CacheFileMaxSize,
+
+		DNSSECValidate:             options.DNSSECValidate,
+		DNSSECNegativeTrustAnchors: options.DNSSECNegativeTrustAnchors,
 
-		Ratelimit:       options.Ratelimit,
-		CacheEnabled:    options.Cache,
-		CacheSizeBytes:  options.CacheSizeBytes,
-		CacheMinTTL:     options.CacheMinTTL,
-		CacheMaxTTL:     options.CacheMaxTTL,
-		CacheOptimistic: options.CacheOptimistic,
-		RefuseAny:       options.RefuseAny,
-		HTTP3:           options.HTTP3,
-		// TODO(e.burkov):  The following CIDRs are aimed to match any address.
-		// This is not quite proper approach to be used by default so think
-		// about configuring it.
-		TrustedProxies: netutil.SliceSubnetSet{
-			netip.MustParsePrefix("0.0.0.0/0"),
-			netip.MustParsePrefix("::0/0"),
-		},
 		EnableEDNSClientSubnet: options.EnableEDNSSubnet,
 		UDPBufferSize:          options.UDPBufferSize,
 		HTTPSServerName:        options.HTTPSServerName,
 		MaxGoroutines:          options.MaxGoRoutines,
 		UsePrivateRDNS:         options.UsePrivateRDNS,
 		PrivateSubnets:         netutil.SubnetSetFunc(netutil.IsLocallyServed),
+		WarmUpUpstreams:        options.WarmUp,
+		ForwardClientAddr:      options.ForwardClientAddr,
+		ProbeInterval:          options.ProbeInterval.Duration,
+		ListenRebindInterval:   options.ListenRebindInterval.Duration,
+		ProbeDomain:            options.ProbeDomain,
+		HedgeRequests:          options.HedgeRequests,
+		HedgeBudget:            options.HedgeBudget,
+		CrashLogSize:           options.CrashLogSize,
+		PoisonQueryThreshold:   options.PoisonQueryThreshold,
+		ServFailBackoff:        options.ServFailBackoff.Duration,
+		ServFailBackoffMax:     options.ServFailBackoffMax.Duration,
+		AnomalyWindow:          options.AnomalyWindow.Duration,
+		AnomalyThreshold:       options.AnomalyThreshold,
+		OnAnomaly:              logAnomaly,
+		HealthCheckInterval:    options.HealthCheckInterval.Duration,
+		HealthCheckFailures:    options.HealthCheckFailures,
+		EjectionBackoff:        options.EjectionBackoff.Duration,
+		EjectionBackoffMax:     options.EjectionBackoffMax.Duration,
+		TCPFastOpen:            options.TCPFastOpen,
+		QUICFlowLabels:         options.QUICFlowLabels,
+		SignatureValidity:      options.DNSSECSignValidity.Duration,
 	}
 
 	if uiStr := options.HTTPSUserinfo; uiStr != "" {
@@ -373,16 +1105,38 @@ func createProxyConfig(options *Options) (conf *proxy.Config) {
 		}
 	}
 
+	if options.BlockCanaryDomains {
+		conf.CanaryDomains = proxy.DefaultCanaryDomains
+	}
+
 	// TODO(e.burkov):  Make these methods of [Options].
-	initUpstreams(conf, options)
+	upsOpts = initUpstreams(conf, options, sessions, resolvers)
 	initEDNS(conf, options)
+	initAddrPreferences(conf, options)
+	initAddrShuffle(conf, options)
 	initBogusNXDomain(conf, options)
 	initTLSConfig(conf, options)
 	initDNSCryptConfig(conf, options)
 	initListenAddrs(conf, options)
 	initSubnets(conf, options)
+	initHandshakeRatelimit(conf, options)
+	initSelfHostname(conf, options)
+	initSigningKeys(conf, options)
+	initDNSSECTrustAnchors(conf, options)
+
+	return conf, upsOpts
+}
+
+// newNormalization returns the normalization of the upstream queries
+// configured in options, if any.
+func newNormalization(options *Options) (n *upstream.Normalization) {
+	if !options.NormalizeUpstreamQueries && !options.UpstreamNoCompression {
+		return nil
+	}
 
-	return conf
+	return &upstream.Normalization{
+		DisableCompression: options.UpstreamNoCompression,
+	}
 }
 
 // isEmpty returns false if uc contains at least a single upstream.  uc must not
@@ -396,8 +1150,58 @@ func isEmpty(uc *proxy.UpstreamConfig) (ok bool) {
 		len(uc.SpecifiedDomainUpstreams) == 0
 }
 
-// initUpstreams inits upstream-related config
-func initUpstreams(config *proxy.Config, options *Options) {
+// upstreamDSCP returns the DSCP of the upstream traffic from options and exits
+// if it's invalid or if either it or the upstream mark can't be set on this
+// system.
+func upstreamDSCP(options *Options) (dscp uint8) {
+	dscp = options.UpstreamDSCP
+	if dscp > proxynetutil.MaxDSCP {
+		log.Fatalf("upstream dscp %d is greater than %d", dscp, proxynetutil.MaxDSCP)
+	}
+
+	err := proxynetutil.ValidateDialControl(options.UpstreamMark, dscp)
+	if err != nil {
+		log.Fatalf("upstream socket options: %s", err)
+	}
+
+	return dscp
+}
+
+// logAnomaly logs the client, which anomaly score has reached the threshold.
+func logAnomaly(a *proxy.ClientAnomaly) {
+	log.Info(
+		"warning: client %s looks anomalous: score %.2f, nxdomain ratio %.2f, tunnel ratio %.2f, %d requests",
+		a.Client,
+		a.Score,
+		a.NXDomainRatio,
+		a.TunnelRatio,
+		a.Requests,
+	)
+}
+
+// upstreamPortRange returns the validated range of the local ports of the UDP
+// sockets of the upstreams from options, or nil if it isn't set.
+func upstreamPortRange(options *Options) (r *upstream.PortRange) {
+	if options.UpstreamPortRange == "" {
+		return nil
+	}
+
+	r, err := upstream.ParsePortRange(options.UpstreamPortRange)
+	if err != nil {
+		log.Fatalf("upstream %s", err)
+	}
+
+	return r
+}
+
+// initUpstreams inits upstream-related config and returns the options of the
+// general upstreams.
+func initUpstreams(
+	config *proxy.Config,
+	options *Options,
+	sessions *upstream.TLSSessionCache,
+	resolvers *upstream.DNSCryptCache,
+) (upsOpts *upstream.Options) {
 	// Init upstreams
 
 	httpVersions := upstream.DefaultHTTPVersions
@@ -414,17 +1218,40 @@ func initUpstreams(config *proxy.Config, options *Options) {
 		HTTPVersions:       httpVersions,
 		InsecureSkipVerify: options.Insecure,
 		Timeout:            timeout,
+		SocketMark:         options.UpstreamMark,
+		DSCP:               upstreamDSCP(options),
+		UDPPortRange:       upstreamPortRange(options),
 	}
 	boot, err := initBootstrap(options.BootstrapDNS, bootOpts)
 	if err != nil {
 		log.Fatalf("error while initializing bootstrap: %s", err)
 	}
 
-	upsOpts := &upstream.Options{
+	upsOpts = &upstream.Options{
 		HTTPVersions:       httpVersions,
 		InsecureSkipVerify: options.Insecure,
 		Bootstrap:          boot,
+		HTTP3AltSvc:        options.HTTP3AltSvc,
 		Timeout:            timeout,
+		TLSSessionCache:    sessions,
+		DNSCryptCache:      resolvers,
+		Normalization:      newNormalization(options),
+		SocketMark:         bootOpts.SocketMark,
+		DSCP:               bootOpts.DSCP,
+		MaxIdleConns:       options.UpstreamMaxIdleConns,
+		EDNSFallback:       options.EDNSFallback,
+		DisableDoQ0RTT:     options.DisableDoQ0RTT,
+		UDPPoolSize:        options.UDPPoolSize,
+		UDPPortRange:       bootOpts.UDPPortRange,
+	}
+	if options.TCPFastOpen {
+		upsOpts.FastOpen = upstream.NewFastOpen()
+	}
+	if options.SpoofWindow.Duration > 0 {
+		upsOpts.SpoofDetector = upstream.NewSpoofDetector(
+			options.SpoofWindow.Duration,
+			options.SpoofPreferLater,
+		)
 	}
 	upstreams := loadServersList(options.Upstreams)
 
@@ -434,9 +1261,19 @@ func initUpstreams(config *proxy.Config, options *Options) {
 	}
 
 	privUpsOpts := &upstream.Options{
-		HTTPVersions: httpVersions,
-		Bootstrap:    boot,
-		Timeout:      min(defaultLocalTimeout, timeout),
+		HTTPVersions:    httpVersions,
+		Bootstrap:       boot,
+		Timeout:         min(defaultLocalTimeout, timeout),
+		TLSSessionCache: sessions,
+		DNSCryptCache:   resolvers,
+		Normalization:   upsOpts.Normalization,
+		SocketMark:      bootOpts.SocketMark,
+		DSCP:            bootOpts.DSCP,
+		MaxIdleConns:    upsOpts.MaxIdleConns,
+		EDNSFallback:    upsOpts.EDNSFallback,
+		DisableDoQ0RTT:  upsOpts.DisableDoQ0RTT,
+		UDPPoolSize:     upsOpts.UDPPoolSize,
+		UDPPortRange:    upsOpts.UDPPortRange,
 	}
 	privUpstreams := loadServersList(options.PrivateRDNSUpstreams)
 
@@ -454,17 +1291,337 @@ func initUpstreams(config *proxy.Config, options *Options) {
 		log.Fatalf("error while parsing fallback upstreams configuration: %s", err)
 	}
 
+	if options.RootFallback {
+		fallbacks.Upstreams = append(fallbacks.Upstreams, upstream.NewIterative(nil))
+	}
+
 	if !isEmpty(fallbacks) {
 		config.Fallbacks = fallbacks
 	}
 
-	if options.AllServers {
+	initUpstreamMode(config, options)
+	initUpstreamGroups(config, options, upsOpts)
+	initVirtualResolvers(config, options, upsOpts)
+
+	return upsOpts
+}
+
+// initUpstreamMode inits the upstream mode and its settings.
+func initUpstreamMode(config *proxy.Config, options *Options) {
+	var err error
+	if options.RacePolicy != "" {
+		config.RacePolicy, err = proxy.ParseRacePolicy(options.RacePolicy)
+		if err != nil {
+			log.Fatalf("parsing race policy: %s", err)
+		}
+	}
+
+	if options.FastestPingMode != "" {
+		config.FastestPingMode, err = fastip.ParsePingMode(options.FastestPingMode)
+		if err != nil {
+			log.Fatalf("parsing fastest ping mode: %s", err)
+		}
+	}
+
+	if options.FastestStrategy != "" {
+		config.FastestStrategy, err = fastip.ParseStrategy(options.FastestStrategy)
+		if err != nil {
+			log.Fatalf("parsing fastest strategy: %s", err)
+		}
+	}
+
+	config.FastestPortsByDomain, err = parseFastestPorts(options.FastestPorts)
+	if err != nil {
+		log.Fatalf("parsing fastest ports: %s", err)
+	}
+
+	config.FastestSampleWindow = options.FastestSampleWindow
+	config.FastestStrategyWindow = options.FastestStrategyWindow.Duration
+	config.FastestCacheFile = options.FastestCacheFile
+	config.FastestCacheFlushInterval = options.FastestCacheFlushInterval.Duration
+	config.FastestDomains = options.FastestDomains
+	config.FastestExcludeDomains = options.FastestExcludeDomains
+	config.FastestProbeTLS = options.FastestProbeTLS
+	config.FastestPreferIPv6Within = options.FastestPreferIPv6Within.Duration
+	config.FastestRefreshInterval = options.FastestRefreshInterval.Duration
+	config.FastestRefreshConcurrency = options.FastestRefreshConcurrency
+
+	if options.AllServers {
 		config.UpstreamMode = proxy.UModeParallel
 	} else if options.FastestAddress {
 		config.UpstreamMode = proxy.UModeFastestAddr
+	} else if options.UpstreamMode != "" {
+		config.UpstreamMode, err = proxy.ParseUpstreamMode(options.UpstreamMode)
+		if err != nil {
+			log.Fatalf("parsing upstream mode: %s", err)
+		} else if config.UpstreamMode == proxy.UModeCustom {
+			log.Fatalf("parsing upstream mode: custom mode is not supported")
+		}
 	} else {
 		config.UpstreamMode = proxy.UModeLoadBalance
 	}
+
+	config.StaggerUpstreams = options.StaggerUpstreams
+	config.StaggerDelay = options.StaggerDelay.Duration
+
+	config.UpstreamWeights, err = parseUpstreamWeights(options.UpstreamWeights)
+	if err != nil {
+		log.Fatalf("parsing upstream weights: %s", err)
+	}
+}
+
+// parseUpstreamWeights parses the static weights of the upstreams from vals in
+// the "address=weight" form.  The addresses are normalized the same way as the
+// ones of the upstreams.  weights is nil if vals are empty.
+func parseUpstreamWeights(vals []string) (weights map[string]float64, err error) {
+	if len(vals) == 0 {
+		return nil, nil
+	}
+
+	weights = make(map[string]float64, len(vals))
+	for i, v := range vals {
+		idx := strings.LastIndexByte(v, '=')
+		if idx <= 0 {
+			return nil, fmt.Errorf("value at index %d: no weight in %q", i, v)
+		}
+
+		var w float64
+		w, err = strconv.ParseFloat(strings.TrimSpace(v[idx+1:]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("value at index %d: weight: %w", i, err)
+		} else if w < 0 {
+			return nil, fmt.Errorf("value at index %d: negative weight %v", i, w)
+		}
+
+		var addr string
+		addr, err = normalizeUpstreamAddr(v[:idx])
+		if err != nil {
+			return nil, fmt.Errorf("value at index %d: %w", i, err)
+		}
+
+		weights[addr] = w
+	}
+
+	return weights, nil
+}
+
+// normalizeUpstreamAddr returns the address of the upstream specified with
+// addr as reported by [upstream.Upstream.Address], e.g. with the default port.
+func normalizeUpstreamAddr(addr string) (norm string, err error) {
+	u, err := upstream.AddressToUpstream(addr, &upstream.Options{})
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+
+	norm = u.Address()
+
+	return norm, u.Close()
+}
+
+// upstreamGroupOptions is the YAML configuration of a [proxy.UpstreamGroup].
+type upstreamGroupOptions struct {
+	// Name is the unique name of the group.
+	Name string `yaml:"name"`
+
+	// Mode is the upstream mode of the group, one of load_balance, parallel,
+	// or fastest_addr.  Empty means load_balance.
+	Mode string `yaml:"mode"`
+
+	// Upstreams are the upstreams of the group.
+	Upstreams []*groupUpstreamOptions `yaml:"upstreams"`
+
+	// Fallbacks are the addresses of the fallback upstreams of the group.
+	Fallbacks []string `yaml:"fallbacks"`
+}
+
+// groupUpstreamOptions is the YAML configuration of a [proxy.GroupUpstream].
+type groupUpstreamOptions struct {
+	// Address is the address of the upstream.
+	Address string `yaml:"address"`
+
+	// Weight is the relative weight of the upstream.  Zero means 1.
+	Weight float64 `yaml:"weight"`
+
+	// Priority is the priority of the upstream, lower is used first.
+	Priority uint `yaml:"priority"`
+
+	// ECS is the static EDNS Client Subnet sent to the upstream instead of the
+	// subnet of the client.  Empty string means no static subnet.
+	ECS string `yaml:"ecs"`
+}
+
+// upstreamRouteOptions is the YAML configuration of a [proxy.UpstreamRoute].
+type upstreamRouteOptions struct {
+	// Group is the name of the group.
+	Group string `yaml:"group"`
+
+	// Domains are the domain names matching the route along with their
+	// subdomains.
+	Domains []string `yaml:"domains"`
+
+	// Clients are the client subnets matching the route.
+	Clients []string `yaml:"clients"`
+}
+
+// secondaryZoneOptions is the YAML configuration of a [zone.Secondary].
+type secondaryZoneOptions struct {
+	// Name is the name of the zone.
+	Name string `yaml:"name"`
+
+	// Primary is the address of the primary nameserver of the zone.  The port
+	// is 53 by default.
+	Primary string `yaml:"primary"`
+
+	// TSIGName is the name of the key to authenticate the transfers with.
+	// Empty string disables the authentication.
+	TSIGName string `yaml:"tsig-name"`
+
+	// TSIGAlgorithm is the algorithm of the key, such as hmac-sha256.
+	TSIGAlgorithm string `yaml:"tsig-algorithm"`
+
+	// TSIGSecret is the base64-encoded secret of the key.
+	TSIGSecret string `yaml:"tsig-secret"`
+}
+
+// parseFastestPorts parses the ports to ping the addresses of the domains on
+// from vals in the "domain=port,port" form.  ports is nil if vals are empty.
+func parseFastestPorts(vals []string) (ports map[string][]uint16, err error) {
+	if len(vals) == 0 {
+		return nil, nil
+	}
+
+	ports = make(map[string][]uint16, len(vals))
+	for i, v := range vals {
+		domain, portsStr, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("value at index %d: no ports in %q", i, v)
+		}
+
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		err = netutil.ValidateDomainName(strings.TrimPrefix(domain, "*."))
+		if err != nil {
+			return nil, fmt.Errorf("value at index %d: %w", i, err)
+		}
+
+		for _, portStr := range strings.Split(portsStr, ",") {
+			var port uint64
+			port, err = strconv.ParseUint(strings.TrimSpace(portStr), 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("value at index %d: port: %w", i, err)
+			} else if port == 0 {
+				return nil, fmt.Errorf("value at index %d: zero port", i)
+			}
+
+			ports[domain] = append(ports[domain], uint16(port))
+		}
+	}
+
+	return ports, nil
+}
+
+// initUpstreamGroups inits the upstream groups and routes.  upsOpts are used
+// for their upstreams.
+func initUpstreamGroups(config *proxy.Config, options *Options, upsOpts *upstream.Options) {
+	for _, g := range options.UpstreamGroups {
+		config.UpstreamGroups = append(config.UpstreamGroups, newUpstreamGroup(g, upsOpts))
+	}
+
+	for i, r := range options.UpstreamRoutes {
+		config.UpstreamRoutes = append(config.UpstreamRoutes, &proxy.UpstreamRoute{
+			Group:         r.Group,
+			Domains:       r.Domains,
+			ClientSubnets: mustParsePrefixes(r.Clients, fmt.Sprintf("upstream route %d client", i)),
+		})
+	}
+}
+
+// newUpstreamGroup returns the upstream group for opts.  upsOpts are used for
+// its upstreams.
+func newUpstreamGroup(opts *upstreamGroupOptions, upsOpts *upstream.Options) (g *proxy.UpstreamGroup) {
+	g = &proxy.UpstreamGroup{
+		Name: opts.Name,
+	}
+
+	var err error
+	if opts.Mode != "" {
+		g.Mode, err = proxy.ParseUpstreamMode(opts.Mode)
+		if err != nil {
+			log.Fatalf("upstream group %q: %s", opts.Name, err)
+		}
+	}
+
+	for _, u := range opts.Upstreams {
+		gu := &proxy.GroupUpstream{
+			Weight:   u.Weight,
+			Priority: u.Priority,
+		}
+
+		uOpts := upsOpts.Clone()
+		if u.ECS != "" {
+			uOpts.ECSSubnet, err = netip.ParsePrefix(u.ECS)
+			if err != nil {
+				log.Fatalf("upstream group %q: upstream %q: ecs: %s", opts.Name, u.Address, err)
+			}
+		}
+
+		gu.Upstream, err = upstream.AddressToUpstream(u.Address, uOpts)
+		if err != nil {
+			log.Fatalf("upstream group %q: upstream %q: %s", opts.Name, u.Address, err)
+		}
+
+		g.Upstreams = append(g.Upstreams, gu)
+	}
+
+	for _, addr := range opts.Fallbacks {
+		var u upstream.Upstream
+		u, err = upstream.AddressToUpstream(addr, upsOpts.Clone())
+		if err != nil {
+			log.Fatalf("upstream group %q: fallback %q: %s", opts.Name, addr, err)
+		}
+
+		g.Fallbacks = append(g.Fallbacks, u)
+	}
+
+	return g
+}
+
+// initVirtualResolvers inits the DNS-over-TLS and DNS-over-HTTPS virtual
+// resolvers.  upsOpts are
+// used for their upstreams.
+func initVirtualResolvers(config *proxy.Config, options *Options, upsOpts *upstream.Options) {
+	for i, s := range options.VirtualResolvers {
+		fields := strings.Split(s, "|")
+		if len(fields) < 4 {
+			log.Fatalf("virtual resolver at index %d: bad format %q", i, s)
+		}
+
+		vr := &proxy.VirtualResolver{
+			ServerName: fields[0],
+		}
+
+		if certPath, keyPath := fields[1], fields[2]; certPath != "" || keyPath != "" {
+			var err error
+			vr.TLSConfig, err = newTLSConfig(options, certPath, keyPath)
+			if err != nil {
+				log.Fatalf("virtual resolver at index %d: %s", i, err)
+			}
+		}
+
+		ups, err := proxy.ParseUpstreamsConfig(fields[3:], upsOpts)
+		if err != nil {
+			log.Fatalf("virtual resolver at index %d: parsing upstreams: %s", i, err)
+		}
+
+		vr.UpstreamConfig = proxy.NewCustomUpstreamConfig(
+			ups,
+			options.Cache,
+			options.CacheSizeBytes,
+			options.EnableEDNSSubnet,
+		)
+
+		config.VirtualResolvers = append(config.VirtualResolvers, vr)
+	}
 }
 
 // initBootstrap initializes the [upstream.Resolver] for bootstrapping upstream
@@ -472,17 +1629,31 @@ func initUpstreams(config *proxy.Config, options *Options) {
 // The returned resolver will also use system hosts files first.
 func initBootstrap(bootstraps []string, opts *upstream.Options) (r upstream.Resolver, err error) {
 	var resolvers []upstream.Resolver
+	var withHosts []int
 
 	for i, b := range bootstraps {
 		var ur *upstream.UpstreamResolver
 		ur, err = upstream.NewUpstreamResolver(b, opts)
-		if err != nil {
+		if nbErr := (upstream.NotBootstrapError{}); errors.As(err, &nbErr) {
+			// The bootstrap needs its hostname resolved itself, so create it
+			// when the ones with the IP addresses are ready.
+			withHosts = append(withHosts, i)
+			_ = ur.Close()
+
+			continue
+		} else if err != nil {
 			return nil, fmt.Errorf("creating bootstrap resolver at index %d: %w", i, err)
 		}
 
 		resolvers = append(resolvers, upstream.NewCachingResolver(ur))
 	}
 
+	resolvers, err = appendHostBootstraps(resolvers, bootstraps, withHosts, opts)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
 	switch len(resolvers) {
 	case 0:
 		etcHosts, hostsErr := upstream.NewDefaultHostsResolver(osutil.RootDirFS())
@@ -500,6 +1671,48 @@ func initBootstrap(bootstraps []string, opts *upstream.Options) (r upstream.Reso
 	}
 }
 
+// appendHostBootstraps appends the bootstrap resolvers from bootstraps at
+// indexes idxs to resolvers.  Those are the bootstraps with hostnames, so their
+// hostnames are resolved with resolvers, which must only contain the
+// bootstraps with IP addresses.  Otherwise, the hostname of a bootstrap could
+// only be resolved by the bootstraps requiring to be resolved as well, which is
+// reported as a cycle.
+func appendHostBootstraps(
+	resolvers []upstream.Resolver,
+	bootstraps []string,
+	idxs []int,
+	opts *upstream.Options,
+) (res []upstream.Resolver, err error) {
+	if len(idxs) == 0 {
+		return resolvers, nil
+	}
+
+	if len(resolvers) == 0 {
+		return nil, fmt.Errorf(
+			"creating bootstrap resolver at index %d: %w: %q can only be "+
+				"resolved by bootstraps with hostnames, specify one with an ip address",
+			idxs[0],
+			upstream.ErrBootstrapCycle,
+			bootstraps[idxs[0]],
+		)
+	}
+
+	hostOpts := opts.Clone()
+	hostOpts.Bootstrap = upstream.ParallelResolver(resolvers)
+
+	res = resolvers
+	for _, i := range idxs {
+		ur, urErr := upstream.NewUpstreamResolver(bootstraps[i], hostOpts)
+		if urErr != nil {
+			return nil, fmt.Errorf("creating bootstrap resolver at index %d: %w", i, urErr)
+		}
+
+		res = append(res, upstream.NewCachingResolver(ur))
+	}
+
+	return res, nil
+}
+
 // initEDNS inits EDNS-related config
 func initEDNS(config *proxy.Config, options *Options) {
 	if options.EDNSAddr != "" {
@@ -513,6 +1726,69 @@ func initEDNS(config *proxy.Config, options *Options) {
 			log.Printf("--edns-addr=%s need --edns to work", options.EDNSAddr)
 		}
 	}
+
+	config.EDNSSubnetLenIPv4 = options.EDNSSubnetLenIPv4
+	config.EDNSSubnetLenIPv6 = options.EDNSSubnetLenIPv6
+
+	for i, s := range options.EDNSClientPolicies {
+		polStr, subnetStr, ok := strings.Cut(s, ":")
+		if !ok {
+			log.Fatalf("parsing edns client policy at index %d: no separator in %q", i, s)
+		}
+
+		pol, err := proxy.ParseECSPolicy(polStr)
+		if err != nil {
+			log.Fatalf("parsing edns client policy at index %d: %s", i, err)
+		}
+
+		subnet, err := proxynetutil.ParseSubnet(subnetStr)
+		if err != nil {
+			log.Fatalf("parsing edns client policy at index %d: %s", i, err)
+		}
+
+		config.ECSPolicies = append(config.ECSPolicies, &proxy.ECSClientPolicy{
+			Subnet: subnet,
+			Policy: pol,
+		})
+	}
+}
+
+// initAddrPreferences inits the per-client address preferences.
+func initAddrPreferences(config *proxy.Config, options *Options) {
+	for i, s := range options.AddrPreferences {
+		prefStr, subnetStr, ok := strings.Cut(s, ":")
+		if !ok {
+			log.Fatalf("parsing address preference at index %d: no separator in %q", i, s)
+		}
+
+		pref, err := proxy.ParseAddrPreference(prefStr)
+		if err != nil {
+			log.Fatalf("parsing address preference at index %d: %s", i, err)
+		}
+
+		subnet, err := proxynetutil.ParseSubnet(subnetStr)
+		if err != nil {
+			log.Fatalf("parsing address preference at index %d: %s", i, err)
+		}
+
+		config.AddrPreferences = append(config.AddrPreferences, &proxy.AddrClientPreference{
+			Subnet:     subnet,
+			Preference: pref,
+		})
+	}
+}
+
+// initAddrShuffle inits the shuffling of the address records in responses.
+func initAddrShuffle(config *proxy.Config, options *Options) {
+	if options.AddrShuffle == "" {
+		return
+	}
+
+	var err error
+	config.AddrShuffle, err = proxy.ParseAddrShuffle(options.AddrShuffle)
+	if err != nil {
+		log.Fatalf("parsing address shuffle: %s", err)
+	}
 }
 
 // initBogusNXDomain inits BogusNXDomain structure
@@ -534,7 +1810,7 @@ func initBogusNXDomain(config *proxy.Config, options *Options) {
 // initTLSConfig inits the TLS config
 func initTLSConfig(config *proxy.Config, options *Options) {
 	if options.TLSCertPath != "" && options.TLSKeyPath != "" {
-		tlsConfig, err := newTLSConfig(options)
+		tlsConfig, err := newTLSConfig(options, options.TLSCertPath, options.TLSKeyPath)
 		if err != nil {
 			log.Fatalf("failed to load TLS config: %s", err)
 		}
@@ -630,6 +1906,9 @@ func initListenAddrs(config *proxy.Config, options *Options) {
 		}
 	}
 
+	config.HTTPListenAddr = tcpAddrs(options.HTTPListenPorts, listenIPs)
+	config.GRPCListenAddr = tcpAddrs(options.GRPCListenPorts, listenIPs)
+
 	if config.DNSCryptResolverCert != nil && config.DNSCryptProviderName != "" {
 		for _, port := range options.DNSCryptListenPorts {
 			for _, ip := range listenIPs {
@@ -643,6 +1922,17 @@ func initListenAddrs(config *proxy.Config, options *Options) {
 	}
 }
 
+// tcpAddrs returns the TCP addresses for each combination of ports and ips.
+func tcpAddrs(ports []int, ips []netip.Addr) (addrs []*net.TCPAddr) {
+	for _, port := range ports {
+		for _, ip := range ips {
+			addrs = append(addrs, net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))))
+		}
+	}
+
+	return addrs
+}
+
 // mustParsePrefixes parses prefixes and considers any error as fatal, logging
 // it with the entity name.
 func mustParsePrefixes(prefixes []string, entity string) (prefs []netip.Prefix) {
@@ -658,10 +1948,28 @@ func mustParsePrefixes(prefixes []string, entity string) (prefs []netip.Prefix)
 	return prefs
 }
 
-// initSubnets sets the DNS64 configuration into conf.
+// initSubnets sets the DNS64 configuration and the trusted subnets into conf.
 func initSubnets(conf *proxy.Config, options *Options) {
 	if conf.UseDNS64 = options.DNS64; conf.UseDNS64 {
 		conf.DNS64Prefs = mustParsePrefixes(options.DNS64Prefix, "dns64 prefix")
+		conf.DNS64Exclude = mustParsePrefixes(options.DNS64Exclude, "dns64 exclusion range")
+	}
+
+	conf.TrustedProxies = netutil.SliceSubnetSet(
+		mustParsePrefixes(options.TrustedProxies, "trusted proxy"),
+	)
+	if len(options.TrustedProxies) == 0 {
+		// Keep trusting any address by default for backwards compatibility.
+		conf.TrustedProxies = netutil.SliceSubnetSet{
+			netip.MustParsePrefix("0.0.0.0/0"),
+			netip.MustParsePrefix("::0/0"),
+		}
+	}
+
+	if len(options.ClientAddrProxies) > 0 {
+		conf.ClientAddrProxies = netutil.SliceSubnetSet(
+			mustParsePrefixes(options.ClientAddrProxies, "client addr proxy"),
+		)
 	}
 
 	if options.UsePrivateRDNS {
@@ -672,6 +1980,561 @@ func initSubnets(conf *proxy.Config, options *Options) {
 	}
 }
 
+// initSelfHostname sets the hostname of the proxy itself and its addresses into
+// conf.
+func initSelfHostname(conf *proxy.Config, options *Options) {
+	conf.SelfHostname = options.SelfHostname
+	for i, a := range options.SelfAddrs {
+		ip, err := netip.ParseAddr(a)
+		if err != nil {
+			log.Fatalf("parsing self addr at index %d: %s", i, err)
+		}
+
+		conf.SelfAddrs = append(conf.SelfAddrs, ip)
+	}
+}
+
+// initSigningKeys loads the zone signing keys into conf.
+func initSigningKeys(conf *proxy.Config, options *Options) {
+	for _, base := range options.DNSSECSignKeys {
+		k, err := loadSigningKey(base)
+		if err != nil {
+			log.Fatalf("loading signing key %s: %s", base, err)
+		}
+
+		conf.SigningKeys = append(conf.SigningKeys, k)
+	}
+}
+
+// loadSigningKey reads the zone signing key from the .key and .private files
+// generated by dnssec-keygen, the path of which without the extensions is base.
+func loadSigningKey(base string) (k *proxy.SigningKey, err error) {
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	pub, err := os.ReadFile(base + ".key")
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	rr, err := dns.NewRR(string(pub))
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("public key: unexpected record %T", rr)
+	}
+
+	privPath := base + ".private"
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	f, err := os.Open(privPath)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	priv, err := dnskey.ReadPrivateKey(f, privPath)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key: unsupported type %T", priv)
+	}
+
+	return &proxy.SigningKey{
+		DNSKEY:     dnskey,
+		PrivateKey: signer,
+	}, nil
+}
+
+// initDNSSECTrustAnchors sets the DNSSEC trust anchors from options into conf.
+func initDNSSECTrustAnchors(conf *proxy.Config, options *Options) {
+	for i, s := range options.DNSSECTrustAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			log.Fatalf("parsing dnssec trust anchor at index %d: %s", i, err)
+		}
+
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			log.Fatalf("parsing dnssec trust anchor at index %d: not a ds record", i)
+		}
+
+		conf.DNSSECTrustAnchors = append(conf.DNSSECTrustAnchors, ds)
+	}
+}
+
+// initHandshakeRatelimit sets the TLS handshake ratelimit allowlist into conf.
+func initHandshakeRatelimit(conf *proxy.Config, options *Options) {
+	for i, s := range options.TLSHandshakeRatelimitAllowlist {
+		p, err := proxynetutil.ParseSubnet(s)
+		if err != nil {
+			log.Fatalf("parsing tls handshake ratelimit allowlist at index %d: %s", i, err)
+		}
+
+		conf.TLSHandshakeRatelimitAllowlist = append(conf.TLSHandshakeRatelimitAllowlist, p)
+	}
+}
+
+// initPlugins starts the plugins and sets them as the request and response
+// handlers into conf.
+func initPlugins(conf *proxy.Config, options *Options) (plugins []*plugin.Plugin) {
+	if len(options.Plugins) == 0 {
+		return nil
+	}
+
+	var handlers proxy.BeforeRequestHandlers
+	for i, cmdLine := range options.Plugins {
+		fields := strings.Fields(cmdLine)
+		if len(fields) == 0 {
+			log.Fatalf("plugin at index %d: empty command line", i)
+		}
+
+		p, err := plugin.Start(&plugin.Config{
+			Path: fields[0],
+			Args: fields[1:],
+		})
+		if err != nil {
+			log.Fatalf("plugin at index %d: %s", i, err)
+		}
+
+		plugins = append(plugins, p)
+		handlers = append(handlers, p)
+	}
+
+	conf.BeforeRequestHandler = handlers
+	conf.ResponseHandler = func(dctx *proxy.DNSContext, err error) {
+		for _, p := range plugins {
+			p.HandleResponse(dctx, err)
+		}
+	}
+
+	return plugins
+}
+
+// initRPZ loads the response policy zones and sets them up as the request and
+// response handlers into conf, after the plugins.
+func initRPZ(conf *proxy.Config, options *Options) (zones []*rpz.Zone) {
+	var confs []*rpz.ZoneConfig
+	for i, s := range options.RPZFiles {
+		name, path, ok := strings.Cut(s, ":")
+		if !ok {
+			log.Fatalf("rpz: file at index %d: want <zone>:<path>, got %q", i, s)
+		}
+
+		confs = append(confs, &rpz.ZoneConfig{Name: name, File: path})
+	}
+
+	for i, s := range options.RPZPrimaries {
+		name, addr, ok := strings.Cut(s, "@")
+		if !ok {
+			log.Fatalf("rpz: primary at index %d: want <zone>@<ip:port>, got %q", i, s)
+		}
+
+		confs = append(confs, &rpz.ZoneConfig{Name: name, Primary: addr})
+	}
+
+	if len(confs) == 0 {
+		return nil
+	}
+
+	for _, c := range confs {
+		z, err := rpz.NewZone(c)
+		if err != nil {
+			log.Fatalf("rpz: %s", err)
+		}
+
+		err = z.Refresh(context.Background())
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+
+		zones = append(zones, z)
+	}
+
+	h := rpz.New(&rpz.Config{
+		MessageConstructor: conf.MessageConstructor,
+		Zones:              zones,
+	})
+
+	if conf.BeforeRequestHandler == nil {
+		conf.BeforeRequestHandler = h
+	} else {
+		conf.BeforeRequestHandler = proxy.BeforeRequestHandlers{conf.BeforeRequestHandler, h}
+	}
+
+	prev := conf.ResponseHandler
+	conf.ResponseHandler = func(dctx *proxy.DNSContext, err error) {
+		if prev != nil {
+			prev(dctx, err)
+		}
+
+		h.HandleResponse(dctx, err)
+	}
+
+	return zones
+}
+
+// refreshRPZ refreshes zones every interval in the background, if there are
+// any.  stop stops refreshing.
+func refreshRPZ(zones []*rpz.Zone, interval time.Duration) (stop func()) {
+	if len(zones) == 0 || interval <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer log.OnPanic("rpz")
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, z := range zones {
+					err := z.Refresh(ctx)
+					if err != nil {
+						log.Error("%s", err)
+					}
+				}
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// initIDN sets up the normalization of internationalized domain names as the
+// first request handler in conf.
+func initIDN(conf *proxy.Config, options *Options) {
+	homoglyph, err := idn.ParseHomoglyphPolicy(options.IDNHomoglyph)
+	if err != nil {
+		log.Fatalf("idn: %s", err)
+	}
+
+	h := idn.New(&idn.Config{
+		MessageConstructor: conf.MessageConstructor,
+		Homoglyph:          homoglyph,
+	})
+
+	if conf.BeforeRequestHandler == nil {
+		conf.BeforeRequestHandler = h
+	} else {
+		conf.BeforeRequestHandler = proxy.BeforeRequestHandlers{h, conf.BeforeRequestHandler}
+	}
+}
+
+// initTunnel sets up the detection of DNS tunneling into conf, if it's enabled.
+func initTunnel(conf *proxy.Config, options *Options) {
+	if options.TunnelAction == "" {
+		return
+	}
+
+	action, err := tunnel.ParseAction(options.TunnelAction)
+	if err != nil {
+		log.Fatalf("tunnel: %s", err)
+	}
+
+	d := tunnel.New(&tunnel.Config{
+		MaxLabelLen:     options.TunnelMaxLabelLen,
+		MinEntropy:      options.TunnelMinEntropy,
+		MaxTXTPerMinute: options.TunnelMaxTXT,
+		ThrottleRate:    options.TunnelThrottle,
+		Action:          action,
+	})
+
+	if conf.BeforeRequestHandler == nil {
+		conf.BeforeRequestHandler = d
+	} else {
+		conf.BeforeRequestHandler = proxy.BeforeRequestHandlers{d, conf.BeforeRequestHandler}
+	}
+}
+
+// initQuota sets up the per-client quotas of requests into conf, if any are
+// configured.
+func initQuota(conf *proxy.Config, options *Options) (l *quota.Limiter) {
+	if options.QuotaHourly == 0 && options.QuotaDaily == 0 {
+		return nil
+	}
+
+	action, err := quota.ParseAction(options.QuotaAction)
+	if err != nil {
+		log.Fatalf("quota: %s", err)
+	}
+
+	l, err = quota.New(&quota.Config{
+		Path:         options.QuotaFile,
+		Hourly:       options.QuotaHourly,
+		Daily:        options.QuotaDaily,
+		ThrottleRate: options.QuotaThrottle,
+		Action:       action,
+	})
+	if err != nil {
+		log.Fatalf("quota: %s", err)
+	}
+
+	// Check the quota before the other handlers, since it's the cheapest.
+	if conf.BeforeRequestHandler == nil {
+		conf.BeforeRequestHandler = l
+	} else {
+		conf.BeforeRequestHandler = proxy.BeforeRequestHandlers{l, conf.BeforeRequestHandler}
+	}
+
+	return l
+}
+
+// initSLO sets up the monitoring of the service level objectives into conf, if
+// any are configured.
+func initSLO(conf *proxy.Config, options *Options) {
+	if options.SLOLatencyP95.Duration == 0 && options.SLOErrorRatio == 0 {
+		return
+	}
+
+	m, err := slo.New(&slo.Config{
+		WebhookURL: options.SLOWebhook,
+		Window:     options.SLOWindow.Duration,
+		LatencyP95: options.SLOLatencyP95.Duration,
+		ErrorRatio: options.SLOErrorRatio,
+	})
+	if err != nil {
+		log.Fatalf("slo: %s", err)
+	}
+
+	prev := conf.ResponseHandler
+	conf.ResponseHandler = func(dctx *proxy.DNSContext, err error) {
+		if prev != nil {
+			prev(dctx, err)
+		}
+
+		m.HandleResponse(dctx, err)
+	}
+}
+
+// initZones starts transferring the secondary zones and sets them up to be
+// served into conf, if any are configured.
+func initZones(conf *proxy.Config, options *Options) (zones []*zone.Secondary) {
+	if len(options.SecondaryZones) == 0 {
+		return nil
+	}
+
+	handlers := proxy.BeforeRequestHandlers{}
+	if conf.BeforeRequestHandler != nil {
+		handlers = append(handlers, conf.BeforeRequestHandler)
+	}
+
+	for i, zo := range options.SecondaryZones {
+		primary, err := parsePrimary(zo.Primary)
+		if err != nil {
+			log.Fatalf("secondary zone at index %d: primary: %s", i, err)
+		}
+
+		c := &zone.Config{
+			Name:    zo.Name,
+			Primary: primary,
+		}
+
+		if zo.TSIGName != "" {
+			c.TSIG = &zone.TSIG{
+				Name:      zo.TSIGName,
+				Algorithm: zo.TSIGAlgorithm,
+				Secret:    zo.TSIGSecret,
+			}
+		}
+
+		z, err := zone.New(c)
+		if err != nil {
+			log.Fatalf("secondary zone at index %d: %s", i, err)
+		}
+
+		z.Start()
+		zones = append(zones, z)
+		handlers = append(handlers, z)
+	}
+
+	conf.BeforeRequestHandler = handlers
+
+	return zones
+}
+
+// parsePrimary parses the address of the primary nameserver, with the port 53
+// by default.
+func parsePrimary(s string) (addrPort netip.AddrPort, err error) {
+	addrPort, err = netip.ParseAddrPort(s)
+	if err == nil {
+		return addrPort, nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return netip.AddrPort{}, err
+	}
+
+	return netip.AddrPortFrom(addr, 53), nil
+}
+
+// closeZones stops keeping the secondary zones started by [initZones] current.
+func closeZones(zones []*zone.Secondary) {
+	for _, z := range zones {
+		err := z.Close()
+		if err != nil {
+			log.Error("closing secondary zone: %s", err)
+		}
+	}
+}
+
+// initMirror sets up the mirroring of the queries and responses into conf, if
+// a sink is configured.
+func initMirror(conf *proxy.Config, options *Options) (m *mirror.Mirror) {
+	if options.Mirror == "" {
+		return nil
+	}
+
+	m, err := mirror.New(&mirror.Config{
+		Sink:   options.Mirror,
+		Sample: options.MirrorSample,
+	})
+	if err != nil {
+		log.Fatalf("mirror: %s", err)
+	}
+
+	prev := conf.ResponseHandler
+	conf.ResponseHandler = func(dctx *proxy.DNSContext, err error) {
+		if prev != nil {
+			prev(dctx, err)
+		}
+
+		m.HandleResponse(dctx, err)
+	}
+
+	return m
+}
+
+// initMgmt sets up the management service into conf, if the management API is
+// enabled.  upsOpts are used for the upstreams added at runtime, and
+// policyZones are served as the filters refreshed at runtime.
+func initMgmt(
+	conf *proxy.Config,
+	options *Options,
+	upsOpts *upstream.Options,
+	policyZones []*rpz.Zone,
+) (svc *mgmt.Service) {
+	if options.MgmtAddr == "" && options.MgmtGRPCAddr == "" {
+		return nil
+	}
+
+	for _, addr := range []string{options.MgmtAddr, options.MgmtGRPCAddr} {
+		if addr != "" && options.MgmtToken == "" && !isLoopbackAddr(addr) {
+			log.Fatalf("mgmt: --mgmt-token is required to serve the api on non-loopback address %q", addr)
+		}
+	}
+
+	filters := make(map[string]mgmt.Refresher, len(policyZones))
+	for _, z := range policyZones {
+		filters[z.Name()] = z
+	}
+
+	// Serve the metrics of the fastest address selection, which are only
+	// collected when it's used.
+	metrics := fastip.NewPrometheusMetrics(fastip.DefaultMetricsMaxHosts)
+	conf.FastestMetrics = metrics
+
+	svc = mgmt.New(&mgmt.Config{
+		Metrics:                metrics,
+		Filters:                filters,
+		UpstreamOptions:        upsOpts,
+		Upstreams:              loadServersList(options.Upstreams),
+		CacheSize:              conf.CacheSizeBytes,
+		CacheEnabled:           conf.CacheEnabled,
+		EnableEDNSClientSubnet: conf.EnableEDNSClientSubnet,
+	})
+
+	// Count and log the requests answered from the cache as well.
+	conf.HandleCachedResponses = true
+
+	// Run the service after the other handlers, so that the upstreams chosen
+	// by them take precedence over the ones set at runtime.
+	if conf.BeforeRequestHandler == nil {
+		conf.BeforeRequestHandler = svc
+	} else {
+		conf.BeforeRequestHandler = proxy.BeforeRequestHandlers{conf.BeforeRequestHandler, svc}
+	}
+
+	prev := conf.ResponseHandler
+	conf.ResponseHandler = func(dctx *proxy.DNSContext, err error) {
+		if prev != nil {
+			prev(dctx, err)
+		}
+
+		svc.HandleResponse(dctx, err)
+	}
+
+	return svc
+}
+
+// runMgmt starts serving the management API of svc for p over HTTP and gRPC,
+// if they're enabled.
+func runMgmt(svc *mgmt.Service, p *proxy.Proxy, options *Options) (srvs []*http.Server) {
+	if svc == nil {
+		return nil
+	}
+
+	if options.MgmtAddr != "" {
+		srvs = append(srvs, serveMgmt(options.MgmtAddr, mgmt.NewHandler(svc, p, options.MgmtToken)))
+	}
+
+	if options.MgmtGRPCAddr != "" {
+		h := mgmt.NewGRPCHandler(svc, p, options.MgmtToken)
+		srvs = append(srvs, serveMgmt(options.MgmtGRPCAddr, h))
+	}
+
+	return srvs
+}
+
+// serveMgmt starts serving the management API on addr with h.
+func serveMgmt(addr string, h http.Handler) (srv *http.Server) {
+	srv = &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: 60 * time.Second,
+	}
+
+	go func() {
+		defer log.OnPanic("mgmt")
+
+		log.Info("mgmt: listening on %s", addr)
+		err := srv.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Error("running the management api: %s", err)
+		}
+	}()
+
+	return srv
+}
+
+// isLoopbackAddr returns true if the host of addr is a loopback IP address or
+// localhost.
+func isLoopbackAddr(addr string) (ok bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	} else if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip, err := netip.ParseAddr(host)
+
+	return err == nil && ip.IsLoopback()
+}
+
 // IPv6 configuration
 type ipv6Configuration struct {
 	ipv6Disabled bool // If true, all AAAA requests will be replied with NoError RCode and empty answer
@@ -689,7 +2552,7 @@ func (c *ipv6Configuration) handleDNSRequest(p *proxy.Proxy, ctx *proxy.DNSConte
 // NewTLSConfig returns a TLS config that includes a certificate
 // Use for server TLS config or when using a client certificate
 // If caPath is empty, system CAs will be used
-func newTLSConfig(options *Options) (*tls.Config, error) {
+func newTLSConfig(options *Options, certPath, keyPath string) (*tls.Config, error) {
 	// Set default TLS min/max versions
 	tlsMinVersion := tls.VersionTLS10 // Default for crypto/tls
 	tlsMaxVersion := tls.VersionTLS13 // Default for crypto/tls
@@ -710,7 +2573,7 @@ func newTLSConfig(options *Options) (*tls.Config, error) {
 		tlsMaxVersion = tls.VersionTLS12
 	}
 
-	cert, err := loadX509KeyPair(options.TLSCertPath, options.TLSKeyPath)
+	cert, err := loadX509KeyPair(certPath, keyPath)
 	if err != nil {
 		return nil, fmt.Errorf("could not load TLS cert: %s", err)
 	}
@@ -744,6 +2607,173 @@ func loadX509KeyPair(certFile, keyFile string) (crt tls.Certificate, err error)
 	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
 }
 
+// stampOptions are the options of the stamp subcommand.
+type stampOptions struct {
+	// ServerAddr is the IP address of the server to put into the encoded
+	// stamp.
+	ServerAddr string `long:"server-addr" description:"IP address of the server to bootstrap the encoded upstream with"`
+
+	// Hashes are the hexadecimal SHA256 digests of the certificates in the
+	// validation chain of the server to put into the encoded stamp.
+	Hashes []string `long:"hash" description:"Hexadecimal SHA256 digest of a certificate in the validation chain of the encoded upstream.  Can be specified multiple times."`
+
+	// DNSSEC marks the encoded server as validating DNSSEC.
+	DNSSEC bool `long:"dnssec" description:"Mark the encoded upstream as validating DNSSEC" optional:"yes" optional-value:"true"`
+
+	// NoLog marks the encoded server as not logging the requests.
+	NoLog bool `long:"no-log" description:"Mark the encoded upstream as not logging the requests" optional:"yes" optional-value:"true"`
+
+	// NoFilter marks the encoded server as not blocking domains.
+	NoFilter bool `long:"no-filter" description:"Mark the encoded upstream as not blocking domains" optional:"yes" optional-value:"true"`
+}
+
+// runStamp runs the stamp subcommand with args, which either encodes the
+// upstream address into a DNS stamp or describes the DNS stamp.
+func runStamp(args []string) {
+	opts := &stampOptions{}
+	parser := goFlags.NewParser(opts, goFlags.Default)
+	parser.Name = "dnsproxy stamp"
+	parser.Usage = "[OPTIONS] encode <upstream> | decode <sdns://...>"
+
+	rest, err := parser.ParseArgs(args)
+	if err != nil {
+		if flagsErr, ok := err.(*goFlags.Error); ok && flagsErr.Type == goFlags.ErrHelp {
+			os.Exit(0)
+		}
+
+		os.Exit(1)
+	}
+
+	if len(rest) != 2 {
+		parser.WriteHelp(os.Stderr)
+
+		os.Exit(1)
+	}
+
+	switch cmd, arg := rest[0], rest[1]; cmd {
+	case "encode":
+		st := &upstream.Stamp{
+			Address:  arg,
+			Hashes:   opts.Hashes,
+			DNSSEC:   opts.DNSSEC,
+			NoLog:    opts.NoLog,
+			NoFilter: opts.NoFilter,
+		}
+
+		if opts.ServerAddr != "" {
+			st.ServerAddr, err = netip.ParseAddr(opts.ServerAddr)
+			if err != nil {
+				log.Fatalf("stamp: server address: %s", err)
+			}
+		}
+
+		var s string
+		s, err = upstream.EncodeStamp(st)
+		if err != nil {
+			log.Fatalf("stamp: encoding: %s", err)
+		}
+
+		fmt.Println(s)
+	case "decode":
+		var st *upstream.Stamp
+		st, err = upstream.DecodeStamp(arg)
+		if err != nil {
+			log.Fatalf("stamp: decoding: %s", err)
+		}
+
+		printStamp(st)
+	default:
+		log.Fatalf("stamp: unknown command %q, want encode or decode", cmd)
+	}
+}
+
+// printStamp prints the human-readable description of st.
+func printStamp(st *upstream.Stamp) {
+	fmt.Printf("address: %s\n", st.Address)
+	if st.ServerAddr.IsValid() {
+		fmt.Printf("server address: %s\n", st.ServerAddr)
+	}
+
+	for _, h := range st.Hashes {
+		fmt.Printf("hash: %s\n", h)
+	}
+
+	fmt.Printf("dnssec: %t\n", st.DNSSEC)
+	fmt.Printf("no log: %t\n", st.NoLog)
+	fmt.Printf("no filter: %t\n", st.NoFilter)
+}
+
+// genProfile prints the device profile of the kind set in options.
+func genProfile(options *Options) {
+	c := &profile.Config{
+		ServerName: options.ProfileServerName,
+	}
+
+	if c.ServerName == "" {
+		c.ServerName = certServerName(options)
+	}
+
+	if len(options.HTTPSListenPorts) > 0 {
+		c.HTTPSPort = uint16(options.HTTPSListenPorts[0])
+	}
+
+	if len(options.TLSListenPorts) > 0 {
+		c.TLSPort = uint16(options.TLSListenPorts[0])
+	}
+
+	for _, a := range options.ListenAddrs {
+		ip, err := netip.ParseAddr(a)
+		if err == nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+			c.ServerAddrs = append(c.ServerAddrs, ip)
+		}
+	}
+
+	var data []byte
+	var err error
+	switch options.GenProfile {
+	case "apple-doh":
+		data, err = profile.AppleMobileConfig(c, profile.ProtocolHTTPS)
+	case "apple-dot":
+		data, err = profile.AppleMobileConfig(c, profile.ProtocolTLS)
+	case "android":
+		var snippet string
+		snippet, err = profile.AndroidPrivateDNS(c)
+		data = []byte(snippet)
+	default:
+		err = fmt.Errorf("unknown kind %q", options.GenProfile)
+	}
+
+	if err != nil {
+		log.Fatalf("generating profile: %s", err)
+	}
+
+	_, _ = os.Stdout.Write(data)
+}
+
+// certServerName returns the first DNS name of the TLS certificate set in
+// options or an empty string if there is none.
+func certServerName(options *Options) (name string) {
+	if options.TLSCertPath == "" || options.TLSKeyPath == "" {
+		return ""
+	}
+
+	cert, err := loadX509KeyPair(options.TLSCertPath, options.TLSKeyPath)
+	if err != nil {
+		log.Fatalf("could not load TLS cert: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		log.Fatalf("could not parse TLS cert: %s", err)
+	}
+
+	if len(leaf.DNSNames) == 0 {
+		return ""
+	}
+
+	return leaf.DNSNames[0]
+}
+
 // loadServersList loads a list of DNS servers from the specified list.  The
 // thing is that the user may specify either a server address or the path to a
 // file with a list of addresses.  This method takes care of it, it reads the
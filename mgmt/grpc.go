@@ -0,0 +1,314 @@
+package mgmt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/internal/dnsgrpc"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// GRPCPathPrefix is the HTTP/2 path prefix of the methods of the management
+// gRPC service defined by mgmt.proto in this directory.
+const GRPCPathPrefix = "/dnsproxy.v1.Management/"
+
+// grpcMethod is a unary method of the management gRPC service.  arg is the JSON
+// argument, which is empty for the methods without arguments.  res is encoded
+// as JSON, unless it's nil.
+type grpcMethod func(ctx context.Context, arg []byte) (res any, err error)
+
+// grpcHandler serves the operations of a [Service] for a proxy over gRPC.  The
+// messages are framed the same way as the ones of DNS-over-gRPC, see package
+// dnsgrpc, and carry JSON documents.
+type grpcHandler struct {
+	svc     *Service
+	proxy   *proxy.Proxy
+	methods map[string]grpcMethod
+	token   string
+}
+
+// NewGRPCHandler returns an HTTP handler serving the operations of svc for p
+// over gRPC, both with and without TLS.  If token isn't empty, the requests
+// must have it as a bearer token in the authorization metadata.
+func NewGRPCHandler(svc *Service, p *proxy.Proxy, token string) (h http.Handler) {
+	hdlr := &grpcHandler{
+		svc:   svc,
+		proxy: p,
+		token: token,
+	}
+
+	hdlr.methods = map[string]grpcMethod{
+		"Upstreams":          hdlr.upstreams,
+		"AddUpstream":        hdlr.addUpstream,
+		"RemoveUpstream":     hdlr.removeUpstream,
+		"FlushCache":         hdlr.flushCache,
+		"Stats":              hdlr.stats,
+		"Anomalies":          hdlr.anomalies,
+		"RefreshFilter":      hdlr.refreshFilter,
+		"FastestCache":       hdlr.fastestCache,
+		"DeleteFastestCache": hdlr.deleteFastestCache,
+		"FlushFastestCache":  hdlr.flushFastestCache,
+	}
+
+	return h2c.NewHandler(hdlr, &http2.Server{})
+}
+
+// type check
+var _ http.Handler = (*grpcHandler)(nil)
+
+// ServeHTTP implements the [http.Handler] interface for *grpcHandler.
+func (h *grpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get(httphdr.ContentType) != dnsgrpc.ContentType {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+
+		return
+	} else if !authorized(r, h.token) {
+		writeGRPCStatus(w, dnsgrpc.StatusUnauthenticated, "unauthorized")
+
+		return
+	}
+
+	defer log.OnCloserError(r.Body, log.DEBUG)
+
+	name, ok := strings.CutPrefix(r.URL.Path, GRPCPathPrefix)
+	if !ok {
+		writeGRPCStatus(w, dnsgrpc.StatusUnimplemented, "unknown method")
+
+		return
+	}
+
+	arg, err := dnsgrpc.ReadFrame(r.Body)
+	if err != nil {
+		log.Debug("mgmt: reading grpc request: %s", err)
+		writeGRPCStatus(w, dnsgrpc.StatusInvalidArgument, "bad request message")
+
+		return
+	}
+
+	if name == "Tail" {
+		h.tail(w, r)
+
+		return
+	}
+
+	m, ok := h.methods[name]
+	if !ok {
+		writeGRPCStatus(w, dnsgrpc.StatusUnimplemented, "unknown method")
+
+		return
+	}
+
+	res, err := m(r.Context(), arg)
+	if err != nil {
+		writeGRPCStatus(w, grpcStatus(err), err.Error())
+
+		return
+	}
+
+	var data []byte
+	if res != nil {
+		data, err = json.Marshal(res)
+		if err != nil {
+			writeGRPCStatus(w, dnsgrpc.StatusInternal, "encoding result")
+
+			return
+		}
+	}
+
+	w.Header().Set(httphdr.ContentType, dnsgrpc.ContentType)
+	w.WriteHeader(http.StatusOK)
+
+	_, err = w.Write(dnsgrpc.AppendFrame(nil, data))
+	if err != nil {
+		log.Debug("mgmt: writing grpc response: %s", err)
+	}
+
+	w.Header().Set(http.TrailerPrefix+dnsgrpc.HdrStatus, dnsgrpc.StatusOK.String())
+}
+
+// upstreams returns the current upstreams.
+func (h *grpcHandler) upstreams(_ context.Context, _ []byte) (res any, err error) {
+	return h.svc.Upstreams(), nil
+}
+
+// addUpstream adds the upstream from arg.
+func (h *grpcHandler) addUpstream(_ context.Context, arg []byte) (res any, err error) {
+	req := &upstreamReq{}
+	err = unmarshalArg(arg, req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return nil, h.svc.AddUpstream(req.Upstream)
+}
+
+// removeUpstream removes the upstream from arg.
+func (h *grpcHandler) removeUpstream(_ context.Context, arg []byte) (res any, err error) {
+	req := &upstreamReq{}
+	err = unmarshalArg(arg, req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return nil, h.svc.RemoveUpstream(req.Upstream)
+}
+
+// flushCache flushes the caches.
+func (h *grpcHandler) flushCache(_ context.Context, _ []byte) (res any, err error) {
+	h.svc.FlushCache(h.proxy)
+
+	return nil, nil
+}
+
+// stats returns the statistics.
+func (h *grpcHandler) stats(_ context.Context, _ []byte) (res any, err error) {
+	return h.svc.Stats(h.proxy), nil
+}
+
+// anomalies returns the per-client request statistics sorted by their anomaly
+// scores.
+func (h *grpcHandler) anomalies(_ context.Context, _ []byte) (res any, err error) {
+	anomalies := h.proxy.Anomalies()
+	if anomalies == nil {
+		anomalies = []*proxy.ClientAnomaly{}
+	}
+
+	return anomalies, nil
+}
+
+// filterReq is the argument of the RefreshFilter method.
+type filterReq struct {
+	Name string `json:"name"`
+}
+
+// refreshFilter refreshes the filter from arg.
+func (h *grpcHandler) refreshFilter(ctx context.Context, arg []byte) (res any, err error) {
+	req := &filterReq{}
+	err = unmarshalArg(arg, req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return nil, h.svc.RefreshFilter(ctx, req.Name)
+}
+
+// fastestCache returns the cached ping results of the fastest address
+// selection.
+func (h *grpcHandler) fastestCache(_ context.Context, _ []byte) (res any, err error) {
+	return h.svc.FastestCache(h.proxy)
+}
+
+// ipReq is the argument of the DeleteFastestCache method.
+type ipReq struct {
+	IP netip.Addr `json:"ip"`
+}
+
+// deleteFastestCache removes the cached ping result for the address from arg.
+func (h *grpcHandler) deleteFastestCache(_ context.Context, arg []byte) (res any, err error) {
+	req := &ipReq{}
+	err = unmarshalArg(arg, req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return nil, h.svc.DeleteFastestCache(h.proxy, req.IP)
+}
+
+// flushFastestCache removes all the cached ping results of the fastest address
+// selection.
+func (h *grpcHandler) flushFastestCache(_ context.Context, _ []byte) (res any, err error) {
+	return nil, h.svc.FlushFastestCache(h.proxy)
+}
+
+// tail streams the query log entries as separate messages until the client
+// cancels the call.
+func (h *grpcHandler) tail(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeGRPCStatus(w, dnsgrpc.StatusInternal, "streaming is not supported")
+
+		return
+	}
+
+	// Subscribe before sending the headers, so that the client doesn't miss
+	// the entries after it gets the response.
+	entries := h.svc.Tail(r.Context())
+
+	w.Header().Set(httphdr.ContentType, dnsgrpc.ContentType)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Debug("mgmt: encoding query log entry: %s", err)
+
+			continue
+		}
+
+		_, err = w.Write(dnsgrpc.AppendFrame(nil, data))
+		if err != nil {
+			log.Debug("mgmt: writing query log entry: %s", err)
+
+			return
+		}
+
+		flusher.Flush()
+	}
+
+	w.Header().Set(http.TrailerPrefix+dnsgrpc.HdrStatus, dnsgrpc.StatusOK.String())
+}
+
+// errBadArgument is returned when the argument of a method isn't a valid JSON
+// document of the expected format.
+const errBadArgument errors.Error = "bad argument"
+
+// unmarshalArg decodes the JSON argument of a method into v.
+func unmarshalArg(arg []byte, v any) (err error) {
+	err = json.Unmarshal(arg, v)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadArgument, err)
+	}
+
+	return nil
+}
+
+// grpcStatus returns the gRPC status corresponding to err.
+func grpcStatus(err error) (st dnsgrpc.Status) {
+	switch {
+	case errors.Is(err, errBadArgument):
+		return dnsgrpc.StatusInvalidArgument
+	case errors.Is(err, ErrNotFound):
+		return dnsgrpc.StatusNotFound
+	case errors.Is(err, ErrDuplicate):
+		return dnsgrpc.StatusAlreadyExists
+	case errors.Is(err, ErrLastUpstream):
+		return dnsgrpc.StatusFailedPrecondition
+	default:
+		return dnsgrpc.StatusUnknown
+	}
+}
+
+// writeGRPCStatus writes the gRPC response without messages, which carries the
+// status in the headers.
+func writeGRPCStatus(w http.ResponseWriter, st dnsgrpc.Status, msg string) {
+	hdr := w.Header()
+	hdr.Set(httphdr.ContentType, dnsgrpc.ContentType)
+	hdr.Set(dnsgrpc.HdrStatus, st.String())
+	hdr.Set(dnsgrpc.HdrMessage, msg)
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,191 @@
+package mgmt_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/bruceluk/dnsproxy/internal/dnsgrpc"
+	"github.com/bruceluk/dnsproxy/mgmt"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// newTestGRPCServer returns a new gRPC server of svc for p with token and the
+// HTTP/2 client for it.
+func newTestGRPCServer(
+	t *testing.T,
+	svc *mgmt.Service,
+	p *proxy.Proxy,
+	token string,
+) (srv *httptest.Server, cli *http.Client) {
+	t.Helper()
+
+	srv = httptest.NewServer(mgmt.NewGRPCHandler(svc, p, token))
+	t.Cleanup(srv.Close)
+
+	cli = &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(
+				ctx context.Context,
+				network string,
+				addr string,
+				_ *tls.Config,
+			) (conn net.Conn, err error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+		Timeout: testTimeout,
+	}
+
+	return srv, cli
+}
+
+// callGRPC calls the unary method of the management service with the JSON
+// argument arg and returns the gRPC status and the JSON result.
+func callGRPC(
+	t *testing.T,
+	srv *httptest.Server,
+	cli *http.Client,
+	token string,
+	method string,
+	arg string,
+) (st string, res []byte) {
+	t.Helper()
+
+	body := bytes.NewReader(dnsgrpc.AppendFrame(nil, []byte(arg)))
+	req, err := http.NewRequest(http.MethodPost, srv.URL+mgmt.GRPCPathPrefix+method, body)
+	require.NoError(t, err)
+
+	req.Header.Set(httphdr.ContentType, dnsgrpc.ContentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := cli.Do(req)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, resp.Body.Close()) }()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	if st = resp.Header.Get(dnsgrpc.HdrStatus); st != "" {
+		return st, nil
+	}
+
+	res, err = dnsgrpc.ReadFrame(resp.Body)
+	require.NoError(t, err)
+
+	// Read the rest of the body to get the trailers.
+	_, err = dnsgrpc.ReadFrame(resp.Body)
+	require.Error(t, err)
+
+	return resp.Trailer.Get(dnsgrpc.HdrStatus), res
+}
+
+func TestNewGRPCHandler(t *testing.T) {
+	const token = "secret"
+
+	svc, p := newTestProxy(t, nil)
+	srv, cli := newTestGRPCServer(t, svc, p, token)
+
+	ok, notFound := dnsgrpc.StatusOK.String(), dnsgrpc.StatusNotFound.String()
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		st, _ := callGRPC(t, srv, cli, "", "Upstreams", "")
+		assert.Equal(t, dnsgrpc.StatusUnauthenticated.String(), st)
+	})
+
+	t.Run("upstreams", func(t *testing.T) {
+		const added = `{"upstream":"192.0.2.2:53"}`
+
+		st, _ := callGRPC(t, srv, cli, token, "AddUpstream", added)
+		require.Equal(t, ok, st)
+
+		st, _ = callGRPC(t, srv, cli, token, "AddUpstream", added)
+		assert.Equal(t, dnsgrpc.StatusAlreadyExists.String(), st)
+
+		st, res := callGRPC(t, srv, cli, token, "Upstreams", "")
+		require.Equal(t, ok, st)
+
+		var lines []string
+		require.NoError(t, json.Unmarshal(res, &lines))
+
+		assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53"}, lines)
+
+		st, _ = callGRPC(t, srv, cli, token, "RemoveUpstream", `{"upstream":"192.0.2.3:53"}`)
+		assert.Equal(t, notFound, st)
+
+		st, _ = callGRPC(t, srv, cli, token, "RemoveUpstream", `bad`)
+		assert.Equal(t, dnsgrpc.StatusInvalidArgument.String(), st)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		svc.HandleResponse(&proxy.DNSContext{
+			Req: (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA),
+		}, nil)
+
+		st, res := callGRPC(t, srv, cli, token, "Stats", "")
+		require.Equal(t, ok, st)
+
+		stats := &mgmt.Stats{}
+		require.NoError(t, json.Unmarshal(res, stats))
+
+		assert.Equal(t, uint64(1), stats.Requests)
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		st, _ := callGRPC(t, srv, cli, token, "RefreshFilter", `{"name":"none"}`)
+		assert.Equal(t, notFound, st)
+
+		st, _ = callGRPC(t, srv, cli, token, "FlushFastestCache", "")
+		assert.Equal(t, notFound, st)
+	})
+
+	t.Run("unknown_method", func(t *testing.T) {
+		st, _ := callGRPC(t, srv, cli, token, "Unknown", "")
+		assert.Equal(t, dnsgrpc.StatusUnimplemented.String(), st)
+	})
+}
+
+func TestNewGRPCHandler_tail(t *testing.T) {
+	svc, p := newTestProxy(t, nil)
+	srv, cli := newTestGRPCServer(t, svc, p, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	body := bytes.NewReader(dnsgrpc.AppendFrame(nil, nil))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+mgmt.GRPCPathPrefix+"Tail", body)
+	require.NoError(t, err)
+
+	req.Header.Set(httphdr.ContentType, dnsgrpc.ContentType)
+
+	resp, err := cli.Do(req)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, resp.Body.Close()) }()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The subscription is made before the response headers are sent.
+	svc.HandleResponse(&proxy.DNSContext{
+		Req: (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA),
+	}, nil)
+
+	data, err := dnsgrpc.ReadFrame(resp.Body)
+	require.NoError(t, err)
+
+	e := &mgmt.LogEntry{}
+	require.NoError(t, json.Unmarshal(data, e))
+
+	assert.Equal(t, "example.com.", e.Name)
+}
@@ -0,0 +1,226 @@
+package mgmt
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/proxy"
+)
+
+// handler serves the operations of a [Service] for a proxy as JSON over HTTP.
+type handler struct {
+	svc   *Service
+	proxy *proxy.Proxy
+	mux   *http.ServeMux
+	token string
+}
+
+// NewHandler returns an HTTP handler serving the operations of svc for p.  If
+// token isn't empty, the requests must have it as a bearer token.
+func NewHandler(svc *Service, p *proxy.Proxy, token string) (h http.Handler) {
+	hdlr := &handler{
+		svc:   svc,
+		proxy: p,
+		mux:   http.NewServeMux(),
+		token: token,
+	}
+
+	hdlr.mux.HandleFunc("GET /upstreams", hdlr.handleUpstreams)
+	hdlr.mux.HandleFunc("POST /upstreams", hdlr.handleAddUpstream)
+	hdlr.mux.HandleFunc("DELETE /upstreams", hdlr.handleRemoveUpstream)
+	hdlr.mux.HandleFunc("POST /cache/flush", hdlr.handleFlushCache)
+	hdlr.mux.HandleFunc("GET /stats", hdlr.handleStats)
+	hdlr.mux.HandleFunc("GET /anomalies", hdlr.handleAnomalies)
+	hdlr.mux.HandleFunc("GET /querylog/tail", hdlr.handleTail)
+	hdlr.mux.HandleFunc("GET /querylog/stream", hdlr.handleStream)
+	hdlr.mux.HandleFunc("POST /filters/{name}/refresh", hdlr.handleRefreshFilter)
+	hdlr.mux.HandleFunc("GET /fastest/cache", hdlr.handleFastestCache)
+	hdlr.mux.HandleFunc("DELETE /fastest/cache/{ip}", hdlr.handleDeleteFastestCache)
+	hdlr.mux.HandleFunc("POST /fastest/cache/flush", hdlr.handleFlushFastestCache)
+	if svc.metrics != nil {
+		hdlr.mux.Handle("GET /metrics", svc.metrics)
+	}
+
+	return hdlr
+}
+
+// type check
+var _ http.Handler = (*handler)(nil)
+
+// ServeHTTP implements the [http.Handler] interface for *handler.
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, h.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+// authorized returns true if token is empty or r has it as a bearer token.
+func authorized(r *http.Request, token string) (ok bool) {
+	if token == "" {
+		return true
+	}
+
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return ok && subtle.ConstantTimeCompare([]byte(tok), []byte(token)) == 1
+}
+
+// upstreamReq is the body of the requests adding and removing upstreams.
+type upstreamReq struct {
+	Upstream string `json:"upstream"`
+}
+
+// handleUpstreams responds with the current upstreams.
+func (h *handler) handleUpstreams(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, h.svc.Upstreams())
+}
+
+// handleAddUpstream adds the upstream from the request body.
+func (h *handler) handleAddUpstream(w http.ResponseWriter, r *http.Request) {
+	req := &upstreamReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	writeResult(w, h.svc.AddUpstream(req.Upstream))
+}
+
+// handleRemoveUpstream removes the upstream from the request body.
+func (h *handler) handleRemoveUpstream(w http.ResponseWriter, r *http.Request) {
+	req := &upstreamReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	writeResult(w, h.svc.RemoveUpstream(req.Upstream))
+}
+
+// handleFlushCache flushes the caches.
+func (h *handler) handleFlushCache(w http.ResponseWriter, _ *http.Request) {
+	h.svc.FlushCache(h.proxy)
+
+	writeResult(w, nil)
+}
+
+// handleStats responds with the statistics.
+func (h *handler) handleStats(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, h.svc.Stats(h.proxy))
+}
+
+// handleAnomalies responds with the per-client request statistics sorted by
+// their anomaly scores.
+func (h *handler) handleAnomalies(w http.ResponseWriter, _ *http.Request) {
+	anomalies := h.proxy.Anomalies()
+	if anomalies == nil {
+		anomalies = []*proxy.ClientAnomaly{}
+	}
+
+	writeJSON(w, anomalies)
+}
+
+// handleRefreshFilter refreshes the filter from the request path.
+func (h *handler) handleRefreshFilter(w http.ResponseWriter, r *http.Request) {
+	writeResult(w, h.svc.RefreshFilter(r.Context(), r.PathValue("name")))
+}
+
+// handleFastestCache responds with the cached ping results of the fastest
+// address selection.
+func (h *handler) handleFastestCache(w http.ResponseWriter, _ *http.Request) {
+	ents, err := h.svc.FastestCache(h.proxy)
+	if err != nil {
+		writeResult(w, err)
+
+		return
+	}
+
+	writeJSON(w, ents)
+}
+
+// handleDeleteFastestCache removes the cached ping result for the address from
+// the request path.
+func (h *handler) handleDeleteFastestCache(w http.ResponseWriter, r *http.Request) {
+	ip, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	writeResult(w, h.svc.DeleteFastestCache(h.proxy, ip))
+}
+
+// handleFlushFastestCache removes all the cached ping results of the fastest
+// address selection.
+func (h *handler) handleFlushFastestCache(w http.ResponseWriter, _ *http.Request) {
+	writeResult(w, h.svc.FlushFastestCache(h.proxy))
+}
+
+// handleTail streams the query log entries as newline-delimited JSON until the
+// client disconnects.
+func (h *handler) handleTail(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+
+		return
+	}
+
+	// Subscribe before sending the headers, so that the client doesn't miss
+	// the entries after it gets the response.
+	entries := h.svc.Tail(r.Context())
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for e := range entries {
+		err := enc.Encode(e)
+		if err != nil {
+			log.Debug("mgmt: writing query log entry: %s", err)
+
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// writeResult responds with the status corresponding to err.
+func writeResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrDuplicate), errors.Is(err, ErrLastUpstream):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	}
+}
+
+// writeJSON responds with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Debug("mgmt: writing response: %s", err)
+	}
+}
@@ -0,0 +1,372 @@
+// Package mgmt implements the management API for controlling a running proxy,
+// so that orchestration systems can manage fleets of proxies programmatically.
+//
+// The operations are defined by [Service] independently of the transport.
+// [NewHandler] serves them as JSON over HTTP, see the README for the endpoints,
+// and [NewGRPCHandler] serves them over gRPC, see mgmt.proto.
+package mgmt
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/bruceluk/dnsproxy/upstream"
+)
+
+// retireDelay is the time after which the replaced upstreams are closed, so
+// that the requests in flight can complete.
+const retireDelay = 1 * time.Minute
+
+const (
+	// ErrNotFound is returned when the upstream or the filter doesn't exist, or
+	// the proxy doesn't choose the fastest addresses.
+	ErrNotFound errors.Error = "not found"
+
+	// ErrDuplicate is returned when the added upstream already exists.
+	ErrDuplicate errors.Error = "already exists"
+
+	// ErrLastUpstream is returned on removing the only upstream left.
+	ErrLastUpstream errors.Error = "can't remove the last upstream"
+)
+
+// Refresher is a filter, which can be refreshed at runtime, such as
+// *category.ReloadingCategorizer.
+type Refresher interface {
+	// Refresh reloads the filter.  It must be safe for concurrent use.
+	Refresh(ctx context.Context) (err error)
+}
+
+// Config is the configuration of a [Service].
+type Config struct {
+	// UpstreamOptions are the options for the upstreams added at runtime.  It
+	// must not be nil.
+	UpstreamOptions *upstream.Options
+
+	// Filters are the filters, which can be refreshed at runtime, by their
+	// names.
+	Filters map[string]Refresher
+
+	// Metrics, if not nil, serves the metrics of the proxy, such as
+	// *fastip.PrometheusMetrics.
+	Metrics http.Handler
+
+	// Upstreams are the lines of the initial upstream configuration, which the
+	// upstreams are added to and removed from, in the format of
+	// [proxy.ParseUpstreamsConfig].
+	Upstreams []string
+
+	// CacheSize is the size of the cache of the upstreams set at runtime in
+	// bytes.
+	CacheSize int
+
+	// TailQueueSize is the maximum number of the query log entries waiting to
+	// be sent to each subscriber.  When the queue is full, the entries are
+	// dropped.  If not positive, a default value of 256 is used.
+	TailQueueSize int
+
+	// CacheEnabled defines if the upstreams set at runtime have a cache.
+	CacheEnabled bool
+
+	// EnableEDNSClientSubnet defines if the cache of the upstreams set at
+	// runtime considers the EDNS Client Subnet option.
+	EnableEDNSClientSubnet bool
+}
+
+// Service performs the management operations.  It must be set as both
+// [proxy.Config.BeforeRequestHandler] and [proxy.Config.ResponseHandler] of the
+// managed proxy.  It's safe for concurrent use.
+type Service struct {
+	// override is the upstream configuration set at runtime.  It's nil until
+	// the upstreams are changed, so that the configured ones are used.
+	override atomic.Pointer[proxy.CustomUpstreamConfig]
+
+	// tail broadcasts the query log entries to the subscribers.
+	tail *tail
+
+	// requests is the number of processed requests.
+	requests *atomic.Uint64
+
+	// failures is the number of requests failed to be resolved.
+	failures *atomic.Uint64
+
+	// upstreamsMu protects upstreams and serializes the changes of override.
+	upstreamsMu *sync.Mutex
+
+	// upstreams are the current lines of the upstream configuration.
+	upstreams []string
+
+	upsOpts      *upstream.Options
+	filters      map[string]Refresher
+	metrics      http.Handler
+	cacheSize    int
+	cacheEnabled bool
+	enableECS    bool
+}
+
+// New returns a new properly initialized *Service.  c must not be nil.
+func New(c *Config) (s *Service) {
+	return &Service{
+		tail:         newTail(c.TailQueueSize),
+		requests:     &atomic.Uint64{},
+		failures:     &atomic.Uint64{},
+		upstreamsMu:  &sync.Mutex{},
+		upstreams:    slices.Clone(c.Upstreams),
+		upsOpts:      c.UpstreamOptions,
+		filters:      c.Filters,
+		metrics:      c.Metrics,
+		cacheSize:    c.CacheSize,
+		cacheEnabled: c.CacheEnabled,
+		enableECS:    c.EnableEDNSClientSubnet,
+	}
+}
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Service)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Service.  It makes the request use the upstreams set at runtime, unless
+// another handler has already chosen the upstreams for it.
+func (s *Service) HandleBefore(_ *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	if dctx.CustomUpstreamConfig == nil {
+		dctx.CustomUpstreamConfig = s.override.Load()
+	}
+
+	return nil
+}
+
+// HandleResponse counts the request from dctx and sends it to the query log
+// subscribers.  It never blocks.  It's intended to be used as
+// [proxy.Config.ResponseHandler] with [proxy.Config.HandleCachedResponses] set,
+// so that the requests answered from the cache are counted as well.
+func (s *Service) HandleResponse(dctx *proxy.DNSContext, err error) {
+	s.requests.Add(1)
+	if err != nil {
+		s.failures.Add(1)
+	}
+
+	if dctx.Req != nil && len(dctx.Req.Question) > 0 {
+		s.tail.publish(newLogEntry(dctx, err))
+	}
+}
+
+// Upstreams returns the current lines of the upstream configuration.
+func (s *Service) Upstreams() (lines []string) {
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+
+	return slices.Clone(s.upstreams)
+}
+
+// AddUpstream adds the line of the upstream configuration, in the format of
+// [proxy.ParseUpstreamsConfig], and makes the proxy use the new upstreams.
+func (s *Service) AddUpstream(line string) (err error) {
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+
+	if slices.Contains(s.upstreams, line) {
+		return fmt.Errorf("upstream %q: %w", line, ErrDuplicate)
+	}
+
+	return s.setUpstreams(append(slices.Clone(s.upstreams), line))
+}
+
+// RemoveUpstream removes the line of the upstream configuration and makes the
+// proxy use the rest of the upstreams.
+func (s *Service) RemoveUpstream(line string) (err error) {
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+
+	i := slices.Index(s.upstreams, line)
+	if i < 0 {
+		return fmt.Errorf("upstream %q: %w", line, ErrNotFound)
+	} else if len(s.upstreams) == 1 {
+		return ErrLastUpstream
+	}
+
+	return s.setUpstreams(slices.Delete(slices.Clone(s.upstreams), i, i+1))
+}
+
+// setUpstreams parses lines and replaces the upstreams set at runtime with
+// them.  The replaced upstreams are closed after [retireDelay].
+// s.upstreamsMu must be locked.
+func (s *Service) setUpstreams(lines []string) (err error) {
+	uc, err := proxy.ParseUpstreamsConfig(lines, s.upsOpts)
+	if err != nil {
+		return fmt.Errorf("parsing upstreams: %w", err)
+	}
+
+	custom := proxy.NewCustomUpstreamConfig(uc, s.cacheEnabled, s.cacheSize, s.enableECS)
+	if prev := s.override.Swap(custom); prev != nil {
+		time.AfterFunc(retireDelay, func() {
+			if closeErr := prev.Close(); closeErr != nil {
+				log.Debug("mgmt: closing replaced upstreams: %s", closeErr)
+			}
+		})
+	}
+
+	s.upstreams = lines
+	log.Info("mgmt: upstreams set to %q", lines)
+
+	return nil
+}
+
+// FlushCache removes all the items from the caches of p and of the upstreams
+// set at runtime.
+func (s *Service) FlushCache(p *proxy.Proxy) {
+	p.ClearCache()
+	if custom := s.override.Load(); custom != nil {
+		custom.ClearCache()
+	}
+
+	log.Info("mgmt: cache flushed")
+}
+
+// Stats are the statistics of a proxy.
+type Stats struct {
+	// Top are the heaviest domains and clients.
+	Top proxy.TopStats `json:"top"`
+
+	// Cache are the statistics of the DNS cache.
+	Cache proxy.CacheStats `json:"cache"`
+
+	// FastOpen are the statistics of TCP Fast Open on the listeners.
+	FastOpen proxy.TCPFastOpenStats `json:"fast_open"`
+
+	// UpstreamFastOpen is the number of the connections to the upstreams,
+	// which data within the SYN has been accepted.
+	UpstreamFastOpen uint64 `json:"upstream_fast_open"`
+
+	// QUICECN are the statistics of ECN on the QUIC listeners.
+	QUICECN proxy.QUICECNStats `json:"quic_ecn"`
+
+	// ZeroTTL are the statistics of the responses with zero TTLs.
+	ZeroTTL proxy.ZeroTTLStats `json:"zero_ttl"`
+
+	// Requests is the number of processed requests.
+	Requests uint64 `json:"requests"`
+
+	// Failures is the number of requests failed to be resolved.
+	Failures uint64 `json:"failures"`
+}
+
+// Stats returns the current statistics of p.
+func (s *Service) Stats(p *proxy.Proxy) (st *Stats) {
+	st = &Stats{
+		Top:      p.TopStats(),
+		Cache:    p.CacheStats(),
+		FastOpen: p.TCPFastOpenStats(),
+		QUICECN:  p.QUICECNStats(),
+		ZeroTTL:  p.ZeroTTLStats(),
+		Requests: s.requests.Load(),
+		Failures: s.failures.Load(),
+	}
+
+	if s.upsOpts.FastOpen != nil {
+		st.UpstreamFastOpen = s.upsOpts.FastOpen.Hits()
+	}
+
+	return st
+}
+
+// FastestCacheEntry is a cached ping result of the fastest address selection.
+type FastestCacheEntry struct {
+	// Expire is the time the entry expires at.
+	Expire time.Time `json:"expire"`
+
+	// Addr is the pinged address.
+	Addr netip.Addr `json:"addr"`
+
+	// Latency is the latency of the successful ping.
+	Latency time.Duration `json:"latency_ns"`
+
+	// Failed is true if the address couldn't be pinged.
+	Failed bool `json:"failed"`
+}
+
+// FastestCache returns the cached ping results of the fastest address selection
+// of p sorted by the address.
+func (s *Service) FastestCache(p *proxy.Proxy) (ents []*FastestCacheEntry, err error) {
+	f := p.FastestAddrFinder()
+	if f == nil {
+		return nil, fmt.Errorf("fastest addr: %w", ErrNotFound)
+	}
+
+	ents = []*FastestCacheEntry{}
+	for _, e := range f.CacheEntries() {
+		ents = append(ents, &FastestCacheEntry{
+			Expire:  e.Expire,
+			Addr:    e.Addr,
+			Latency: e.Latency,
+			Failed:  e.Failed,
+		})
+	}
+
+	slices.SortFunc(ents, func(a, b *FastestCacheEntry) (res int) {
+		return a.Addr.Compare(b.Addr)
+	})
+
+	return ents, nil
+}
+
+// DeleteFastestCache removes the cached ping result for ip from the fastest
+// address selection of p, so that ip is pinged again.
+func (s *Service) DeleteFastestCache(p *proxy.Proxy, ip netip.Addr) (err error) {
+	f := p.FastestAddrFinder()
+	if f == nil {
+		return fmt.Errorf("fastest addr: %w", ErrNotFound)
+	}
+
+	f.CacheDelete(ip)
+
+	log.Info("mgmt: fastest addr cache entry for %s removed", ip)
+
+	return nil
+}
+
+// FlushFastestCache removes all the cached ping results from the fastest
+// address selection of p.
+func (s *Service) FlushFastestCache(p *proxy.Proxy) (err error) {
+	f := p.FastestAddrFinder()
+	if f == nil {
+		return fmt.Errorf("fastest addr: %w", ErrNotFound)
+	}
+
+	f.CacheFlush()
+
+	log.Info("mgmt: fastest addr cache flushed")
+
+	return nil
+}
+
+// RefreshFilter refreshes the filter with name.
+func (s *Service) RefreshFilter(ctx context.Context, name string) (err error) {
+	f, ok := s.filters[name]
+	if !ok {
+		return fmt.Errorf("filter %q: %w", name, ErrNotFound)
+	}
+
+	err = f.Refresh(ctx)
+	if err != nil {
+		return fmt.Errorf("refreshing filter %q: %w", name, err)
+	}
+
+	log.Info("mgmt: filter %q refreshed", name)
+
+	return nil
+}
+
+// Tail returns the channel receiving the query log entries of the requests
+// processed until ctx is canceled.  The channel is closed afterwards.  The
+// entries are dropped if the receiver can't keep up.
+func (s *Service) Tail(ctx context.Context) (entries <-chan *LogEntry) {
+	return s.tail.subscribe(ctx)
+}
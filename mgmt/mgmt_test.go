@@ -0,0 +1,384 @@
+package mgmt_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/bruceluk/dnsproxy/fastip"
+	"github.com/bruceluk/dnsproxy/mgmt"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// fakeRefresher is a [mgmt.Refresher] for tests.
+type fakeRefresher struct {
+	onRefresh func(ctx context.Context) (err error)
+}
+
+// type check
+var _ mgmt.Refresher = (*fakeRefresher)(nil)
+
+// Refresh implements the [mgmt.Refresher] interface for *fakeRefresher.
+func (r *fakeRefresher) Refresh(ctx context.Context) (err error) {
+	return r.onRefresh(ctx)
+}
+
+// newTestService returns a new service and the HTTP server serving it with
+// token.
+func newTestService(
+	t *testing.T,
+	filters map[string]mgmt.Refresher,
+	token string,
+) (svc *mgmt.Service, srv *httptest.Server) {
+	t.Helper()
+
+	svc, p := newTestProxy(t, filters)
+
+	srv = httptest.NewServer(mgmt.NewHandler(svc, p, token))
+	t.Cleanup(srv.Close)
+
+	return svc, srv
+}
+
+// newTestProxy returns a new service and the proxy it manages.
+func newTestProxy(
+	t *testing.T,
+	filters map[string]mgmt.Refresher,
+) (svc *mgmt.Service, p *proxy.Proxy) {
+	t.Helper()
+
+	upsOpts := &upstream.Options{Timeout: testTimeout}
+	lines := []string{"192.0.2.1:53"}
+
+	uc, err := proxy.ParseUpstreamsConfig(lines, upsOpts)
+	require.NoError(t, err)
+
+	p, err = proxy.New(&proxy.Config{
+		UpstreamConfig: uc,
+		CacheEnabled:   true,
+		TopStatsSize:   10,
+	})
+	require.NoError(t, err)
+
+	svc = mgmt.New(&mgmt.Config{
+		UpstreamOptions: upsOpts,
+		Filters:         filters,
+		Upstreams:       lines,
+	})
+
+	return svc, p
+}
+
+// do sends the request with method, path, and body to srv and returns the
+// response status code.
+func do(t *testing.T, srv *httptest.Server, method, path, body string) (code int) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	return resp.StatusCode
+}
+
+func TestService_upstreams(t *testing.T) {
+	svc, srv := newTestService(t, nil, "")
+
+	dctx := &proxy.DNSContext{}
+	require.NoError(t, svc.HandleBefore(nil, dctx))
+	assert.Nil(t, dctx.CustomUpstreamConfig)
+
+	const added = `{"upstream":"192.0.2.2:53"}`
+
+	assert.Equal(t, http.StatusNoContent, do(t, srv, http.MethodPost, "/upstreams", added))
+	assert.Equal(t, http.StatusConflict, do(t, srv, http.MethodPost, "/upstreams", added))
+	assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53"}, svc.Upstreams())
+
+	require.NoError(t, svc.HandleBefore(nil, dctx))
+	assert.NotNil(t, dctx.CustomUpstreamConfig)
+
+	code := do(t, srv, http.MethodDelete, "/upstreams", `{"upstream":"192.0.2.1:53"}`)
+	assert.Equal(t, http.StatusNoContent, code)
+
+	code = do(t, srv, http.MethodDelete, "/upstreams", `{"upstream":"192.0.2.3:53"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	err := svc.RemoveUpstream("192.0.2.2:53")
+	assert.ErrorIs(t, err, mgmt.ErrLastUpstream)
+
+	err = svc.AddUpstream("bad://upstream")
+	assert.Error(t, err)
+}
+
+func TestService_stats(t *testing.T) {
+	svc, srv := newTestService(t, nil, "")
+
+	dctx := &proxy.DNSContext{
+		Req:  (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA),
+		Addr: netip.MustParseAddrPort("192.0.2.10:5353"),
+	}
+	svc.HandleResponse(dctx, nil)
+	svc.HandleResponse(dctx, errors.Error("test"))
+
+	assert.Equal(t, http.StatusNoContent, do(t, srv, http.MethodPost, "/cache/flush", ""))
+
+	resp, err := srv.Client().Get(srv.URL + "/stats")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, resp.Body.Close()) }()
+
+	st := &mgmt.Stats{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(st))
+
+	assert.Equal(t, uint64(2), st.Requests)
+	assert.Equal(t, uint64(1), st.Failures)
+	assert.Positive(t, st.Cache.HighWatermark)
+
+	anomaliesResp, err := srv.Client().Get(srv.URL + "/anomalies")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, anomaliesResp.Body.Close()) }()
+
+	var anomalies []*proxy.ClientAnomaly
+	require.NoError(t, json.NewDecoder(anomaliesResp.Body).Decode(&anomalies))
+
+	assert.NotNil(t, anomalies)
+	assert.Empty(t, anomalies)
+}
+
+func TestService_Tail(t *testing.T) {
+	svc, srv := newTestService(t, nil, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/querylog/tail", nil)
+	require.NoError(t, err)
+
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, resp.Body.Close()) }()
+
+	dctx := &proxy.DNSContext{
+		Req:   (&dns.Msg{}).SetQuestion("example.com.", dns.TypeAAAA),
+		Res:   (&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}),
+		Addr:  netip.MustParseAddrPort("192.0.2.10:5353"),
+		Proto: proxy.ProtoUDP,
+	}
+	proxy.SetValue(dctx, proxy.KeyCategory, "adult")
+
+	// The handler flushes the headers after subscribing.
+	svc.HandleResponse(dctx, nil)
+
+	sc := bufio.NewScanner(resp.Body)
+	require.True(t, sc.Scan())
+
+	e := &mgmt.LogEntry{}
+	require.NoError(t, json.Unmarshal(sc.Bytes(), e))
+
+	assert.Equal(t, "example.com.", e.Name)
+	assert.Equal(t, "AAAA", e.Type)
+	assert.Equal(t, "NXDOMAIN", e.Rcode)
+	assert.Equal(t, "192.0.2.10", e.Client)
+	assert.Equal(t, proxy.ProtoUDP, e.Proto)
+	assert.Equal(t, map[string]string{"category": "adult"}, e.Values)
+}
+
+func TestNewHandler_stream(t *testing.T) {
+	svc, srv := newTestService(t, nil, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	const path = "/querylog/stream?domain=Example.COM&client=192.0.2.0/24&rcode=nxdomain"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+path, nil)
+	require.NoError(t, err)
+
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, resp.Body.Close()) }()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	for _, q := range []struct {
+		name   string
+		client string
+		rcode  int
+	}{{
+		name:   "example.org.",
+		client: "192.0.2.10:5353",
+		rcode:  dns.RcodeNameError,
+	}, {
+		name:   "www.example.com.",
+		client: "198.51.100.1:5353",
+		rcode:  dns.RcodeNameError,
+	}, {
+		name:   "www.example.com.",
+		client: "192.0.2.10:5353",
+		rcode:  dns.RcodeSuccess,
+	}, {
+		name:   "www.example.com.",
+		client: "192.0.2.10:5353",
+		rcode:  dns.RcodeNameError,
+	}} {
+		svc.HandleResponse(&proxy.DNSContext{
+			Req:   (&dns.Msg{}).SetQuestion(q.name, dns.TypeA),
+			Res:   (&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: q.rcode}}),
+			Addr:  netip.MustParseAddrPort(q.client),
+			Proto: proxy.ProtoUDP,
+		}, nil)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	require.True(t, sc.Scan())
+	assert.Equal(t, "event: query", sc.Text())
+
+	require.True(t, sc.Scan())
+	data, ok := strings.CutPrefix(sc.Text(), "data: ")
+	require.True(t, ok)
+
+	e := &mgmt.LogEntry{}
+	require.NoError(t, json.Unmarshal([]byte(data), e))
+
+	assert.Equal(t, "www.example.com.", e.Name)
+	assert.Equal(t, "NXDOMAIN", e.Rcode)
+	assert.Equal(t, "192.0.2.10", e.Client)
+
+	require.True(t, sc.Scan())
+	assert.Empty(t, sc.Text())
+}
+
+func TestNewHandler_streamBadFilter(t *testing.T) {
+	_, srv := newTestService(t, nil, "")
+
+	for _, path := range []string{
+		"/querylog/stream?client=bad",
+		"/querylog/stream?client=192.0.2.0/33",
+		"/querylog/stream?min_elapsed=1",
+	} {
+		assert.Equal(t, http.StatusBadRequest, do(t, srv, http.MethodGet, path, ""), path)
+	}
+}
+
+func TestService_RefreshFilter(t *testing.T) {
+	refreshed := 0
+	filters := map[string]mgmt.Refresher{
+		"ads": &fakeRefresher{
+			onRefresh: func(_ context.Context) (err error) {
+				refreshed++
+
+				return nil
+			},
+		},
+		"broken": &fakeRefresher{
+			onRefresh: func(_ context.Context) (err error) {
+				return errors.Error("test")
+			},
+		},
+	}
+
+	_, srv := newTestService(t, filters, "")
+
+	assert.Equal(t, http.StatusNoContent, do(t, srv, http.MethodPost, "/filters/ads/refresh", ""))
+	assert.Equal(t, 1, refreshed)
+
+	code := do(t, srv, http.MethodPost, "/filters/broken/refresh", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code = do(t, srv, http.MethodPost, "/filters/unknown/refresh", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestService_FastestCache(t *testing.T) {
+	_, srv := newTestService(t, nil, "")
+
+	code := do(t, srv, http.MethodGet, "/fastest/cache", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	upsOpts := &upstream.Options{Timeout: testTimeout}
+	uc, err := proxy.ParseUpstreamsConfig([]string{"192.0.2.1:53"}, upsOpts)
+	require.NoError(t, err)
+
+	f := fastip.NewFastestAddr()
+	p, err := proxy.New(&proxy.Config{
+		UpstreamConfig: uc,
+		UpstreamMode:   proxy.UModeFastestAddr,
+		FastestAddr:    f,
+	})
+	require.NoError(t, err)
+
+	svc := mgmt.New(&mgmt.Config{UpstreamOptions: upsOpts})
+	srv = httptest.NewServer(mgmt.NewHandler(svc, p, ""))
+	t.Cleanup(srv.Close)
+
+	expire := time.Now().Add(time.Hour).Truncate(time.Second)
+	f.RestoreCache([]*fastip.CacheEntry{{
+		Expire:  expire,
+		Addr:    netip.MustParseAddr("192.0.2.2"),
+		Latency: 20 * time.Millisecond,
+	}, {
+		Expire: expire,
+		Addr:   netip.MustParseAddr("192.0.2.1"),
+		Failed: true,
+	}})
+
+	resp, err := srv.Client().Get(srv.URL + "/fastest/cache")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, resp.Body.Close()) }()
+
+	var ents []*mgmt.FastestCacheEntry
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&ents))
+	require.Len(t, ents, 2)
+
+	assert.Equal(t, netip.MustParseAddr("192.0.2.1"), ents[0].Addr)
+	assert.True(t, ents[0].Failed)
+	assert.Equal(t, 20*time.Millisecond, ents[1].Latency)
+	assert.True(t, expire.Equal(ents[1].Expire))
+
+	code = do(t, srv, http.MethodDelete, "/fastest/cache/bad", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code = do(t, srv, http.MethodDelete, "/fastest/cache/192.0.2.1", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	require.Len(t, f.CacheEntries(), 1)
+
+	code = do(t, srv, http.MethodPost, "/fastest/cache/flush", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.Empty(t, f.CacheEntries())
+}
+
+func TestNewHandler_token(t *testing.T) {
+	const token = "secret"
+
+	_, srv := newTestService(t, nil, token)
+
+	assert.Equal(t, http.StatusUnauthorized, do(t, srv, http.MethodGet, "/upstreams", ""))
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/upstreams", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
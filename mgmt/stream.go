@@ -0,0 +1,183 @@
+package mgmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// streamKeepAlive is the interval of sending the comments to the event stream
+// subscribers, so that the intermediate proxies don't close the idle
+// connections.
+const streamKeepAlive = 15 * time.Second
+
+// logFilter selects the query log entries sent to a subscriber.  The empty
+// fields match any entry.
+type logFilter struct {
+	// client is the network of the clients.
+	client netip.Prefix
+
+	// domain is the lowercased FQDN of the requested domain, which also
+	// matches its subdomains.
+	domain string
+
+	// rcode is the response code.
+	rcode string
+
+	// source is the source of the response.
+	source string
+
+	// minElapsed is the minimum time spent resolving the request.
+	minElapsed time.Duration
+
+	// failed makes the filter match only the requests failed to be resolved.
+	failed bool
+}
+
+// newLogFilter returns the filter of the query log entries from the query
+// parameters of the request.
+func newLogFilter(q url.Values) (f *logFilter, err error) {
+	f = &logFilter{
+		domain: dns.CanonicalName(q.Get("domain")),
+		rcode:  strings.ToUpper(q.Get("rcode")),
+		source: strings.ToLower(q.Get("source")),
+	}
+
+	if f.domain == "." {
+		f.domain = ""
+	}
+
+	if s := q.Get("client"); s != "" {
+		f.client, err = parseClient(s)
+		if err != nil {
+			return nil, fmt.Errorf("client: %w", err)
+		}
+	}
+
+	if s := q.Get("min_elapsed"); s != "" {
+		f.minElapsed, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("min_elapsed: %w", err)
+		}
+	}
+
+	f.failed = q.Get("failed") == "true"
+
+	return f, nil
+}
+
+// parseClient parses the network of the clients from an IP address or a CIDR.
+func parseClient(s string) (pref netip.Prefix, err error) {
+	if !strings.Contains(s, "/") {
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(s)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return netip.Prefix{}, err
+		}
+
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	pref, err = netip.ParsePrefix(s)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return netip.Prefix{}, err
+	}
+
+	return pref.Masked(), nil
+}
+
+// match returns true if e matches f.
+func (f *logFilter) match(e *LogEntry) (ok bool) {
+	switch {
+	case f.domain != "" && !dns.IsSubDomain(f.domain, strings.ToLower(e.Name)):
+		return false
+	case f.rcode != "" && e.Rcode != f.rcode:
+		return false
+	case f.source != "" && e.Source != f.source:
+		return false
+	case e.Elapsed < f.minElapsed:
+		return false
+	case f.failed && e.Error == "":
+		return false
+	case f.client.IsValid():
+		addr, err := netip.ParseAddr(e.Client)
+
+		return err == nil && f.client.Contains(addr.Unmap())
+	default:
+		return true
+	}
+}
+
+// handleStream streams the query log entries as server-sent events until the
+// client disconnects.
+func (h *handler) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+
+		return
+	}
+
+	filter, err := newLogFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	// Subscribe before sending the headers, so that the client doesn't miss
+	// the entries after it gets the response.
+	entries := h.svc.Tail(r.Context())
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, open := <-entries:
+			if !open {
+				return
+			} else if !filter.match(e) {
+				continue
+			}
+
+			err = writeEvent(w, e)
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		}
+
+		if err != nil {
+			log.Debug("mgmt: writing query event: %s", err)
+
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes e to w as a server-sent event of the "query" type.
+func writeEvent(w http.ResponseWriter, e *LogEntry) (err error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding entry: %w", err)
+	}
+
+	_, err = fmt.Fprintf(w, "event: query\ndata: %s\n\n", data)
+
+	return err
+}
@@ -0,0 +1,163 @@
+package mgmt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// defaultTailQueueSize is the default number of the query log entries waiting
+// to be sent to each subscriber.
+const defaultTailQueueSize = 256
+
+// LogEntry is a query log entry of a processed request.
+type LogEntry struct {
+	// Time is the time the request has been processed at.
+	Time time.Time `json:"time"`
+
+	// Client is the IP address of the client.
+	Client string `json:"client"`
+
+	// Proto is the protocol the request has been received over.
+	Proto proxy.Proto `json:"proto"`
+
+	// Name is the requested domain name.
+	Name string `json:"name"`
+
+	// Type is the requested record type.
+	Type string `json:"type"`
+
+	// Rcode is the response code, if there is a response.
+	Rcode string `json:"rcode,omitempty"`
+
+	// Upstream is the address of the upstream the response has been received
+	// from, if any.
+	Upstream string `json:"upstream,omitempty"`
+
+	// Source is the source of the response, see [proxy.Source].
+	Source string `json:"source,omitempty"`
+
+	// Error is the error of resolving the request, if any.
+	Error string `json:"error,omitempty"`
+
+	// Elapsed is the time spent resolving the request.
+	Elapsed time.Duration `json:"elapsed_ns"`
+
+	// Attempts is the number of the upstreams the request has been sent to.
+	Attempts int `json:"attempts,omitempty"`
+
+	// Stale is true if the response is an expired cached one.
+	Stale bool `json:"stale,omitempty"`
+
+	// Values are the values set by the handlers of the request, formatted
+	// with [fmt.Sprint], by the names of their keys, see [proxy.ValueKey].
+	Values map[string]string `json:"values,omitempty"`
+}
+
+// newLogEntry returns a new query log entry for dctx and err.  dctx must have a
+// request with a question.
+func newLogEntry(dctx *proxy.DNSContext, err error) (e *LogEntry) {
+	q := dctx.Req.Question[0]
+	e = &LogEntry{
+		Time:     time.Now(),
+		Client:   dctx.Addr.Addr().String(),
+		Proto:    dctx.Proto,
+		Name:     q.Name,
+		Type:     dns.Type(q.Qtype).String(),
+		Upstream: dctx.CachedUpstreamAddr,
+		Elapsed:  dctx.QueryDuration,
+		Attempts: dctx.Provenance.Attempts,
+		Stale:    dctx.Provenance.Stale,
+	}
+
+	if dctx.Res != nil {
+		e.Rcode = dns.RcodeToString[dctx.Res.Rcode]
+		e.Source = dctx.Provenance.Source.String()
+	}
+
+	if dctx.Upstream != nil {
+		e.Upstream = dctx.Upstream.Address()
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	dctx.RangeValues(func(name string, v any) (cont bool) {
+		if e.Values == nil {
+			e.Values = map[string]string{}
+		}
+
+		e.Values[name] = fmt.Sprint(v)
+
+		return true
+	})
+
+	return e
+}
+
+// tail broadcasts the query log entries to the subscribers.  It's safe for
+// concurrent use.
+type tail struct {
+	// mu protects subs.
+	mu *sync.RWMutex
+
+	// subs are the queues of the subscribers.
+	subs map[chan *LogEntry]struct{}
+
+	queueSize int
+}
+
+// newTail returns a new *tail with queueSize queues for the subscribers.  If
+// queueSize isn't positive, [defaultTailQueueSize] is used.
+func newTail(queueSize int) (t *tail) {
+	if queueSize <= 0 {
+		queueSize = defaultTailQueueSize
+	}
+
+	return &tail{
+		mu:        &sync.RWMutex{},
+		subs:      map[chan *LogEntry]struct{}{},
+		queueSize: queueSize,
+	}
+}
+
+// publish sends e to all the subscribers, dropping it for the ones with full
+// queues.
+func (t *tail) publish(e *LogEntry) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for ch := range t.subs {
+		select {
+		case ch <- e:
+		default:
+			// Don't slow down the processing of requests for a slow
+			// subscriber.
+		}
+	}
+}
+
+// subscribe returns a new subscription, which is closed when ctx is canceled.
+func (t *tail) subscribe(ctx context.Context) (entries <-chan *LogEntry) {
+	ch := make(chan *LogEntry, t.queueSize)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.subs[ch] = struct{}{}
+
+	context.AfterFunc(ctx, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		delete(t.subs, ch)
+		close(ch)
+	})
+
+	return ch
+}
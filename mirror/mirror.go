@@ -0,0 +1,246 @@
+// Package mirror implements copying of a sample of DNS queries and responses to
+// an external sink, such as an intrusion detection system, without slowing
+// down the processing of requests.
+//
+// The messages are sent in the DNS wire format, each prefixed with its length
+// as a 2-byte big-endian integer, like in DNS over TCP.  Each query is followed
+// by its response, if there is one; the two can be told apart by the QR bit.
+// For datagram sinks, each datagram contains a single message.
+package mirror
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultQueueSize is the default number of messages waiting to be sent.
+	defaultQueueSize = 1024
+
+	// dialTimeout is the timeout for connecting to the sink.
+	dialTimeout = 5 * time.Second
+
+	// writeTimeout is the timeout for sending a single message to the sink.
+	writeTimeout = 1 * time.Second
+)
+
+// Config is the configuration of a [Mirror].
+type Config struct {
+	// Sink is the URL of the sink.  The supported schemes are "udp", e.g.
+	// "udp://192.0.2.1:5353", "unix" for stream sockets, and "unixgram" for
+	// datagram sockets, e.g. "unix:///run/ids.sock".
+	Sink string
+
+	// Sample is the share of the requests to mirror, between 0 and 1.  Zero
+	// means all requests.
+	Sample float64
+
+	// QueueSize is the maximum number of messages waiting to be sent.  When
+	// the queue is full, the messages are dropped.  If not positive, a default
+	// value of 1024 is used.
+	QueueSize int
+}
+
+// Mirror sends the sampled queries and responses to the sink.  It's safe for
+// concurrent use.
+type Mirror struct {
+	// queue contains the packed messages with length prefixes.
+	queue chan []byte
+
+	// stop is closed to stop the sending goroutine.
+	stop chan struct{}
+
+	// done is closed when the sending goroutine exits.
+	done chan struct{}
+
+	// closeOnce makes sure stop is closed only once.
+	closeOnce *sync.Once
+
+	// conn is the connection to the sink.  It's only accessed by the sending
+	// goroutine.
+	conn net.Conn
+
+	network string
+	addr    string
+	sample  float64
+}
+
+// New returns a new properly initialized *Mirror and starts sending the
+// messages.  c must not be nil.
+func New(c *Config) (m *Mirror, err error) {
+	if c.Sample < 0 || c.Sample > 1 {
+		return nil, fmt.Errorf("sample: value %v out of range [0, 1]", c.Sample)
+	}
+
+	network, addr, err := parseSink(c.Sink)
+	if err != nil {
+		return nil, fmt.Errorf("sink: %w", err)
+	}
+
+	size := c.QueueSize
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+
+	m = &Mirror{
+		queue:     make(chan []byte, size),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+		network:   network,
+		addr:      addr,
+		sample:    c.Sample,
+	}
+
+	go m.send()
+
+	return m, nil
+}
+
+// parseSink returns the network and the address of the sink from its URL.
+func parseSink(sink string) (network, addr string, err error) {
+	u, err := url.Parse(sink)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", "", err
+	}
+
+	switch u.Scheme {
+	case "udp":
+		addr = u.Host
+	case "unix", "unixgram":
+		addr = u.Path
+	default:
+		return "", "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	if addr == "" {
+		return "", "", errors.Error("no address")
+	}
+
+	return u.Scheme, addr, nil
+}
+
+// HandleResponse enqueues the request and the response from dctx, if it's
+// sampled.  It never blocks.  It's intended to be used as
+// [proxy.Config.ResponseHandler].
+func (m *Mirror) HandleResponse(dctx *proxy.DNSContext, _ error) {
+	// #nosec G404 -- Sampling doesn't need cryptographically secure random
+	// numbers.
+	if dctx.Req == nil || (m.sample > 0 && rand.Float64() >= m.sample) {
+		return
+	}
+
+	m.enqueue(dctx.Req)
+	if dctx.Res != nil {
+		m.enqueue(dctx.Res)
+	}
+}
+
+// enqueue packs msg and adds it to the queue, unless it's full.
+func (m *Mirror) enqueue(msg *dns.Msg) {
+	packed, err := msg.Pack()
+	if err != nil {
+		log.Debug("mirror: packing message: %s", err)
+
+		return
+	}
+
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+
+	select {
+	case m.queue <- buf:
+	default:
+		log.Debug("mirror: queue is full, dropping message")
+	}
+}
+
+// send sends the messages from the queue to the sink until the mirror is
+// closed.  It's intended to be used as a goroutine.
+func (m *Mirror) send() {
+	defer log.OnPanic("mirror")
+	defer close(m.done)
+
+	for {
+		select {
+		case buf := <-m.queue:
+			m.writeLogged(buf)
+		case <-m.stop:
+			m.flush()
+
+			return
+		}
+	}
+}
+
+// flush sends the messages remaining in the queue and closes the connection.
+func (m *Mirror) flush() {
+	for {
+		select {
+		case buf := <-m.queue:
+			m.writeLogged(buf)
+		default:
+			if m.conn != nil {
+				_ = m.conn.Close()
+			}
+
+			return
+		}
+	}
+}
+
+// writeLogged sends buf to the sink and logs the error, if any.
+func (m *Mirror) writeLogged(buf []byte) {
+	err := m.write(buf)
+	if err != nil {
+		log.Debug("mirror: sending to %s: %s", m.addr, err)
+	}
+}
+
+// write sends buf to the sink, connecting to it if needed.  On failure, the
+// connection is closed, so that the next write reconnects.
+func (m *Mirror) write(buf []byte) (err error) {
+	if m.conn == nil {
+		m.conn, err = net.DialTimeout(m.network, m.addr, dialTimeout)
+		if err != nil {
+			m.conn = nil
+
+			return fmt.Errorf("connecting: %w", err)
+		}
+	}
+
+	err = m.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err == nil {
+		_, err = m.conn.Write(buf)
+	}
+
+	if err != nil {
+		err = errors.WithDeferred(err, m.conn.Close())
+		m.conn = nil
+
+		return err
+	}
+
+	return nil
+}
+
+// Close stops the mirror after sending the queued messages.  The messages
+// passed to [Mirror.HandleResponse] after that are ignored.
+func (m *Mirror) Close() (err error) {
+	m.closeOnce.Do(func() { close(m.stop) })
+	<-m.done
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// newTestContext returns a new *proxy.DNSContext with an A request for name
+// and a response to it.
+func newTestContext(name string) (dctx *proxy.DNSContext) {
+	req := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+
+	return &proxy.DNSContext{
+		Req:  req,
+		Res:  (&dns.Msg{}).SetReply(req),
+		Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+	}
+}
+
+// readMsg reads a single length-prefixed message from r.
+func readMsg(t *testing.T, r io.Reader) (msg *dns.Msg) {
+	t.Helper()
+
+	var l uint16
+	require.NoError(t, binary.Read(r, binary.BigEndian, &l))
+
+	buf := make([]byte, l)
+	_, err := io.ReadFull(r, buf)
+	require.NoError(t, err)
+
+	msg = &dns.Msg{}
+	require.NoError(t, msg.Unpack(buf))
+
+	return msg
+}
+
+func TestMirror_udp(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, pc.Close)
+
+	m, err := New(&Config{
+		Sink: "udp://" + pc.LocalAddr().String(),
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, m.Close)
+
+	m.HandleResponse(newTestContext("example.org."), nil)
+
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(testTimeout)))
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for _, wantResp := range []bool{false, true} {
+		n, _, readErr := pc.ReadFrom(buf)
+		require.NoError(t, readErr)
+
+		msg := readMsg(t, bytes.NewReader(buf[:n]))
+		assert.Equal(t, wantResp, msg.Response)
+		assert.Equal(t, "example.org.", msg.Question[0].Name)
+	}
+}
+
+func TestMirror_unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sink.sock")
+
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	m, err := New(&Config{
+		Sink: "unix://" + path,
+	})
+	require.NoError(t, err)
+
+	for _, name := range []string{"a.example.", "b.example."} {
+		m.HandleResponse(newTestContext(name), nil)
+	}
+
+	// Make sure all the messages are sent.
+	require.NoError(t, m.Close())
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+
+	for _, name := range []string{"a.example.", "a.example.", "b.example.", "b.example."} {
+		assert.Equal(t, name, readMsg(t, conn).Question[0].Name)
+	}
+}
+
+func TestNew_errors(t *testing.T) {
+	testCases := []struct {
+		conf *Config
+		name string
+	}{{
+		conf: &Config{Sink: "udp://127.0.0.1:5353", Sample: 2},
+		name: "bad_sample",
+	}, {
+		conf: &Config{Sink: "tcp://127.0.0.1:5353"},
+		name: "bad_scheme",
+	}, {
+		conf: &Config{Sink: "unix://"},
+		name: "no_address",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.conf)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package plugin
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Plugin)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Plugin.  It calls the plugin at [StageRequest].
+func (p *Plugin) HandleBefore(_ *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	if !slices.Contains(p.stages, StageRequest) {
+		return nil
+	}
+
+	resp, msg, err := p.exchange(StageRequest, dctx, dctx.Req)
+	if err != nil {
+		if !p.failClosed {
+			log.Info("plugin %s: request stage: %s; passing", p.name, err)
+
+			return nil
+		}
+
+		return &proxy.BeforeRequestError{
+			Err:      fmt.Errorf("plugin %s: %w", p.name, err),
+			Response: newReply(dctx.Req, dns.RcodeServerFailure),
+		}
+	}
+
+	switch resp.Action {
+	case ActionBlock:
+		return &proxy.BeforeRequestError{
+			Err:      fmt.Errorf("plugin %s: blocked", p.name),
+			Response: newReply(dctx.Req, dns.RcodeNameError),
+		}
+	case ActionRespond:
+		return &proxy.BeforeRequestError{
+			Err:      fmt.Errorf("plugin %s: responded", p.name),
+			Response: msg,
+		}
+	case ActionRewrite:
+		dctx.Req = msg
+	}
+
+	return nil
+}
+
+// HandleResponse is a [proxy.ResponseHandler] that calls the plugin at
+// [StageResponse] and modifies the response in dctx accordingly.
+func (p *Plugin) HandleResponse(dctx *proxy.DNSContext, err error) {
+	if err != nil || dctx.Res == nil || !slices.Contains(p.stages, StageResponse) {
+		return
+	}
+
+	resp, msg, err := p.exchange(StageResponse, dctx, dctx.Res)
+	if err != nil {
+		log.Info("plugin %s: response stage: %s", p.name, err)
+
+		if p.failClosed {
+			dctx.Res = newReply(dctx.Req, dns.RcodeServerFailure)
+		}
+
+		return
+	}
+
+	switch resp.Action {
+	case ActionBlock:
+		dctx.Res = newReply(dctx.Req, dns.RcodeNameError)
+	case ActionRespond, ActionRewrite:
+		dctx.Res = msg
+	}
+}
+
+// exchange calls the plugin at stage with m and returns its response with the
+// decoded message, if any.
+func (p *Plugin) exchange(
+	stage Stage,
+	dctx *proxy.DNSContext,
+	m *dns.Msg,
+) (resp *Response, msg *dns.Msg, err error) {
+	data, err := m.Pack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	resp, err = p.call(&Request{
+		Stage:  stage,
+		Client: dctx.Addr.Addr().String(),
+		Proto:  string(dctx.Proto),
+		Msg:    data,
+	})
+	if err != nil {
+		return nil, nil, err
+	} else if resp.Error != "" {
+		return nil, nil, fmt.Errorf("plugin error: %s", resp.Error)
+	}
+
+	switch resp.Action {
+	case ActionPass, ActionBlock:
+		return resp, nil, nil
+	case ActionRewrite, ActionRespond:
+		msg, err = unpackMsg(resp.Msg, dctx.Req.Id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("action %s: %w", resp.Action, err)
+		}
+
+		return resp, msg, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown action %q", resp.Action)
+	}
+}
+
+// unpackMsg unpacks the message from data and sets its ID to id.
+func unpackMsg(data []byte, id uint16) (msg *dns.Msg, err error) {
+	if len(data) == 0 {
+		return nil, errors.Error("no message")
+	}
+
+	msg = &dns.Msg{}
+	err = msg.Unpack(data)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking message: %w", err)
+	}
+
+	msg.Id = id
+
+	return msg, nil
+}
+
+// newReply returns a new response to req with code.
+func newReply(req *dns.Msg, code int) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetRcode(req, code)
+	resp.RecursionAvailable = true
+
+	return resp
+}
@@ -0,0 +1,316 @@
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// defaultTimeout is the default timeout for a single call of a plugin.
+	defaultTimeout = 1 * time.Second
+
+	// closeTimeout is the time given to the plugin process to exit after its
+	// standard input is closed.
+	closeTimeout = 5 * time.Second
+)
+
+// errClosed is returned when the plugin isn't running anymore.
+const errClosed errors.Error = "plugin is not running"
+
+// Config is the configuration of a [Plugin].
+type Config struct {
+	// Name is the name of the plugin used in logs.  If empty, Path is used.
+	Name string
+
+	// Path is the path to the plugin executable.
+	Path string
+
+	// Args are the command-line arguments of the plugin executable.
+	Args []string
+
+	// Stages are the stages the plugin is called at.  If empty, the plugin is
+	// called at all stages.
+	Stages []Stage
+
+	// Timeout is the maximum duration of a single call.  If not positive,
+	// a default value of 1s is used.
+	Timeout time.Duration
+
+	// FailClosed makes the requests fail with SERVFAIL if the plugin fails to
+	// respond in time or responds with an error.  Otherwise, such failures are
+	// logged and the processing continues as if the plugin passed the request.
+	FailClosed bool
+}
+
+// Plugin is a running plugin process.  It's safe for concurrent use.
+type Plugin struct {
+	// cmd is the plugin process.  It's nil if the plugin isn't a process.
+	cmd *exec.Cmd
+
+	// w is the writer of the requests.
+	w io.WriteCloser
+
+	// writeLock protects w.
+	writeLock *sync.Mutex
+
+	// pendingLock protects pending and readErr.
+	pendingLock *sync.Mutex
+
+	// pending are the channels waiting for the responses by the request IDs.
+	pending map[uint64]chan *Response
+
+	// done is closed when the plugin stops responding.
+	done chan struct{}
+
+	// readErr is the error that stopped the reading of responses.
+	readErr error
+
+	// nextID is the ID of the next request.
+	nextID *atomic.Uint64
+
+	// name is the name of the plugin used in logs.
+	name string
+
+	// stages are the stages the plugin is called at.
+	stages []Stage
+
+	// timeout is the maximum duration of a single call.
+	timeout time.Duration
+
+	// failClosed makes the requests fail if the plugin fails.
+	failClosed bool
+}
+
+// Start starts the plugin process and returns the *Plugin communicating with
+// it.  c must not be nil.
+func Start(c *Config) (p *Plugin, err error) {
+	// #nosec G204 -- Trust the plugin path and arguments given in the
+	// configuration.
+	cmd := exec.Command(c.Path, c.Args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating stdin pipe: %w", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating stdout pipe: %w", err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating stderr pipe: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("starting plugin: %w", err)
+	}
+
+	p = newPlugin(c, stdout, stdin)
+	p.cmd = cmd
+
+	go p.logStderr(stderr)
+
+	log.Info("plugin %s: started with pid %d", p.name, cmd.Process.Pid)
+
+	return p, nil
+}
+
+// newPlugin returns a new *Plugin reading responses from r and writing
+// requests to w.
+func newPlugin(c *Config, r io.Reader, w io.WriteCloser) (p *Plugin) {
+	p = &Plugin{
+		w:           w,
+		writeLock:   &sync.Mutex{},
+		pendingLock: &sync.Mutex{},
+		pending:     map[uint64]chan *Response{},
+		done:        make(chan struct{}),
+		nextID:      &atomic.Uint64{},
+		name:        c.Name,
+		stages:      slices.Clone(c.Stages),
+		timeout:     c.Timeout,
+		failClosed:  c.FailClosed,
+	}
+
+	if p.name == "" {
+		p.name = c.Path
+	}
+
+	if len(p.stages) == 0 {
+		p.stages = []Stage{StageRequest, StageResponse}
+	}
+
+	if p.timeout <= 0 {
+		p.timeout = defaultTimeout
+	}
+
+	go p.readLoop(r)
+
+	return p
+}
+
+// readLoop reads the responses from r and dispatches them to the waiting
+// calls until r fails.
+func (p *Plugin) readLoop(r io.Reader) {
+	defer log.OnPanic("plugin " + p.name)
+
+	var err error
+	for {
+		var data []byte
+		data, err = readFrame(r)
+		if err != nil {
+			break
+		}
+
+		resp := &Response{}
+		err = json.Unmarshal(data, resp)
+		if err != nil {
+			log.Error("plugin %s: decoding response: %s", p.name, err)
+
+			continue
+		}
+
+		p.dispatch(resp)
+	}
+
+	if errors.Is(err, io.EOF) {
+		err = errClosed
+	}
+
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+
+	p.readErr = err
+	close(p.done)
+}
+
+// dispatch passes resp to the call waiting for it, if any.
+func (p *Plugin) dispatch(resp *Response) {
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+
+	ch, ok := p.pending[resp.ID]
+	if !ok {
+		log.Debug("plugin %s: response to unknown request %d", p.name, resp.ID)
+
+		return
+	}
+
+	delete(p.pending, resp.ID)
+	ch <- resp
+}
+
+// logStderr logs the lines written by the plugin to its standard error.
+func (p *Plugin) logStderr(r io.Reader) {
+	defer log.OnPanic("plugin " + p.name)
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		log.Info("plugin %s: %s", p.name, s.Text())
+	}
+}
+
+// call sends req to the plugin and waits for the response.
+func (p *Plugin) call(req *Request) (resp *Response, err error) {
+	req.ID = p.nextID.Add(1)
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encoding request: %w", err)
+	}
+
+	ch := make(chan *Response, 1)
+	p.pendingLock.Lock()
+	if p.readErr != nil {
+		err = p.readErr
+		p.pendingLock.Unlock()
+
+		return nil, err
+	}
+	p.pending[req.ID] = ch
+	p.pendingLock.Unlock()
+
+	defer p.forget(req.ID)
+
+	err = p.write(data)
+	if err != nil {
+		return nil, fmt.Errorf("writing request: %w", err)
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case resp = <-ch:
+		return resp, nil
+	case <-p.done:
+		return nil, errClosed
+	case <-timer.C:
+		return nil, fmt.Errorf("no response in %s", p.timeout)
+	}
+}
+
+// write writes a single frame with data to the plugin.
+func (p *Plugin) write(data []byte) (err error) {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+
+	return writeFrame(p.w, data)
+}
+
+// forget removes the pending call with id, if any.
+func (p *Plugin) forget(id uint64) {
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+
+	delete(p.pending, id)
+}
+
+// Close stops the plugin.  The process is killed if it doesn't exit in time
+// after its standard input is closed.
+func (p *Plugin) Close() (err error) {
+	err = p.w.Close()
+	if err != nil {
+		log.Debug("plugin %s: closing stdin: %s", p.name, err)
+	}
+
+	if p.cmd == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(closeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-p.done:
+	case <-timer.C:
+		log.Info("plugin %s: killing after %s", p.name, closeTimeout)
+
+		err = p.cmd.Process.Kill()
+		if err != nil {
+			return fmt.Errorf("killing plugin %s: %w", p.name, err)
+		}
+
+		// Wait for the reading to finish, since the pipes are closed by Wait.
+		<-p.done
+	}
+
+	err = p.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("waiting for plugin %s: %w", p.name, err)
+	}
+
+	return nil
+}
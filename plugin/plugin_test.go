@@ -0,0 +1,167 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPlugin returns a *Plugin connected to a fake plugin goroutine, which
+// answers each request using onRequest.
+func newTestPlugin(
+	t *testing.T,
+	c *Config,
+	onRequest func(req *Request) (resp *Response),
+) (p *Plugin) {
+	t.Helper()
+
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+
+	go func() {
+		defer func() { _ = respW.Close() }()
+
+		for {
+			data, err := readFrame(reqR)
+			if err != nil {
+				return
+			}
+
+			req := &Request{}
+			if json.Unmarshal(data, req) != nil {
+				return
+			}
+
+			resp := onRequest(req)
+			if resp == nil {
+				continue
+			}
+
+			resp.ID = req.ID
+			data, _ = json.Marshal(resp)
+			if writeFrame(respW, data) != nil {
+				return
+			}
+		}
+	}()
+
+	p = newPlugin(c, respR, reqW)
+	testutil.CleanupAndRequireSuccess(t, p.Close)
+
+	return p
+}
+
+// newTestContext returns a new *proxy.DNSContext for a request for name.
+func newTestContext(name string) (dctx *proxy.DNSContext) {
+	return &proxy.DNSContext{
+		Req:   (&dns.Msg{}).SetQuestion(name, dns.TypeA),
+		Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+		Proto: proxy.ProtoUDP,
+	}
+}
+
+func TestPlugin_HandleBefore(t *testing.T) {
+	rewritten := (&dns.Msg{}).SetQuestion("rewritten.example.", dns.TypeA)
+	rewrittenData, err := rewritten.Pack()
+	require.NoError(t, err)
+
+	p := newTestPlugin(t, &Config{Name: "test"}, func(req *Request) (resp *Response) {
+		m := &dns.Msg{}
+		require.NoError(t, m.Unpack(req.Msg))
+
+		assert.Equal(t, StageRequest, req.Stage)
+		assert.Equal(t, "192.0.2.1", req.Client)
+		assert.Equal(t, "udp", req.Proto)
+
+		switch m.Question[0].Name {
+		case "block.example.":
+			return &Response{Action: ActionBlock}
+		case "rewrite.example.":
+			return &Response{Action: ActionRewrite, Msg: rewrittenData}
+		case "error.example.":
+			return &Response{Error: "test error"}
+		case "silent.example.":
+			return nil
+		default:
+			return &Response{Action: ActionPass}
+		}
+	})
+
+	t.Run("pass", func(t *testing.T) {
+		assert.NoError(t, p.HandleBefore(nil, newTestContext("pass.example.")))
+	})
+
+	t.Run("block", func(t *testing.T) {
+		hErr := p.HandleBefore(nil, newTestContext("block.example."))
+
+		befErr := &proxy.BeforeRequestError{}
+		require.ErrorAs(t, hErr, &befErr)
+
+		assert.Equal(t, dns.RcodeNameError, befErr.Response.Rcode)
+	})
+
+	t.Run("rewrite", func(t *testing.T) {
+		dctx := newTestContext("rewrite.example.")
+		id := dctx.Req.Id
+		require.NoError(t, p.HandleBefore(nil, dctx))
+
+		assert.Equal(t, "rewritten.example.", dctx.Req.Question[0].Name)
+		assert.Equal(t, id, dctx.Req.Id)
+	})
+
+	t.Run("error_fail_open", func(t *testing.T) {
+		assert.NoError(t, p.HandleBefore(nil, newTestContext("error.example.")))
+	})
+
+	t.Run("timeout_fail_closed", func(t *testing.T) {
+		closed := newTestPlugin(t, &Config{
+			Timeout:    10 * time.Millisecond,
+			FailClosed: true,
+		}, func(_ *Request) (resp *Response) { return nil })
+
+		hErr := closed.HandleBefore(nil, newTestContext("silent.example."))
+
+		befErr := &proxy.BeforeRequestError{}
+		require.ErrorAs(t, hErr, &befErr)
+
+		assert.Equal(t, dns.RcodeServerFailure, befErr.Response.Rcode)
+	})
+}
+
+func TestPlugin_HandleResponse(t *testing.T) {
+	p := newTestPlugin(t, &Config{
+		Stages: []Stage{StageResponse},
+	}, func(req *Request) (resp *Response) {
+		assert.Equal(t, StageResponse, req.Stage)
+
+		return &Response{Action: ActionBlock}
+	})
+
+	dctx := newTestContext("example.")
+	require.NoError(t, p.HandleBefore(nil, dctx))
+
+	dctx.Res = (&dns.Msg{}).SetReply(dctx.Req)
+	p.HandleResponse(dctx, nil)
+
+	assert.Equal(t, dns.RcodeNameError, dctx.Res.Rcode)
+}
+
+func TestPlugin_call_closed(t *testing.T) {
+	p := newTestPlugin(t, &Config{}, func(_ *Request) (resp *Response) {
+		return &Response{Action: ActionPass}
+	})
+
+	require.NoError(t, p.Close())
+	<-p.done
+
+	_, err := p.call(&Request{Stage: StageRequest})
+	assert.ErrorIs(t, err, errClosed)
+}
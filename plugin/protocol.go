@@ -0,0 +1,126 @@
+// Package plugin implements running external filtering and rewriting stages as
+// separate processes.
+//
+// A plugin is an executable that reads requests from its standard input and
+// writes responses to its standard output.  Each message is a JSON object
+// prefixed with its length as a 4-byte big-endian unsigned integer.  The
+// plugin may process the requests concurrently and respond in any order,
+// responses are matched to requests by their ID.  Anything written by the
+// plugin to its standard error is logged.
+package plugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Stage is the stage of the request processing a plugin is called at.
+type Stage string
+
+const (
+	// StageRequest is the stage before the request is resolved.  The message
+	// is the request.
+	StageRequest Stage = "request"
+
+	// StageResponse is the stage after the request is resolved.  The message
+	// is the response.
+	StageResponse Stage = "response"
+)
+
+// Action is the action a plugin decides to take.
+type Action string
+
+const (
+	// ActionPass continues processing as usual.
+	ActionPass Action = "pass"
+
+	// ActionBlock responds with NXDOMAIN.
+	ActionBlock Action = "block"
+
+	// ActionRewrite replaces the message of the stage with the one from the
+	// response.  At [StageRequest], the rewritten request is resolved instead
+	// of the original one.
+	ActionRewrite Action = "rewrite"
+
+	// ActionRespond responds to the client with the message from the response
+	// right away.  At [StageResponse] it's the same as [ActionRewrite].
+	ActionRespond Action = "respond"
+)
+
+// Request is a message sent to the plugin.
+type Request struct {
+	// Stage is the stage the plugin is called at.
+	Stage Stage `json:"stage"`
+
+	// Client is the IP address of the client.
+	Client string `json:"client"`
+
+	// Proto is the protocol the request was received over.
+	Proto string `json:"proto"`
+
+	// Msg is the DNS message in the wire format.  It's encoded as a base64
+	// string in JSON.
+	Msg []byte `json:"msg"`
+
+	// ID is the identifier of the request unique within the plugin process.
+	ID uint64 `json:"id"`
+}
+
+// Response is a message received from the plugin.
+type Response struct {
+	// Action is the decided action.
+	Action Action `json:"action"`
+
+	// Error is the error description.  If it's not empty, Action is ignored
+	// and the processing continues as if the plugin failed.
+	Error string `json:"error,omitempty"`
+
+	// Msg is the DNS message in the wire format for [ActionRewrite] and
+	// [ActionRespond].  It's encoded as a base64 string in JSON.
+	Msg []byte `json:"msg,omitempty"`
+
+	// ID is the identifier of the corresponding request.
+	ID uint64 `json:"id"`
+}
+
+// maxFrameSize is the maximum size of a single message in bytes.
+const maxFrameSize = 1 << 20
+
+// writeFrame writes data prefixed with its length into w.
+func writeFrame(w io.Writer, data []byte) (err error) {
+	if len(data) > maxFrameSize {
+		return fmt.Errorf("frame size %d exceeds %d", len(data), maxFrameSize)
+	}
+
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+
+	_, err = w.Write(buf)
+
+	return err
+}
+
+// readFrame reads a single length-prefixed frame from r.
+func readFrame(r io.Reader) (data []byte, err error) {
+	var lenBuf [4]byte
+	_, err = io.ReadFull(r, lenBuf[:])
+	if err != nil {
+		// Don't wrap the error since it may be [io.EOF].
+		return nil, err
+	}
+
+	l := binary.BigEndian.Uint32(lenBuf[:])
+	if l > maxFrameSize {
+		return nil, fmt.Errorf("frame size %d exceeds %d", l, maxFrameSize)
+	}
+
+	data = make([]byte, l)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, fmt.Errorf("reading frame: %w", err)
+	}
+
+	return data, nil
+}
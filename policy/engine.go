@@ -0,0 +1,276 @@
+package policy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// Action is the decision made for a request.
+type Action uint8
+
+const (
+	// ActionAllow processes the request as usual.
+	ActionAllow Action = iota
+
+	// ActionBlock responds to the request with NXDOMAIN.
+	ActionBlock
+
+	// ActionRoute processes the request using the upstreams specified by the
+	// rule.
+	ActionRoute
+)
+
+// String implements the [fmt.Stringer] interface for Action.
+func (a Action) String() (s string) {
+	switch a {
+	case ActionAllow:
+		return "allow"
+	case ActionBlock:
+		return "block"
+	case ActionRoute:
+		return "route"
+	default:
+		return fmt.Sprintf("!bad_action_%d", uint8(a))
+	}
+}
+
+// Rule is a single rule of the policy.
+type Rule struct {
+	// Expr is the condition of the rule.  It must not be nil.
+	Expr *Expr
+
+	// Schedule is the schedule during which the rule is active, in the time
+	// zone of the engine.  If nil, the rule is always active.  The schedule
+	// of a named rule may be overridden with [Engine.Override].
+	Schedule *Schedule
+
+	// Name is the optional name of the rule.  Names must be unique.
+	Name string
+
+	// Upstream is the name of the upstream configuration from
+	// [Config.Upstreams] to use for [ActionRoute].  It's ignored for other
+	// actions.
+	Upstream string
+
+	// Action is the decision made when Expr evaluates to true.
+	Action Action
+}
+
+// String implements the [fmt.Stringer] interface for *Rule.  It returns the
+// name of the rule or, if it's unnamed, its expression.
+func (r *Rule) String() (s string) {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	return r.Expr.String()
+}
+
+// ClientTags assigns tags to the clients within a subnet.
+type ClientTags struct {
+	// Subnet is the subnet of the clients.  It must be valid.
+	Subnet netip.Prefix
+
+	// Tags are the tags assigned to the clients within Subnet.
+	Tags []string
+}
+
+// Config is the configuration of an [Engine].
+type Config struct {
+	// MessageConstructor is used to build the responses to the blocked
+	// requests.  If nil, the responses are built with the plain NXDOMAIN code.
+	MessageConstructor proxy.MessageConstructor
+
+	// Location is the time zone for the time-related variables.  If nil,
+	// [time.Local] is used.
+	Location *time.Location
+
+	// Upstreams are the named upstream configurations referenced by the rules
+	// with [ActionRoute].
+	Upstreams map[string]*proxy.CustomUpstreamConfig
+
+	// Rules are the rules evaluated in order for each request.  The first rule
+	// with a matching condition decides, requests matching no rules are
+	// allowed.
+	Rules []*Rule
+
+	// ClientTags assigns tags to clients.  A client gets the tags of all the
+	// subnets containing its address.
+	ClientTags []*ClientTags
+}
+
+// Engine decides on requests according to the policy rules.  It's safe for
+// concurrent use.
+type Engine struct {
+	messages  proxy.MessageConstructor
+	location  *time.Location
+	upstreams map[string]*proxy.CustomUpstreamConfig
+	now       func() (now time.Time)
+
+	// overridesLock protects overrides.
+	overridesLock *sync.Mutex
+
+	// overrides are the overridden states of the named rules.
+	overrides map[string]*override
+
+	rules      []*Rule
+	clientTags []*ClientTags
+}
+
+// New returns a new properly initialized *Engine.  c must not be nil.
+func New(c *Config) (e *Engine, err error) {
+	err = validateRules(c.Rules, c.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, ct := range c.ClientTags {
+		if ct == nil || !ct.Subnet.IsValid() {
+			return nil, fmt.Errorf("client tags at index %d: bad subnet", i)
+		}
+	}
+
+	e = &Engine{
+		messages:      c.MessageConstructor,
+		location:      c.Location,
+		upstreams:     c.Upstreams,
+		now:           time.Now,
+		overridesLock: &sync.Mutex{},
+		overrides:     map[string]*override{},
+		rules:         slices.Clone(c.Rules),
+		clientTags:    slices.Clone(c.ClientTags),
+	}
+
+	if e.location == nil {
+		e.location = time.Local
+	}
+
+	return e, nil
+}
+
+// validateRules returns an error if any of rules is invalid.
+func validateRules(rules []*Rule, ups map[string]*proxy.CustomUpstreamConfig) (err error) {
+	var errs []error
+	names := container.NewMapSet[string]()
+	for i, r := range rules {
+		switch {
+		case r == nil || r.Expr == nil:
+			errs = append(errs, fmt.Errorf("rule at index %d: no expression", i))
+		case r.Action > ActionRoute:
+			errs = append(errs, fmt.Errorf("rule at index %d: bad action %s", i, r.Action))
+		case r.Action == ActionRoute && ups[r.Upstream] == nil:
+			errs = append(errs, fmt.Errorf("rule at index %d: unknown upstream %q", i, r.Upstream))
+		case r.Name != "" && names.Has(r.Name):
+			errs = append(errs, fmt.Errorf("rule at index %d: duplicate name %q", i, r.Name))
+		default:
+			names.Add(r.Name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Decision is the result of evaluating the policy for a request.
+type Decision struct {
+	// Rule is the rule that made the decision.  It's nil if no rules matched.
+	Rule *Rule
+
+	// Tags are the tags of the client the rules have been evaluated for.  They
+	// must not be modified.
+	Tags []string
+
+	// Action is the decided action.
+	Action Action
+}
+
+// Decide evaluates the rules for the request from dctx.  The rules, failed to
+// evaluate, are logged and skipped.
+func (e *Engine) Decide(dctx *proxy.DNSContext) (d Decision) {
+	now := e.now().In(e.location)
+	tags := e.tags(dctx.Addr.Addr())
+	in := newInput(dctx, now, tags)
+	for i, r := range e.rules {
+		if !e.isActive(r, now) {
+			continue
+		}
+
+		ok, err := r.Expr.Eval(in)
+		if err != nil {
+			log.Debug("policy: evaluating rule at index %d: %s", i, err)
+
+			continue
+		}
+
+		if ok {
+			return Decision{Rule: r, Tags: tags, Action: r.Action}
+		}
+	}
+
+	return Decision{Tags: tags, Action: ActionAllow}
+}
+
+// tags returns the tags of the client with addr.
+func (e *Engine) tags(addr netip.Addr) (tags []string) {
+	addr = addr.Unmap()
+	for _, ct := range e.clientTags {
+		if ct.Subnet.Contains(addr) {
+			tags = append(tags, ct.Tags...)
+		}
+	}
+
+	return tags
+}
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Engine)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Engine.  It sets the [proxy.KeyPolicyTags] and [proxy.KeyMatchedRule]
+// values of dctx.
+func (e *Engine) HandleBefore(_ *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	d := e.Decide(dctx)
+	if len(d.Tags) > 0 {
+		proxy.SetValue(dctx, proxy.KeyPolicyTags, d.Tags)
+	}
+
+	if d.Rule != nil {
+		proxy.SetValue(dctx, proxy.KeyMatchedRule, d.Rule.String())
+	}
+
+	switch d.Action {
+	case ActionBlock:
+		return &proxy.BeforeRequestError{
+			Err:      fmt.Errorf("policy: blocked by rule %q", d.Rule.Expr),
+			Response: e.newBlockedResp(dctx.Req),
+		}
+	case ActionRoute:
+		dctx.CustomUpstreamConfig = e.upstreams[d.Rule.Upstream]
+
+		log.Debug("policy: routing to %q by rule %q", d.Rule.Upstream, d.Rule.Expr)
+	default:
+		// Go on.
+	}
+
+	return nil
+}
+
+// newBlockedResp returns the response for the blocked request.
+func (e *Engine) newBlockedResp(req *dns.Msg) (resp *dns.Msg) {
+	if e.messages != nil {
+		return e.messages.NewMsgNXDOMAIN(req)
+	}
+
+	resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+	resp.RecursionAvailable = true
+
+	return resp
+}
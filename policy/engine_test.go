@@ -0,0 +1,146 @@
+package policy
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_HandleBefore(t *testing.T) {
+	const rulesText = `
+# Kids can't play at night.
+block "kids" in tags && subdomain(qname, "games.example") && (hour >= 22 || hour < 7)
+route corp subdomain(qname, "corp.example")
+allow true
+`
+
+	rules, err := ReadRules(strings.NewReader(rulesText))
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+
+	corp := proxy.NewCustomUpstreamConfig(&proxy.UpstreamConfig{}, false, 0, false)
+
+	e, err := New(&Config{
+		Location:  time.UTC,
+		Upstreams: map[string]*proxy.CustomUpstreamConfig{"corp": corp},
+		Rules:     rules,
+		ClientTags: []*ClientTags{{
+			Subnet: netip.MustParsePrefix("192.168.1.0/24"),
+			Tags:   []string{"kids"},
+		}},
+	})
+	require.NoError(t, err)
+
+	night := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+	e.now = func() (now time.Time) { return night }
+
+	kid := netip.MustParseAddrPort("192.168.1.2:53")
+	adult := netip.MustParseAddrPort("192.168.2.2:53")
+
+	newCtx := func(name string, addr netip.AddrPort) (dctx *proxy.DNSContext) {
+		return &proxy.DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion(name, dns.TypeA),
+			Addr: addr,
+		}
+	}
+
+	t.Run("block", func(t *testing.T) {
+		dctx := newCtx("www.games.example.", kid)
+		hErr := e.HandleBefore(nil, dctx)
+
+		befErr := &proxy.BeforeRequestError{}
+		require.ErrorAs(t, hErr, &befErr)
+
+		assert.Equal(t, dns.RcodeNameError, befErr.Response.Rcode)
+
+		tags, _ := proxy.Value(dctx, proxy.KeyPolicyTags)
+		assert.Equal(t, []string{"kids"}, tags)
+
+		rule, _ := proxy.Value(dctx, proxy.KeyMatchedRule)
+		assert.Equal(t, rules[0].Expr.String(), rule)
+	})
+
+	t.Run("allow_other_client", func(t *testing.T) {
+		dctx := newCtx("www.games.example.", adult)
+		require.NoError(t, e.HandleBefore(nil, dctx))
+
+		assert.Nil(t, dctx.CustomUpstreamConfig)
+
+		_, ok := proxy.Value(dctx, proxy.KeyPolicyTags)
+		assert.False(t, ok)
+	})
+
+	t.Run("route", func(t *testing.T) {
+		dctx := newCtx("host.corp.example.", kid)
+		require.NoError(t, e.HandleBefore(nil, dctx))
+
+		assert.Same(t, corp, dctx.CustomUpstreamConfig)
+	})
+
+	t.Run("daytime", func(t *testing.T) {
+		e.now = func() (now time.Time) { return night.Add(-12 * time.Hour) }
+
+		d := e.Decide(newCtx("www.games.example.", kid))
+		assert.Equal(t, ActionAllow, d.Action)
+	})
+}
+
+func TestNew_errors(t *testing.T) {
+	expr, err := Compile("true")
+	require.NoError(t, err)
+
+	_, err = New(&Config{
+		Rules: []*Rule{nil, {
+			Expr:     expr,
+			Action:   ActionRoute,
+			Upstream: "none",
+		}},
+	})
+	require.Error(t, err)
+
+	assert.Contains(t, err.Error(), "rule at index 0: no expression")
+	assert.Contains(t, err.Error(), `rule at index 1: unknown upstream "none"`)
+}
+
+func TestReadRules_errors(t *testing.T) {
+	testCases := []struct {
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		name:       "bad_action",
+		in:         "drop true",
+		wantErrMsg: `line 1: unknown action "drop"`,
+	}, {
+		name:       "no_upstream",
+		in:         "\nroute",
+		wantErrMsg: "line 2: no upstream name",
+	}, {
+		name:       "bad_expr",
+		in:         "block qname ==",
+		wantErrMsg: `line 1: parsing "qname ==": unexpected end of expression`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ReadRules(strings.NewReader(tc.in))
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+// newTestContext returns a new *proxy.DNSContext for an A request for name
+// from a fixed client.
+func newTestContext(name string) (dctx *proxy.DNSContext) {
+	return &proxy.DNSContext{
+		Req:  (&dns.Msg{}).SetQuestion(name, dns.TypeA),
+		Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+	}
+}
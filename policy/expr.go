@@ -0,0 +1,363 @@
+package policy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Expr is a compiled policy expression.  See the package documentation for
+// the language description.
+type Expr struct {
+	// root is the root node of the syntax tree.
+	root node
+
+	// src is the source text of the expression.
+	src string
+}
+
+// String implements the [fmt.Stringer] interface for *Expr.
+func (e *Expr) String() (s string) {
+	return e.src
+}
+
+// Eval evaluates the expression against the input and returns true if the
+// result is the boolean true.  It returns an error if the expression doesn't
+// evaluate to a boolean or an operation is applied to the values of
+// inappropriate types.  in must not be nil.
+func (e *Expr) Eval(in *Input) (ok bool, err error) {
+	v, err := e.root.eval(in)
+	if err != nil {
+		return false, err
+	}
+
+	ok, isBool := v.(bool)
+	if !isBool {
+		return false, fmt.Errorf("result is %s, not bool", typeName(v))
+	}
+
+	return ok, nil
+}
+
+// value is the value of an expression.  It's one of bool, int, string, or
+// []string.
+type value = any
+
+// typeName returns the name of the type of v to be used in errors.
+func typeName(v value) (name string) {
+	switch v.(type) {
+	case bool:
+		return "bool"
+	case int:
+		return "number"
+	case string:
+		return "string"
+	case []string:
+		return "list"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// node is a node of the syntax tree of an expression.
+type node interface {
+	// eval returns the value of the node for in.
+	eval(in *Input) (v value, err error)
+}
+
+// literal is a constant value.
+type literal struct {
+	val value
+}
+
+// type check
+var _ node = literal{}
+
+// eval implements the [node] interface for literal.
+func (n literal) eval(_ *Input) (v value, err error) {
+	return n.val, nil
+}
+
+// variable is a reference to a value of the input.
+type variable string
+
+// type check
+var _ node = variable("")
+
+// eval implements the [node] interface for variable.
+func (n variable) eval(in *Input) (v value, err error) {
+	return variables[string(n)](in), nil
+}
+
+// variables are the getters of the input values by their names.
+var variables = map[string]func(in *Input) (v value){
+	"qname":         func(in *Input) (v value) { return in.QName },
+	"qname_unicode": func(in *Input) (v value) { return in.QNameUnicode },
+	"qtype":         func(in *Input) (v value) { return in.QType },
+	"client":        func(in *Input) (v value) { return in.Client.String() },
+	"proto":         func(in *Input) (v value) { return in.Proto },
+	"hour":          func(in *Input) (v value) { return in.Time.Hour() },
+	"minute":        func(in *Input) (v value) { return in.Time.Minute() },
+	"weekday":       func(in *Input) (v value) { return int(in.Time.Weekday()) },
+	"tags":          func(in *Input) (v value) { return in.Tags },
+}
+
+// listNode is a list of strings.
+type listNode struct {
+	elems []node
+}
+
+// type check
+var _ node = (*listNode)(nil)
+
+// eval implements the [node] interface for *listNode.
+func (n *listNode) eval(in *Input) (v value, err error) {
+	l := make([]string, 0, len(n.elems))
+	for i, elem := range n.elems {
+		var s string
+		s, err = evalAs[string](elem, in)
+		if err != nil {
+			return nil, fmt.Errorf("list element at index %d: %w", i, err)
+		}
+
+		l = append(l, s)
+	}
+
+	return l, nil
+}
+
+// evalAs evaluates n and returns an error if the result isn't of type T.
+func evalAs[T value](n node, in *Input) (res T, err error) {
+	v, err := n.eval(in)
+	if err != nil {
+		return res, err
+	}
+
+	res, ok := v.(T)
+	if !ok {
+		return res, fmt.Errorf("want %s, got %s", typeName(res), typeName(v))
+	}
+
+	return res, nil
+}
+
+// notNode is a logical negation.
+type notNode struct {
+	operand node
+}
+
+// type check
+var _ node = (*notNode)(nil)
+
+// eval implements the [node] interface for *notNode.
+func (n *notNode) eval(in *Input) (v value, err error) {
+	b, err := evalAs[bool](n.operand, in)
+	if err != nil {
+		return nil, fmt.Errorf("operand of !: %w", err)
+	}
+
+	return !b, nil
+}
+
+// andNode is a short-circuit logical conjunction.
+type andNode struct {
+	left  node
+	right node
+}
+
+// type check
+var _ node = (*andNode)(nil)
+
+// eval implements the [node] interface for *andNode.
+func (n *andNode) eval(in *Input) (v value, err error) {
+	b, err := evalAs[bool](n.left, in)
+	if err != nil || !b {
+		return false, err
+	}
+
+	return evalAs[bool](n.right, in)
+}
+
+// orNode is a short-circuit logical disjunction.
+type orNode struct {
+	left  node
+	right node
+}
+
+// type check
+var _ node = (*orNode)(nil)
+
+// eval implements the [node] interface for *orNode.
+func (n *orNode) eval(in *Input) (v value, err error) {
+	b, err := evalAs[bool](n.left, in)
+	if err != nil || b {
+		return b, err
+	}
+
+	return evalAs[bool](n.right, in)
+}
+
+// cmpNode is a comparison of two values.
+type cmpNode struct {
+	left  node
+	right node
+	op    string
+}
+
+// type check
+var _ node = (*cmpNode)(nil)
+
+// eval implements the [node] interface for *cmpNode.
+func (n *cmpNode) eval(in *Input) (v value, err error) {
+	l, err := n.left.eval(in)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := n.right.eval(in)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "in":
+		return evalIn(l, r)
+	case "==":
+		return equal(l, r)
+	case "!=":
+		eq, eqErr := equal(l, r)
+
+		return !eq, eqErr
+	default:
+		return compare(l, r, n.op)
+	}
+}
+
+// evalIn returns true if l is an element of the list r or a substring of the
+// string r.
+func evalIn(l, r value) (ok bool, err error) {
+	s, isStr := l.(string)
+	if !isStr {
+		return false, fmt.Errorf("left operand of in: want string, got %s", typeName(l))
+	}
+
+	switch r := r.(type) {
+	case []string:
+		return slices.Contains(r, s), nil
+	case string:
+		return strings.Contains(r, s), nil
+	default:
+		return false, fmt.Errorf("right operand of in: want list or string, got %s", typeName(r))
+	}
+}
+
+// equal returns true if l and r are equal.  Strings are compared
+// case-insensitively.
+func equal(l, r value) (ok bool, err error) {
+	switch l := l.(type) {
+	case string:
+		rs, isStr := r.(string)
+		if isStr {
+			return strings.EqualFold(l, rs), nil
+		}
+	case int, bool:
+		if typeName(l) == typeName(r) {
+			return l == r, nil
+		}
+	}
+
+	return false, fmt.Errorf("cannot compare %s and %s", typeName(l), typeName(r))
+}
+
+// compare returns the result of the ordering comparison op of numbers l and r.
+func compare(l, r value, op string) (ok bool, err error) {
+	ln, lok := l.(int)
+	rn, rok := r.(int)
+	if !lok || !rok {
+		return false, fmt.Errorf("operator %s: want numbers, got %s and %s", op, typeName(l), typeName(r))
+	}
+
+	switch op {
+	case "<":
+		return ln < rn, nil
+	case "<=":
+		return ln <= rn, nil
+	case ">":
+		return ln > rn, nil
+	default:
+		return ln >= rn, nil
+	}
+}
+
+// function is a built-in function of the expression language.
+type function struct {
+	// call computes the result of the function.  len(args) is always equal to
+	// arity.
+	call func(args []string) (v value, err error)
+
+	// arity is the number of string arguments of the function.
+	arity int
+}
+
+// functions are the built-in functions of the expression language.
+var functions = map[string]*function{
+	"subdomain": {call: subdomain, arity: 2},
+	"prefix":    {call: func(a []string) (v value, err error) { return strings.HasPrefix(a[0], a[1]), nil }, arity: 2},
+	"suffix":    {call: func(a []string) (v value, err error) { return strings.HasSuffix(a[0], a[1]), nil }, arity: 2},
+	"lower":     {call: func(a []string) (v value, err error) { return strings.ToLower(a[0]), nil }, arity: 1},
+	"incidr":    {call: inCIDR, arity: 2},
+}
+
+// subdomain returns true if args[0] is args[1] or its subdomain.
+func subdomain(args []string) (v value, err error) {
+	name, domain := strings.ToLower(args[0]), strings.ToLower(args[1])
+
+	return name == domain || strings.HasSuffix(name, "."+domain), nil
+}
+
+// inCIDR returns true if the IP address args[0] is within the CIDR args[1].
+func inCIDR(args []string) (v value, err error) {
+	ip, err := netip.ParseAddr(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	pref, err := netip.ParsePrefix(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return pref.Contains(ip.Unmap()), nil
+}
+
+// callNode is a call of a built-in function.
+type callNode struct {
+	fn   *function
+	name string
+	args []node
+}
+
+// type check
+var _ node = (*callNode)(nil)
+
+// eval implements the [node] interface for *callNode.
+func (n *callNode) eval(in *Input) (v value, err error) {
+	args := make([]string, 0, len(n.args))
+	for i, arg := range n.args {
+		var s string
+		s, err = evalAs[string](arg, in)
+		if err != nil {
+			return nil, fmt.Errorf("%s: argument at index %d: %w", n.name, i, err)
+		}
+
+		args = append(args, s)
+	}
+
+	v, err = n.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.name, err)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,163 @@
+package policy
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpr_Eval(t *testing.T) {
+	in := &Input{
+		Time:   time.Date(2024, 1, 1, 23, 30, 0, 0, time.UTC),
+		Client: netip.MustParseAddr("192.0.2.1"),
+		QName:  "www.example.com",
+		QType:  "AAAA",
+		Proto:  "udp",
+		Tags:   []string{"kids", "guest"},
+	}
+
+	testCases := []struct {
+		name string
+		expr string
+		want bool
+	}{{
+		name: "subdomain",
+		expr: `subdomain(qname, "example.com")`,
+		want: true,
+	}, {
+		name: "not_subdomain",
+		expr: `subdomain(qname, "ample.com")`,
+		want: false,
+	}, {
+		name: "qtype_case",
+		expr: `qtype == "aaaa"`,
+		want: true,
+	}, {
+		name: "tags",
+		expr: `"kids" in tags && !("adult" in tags)`,
+		want: true,
+	}, {
+		name: "time",
+		expr: `hour >= 22 || hour < 7`,
+		want: true,
+	}, {
+		name: "weekday",
+		expr: `weekday == 1 && minute == 30`,
+		want: true,
+	}, {
+		name: "list",
+		expr: `qtype in ["A", "AAAA"]`,
+		want: true,
+	}, {
+		name: "cidr",
+		expr: `incidr(client, "192.0.2.0/24") && proto != "tcp"`,
+		want: true,
+	}, {
+		name: "precedence",
+		expr: `false && false || true`,
+		want: true,
+	}, {
+		name: "functions",
+		expr: `prefix(qname, "www.") && suffix(lower("A.COM"), ".com")`,
+		want: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := Compile(tc.expr)
+			require.NoError(t, err)
+
+			ok, err := e.Eval(in)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, ok)
+		})
+	}
+}
+
+func TestCompile_errors(t *testing.T) {
+	testCases := []struct {
+		name       string
+		expr       string
+		wantErrMsg string
+	}{{
+		name:       "empty",
+		expr:       ``,
+		wantErrMsg: `parsing "": unexpected end of expression`,
+	}, {
+		name:       "unknown_var",
+		expr:       `foo == 1`,
+		wantErrMsg: `parsing "foo == 1": at position 0: unknown variable "foo"`,
+	}, {
+		name:       "unknown_func",
+		expr:       `foo(qname)`,
+		wantErrMsg: `parsing "foo(qname)": at position 0: unknown function "foo"`,
+	}, {
+		name:       "arity",
+		expr:       `lower()`,
+		wantErrMsg: `parsing "lower()": at position 0: lower: want 1 args, got 0`,
+	}, {
+		name:       "unclosed",
+		expr:       `(true`,
+		wantErrMsg: `parsing "(true": at position 5: want ")"`,
+	}, {
+		name:       "trailing",
+		expr:       `true true`,
+		wantErrMsg: `parsing "true true": at position 5: unexpected "true"`,
+	}, {
+		name:       "bad_char",
+		expr:       `qname ~ "a"`,
+		wantErrMsg: `lexing "qname ~ \"a\"": at position 6: unexpected character '~'`,
+	}, {
+		name:       "bad_string",
+		expr:       `qname == "a`,
+		wantErrMsg: `lexing "qname == \"a": at position 9: bad string literal`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Compile(tc.expr)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestExpr_Eval_typeErrors(t *testing.T) {
+	in := &Input{QName: "example.com"}
+
+	testCases := []struct {
+		name       string
+		expr       string
+		wantErrMsg string
+	}{{
+		name:       "not_bool",
+		expr:       `qname`,
+		wantErrMsg: `result is string, not bool`,
+	}, {
+		name:       "compare_types",
+		expr:       `qname == 1`,
+		wantErrMsg: `cannot compare string and number`,
+	}, {
+		name:       "order_strings",
+		expr:       `qname < "b"`,
+		wantErrMsg: `operator <: want numbers, got string and string`,
+	}, {
+		name:       "not_operand",
+		expr:       `!qname`,
+		wantErrMsg: `operand of !: want bool, got string`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := Compile(tc.expr)
+			require.NoError(t, err)
+
+			_, err = e.Eval(in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
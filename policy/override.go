@@ -0,0 +1,126 @@
+package policy
+
+import (
+	"fmt"
+	"time"
+)
+
+// override is the manually set state of a named rule.
+type override struct {
+	// until is the time the override expires at.  Zero value means it never
+	// expires.
+	until time.Time
+
+	// active is true if the rule is forced to be active.
+	active bool
+}
+
+// isActive returns true if r is active at now, considering its schedule and
+// override.
+func (e *Engine) isActive(r *Rule, now time.Time) (ok bool) {
+	if r.Name != "" {
+		if o := e.override(r.Name, now); o != nil {
+			return o.active
+		}
+	}
+
+	return r.Schedule == nil || r.Schedule.Contains(now)
+}
+
+// override returns the unexpired override of the rule with name, if any.
+func (e *Engine) override(name string, now time.Time) (o *override) {
+	e.overridesLock.Lock()
+	defer e.overridesLock.Unlock()
+
+	o = e.overrides[name]
+	if o != nil && !o.until.IsZero() && !now.Before(o.until) {
+		delete(e.overrides, name)
+
+		return nil
+	}
+
+	return o
+}
+
+// Override forces the rule with name to be active or inactive regardless of
+// its schedule until the given time.  Zero until means until the override is
+// cleared with [Engine.ClearOverride].
+func (e *Engine) Override(name string, active bool, until time.Time) (err error) {
+	if e.ruleByName(name) == nil {
+		return fmt.Errorf("no rule with name %q", name)
+	}
+
+	e.overridesLock.Lock()
+	defer e.overridesLock.Unlock()
+
+	e.overrides[name] = &override{
+		until:  until,
+		active: active,
+	}
+
+	return nil
+}
+
+// ClearOverride removes the override of the rule with name, if any, so that
+// its schedule applies again.
+func (e *Engine) ClearOverride(name string) {
+	e.overridesLock.Lock()
+	defer e.overridesLock.Unlock()
+
+	delete(e.overrides, name)
+}
+
+// ruleByName returns the rule with name or nil if there is none.
+func (e *Engine) ruleByName(name string) (r *Rule) {
+	for _, r = range e.rules {
+		if name != "" && r.Name == name {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// RuleState is the current state of a named rule.
+type RuleState struct {
+	// OverriddenUntil is the time the override expires at.  It's zero if the
+	// rule isn't overridden or the override doesn't expire.
+	OverriddenUntil time.Time
+
+	// Schedule is the schedule of the rule.  It's nil if the rule has none.
+	Schedule *Schedule
+
+	// Name is the name of the rule.
+	Name string
+
+	// Active is true if the rule is currently active.
+	Active bool
+
+	// Overridden is true if the state is set with [Engine.Override].
+	Overridden bool
+}
+
+// RuleStates returns the current states of all the named rules.
+func (e *Engine) RuleStates() (states []*RuleState) {
+	now := e.now().In(e.location)
+	for _, r := range e.rules {
+		if r.Name == "" {
+			continue
+		}
+
+		s := &RuleState{
+			Schedule: r.Schedule,
+			Name:     r.Name,
+			Active:   e.isActive(r, now),
+		}
+
+		if o := e.override(r.Name, now); o != nil {
+			s.OverriddenUntil = o.until
+			s.Overridden = true
+		}
+
+		states = append(states, s)
+	}
+
+	return states
+}
@@ -0,0 +1,374 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// tokenKind is the kind of a lexical token of an expression.
+type tokenKind uint8
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+// token is a lexical token of an expression.
+type token struct {
+	// text is the source text of the token.  For string literals it's the
+	// unquoted value.
+	text string
+
+	// pos is the byte offset of the token within the expression.
+	pos int
+
+	// kind is the kind of the token.
+	kind tokenKind
+}
+
+// operators are the operator tokens sorted so that the longer ones go first.
+var operators = []string{
+	"&&", "||", "==", "!=", "<=", ">=",
+	"<", ">", "!", "(", ")", "[", "]", ",",
+}
+
+// lex splits the expression into tokens.
+func lex(s string) (tokens []token, err error) {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if unicode.IsSpace(r) {
+			i += size
+
+			continue
+		}
+
+		var t token
+		t, err = lexToken(s, i)
+		if err != nil {
+			return nil, fmt.Errorf("at position %d: %w", i, err)
+		}
+
+		tokens = append(tokens, t)
+		i = t.pos + t.len(s[t.pos:])
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(s)}), nil
+}
+
+// len returns the length of the source text of t within src, which must start
+// with t.
+func (t token) len(src string) (n int) {
+	switch t.kind {
+	case tokenString:
+		quoted, _ := strconv.QuotedPrefix(src)
+
+		return len(quoted)
+	default:
+		return len(t.text)
+	}
+}
+
+// lexToken returns the token starting at the position i of s.
+func lexToken(s string, i int) (t token, err error) {
+	c := s[i]
+	switch {
+	case c == '"':
+		var quoted string
+		quoted, err = strconv.QuotedPrefix(s[i:])
+		if err != nil {
+			return token{}, errors.Error("bad string literal")
+		}
+
+		// Don't check the error, since quoted is valid.
+		text, _ := strconv.Unquote(quoted)
+
+		return token{kind: tokenString, text: text, pos: i}, nil
+	case c >= '0' && c <= '9':
+		end := i + strings.IndexFunc(s[i:]+" ", func(r rune) (ok bool) { return r < '0' || r > '9' })
+
+		return token{kind: tokenNumber, text: s[i:end], pos: i}, nil
+	case isIdentStart(c):
+		end := i + strings.IndexFunc(s[i:]+" ", func(r rune) (ok bool) {
+			return r > unicode.MaxASCII || !isIdentPart(byte(r))
+		})
+
+		return token{kind: tokenIdent, text: s[i:end], pos: i}, nil
+	default:
+		for _, op := range operators {
+			if strings.HasPrefix(s[i:], op) {
+				return token{kind: tokenOp, text: op, pos: i}, nil
+			}
+		}
+
+		return token{}, fmt.Errorf("unexpected character %q", c)
+	}
+}
+
+// isIdentStart returns true if c may start an identifier.
+func isIdentStart(c byte) (ok bool) {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isIdentPart returns true if c may be a part of an identifier.
+func isIdentPart(c byte) (ok bool) {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+// parser is a recursive descent parser of expressions.  The grammar is:
+//
+//	expr    = and { "||" and } ;
+//	and     = not { "&&" not } ;
+//	not     = "!" not | cmp ;
+//	cmp     = primary [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" ) primary ] ;
+//	primary = ident | call | string | number | "true" | "false" | list | "(" expr ")" ;
+//	call    = ident "(" [ expr { "," expr } ] ")" ;
+//	list    = "[" [ expr { "," expr } ] "]" ;
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Compile parses the expression and returns its compiled form, ready to be
+// evaluated.  It returns an error if s isn't a valid expression or refers to
+// unknown variables or functions.
+func Compile(s string) (e *Expr, err error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, fmt.Errorf("lexing %q: %w", s, err)
+	}
+
+	p := &parser{tokens: tokens}
+	n, err := p.parseOr()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = p.unexpected()
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", s, err)
+	}
+
+	return &Expr{root: n, src: s}, nil
+}
+
+// peek returns the current token.
+func (p *parser) peek() (t token) {
+	return p.tokens[p.pos]
+}
+
+// next returns the current token and advances to the next one.
+func (p *parser) next() (t token) {
+	t = p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+// accept advances to the next token and returns true if the current one is
+// the operator or keyword op.
+func (p *parser) accept(op string) (ok bool) {
+	t := p.peek()
+	if (t.kind == tokenOp || t.kind == tokenIdent) && t.text == op {
+		p.pos++
+
+		return true
+	}
+
+	return false
+}
+
+// expect advances to the next token if the current one is the operator op and
+// returns an error otherwise.
+func (p *parser) expect(op string) (err error) {
+	if !p.accept(op) {
+		return fmt.Errorf("at position %d: want %q", p.peek().pos, op)
+	}
+
+	return nil
+}
+
+// unexpected returns an error about the current token.
+func (p *parser) unexpected() (err error) {
+	t := p.peek()
+	if t.kind == tokenEOF {
+		return errors.Error("unexpected end of expression")
+	}
+
+	return fmt.Errorf("at position %d: unexpected %q", t.pos, t.text)
+}
+
+// parseOr parses the "expr" production.
+func (p *parser) parseOr() (n node, err error) {
+	n, err = p.parseAnd()
+	for err == nil && p.accept("||") {
+		var r node
+		r, err = p.parseAnd()
+		n = &orNode{left: n, right: r}
+	}
+
+	return n, err
+}
+
+// parseAnd parses the "and" production.
+func (p *parser) parseAnd() (n node, err error) {
+	n, err = p.parseNot()
+	for err == nil && p.accept("&&") {
+		var r node
+		r, err = p.parseNot()
+		n = &andNode{left: n, right: r}
+	}
+
+	return n, err
+}
+
+// parseNot parses the "not" production.
+func (p *parser) parseNot() (n node, err error) {
+	if !p.accept("!") {
+		return p.parseCmp()
+	}
+
+	n, err = p.parseNot()
+
+	return &notNode{operand: n}, err
+}
+
+// comparisons are the supported comparison operators.
+var comparisons = []string{"==", "!=", "<=", ">=", "<", ">", "in"}
+
+// parseCmp parses the "cmp" production.
+func (p *parser) parseCmp() (n node, err error) {
+	n, err = p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range comparisons {
+		if p.accept(op) {
+			var r node
+			r, err = p.parsePrimary()
+
+			return &cmpNode{left: n, right: r, op: op}, err
+		}
+	}
+
+	return n, nil
+}
+
+// parsePrimary parses the "primary" production.
+func (p *parser) parsePrimary() (n node, err error) {
+	switch t := p.peek(); t.kind {
+	case tokenString:
+		p.next()
+
+		return literal{val: t.text}, nil
+	case tokenNumber:
+		p.next()
+
+		return parseNumber(t)
+	case tokenIdent:
+		return p.parseIdent()
+	case tokenOp:
+		return p.parseGroup()
+	default:
+		return nil, p.unexpected()
+	}
+}
+
+// parseNumber parses the number literal token.
+func parseNumber(t token) (n node, err error) {
+	v, err := strconv.Atoi(t.text)
+	if err != nil {
+		return nil, fmt.Errorf("at position %d: bad number %q", t.pos, t.text)
+	}
+
+	return literal{val: v}, nil
+}
+
+// parseGroup parses a parenthesized expression or a list.
+func (p *parser) parseGroup() (n node, err error) {
+	switch {
+	case p.accept("("):
+		n, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		return n, p.expect(")")
+	case p.accept("["):
+		var elems []node
+		elems, err = p.parseArgs("]")
+
+		return &listNode{elems: elems}, err
+	default:
+		return nil, p.unexpected()
+	}
+}
+
+// parseIdent parses a keyword, a variable, or a function call.
+func (p *parser) parseIdent() (n node, err error) {
+	t := p.next()
+	switch t.text {
+	case "true":
+		return literal{val: true}, nil
+	case "false":
+		return literal{val: false}, nil
+	}
+
+	if !p.accept("(") {
+		if _, ok := variables[t.text]; !ok {
+			return nil, fmt.Errorf("at position %d: unknown variable %q", t.pos, t.text)
+		}
+
+		return variable(t.text), nil
+	}
+
+	fn, ok := functions[t.text]
+	if !ok {
+		return nil, fmt.Errorf("at position %d: unknown function %q", t.pos, t.text)
+	}
+
+	args, err := p.parseArgs(")")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != fn.arity {
+		return nil, fmt.Errorf("at position %d: %s: want %d args, got %d", t.pos, t.text, fn.arity, len(args))
+	}
+
+	return &callNode{fn: fn, name: t.text, args: args}, nil
+}
+
+// parseArgs parses a comma-separated list of expressions terminated by end.
+func (p *parser) parseArgs(end string) (args []node, err error) {
+	if p.accept(end) {
+		return nil, nil
+	}
+
+	for {
+		var arg node
+		arg, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+		if p.accept(end) {
+			return args, nil
+		}
+
+		err = p.expect(",")
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Package policy implements a rule-based engine deciding whether a DNS request
+// should be allowed, blocked, or routed to a specific set of upstreams.
+//
+// Each rule contains a boolean expression evaluated for every request.  The
+// expression language supports:
+//
+//   - string literals in double quotes, decimal numbers, true, and false;
+//   - lists of strings, e.g. ["a", "b"];
+//   - the variables qname (lowercased, without the trailing dot, with the
+//     internationalized labels in the Punycode form), qname_unicode (same
+//     with the labels in the Unicode form), qtype (e.g. "AAAA"), client (the
+//     client's IP address), proto (e.g. "udp"), hour, minute, weekday (0 is
+//     Sunday), and tags (the list of the client's tags);
+//   - the comparison operators ==, !=, <, <=, >, >=, and in;
+//   - the logical operators !, &&, and ||, and parentheses;
+//   - the functions subdomain(name, domain), prefix(s, p), suffix(s, s),
+//     lower(s), and incidr(ip, cidr).
+//
+// For example:
+//
+//	subdomain(qname, "example.com") && "kids" in tags && (hour >= 22 || hour < 7)
+package policy
+
+import (
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/bruceluk/dnsproxy/idn"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// Input is the data about a request that expressions are evaluated against.
+type Input struct {
+	// Time is the time of the request in the configured location.
+	Time time.Time
+
+	// Client is the address of the client.
+	Client netip.Addr
+
+	// QName is the lowercased question name without the trailing dot.
+	QName string
+
+	// QNameUnicode is QName with the internationalized labels in the Unicode
+	// form.
+	QNameUnicode string
+
+	// QType is the textual representation of the question type.
+	QType string
+
+	// Proto is the protocol the request was received over.
+	Proto string
+
+	// Tags are the tags of the client.
+	Tags []string
+}
+
+// newInput returns the input for the request from dctx at now.  tags must not
+// be modified.
+func newInput(dctx *proxy.DNSContext, now time.Time, tags []string) (in *Input) {
+	in = &Input{
+		Time:   now,
+		Client: dctx.Addr.Addr().Unmap(),
+		Proto:  string(dctx.Proto),
+		Tags:   tags,
+	}
+
+	if req := dctx.Req; req != nil && len(req.Question) > 0 {
+		q := req.Question[0]
+		in.QName = strings.ToLower(strings.TrimSuffix(q.Name, "."))
+		in.QNameUnicode = idn.ToUnicode(in.QName)
+		in.QType = dns.Type(q.Qtype).String()
+	}
+
+	return in
+}
@@ -0,0 +1,105 @@
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// ReadRules reads the rules from r.  Each non-empty line not starting with '#'
+// is a rule in one of the following forms:
+//
+//	allow [OPTIONS] EXPR
+//	block [OPTIONS] EXPR
+//	route UPSTREAM [OPTIONS] EXPR
+//
+// where UPSTREAM is the name of the upstream configuration and EXPR is the
+// condition of the rule.  OPTIONS are space-separated:
+//
+//   - name=NAME sets the name of the rule;
+//   - when=SCHEDULE sets the schedule of the rule, see [ParseSchedule].
+//
+// For example:
+//
+//	block name=bedtime when=22:00-07:00 "kids" in tags && subdomain(qname, "games.example")
+func ReadRules(r io.Reader) (rules []*Rule, err error) {
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		var rule *Rule
+		rule, err = parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	err = s.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+// parseRule parses a single non-empty rule line.
+func parseRule(line string) (r *Rule, err error) {
+	actionStr, rest, _ := strings.Cut(line, " ")
+
+	r = &Rule{}
+	switch actionStr {
+	case "allow":
+		r.Action = ActionAllow
+	case "block":
+		r.Action = ActionBlock
+	case "route":
+		r.Action = ActionRoute
+		r.Upstream, rest, _ = strings.Cut(strings.TrimSpace(rest), " ")
+		if r.Upstream == "" {
+			return nil, errors.Error("no upstream name")
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", actionStr)
+	}
+
+	rest, err = r.parseOptions(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Expr, err = Compile(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// parseOptions parses the options at the beginning of s into r and returns the
+// rest of s.
+func (r *Rule) parseOptions(s string) (rest string, err error) {
+	for rest = strings.TrimSpace(s); ; rest = strings.TrimSpace(rest) {
+		opt, tail, _ := strings.Cut(rest, " ")
+		switch {
+		case strings.HasPrefix(opt, "name="):
+			r.Name = strings.TrimPrefix(opt, "name=")
+		case strings.HasPrefix(opt, "when="):
+			r.Schedule, err = ParseSchedule(strings.TrimPrefix(opt, "when="))
+			if err != nil {
+				return "", fmt.Errorf("schedule: %w", err)
+			}
+		default:
+			return rest, nil
+		}
+
+		rest = tail
+	}
+}
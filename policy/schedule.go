@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Schedule is a weekly schedule during which a rule is active.
+type Schedule struct {
+	// Days are the days of week the schedule starts on.  If empty, the
+	// schedule starts on every day.
+	Days []time.Weekday
+
+	// Start is the offset from the midnight the schedule starts at.
+	Start time.Duration
+
+	// End is the offset from the midnight the schedule ends at.  If it's less
+	// than or equal to Start, the schedule ends on the next day, e.g. the
+	// schedule from 22:00 to 07:00 covers the night.
+	End time.Duration
+}
+
+// weekdays are the abbreviated names of the days of week.
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseSchedule parses the schedule in the "[DAYS/]HH:MM-HH:MM" format, where
+// DAYS is a comma-separated list of abbreviated day names, e.g.
+// "sat,sun/10:00-12:00" or "22:00-07:00".
+func ParseSchedule(s string) (sch *Schedule, err error) {
+	sch = &Schedule{}
+
+	daysStr, rangeStr, hasDays := strings.Cut(s, "/")
+	if !hasDays {
+		rangeStr = daysStr
+	} else {
+		sch.Days, err = parseDays(daysStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	startStr, endStr, ok := strings.Cut(rangeStr, "-")
+	if !ok {
+		return nil, fmt.Errorf("bad time range %q", rangeStr)
+	}
+
+	sch.Start, err = parseClock(startStr)
+	if err != nil {
+		return nil, fmt.Errorf("start: %w", err)
+	}
+
+	sch.End, err = parseClock(endStr)
+	if err != nil {
+		return nil, fmt.Errorf("end: %w", err)
+	}
+
+	return sch, nil
+}
+
+// parseDays parses a comma-separated list of abbreviated day names.
+func parseDays(s string) (days []time.Weekday, err error) {
+	for _, name := range strings.Split(s, ",") {
+		i := slices.Index(weekdays, strings.ToLower(strings.TrimSpace(name)))
+		if i < 0 {
+			return nil, fmt.Errorf("bad day %q", name)
+		}
+
+		days = append(days, time.Weekday(i))
+	}
+
+	return days, nil
+}
+
+// parseClock parses the time of day in the "HH:MM" format and returns its
+// offset from the midnight.
+func parseClock(s string) (d time.Duration, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Error("bad time of day, want HH:MM")
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// String implements the [fmt.Stringer] interface for *Schedule.
+func (sch *Schedule) String() (s string) {
+	var days []string
+	for _, d := range sch.Days {
+		days = append(days, weekdays[d])
+	}
+
+	rangeStr := formatClock(sch.Start) + "-" + formatClock(sch.End)
+	if len(days) == 0 {
+		return rangeStr
+	}
+
+	return strings.Join(days, ",") + "/" + rangeStr
+}
+
+// formatClock formats the offset from the midnight as "HH:MM".
+func formatClock(d time.Duration) (s string) {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// Contains returns true if t is within the schedule.  The time zone of t is
+// used to determine the day and the time of day.
+func (sch *Schedule) Contains(t time.Time) (ok bool) {
+	// Don't subtract the midnight, since the day may be shorter or longer due
+	// to daylight saving time.
+	h, m, sec := t.Clock()
+	offset := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+
+	if sch.Start < sch.End {
+		return sch.startsOn(t.Weekday()) && offset >= sch.Start && offset < sch.End
+	}
+
+	// The schedule wraps around the midnight.
+	if offset >= sch.Start {
+		return sch.startsOn(t.Weekday())
+	}
+
+	return offset < sch.End && sch.startsOn((t.Weekday()+6)%7)
+}
+
+// startsOn returns true if the schedule starts on the day d.
+func (sch *Schedule) startsOn(d time.Weekday) (ok bool) {
+	return len(sch.Days) == 0 || slices.Contains(sch.Days, d)
+}
@@ -0,0 +1,120 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedule_Contains(t *testing.T) {
+	// 2024-01-05 is Friday.
+	at := func(day, hour, minute int) (t time.Time) {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	testCases := []struct {
+		at   time.Time
+		name string
+		sch  string
+		want bool
+	}{{
+		at:   at(5, 10, 0),
+		name: "within",
+		sch:  "09:00-17:00",
+		want: true,
+	}, {
+		at:   at(5, 17, 0),
+		name: "end_excluded",
+		sch:  "09:00-17:00",
+		want: false,
+	}, {
+		at:   at(5, 23, 0),
+		name: "night_evening",
+		sch:  "fri/22:00-07:00",
+		want: true,
+	}, {
+		at:   at(6, 6, 59),
+		name: "night_morning_next_day",
+		sch:  "fri/22:00-07:00",
+		want: true,
+	}, {
+		at:   at(5, 6, 0),
+		name: "night_morning_wrong_day",
+		sch:  "fri/22:00-07:00",
+		want: false,
+	}, {
+		at:   at(6, 11, 0),
+		name: "weekend",
+		sch:  "sat,sun/10:00-12:00",
+		want: true,
+	}, {
+		at:   at(5, 11, 0),
+		name: "weekday",
+		sch:  "sat,sun/10:00-12:00",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sch, err := ParseSchedule(tc.sch)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.sch, sch.String())
+			assert.Equal(t, tc.want, sch.Contains(tc.at))
+		})
+	}
+}
+
+func TestParseSchedule_errors(t *testing.T) {
+	for _, s := range []string{"", "10:00", "xyz/10:00-11:00", "25:00-26:00", "10:00-1100"} {
+		_, err := ParseSchedule(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestEngine_Override(t *testing.T) {
+	rules, err := ReadRules(strings.NewReader(
+		`block name=bedtime when=22:00-07:00 subdomain(qname, "games.example")`,
+	))
+	require.NoError(t, err)
+
+	e, err := New(&Config{
+		Location: time.UTC,
+		Rules:    rules,
+	})
+	require.NoError(t, err)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	e.now = func() (t time.Time) { return now }
+
+	dctx := newTestContext("games.example.")
+	assert.Equal(t, ActionAllow, e.Decide(dctx).Action)
+
+	require.NoError(t, e.Override("bedtime", true, now.Add(time.Hour)))
+	assert.Equal(t, ActionBlock, e.Decide(dctx).Action)
+
+	states := e.RuleStates()
+	require.Len(t, states, 1)
+
+	assert.True(t, states[0].Active)
+	assert.True(t, states[0].Overridden)
+	assert.Equal(t, now.Add(time.Hour), states[0].OverriddenUntil)
+
+	// Let the override expire.
+	now = now.Add(time.Hour)
+	assert.Equal(t, ActionAllow, e.Decide(dctx).Action)
+
+	now = now.Add(11 * time.Hour)
+	assert.Equal(t, ActionBlock, e.Decide(dctx).Action)
+
+	require.NoError(t, e.Override("bedtime", false, time.Time{}))
+	assert.Equal(t, ActionAllow, e.Decide(dctx).Action)
+
+	e.ClearOverride("bedtime")
+	assert.Equal(t, ActionBlock, e.Decide(dctx).Action)
+
+	assert.Error(t, e.Override("unknown", true, time.Time{}))
+}
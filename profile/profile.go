@@ -0,0 +1,276 @@
+// Package profile generates the configuration profiles, which make the devices
+// use the proxy as their encrypted DNS resolver.
+package profile
+
+import (
+	"bytes"
+	"crypto/sha1" // #nosec G505 -- See nameUUID.
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// Protocol is the encrypted DNS protocol configured by a profile.
+type Protocol string
+
+// Protocol values.
+const (
+	// ProtocolHTTPS is DNS-over-HTTPS.
+	ProtocolHTTPS Protocol = "https"
+
+	// ProtocolTLS is DNS-over-TLS.
+	ProtocolTLS Protocol = "tls"
+)
+
+// Default ports of the protocols.  The devices don't support other ports for
+// DNS-over-TLS.
+const (
+	defaultHTTPSPort uint16 = 443
+	defaultTLSPort   uint16 = 853
+)
+
+// Config describes the encrypted DNS endpoints of the proxy.
+type Config struct {
+	// ServerName is the hostname of the proxy, as in its TLS certificate.  It
+	// must be a valid hostname.
+	ServerName string
+
+	// DisplayName is the name of the profile shown to the user.  If empty,
+	// it's derived from ServerName.
+	DisplayName string
+
+	// Identifier is the reverse-DNS-style identifier of the profile, which is
+	// used to replace the previously installed version of it.  If empty, it's
+	// derived from ServerName.
+	Identifier string
+
+	// ServerAddrs are the IP addresses of the proxy, which the devices use to
+	// avoid resolving ServerName.  It may be empty.
+	ServerAddrs []netip.Addr
+
+	// HTTPSPort is the port of the DNS-over-HTTPS listener.  If zero, 443 is
+	// used.
+	HTTPSPort uint16
+
+	// TLSPort is the port of the DNS-over-TLS listener.  It must be either
+	// zero or 853, since the devices don't support other ports.
+	TLSPort uint16
+}
+
+// validate returns an error if c can't be used to generate profiles for
+// proto.
+func (c *Config) validate(proto Protocol) (err error) {
+	if c == nil {
+		return errors.Error("no config")
+	}
+
+	err = netutil.ValidateHostname(c.ServerName)
+	if err != nil {
+		return fmt.Errorf("server name: %w", err)
+	}
+
+	switch proto {
+	case ProtocolHTTPS:
+		return nil
+	case ProtocolTLS:
+		if c.TLSPort != 0 && c.TLSPort != defaultTLSPort {
+			return fmt.Errorf("tls port: %d is not supported by the devices", c.TLSPort)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("bad protocol %q", proto)
+	}
+}
+
+// DoHURL returns the URL of the DNS-over-HTTPS endpoint described by c.  c
+// must be valid.
+func (c *Config) DoHURL() (u *url.URL) {
+	host := c.ServerName
+	if c.HTTPSPort != 0 && c.HTTPSPort != defaultHTTPSPort {
+		host = net.JoinHostPort(host, strconv.Itoa(int(c.HTTPSPort)))
+	}
+
+	return &url.URL{
+		Scheme: "https",
+		Host:   host,
+		Path:   "/dns-query",
+	}
+}
+
+// appleDNSSettings is the data of the Apple DNS settings payload.
+type appleDNSSettings struct {
+	DisplayName       string
+	Identifier        string
+	PayloadUUID       string
+	ProfileUUID       string
+	Protocol          string
+	ServerURL         string
+	ServerName        string
+	PayloadIdentifier string
+	ServerAddrs       []netip.Addr
+}
+
+// appleTmpl is the template of the Apple configuration profile.
+var appleTmpl = template.Must(template.New("mobileconfig").Funcs(template.FuncMap{
+	"xml": xmlEscape,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>DNSSettings</key>
+			<dict>
+				<key>DNSProtocol</key>
+				<string>{{ .Protocol }}</string>
+{{- if .ServerAddrs }}
+				<key>ServerAddresses</key>
+				<array>
+{{- range .ServerAddrs }}
+					<string>{{ . }}</string>
+{{- end }}
+				</array>
+{{- end }}
+{{- if .ServerURL }}
+				<key>ServerURL</key>
+				<string>{{ xml .ServerURL }}</string>
+{{- else }}
+				<key>ServerName</key>
+				<string>{{ xml .ServerName }}</string>
+{{- end }}
+			</dict>
+			<key>PayloadDisplayName</key>
+			<string>{{ xml .DisplayName }}</string>
+			<key>PayloadIdentifier</key>
+			<string>{{ xml .PayloadIdentifier }}</string>
+			<key>PayloadType</key>
+			<string>com.apple.dnsSettings.managed</string>
+			<key>PayloadUUID</key>
+			<string>{{ .PayloadUUID }}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>{{ xml .DisplayName }}</string>
+	<key>PayloadIdentifier</key>
+	<string>{{ xml .Identifier }}</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{ .ProfileUUID }}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+// AppleMobileConfig returns the Apple configuration profile, also known as
+// .mobileconfig, making the device use the proto endpoint described by c.
+// The profile is unsigned.  The UUIDs in the profile are derived from the
+// identifier, so generating the profile again gives the same result.
+func AppleMobileConfig(c *Config, proto Protocol) (data []byte, err error) {
+	err = c.validate(proto)
+	if err != nil {
+		return nil, fmt.Errorf("validating config: %w", err)
+	}
+
+	id := c.Identifier
+	if id == "" {
+		id = "dnsproxy." + c.ServerName
+	}
+
+	displayName := c.DisplayName
+	if displayName == "" {
+		displayName = "dnsproxy (" + c.ServerName + ")"
+	}
+
+	settings := &appleDNSSettings{
+		DisplayName:       displayName,
+		Identifier:        id,
+		ServerAddrs:       c.ServerAddrs,
+		PayloadIdentifier: id + ".dnssettings." + string(proto),
+	}
+
+	if proto == ProtocolHTTPS {
+		settings.Protocol = "HTTPS"
+		settings.ServerURL = c.DoHURL().String()
+	} else {
+		settings.Protocol = "TLS"
+		settings.ServerName = c.ServerName
+	}
+
+	settings.ProfileUUID = nameUUID(id)
+	settings.PayloadUUID = nameUUID(settings.PayloadIdentifier)
+
+	buf := &bytes.Buffer{}
+	err = appleTmpl.Execute(buf, settings)
+	if err != nil {
+		// Shouldn't happen, since the template and the data are controlled.
+		return nil, fmt.Errorf("executing template: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// AndroidPrivateDNS returns the instructions for setting up the Private DNS
+// on Android devices to use the DNS-over-TLS endpoint described by c.
+func AndroidPrivateDNS(c *Config) (snippet string, err error) {
+	err = c.validate(ProtocolTLS)
+	if err != nil {
+		return "", fmt.Errorf("validating config: %w", err)
+	}
+
+	return fmt.Sprintf(`# Settings > Network & internet > Private DNS > Private DNS provider hostname:
+%[1]s
+
+# Or, using adb:
+adb shell settings put global private_dns_mode hostname
+adb shell settings put global private_dns_specifier %[1]s
+`, c.ServerName), nil
+}
+
+// xmlEscape returns s with the XML special characters escaped.
+func xmlEscape(s string) (escaped string) {
+	b := &strings.Builder{}
+
+	// Don't check the error since strings.Builder never returns one.
+	_ = xml.EscapeText(b, []byte(s))
+
+	return b.String()
+}
+
+// nameUUID returns the name-based version 5 UUID of name within the URL
+// namespace as defined by RFC 9562.
+func nameUUID(name string) (uuid string) {
+	// urlNamespace is the namespace UUID for URLs, 6ba7b811-9dad-11d1-80b4-00c04fd430c8.
+	urlNamespace := []byte{
+		0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1,
+		0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8,
+	}
+
+	// #nosec G401 -- SHA-1 is required by the UUID version 5 specification and
+	// isn't used for security here.
+	h := sha1.New()
+	_, _ = h.Write(urlNamespace)
+	_, _ = h.Write([]byte(name))
+	sum := h.Sum(nil)
+
+	// Set the version and the variant.
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%X-%X-%X-%X-%X", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
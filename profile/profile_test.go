@@ -0,0 +1,58 @@
+package profile
+
+import (
+	"encoding/xml"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppleMobileConfig(t *testing.T) {
+	c := &Config{
+		ServerName:  "dns.example",
+		ServerAddrs: []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		HTTPSPort:   8443,
+		TLSPort:     853,
+	}
+
+	doh, err := AppleMobileConfig(c, ProtocolHTTPS)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(doh), "<string>https://dns.example:8443/dns-query</string>")
+	assert.Contains(t, string(doh), "<string>192.0.2.1</string>")
+	assert.NoError(t, xml.Unmarshal(doh, &struct{}{}))
+
+	dot, err := AppleMobileConfig(c, ProtocolTLS)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(dot), "<key>ServerName</key>\n\t\t\t\t<string>dns.example</string>")
+	assert.NotContains(t, string(dot), "ServerURL")
+
+	again, err := AppleMobileConfig(c, ProtocolTLS)
+	require.NoError(t, err)
+
+	assert.Equal(t, dot, again)
+
+	_, err = AppleMobileConfig(c, "quic")
+	assert.Error(t, err)
+
+	_, err = AppleMobileConfig(&Config{ServerName: "bad name"}, ProtocolTLS)
+	assert.Error(t, err)
+}
+
+func TestAndroidPrivateDNS(t *testing.T) {
+	s, err := AndroidPrivateDNS(&Config{ServerName: "dns.example"})
+	require.NoError(t, err)
+
+	assert.Contains(t, s, "private_dns_specifier dns.example\n")
+
+	_, err = AndroidPrivateDNS(&Config{ServerName: "dns.example", TLSPort: 8853})
+	assert.Error(t, err)
+}
+
+func TestNameUUID(t *testing.T) {
+	// The value is the same as the one from Python's uuid.uuid5.
+	assert.Equal(t, "FCDE3C85-2270-590F-9E7C-EE003D65E0E2", nameUUID("http://www.example.com/"))
+}
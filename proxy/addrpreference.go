@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// AddrPreference defines how the A and AAAA records in responses are handled
+// for a particular client.
+type AddrPreference uint8
+
+const (
+	// AddrPreferenceDefault leaves the responses as is.
+	AddrPreferenceDefault AddrPreference = iota
+
+	// AddrPreferenceIPv4 puts the A records before the AAAA ones and responds
+	// to AAAA requests with NODATA if the name has A records.
+	AddrPreferenceIPv4
+
+	// AddrPreferenceIPv6 puts the AAAA records before the A ones and responds
+	// to A requests with NODATA if the name has AAAA records.
+	AddrPreferenceIPv6
+
+	// AddrPreferenceIPv4Only removes the AAAA records from the responses.
+	AddrPreferenceIPv4Only
+
+	// AddrPreferenceIPv6Only removes the A records from the responses.
+	AddrPreferenceIPv6Only
+)
+
+// String implements the [fmt.Stringer] interface for AddrPreference.
+func (pref AddrPreference) String() (s string) {
+	switch pref {
+	case AddrPreferenceDefault:
+		return "default"
+	case AddrPreferenceIPv4:
+		return "prefer-ipv4"
+	case AddrPreferenceIPv6:
+		return "prefer-ipv6"
+	case AddrPreferenceIPv4Only:
+		return "ipv4-only"
+	case AddrPreferenceIPv6Only:
+		return "ipv6-only"
+	default:
+		return fmt.Sprintf("!bad_addr_preference_%d", uint8(pref))
+	}
+}
+
+// ParseAddrPreference parses the address preference from its string
+// representation as returned by [AddrPreference.String].
+func ParseAddrPreference(s string) (pref AddrPreference, err error) {
+	for pref = AddrPreferenceDefault; pref <= AddrPreferenceIPv6Only; pref++ {
+		if pref.String() == s {
+			return pref, nil
+		}
+	}
+
+	return AddrPreferenceDefault, fmt.Errorf("unknown address preference %q", s)
+}
+
+// AddrClientPreference is the address preference for the clients within a
+// subnet.
+type AddrClientPreference struct {
+	// Subnet is the subnet of the clients the preference applies to.  It must
+	// be valid.
+	Subnet netip.Prefix
+
+	// Preference is the preference applied to the responses for the clients
+	// within Subnet.
+	Preference AddrPreference
+}
+
+// validateAddrPreferences returns an error if any of prefs is invalid.
+func validateAddrPreferences(prefs []*AddrClientPreference) (err error) {
+	var errs []error
+	for i, pref := range prefs {
+		err = validateAddrPreference(pref)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("preference at index %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateAddrPreference returns an error if pref is invalid.
+func validateAddrPreference(pref *AddrClientPreference) (err error) {
+	switch {
+	case pref == nil:
+		return errors.Error("preference is nil")
+	case !pref.Subnet.IsValid():
+		return fmt.Errorf("bad subnet %s", pref.Subnet)
+	case pref.Preference > AddrPreferenceIPv6Only:
+		return fmt.Errorf("bad preference %s", pref.Preference)
+	default:
+		return nil
+	}
+}
+
+// sortAddrPreferences returns a copy of prefs sorted from the most specific
+// subnet to the least specific one, so that the first matching preference is
+// the one of the longest matching prefix.
+func sortAddrPreferences(prefs []*AddrClientPreference) (sorted []*AddrClientPreference) {
+	if len(prefs) == 0 {
+		return nil
+	}
+
+	sorted = slices.Clone(prefs)
+	slices.SortStableFunc(sorted, func(a, b *AddrClientPreference) (res int) {
+		return b.Subnet.Bits() - a.Subnet.Bits()
+	})
+
+	return sorted
+}
+
+// addrPreference returns the address preference for the client with addr.
+func (p *Proxy) addrPreference(addr netip.Addr) (pref AddrPreference) {
+	addr = addr.Unmap()
+	for _, cp := range p.addrPreferences {
+		if cp.Subnet.Contains(addr) {
+			return cp.Preference
+		}
+	}
+
+	return AddrPreferenceDefault
+}
+
+// applyAddrPreference modifies the successful response in dctx according to
+// the address preference of the client.
+func (p *Proxy) applyAddrPreference(dctx *DNSContext) {
+	resp := dctx.Res
+	if resp == nil || resp.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	pref := p.addrPreference(dctx.Addr.Addr())
+	switch pref {
+	case AddrPreferenceIPv4:
+		p.suppressAddrs(dctx, dns.TypeAAAA, dns.TypeA)
+		sortAddrs(resp, dns.TypeA)
+	case AddrPreferenceIPv6:
+		p.suppressAddrs(dctx, dns.TypeA, dns.TypeAAAA)
+		sortAddrs(resp, dns.TypeAAAA)
+	case AddrPreferenceIPv4Only:
+		removeAddrs(resp, dns.TypeAAAA)
+	case AddrPreferenceIPv6Only:
+		removeAddrs(resp, dns.TypeA)
+	default:
+		return
+	}
+
+	log.Debug("dnsproxy: address preference %s applied", pref)
+}
+
+// suppressAddrs removes the records of type drop from the response in dctx to
+// the request for drop if the requested name has records of type want.
+func (p *Proxy) suppressAddrs(dctx *DNSContext, drop, want uint16) {
+	if dctx.Req.Question[0].Qtype != drop || !hasRRType(dctx.Res.Answer, drop) {
+		return
+	}
+
+	req := dctx.Req.Copy()
+	req.Id = dns.Id()
+	req.Question[0].Qtype = want
+
+	d := &DNSContext{
+		Req:                  req,
+		Addr:                 dctx.Addr,
+		CustomUpstreamConfig: dctx.CustomUpstreamConfig,
+	}
+
+	upstreams, group, _ := p.selectUpstreams(d)
+	if len(upstreams) == 0 {
+		return
+	}
+
+	resp, _, _, err := p.exchangeRouted(req, upstreams, group)
+	if err != nil {
+		log.Debug("dnsproxy: address preference: checking %s: %s", dns.Type(want), err)
+
+		return
+	}
+
+	if hasRRType(resp.Answer, want) {
+		removeAddrs(dctx.Res, drop)
+	}
+}
+
+// hasRRType returns true if rrs contain a record of type rrType.
+func hasRRType(rrs []dns.RR, rrType uint16) (ok bool) {
+	return slices.ContainsFunc(rrs, func(rr dns.RR) (has bool) {
+		return rr.Header().Rrtype == rrType
+	})
+}
+
+// removeAddrs removes the records of type rrType from the answer and
+// additional sections of resp.
+func removeAddrs(resp *dns.Msg, rrType uint16) {
+	isType := func(rr dns.RR) (ok bool) { return rr.Header().Rrtype == rrType }
+
+	resp.Answer = slices.DeleteFunc(resp.Answer, isType)
+	resp.Extra = slices.DeleteFunc(resp.Extra, isType)
+}
+
+// sortAddrs moves the records of type first before the other address records
+// in the answer section of resp.  The other records, such as CNAME, are put
+// before all address records, keeping their relative order.
+func sortAddrs(resp *dns.Msg, first uint16) {
+	slices.SortStableFunc(resp.Answer, func(a, b dns.RR) (res int) {
+		return addrRank(a, first) - addrRank(b, first)
+	})
+}
+
+// addrRank returns the rank of rr for sorting the address records: 0 for the
+// non-address records, 1 for the records of type first, and 2 for the other
+// address records.
+func addrRank(rr dns.RR, first uint16) (rank int) {
+	switch rr.Header().Rrtype {
+	case first:
+		return 1
+	case dns.TypeA, dns.TypeAAAA:
+		return 2
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAddrPreference(t *testing.T) {
+	for pref := AddrPreferenceDefault; pref <= AddrPreferenceIPv6Only; pref++ {
+		got, err := ParseAddrPreference(pref.String())
+		require.NoError(t, err)
+
+		assert.Equal(t, pref, got)
+	}
+
+	_, err := ParseAddrPreference("bad")
+	assert.Error(t, err)
+}
+
+func TestProxy_Resolve_addrPreference(t *testing.T) {
+	const host = "dual.example."
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(m)
+			hdr := func(rrType uint16) (h dns.RR_Header) {
+				return dns.RR_Header{Name: host, Rrtype: rrType, Class: dns.ClassINET, Ttl: 60}
+			}
+
+			a := &dns.A{Hdr: hdr(dns.TypeA), A: net.IP{192, 0, 2, 1}}
+			aaaa := &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: net.ParseIP("2001:db8::1")}
+
+			switch m.Question[0].Qtype {
+			case dns.TypeA:
+				resp.Answer = []dns.RR{a}
+			case dns.TypeAAAA:
+				resp.Answer = []dns.RR{aaaa}
+			case dns.TypeANY:
+				resp.Answer = []dns.RR{aaaa, a}
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+		AddrPreferences: []*AddrClientPreference{{
+			Subnet:     netip.MustParsePrefix("192.0.2.0/24"),
+			Preference: AddrPreferenceIPv4,
+		}, {
+			Subnet:     netip.MustParsePrefix("192.0.2.128/25"),
+			Preference: AddrPreferenceIPv6Only,
+		}},
+	})
+
+	testCases := []struct {
+		client string
+		name   string
+		want   []uint16
+		qtype  uint16
+	}{{
+		client: "198.51.100.1:53",
+		name:   "default",
+		want:   []uint16{dns.TypeAAAA},
+		qtype:  dns.TypeAAAA,
+	}, {
+		client: "192.0.2.1:53",
+		name:   "prefer_ipv4_aaaa",
+		want:   []uint16{},
+		qtype:  dns.TypeAAAA,
+	}, {
+		client: "192.0.2.1:53",
+		name:   "prefer_ipv4_a",
+		want:   []uint16{dns.TypeA},
+		qtype:  dns.TypeA,
+	}, {
+		client: "192.0.2.1:53",
+		name:   "prefer_ipv4_any",
+		want:   []uint16{dns.TypeA, dns.TypeAAAA},
+		qtype:  dns.TypeANY,
+	}, {
+		client: "192.0.2.200:53",
+		name:   "ipv6_only_any",
+		want:   []uint16{dns.TypeAAAA},
+		qtype:  dns.TypeANY,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion(host, tc.qtype),
+				Addr: netip.MustParseAddrPort(tc.client),
+			}
+
+			require.NoError(t, p.Resolve(dctx))
+			require.NotNil(t, dctx.Res)
+
+			got := []uint16{}
+			for _, rr := range dctx.Res.Answer {
+				got = append(got, rr.Header().Rrtype)
+			}
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+	"golang.org/x/exp/rand"
+)
+
+// AddrShuffle defines how the order of the A and AAAA records in responses is
+// changed, so that the clients always using the first record spread the load
+// across the addresses.
+type AddrShuffle uint8
+
+const (
+	// AddrShuffleNone leaves the order of the records as is.
+	AddrShuffleNone AddrShuffle = iota
+
+	// AddrShuffleRoundRobin rotates the records by one position with each
+	// response.
+	AddrShuffleRoundRobin
+
+	// AddrShuffleRandom shuffles the records randomly.
+	AddrShuffleRandom
+)
+
+// String implements the [fmt.Stringer] interface for AddrShuffle.
+func (s AddrShuffle) String() (str string) {
+	switch s {
+	case AddrShuffleNone:
+		return "none"
+	case AddrShuffleRoundRobin:
+		return "round-robin"
+	case AddrShuffleRandom:
+		return "random"
+	default:
+		return fmt.Sprintf("!bad_addr_shuffle_%d", uint8(s))
+	}
+}
+
+// ParseAddrShuffle parses the address shuffling mode from its string
+// representation as returned by [AddrShuffle.String].
+func ParseAddrShuffle(str string) (s AddrShuffle, err error) {
+	for s = AddrShuffleNone; s <= AddrShuffleRandom; s++ {
+		if s.String() == str {
+			return s, nil
+		}
+	}
+
+	return AddrShuffleNone, fmt.Errorf("unknown address shuffle %q", str)
+}
+
+// shuffleAddrs changes the order of the address records in the successful
+// response in dctx according to [Config.AddrShuffle].  The records of each
+// type are only reordered within the positions they already take, so the
+// order of the types and the positions of the other records are kept.
+func (p *Proxy) shuffleAddrs(dctx *DNSContext) {
+	resp := dctx.Res
+	if p.AddrShuffle == AddrShuffleNone || resp == nil || resp.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	var shift uint64
+	if p.AddrShuffle == AddrShuffleRoundRobin {
+		shift = p.addrShuffleCounter.Add(1)
+	}
+
+	for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var idxs []int
+		var rrs []dns.RR
+		for i, rr := range resp.Answer {
+			if rr.Header().Rrtype == rrType {
+				idxs = append(idxs, i)
+				rrs = append(rrs, rr)
+			}
+		}
+
+		if len(rrs) < 2 {
+			continue
+		}
+
+		if p.AddrShuffle == AddrShuffleRandom {
+			rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+		} else {
+			k := int(shift % uint64(len(rrs)))
+			rrs = append(rrs[k:], rrs[:k]...)
+		}
+
+		for i, idx := range idxs {
+			resp.Answer[idx] = rrs[i]
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newShuffleResp returns a response to an A request for name with a CNAME
+// record followed by the A records with ips.
+func newShuffleResp(t *testing.T, ips ...net.IP) (resp *dns.Msg) {
+	t.Helper()
+
+	const name = "example.org."
+
+	req := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Answer = append(resp.Answer, newRR(t, name, dns.TypeCNAME, 10, "cdn.example.org."))
+	for _, ip := range ips {
+		resp.Answer = append(resp.Answer, newRR(t, "cdn.example.org.", dns.TypeA, 10, ip))
+	}
+
+	return resp
+}
+
+// answerIPs returns the addresses of the A records in the answer section of
+// resp.
+func answerIPs(resp *dns.Msg) (ips []net.IP) {
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ips = append(ips, a.A)
+		}
+	}
+
+	return ips
+}
+
+func TestProxy_shuffleAddrs(t *testing.T) {
+	ip1, ip2, ip3 := net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}, net.IP{192, 0, 2, 3}
+
+	t.Run("none", func(t *testing.T) {
+		p := &Proxy{}
+		dctx := &DNSContext{Res: newShuffleResp(t, ip1, ip2, ip3)}
+		p.shuffleAddrs(dctx)
+
+		assert.Equal(t, []net.IP{ip1, ip2, ip3}, answerIPs(dctx.Res))
+	})
+
+	t.Run("round_robin", func(t *testing.T) {
+		p := &Proxy{Config: Config{AddrShuffle: AddrShuffleRoundRobin}}
+
+		var firsts []net.IP
+		for range 3 {
+			dctx := &DNSContext{Res: newShuffleResp(t, ip1, ip2, ip3)}
+			p.shuffleAddrs(dctx)
+
+			// The CNAME record must stay in place.
+			require.IsType(t, (*dns.CNAME)(nil), dctx.Res.Answer[0])
+			firsts = append(firsts, answerIPs(dctx.Res)[0])
+		}
+
+		assert.Equal(t, []net.IP{ip2, ip3, ip1}, firsts)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		p := &Proxy{Config: Config{AddrShuffle: AddrShuffleRandom}}
+		dctx := &DNSContext{Res: newShuffleResp(t, ip1, ip2, ip3)}
+		p.shuffleAddrs(dctx)
+
+		require.IsType(t, (*dns.CNAME)(nil), dctx.Res.Answer[0])
+		assert.ElementsMatch(t, []net.IP{ip1, ip2, ip3}, answerIPs(dctx.Res))
+	})
+}
+
+func TestParseAddrShuffle(t *testing.T) {
+	for s := AddrShuffleNone; s <= AddrShuffleRandom; s++ {
+		parsed, err := ParseAddrShuffle(s.String())
+		require.NoError(t, err)
+
+		assert.Equal(t, s, parsed)
+	}
+
+	_, err := ParseAddrShuffle("bad")
+	assert.Error(t, err)
+}
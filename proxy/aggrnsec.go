@@ -0,0 +1,665 @@
+package proxy
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// nsecCacheMaxRecords is the maximum number of NSEC and NSEC3 records
+	// stored at once, so that the responses for the random names don't make
+	// the cache take too much memory.
+	nsecCacheMaxRecords = 10_000
+
+	// nsec3MaxIterations is the maximum number of the additional NSEC3 hash
+	// iterations of the used records.  The zones using more are treated as if
+	// they had no NSEC3 records at all, see RFC 9276.
+	nsec3MaxIterations = 100
+)
+
+// nsecRecord is a cached NSEC or NSEC3 record.
+type nsecRecord struct {
+	// expire is the time after which the record can't be used.
+	expire time.Time
+
+	// owner is the key of the owner name of the record, which is the lowercased
+	// owner name for NSEC and the hash of it for NSEC3.
+	owner string
+
+	// next is the key of the next name of the record, in the same form as
+	// owner.
+	next string
+
+	// rrs are the record itself and its signatures.
+	rrs []dns.RR
+
+	// types are the types existing at the owner name.
+	types []uint16
+
+	// optOut is true if the NSEC3 record has the Opt-Out flag set, so that
+	// it doesn't prove the nonexistence of the names it covers.
+	optOut bool
+}
+
+// isCut returns true if the owner name of r is a delegation point or has a
+// DNAME record, so that r can't prove anything about the names below it.
+func (r *nsecRecord) isCut() (ok bool) {
+	hasNS := slices.Contains(r.types, dns.TypeNS)
+	hasSOA := slices.Contains(r.types, dns.TypeSOA)
+
+	return (hasNS && !hasSOA) || slices.Contains(r.types, dns.TypeDNAME)
+}
+
+// nsecChain is a set of the cached NSEC or NSEC3 records of a zone sorted by
+// their owner keys.
+type nsecChain struct {
+	// compare compares the keys of the records.
+	compare func(a, b string) (res int)
+
+	// records are the records sorted by owner.
+	records []*nsecRecord
+}
+
+// set adds r to c, replacing the one with the same owner, if any.  It returns
+// true if r is added and not replaced.
+func (c *nsecChain) set(r *nsecRecord) (added bool) {
+	i, ok := slices.BinarySearchFunc(c.records, r.owner, c.compareOwner)
+	if ok {
+		c.records[i] = r
+
+		return false
+	}
+
+	c.records = slices.Insert(c.records, i, r)
+
+	return true
+}
+
+// compareOwner compares the owner of r with key.
+func (c *nsecChain) compareOwner(r *nsecRecord, key string) (res int) {
+	return c.compare(r.owner, key)
+}
+
+// find returns the unexpired record matching key or covering it.  match is
+// true if the owner of r is key.  r is nil if there is no such record.
+func (c *nsecChain) find(key string, now time.Time) (r *nsecRecord, match bool) {
+	if key == "" || len(c.records) == 0 {
+		return nil, false
+	}
+
+	i, match := slices.BinarySearchFunc(c.records, key, c.compareOwner)
+	if !match {
+		// The record preceding key, or the last one, which covers the names
+		// after it up to the first one.
+		i = (i - 1 + len(c.records)) % len(c.records)
+	}
+
+	r = c.records[i]
+	if !now.Before(r.expire) {
+		return nil, false
+	}
+
+	if match || c.covers(r, key) {
+		return r, match
+	}
+
+	return nil, false
+}
+
+// covers returns true if key is strictly between the owner and the next keys
+// of r, taking into account that the last record of a zone wraps around to its
+// first one.
+func (c *nsecChain) covers(r *nsecRecord, key string) (ok bool) {
+	if c.compare(r.owner, r.next) < 0 {
+		return c.compare(r.owner, key) < 0 && c.compare(key, r.next) < 0
+	}
+
+	return c.compare(r.owner, key) < 0 || c.compare(key, r.next) < 0
+}
+
+// removeExpired removes the expired records from c and returns their number.
+func (c *nsecChain) removeExpired(now time.Time) (n int) {
+	l := len(c.records)
+	c.records = slices.DeleteFunc(c.records, func(r *nsecRecord) (ok bool) {
+		return !now.Before(r.expire)
+	})
+
+	return l - len(c.records)
+}
+
+// nsec3Params are the hashing parameters of the NSEC3 records of a zone.
+type nsec3Params struct {
+	salt       string
+	iterations uint16
+	hash       uint8
+}
+
+// hashName returns the NSEC3 hash of name.
+func (p nsec3Params) hashName(name string) (hash string) {
+	return dns.HashName(name, p.hash, p.iterations, p.salt)
+}
+
+// nsecZone is the cached negative data of a signed zone.
+type nsecZone struct {
+	// soaExpire is the time after which soa can't be used.
+	soaExpire time.Time
+
+	// soa are the SOA record of the zone and its signatures.
+	soa []dns.RR
+
+	// nsec are the NSEC records of the zone.
+	nsec *nsecChain
+
+	// nsec3 are the NSEC3 records of the zone hashed with nsec3Params.
+	nsec3 *nsecChain
+
+	// nsec3Params are the hashing parameters of nsec3.
+	nsec3Params nsec3Params
+}
+
+// newNSECZone returns a new empty *nsecZone.
+func newNSECZone() (z *nsecZone) {
+	return &nsecZone{
+		nsec:  &nsecChain{compare: compareCanonical},
+		nsec3: &nsecChain{compare: strings.Compare},
+	}
+}
+
+// nsecCache stores the NSEC and NSEC3 records of the negative responses
+// validated by the proxy and uses them to synthesize the NXDOMAIN responses for the names
+// they prove nonexistent, see RFC 8198.  It's safe for concurrent use.
+type nsecCache struct {
+	// mu protects zones and size.
+	mu *sync.Mutex
+
+	// zones are the cached zones by their lowercased apex names.
+	zones map[string]*nsecZone
+
+	// size is the number of the stored NSEC and NSEC3 records.
+	size int
+}
+
+// newNSECCache returns a new properly initialized *nsecCache.
+func newNSECCache() (c *nsecCache) {
+	return &nsecCache{
+		mu:    &sync.Mutex{},
+		zones: map[string]*nsecZone{},
+	}
+}
+
+// set stores the NSEC and NSEC3 records of m, if it's a validated NXDOMAIN or
+// NODATA response.
+func (c *nsecCache) set(m *dns.Msg, now time.Time) {
+	if !m.AuthenticatedData || len(m.Answer) > 0 {
+		return
+	} else if m.Rcode != dns.RcodeNameError && m.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	soa := findSOA(m.Ns)
+	if soa == nil {
+		return
+	}
+
+	zone := strings.ToLower(soa.Hdr.Name)
+	soaSigs := findSigs(m.Ns, zone, zone, dns.TypeSOA)
+	if len(soaSigs) == 0 {
+		return
+	}
+
+	ttl := min(soa.Hdr.Ttl, soa.Minttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	z := c.zones[zone]
+	if z == nil {
+		z = newNSECZone()
+		c.zones[zone] = z
+	}
+
+	// Copy the records, since the response may be modified afterwards.
+	z.soa = appendWithTTL(nil, append([]dns.RR{soa}, soaSigs...), soa.Hdr.Ttl)
+	z.soaExpire = now.Add(time.Duration(ttl) * time.Second)
+
+	c.setRecords(z, m.Ns, zone, ttl, now)
+}
+
+// setRecords stores the NSEC and NSEC3 records from rrs signed by the zone with
+// the apex name zone into z.  The records expire after ttl seconds, unless
+// their own TTLs are shorter.  c.mu must be locked.
+func (c *nsecCache) setRecords(z *nsecZone, rrs []dns.RR, zone string, ttl uint32, now time.Time) {
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype != dns.TypeNSEC && hdr.Rrtype != dns.TypeNSEC3 {
+			continue
+		}
+
+		// The records not signed by the zone can't be used to prove anything
+		// in it.
+		sigs := findSigs(rrs, hdr.Name, zone, hdr.Rrtype)
+		if len(sigs) == 0 {
+			continue
+		}
+
+		var r *nsecRecord
+		var chain *nsecChain
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			r, chain = newNSECRecord(rr, zone), z.nsec
+		case *dns.NSEC3:
+			r, chain = c.newNSEC3Record(z, rr, zone), z.nsec3
+		}
+
+		if r == nil || !c.reserve(now) {
+			continue
+		}
+
+		r.rrs = appendWithTTL(nil, append([]dns.RR{rr}, sigs...), hdr.Ttl)
+		r.expire = now.Add(time.Duration(min(hdr.Ttl, ttl)) * time.Second)
+		if chain.set(r) {
+			c.size++
+		}
+	}
+}
+
+// newNSECRecord returns a new *nsecRecord for rr from zone or nil if rr can't
+// be used.
+func newNSECRecord(rr *dns.NSEC, zone string) (r *nsecRecord) {
+	owner := strings.ToLower(rr.Hdr.Name)
+	if !dns.IsSubDomain(zone, owner) {
+		return nil
+	}
+
+	return &nsecRecord{
+		owner: owner,
+		next:  strings.ToLower(rr.NextDomain),
+		types: rr.TypeBitMap,
+	}
+}
+
+// newNSEC3Record returns a new *nsecRecord for rr from z with the apex name
+// zone or nil if rr can't be used.  The NSEC3 records of z are reset if rr uses
+// other parameters.  c.mu must be locked.
+func (c *nsecCache) newNSEC3Record(z *nsecZone, rr *dns.NSEC3, zone string) (r *nsecRecord) {
+	if rr.Hash != dns.SHA1 || rr.Iterations > nsec3MaxIterations {
+		return nil
+	}
+
+	hash, parent, ok := strings.Cut(rr.Hdr.Name, ".")
+	if !ok || !strings.EqualFold(dns.Fqdn(parent), zone) {
+		return nil
+	}
+
+	params := nsec3Params{
+		salt:       strings.ToUpper(rr.Salt),
+		iterations: rr.Iterations,
+		hash:       rr.Hash,
+	}
+	if params != z.nsec3Params {
+		// The zone has been re-salted, so the records hashed with the
+		// previous parameters can't be compared with the new ones.
+		c.size -= len(z.nsec3.records)
+		z.nsec3.records = nil
+		z.nsec3Params = params
+	}
+
+	return &nsecRecord{
+		owner:  strings.ToUpper(hash),
+		next:   strings.ToUpper(rr.NextDomain),
+		types:  rr.TypeBitMap,
+		optOut: rr.Flags&1 != 0,
+	}
+}
+
+// reserve returns true if there is space for another record, removing the
+// expired ones if needed.  c.mu must be locked.
+func (c *nsecCache) reserve(now time.Time) (ok bool) {
+	if c.size < nsecCacheMaxRecords {
+		return true
+	}
+
+	for name, z := range c.zones {
+		c.size -= z.nsec.removeExpired(now) + z.nsec3.removeExpired(now)
+		if len(z.nsec.records) == 0 && len(z.nsec3.records) == 0 && !now.Before(z.soaExpire) {
+			delete(c.zones, name)
+		}
+	}
+
+	return c.size < nsecCacheMaxRecords
+}
+
+// clear removes all the records from c.
+func (c *nsecCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.zones = map[string]*nsecZone{}
+	c.size = 0
+}
+
+// get returns the NXDOMAIN response to req synthesized from the cached records
+// or nil if the nonexistence of the requested name can't be proven.
+func (c *nsecCache) get(req *dns.Msg, now time.Time) (resp *dns.Msg) {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	name := strings.ToLower(dns.Fqdn(q.Name))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	zone, z := c.findZone(name, now)
+	if z == nil || zone == name {
+		return nil
+	}
+
+	proof := z.nsecProof(name, now)
+	if proof == nil {
+		proof = z.nsec3Proof(name, zone, now)
+	}
+
+	if proof == nil {
+		return nil
+	}
+
+	// The TTL of the synthesized response must not exceed the remaining TTL of
+	// any of the records it's synthesized from, see RFC 8198 Section 5.4.
+	expire := z.soaExpire
+	for _, r := range proof {
+		if r.expire.Before(expire) {
+			expire = r.expire
+		}
+	}
+
+	ttl := uint32(expire.Sub(now) / time.Second)
+	if ttl == 0 {
+		return nil
+	}
+
+	resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+	resp.RecursionAvailable = true
+	resp.AuthenticatedData = true
+
+	resp.Ns = appendWithTTL(resp.Ns, z.soa, ttl)
+	for _, r := range proof {
+		resp.Ns = appendWithTTL(resp.Ns, r.rrs, ttl)
+	}
+
+	return resp
+}
+
+// findZone returns the deepest unexpired cached zone containing name, if any.
+// c.mu must be locked.
+func (c *nsecCache) findZone(name string, now time.Time) (zone string, z *nsecZone) {
+	for _, off := range append(dns.Split(name), len(name)-1) {
+		zone = name[off:]
+		if z = c.zones[zone]; z != nil {
+			break
+		}
+	}
+
+	if z == nil || !now.Before(z.soaExpire) {
+		return "", nil
+	}
+
+	return zone, z
+}
+
+// nsecProof returns the NSEC records proving that name doesn't exist in z or
+// nil if there are none cached, see RFC 4035 Section 5.4.
+func (z *nsecZone) nsecProof(name string, now time.Time) (proof []*nsecRecord) {
+	r := z.nsecDenial(name, now)
+	if r == nil {
+		return nil
+	}
+
+	// The closest encloser is the longest of the common ancestors of the name
+	// with the names of the covering record.
+	n := max(dns.CompareDomainName(name, r.owner), dns.CompareDomainName(name, r.next))
+	wildcard := "*." + ancestor(name, n)
+	if wildcard == "*.." {
+		wildcard = "*."
+	}
+
+	w, match := z.nsec.find(wildcard, now)
+	if w == nil || match || !z.provesNSEC(w, wildcard) {
+		return nil
+	}
+
+	if w == r {
+		return []*nsecRecord{r}
+	}
+
+	return []*nsecRecord{r, w}
+}
+
+// nsecDenial returns the NSEC record proving that no names at or below name
+// exist in z, regardless of the wildcards, or nil if there is none cached.
+func (z *nsecZone) nsecDenial(name string, now time.Time) (r *nsecRecord) {
+	r, match := z.nsec.find(name, now)
+	if r == nil || match || !z.provesNSEC(r, name) {
+		return nil
+	} else if dns.IsSubDomain(name, r.next) {
+		// The name is an empty non-terminal.
+		return nil
+	}
+
+	return r
+}
+
+// provesNSEC returns true if the NSEC record r covering name can be used to
+// prove its nonexistence.
+func (z *nsecZone) provesNSEC(r *nsecRecord, name string) (ok bool) {
+	return !dns.IsSubDomain(r.owner, name) || !r.isCut()
+}
+
+// nsec3Proof returns the NSEC3 records proving that name doesn't exist in z
+// with the apex name zone or nil if there are none cached, see RFC 5155
+// Section 8.4.
+func (z *nsecZone) nsec3Proof(name, zone string, now time.Time) (proof []*nsecRecord) {
+	if len(z.nsec3.records) == 0 {
+		return nil
+	}
+
+	nextCloser := name
+	for _, off := range append(dns.Split(name), len(name)-1)[1:] {
+		encloser := name[off:]
+		ce, match := z.nsec3.find(z.nsec3Params.hashName(encloser), now)
+		if ce != nil && match {
+			if encloser != zone && ce.isCut() {
+				return nil
+			}
+
+			return z.nsec3ProofFor(ce, encloser, nextCloser, now)
+		}
+
+		if encloser == zone {
+			break
+		}
+
+		nextCloser = encloser
+	}
+
+	return nil
+}
+
+// nsec3ProofFor returns the NSEC3 records proving the nonexistence of
+// nextCloser and the wildcard at the closest encloser, given the record ce
+// matching the closest encloser.
+func (z *nsecZone) nsec3ProofFor(
+	ce *nsecRecord,
+	encloser string,
+	nextCloser string,
+	now time.Time,
+) (proof []*nsecRecord) {
+	nc := z.nsec3Denial(nextCloser, now)
+	if nc == nil || nc.optOut {
+		return nil
+	}
+
+	w, match := z.nsec3.find(z.nsec3Params.hashName("*."+encloser), now)
+	if w == nil || match {
+		return nil
+	}
+
+	proof = []*nsecRecord{ce, nc}
+	if !slices.Contains(proof, w) {
+		proof = append(proof, w)
+	}
+
+	return proof
+}
+
+// nsec3Denial returns the NSEC3 record covering the hash of name, which proves
+// that no names at or below name exist in z, unless it has the Opt-Out flag
+// set, or nil if there is none cached.
+func (z *nsecZone) nsec3Denial(name string, now time.Time) (r *nsecRecord) {
+	if len(z.nsec3.records) == 0 {
+		return nil
+	}
+
+	r, match := z.nsec3.find(z.nsec3Params.hashName(name), now)
+	if match {
+		return nil
+	}
+
+	return r
+}
+
+// matchTypes returns the types existing at name according to the NSEC or NSEC3
+// record of z matching it.  match is false if there is no such record, in which
+// case optOut is true if the NSEC3 record covering name has the Opt-Out flag
+// set.
+func (z *nsecZone) matchTypes(name string, now time.Time) (types []uint16, match, optOut bool) {
+	if r, ok := z.nsec.find(name, now); r != nil && ok {
+		return r.types, true, false
+	} else if len(z.nsec3.records) == 0 {
+		return nil, false, false
+	}
+
+	r, ok := z.nsec3.find(z.nsec3Params.hashName(name), now)
+	if r == nil {
+		return nil, false, false
+	} else if ok {
+		return r.types, true, false
+	}
+
+	return nil, false, r.optOut
+}
+
+// provesNoData returns true if the records of z prove that name exists but has
+// no records of qtype, see RFC 4035 Section 5.4 and RFC 5155 Section 8.5.
+func (z *nsecZone) provesNoData(name string, qtype uint16, now time.Time) (ok bool) {
+	types, match, _ := z.matchTypes(name, now)
+	if match {
+		return !slices.Contains(types, qtype) && !slices.Contains(types, dns.TypeCNAME)
+	}
+
+	// The NSEC record covering an empty non-terminal precedes its descendants.
+	r, _ := z.nsec.find(name, now)
+
+	return r != nil && dns.IsSubDomain(name, r.next)
+}
+
+// findSOA returns the first SOA record from rrs, if any.
+func findSOA(rrs []dns.RR) (soa *dns.SOA) {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+
+	return nil
+}
+
+// findSigs returns the signatures from rrs covering the records of typ with
+// name and signed by the zone with the apex name signer.
+func findSigs(rrs []dns.RR, name, signer string, typ uint16) (sigs []dns.RR) {
+	for _, rr := range rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if ok &&
+			sig.TypeCovered == typ &&
+			strings.EqualFold(sig.Hdr.Name, name) &&
+			strings.EqualFold(sig.SignerName, signer) {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	return sigs
+}
+
+// appendWithTTL appends the copies of rrs with the TTL set to ttl to dst.
+func appendWithTTL(dst, rrs []dns.RR, ttl uint32) (res []dns.RR) {
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = ttl
+		dst = append(dst, rr)
+	}
+
+	return dst
+}
+
+// ancestor returns the ancestor of name consisting of its last n labels.
+func ancestor(name string, n int) (a string) {
+	offs := dns.Split(name)
+	if n <= 0 || len(offs) == 0 {
+		return "."
+	}
+
+	return name[offs[max(len(offs)-n, 0)]:]
+}
+
+// compareCanonical compares the lowercased names a and b in the canonical DNS
+// name order, see RFC 4034 Section 6.1.
+func compareCanonical(a, b string) (res int) {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i := 1; i <= min(len(la), len(lb)); i++ {
+		res = strings.Compare(la[len(la)-i], lb[len(lb)-i])
+		if res != 0 {
+			return res
+		}
+	}
+
+	return cmp.Compare(len(la), len(lb))
+}
+
+// replyFromNSEC tries to synthesize the NXDOMAIN response to the request in d
+// from the cached NSEC and NSEC3 records.  It returns true on success.
+func (p *Proxy) replyFromNSEC(d *DNSContext) (ok bool) {
+	if p.nsecCache == nil || d.CustomUpstreamConfig != nil {
+		return false
+	}
+
+	resp := p.nsecCache.get(d.Req, p.time.Now())
+	if resp == nil {
+		return false
+	}
+
+	filterMsg(resp, resp, d.adBit, d.doBit, 0)
+
+	d.Res = resp
+	d.Provenance = Provenance{Source: SourceCache}
+
+	log.Debug("dnsproxy: cache: synthesized nxdomain from nsec records")
+
+	return true
+}
+
+// cacheNSEC stores the NSEC and NSEC3 records of the response in d for
+// synthesizing the NXDOMAIN responses, if it's validated as secure by p.
+func (p *Proxy) cacheNSEC(d *DNSContext) {
+	if p.nsecCache == nil || d.CustomUpstreamConfig != nil || !d.dnssecSecure {
+		return
+	}
+
+	p.nsecCache.set(d.Res, p.time.Now())
+}
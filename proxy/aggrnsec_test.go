@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSigned returns rr along with a fake signature of it by the zone
+// example.
+func newTestSigned(rr dns.RR) (rrs []dns.RR) {
+	hdr := rr.Header()
+
+	return []dns.RR{rr, &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   hdr.Name,
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+			Ttl:    hdr.Ttl,
+		},
+		TypeCovered: hdr.Rrtype,
+		SignerName:  "example.",
+	}}
+}
+
+// newTestSOA returns the signed SOA record of the zone example.
+func newTestSOA() (rrs []dns.RR) {
+	return newTestSigned(&dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   "example.",
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Ns:     "ns.example.",
+		Mbox:   "hostmaster.example.",
+		Minttl: 300,
+	})
+}
+
+// newTestNSEC returns the signed NSEC record of the zone example.
+func newTestNSEC(owner, next string, types ...uint16) (rrs []dns.RR) {
+	return newTestSigned(&dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   owner,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		NextDomain: next,
+		TypeBitMap: types,
+	})
+}
+
+func TestProxy_Resolve_aggressiveNSEC(t *testing.T) {
+	signer := newTestZoneSigner(t)
+
+	// The zone example contains the names example, a.example, and the
+	// delegation m.example.
+	nsecs := map[string][]dns.RR{
+		"example.":   signer.sign(t, newTestNSEC("example.", "a.example.", dns.TypeNS, dns.TypeSOA)[0]),
+		"a.example.": signer.sign(t, newTestNSEC("a.example.", "m.example.", dns.TypeA)[0]),
+		"m.example.": signer.sign(t, newTestNSEC("m.example.", "example.", dns.TypeNS, dns.TypeDS)[0]),
+	}
+
+	// exchanges is the number of the A requests, excluding the ones made by
+	// the validator.
+	var exchanges int
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			q := req.Question[0]
+			if q.Qtype == dns.TypeDNSKEY {
+				resp = (&dns.Msg{}).SetReply(req)
+				resp.Answer = signer.sign(t, dns.Copy(signer.key))
+
+				return resp, nil
+			}
+
+			if q.Qtype == dns.TypeA {
+				exchanges++
+			}
+
+			// The upstream claims the responses validated in any case.
+			resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+			resp.AuthenticatedData = true
+			resp.Ns = signer.sign(t, newTestSOA()[0])
+
+			if q.Name > "m.example." {
+				resp.Ns = append(resp.Ns, nsecs["m.example."]...)
+			} else {
+				resp.Ns = append(resp.Ns, nsecs["a.example."]...)
+			}
+
+			resp.Ns = append(resp.Ns, nsecs["example."]...)
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	newProxy := func(t *testing.T, validate bool) (p *Proxy) {
+		t.Helper()
+
+		exchanges = 0
+
+		return mustNew(t, &Config{
+			UDPListenAddr:              []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:             &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies:             defaultTrustedProxies,
+			CacheEnabled:               true,
+			CacheAggressiveNSEC:        true,
+			DNSSECValidate:             validate,
+			DNSSECTrustAnchors:         []*dns.DS{signer.key.ToDS(dns.SHA256)},
+			DNSSECNegativeTrustAnchors: []string{"nta.example"},
+		})
+	}
+
+	resolve := func(t *testing.T, p *Proxy, name string) (dctx *DNSContext) {
+		t.Helper()
+
+		dctx = &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion(name, dns.TypeA),
+			Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+
+		assert.Equal(t, dns.RcodeNameError, dctx.Res.Rcode)
+
+		return dctx
+	}
+
+	t.Run("validated", func(t *testing.T) {
+		p := newProxy(t, true)
+
+		resolve(t, p, "b.example.")
+		require.Equal(t, 1, exchanges)
+
+		// The names covered by the cached records are answered without the
+		// upstream.
+		dctx := resolve(t, p, "c.example.")
+		assert.Equal(t, 1, exchanges)
+		assert.Equal(t, SourceCache, dctx.Provenance.Source)
+
+		require.Len(t, dctx.Res.Ns, 1)
+
+		soa := testutil.RequireTypeAssert[*dns.SOA](t, dctx.Res.Ns[0])
+		assert.LessOrEqual(t, soa.Hdr.Ttl, uint32(300))
+
+		resolve(t, p, "y.example.")
+		assert.Equal(t, 2, exchanges)
+
+		// The last record of the chain covers the names after it.
+		resolve(t, p, "z.example.")
+		assert.Equal(t, 2, exchanges)
+
+		p.ClearCache()
+
+		resolve(t, p, "c.example.")
+		assert.Equal(t, 3, exchanges)
+	})
+
+	t.Run("not_validated", func(t *testing.T) {
+		p := newProxy(t, true)
+
+		// The validation is disabled for the names within the negative trust
+		// anchors, so the AD flag of the upstream isn't trusted.
+		resolve(t, p, "b.nta.example.")
+		require.Equal(t, 1, exchanges)
+
+		resolve(t, p, "c.nta.example.")
+		assert.Equal(t, 2, exchanges)
+	})
+
+	t.Run("no_validation", func(t *testing.T) {
+		p := newProxy(t, false)
+
+		resolve(t, p, "b.example.")
+		require.Equal(t, 1, exchanges)
+
+		resolve(t, p, "c.example.")
+		assert.Equal(t, 2, exchanges)
+	})
+}
+
+func TestNSECCache_delegation(t *testing.T) {
+	m := (&dns.Msg{}).SetRcode((&dns.Msg{}).SetQuestion("x.m.example.", dns.TypeA), dns.RcodeNameError)
+	m.AuthenticatedData = true
+	m.Ns = newTestSOA()
+	m.Ns = append(m.Ns, newTestNSEC("m.example.", "example.", dns.TypeNS, dns.TypeDS)...)
+
+	now := time.Now()
+	c := newNSECCache()
+	c.set(m, now)
+
+	// The names under the delegation aren't proven nonexistent by the records
+	// of the parent zone.
+	assert.Nil(t, c.get((&dns.Msg{}).SetQuestion("y.m.example.", dns.TypeA), now))
+}
+
+func TestNSECCache_nsec3(t *testing.T) {
+	const salt = "AABB"
+
+	// The zone example contains the names example and a.example.
+	hashes := []string{
+		dns.HashName("example.", dns.SHA1, 1, salt),
+		dns.HashName("a.example.", dns.SHA1, 1, salt),
+	}
+	slices.Sort(hashes)
+
+	newResp := func(optOut bool) (m *dns.Msg) {
+		m = (&dns.Msg{}).SetRcode((&dns.Msg{}).SetQuestion("b.example.", dns.TypeA), dns.RcodeNameError)
+		m.AuthenticatedData = true
+		m.Ns = newTestSOA()
+
+		for i, h := range hashes {
+			rr := &dns.NSEC3{
+				Hdr: dns.RR_Header{
+					Name:   h + ".example.",
+					Rrtype: dns.TypeNSEC3,
+					Class:  dns.ClassINET,
+					Ttl:    3600,
+				},
+				Hash:       dns.SHA1,
+				Iterations: 1,
+				SaltLength: uint8(len(salt) / 2),
+				Salt:       salt,
+				HashLength: 20,
+				NextDomain: hashes[(i+1)%len(hashes)],
+				TypeBitMap: []uint16{dns.TypeA},
+			}
+			if optOut {
+				rr.Flags = 1
+			}
+
+			m.Ns = append(m.Ns, newTestSigned(rr)...)
+		}
+
+		return m
+	}
+
+	now := time.Now()
+	req := (&dns.Msg{}).SetQuestion("c.example.", dns.TypeA)
+
+	t.Run("nxdomain", func(t *testing.T) {
+		c := newNSECCache()
+		c.set(newResp(false), now)
+
+		resp := c.get(req, now)
+		require.NotNil(t, resp)
+
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+		assert.True(t, resp.AuthenticatedData)
+
+		// The existing names aren't proven nonexistent.
+		assert.Nil(t, c.get((&dns.Msg{}).SetQuestion("a.example.", dns.TypeA), now))
+		assert.Nil(t, c.get((&dns.Msg{}).SetQuestion("example.", dns.TypeA), now))
+
+		// The records expire.
+		assert.Nil(t, c.get(req, now.Add(300*time.Second)))
+	})
+
+	t.Run("opt_out", func(t *testing.T) {
+		c := newNSECCache()
+		c.set(newResp(true), now)
+
+		assert.Nil(t, c.get(req, now))
+	})
+
+	t.Run("not_validated", func(t *testing.T) {
+		resp := newResp(false)
+		resp.AuthenticatedData = false
+
+		c := newNSECCache()
+		c.set(resp, now)
+
+		assert.Nil(t, c.get(req, now))
+	})
+}
+
+func TestCompareCanonical(t *testing.T) {
+	// The example from RFC 4034 Section 6.1.
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"z.a.example.",
+		"zabc.a.example.",
+		"z.example.",
+		"*.z.example.",
+	}
+
+	assert.True(t, slices.IsSortedFunc(names, compareCanonical))
+}
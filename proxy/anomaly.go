@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+const (
+	// anomalyBuckets is the number of the slices the anomaly window is split
+	// into, so that it slides with the granularity of a slice.
+	anomalyBuckets = 6
+
+	// anomalyMinRequests is the minimum number of the client's requests within
+	// the window to score it, so that a few failed requests don't make a
+	// client look anomalous.
+	anomalyMinRequests = 20
+
+	// anomalyMaxClients is the maximum number of the clients tracked at once,
+	// so that the requests from many addresses don't make the tracking take
+	// too much memory.
+	anomalyMaxClients = 10_000
+)
+
+// ClientAnomaly is the summary of a client's requests within the anomaly
+// window, see [Config.AnomalyWindow].
+type ClientAnomaly struct {
+	// QTypes are the numbers of the requests by their types.
+	QTypes map[string]uint64 `json:"qtypes"`
+
+	// Client is the client's address.
+	Client netip.Addr `json:"client"`
+
+	// Requests is the number of the client's requests.
+	Requests uint64 `json:"requests"`
+
+	// NXDomain is the number of the requests answered with NXDOMAIN.
+	NXDomain uint64 `json:"nxdomain"`
+
+	// NXDomainRatio is the share of the requests answered with NXDOMAIN, which
+	// is high for the malware generating the domain names algorithmically.
+	NXDomainRatio float64 `json:"nxdomain_ratio"`
+
+	// TunnelRatio is the share of the requests of the types typical for DNS
+	// tunneling, which are able to carry arbitrary data, like TXT and NULL.
+	TunnelRatio float64 `json:"tunnel_ratio"`
+
+	// Score is the anomaly score in the [0, 1] range, the larger of
+	// NXDomainRatio and TunnelRatio.  It's zero until the client has sent
+	// enough requests within the window.
+	Score float64 `json:"score"`
+}
+
+// anomalyBucket is the statistics of a client's requests within a slice of the
+// anomaly window.
+type anomalyBucket struct {
+	// qtypes are the numbers of the requests by their types.
+	qtypes map[uint16]uint64
+
+	// start is the start of the slice.
+	start time.Time
+
+	// requests is the number of the requests.
+	requests uint64
+
+	// nxdomain is the number of the requests answered with NXDOMAIN.
+	nxdomain uint64
+}
+
+// anomalyClient is the state of a single client.
+type anomalyClient struct {
+	// buckets are the statistics of the slices of the window, indexed by the
+	// slice number modulo [anomalyBuckets].
+	buckets [anomalyBuckets]anomalyBucket
+
+	// reported is true if the client has been reported since its score has
+	// reached the threshold last time.
+	reported bool
+}
+
+// anomalyDetector collects the per-client statistics of the requests over a
+// sliding window and scores them.  It's safe for concurrent use.
+type anomalyDetector struct {
+	// mu protects the states in clients.
+	mu *sync.Mutex
+
+	// clients are the states of the clients by their addresses.
+	clients *gocache.Cache
+
+	// onAnomaly is called when a client's score reaches threshold.  It may be
+	// nil.
+	onAnomaly func(a *ClientAnomaly)
+
+	// window is the length of the sliding window.
+	window time.Duration
+
+	// slice is the length of a single bucket.
+	slice time.Duration
+
+	// threshold is the score reaching which a client is reported.
+	threshold float64
+}
+
+// newAnomalyDetector returns a new properly initialized *anomalyDetector or nil
+// if the collection is disabled in c.
+func newAnomalyDetector(c *Config) (d *anomalyDetector) {
+	if c.AnomalyWindow <= 0 {
+		return nil
+	}
+
+	return &anomalyDetector{
+		mu:        &sync.Mutex{},
+		clients:   gocache.New(c.AnomalyWindow, c.AnomalyWindow),
+		onAnomaly: c.OnAnomaly,
+		window:    c.AnomalyWindow,
+		slice:     max(c.AnomalyWindow/anomalyBuckets, 1),
+		threshold: c.AnomalyThreshold,
+	}
+}
+
+// validateAnomaly returns an error if the anomaly detection settings of c are
+// invalid.
+func (c *Config) validateAnomaly() (err error) {
+	if c.AnomalyWindow < 0 {
+		return errors.Error("negative window")
+	}
+
+	if c.AnomalyThreshold < 0 || c.AnomalyThreshold > 1 {
+		return fmt.Errorf("threshold %v out of range [0, 1]", c.AnomalyThreshold)
+	}
+
+	return nil
+}
+
+// record counts the request of type qtype from client answered with rcode at
+// now.  It returns the summary of the client if its score has just reached the
+// threshold.
+func (d *anomalyDetector) record(
+	client netip.Addr,
+	qtype uint16,
+	rcode int,
+	now time.Time,
+) (reported *ClientAnomaly) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := client.String()
+	var c *anomalyClient
+	if v, ok := d.clients.Get(key); ok {
+		c = v.(*anomalyClient)
+	} else if d.clients.ItemCount() >= anomalyMaxClients {
+		return nil
+	} else {
+		c = &anomalyClient{}
+	}
+
+	// Refresh the expiration, so that the state is kept while the client is
+	// active.
+	d.clients.SetDefault(key, c)
+
+	start := now.Truncate(d.slice)
+	b := &c.buckets[(start.UnixNano()/int64(d.slice))%anomalyBuckets]
+	if !b.start.Equal(start) {
+		*b = anomalyBucket{qtypes: map[uint16]uint64{}, start: start}
+	}
+
+	b.requests++
+	b.qtypes[qtype]++
+	if rcode == dns.RcodeNameError {
+		b.nxdomain++
+	}
+
+	if d.threshold == 0 {
+		return nil
+	}
+
+	a := d.summarize(client, c, now)
+	switch {
+	case a.Score < d.threshold:
+		c.reported = false
+	case !c.reported:
+		c.reported = true
+
+		return a
+	}
+
+	return nil
+}
+
+// summarize returns the summary of the requests of c from client within the
+// window ending at now.  d.mu must be locked.
+func (d *anomalyDetector) summarize(
+	client netip.Addr,
+	c *anomalyClient,
+	now time.Time,
+) (a *ClientAnomaly) {
+	a = &ClientAnomaly{
+		QTypes: map[string]uint64{},
+		Client: client,
+	}
+
+	var tunnel uint64
+	windowStart := now.Add(-d.window)
+	for _, b := range c.buckets {
+		if !b.start.After(windowStart) {
+			continue
+		}
+
+		a.Requests += b.requests
+		a.NXDomain += b.nxdomain
+		for qt, n := range b.qtypes {
+			a.QTypes[dns.Type(qt).String()] += n
+			if isTunnelType(qt) {
+				tunnel += n
+			}
+		}
+	}
+
+	if a.Requests == 0 {
+		return a
+	}
+
+	a.NXDomainRatio = float64(a.NXDomain) / float64(a.Requests)
+	a.TunnelRatio = float64(tunnel) / float64(a.Requests)
+	if a.Requests >= anomalyMinRequests {
+		a.Score = max(a.NXDomainRatio, a.TunnelRatio)
+	}
+
+	return a
+}
+
+// list returns the summaries of all the tracked clients at now sorted by their
+// scores in descending order.
+func (d *anomalyDetector) list(now time.Time) (anomalies []*ClientAnomaly) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, item := range d.clients.Items() {
+		client, err := netip.ParseAddr(key)
+		if err != nil {
+			// Shouldn't happen, since the keys are the valid addresses.
+			panic(err)
+		}
+
+		a := d.summarize(client, item.Object.(*anomalyClient), now)
+		if a.Requests > 0 {
+			anomalies = append(anomalies, a)
+		}
+	}
+
+	slices.SortFunc(anomalies, func(a, b *ClientAnomaly) (res int) {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), a.Client.Compare(b.Client))
+	})
+
+	return anomalies
+}
+
+// isTunnelType returns true if qtype is typical for DNS tunneling, i.e. the
+// records of the type may carry arbitrary data, and the regular clients rarely
+// request them.  The private use types are included as well.
+func isTunnelType(qtype uint16) (ok bool) {
+	switch qtype {
+	case dns.TypeTXT, dns.TypeNULL, dns.TypeCNAME, dns.TypeMX, dns.TypeANY:
+		return true
+	default:
+		return qtype >= 0xff00 && qtype <= 0xfffe
+	}
+}
+
+// recordAnomaly counts the request of d in the per-client statistics, if those
+// are collected, and calls [Config.OnAnomaly] if the client's score has just
+// reached the threshold.  d.Req must have a single question.
+func (p *Proxy) recordAnomaly(d *DNSContext) {
+	if p.anomalies == nil || d.Res == nil {
+		return
+	}
+
+	client := d.Addr.Addr().Unmap()
+	a := p.anomalies.record(client, d.Req.Question[0].Qtype, d.Res.Rcode, p.time.Now())
+	if a != nil && p.anomalies.onAnomaly != nil {
+		p.anomalies.onAnomaly(a)
+	}
+}
+
+// Anomalies returns the summaries of the requests of the clients active within
+// the anomaly window sorted by their anomaly scores in descending order.  It
+// returns nil if the collection is disabled, see [Config.AnomalyWindow].
+func (p *Proxy) Anomalies() (anomalies []*ClientAnomaly) {
+	if p.anomalies == nil {
+		return nil
+	}
+
+	return p.anomalies.list(p.time.Now())
+}
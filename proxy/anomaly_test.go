@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	d := newAnomalyDetector(&Config{
+		AnomalyWindow:    time.Minute,
+		AnomalyThreshold: 0.5,
+	})
+	require.NotNil(t, d)
+
+	client := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+
+	// Mix the regular requests with the tunneling ones, so that the score
+	// reaches the threshold exactly with the last request.
+	for i := range anomalyMinRequests - 1 {
+		qtype := dns.TypeA
+		if i%2 == 1 {
+			qtype = dns.TypeTXT
+		}
+
+		assert.Nil(t, d.record(client, qtype, dns.RcodeSuccess, now))
+	}
+
+	a := d.record(client, dns.TypeTXT, dns.RcodeSuccess, now)
+	require.NotNil(t, a)
+
+	assert.Equal(t, client, a.Client)
+	assert.Equal(t, uint64(anomalyMinRequests), a.Requests)
+	assert.Equal(t, map[string]uint64{"A": 10, "TXT": 10}, a.QTypes)
+	assert.Equal(t, 0.5, a.TunnelRatio)
+	assert.Equal(t, 0.5, a.Score)
+
+	// The client isn't reported again until the score drops.
+	assert.Nil(t, d.record(client, dns.TypeTXT, dns.RcodeSuccess, now))
+	assert.Nil(t, d.record(client, dns.TypeA, dns.RcodeSuccess, now))
+	assert.Nil(t, d.record(client, dns.TypeA, dns.RcodeSuccess, now))
+
+	list := d.list(now)
+	require.Len(t, list, 1)
+
+	assert.Less(t, list[0].Score, 0.5)
+
+	// The old requests leave the window.
+	later := now.Add(time.Minute)
+	for range anomalyMinRequests - 1 {
+		assert.Nil(t, d.record(client, dns.TypeA, dns.RcodeNameError, later))
+	}
+
+	a = d.record(client, dns.TypeA, dns.RcodeNameError, later)
+	require.NotNil(t, a)
+
+	assert.Equal(t, uint64(anomalyMinRequests), a.Requests)
+	assert.Equal(t, 1.0, a.NXDomainRatio)
+	assert.Zero(t, a.TunnelRatio)
+
+	assert.Nil(t, newAnomalyDetector(&Config{}))
+}
+
+func TestProxy_Anomalies(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetRcode(m, dns.RcodeNameError), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	var reported []*ClientAnomaly
+	p := mustNew(t, &Config{
+		UDPListenAddr:    []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:   &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:   defaultTrustedProxies,
+		AnomalyWindow:    time.Minute,
+		AnomalyThreshold: 0.9,
+		OnAnomaly:        func(a *ClientAnomaly) { reported = append(reported, a) },
+	})
+
+	client := netip.MustParseAddrPort("192.0.2.1:53")
+	for range anomalyMinRequests + 1 {
+		dctx := &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion("random.example.", dns.TypeA),
+			Addr: client,
+		}
+
+		require.NoError(t, p.handleDNSRequest(dctx))
+	}
+
+	require.Len(t, reported, 1)
+
+	assert.Equal(t, client.Addr(), reported[0].Client)
+	assert.Equal(t, 1.0, reported[0].Score)
+
+	anomalies := p.Anomalies()
+	require.Len(t, anomalies, 1)
+
+	assert.Equal(t, uint64(anomalyMinRequests+1), anomalies[0].Requests)
+}
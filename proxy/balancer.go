@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/rand"
+	"gonum.org/v1/gonum/stat/sampleuv"
+)
+
+// rttEWMAWeight is the weight of the latest round-trip time in the
+// exponentially weighted moving average of [lowestRTTBalancer].
+const rttEWMAWeight = 0.3
+
+// UpstreamBalancer orders the upstreams for the requests in [UModeCustom].
+// The built-in balancing modes are implemented with it as well.
+type UpstreamBalancer interface {
+	// Order returns the upstreams from ups in the order they should be tried
+	// for req until one of them succeeds.  It may omit some of ups, but must
+	// not return any others.  ups and req must not be modified.  It must be
+	// safe for concurrent use.
+	Order(req *dns.Msg, ups []upstream.Upstream) (ordered []upstream.Upstream)
+
+	// Observe is called after the exchange with u, which took rtt and failed
+	// with err, if not nil.  It must be safe for concurrent use.
+	Observe(u upstream.Upstream, rtt time.Duration, err error)
+}
+
+// newUpstreamBalancers returns the balancers for the balancing upstream modes
+// supported by c.
+func newUpstreamBalancers(c *Config, src rand.Source) (bs map[UpstreamModeType]UpstreamBalancer) {
+	bs = map[UpstreamModeType]UpstreamBalancer{
+		UModeRoundRobin:     &roundRobinBalancer{next: &atomic.Uint64{}},
+		UModeLowestRTT:      newLowestRTTBalancer(),
+		UModeConsistentHash: consistentHashBalancer{},
+		UModeWeighted: &weightedBalancer{
+			weights: c.UpstreamWeights,
+			src:     src,
+		},
+	}
+
+	if c.UpstreamBalancer != nil {
+		bs[UModeCustom] = c.UpstreamBalancer
+	}
+
+	return bs
+}
+
+// validateUpstreamBalancer returns an error if the upstream mode of c isn't
+// supported by its configuration.
+func (c *Config) validateUpstreamBalancer() (err error) {
+	if c.UpstreamMode < UModeLoadBalance || c.UpstreamMode > UModeStaggered {
+		return fmt.Errorf("bad upstream mode %s", c.UpstreamMode)
+	}
+
+	if c.UpstreamBalancer == nil {
+		if c.UpstreamMode == UModeCustom {
+			return errors.Error("no balancer for custom mode")
+		}
+
+		for _, g := range c.UpstreamGroups {
+			if g.Mode == UModeCustom {
+				return fmt.Errorf("group %q: no balancer for custom mode", g.Name)
+			}
+		}
+	}
+
+	for addr, w := range c.UpstreamWeights {
+		if w < 0 {
+			return fmt.Errorf("upstream %s: negative weight %v", addr, w)
+		}
+	}
+
+	return nil
+}
+
+// exchangeBalanced resolves req using ups in the order chosen by b until one
+// succeeds.
+func (p *Proxy) exchangeBalanced(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+	b UpstreamBalancer,
+) (resp *dns.Msg, u upstream.Upstream, attempts int, err error) {
+	if p.upstreamHealth != nil {
+		ups = p.upstreamHealth.filter(ups)
+	}
+
+	var errs []error
+	for _, u = range b.Order(req, ups) {
+		var elapsed time.Duration
+		resp, elapsed, err = exchange(u, req, p.time)
+		p.recordRTT(u.Address(), elapsed, err)
+		b.Observe(u, elapsed, err)
+		attempts++
+
+		if err == nil {
+			return resp, u, attempts, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	if attempts == 0 {
+		return nil, nil, 0, upstream.ErrNoUpstreams
+	}
+
+	err = fmt.Errorf("all upstreams failed to exchange request: %w", errors.Join(errs...))
+
+	return nil, nil, attempts, err
+}
+
+// roundRobinBalancer is an [UpstreamBalancer] starting each request with the
+// upstream following the one the previous request has been started with.
+type roundRobinBalancer struct {
+	// next is the number of the requests ordered so far.
+	next *atomic.Uint64
+}
+
+// type check
+var _ UpstreamBalancer = (*roundRobinBalancer)(nil)
+
+// Order implements the [UpstreamBalancer] interface for *roundRobinBalancer.
+func (b *roundRobinBalancer) Order(
+	_ *dns.Msg,
+	ups []upstream.Upstream,
+) (ordered []upstream.Upstream) {
+	if len(ups) == 0 {
+		return nil
+	}
+
+	i := int((b.next.Add(1) - 1) % uint64(len(ups)))
+
+	return append(slices.Clone(ups[i:]), ups[:i]...)
+}
+
+// Observe implements the [UpstreamBalancer] interface for *roundRobinBalancer.
+func (b *roundRobinBalancer) Observe(_ upstream.Upstream, _ time.Duration, _ error) {}
+
+// lowestRTTBalancer is an [UpstreamBalancer] trying the upstreams in the order
+// of their exponentially weighted moving average round-trip times.  The
+// upstreams not requested yet are tried first.
+type lowestRTTBalancer struct {
+	// mu protects rtts.
+	mu *sync.Mutex
+
+	// rtts are the average round-trip times of the upstreams by their
+	// addresses.
+	rtts map[string]time.Duration
+}
+
+// newLowestRTTBalancer returns a new properly initialized *lowestRTTBalancer.
+func newLowestRTTBalancer() (b *lowestRTTBalancer) {
+	return &lowestRTTBalancer{
+		mu:   &sync.Mutex{},
+		rtts: map[string]time.Duration{},
+	}
+}
+
+// type check
+var _ UpstreamBalancer = (*lowestRTTBalancer)(nil)
+
+// Order implements the [UpstreamBalancer] interface for *lowestRTTBalancer.
+func (b *lowestRTTBalancer) Order(
+	_ *dns.Msg,
+	ups []upstream.Upstream,
+) (ordered []upstream.Upstream) {
+	rtts := make(map[upstream.Upstream]time.Duration, len(ups))
+
+	b.mu.Lock()
+	for _, u := range ups {
+		rtts[u] = b.rtts[u.Address()]
+	}
+	b.mu.Unlock()
+
+	ordered = slices.Clone(ups)
+	slices.SortStableFunc(ordered, func(a, b upstream.Upstream) (res int) {
+		return cmp.Compare(rtts[a], rtts[b])
+	})
+
+	return ordered
+}
+
+// Observe implements the [UpstreamBalancer] interface for *lowestRTTBalancer.
+// The failures are accounted as the default timeout.
+func (b *lowestRTTBalancer) Observe(u upstream.Upstream, rtt time.Duration, err error) {
+	if err != nil {
+		rtt = max(rtt, defaultTimeout)
+	}
+
+	addr := u.Address()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	avg, ok := b.rtts[addr]
+	if ok {
+		rtt = time.Duration(rttEWMAWeight*float64(rtt) + (1-rttEWMAWeight)*float64(avg))
+	}
+
+	// Keep the zero value for the upstreams not requested yet.
+	b.rtts[addr] = max(rtt, 1)
+}
+
+// consistentHashBalancer is an [UpstreamBalancer] trying the upstreams in the
+// order determined by the requested name, so that the requests for the same
+// name are sent to the same upstream, which improves the hit rate of its
+// cache.  It uses the rendezvous hashing, so only the names of a removed
+// upstream are moved to the other ones.
+type consistentHashBalancer struct{}
+
+// type check
+var _ UpstreamBalancer = consistentHashBalancer{}
+
+// Order implements the [UpstreamBalancer] interface for
+// consistentHashBalancer.
+func (consistentHashBalancer) Order(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+) (ordered []upstream.Upstream) {
+	name := strings.ToLower(req.Question[0].Name)
+
+	scores := make(map[upstream.Upstream]uint64, len(ups))
+	for _, u := range ups {
+		h := fnv.New64a()
+
+		// Don't handle the errors since the hash never returns them.
+		_, _ = h.Write([]byte(u.Address()))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(name))
+
+		scores[u] = h.Sum64()
+	}
+
+	ordered = slices.Clone(ups)
+	slices.SortStableFunc(ordered, func(a, b upstream.Upstream) (res int) {
+		return cmp.Compare(scores[b], scores[a])
+	})
+
+	return ordered
+}
+
+// Observe implements the [UpstreamBalancer] interface for
+// consistentHashBalancer.
+func (consistentHashBalancer) Observe(_ upstream.Upstream, _ time.Duration, _ error) {}
+
+// weightedBalancer is an [UpstreamBalancer] trying the upstreams in a random
+// order according to their static weights, regardless of their round-trip
+// times.
+type weightedBalancer struct {
+	// weights are the weights of the upstreams by their addresses.  The
+	// missing upstreams have the weight of 1.
+	weights map[string]float64
+
+	// src is the source of randomness.
+	src rand.Source
+}
+
+// type check
+var _ UpstreamBalancer = (*weightedBalancer)(nil)
+
+// Order implements the [UpstreamBalancer] interface for *weightedBalancer.
+// The upstreams with zero weight are omitted.
+func (b *weightedBalancer) Order(
+	_ *dns.Msg,
+	ups []upstream.Upstream,
+) (ordered []upstream.Upstream) {
+	weights := make([]float64, 0, len(ups))
+	for _, u := range ups {
+		w, ok := b.weights[u.Address()]
+		if !ok {
+			w = 1
+		}
+
+		weights = append(weights, w)
+	}
+
+	w := sampleuv.NewWeighted(weights, b.src)
+	for i, ok := w.Take(); ok; i, ok = w.Take() {
+		ordered = append(ordered, ups[i])
+	}
+
+	return ordered
+}
+
+// Observe implements the [UpstreamBalancer] interface for *weightedBalancer.
+func (b *weightedBalancer) Observe(_ upstream.Upstream, _ time.Duration, _ error) {}
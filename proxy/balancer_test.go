@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newNamedUpstreams returns the upstreams with the specified addresses, which
+// respond to all the requests.
+func newNamedUpstreams(addrs ...string) (ups []upstream.Upstream) {
+	for _, addr := range addrs {
+		ups = append(ups, &fakeUpstream{
+			onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+				return (&dns.Msg{}).SetReply(m), nil
+			},
+			onAddress: func() (a string) { return addr },
+			onClose:   func() (err error) { return nil },
+		})
+	}
+
+	return ups
+}
+
+// upstreamAddrs returns the addresses of ups.
+func upstreamAddrs(ups []upstream.Upstream) (addrs []string) {
+	for _, u := range ups {
+		addrs = append(addrs, u.Address())
+	}
+
+	return addrs
+}
+
+func TestUpstreamBalancers(t *testing.T) {
+	ups := newNamedUpstreams("a", "b", "c")
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+	bs := newUpstreamBalancers(&Config{
+		UpstreamWeights: map[string]float64{"a": 0, "b": 2},
+	}, nil)
+
+	t.Run("round_robin", func(t *testing.T) {
+		b := bs[UModeRoundRobin]
+		assert.Equal(t, []string{"a", "b", "c"}, upstreamAddrs(b.Order(req, ups)))
+		assert.Equal(t, []string{"b", "c", "a"}, upstreamAddrs(b.Order(req, ups)))
+		assert.Equal(t, []string{"c", "a", "b"}, upstreamAddrs(b.Order(req, ups)))
+		assert.Equal(t, []string{"a", "b", "c"}, upstreamAddrs(b.Order(req, ups)))
+	})
+
+	t.Run("lowest_rtt", func(t *testing.T) {
+		b := bs[UModeLowestRTT]
+		b.Observe(ups[0], 30*time.Millisecond, nil)
+		b.Observe(ups[1], 10*time.Millisecond, nil)
+
+		// The upstreams not requested yet go first.
+		assert.Equal(t, []string{"c", "b", "a"}, upstreamAddrs(b.Order(req, ups)))
+
+		b.Observe(ups[2], 20*time.Millisecond, nil)
+		assert.Equal(t, []string{"b", "c", "a"}, upstreamAddrs(b.Order(req, ups)))
+
+		b.Observe(ups[1], 0, errors.Error("test error"))
+		assert.Equal(t, []string{"c", "a", "b"}, upstreamAddrs(b.Order(req, ups)))
+	})
+
+	t.Run("consistent_hash", func(t *testing.T) {
+		b := bs[UModeConsistentHash]
+
+		ordered := upstreamAddrs(b.Order(req, ups))
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, ordered)
+
+		upper := (&dns.Msg{}).SetQuestion("EXAMPLE.ORG.", dns.TypeAAAA)
+		assert.Equal(t, ordered, upstreamAddrs(b.Order(upper, ups)))
+
+		// Removing an upstream doesn't change the order of the others.
+		var rest []upstream.Upstream
+		for _, u := range ups {
+			if u.Address() != ordered[0] {
+				rest = append(rest, u)
+			}
+		}
+
+		assert.Equal(t, ordered[1:], upstreamAddrs(b.Order(req, rest)))
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		b := bs[UModeWeighted]
+
+		firsts := map[string]int{}
+		for range 100 {
+			ordered := upstreamAddrs(b.Order(req, ups))
+			require.ElementsMatch(t, []string{"b", "c"}, ordered)
+
+			firsts[ordered[0]]++
+		}
+
+		assert.Greater(t, firsts["b"], firsts["c"])
+	})
+
+	assert.NotContains(t, bs, UModeCustom)
+}
+
+// testBalancer is an [UpstreamBalancer] for tests.
+type testBalancer struct {
+	onOrder   func(req *dns.Msg, ups []upstream.Upstream) (ordered []upstream.Upstream)
+	onObserve func(u upstream.Upstream, rtt time.Duration, err error)
+}
+
+// type check
+var _ UpstreamBalancer = (*testBalancer)(nil)
+
+// Order implements the [UpstreamBalancer] interface for *testBalancer.
+func (b *testBalancer) Order(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+) (ordered []upstream.Upstream) {
+	return b.onOrder(req, ups)
+}
+
+// Observe implements the [UpstreamBalancer] interface for *testBalancer.
+func (b *testBalancer) Observe(u upstream.Upstream, rtt time.Duration, err error) {
+	b.onObserve(u, rtt, err)
+}
+
+func TestProxy_exchangeBalanced_custom(t *testing.T) {
+	ups := newNamedUpstreams("a", "b")
+	failing := &fakeUpstream{
+		onExchange: func(_ *dns.Msg) (resp *dns.Msg, err error) {
+			return nil, errors.Error("test error")
+		},
+		onAddress: func() (addr string) { return "failing" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	var observed []string
+	b := &testBalancer{
+		onOrder: func(_ *dns.Msg, ups []upstream.Upstream) (ordered []upstream.Upstream) {
+			return []upstream.Upstream{ups[2], ups[1]}
+		},
+		onObserve: func(u upstream.Upstream, _ time.Duration, err error) {
+			observed = append(observed, u.Address())
+		},
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: append(ups, failing),
+		},
+		TrustedProxies:   defaultTrustedProxies,
+		UpstreamMode:     UModeCustom,
+		UpstreamBalancer: b,
+	})
+
+	d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)}
+	_, err := p.replyFromUpstream(d)
+	require.NoError(t, err)
+
+	assert.Equal(t, "b", d.Upstream.Address())
+	assert.Equal(t, []string{"failing", "b"}, observed)
+}
+
+func TestConfig_validateUpstreamBalancer(t *testing.T) {
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &Config{UpstreamMode: UModeRoundRobin},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &Config{UpstreamMode: UModeStaggered + 1},
+		name:       "bad_mode",
+		wantErrMsg: "bad upstream mode !bad_upstream_mode_9",
+	}, {
+		conf:       &Config{UpstreamMode: UModeCustom},
+		name:       "no_balancer",
+		wantErrMsg: "no balancer for custom mode",
+	}, {
+		conf: &Config{
+			UpstreamGroups: []*UpstreamGroup{{Name: "default", Mode: UModeCustom}},
+		},
+		name:       "no_group_balancer",
+		wantErrMsg: `group "default": no balancer for custom mode`,
+	}, {
+		conf: &Config{
+			UpstreamMode:    UModeWeighted,
+			UpstreamWeights: map[string]float64{"a": -1},
+		},
+		name:       "negative_weight",
+		wantErrMsg: "upstream a: negative weight -1",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validateUpstreamBalancer())
+		})
+	}
+}
@@ -61,12 +61,38 @@ func (noopRequestHandler) HandleBefore(_ *Proxy, _ *DNSContext) (err error) {
 	return nil
 }
 
-// handleBefore calls the [BeforeRequestHandler] if it's set.  If the returned
+// BeforeRequestHandlers is a [BeforeRequestHandler] that calls the handlers in
+// order until one of them returns a non-nil error.
+type BeforeRequestHandlers []BeforeRequestHandler
+
+// type check
+var _ BeforeRequestHandler = BeforeRequestHandlers(nil)
+
+// HandleBefore implements the [BeforeRequestHandler] interface for
+// BeforeRequestHandlers.
+func (hs BeforeRequestHandlers) HandleBefore(p *Proxy, dctx *DNSContext) (err error) {
+	for _, h := range hs {
+		err = h.HandleBefore(p, dctx)
+		if err != nil {
+			// Don't wrap the error since it may be a [BeforeRequestError].
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleBefore calls the [BeforeRequestHandler] if it's set, and then the one
+// of the [VirtualResolver] the request is sent to, if any.  If the returned
 // error is nil, it returns true and the request is processed further.  If the
 // returned error has type [BeforeRequestError], the specified response is sent
 // to the client.  Otherwise, the request just ignored.
 func (p *Proxy) handleBefore(d *DNSContext) (cont bool) {
 	err := p.beforeRequestHandler.HandleBefore(p, d)
+	if err == nil && d.VirtualResolver != nil && d.VirtualResolver.BeforeRequestHandler != nil {
+		err = d.VirtualResolver.BeforeRequestHandler.HandleBefore(p, d)
+	}
+
 	if err == nil {
 		return true
 	}
@@ -75,6 +101,8 @@ func (p *Proxy) handleBefore(d *DNSContext) (cont bool) {
 
 	if befReqErr := (&BeforeRequestError{}); errors.As(err, &befReqErr) {
 		d.Res = befReqErr.Response
+		d.setLocalSource()
+		p.signResponse(d)
 
 		p.logDNSMessage(d.Res)
 		p.respond(d)
@@ -120,3 +120,30 @@ func TestProxy_HandleDNSRequest_beforeRequestHandler(t *testing.T) {
 		assert.Equal(t, errorResponse, resp)
 	})
 }
+
+func TestBeforeRequestHandlers(t *testing.T) {
+	t.Parallel()
+
+	const errStop errors.Error = "stop"
+
+	var called []int
+	newHandler := func(n int, err error) (h BeforeRequestHandler) {
+		return &testBeforeRequestHandler{
+			onHandleBefore: func(_ *Proxy, _ *DNSContext) (hErr error) {
+				called = append(called, n)
+
+				return err
+			},
+		}
+	}
+
+	hs := BeforeRequestHandlers{
+		newHandler(1, nil),
+		newHandler(2, errStop),
+		newHandler(3, nil),
+	}
+
+	err := hs.HandleBefore(nil, &DNSContext{})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, []int{1, 2}, called)
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/binary"
 	"math"
 	"net"
@@ -10,11 +11,11 @@ import (
 	"sync"
 	"time"
 
-	glcache "github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/mathutil"
 	"github.com/bruceluk/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	gocache "github.com/patrickmn/go-cache"
 )
 
 // defaultCacheSize is the size of cache in bytes by default.
@@ -29,10 +30,42 @@ type cache struct {
 	itemsWithSubnetLock *sync.RWMutex
 
 	// items is the requests cache.
-	items glcache.Cache
+	items *cacheStore
 
-	// itemsWithSubnet is the requests cache.
-	itemsWithSubnet glcache.Cache
+	// itemsWithSubnet is the requests cache.  It's nil if EDNS Client Subnet
+	// is disabled.
+	itemsWithSubnet *cacheStore
+
+	// compressMinSize is the minimum size of a packed item to store it
+	// compressed.  Compression is disabled if it's not positive.
+	compressMinSize int
+
+	// staleRefreshes are the times of the next background refreshes of the
+	// stale items, which the upstreams have recently failed to resolve, by
+	// their keys.  It's nil if serving stale items is disabled.
+	staleRefreshes *gocache.Cache
+
+	// staleLock protects staleRefreshes.
+	staleLock *sync.Mutex
+
+	// staleMax is the maximum time the expired items are returned for, see
+	// [Config.CacheServeStale].  It's only used if optimistic is false.
+	staleMax time.Duration
+
+	// staleTTL is the TTL of the stale items in seconds.
+	staleTTL uint32
+
+	// negativeMinTTL is the minimum TTL of the negative responses in seconds,
+	// see [Config.CacheNegativeMinTTL].
+	negativeMinTTL uint32
+
+	// negativeMaxTTL is the maximum TTL of the negative responses in seconds,
+	// see [Config.CacheNegativeMaxTTL].
+	negativeMaxTTL uint32
+
+	// file is the file backing the cache.  It's nil if the cache isn't
+	// persisted.
+	file *cacheFile
 
 	// optimistic defines if the cache should return expired items and resolve
 	// those again.
@@ -49,18 +82,23 @@ type cacheItem struct {
 	u string
 
 	// ttl is the time-to-live value for the item.  Should be set before calling
-	// [cacheItem.pack].
+	// [cacheItem.pack].  For the unpacked items, it's the remaining TTL.
 	ttl uint32
 }
 
 // respToItem converts the pair of the response and upstream resolved the one
-// into item for storing it in cache.
-func respToItem(m *dns.Msg, u upstream.Upstream) (item *cacheItem) {
+// into item for storing it in c.  The TTL of the negative responses is kept
+// within the negative TTL limits of c.
+func (c *cache) respToItem(m *dns.Msg, u upstream.Upstream) (item *cacheItem) {
 	ttl := cacheTTL(m)
 	if ttl == 0 {
 		return nil
 	}
 
+	if isNegative(m) {
+		ttl = respectTTLOverrides(ttl, c.negativeMinTTL, c.negativeMaxTTL)
+	}
+
 	upsAddr := ""
 	if u != nil {
 		upsAddr = u.Address()
@@ -110,9 +148,10 @@ func (ci *cacheItem) pack() (packed []byte) {
 const optimisticTTL = 10
 
 // unpackItem converts the data into cacheItem using req as a request message.
-// expired is true if the item exists but expired.  The expired cached items are
-// only returned if c is optimistic.  req must not be nil.
-func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bool) {
+// do is the DNSSEC OK flag of the client's request.  expired is true if the
+// item exists but expired.  The expired cached items are only returned if c is
+// optimistic or serves stale items.  req must not be nil.
+func (c *cache) unpackItem(data []byte, req *dns.Msg, do bool) (ci *cacheItem, expired bool) {
 	if len(data) < minPackedLen {
 		return nil, false
 	}
@@ -122,22 +161,20 @@ func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bo
 	now := time.Now().Unix()
 	var ttl uint32
 	if expired = expire <= now; expired {
-		if !c.optimistic {
+		switch {
+		case c.optimistic:
+			ttl = optimisticTTL
+		case c.isStale(expire, now):
+			ttl = c.staleTTL
+		default:
 			return nil, expired
 		}
-
-		ttl = optimisticTTL
 	} else {
 		ttl = uint32(expire - now)
 	}
 
-	l := int(binary.BigEndian.Uint16(b.Next(packedMsgLenSz)))
-	if l == 0 {
-		return nil, expired
-	}
-
-	m := &dns.Msg{}
-	if m.Unpack(b.Next(l)) != nil {
+	m, upsAddr, ok := unpackMsg(b.Bytes())
+	if !ok {
 		return nil, expired
 	}
 
@@ -145,19 +182,15 @@ func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bo
 	res.AuthenticatedData = m.AuthenticatedData
 	res.RecursionAvailable = m.RecursionAvailable
 
-	var doBit bool
-	if o := req.IsEdns0(); o != nil {
-		doBit = o.Do()
-	}
-
 	// Don't return OPT records from cache since it's deprecated by RFC 6891.
 	// If the request has DO bit set we only remove all the OPT RRs, and also
 	// all DNSSEC RRs otherwise.
-	filterMsg(res, m, req.AuthenticatedData, doBit, ttl)
+	filterMsg(res, m, req.AuthenticatedData, do, ttl)
 
 	return &cacheItem{
-		m: res,
-		u: string(b.Next(b.Len())),
+		m:   res,
+		u:   upsAddr,
+		ttl: ttl,
 	}, expired
 }
 
@@ -170,10 +203,61 @@ func (p *Proxy) initCache() {
 	}
 
 	size := p.CacheSizeBytes
-	log.Info("dnsproxy: cache: enabled, size %d b", size)
+	log.Info("dnsproxy: cache: enabled, size %d b, low watermark %d b", size, p.CacheLowWatermark)
 
 	p.cache = newCache(size, p.EnableEDNSClientSubnet, p.CacheOptimistic)
+	p.cache.setLowWatermark(p.CacheLowWatermark)
+	if p.CacheCompressMinSize > 0 {
+		log.Info("dnsproxy: cache: compressing items from %d b", p.CacheCompressMinSize)
+
+		p.cache.compressMinSize = p.CacheCompressMinSize
+	}
+
+	if p.CacheServeStale > 0 && !p.CacheOptimistic {
+		log.Info("dnsproxy: cache: serving stale responses for %s", p.CacheServeStale)
+
+		p.cache.setServeStale(p.CacheServeStale, p.CacheStaleTTL)
+	}
+
+	p.cache.negativeMinTTL = p.CacheNegativeMinTTL
+	p.cache.negativeMaxTTL = p.CacheNegativeMaxTTL
 	p.shortFlighter = newOptimisticResolver(p)
+
+	if p.CacheAggressiveNSEC && p.dnssecValidator != nil {
+		log.Info("dnsproxy: cache: synthesizing nxdomain from nsec records")
+
+		p.nsecCache = newNSECCache()
+	}
+
+	p.prefetcher = newPrefetcher(&p.Config)
+	if p.prefetcher != nil {
+		log.Info("dnsproxy: cache: prefetching responses after %d hits", p.CachePrefetchHits)
+	}
+
+	if p.CacheFile != "" {
+		p.initCacheFile()
+	}
+}
+
+// initCacheFile loads the cache from the file set in the configuration and
+// makes the file back the cache.
+func (p *Proxy) initCacheFile() {
+	maxSize := int64(p.CacheFileMaxSize)
+	if maxSize <= 0 {
+		maxSize = cacheFileSizeFactor * int64(cmp.Or(p.CacheSizeBytes, defaultCacheSize))
+	}
+
+	log.Info("dnsproxy: cache: persisting to %q, max size %d b", p.CacheFile, maxSize)
+
+	f := newCacheFile(p.CacheFile, maxSize, p.cache)
+	err := f.load()
+	if err != nil {
+		// Start with the empty cache, since the file is rewritten on start
+		// anyway.
+		log.Error("dnsproxy: cache: loading file: %s", err)
+	}
+
+	p.cache.file = f
 }
 
 // newCache returns a properly initialized cache.
@@ -181,21 +265,42 @@ func newCache(size int, withECS, optimistic bool) (c *cache) {
 	c = &cache{
 		itemsLock:           &sync.RWMutex{},
 		itemsWithSubnetLock: &sync.RWMutex{},
-		items:               createCache(size),
+		items:               newCacheStore(size),
 		optimistic:          optimistic,
 	}
 
 	if withECS {
-		c.itemsWithSubnet = createCache(size)
+		c.itemsWithSubnet = newCacheStore(size)
 	}
 
 	return c
 }
 
-// get returns cached item for the req if it's found.  expired is true if the
-// item's TTL is expired.  key is the resulting key for req.  It's returned to
-// avoid recalculating it afterwards.
-func (c *cache) get(req *dns.Msg) (ci *cacheItem, expired bool, key []byte) {
+// setLowWatermark sets the low watermark of the stores of c to low bytes, see
+// [cacheStore.setLowWatermark].
+func (c *cache) setLowWatermark(low int) {
+	c.items.setLowWatermark(low)
+	if c.itemsWithSubnet != nil {
+		c.itemsWithSubnet.setLowWatermark(low)
+	}
+}
+
+// stats returns the statistics of the stores of c combined.
+func (c *cache) stats() (s CacheStats) {
+	s = c.items.statistics()
+	if c.itemsWithSubnet != nil {
+		s.add(c.itemsWithSubnet.statistics())
+	}
+
+	return s
+}
+
+// get returns cached item for the req if it's found.  do is the DNSSEC OK flag
+// of the client's request, which may differ from the one of req, since the
+// flag is set for the requests to upstreams.  expired is true if the item's TTL
+// is expired.  key is the resulting key for req.  It's returned to avoid
+// recalculating it afterwards.
+func (c *cache) get(req *dns.Msg, do bool) (ci *cacheItem, expired bool, key []byte) {
 	c.itemsLock.RLock()
 	defer c.itemsLock.RUnlock()
 
@@ -203,26 +308,31 @@ func (c *cache) get(req *dns.Msg) (ci *cacheItem, expired bool, key []byte) {
 		return nil, false, nil
 	}
 
-	key = msgToKey(req)
-	data := c.items.Get(key)
+	key = msgToKey(req, do)
+	data := c.items.get(key)
 	if data == nil {
 		return nil, false, key
 	}
 
-	if ci, expired = c.unpackItem(data, req); ci == nil {
-		c.items.Del(key)
+	if ci, expired = c.unpackItem(data, req, do); ci == nil {
+		c.items.del(key)
 	}
 
 	return ci, expired, key
 }
 
-// getWithSubnet returns cached item for the req if it's found by n.  expired
-// is true if the item's TTL is expired.  k is the resulting key for req.  It's
-// returned to avoid recalculating it afterwards.
+// getWithSubnet returns cached item for the req if it's found by n.  do is the
+// same as for [cache.get].  expired is true if the item's TTL is expired.  k is
+// the resulting key for req.  It's returned to avoid recalculating it
+// afterwards.
 //
 // Note that a slow longest-prefix-match algorithm is used, so cache searches
 // are performed up to mask+1 times.
-func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expired bool, k []byte) {
+func (c *cache) getWithSubnet(
+	req *dns.Msg,
+	do bool,
+	n *net.IPNet,
+) (ci *cacheItem, expired bool, k []byte) {
 	c.itemsWithSubnetLock.RLock()
 	defer c.itemsWithSubnetLock.RUnlock()
 
@@ -234,8 +344,8 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 	ipLen := len(ecsIP)
 	m, _ := n.Mask.Size()
 
-	k = msgToKeyWithSubnet(req, ecsIP, m)
-	data := c.itemsWithSubnet.Get(k)
+	k = msgToKeyWithSubnet(req, do, ecsIP, m)
+	data := c.itemsWithSubnet.get(k)
 
 	// In order to reduce allocations we apply mask on bits level.  As the key
 	// k has ecsIP in bytes slice representation, each iteration we can just
@@ -247,7 +357,7 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 		// In case mask is zero, the key doesn't have IP in it.
 		if m == 0 {
 			k = slices.Delete(k, keyIPIndex, keyIPIndex+ipLen)
-			data = c.itemsWithSubnet.Get(k)
+			data = c.itemsWithSubnet.get(k)
 
 			continue
 		}
@@ -262,15 +372,15 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 		// Clear the last non-zero bit in the byte of the IP address.
 		k[keyIPIndex+m/8] &= bitmask
 
-		data = c.itemsWithSubnet.Get(k)
+		data = c.itemsWithSubnet.get(k)
 	}
 
 	if data == nil {
 		return nil, false, k
 	}
 
-	if ci, expired = c.unpackItem(data, req); ci == nil {
-		c.itemsWithSubnet.Del(k)
+	if ci, expired = c.unpackItem(data, req, do); ci == nil {
+		c.itemsWithSubnet.del(k)
 	}
 
 	return ci, expired, k
@@ -278,56 +388,49 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 
 // canLookUpInCache returns true if these parameters could be used to make a
 // cache lookup.
-func canLookUpInCache(cache glcache.Cache, req *dns.Msg) (ok bool) {
+func canLookUpInCache(cache *cacheStore, req *dns.Msg) (ok bool) {
 	return cache != nil && req != nil && len(req.Question) == 1
 }
 
-// createCache returns new Cache with the given cacheSize.
-func createCache(cacheSize int) (glc glcache.Cache) {
-	conf := glcache.Config{
-		MaxSize:   defaultCacheSize,
-		EnableLRU: true,
-	}
-
-	if cacheSize > 0 {
-		conf.MaxSize = uint(cacheSize)
-	}
-
-	return glcache.New(conf)
-}
-
-// set tries to add the ci into cache.
-func (c *cache) set(m *dns.Msg, u upstream.Upstream) {
-	item := respToItem(m, u)
+// set tries to add the ci into cache.  do is the DNSSEC OK flag of the client's
+// request, the DNSSEC RRs are only stored for the requests having it set.
+func (c *cache) set(m *dns.Msg, u upstream.Upstream, do bool) {
+	item := c.respToItem(cacheVariant(m, do), u)
 	if item == nil {
 		return
 	}
 
-	key := msgToKey(m)
-	packed := item.pack()
+	key := msgToKey(m, do)
+	packed := c.compress(item.pack())
 
 	c.itemsLock.Lock()
 	defer c.itemsLock.Unlock()
 
-	c.items.Set(key, packed)
+	c.items.set(key, packed)
+	if c.file != nil {
+		c.file.add(stateSectionCache, key, packed)
+	}
 }
 
 // setWithSubnet tries to add the ci into cache with subnet and ip used to
-// calculate the key.
-func (c *cache) setWithSubnet(m *dns.Msg, u upstream.Upstream, subnet *net.IPNet) {
-	item := respToItem(m, u)
+// calculate the key.  do is the same as for [cache.set].
+func (c *cache) setWithSubnet(m *dns.Msg, u upstream.Upstream, do bool, subnet *net.IPNet) {
+	item := c.respToItem(cacheVariant(m, do), u)
 	if item == nil {
 		return
 	}
 
 	pref, _ := subnet.Mask.Size()
-	key := msgToKeyWithSubnet(m, subnet.IP.Mask(subnet.Mask), pref)
-	packed := item.pack()
+	key := msgToKeyWithSubnet(m, do, subnet.IP.Mask(subnet.Mask), pref)
+	packed := c.compress(item.pack())
 
 	c.itemsWithSubnetLock.Lock()
 	defer c.itemsWithSubnetLock.Unlock()
 
-	c.itemsWithSubnet.Set(key, packed)
+	c.itemsWithSubnet.set(key, packed)
+	if c.file != nil {
+		c.file.add(stateSectionCacheWithSubnet, key, packed)
+	}
 }
 
 // clearItems empties the simple cache.
@@ -335,7 +438,7 @@ func (c *cache) clearItems() {
 	c.itemsLock.Lock()
 	defer c.itemsLock.Unlock()
 
-	c.items.Clear()
+	c.items.clear()
 }
 
 // clearItemsWithSubnet empties the subnet cache, if any.
@@ -348,7 +451,7 @@ func (c *cache) clearItemsWithSubnet() {
 	c.itemsWithSubnetLock.Lock()
 	defer c.itemsWithSubnetLock.Unlock()
 
-	c.itemsWithSubnet.Clear()
+	c.itemsWithSubnet.clear()
 }
 
 // cacheTTL returns the number of seconds for which m is valid to be cached.
@@ -441,6 +544,35 @@ func isCacheableNegative(m *dns.Msg) (ok bool) {
 	return ok
 }
 
+// isNegative returns true if m is an NXDOMAIN or a NODATA response, including
+// the ones with a CNAME chain leading to the nonexistent name or type.  m must
+// have a single question.
+func isNegative(m *dns.Msg) (ok bool) {
+	switch m.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		qt := m.Question[0].Qtype
+		for _, rr := range m.Answer {
+			if t := rr.Header().Rrtype; t == qt || qt == dns.TypeANY {
+				return false
+			}
+		}
+
+		return isCacheableNegative(m)
+	default:
+		return false
+	}
+}
+
+// negativeTTL returns the TTL of the negative response derived from soa, which
+// is the minimum of its TTL and its MINIMUM field.
+//
+// See https://datatracker.ietf.org/doc/html/rfc2308#section-5.
+func negativeTTL(soa *dns.SOA) (ttl uint32) {
+	return min(soa.Hdr.Ttl, soa.Minttl)
+}
+
 // ServFailMaxCacheTTL is the maximum time-to-live value for caching
 // SERVFAIL responses in seconds.  It's consistent with the upper constraint
 // of 5 minutes given by RFC 2308.
@@ -449,16 +581,26 @@ func isCacheableNegative(m *dns.Msg) (ok bool) {
 const ServFailMaxCacheTTL = 30
 
 // calculateTTL returns the number of seconds for which m could be cached.  It's
-// usually the lowest TTL among all m's resource records.  It returns 0 if m
-// isn't cacheable according to it's contents.
+// usually the lowest TTL among all m's resource records, where the TTL of the
+// SOA record in the authority section is limited by its MINIMUM field, so that
+// the negative responses, including the ones with CNAME chains, are cached for
+// no longer than RFC 2308 allows.  It returns 0 if m isn't cacheable according
+// to it's contents.
 func calculateTTL(m *dns.Msg) (ttl uint32) {
 	// Use the maximum value as a guard value.  If the inner loop is entered,
 	// it's going to be rewritten with an actual TTL value that is lower than
 	// MaxUint32.  If the inner loop isn't entered, catch that and return zero.
 	ttl = math.MaxUint32
-	for _, rrset := range [...][]dns.RR{m.Answer, m.Ns, m.Extra} {
+	for i, rrset := range [...][]dns.RR{m.Answer, m.Ns, m.Extra} {
 		for _, rr := range rrset {
 			ttl = minTTL(rr.Header(), ttl)
+
+			// Only the SOA record in the authority section defines the
+			// negative TTL.
+			if soa, ok := rr.(*dns.SOA); ok && i == 1 {
+				ttl = min(ttl, negativeTTL(soa))
+			}
+
 			if ttl == 0 {
 				return 0
 			}
@@ -501,20 +643,42 @@ func respectTTLOverrides(ttl, cacheMinTTL, cacheMaxTTL uint32) uint32 {
 	return ttl
 }
 
-// msgToKey constructs the cache key from type, class and question's name of m.
-func msgToKey(m *dns.Msg) (b []byte) {
+// msgToKey constructs the cache key from DO bit, type, class and question's
+// name of m.  do is the DNSSEC OK flag of the client's request, since the
+// responses to the requests with and without it are stored separately.
+func msgToKey(m *dns.Msg, do bool) (b []byte) {
 	q := m.Question[0]
 	name := q.Name
-	b = make([]byte, packedMsgLenSz+packedMsgLenSz+len(name))
+	b = make([]byte, 1+packedMsgLenSz+packedMsgLenSz+len(name))
 
-	// Put QTYPE, QCLASS, and QNAME.
-	binary.BigEndian.PutUint16(b, q.Qtype)
-	binary.BigEndian.PutUint16(b[packedMsgLenSz:], q.Qclass)
-	copy(b[2*packedMsgLenSz:], strings.ToLower(name))
+	// Put DO, QTYPE, QCLASS, and QNAME.
+	b[0] = mathutil.BoolToNumber[byte](do)
+	binary.BigEndian.PutUint16(b[1:], q.Qtype)
+	binary.BigEndian.PutUint16(b[1+packedMsgLenSz:], q.Qclass)
+	copy(b[1+2*packedMsgLenSz:], strings.ToLower(name))
 
 	return b
 }
 
+// cacheVariant returns the variant of m to store in cache for the requests
+// with DNSSEC OK flag equal to do.  The variant for the requests having it set
+// is m itself, containing the DNSSEC RRs along with the records they sign.  The
+// other one is a copy of m without them, so that the clients don't get the
+// records they haven't requested and the clients setting the flag don't get
+// the answer lacking the signatures.
+func cacheVariant(m *dns.Msg, do bool) (v *dns.Msg) {
+	if do {
+		return m
+	}
+
+	v = m.Copy()
+
+	// Keep the AD bit, since it's filtered for each request when unpacking.
+	filterMsg(v, m, true, false, 0)
+
+	return v
+}
+
 const (
 	// keyMaskIndex is the index of the byte with mask ones value.
 	keyMaskIndex = 1 + 2*packedMsgLenSz
@@ -524,9 +688,9 @@ const (
 )
 
 // msgToKeyWithSubnet constructs the cache key from DO bit, type, class, subnet
-// mask, client's IP address and question's name of m.  ecsIP is expected to be
-// masked already.
-func msgToKeyWithSubnet(m *dns.Msg, ecsIP net.IP, mask int) (key []byte) {
+// mask, client's IP address and question's name of m.  do is the same as for
+// [msgToKey].  ecsIP is expected to be masked already.
+func msgToKeyWithSubnet(m *dns.Msg, do bool, ecsIP net.IP, mask int) (key []byte) {
 	q := m.Question[0]
 	keyLen := keyIPIndex + len(q.Name)
 	masked := mask != 0
@@ -538,13 +702,10 @@ func msgToKeyWithSubnet(m *dns.Msg, ecsIP net.IP, mask int) (key []byte) {
 	key = make([]byte, keyLen)
 
 	// Put DO.
-	opt := m.IsEdns0()
-	key[0] = mathutil.BoolToNumber[byte](opt != nil && opt.Do())
+	key[0] = mathutil.BoolToNumber[byte](do)
 
 	// Put Qtype.
-	//
-	// TODO(d.kolyshev): We should put Qtype in key[1:].
-	binary.BigEndian.PutUint16(key[:], q.Qtype)
+	binary.BigEndian.PutUint16(key[1:], q.Qtype)
 
 	// Put Qclass.
 	binary.BigEndian.PutUint16(key[1+packedMsgLenSz:], q.Qclass)
@@ -55,7 +55,7 @@ func TestServeCached(t *testing.T) {
 	}).SetQuestion("google.com.", dns.TypeA)
 	reply.SetEdns0(defaultUDPBufSize, false)
 
-	dnsProxy.cache.set(reply, upstreamWithAddr)
+	dnsProxy.cache.set(reply, upstreamWithAddr, false)
 
 	// Create a DNS-over-UDP client connection.
 	addr := dnsProxy.Addr(ProtoUDP)
@@ -127,17 +127,17 @@ func TestCache_expired(t *testing.T) {
 				t.Cleanup(func() { testCache.optimistic = false })
 			}
 
-			key := msgToKey(reply)
+			key := msgToKey(reply, false)
 			data := (&cacheItem{
 				m:   reply,
 				u:   testUpsAddr,
 				ttl: tc.ttl,
 			}).pack()
-			testCache.items.Set(key, data)
-			t.Cleanup(testCache.items.Clear)
+			testCache.items.set(key, data)
+			t.Cleanup(testCache.items.clear)
 
-			r, expired, key := testCache.get(req)
-			assert.Equal(t, msgToKey(req), key)
+			r, expired, key := testCache.get(req, false)
+			assert.Equal(t, msgToKey(req, false), key)
 			assert.Equal(t, tc.ttl == 0, expired)
 
 			if tc.wantTTL != 0 {
@@ -152,46 +152,139 @@ func TestCache_expired(t *testing.T) {
 	}
 }
 
+func TestCache_compress(t *testing.T) {
+	const host = "example.org."
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeTXT)
+	resp := (&dns.Msg{}).SetReply(req)
+	for i := range 10 {
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   host,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    defaultTestTTL,
+			},
+			Txt: []string{strings.Repeat(string(rune('a'+i)), 200)},
+		})
+	}
+
+	plain := (&cacheItem{m: resp, u: testUpsAddr, ttl: defaultTestTTL}).pack()
+
+	testCases := []struct {
+		name           string
+		minSize        int
+		wantCompressed bool
+	}{{
+		name:           "disabled",
+		minSize:        0,
+		wantCompressed: false,
+	}, {
+		name:           "below_threshold",
+		minSize:        len(plain) + 1,
+		wantCompressed: false,
+	}, {
+		name:           "compressed",
+		minSize:        len(plain),
+		wantCompressed: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCache(testCacheSize, false, false)
+			c.compressMinSize = tc.minSize
+
+			c.set(resp, upstreamWithAddr, false)
+
+			data := c.items.get(msgToKey(req, false))
+			require.NotNil(t, data)
+
+			if tc.wantCompressed {
+				assert.Less(t, len(data), len(plain))
+			} else {
+				assert.Len(t, data, len(plain))
+			}
+
+			ci, expired, _ := c.get(req, false)
+			require.NotNil(t, ci)
+
+			assert.False(t, expired)
+			assert.Equal(t, testUpsAddr, ci.u)
+			require.Len(t, ci.m.Answer, len(resp.Answer))
+			for i, rr := range ci.m.Answer {
+				assert.Equal(t, resp.Answer[i].String(), rr.String())
+			}
+		})
+	}
+}
+
 func TestCacheDO(t *testing.T) {
+	const host = "google.com."
+
 	testCache := newCache(testCacheSize, false, false)
 
-	// Fill the cache.
+	a := newRR(t, host, dns.TypeA, 3600, net.IP{8, 8, 8, 8})
+	rrsig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   host,
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		TypeCovered: dns.TypeA,
+		Algorithm:   dns.RSASHA256,
+		Labels:      2,
+		OrigTtl:     3600,
+		SignerName:  host,
+		Signature:   "c29tZSBzaWduYXR1cmU=",
+	}
+
 	reply := (&dns.Msg{
 		MsgHdr: dns.MsgHdr{
-			Response: true,
+			Response:          true,
+			AuthenticatedData: true,
 		},
-		Answer: []dns.RR{newRR(t, "google.com.", dns.TypeA, 3600, net.IP{8, 8, 8, 8})},
-	}).SetQuestion("google.com.", dns.TypeA)
+		Answer: []dns.RR{a, rrsig},
+	}).SetQuestion(host, dns.TypeA)
 	reply.SetEdns0(4096, true)
 
-	// Store in cache.
-	testCache.set(reply, upstreamWithAddr)
+	request := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
 
-	// Make a request.
-	request := (&dns.Msg{}).SetQuestion("google.com.", dns.TypeA)
+	// Store only the variant for the clients without DO bit.
+	testCache.set(reply, upstreamWithAddr, false)
 
 	t.Run("without_do", func(t *testing.T) {
-		ci, expired, key := testCache.get(request)
+		ci, expired, key := testCache.get(request, false)
 		assert.False(t, expired)
-		assert.Equal(t, msgToKey(request), key)
-		assert.NotNil(t, ci)
+		assert.Equal(t, msgToKey(request, false), key)
+
+		require.NotNil(t, ci)
+		require.Len(t, ci.m.Answer, 1)
+
+		assert.Equal(t, a.String(), ci.m.Answer[0].String())
+		assert.Equal(t, testUpsAddr, ci.u)
 	})
 
-	t.Run("with_do", func(t *testing.T) {
-		reqClone := request.Copy()
-		t.Cleanup(func() {
-			request = reqClone
-		})
+	t.Run("with_do_miss", func(t *testing.T) {
+		ci, expired, key := testCache.get(request, true)
+		assert.False(t, expired)
+		assert.Equal(t, msgToKey(request, true), key)
+		assert.Nil(t, ci)
+	})
 
-		request.SetEdns0(4096, true)
+	// Store the variant for the clients with DO bit.
+	testCache.set(reply, upstreamWithAddr, true)
 
-		ci, expired, key := testCache.get(request)
+	t.Run("with_do", func(t *testing.T) {
+		ci, expired, _ := testCache.get(request, true)
 		assert.False(t, expired)
-		assert.Equal(t, msgToKey(request), key)
 
 		require.NotNil(t, ci)
+		require.Len(t, ci.m.Answer, 2)
 
-		assert.Equal(t, testUpsAddr, ci.u)
+		assert.Equal(t, a.String(), ci.m.Answer[0].String())
+		assert.Equal(t, rrsig.String(), ci.m.Answer[1].String())
+		assert.True(t, ci.m.AuthenticatedData)
 	})
 }
 
@@ -205,26 +298,26 @@ func TestCacheCNAME(t *testing.T) {
 		},
 		Answer: []dns.RR{newRR(t, "google.com.", dns.TypeCNAME, 3600, "test.google.com.")},
 	}).SetQuestion("google.com.", dns.TypeA)
-	testCache.set(reply, upstreamWithAddr)
+	testCache.set(reply, upstreamWithAddr, false)
 
 	// Create a DNS request.
 	request := (&dns.Msg{}).SetQuestion("google.com.", dns.TypeA)
 
 	t.Run("no_cnames", func(t *testing.T) {
-		r, expired, _ := testCache.get(request)
+		r, expired, _ := testCache.get(request, false)
 		assert.Nil(t, r)
 		assert.False(t, expired)
 	})
 
 	// Now fill the cache with a cacheable CNAME response.
 	reply.Answer = append(reply.Answer, newRR(t, "google.com.", dns.TypeA, 3600, net.IP{8, 8, 8, 8}))
-	testCache.set(reply, upstreamWithAddr)
+	testCache.set(reply, upstreamWithAddr, false)
 
 	// We are testing that a proper CNAME response gets cached
 	t.Run("cnames_exist", func(t *testing.T) {
-		r, expired, key := testCache.get(request)
+		r, expired, key := testCache.get(request, false)
 		assert.False(t, expired)
-		assert.Equal(t, key, msgToKey(request))
+		assert.Equal(t, key, msgToKey(request, false))
 
 		require.NotNil(t, r)
 
@@ -241,9 +334,9 @@ func TestCache_uncacheable(t *testing.T) {
 	reply := (&dns.Msg{}).SetRcode(request, dns.RcodeBadAlg)
 
 	// We are testing that SERVFAIL responses aren't cached
-	testCache.set(reply, upstreamWithAddr)
+	testCache.set(reply, upstreamWithAddr, false)
 
-	r, expired, _ := testCache.get(request)
+	r, expired, _ := testCache.get(request, false)
 	assert.Nil(t, r)
 	assert.False(t, expired)
 }
@@ -300,23 +393,23 @@ func TestCacheExpiration(t *testing.T) {
 			},
 			Answer: []dns.RR{dns.Copy(rr)},
 		}).SetQuestion(rr.Header().Name, dns.TypeA)
-		dnsProxy.cache.set(rep, upstreamWithAddr)
+		dnsProxy.cache.set(rep, upstreamWithAddr, false)
 		replies[i] = rep
 	}
 
 	for _, r := range replies {
-		ci, expired, key := dnsProxy.cache.get(r)
+		ci, expired, key := dnsProxy.cache.get(r, false)
 		require.NotNil(t, ci)
 
 		assert.False(t, expired)
-		assert.Equal(t, msgToKey(ci.m), key)
+		assert.Equal(t, msgToKey(ci.m, false), key)
 
 		requireEqualMsgs(t, ci.m, r)
 	}
 
 	assert.Eventually(t, func() bool {
 		for _, r := range replies {
-			if ci, _, _ := dnsProxy.cache.get(r); ci != nil {
+			if ci, _, _ := dnsProxy.cache.get(r, false); ci != nil {
 				return false
 			}
 		}
@@ -365,9 +458,9 @@ func TestCacheExpirationWithTTLOverride(t *testing.T) {
 		err = dnsProxy.Resolve(d)
 		require.NoError(t, err)
 
-		ci, expired, key := dnsProxy.cache.get(d.Req)
+		ci, expired, key := dnsProxy.cache.get(d.Req, false)
 		assert.False(t, expired)
-		assert.Equal(t, msgToKey(d.Req), key)
+		assert.Equal(t, msgToKey(d.Req, false), key)
 
 		require.NotNil(t, ci)
 		assert.Equal(t, dnsProxy.CacheMinTTL, ci.m.Answer[0].Header().Ttl)
@@ -389,9 +482,9 @@ func TestCacheExpirationWithTTLOverride(t *testing.T) {
 		err = dnsProxy.Resolve(d)
 		assert.Nil(t, err)
 
-		ci, expired, key := dnsProxy.cache.get(d.Req)
+		ci, expired, key := dnsProxy.cache.get(d.Req, false)
 		assert.False(t, expired)
-		assert.Equal(t, msgToKey(d.Req), key)
+		assert.Equal(t, msgToKey(d.Req, false), key)
 
 		require.NotNil(t, ci)
 		assert.Equal(t, dnsProxy.CacheMaxTTL, ci.m.Answer[0].Header().Ttl)
@@ -521,13 +614,13 @@ func (tests testCases) run(t *testing.T) {
 			},
 			Answer: res.a,
 		}).SetQuestion(res.q, res.t)
-		testCache.set(reply, upstreamWithAddr)
+		testCache.set(reply, upstreamWithAddr, false)
 	}
 
 	for _, tc := range tests.cases {
 		request := (&dns.Msg{}).SetQuestion(tc.q, tc.t)
 
-		ci, expired, _ := testCache.get(request)
+		ci, expired, _ := testCache.get(request, false)
 		assert.False(t, expired)
 		tc.ok(t, ci != nil)
 
@@ -544,7 +637,7 @@ func (tests testCases) run(t *testing.T) {
 			Answer: tc.a,
 		}).SetQuestion(tc.q, tc.t)
 
-		testCache.set(reply, upstreamWithAddr)
+		testCache.set(reply, upstreamWithAddr, false)
 
 		requireEqualMsgs(t, ci.m, reply)
 	}
@@ -591,20 +684,20 @@ func setAndGetCache(t *testing.T, c *cache, g *sync.WaitGroup, host, ip string)
 		Answer: []dns.RR{newRR(t, host, dns.TypeA, 1, ipAddr)},
 	}).SetQuestion(host, dns.TypeA)
 
-	c.set(dnsMsg, upstreamWithAddr)
+	c.set(dnsMsg, upstreamWithAddr, false)
 
 	for range 2 {
-		ci, expired, key := c.get(dnsMsg)
+		ci, expired, key := c.get(dnsMsg, false)
 		require.NotNilf(t, ci, "no cache found for %s", host)
 
 		assert.False(t, expired)
-		assert.Equal(t, msgToKey(dnsMsg), key)
+		assert.Equal(t, msgToKey(dnsMsg, false), key)
 
 		requireEqualMsgs(t, ci.m, dnsMsg)
 	}
 
 	assert.Eventuallyf(t, func() bool {
-		ci, _, _ := c.get(dnsMsg)
+		ci, _, _ := c.get(dnsMsg, false)
 
 		return ci == nil
 	}, 1100*time.Millisecond, 100*time.Millisecond, "cache for %s should already be removed", host)
@@ -621,7 +714,7 @@ func TestCache_getWithSubnet(t *testing.T) {
 	c := newCache(testCacheSize, true, false)
 
 	t.Run("empty", func(t *testing.T) {
-		ci, expired, _ := c.getWithSubnet(req, &net.IPNet{IP: ip1234, Mask: mask24})
+		ci, expired, _ := c.getWithSubnet(req, false, &net.IPNet{IP: ip1234, Mask: mask24})
 		assert.Nil(t, ci)
 		assert.False(t, expired)
 	})
@@ -630,12 +723,12 @@ func TestCache_getWithSubnet(t *testing.T) {
 	resp := (&dns.Msg{
 		Answer: []dns.RR{newRR(t, testFQDN, dns.TypeA, 1, net.IP{1, 1, 1, 1})},
 	}).SetReply(req)
-	c.setWithSubnet(resp, upstreamWithAddr, &net.IPNet{IP: ip1234, Mask: mask16})
+	c.setWithSubnet(resp, upstreamWithAddr, false, &net.IPNet{IP: ip1234, Mask: mask16})
 
 	t.Run("different_ip", func(t *testing.T) {
-		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip2234, Mask: mask24})
+		ci, expired, key := c.getWithSubnet(req, false, &net.IPNet{IP: ip2234, Mask: mask24})
 		assert.False(t, expired)
-		assert.Equal(t, msgToKeyWithSubnet(req, ip2234, 0), key)
+		assert.Equal(t, msgToKeyWithSubnet(req, false, ip2234, 0), key)
 		assert.Nil(t, ci)
 	})
 
@@ -643,18 +736,18 @@ func TestCache_getWithSubnet(t *testing.T) {
 	resp = (&dns.Msg{
 		Answer: []dns.RR{newRR(t, testFQDN, dns.TypeA, 1, net.IP{2, 2, 2, 2})},
 	}).SetReply(req)
-	c.setWithSubnet(resp, upstreamWithAddr, &net.IPNet{IP: ip2234, Mask: mask16})
+	c.setWithSubnet(resp, upstreamWithAddr, false, &net.IPNet{IP: ip2234, Mask: mask16})
 
 	// Add a response entry without subnet.
 	resp = (&dns.Msg{
 		Answer: []dns.RR{newRR(t, testFQDN, dns.TypeA, 1, net.IP{3, 3, 3, 3})},
 	}).SetReply(req)
-	c.setWithSubnet(resp, upstreamWithAddr, &net.IPNet{IP: nil, Mask: nil})
+	c.setWithSubnet(resp, upstreamWithAddr, false, &net.IPNet{IP: nil, Mask: nil})
 
 	t.Run("with_subnet_1", func(t *testing.T) {
-		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip1234, Mask: mask24})
+		ci, expired, key := c.getWithSubnet(req, false, &net.IPNet{IP: ip1234, Mask: mask24})
 		assert.False(t, expired)
-		assert.Equal(t, msgToKeyWithSubnet(req, ip1234.Mask(mask16), 16), key)
+		assert.Equal(t, msgToKeyWithSubnet(req, false, ip1234.Mask(mask16), 16), key)
 
 		require.NotNil(t, ci)
 		require.NotNil(t, ci.m)
@@ -665,9 +758,9 @@ func TestCache_getWithSubnet(t *testing.T) {
 	})
 
 	t.Run("with_subnet_2", func(t *testing.T) {
-		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip2234, Mask: mask24})
+		ci, expired, key := c.getWithSubnet(req, false, &net.IPNet{IP: ip2234, Mask: mask24})
 		assert.False(t, expired)
-		assert.Equal(t, msgToKeyWithSubnet(req, ip2234.Mask(mask16), 16), key)
+		assert.Equal(t, msgToKeyWithSubnet(req, false, ip2234.Mask(mask16), 16), key)
 
 		require.NotNil(t, ci)
 		require.NotNil(t, ci.m)
@@ -678,9 +771,9 @@ func TestCache_getWithSubnet(t *testing.T) {
 	})
 
 	t.Run("with_subnet_3", func(t *testing.T) {
-		ci, expired, key := c.getWithSubnet(req, &net.IPNet{IP: ip3234, Mask: mask24})
+		ci, expired, key := c.getWithSubnet(req, false, &net.IPNet{IP: ip3234, Mask: mask24})
 		assert.False(t, expired)
-		assert.Equal(t, msgToKeyWithSubnet(req, ip1234, 0), key)
+		assert.Equal(t, msgToKeyWithSubnet(req, false, ip1234, 0), key)
 
 		require.NotNil(t, ci)
 		require.NotNil(t, ci.m)
@@ -715,16 +808,17 @@ func TestCache_getWithSubnet_mask(t *testing.T) {
 	c.setWithSubnet(
 		resp,
 		upstreamWithAddr,
+		false,
 		&net.IPNet{IP: cachedIP, Mask: cidrMask},
 	)
 
 	t.Run("mask_matched", func(t *testing.T) {
-		ci, expired, key := c.getWithSubnet(req, &net.IPNet{
+		ci, expired, key := c.getWithSubnet(req, false, &net.IPNet{
 			IP:   testIP,
 			Mask: net.CIDRMask(24, netutil.IPv4BitLen),
 		})
 		assert.False(t, expired)
-		assert.Equal(t, msgToKeyWithSubnet(req, testIP.Mask(cidrMask), cidrMaskOnes), key)
+		assert.Equal(t, msgToKeyWithSubnet(req, false, testIP.Mask(cidrMask), cidrMaskOnes), key)
 
 		require.NotNil(t, ci)
 		require.NotNil(t, ci.m)
@@ -735,12 +829,12 @@ func TestCache_getWithSubnet_mask(t *testing.T) {
 	})
 
 	t.Run("no_mask_matched", func(t *testing.T) {
-		ci, expired, key := c.getWithSubnet(req, &net.IPNet{
+		ci, expired, key := c.getWithSubnet(req, false, &net.IPNet{
 			IP:   noMatchIP,
 			Mask: net.CIDRMask(24, netutil.IPv4BitLen),
 		})
 		assert.False(t, expired)
-		assert.Equal(t, msgToKeyWithSubnet(req, noMatchIP, 0), key)
+		assert.Equal(t, msgToKeyWithSubnet(req, false, noMatchIP, 0), key)
 		assert.Nil(t, ci)
 	})
 }
@@ -777,11 +871,26 @@ func TestCache_IsCacheable_negative(t *testing.T) {
 				Class:  dns.ClassINET,
 				Ttl:    someTTL,
 			},
-			Ns:   ns,
-			Mbox: mbox,
+			Ns:     ns,
+			Mbox:   mbox,
+			Minttl: someTTL,
 		}
 	}
 
+	soaMinAns := func(name, ns, mbox string, minimum uint32) (rr dns.RR) {
+		soa := soaAns(name, ns, mbox).(*dns.SOA)
+		soa.Minttl = minimum
+
+		return soa
+	}
+
+	shortCNAMEAns := func(name, cname string, ttl uint32) (rr dns.RR) {
+		rr = cnameAns(name, cname)
+		rr.Header().Ttl = ttl
+
+		return rr
+	}
+
 	nsAns := func(name, ns string) (rr dns.RR) {
 		return &dns.NS{
 			Hdr: dns.RR_Header{
@@ -939,6 +1048,43 @@ func TestCache_IsCacheable_negative(t *testing.T) {
 		},
 		name:    "servfail_response",
 		wantTTL: ServFailMaxCacheTTL,
+	}, {
+		req: &dns.Msg{
+			MsgHdr:   msgHdr(dns.RcodeSuccess),
+			Question: aQuestions(anotherHostname),
+			Ns:       []dns.RR{soaMinAns(xx, ns1, mbox, someTTL/2)},
+		},
+		name:    "nodata_soa_minimum",
+		wantTTL: someTTL / 2,
+	}, {
+		req: &dns.Msg{
+			MsgHdr:   msgHdr(dns.RcodeNameError),
+			Question: aQuestions(hostname),
+			Answer:   []dns.RR{cnameAns(hostname, cname)},
+			Ns:       []dns.RR{soaMinAns(xx, ns1, mbox, someTTL/2)},
+		},
+		name:    "nxdomain_cname_soa_minimum",
+		wantTTL: someTTL / 2,
+	}, {
+		req: &dns.Msg{
+			MsgHdr:   msgHdr(dns.RcodeNameError),
+			Question: aQuestions(hostname),
+			Answer: []dns.RR{
+				cnameAns(hostname, anotherHostname),
+				shortCNAMEAns(anotherHostname, cname, someTTL/4),
+			},
+			Ns: []dns.RR{soaMinAns(xx, ns1, mbox, someTTL/2)},
+		},
+		name:    "nxdomain_cname_chain_ttl",
+		wantTTL: someTTL / 4,
+	}, {
+		req: &dns.Msg{
+			MsgHdr:   msgHdr(dns.RcodeNameError),
+			Question: aQuestions(hostname),
+			Ns:       []dns.RR{soaMinAns(xx, ns1, mbox, 0)},
+		},
+		name:    "nxdomain_zero_soa_minimum",
+		wantTTL: 0,
 	}}
 
 	for _, tc := range testCases {
@@ -947,3 +1093,210 @@ func TestCache_IsCacheable_negative(t *testing.T) {
 		})
 	}
 }
+
+func TestCache_negativeTTL(t *testing.T) {
+	const (
+		host     = "nx.example."
+		cname    = "cname.example."
+		soaTTL   = 3600
+		minTTL   = 1800
+		cnameTTL = 600
+	)
+
+	newResp := func(withCNAME bool) (m *dns.Msg) {
+		m = (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		m.Response = true
+		m.Rcode = dns.RcodeNameError
+		if withCNAME {
+			m.Answer = []dns.RR{&dns.CNAME{
+				Hdr: dns.RR_Header{
+					Name:   host,
+					Rrtype: dns.TypeCNAME,
+					Class:  dns.ClassINET,
+					Ttl:    cnameTTL,
+				},
+				Target: cname,
+			}}
+		}
+
+		m.Ns = []dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   "example.",
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    soaTTL,
+			},
+			Ns:     "ns.example.",
+			Mbox:   "hostmaster.example.",
+			Minttl: minTTL,
+		}}
+
+		return m
+	}
+
+	testCases := []struct {
+		name      string
+		minTTL    uint32
+		maxTTL    uint32
+		withCNAME bool
+		wantTTL   uint32
+	}{{
+		name:      "soa_minimum",
+		minTTL:    0,
+		maxTTL:    0,
+		withCNAME: false,
+		wantTTL:   minTTL,
+	}, {
+		name:      "max",
+		minTTL:    0,
+		maxTTL:    300,
+		withCNAME: false,
+		wantTTL:   300,
+	}, {
+		name:      "min",
+		minTTL:    7200,
+		maxTTL:    0,
+		withCNAME: false,
+		wantTTL:   7200,
+	}, {
+		name:      "cname",
+		minTTL:    0,
+		maxTTL:    0,
+		withCNAME: true,
+		wantTTL:   cnameTTL,
+	}, {
+		name:      "cname_max",
+		minTTL:    0,
+		maxTTL:    300,
+		withCNAME: true,
+		wantTTL:   300,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCache(testCacheSize, false, false)
+			c.negativeMinTTL = tc.minTTL
+			c.negativeMaxTTL = tc.maxTTL
+
+			resp := newResp(tc.withCNAME)
+			c.set(resp, nil, false)
+
+			ci, expired, _ := c.get(newResp(false), false)
+			require.NotNil(t, ci)
+			require.False(t, expired)
+
+			assert.Equal(t, dns.RcodeNameError, ci.m.Rcode)
+			assert.InDelta(t, tc.wantTTL, ci.ttl, 1)
+			for _, rr := range append(ci.m.Answer, ci.m.Ns...) {
+				assert.InDelta(t, tc.wantTTL, rr.Header().Ttl, 1)
+			}
+		})
+	}
+
+	t.Run("positive", func(t *testing.T) {
+		c := newCache(testCacheSize, false, false)
+		c.negativeMaxTTL = 300
+
+		resp := newResp(false)
+		resp.Rcode = dns.RcodeSuccess
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   host,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    cnameTTL,
+			},
+			A: net.IP{192, 0, 2, 1},
+		}}
+		resp.Ns = nil
+		c.set(resp, nil, false)
+
+		ci, _, _ := c.get(newResp(false), false)
+		require.NotNil(t, ci)
+
+		assert.InDelta(t, cnameTTL, ci.ttl, 1)
+	})
+}
+
+func TestProxy_setMinMaxTTL_negative(t *testing.T) {
+	p := &Proxy{Config: Config{
+		CacheMinTTL:         60,
+		CacheNegativeMaxTTL: 300,
+	}}
+
+	resp := (&dns.Msg{}).SetQuestion("nx.example.", dns.TypeAAAA)
+	resp.Response = true
+	resp.Ns = []dns.RR{&dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   "example.",
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Ns:     "ns.example.",
+		Mbox:   "hostmaster.example.",
+		Minttl: 1800,
+	}}
+
+	p.setMinMaxTTL(resp)
+	assert.Equal(t, uint32(300), resp.Ns[0].Header().Ttl)
+
+	resp.Ns[0].(*dns.SOA).Minttl = 10
+	resp.Ns[0].Header().Ttl = 3600
+
+	p.setMinMaxTTL(resp)
+	assert.Equal(t, uint32(10), resp.Ns[0].Header().Ttl)
+}
+
+func TestProxy_Resolve_cachedResponseHandler(t *testing.T) {
+	testCases := []struct {
+		name           string
+		handleCached   bool
+		wantHandledNum int
+	}{{
+		name:           "handle_cached",
+		handleCached:   true,
+		wantHandledNum: 2,
+	}, {
+		name:           "upstream_only",
+		handleCached:   false,
+		wantHandledNum: 1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var handled []*dns.Msg
+			p := mustNew(t, &Config{
+				UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{
+						newRaceUpstream("upstream", net.IP{192, 0, 2, 1}, nil),
+					},
+				},
+				TrustedProxies: defaultTrustedProxies,
+				CacheEnabled:   true,
+				CacheSizeBytes: defaultCacheSize,
+				ResponseHandler: func(dctx *DNSContext, err error) {
+					require.NoError(t, err)
+
+					handled = append(handled, dctx.Res)
+				},
+				HandleCachedResponses: tc.handleCached,
+			})
+
+			for range 2 {
+				err := p.Resolve(&DNSContext{
+					Req: (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA),
+				})
+				require.NoError(t, err)
+			}
+
+			require.Len(t, handled, tc.wantHandledNum)
+
+			for _, resp := range handled {
+				require.NotNil(t, resp)
+				require.Len(t, resp.Answer, 1)
+			}
+		})
+	}
+}
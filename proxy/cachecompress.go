@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// compressBufPool is the pool of buffers for compressing and decompressing the
+// cache items.
+var compressBufPool = &sync.Pool{
+	New: func() (v any) { return &bytes.Buffer{} },
+}
+
+// flateWriterPool is the pool of *flate.Writer for compressing the cache
+// items.
+var flateWriterPool = &sync.Pool{
+	New: func() (v any) {
+		// The error is only returned for invalid levels.
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+
+		return w
+	},
+}
+
+// flateReaderPool is the pool of flate readers for decompressing the cache
+// items.
+var flateReaderPool = &sync.Pool{
+	New: func() (v any) { return flate.NewReader(nil) },
+}
+
+// compress returns packed with its message and upstream address compressed, if
+// compression is enabled for c, packed is at least as large as the threshold,
+// and compressing makes it smaller.  Otherwise, it returns packed itself.  The
+// compressed item has the zero message length followed by the compressed
+// data, so that it can't be confused with the uncompressed one.
+func (c *cache) compress(packed []byte) (res []byte) {
+	if c.compressMinSize <= 0 || len(packed) < c.compressMinSize {
+		return packed
+	}
+
+	buf := compressBufPool.Get().(*bytes.Buffer)
+	defer compressBufPool.Put(buf)
+
+	buf.Reset()
+	_, _ = buf.Write(packed[:expTimeSz])
+	_, _ = buf.Write([]byte{0, 0})
+
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+
+	w.Reset(buf)
+	_, err := w.Write(packed[expTimeSz:])
+	if err == nil {
+		err = w.Close()
+	}
+
+	if err != nil {
+		// Shouldn't happen, since the writes to *bytes.Buffer never fail.
+		log.Debug("dnsproxy: cache: compressing item: %s", err)
+
+		return packed
+	}
+
+	if buf.Len() >= len(packed) {
+		return packed
+	}
+
+	return bytes.Clone(buf.Bytes())
+}
+
+// unpackMsg unpacks the message and the upstream address from data, which is
+// the part of the packed cache item following the expiration time.  It
+// decompresses data, if it's compressed.
+func unpackMsg(data []byte) (m *dns.Msg, upsAddr string, ok bool) {
+	if len(data) <= packedMsgLenSz || binary.BigEndian.Uint16(data) != 0 {
+		return unpackPlainMsg(data)
+	}
+
+	buf := compressBufPool.Get().(*bytes.Buffer)
+	defer compressBufPool.Put(buf)
+
+	buf.Reset()
+	err := decompress(buf, data[packedMsgLenSz:])
+	if err != nil {
+		log.Debug("dnsproxy: cache: decompressing item: %s", err)
+
+		return nil, "", false
+	}
+
+	return unpackPlainMsg(buf.Bytes())
+}
+
+// decompress writes the decompressed data to buf.
+func decompress(buf *bytes.Buffer, data []byte) (err error) {
+	r := flateReaderPool.Get().(io.ReadCloser)
+	defer flateReaderPool.Put(r)
+
+	err = r.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	_, err = buf.ReadFrom(r)
+
+	// Don't wrap the error since it's informative enough as is.
+	return err
+}
+
+// unpackPlainMsg unpacks the message and the upstream address from the
+// uncompressed data.
+func unpackPlainMsg(data []byte) (m *dns.Msg, upsAddr string, ok bool) {
+	if len(data) < packedMsgLenSz {
+		return nil, "", false
+	}
+
+	b := bytes.NewBuffer(data)
+	l := int(binary.BigEndian.Uint16(b.Next(packedMsgLenSz)))
+	if l == 0 {
+		return nil, "", false
+	}
+
+	m = &dns.Msg{}
+	if m.Unpack(b.Next(l)) != nil {
+		return nil, "", false
+	}
+
+	return m, string(b.Next(b.Len())), true
+}
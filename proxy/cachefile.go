@@ -0,0 +1,423 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// cacheFileMagic is the magic string the cache file starts with.
+	cacheFileMagic = "DPXC"
+
+	// cacheFileVersion is the version of the format of the cache file.  It must
+	// be incremented on any incompatible change of the format.
+	cacheFileVersion uint8 = 1
+
+	// cacheFileQueueLen is the maximum number of the items waiting to be
+	// written to the cache file.  The items set while the queue is full aren't
+	// written.
+	cacheFileQueueLen = 1024
+
+	// cacheFileSizeFactor is the ratio of the default maximum size of the cache
+	// file to the size of the cache.
+	cacheFileSizeFactor = 4
+)
+
+// cacheFile is the file backing a [cache], so that the cached responses survive
+// restarts.  The file is an append-only log of the cache items, written behind
+// the cache by a separate goroutine, so that writing doesn't block the
+// requests.  Once it exceeds the maximum size, it's rewritten with the most
+// recently used unexpired items from the cache taking at most half of it.
+//
+// The file starts with the "DPXC" magic string and the version byte followed by
+// the sections in the format of [Proxy.ExportState], each containing one or
+// more cache items.
+type cacheFile struct {
+	// cache is the cache backed by the file.
+	cache *cache
+
+	// queue are the records waiting to be written.
+	queue chan []byte
+
+	// clears signals the writer that the cache has been cleared.
+	clears chan unit
+
+	// mu protects stop and done.
+	mu *sync.Mutex
+
+	// stop is closed to stop the writer.  It's nil if the writer isn't
+	// running.
+	stop chan unit
+
+	// done receives the result of the writer once it's stopped.
+	done chan error
+
+	// path is the path to the file.
+	path string
+
+	// maxSize is the size of the file in bytes, after which it's rewritten.
+	maxSize int64
+}
+
+// newCacheFile returns a new *cacheFile at path backing c.  maxSize is the size
+// of the file after which it's rewritten.
+func newCacheFile(path string, maxSize int64, c *cache) (f *cacheFile) {
+	return &cacheFile{
+		cache:   c,
+		queue:   make(chan []byte, cacheFileQueueLen),
+		clears:  make(chan unit, 1),
+		mu:      &sync.Mutex{},
+		path:    path,
+		maxSize: maxSize,
+	}
+}
+
+// add queues the item with key and packed value to be written to the section
+// sec of the file.  It doesn't block.
+func (f *cacheFile) add(sec stateSection, key, val []byte) {
+	e := &stateEncoder{}
+	e.bytes(key)
+	e.bytes(val)
+	e.uint(0)
+
+	select {
+	case f.queue <- appendStateSection(nil, sec, e.buf):
+		// Go on.
+	default:
+		log.Debug("dnsproxy: cache file: queue is full; skipping item")
+	}
+}
+
+// clear makes the writer drop the queued items and rewrite the file with the
+// current items of the cache.  It doesn't block.
+func (f *cacheFile) clear() {
+	select {
+	case f.clears <- unit{}:
+	default:
+	}
+}
+
+// load restores the unexpired items from the file into the cache.  A missing
+// file isn't an error, and the malformed tail of the file, e.g. an item written
+// partially before a crash, is ignored.
+func (f *cacheFile) load() (err error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading cache file: %w", err)
+	}
+
+	if !bytes.HasPrefix(data, []byte(cacheFileMagic)) || len(data) < len(cacheFileMagic)+1 {
+		return fmt.Errorf("%w: bad magic", errBadState)
+	}
+
+	data = data[len(cacheFileMagic):]
+	if v := data[0]; v != cacheFileVersion {
+		return fmt.Errorf("unsupported cache file version %d", v)
+	}
+
+	now := uint32(time.Now().Unix())
+
+	var n int
+	for data = data[1:]; len(data) >= stateSectionHdrLen; {
+		sec := stateSection(data[0])
+		l := binary.BigEndian.Uint32(data[1:])
+		data = data[stateSectionHdrLen:]
+		if uint64(len(data)) < uint64(l) {
+			log.Debug("dnsproxy: cache file: truncated section %s", sec)
+
+			break
+		}
+
+		n += f.loadSection(sec, &stateDecoder{data: data[:l]}, now)
+		data = data[l:]
+	}
+
+	log.Info("dnsproxy: cache file: loaded %d items", n)
+
+	return nil
+}
+
+// loadSection restores the items of the section sec from d into the cache,
+// skipping the ones expired at now, and returns their number.
+func (f *cacheFile) loadSection(sec stateSection, d *stateDecoder, now uint32) (n int) {
+	var s *cacheStore
+	switch sec {
+	case stateSectionCache:
+		s = f.cache.items
+	case stateSectionCacheWithSubnet:
+		s = f.cache.itemsWithSubnet
+	}
+
+	if s == nil {
+		return 0
+	}
+
+	for d.more() {
+		key, val, flags := d.bytes(), d.bytes(), d.uint()
+		if d.err != nil {
+			log.Debug("dnsproxy: cache file: section %s: %s", sec, d.err)
+
+			break
+		}
+
+		e := &storeEntry{val: val}
+		if !e.expired(now) {
+			s.restore(string(key), val, flags&1 != 0)
+			n++
+		}
+	}
+
+	return n
+}
+
+// start rewrites the file with the items of the cache and starts the writer.
+// It's a no-op if the writer is already running.
+func (f *cacheFile) start() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stop != nil {
+		return nil
+	}
+
+	file, size, err := f.rewrite()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	f.stop = make(chan unit)
+	f.done = make(chan error, 1)
+
+	go f.write(file, size, f.stop, f.done)
+
+	return nil
+}
+
+// type check
+var _ io.Closer = (*cacheFile)(nil)
+
+// Close implements the [io.Closer] interface for *cacheFile.  It stops the
+// writer, once the queued items are written.
+func (f *cacheFile) Close() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stop == nil {
+		return nil
+	}
+
+	close(f.stop)
+	err = <-f.done
+	f.stop, f.done = nil, nil
+
+	if err != nil {
+		return fmt.Errorf("cache file: %w", err)
+	}
+
+	return nil
+}
+
+// write writes the queued items to file of size bytes until stop is closed,
+// then sends the result to done.  file is nil while the items are discarded
+// after a failed rewrite.
+func (f *cacheFile) write(file *os.File, size int64, stop <-chan unit, done chan<- error) {
+	defer log.OnPanic("cache file")
+
+	w := bufio.NewWriter(file)
+	for {
+		var err error
+		select {
+		case rec := <-f.queue:
+			size, err = f.writeRecord(&file, w, size, rec)
+		case <-f.clears:
+			f.drain()
+			file, size, err = f.reopen(file, w)
+		case <-stop:
+			done <- f.finish(file, w, size)
+
+			return
+		}
+
+		if err != nil {
+			log.Error("dnsproxy: cache file: %s", err)
+		}
+	}
+}
+
+// finish handles the pending clearing of the cache and the queued items, then
+// closes file, if any.
+func (f *cacheFile) finish(file *os.File, w *bufio.Writer, size int64) (err error) {
+	select {
+	case <-f.clears:
+		f.drain()
+		file, _, err = f.reopen(file, w)
+	default:
+		for len(f.queue) > 0 && err == nil {
+			size, err = f.writeRecord(&file, w, size, <-f.queue)
+		}
+	}
+
+	err = errors.Join(err, w.Flush())
+	if file != nil {
+		err = errors.Join(err, file.Close())
+	}
+
+	return err
+}
+
+// writeRecord writes rec to w over *file of size bytes and returns the new
+// size, rewriting the file if it exceeds the maximum size.
+func (f *cacheFile) writeRecord(
+	file **os.File,
+	w *bufio.Writer,
+	size int64,
+	rec []byte,
+) (newSize int64, err error) {
+	n, err := w.Write(rec)
+	size += int64(n)
+	if err != nil {
+		return size, fmt.Errorf("writing item: %w", err)
+	}
+
+	if size > f.maxSize {
+		*file, size, err = f.reopen(*file, w)
+
+		return size, err
+	}
+
+	// Flush once the queue is empty, so that the items get to the file soon
+	// without a write per item under load.
+	if len(f.queue) == 0 {
+		err = w.Flush()
+		if err != nil {
+			return size, fmt.Errorf("flushing: %w", err)
+		}
+	}
+
+	return size, nil
+}
+
+// reopen closes file, if any, rewrites it with the items of the cache, and
+// resets w to write to the new file.  newFile is nil if rewriting fails, in
+// which case w discards the items until the next successful rewrite.
+func (f *cacheFile) reopen(file *os.File, w *bufio.Writer) (newFile *os.File, size int64, err error) {
+	w.Reset(io.Discard)
+	if file != nil {
+		err = file.Close()
+		if err != nil {
+			log.Debug("dnsproxy: cache file: closing: %s", err)
+		}
+	}
+
+	newFile, size, err = f.rewrite()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	w.Reset(newFile)
+
+	return newFile, size, nil
+}
+
+// drain drops the queued items.
+func (f *cacheFile) drain() {
+	for len(f.queue) > 0 {
+		<-f.queue
+	}
+}
+
+// rewrite atomically replaces the file with the most recently used unexpired
+// items of the cache taking at most half of the maximum size, and returns it
+// opened for appending along with its size.
+func (f *cacheFile) rewrite() (file *os.File, size int64, err error) {
+	buf := append([]byte(cacheFileMagic), cacheFileVersion)
+
+	// Split the space between the stores evenly.
+	limit := f.maxSize / 2
+	if f.cache.itemsWithSubnet != nil {
+		limit /= 2
+	}
+
+	now := uint32(time.Now().Unix())
+	buf = appendStateSection(buf, stateSectionCache, exportRecent(f.cache.items, now, limit))
+	if f.cache.itemsWithSubnet != nil {
+		buf = appendStateSection(
+			buf,
+			stateSectionCacheWithSubnet,
+			exportRecent(f.cache.itemsWithSubnet, now, limit),
+		)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	_, err = tmp.Write(buf)
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+
+	if err != nil {
+		return nil, 0, errors.WithDeferred(
+			fmt.Errorf("writing cache file: %w", err),
+			os.Remove(tmp.Name()),
+		)
+	}
+
+	file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("opening cache file: %w", err)
+	}
+
+	return file, int64(len(buf)), nil
+}
+
+// exportRecent returns the most recently used items of s unexpired at now and
+// taking at most limit bytes encoded as a section payload.
+func exportRecent(s *cacheStore, now uint32, limit int64) (payload []byte) {
+	var recs [][]byte
+	s.export(func(key string, val []byte, frequent bool) {
+		if (&storeEntry{val: val}).expired(now) {
+			return
+		}
+
+		e := &stateEncoder{}
+		e.bytes([]byte(key))
+		e.bytes(val)
+
+		var flags uint64
+		if frequent {
+			flags = 1
+		}
+
+		e.uint(flags)
+		recs = append(recs, e.buf)
+	})
+
+	// The items are exported from the least recently used, so keep the tail.
+	first := len(recs)
+	for size := int64(0); first > 0; first-- {
+		size += int64(len(recs[first-1]))
+		if size > limit {
+			break
+		}
+	}
+
+	return bytes.Join(recs[first:], nil)
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCacheFile returns a new cache backed by the started file at path with
+// maxSize.
+func newTestCacheFile(t *testing.T, path string, maxSize int64) (c *cache) {
+	t.Helper()
+
+	c = newCache(0, false, false)
+	c.file = newCacheFile(path, maxSize, c)
+	require.NoError(t, c.file.load())
+	require.NoError(t, c.file.start())
+
+	return c
+}
+
+// setTestReply caches the reply to the request for host with ttl in c.
+func setTestReply(t *testing.T, c *cache, host string, ttl uint32) (req *dns.Msg) {
+	t.Helper()
+
+	req = (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	reply := (&dns.Msg{
+		Answer: []dns.RR{newRR(t, host, dns.TypeA, ttl, net.IP{192, 0, 2, 1})},
+	}).SetReply(req)
+	c.set(reply, upstreamWithAddr, false)
+
+	return req
+}
+
+func TestCacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+
+	src := newTestCacheFile(t, path, 1<<20)
+	req := setTestReply(t, src, "example.org.", 3600)
+
+	expiredVal := binary.BigEndian.AppendUint32(nil, uint32(time.Now().Unix()-1))
+	src.file.add(stateSectionCache, []byte("expired"), expiredVal)
+
+	require.NoError(t, src.file.Close())
+
+	// Emulate an item written partially before a crash.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte{byte(stateSectionCache), 0, 0, 1})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	dst := newTestCacheFile(t, path, 1<<20)
+	t.Cleanup(func() { require.NoError(t, dst.file.Close()) })
+
+	ci, expired, _ := dst.get(req, false)
+	require.NotNil(t, ci)
+
+	assert.False(t, expired)
+	assert.Equal(t, upstreamWithAddr.Address(), ci.u)
+
+	assert.Nil(t, dst.items.get([]byte("expired")))
+}
+
+func TestCacheFile_rewrite(t *testing.T) {
+	const maxSize = 2048
+
+	path := filepath.Join(t.TempDir(), "cache")
+
+	c := newTestCacheFile(t, path, maxSize)
+
+	var last *dns.Msg
+	for i := range 100 {
+		last = setTestReply(t, c, fmt.Sprintf("host-%d.example.", i), 3600)
+	}
+
+	require.NoError(t, c.file.Close())
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+
+	assert.LessOrEqual(t, fi.Size(), int64(maxSize))
+
+	// The most recently used items are kept.
+	loaded := newTestCacheFile(t, path, maxSize)
+	t.Cleanup(func() { require.NoError(t, loaded.file.Close()) })
+
+	ci, _, _ := loaded.get(last, false)
+	assert.NotNil(t, ci)
+}
+
+func TestProxy_ClearCache_cacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+
+	c := newTestCacheFile(t, path, 1<<20)
+	req := setTestReply(t, c, "example.org.", 3600)
+
+	p := &Proxy{cache: c}
+	p.ClearCache()
+
+	require.NoError(t, c.file.Close())
+
+	loaded := newTestCacheFile(t, path, 1<<20)
+	t.Cleanup(func() { require.NoError(t, loaded.file.Close()) })
+
+	ci, _, _ := loaded.get(req, false)
+	assert.Nil(t, ci)
+}
+
+func TestCacheFile_rewriteFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, os.Mkdir(dir, 0o700))
+
+	c := newTestCacheFile(t, filepath.Join(dir, "cache"), 1<<20)
+	setTestReply(t, c, "example.org.", 3600)
+
+	// Make the rewriting fail.
+	require.NoError(t, os.RemoveAll(dir))
+
+	c.file.clear()
+	setTestReply(t, c, "example.net.", 3600)
+
+	// The file closed before the failed rewrite isn't closed again.
+	assert.NotErrorIs(t, c.file.Close(), os.ErrClosed)
+}
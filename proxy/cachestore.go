@@ -0,0 +1,416 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// cacheItemOverhead is the approximate number of bytes taken by the
+// bookkeeping of a single item of [cacheStore] in addition to its key and
+// value: the list element, the entry itself, and the map bucket slot.
+const cacheItemOverhead = 128
+
+// defaultLowWatermarkRatio is the default low watermark of [cacheStore] as the
+// share of its high watermark.
+const defaultLowWatermarkRatio = 7.0 / 8.0
+
+// CacheStats are the statistics of the DNS cache.
+type CacheStats struct {
+	// Size is the current size of the cached items in bytes, including the
+	// per-item overhead.
+	Size int
+
+	// HighWatermark is the size in bytes over which the cache starts evicting
+	// the items, see [Config.CacheSizeBytes].
+	HighWatermark int
+
+	// LowWatermark is the size in bytes the eviction shrinks the cache to, see
+	// [Config.CacheLowWatermark].
+	LowWatermark int
+
+	// Count is the number of the cached items.
+	Count int
+
+	// Hits is the number of the lookups that found an item.
+	Hits uint64
+
+	// Misses is the number of the lookups that found nothing.
+	Misses uint64
+
+	// Evictions is the number of the items evicted to free the space,
+	// including the expired ones.
+	Evictions uint64
+
+	// Expired is the number of the expired items evicted before the live ones.
+	Expired uint64
+}
+
+// add adds the counters of other to s.  The watermarks are taken from other if
+// s has none.
+func (s *CacheStats) add(other CacheStats) {
+	s.Size += other.Size
+	s.Count += other.Count
+	s.Hits += other.Hits
+	s.Misses += other.Misses
+	s.Evictions += other.Evictions
+	s.Expired += other.Expired
+
+	if s.HighWatermark == 0 {
+		s.HighWatermark = other.HighWatermark
+		s.LowWatermark = other.LowWatermark
+	}
+}
+
+// storeEntry is a single item of [cacheStore].
+type storeEntry struct {
+	// key is the key of the item.
+	key string
+
+	// val is the packed cache item, which starts with its expiration time.
+	val []byte
+
+	// size is the accounted size of the item.
+	size int
+
+	// frequent is true if the item is in the list of the frequently used
+	// items.
+	frequent bool
+}
+
+// expired returns true if the item is expired at now, the Unix time.
+func (e *storeEntry) expired(now uint32) (ok bool) {
+	return len(e.val) < expTimeSz || binary.BigEndian.Uint32(e.val) <= now
+}
+
+// ghostEntry is the key of an evicted item remembered by [cacheStore] to adapt
+// the eviction to the workload.
+type ghostEntry struct {
+	// key is the key of the evicted item.
+	key string
+
+	// frequent is true if the item was evicted from the list of the frequently
+	// used items.
+	frequent bool
+}
+
+// cacheStore is an in-memory store of the packed cache items limited by their
+// size in bytes.  It evicts the items once their size exceeds the high
+// watermark until it's not greater than the low watermark.  The expired items
+// are evicted first, and the live ones are evicted by an adaptive replacement
+// policy similar to ARC: the items used once and the items used repeatedly
+// are kept in separate LRU lists, and the keys of the recently evicted items
+// move the target size of the lists towards the one which would have kept
+// them.  It's safe for concurrent use.
+type cacheStore struct {
+	// mu protects all the fields below.
+	mu *sync.Mutex
+
+	// items are the entries of the cached items by their keys.
+	items map[string]*list.Element
+
+	// recent are the items used once, the most recently used first.
+	recent *list.List
+
+	// frequent are the items used more than once, the most recently used
+	// first.
+	frequent *list.List
+
+	// ghosts are the entries of the keys of the recently evicted items by the
+	// keys.
+	ghosts map[string]*list.Element
+
+	// ghostList are the keys of the recently evicted items, the most recently
+	// evicted first.
+	ghostList *list.List
+
+	// now returns the current time.  It's replaced in tests.
+	now func() (t time.Time)
+
+	// stats are the counters of the store.  Size and Count aren't maintained.
+	stats CacheStats
+
+	// recentSize and frequentSize are the sizes of the items in recent and
+	// frequent.
+	recentSize   int
+	frequentSize int
+
+	// recentTarget is the adaptive target size of the recent items.
+	recentTarget int
+
+	// ghostSize is the size of the keys in ghostList.
+	ghostSize int
+
+	// high and low are the high and low watermarks.
+	high int
+	low  int
+}
+
+// newCacheStore returns a new properly initialized *cacheStore with the high
+// watermark of size bytes, or [defaultCacheSize] if it's not positive.  The low
+// watermark is set to the default.
+func newCacheStore(size int) (s *cacheStore) {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+
+	s = &cacheStore{
+		mu:        &sync.Mutex{},
+		items:     map[string]*list.Element{},
+		recent:    list.New(),
+		frequent:  list.New(),
+		ghosts:    map[string]*list.Element{},
+		ghostList: list.New(),
+		now:       time.Now,
+		high:      size,
+	}
+	s.setLowWatermark(0)
+
+	return s
+}
+
+// setLowWatermark sets the low watermark of s to low bytes.  If low isn't
+// positive or is greater than the high watermark, the default is used.
+func (s *cacheStore) setLowWatermark(low int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if low <= 0 || low > s.high {
+		low = int(float64(s.high) * defaultLowWatermarkRatio)
+	}
+
+	s.low = low
+}
+
+// get returns the value of the item with key or nil if there is none.  It
+// marks the item as used.
+func (s *cacheStore) get(key []byte) (val []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.items[string(key)]
+	if !ok {
+		s.stats.Misses++
+
+		return nil
+	}
+
+	s.stats.Hits++
+	s.touch(elem)
+
+	return elem.Value.(*storeEntry).val
+}
+
+// touch marks the item of elem as used, promoting it to the frequently used
+// ones.  s.mu must be locked.
+func (s *cacheStore) touch(elem *list.Element) {
+	e := elem.Value.(*storeEntry)
+	if e.frequent {
+		s.frequent.MoveToFront(elem)
+
+		return
+	}
+
+	s.recent.Remove(elem)
+	s.recentSize -= e.size
+
+	e.frequent = true
+	s.items[e.key] = s.frequent.PushFront(e)
+	s.frequentSize += e.size
+}
+
+// set stores val with key.  The items larger than the high watermark aren't
+// stored.
+func (s *cacheStore) set(key, val []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := string(key)
+	size := len(k) + len(val) + cacheItemOverhead
+	if elem, ok := s.items[k]; ok {
+		s.remove(elem)
+		if size <= s.high {
+			s.insert(&storeEntry{key: k, val: val, size: size, frequent: true})
+		}
+	} else if size <= s.high {
+		s.insert(&storeEntry{key: k, val: val, size: size, frequent: s.adapt(k, size)})
+	}
+
+	if s.recentSize+s.frequentSize > s.high {
+		s.evict()
+	}
+}
+
+// adapt moves the target size of the recent items towards the list the item
+// with key was evicted from, if it was, and forgets the key.  frequent is true
+// if the item was evicted recently, so it should be stored as a frequently used
+// one.  s.mu must be locked.
+func (s *cacheStore) adapt(key string, size int) (frequent bool) {
+	elem, ok := s.ghosts[key]
+	if !ok {
+		return false
+	}
+
+	if elem.Value.(*ghostEntry).frequent {
+		s.recentTarget = max(s.recentTarget-size, 0)
+	} else {
+		s.recentTarget = min(s.recentTarget+size, s.high)
+	}
+
+	s.removeGhost(elem)
+
+	return true
+}
+
+// insert adds e to the front of its list.  s.mu must be locked.
+func (s *cacheStore) insert(e *storeEntry) {
+	if e.frequent {
+		s.items[e.key] = s.frequent.PushFront(e)
+		s.frequentSize += e.size
+	} else {
+		s.items[e.key] = s.recent.PushFront(e)
+		s.recentSize += e.size
+	}
+}
+
+// remove removes the item of elem.  s.mu must be locked.
+func (s *cacheStore) remove(elem *list.Element) {
+	e := elem.Value.(*storeEntry)
+	if e.frequent {
+		s.frequent.Remove(elem)
+		s.frequentSize -= e.size
+	} else {
+		s.recent.Remove(elem)
+		s.recentSize -= e.size
+	}
+
+	delete(s.items, e.key)
+}
+
+// evict removes the expired items and then the least valuable live ones until
+// the size of the items isn't greater than the low watermark.  s.mu must be
+// locked.
+func (s *cacheStore) evict() {
+	now := uint32(s.now().Unix())
+	for _, l := range []*list.List{s.recent, s.frequent} {
+		for elem := l.Back(); elem != nil; {
+			prev := elem.Prev()
+			if elem.Value.(*storeEntry).expired(now) {
+				s.remove(elem)
+				s.stats.Expired++
+				s.stats.Evictions++
+			}
+
+			elem = prev
+		}
+	}
+
+	for s.recentSize+s.frequentSize > s.low {
+		l := s.frequent
+		if s.recentSize > 0 && (s.recentSize > s.recentTarget || s.frequentSize == 0) {
+			l = s.recent
+		}
+
+		elem := l.Back()
+		e := elem.Value.(*storeEntry)
+		s.remove(elem)
+		s.addGhost(e)
+		s.stats.Evictions++
+	}
+}
+
+// addGhost remembers the key of the evicted e, forgetting the oldest keys if
+// they take more than a half of the high watermark, which is usually enough to
+// remember about as many keys as there are items.  s.mu must be locked.
+func (s *cacheStore) addGhost(e *storeEntry) {
+	s.ghosts[e.key] = s.ghostList.PushFront(&ghostEntry{key: e.key, frequent: e.frequent})
+	s.ghostSize += len(e.key) + cacheItemOverhead
+
+	for s.ghostSize > s.high/2 {
+		s.removeGhost(s.ghostList.Back())
+	}
+}
+
+// removeGhost forgets the key of elem.  s.mu must be locked.
+func (s *cacheStore) removeGhost(elem *list.Element) {
+	g := elem.Value.(*ghostEntry)
+	s.ghostList.Remove(elem)
+	s.ghostSize -= len(g.key) + cacheItemOverhead
+	delete(s.ghosts, g.key)
+}
+
+// del removes the item with key, if any.
+func (s *cacheStore) del(key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[string(key)]; ok {
+		s.remove(elem)
+	}
+}
+
+// clear removes all the items and forgets the evicted ones.  The counters
+// aren't reset.
+func (s *cacheStore) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clear(s.items)
+	clear(s.ghosts)
+	s.recent.Init()
+	s.frequent.Init()
+	s.ghostList.Init()
+	s.recentSize, s.frequentSize, s.recentTarget, s.ghostSize = 0, 0, 0, 0
+}
+
+// export calls fn for each item of s, the least recently used first within
+// the items used once and then within the items used repeatedly, so that
+// restoring them in the same order keeps their recency.  fn must not use s.
+func (s *cacheStore) export(fn func(key string, val []byte, frequent bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range []*list.List{s.recent, s.frequent} {
+		for elem := l.Back(); elem != nil; elem = elem.Prev() {
+			e := elem.Value.(*storeEntry)
+			fn(e.key, e.val, e.frequent)
+		}
+	}
+}
+
+// restore stores val with key as the most recently used item, as one of the
+// frequently used items if frequent is true.  It replaces the existing item
+// with key, if any.
+func (s *cacheStore) restore(key string, val []byte, frequent bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[key]; ok {
+		s.remove(elem)
+	}
+
+	size := len(key) + len(val) + cacheItemOverhead
+	if size > s.high {
+		return
+	}
+
+	s.insert(&storeEntry{key: key, val: val, size: size, frequent: frequent})
+	if s.recentSize+s.frequentSize > s.high {
+		s.evict()
+	}
+}
+
+// statistics returns the current statistics of s.
+func (s *cacheStore) statistics() (st CacheStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st = s.stats
+	st.Size = s.recentSize + s.frequentSize
+	st.Count = len(s.items)
+	st.HighWatermark = s.high
+	st.LowWatermark = s.low
+
+	return st
+}
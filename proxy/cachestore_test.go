@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStoreValue returns the value for [cacheStore] of size bytes expiring
+// at exp.
+func newTestStoreValue(size int, exp time.Time) (val []byte) {
+	val = make([]byte, size)
+	binary.BigEndian.PutUint32(val, uint32(exp.Unix()))
+
+	return val
+}
+
+func TestCacheStore(t *testing.T) {
+	const (
+		// keyLen is the length of the keys produced by testKey.
+		keyLen = len("key_00")
+
+		valLen   = 100
+		itemSize = keyLen + valLen + cacheItemOverhead
+	)
+
+	testKey := func(i int) (key []byte) { return []byte(fmt.Sprintf("key_%02d", i)) }
+
+	now := time.Now()
+	live := newTestStoreValue(valLen, now.Add(time.Hour))
+	expired := newTestStoreValue(valLen, now.Add(-time.Second))
+
+	newStore := func() (s *cacheStore) {
+		s = newCacheStore(10 * itemSize)
+		s.setLowWatermark(6 * itemSize)
+		s.now = func() (t time.Time) { return now }
+
+		return s
+	}
+
+	t.Run("watermarks", func(t *testing.T) {
+		s := newStore()
+		for i := range 10 {
+			s.set(testKey(i), live)
+		}
+
+		st := s.statistics()
+		assert.Equal(t, 10, st.Count)
+		assert.Equal(t, 10*itemSize, st.Size)
+		assert.Zero(t, st.Evictions)
+
+		s.set(testKey(10), live)
+
+		st = s.statistics()
+		assert.Equal(t, 6, st.Count)
+		assert.Equal(t, 6*itemSize, st.Size)
+		assert.Equal(t, uint64(5), st.Evictions)
+		assert.Equal(t, 10*itemSize, st.HighWatermark)
+		assert.Equal(t, 6*itemSize, st.LowWatermark)
+
+		// The least recently used items are evicted.
+		assert.Nil(t, s.get(testKey(0)))
+		assert.Nil(t, s.get(testKey(4)))
+		assert.NotNil(t, s.get(testKey(5)))
+		assert.NotNil(t, s.get(testKey(10)))
+	})
+
+	t.Run("expired_first", func(t *testing.T) {
+		s := newStore()
+		for i := range 10 {
+			val := live
+			if i%2 == 1 {
+				val = expired
+			}
+
+			s.set(testKey(i), val)
+		}
+
+		s.set(testKey(10), live)
+
+		st := s.statistics()
+		assert.Equal(t, 6, st.Count)
+		assert.Equal(t, uint64(5), st.Expired)
+
+		for i := 0; i <= 10; i += 2 {
+			assert.NotNil(t, s.get(testKey(i)), i)
+		}
+	})
+
+	t.Run("frequent_survive_scan", func(t *testing.T) {
+		s := newStore()
+		for i := range 3 {
+			s.set(testKey(i), live)
+			require.NotNil(t, s.get(testKey(i)))
+		}
+
+		for i := 3; i < 30; i++ {
+			s.set(testKey(i), live)
+		}
+
+		for i := range 3 {
+			assert.NotNil(t, s.get(testKey(i)), i)
+		}
+	})
+
+	t.Run("ghost", func(t *testing.T) {
+		s := newStore()
+		for i := range 11 {
+			s.set(testKey(i), live)
+		}
+
+		require.Nil(t, s.get(testKey(0)))
+
+		// The recently evicted item is stored as a frequently used one and
+		// gets more room for the recent items.
+		s.set(testKey(0), live)
+
+		elem := s.items[string(testKey(0))]
+		require.NotNil(t, elem)
+
+		assert.True(t, elem.Value.(*storeEntry).frequent)
+		assert.Equal(t, itemSize, s.recentTarget)
+	})
+
+	t.Run("too_large", func(t *testing.T) {
+		s := newStore()
+		s.set(testKey(0), live)
+		s.set(testKey(0), newTestStoreValue(10*itemSize, now.Add(time.Hour)))
+
+		assert.Nil(t, s.get(testKey(0)))
+		assert.Zero(t, s.statistics().Size)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		s := newStore()
+		s.set(testKey(0), live)
+		s.clear()
+
+		st := s.statistics()
+		assert.Zero(t, st.Count)
+		assert.Zero(t, st.Size)
+		assert.Nil(t, s.get(testKey(0)))
+	})
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/miekg/dns"
+)
+
+// DefaultCanaryDomains are the well-known canary domains.  The browsers and
+// operating systems check these to decide whether they may bypass the
+// configured DNS resolver, and don't if the domain doesn't resolve.
+var DefaultCanaryDomains = []string{
+	// Firefox disables DNS-over-HTTPS enabled by default, see
+	// https://support.mozilla.org/kb/canary-domain-use-application-dnsnet.
+	"use-application-dns.net",
+
+	// Apple devices disable iCloud Private Relay, see
+	// https://developer.apple.com/support/prepare-your-network-for-icloud-private-relay.
+	"mask.icloud.com",
+	"mask-h2.icloud.com",
+}
+
+// newCanaryDomains returns the set of lowercased fully-qualified domains.
+func newCanaryDomains(domains []string) (set *container.MapSet[string]) {
+	set = container.NewMapSet[string]()
+	for _, d := range domains {
+		set.Add(dns.Fqdn(strings.ToLower(d)))
+	}
+
+	return set
+}
+
+// isCanary returns true if req is a request for one of the canary domains.
+// req must have exactly one question.
+func (p *Proxy) isCanary(req *dns.Msg) (ok bool) {
+	return p.canaryDomains.Len() > 0 && p.canaryDomains.Has(strings.ToLower(req.Question[0].Name))
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_validateRequest_canary(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+		CanaryDomains:  DefaultCanaryDomains,
+	})
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantBlock bool
+	}{{
+		name:      "mozilla",
+		host:      "use-application-dns.net.",
+		wantBlock: true,
+	}, {
+		name:      "case",
+		host:      "Mask.iCloud.com.",
+		wantBlock: true,
+	}, {
+		name:      "subdomain",
+		host:      "sub.use-application-dns.net.",
+		wantBlock: false,
+	}, {
+		name:      "other",
+		host:      "example.org.",
+		wantBlock: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{
+				Req: (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA),
+			}
+
+			resp := p.validateRequest(d)
+			if !tc.wantBlock {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+			assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// EDNS0ClientAddrCode is the code of the EDNS0 option carrying the address of
+// the original client between the chained proxies.  It's within the range
+// reserved for local and experimental use by RFC 6891.  The option data is the
+// IP address, either 4 or 16 bytes long, followed by the port in network byte
+// order.
+const EDNS0ClientAddrCode uint16 = 65300
+
+// portLen is the length of the port in the client address option data.
+const portLen = 2
+
+// restoreClientAddr removes the client address option from the request of
+// dctx.  If the request came from one of [Config.ClientAddrProxies], the
+// address from the option, if valid, is set as the client address of dctx.
+func (p *Proxy) restoreClientAddr(dctx *DNSContext) {
+	opt := dctx.Req.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	var data []byte
+	opt.Option = slices.DeleteFunc(opt.Option, func(e dns.EDNS0) (ok bool) {
+		local, isLocal := e.(*dns.EDNS0_LOCAL)
+		if ok = isLocal && local.Code == EDNS0ClientAddrCode; ok {
+			data = local.Data
+		}
+
+		return ok
+	})
+
+	if data == nil {
+		return
+	}
+
+	prx := dctx.Addr
+	if p.ClientAddrProxies == nil || !p.ClientAddrProxies.Contains(prx.Addr()) {
+		log.Debug("dnsproxy: client addr from untrusted %s ignored", prx)
+
+		return
+	}
+
+	addr, ok := parseClientAddr(data)
+	if !ok {
+		log.Debug("dnsproxy: bad client addr option from %s: %x", prx, data)
+
+		return
+	}
+
+	log.Debug("dnsproxy: request from %s came through proxy %s", addr, prx)
+
+	dctx.Addr = addr
+}
+
+// parseClientAddr parses the data of the client address option.
+func parseClientAddr(data []byte) (addr netip.AddrPort, ok bool) {
+	switch len(data) {
+	case net.IPv4len + portLen, net.IPv6len + portLen:
+		// Go on.
+	default:
+		return netip.AddrPort{}, false
+	}
+
+	ip, _ := netip.AddrFromSlice(data[:len(data)-portLen])
+	port := binary.BigEndian.Uint16(data[len(data)-portLen:])
+
+	return netip.AddrPortFrom(ip, port), true
+}
+
+// addClientAddr adds the client address option with the address of the client
+// of dctx to its request, if [Config.ForwardClientAddr] is enabled.
+func (p *Proxy) addClientAddr(dctx *DNSContext) {
+	if !p.ForwardClientAddr || !dctx.Addr.IsValid() {
+		return
+	}
+
+	addr := dctx.Addr.Addr().Unmap()
+	data := binary.BigEndian.AppendUint16(addr.AsSlice(), dctx.Addr.Port())
+	e := &dns.EDNS0_LOCAL{
+		Code: EDNS0ClientAddrCode,
+		Data: data,
+	}
+
+	if opt := dctx.Req.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, e)
+
+		return
+	}
+
+	dctx.Req.SetEdns0(defaultUDPBufSize, false)
+	opt := dctx.Req.IsEdns0()
+	opt.Option = append(opt.Option, e)
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientAddrOption returns the data of the client address option of req, if
+// any.
+func clientAddrOption(req *dns.Msg) (data []byte) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, e := range opt.Option {
+		if local, ok := e.(*dns.EDNS0_LOCAL); ok && local.Code == EDNS0ClientAddrCode {
+			return local.Data
+		}
+	}
+
+	return nil
+}
+
+func TestProxy_forwardClientAddr(t *testing.T) {
+	var lastReq *dns.Msg
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			lastReq = req.Copy()
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	newProxy := func(t *testing.T, forward bool, trusted netutil.SubnetSet) (p *Proxy) {
+		t.Helper()
+
+		return mustNew(t, &Config{
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{ups},
+			},
+			TrustedProxies:    defaultTrustedProxies,
+			ClientAddrProxies: trusted,
+			ForwardClientAddr: forward,
+		})
+	}
+
+	clientAddr := netip.MustParseAddrPort("[2001:db8::1]:12345")
+	proxyAddr := netip.MustParseAddrPort("192.0.2.1:53")
+
+	edge := newProxy(t, true, nil)
+	inner := newProxy(t, false, netutil.SliceSubnetSet{netip.MustParsePrefix("192.0.2.0/24")})
+
+	dctx := &DNSContext{
+		Req:  (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA),
+		Addr: clientAddr,
+	}
+	require.NoError(t, edge.handleDNSRequest(dctx))
+
+	require.NotNil(t, lastReq)
+	fwdData := clientAddrOption(lastReq)
+	require.NotNil(t, fwdData)
+
+	testCases := []struct {
+		name     string
+		data     []byte
+		from     netip.AddrPort
+		wantAddr netip.AddrPort
+	}{{
+		name:     "trusted",
+		data:     fwdData,
+		from:     proxyAddr,
+		wantAddr: clientAddr,
+	}, {
+		name:     "untrusted",
+		data:     fwdData,
+		from:     netip.MustParseAddrPort("198.51.100.1:53"),
+		wantAddr: netip.MustParseAddrPort("198.51.100.1:53"),
+	}, {
+		name:     "bad_data",
+		data:     []byte{1, 2, 3},
+		from:     proxyAddr,
+		wantAddr: proxyAddr,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+			req.SetEdns0(defaultUDPBufSize, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+				Code: EDNS0ClientAddrCode,
+				Data: tc.data,
+			})
+
+			lastReq = nil
+			innerCtx := &DNSContext{
+				Req:  req,
+				Addr: tc.from,
+			}
+			require.NoError(t, inner.handleDNSRequest(innerCtx))
+
+			assert.Equal(t, tc.wantAddr, innerCtx.Addr)
+
+			// The option must not be passed further.
+			require.NotNil(t, lastReq)
+			assert.Nil(t, clientAddrOption(lastReq))
+		})
+	}
+}
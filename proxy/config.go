@@ -12,7 +12,9 @@ import (
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/bruceluk/dnsproxy/fastip"
 	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
 )
 
 // UpstreamModeType - upstream mode
@@ -25,8 +27,61 @@ const (
 	UModeParallel
 	// UModeFastestAddr - use Fastest Address algorithm
 	UModeFastestAddr
+	// UModeRoundRobin - start each request with the next upstream
+	UModeRoundRobin
+	// UModeLowestRTT - prefer the upstream with the lowest average round-trip
+	// time
+	UModeLowestRTT
+	// UModeConsistentHash - prefer the same upstream for the same name
+	UModeConsistentHash
+	// UModeWeighted - choose the upstreams randomly according to the static
+	// weights, see [Config.UpstreamWeights]
+	UModeWeighted
+	// UModeCustom - use [Config.UpstreamBalancer]
+	UModeCustom
+	// UModeStaggered - race the fastest upstreams, sending the request to
+	// each next one after [Config.StaggerDelay]
+	UModeStaggered
 )
 
+// String implements the [fmt.Stringer] interface for UpstreamModeType.
+func (m UpstreamModeType) String() (s string) {
+	switch m {
+	case UModeLoadBalance:
+		return "load_balance"
+	case UModeParallel:
+		return "parallel"
+	case UModeFastestAddr:
+		return "fastest_addr"
+	case UModeRoundRobin:
+		return "round_robin"
+	case UModeLowestRTT:
+		return "lowest_rtt"
+	case UModeConsistentHash:
+		return "consistent_hash"
+	case UModeWeighted:
+		return "weighted"
+	case UModeCustom:
+		return "custom"
+	case UModeStaggered:
+		return "staggered"
+	default:
+		return fmt.Sprintf("!bad_upstream_mode_%d", int(m))
+	}
+}
+
+// ParseUpstreamMode parses the upstream mode from its string representation as
+// returned by [UpstreamModeType.String].
+func ParseUpstreamMode(s string) (m UpstreamModeType, err error) {
+	for m = UModeLoadBalance; m <= UModeStaggered; m++ {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+
+	return UModeLoadBalance, fmt.Errorf("unknown upstream mode %q", s)
+}
+
 // RequestHandler is an optional custom handler for DNS requests.  It's used
 // instead of [Proxy.Resolve] if set.  The resulting error doesn't affect the
 // request processing.  The custom handler is responsible for calling
@@ -41,6 +96,13 @@ type RequestHandler func(p *Proxy, dctx *DNSContext) (err error)
 // message if the upstream or cache succeeded.  err is only not nil if the
 // upstream failed to respond.
 //
+// If [Config.HandleCachedResponses] is set, it's also called for the responses
+// served from the cache, including the optimistic and the stale ones, with a
+// nil err.  In that case, dctx.Upstream is nil,
+// [DNSContext.CachedUpstreamAddr] is the address of the upstream which has
+// resolved the cached response, and [DNSContext.Provenance] has [SourceCache]
+// as its source.
+//
 // TODO(e.burkov):  Use the same interface-based approach as
 // [BeforeRequestHandler].
 type ResponseHandler func(dctx *DNSContext, err error)
@@ -54,6 +116,12 @@ type Config struct {
 	// value of nil makes Proxy not trust any address.
 	TrustedProxies netutil.SubnetSet
 
+	// ClientAddrProxies is the set of networks of the chained proxies trusted
+	// to pass the original client address in the [EDNS0ClientAddrCode] option.
+	// The value of nil makes Proxy not trust any address.  The option is
+	// removed from all the incoming requests regardless.
+	ClientAddrProxies netutil.SubnetSet
+
 	// PrivateSubnets is the set of private networks.  Client having an address
 	// within this set is able to resolve PTR requests for addresses within this
 	// set.
@@ -89,6 +157,16 @@ type Config struct {
 	// general set fails responding.
 	Fallbacks *UpstreamConfig
 
+	// UpstreamGroups are the named groups of upstreams the requests are routed
+	// to by UpstreamRoutes.  If not empty, it must contain the group named
+	// [DefaultUpstreamGroup], and UpstreamConfig must be nil or empty, since it
+	// is replaced with the one containing the upstreams of all the groups.
+	UpstreamGroups []*UpstreamGroup
+
+	// UpstreamRoutes route the requests to UpstreamGroups.  The requests not
+	// matching any route are sent to the [DefaultUpstreamGroup].
+	UpstreamRoutes []*UpstreamRoute
+
 	// Userinfo is the sole permitted userinfo for the DoH basic authentication.
 	// If Userinfo is set, all DoH queries are required to have this basic
 	// authentication information.
@@ -98,6 +176,11 @@ type Config struct {
 	// DNS-over-HTTP, and DNS-over-QUIC servers.
 	TLSConfig *tls.Config
 
+	// VirtualResolvers are the DNS-over-TLS and DNS-over-HTTPS resolvers
+	// selected by the server name the client presents.  The requests with
+	// other server names or without any are handled as usual.
+	VirtualResolvers []*VirtualResolver
+
 	// DNSCryptResolverCert is the DNSCrypt resolver certificate.  Required for
 	// DNSCrypt server.
 	DNSCryptResolverCert *dnscrypt.Cert
@@ -122,6 +205,17 @@ type Config struct {
 	// requests.
 	HTTPSListenAddr []*net.TCPAddr
 
+	// HTTPListenAddr is the set of TCP addresses to listen for DNS-over-HTTPS
+	// requests without TLS, either over HTTP/1.1 or HTTP/2 with prior
+	// knowledge.  It's only intended to be used behind a reverse proxy
+	// terminating TLS, which should be added to [Config.TrustedProxies].
+	HTTPListenAddr []*net.TCPAddr
+
+	// GRPCListenAddr is the set of TCP addresses to listen for DNS-over-gRPC
+	// requests.  The requests are served over TLS if [Config.TLSConfig] is
+	// set, and over HTTP/2 with prior knowledge without TLS otherwise.
+	GRPCListenAddr []*net.TCPAddr
+
 	// TLSListenAddr is the set of TCP addresses to listen for DNS-over-TLS
 	// requests.
 	TLSListenAddr []*net.TCPAddr
@@ -138,6 +232,14 @@ type Config struct {
 	// requests.
 	DNSCryptTCPListenAddr []*net.TCPAddr
 
+	// ListenRebindInterval is the interval of checking the addresses of the
+	// network interfaces, so that the plain DNS listeners bound to the
+	// addresses which have disappeared and then reappeared, e.g. after the WAN
+	// link of a router has flapped, are rebound without restarting the proxy.
+	// Only the listeners from UDPListenAddr and TCPListenAddr with specific IP
+	// addresses are rebound.  Zero disables the checking.
+	ListenRebindInterval time.Duration
+
 	// BogusNXDomain is the set of networks used to transform responses into
 	// NXDOMAIN ones if they contain at least a single IP address within these
 	// networks.  It's similar to dnsmasq's "bogus-nxdomain".
@@ -148,12 +250,40 @@ type Config struct {
 	// default Well-Known Prefix.
 	DNS64Prefs []netip.Prefix
 
+	// DNS64Exclude is the set of DNS64 exclusion ranges.  The AAAA answers
+	// within the IPv6 ones are treated as absent, so that the AAAA records are
+	// synthesized instead, and the A answers within the IPv4 ones aren't
+	// synthesized.  If it contains no IPv6 ranges, ::ffff:0:0/96 is used.
+	DNS64Exclude []netip.Prefix
+
 	// RatelimitWhitelist is a list of IP addresses excluded from rate limiting.
 	RatelimitWhitelist []netip.Addr
 
+	// TLSHandshakeRatelimitAllowlist is a list of subnets excluded from the
+	// TLS handshake rate limiting.
+	TLSHandshakeRatelimitAllowlist []netip.Prefix
+
+	// ECSPolicies are the per-client EDNS Client Subnet policies.  The policy
+	// of the most specific subnet containing the client's address is used,
+	// other clients are handled according to [ECSPolicyDefault].
+	ECSPolicies []*ECSClientPolicy
+
+	// AddrPreferences are the per-client preferences of the address families
+	// in responses.  The preference of the most specific subnet containing the
+	// client's address is used, other clients get the responses as is.
+	AddrPreferences []*AddrClientPreference
+
 	// EDNSAddr is the ECS IP used in request.
 	EDNSAddr net.IP
 
+	// EDNSSubnetLenIPv4 is the length of the IPv4 subnet of the client sent in
+	// the EDNS Client Subnet option.  Zero means 24.
+	EDNSSubnetLenIPv4 int
+
+	// EDNSSubnetLenIPv6 is the length of the IPv6 subnet of the client sent in
+	// the EDNS Client Subnet option.  Zero means 56.
+	EDNSSubnetLenIPv6 int
+
 	// TODO(s.chzhen):  Extract ratelimit settings to a separate structure.
 
 	// RatelimitSubnetLenIPv4 is a subnet length for IPv4 addresses used for
@@ -168,15 +298,90 @@ type Config struct {
 	// to disable).
 	Ratelimit int
 
-	// CacheSizeBytes is the maximum cache size in bytes.
+	// TLSHandshakeRatelimit is a maximum number of new TLS handshakes per
+	// second from a given subnet on DNS-over-TLS and DNS-over-HTTPS listeners
+	// (0 to disable).  The subnets are defined by RatelimitSubnetLenIPv4 and
+	// RatelimitSubnetLenIPv6.  Connections exceeding the limit are closed right
+	// after being accepted, before any handshake work is done.
+	TLSHandshakeRatelimit int
+
+	// TopStatsSize is the number of the heaviest domains and clients tracked
+	// for [Proxy.TopStats] (0 to disable).  The tracking takes a constant
+	// amount of memory and a few hash computations per request.
+	TopStatsSize int
+
+	// CrashLogSize is the number of the latest reports kept for
+	// [Proxy.CrashReports] about the panics occurred while handling the
+	// requests (0 to disable).  If positive, such panics are recovered, and
+	// the requests are answered with SERVFAIL, instead of crashing the
+	// program.
+	CrashLogSize int
+
+	// PoisonQueryThreshold is the number of crashes caused by the identical
+	// requests, after which such requests are refused without handling (0 to
+	// disable).  The requests are identical if they only differ in ID.  It's
+	// ignored if CrashLogSize is not positive.
+	PoisonQueryThreshold uint
+
+	// CacheSizeBytes is the maximum cache size in bytes, the high watermark of
+	// the cache.  The size of a cached response includes its key and a
+	// constant per-item overhead, so that the large responses, like HTTPS and
+	// TXT ones, take the memory they actually need.
 	CacheSizeBytes int
 
+	// CacheLowWatermark is the cache size in bytes the eviction shrinks the
+	// cache to once it grows over CacheSizeBytes, so that the items are evicted
+	// in batches.  The expired items are evicted first.  If it's not positive
+	// or greater than CacheSizeBytes, 7/8 of CacheSizeBytes is used.
+	CacheLowWatermark int
+
+	// CacheCompressMinSize is the minimum size of a cached response in bytes to
+	// store it compressed, which fits more responses into CacheSizeBytes at the
+	// cost of decompressing them on each cache hit (0 to disable).
+	CacheCompressMinSize int
+
 	// CacheMinTTL is the minimum TTL for cached DNS responses in seconds.
 	CacheMinTTL uint32
 
 	// CacheMaxTTL is the maximum TTL for cached DNS responses in seconds.
 	CacheMaxTTL uint32
 
+	// CacheNegativeMinTTL is the minimum TTL for cached NXDOMAIN and NODATA
+	// responses in seconds.  The TTL of such responses is derived from the SOA
+	// record in their authority section, as RFC 2308 describes, and isn't
+	// affected by CacheMinTTL and CacheMaxTTL.
+	CacheNegativeMinTTL uint32
+
+	// CacheNegativeMaxTTL is the maximum TTL for cached NXDOMAIN and NODATA
+	// responses in seconds (0 for no limit).  RFC 2308 recommends the values
+	// of one to three hours.
+	CacheNegativeMaxTTL uint32
+
+	// CacheServeStale is the maximum time the expired cached responses are
+	// kept for to be served when the upstreams fail to resolve the requests,
+	// see RFC 8767 (0 to disable).  The requests for a stale response are only
+	// sent to the upstreams in background for a while after they have failed.
+	// It's ignored if CacheOptimistic is true.
+	CacheServeStale time.Duration
+
+	// CacheStaleTTL is the TTL of the stale responses.  If zero, 30 seconds is
+	// used, as RFC 8767 recommends.
+	CacheStaleTTL time.Duration
+
+	// ZeroTTLFloor is the minimum TTL the zero TTLs in the upstream responses
+	// for ZeroTTLFloorDomains are raised to, so that the responses for the
+	// domains abusing zero TTLs get cached (0 to disable).  The zero TTLs are
+	// honored for the other domains.
+	ZeroTTLFloor time.Duration
+
+	// ZeroTTLFloorJitter is the maximum random time added to ZeroTTLFloor, so
+	// that the floored responses don't expire at once.
+	ZeroTTLFloorJitter time.Duration
+
+	// ZeroTTLFloorDomains are the domains, which responses, including the ones
+	// for their subdomains, have their zero TTLs raised to ZeroTTLFloor.
+	ZeroTTLFloorDomains []string
+
 	// MaxGoroutines is the maximum number of goroutines processing DNS
 	// requests.  Important for mobile users.
 	//
@@ -191,22 +396,263 @@ type Config struct {
 	// UpstreamMode determines the logic through which upstreams will be used.
 	UpstreamMode UpstreamModeType
 
+	// UpstreamBalancer orders the upstreams in [UModeCustom].  It must be set
+	// if UpstreamMode or the mode of any upstream group is [UModeCustom].
+	UpstreamBalancer UpstreamBalancer
+
+	// UpstreamWeights are the static weights of the upstreams by their
+	// addresses in [UModeWeighted].  The upstreams missing here have the
+	// weight of 1, and the ones with zero weight are only used for the
+	// requests they're the only upstream for.  The weights must not be
+	// negative.
+	UpstreamWeights map[string]float64
+
+	// StaggerUpstreams is the maximum number of the upstreams a request is
+	// sent to in [UModeStaggered].  Zero means all of them.  It must not be
+	// negative.
+	StaggerUpstreams int
+
+	// StaggerDelay is the delay after which the request is sent to the next
+	// upstream in [UModeStaggered] if none has responded yet.  Zero means the
+	// default one, which is 100 milliseconds.  It must not be negative.
+	StaggerDelay time.Duration
+
 	// FastestPingTimeout is the timeout for waiting the first successful
 	// dialing when the UpstreamMode is set to UModeFastestAddr.  Non-positive
 	// value will be replaced with the default one.
 	FastestPingTimeout time.Duration
 
+	// FastestAddr, if not nil, is used to find the fastest address when the
+	// UpstreamMode is set to UModeFastestAddr instead of a new one, in which
+	// case FastestPingTimeout is ignored.  It's mostly useful with
+	// [fastip.NewTestFastestAddr] to test the configuration deterministically.
+	FastestAddr *fastip.FastestAddr
+
+	// FastestPingMode defines how the addresses are pinged when the
+	// UpstreamMode is set to UModeFastestAddr.  It's ignored if FastestAddr is
+	// set.
+	FastestPingMode fastip.PingMode
+
+	// FastestSampleWindow is the number of the latest successful pings of an
+	// address its latency is averaged over when the UpstreamMode is set to
+	// UModeFastestAddr.  Zero means [fastip.DefaultSampleWindow].  It's
+	// ignored if FastestAddr is set.
+	FastestSampleWindow uint
+
+	// FastestStrategy defines how the address is chosen among the pinged ones
+	// when the UpstreamMode is set to UModeFastestAddr.  It's ignored if
+	// FastestAddr is set.
+	FastestStrategy fastip.Strategy
+
+	// FastestStrategyWindow is the maximum difference between the latency of
+	// an address and the lowest one for the address to be chosen by the
+	// FastestStrategy other than [fastip.StrategyFastest].  Non-positive value
+	// means [fastip.DefaultStrategyWindow].  It's ignored if FastestAddr is
+	// set.
+	FastestStrategyWindow time.Duration
+
+	// FastestCacheFile is the path to the file the ping results of the
+	// fastest address finder are persisted to, so that they survive restarts.
+	// The file is read when the proxy is created and written on shutdown and
+	// every FastestCacheFlushInterval, if it's positive.  It's ignored if
+	// FastestAddr is set.
+	FastestCacheFile string
+
+	// FastestCacheFlushInterval is the interval of writing the ping results to
+	// FastestCacheFile.  Zero means the results are only written on shutdown.
+	FastestCacheFlushInterval time.Duration
+
+	// FastestPortsByDomain are the ports to ping the addresses of the domains
+	// on when the UpstreamMode is set to UModeFastestAddr, see
+	// [fastip.FastestAddr.PortsByDomain].  It's ignored if FastestAddr is set.
+	FastestPortsByDomain map[string][]uint16
+
+	// FastestDomains are the domains, which A and AAAA requests, including the
+	// ones for their subdomains, are resolved choosing the fastest address,
+	// even if the UpstreamMode, or the mode of the upstream group, isn't
+	// UModeFastestAddr.
+	FastestDomains []string
+
+	// FastestExcludeDomains are the domains, which requests, including the
+	// ones for their subdomains, are resolved in UModeLoadBalance instead of
+	// UModeFastestAddr.  The closest domain of the requested one takes
+	// precedence when it matches both FastestDomains and
+	// FastestExcludeDomains, and the exclusion wins for the same domain.
+	FastestExcludeDomains []string
+
+	// FastestProbeTLS makes the fastest address finder complete the TLS
+	// handshake with the queried host when pinging port 443 with TCP, see
+	// [fastip.TCPProber.ProbeTLS].  It's ignored if FastestAddr is set.
+	FastestProbeTLS bool
+
+	// FastestPreferIPv6Within is the latency margin within which an IPv6
+	// address is chosen over a faster IPv4 one when the UpstreamMode is set to
+	// UModeFastestAddr.  Zero disables the preference.  It's ignored if
+	// FastestAddr is set.
+	FastestPreferIPv6Within time.Duration
+
+	// FastestMetrics, if not nil, collects the statistics of the fastest
+	// address selection when the UpstreamMode is set to UModeFastestAddr.  It's
+	// ignored if FastestAddr is set.
+	FastestMetrics fastip.Metrics
+
+	// FastestRefreshInterval is the interval of re-pinging the cached
+	// addresses in use in background when the UpstreamMode is set to
+	// UModeFastestAddr, so that their results are replaced before they expire,
+	// see [fastip.FastestAddr.Start].  Zero disables re-pinging.  It's ignored
+	// if FastestAddr is set.
+	FastestRefreshInterval time.Duration
+
+	// FastestRefreshConcurrency is the maximum number of the addresses
+	// re-pinged at once, see FastestRefreshInterval.  Non-positive value will
+	// be replaced with the default one.  It's ignored if FastestAddr is set.
+	FastestRefreshConcurrency int
+
+	// ProbeInterval is the interval of probing all the upstreams in background
+	// to keep their round-trip time statistics fresh, so that the load
+	// balancing accounts even the upstreams not currently chosen for the
+	// requests.  Zero disables probing.
+	ProbeInterval time.Duration
+
+	// HedgeBudget is the maximum share of the requests that may be hedged, see
+	// HedgeRequests.  It must not be greater than 1.  Non-positive value will
+	// be replaced with the default one, which is 0.1.
+	HedgeBudget float64
+
+	// ServFailBackoff is the time the requests for a question aren't sent to
+	// the upstreams for after they have failed to resolve it, either with an
+	// error or with SERVFAIL, see RFC 9520.  Such requests are answered with
+	// SERVFAIL.  The time doubles with each consecutive failure up to
+	// ServFailBackoffMax.  The requests with the custom upstreams aren't
+	// suppressed.  Zero disables the suppression.
+	ServFailBackoff time.Duration
+
+	// ServFailBackoffMax is the maximum time the requests for a failing
+	// question aren't sent to the upstreams for, see ServFailBackoff.
+	// Non-positive value will be replaced with the default one, which is 5
+	// minutes.
+	ServFailBackoffMax time.Duration
+
+	// AnomalyWindow is the length of the sliding window, over which the
+	// per-client statistics of the requested types and NXDOMAIN responses are
+	// collected and scored, see [Proxy.Anomalies].  The window slides with the
+	// granularity of a sixth of it.  Zero disables the collection.
+	AnomalyWindow time.Duration
+
+	// AnomalyThreshold is the anomaly score in the (0, 1] range, reaching which
+	// a client is reported to OnAnomaly.  The client is reported again only
+	// after its score drops below the threshold.  Zero disables the reporting.
+	AnomalyThreshold float64
+
+	// OnAnomaly, if not nil, is called when the anomaly score of a client
+	// reaches AnomalyThreshold.  It's called synchronously while handling the
+	// request, so it must not block, and it must be safe for concurrent use.
+	OnAnomaly func(a *ClientAnomaly)
+
+	// HealthCheckInterval is the interval of probing the health of all the
+	// upstreams in background with the requests for the SOA record of the
+	// root zone.  The upstreams failing HealthCheckFailures requests or probes
+	// in a row are ejected, i.e. not used in the load-balancing and parallel
+	// modes unless all the others are ejected as well, until they pass a
+	// probe.  Zero disables the health checks.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckFailures is the number of the consecutive failures after
+	// which an upstream is ejected, see HealthCheckInterval.  Zero will be
+	// replaced with the default one, which is 3.
+	HealthCheckFailures uint
+
+	// EjectionBackoff is the time an ejected upstream isn't probed for after
+	// the ejection.  The time doubles with each failed probe up to
+	// EjectionBackoffMax.  Non-positive value will be replaced with the
+	// default one, which is 10 seconds.
+	EjectionBackoff time.Duration
+
+	// EjectionBackoffMax is the maximum time an ejected upstream isn't probed
+	// for, see EjectionBackoff.  Non-positive value will be replaced with the
+	// default one, which is 5 minutes.
+	EjectionBackoffMax time.Duration
+
+	// OnUpstreamStateChange, if not nil, is called when an upstream is ejected
+	// or re-admitted, see HealthCheckInterval.  It must be safe for concurrent
+	// use.
+	OnUpstreamStateChange func(c *UpstreamStateChange)
+
+	// OnRaceDisagreement, if not nil, is called when the upstreams return
+	// different responses to the same request in [UModeParallel].  It must be
+	// safe for concurrent use.  With [RacePolicyFirst] it's called after the
+	// response has already been sent to the client.
+	OnRaceDisagreement func(d *RaceDisagreement)
+
+	// OnListenerError, if not nil, is called when a listener fails to bind,
+	// stops serving, or fails a TLS handshake or a QUIC connection with a
+	// client, so that the supervisors can react, e.g. rebind after an
+	// interface flap.  It must not block, and it must be safe for concurrent
+	// use.
+	OnListenerError func(e *ListenerError)
+
+	// SigningKeys are the zone signing keys to sign the locally generated
+	// responses with, e.g. the ones of [Config.BeforeRequestHandler] serving
+	// the zones, so that the validating clients accept them.  Only the names
+	// within the zones of the keys are signed, and only if the DO bit is set
+	// in the request.  The missing names and types are denied with the compact
+	// NSEC records, see RFC 9824, and the DNSKEY records are added to the
+	// responses for the zone apexes.
+	SigningKeys []*SigningKey
+
+	// SignatureValidity is the validity period of the signatures made with
+	// SigningKeys.  If zero, 24 hours is used.
+	SignatureValidity time.Duration
+
+	// CanaryDomains are the domains, requests for which are answered with
+	// NXDOMAIN instead of being resolved.  It's mostly useful with
+	// [DefaultCanaryDomains] to prevent the clients from bypassing the proxy.
+	// The subdomains aren't matched.
+	CanaryDomains []string
+
+	// SelfHostname is the hostname of the proxy itself.  If not empty, the
+	// requests for it are answered by the proxy with SelfAddrs and with its
+	// encrypted endpoints in the HTTPS records, and the SVCB requests for
+	// "_dns.resolver.arpa" and "_dns." + SelfHostname are answered with the
+	// endpoints for the Discovery of Designated Resolvers, see RFC 9462.
+	SelfHostname string
+
+	// SelfAddrs are the IP addresses to answer the requests for SelfHostname
+	// with.  If empty, the addresses of the listeners are used, except for the
+	// unspecified ones.
+	SelfAddrs []netip.Addr
+
+	// ProbeDomain is the domain name, the A records of which are requested to
+	// probe the upstreams, see ProbeInterval.  If empty, the root name servers
+	// are requested.
+	ProbeDomain string
+
+	// RacePolicy defines which response is used when the upstreams return
+	// different responses to the same request in [UModeParallel].
+	RacePolicy RacePolicy
+
+	// AddrShuffle defines how the order of the A and AAAA records in the
+	// responses, including the cached ones, is changed.
+	AddrShuffle AddrShuffle
+
 	// RefuseAny makes proxy refuse the requests of type ANY.
 	RefuseAny bool
 
 	// HTTP3 enables HTTP/3 support for HTTPS server.
 	HTTP3 bool
 
+	// HedgeRequests makes the proxy send the request to another upstream as
+	// well if the chosen one hasn't responded within the 95th percentile of
+	// its latest round-trip times, and use the response that comes first.  The
+	// number of such requests is limited by HedgeBudget.  It's only used in
+	// [UModeLoadBalance].
+	HedgeRequests bool
+
 	// Enable EDNS Client Subnet option DNS requests to the upstream server will
 	// contain an OPT record with Client Subnet option.  If the original request
 	// already has this option set, we pass it through as is.  Otherwise, we set
 	// it ourselves using the client IP with subnet /24 (for IPv4) and /56 (for
-	// IPv6).
+	// IPv6), see EDNSSubnetLenIPv4 and EDNSSubnetLenIPv6.
 	//
 	// If the upstream server supports ECS, it sets subnet number in the
 	// response.  This subnet number along with the client IP and other data is
@@ -230,6 +676,63 @@ type Config struct {
 	// CacheOptimistic defines if the optimistic cache mechanism should be used.
 	CacheOptimistic bool
 
+	// CachePrefetchHits is the number of the cache hits of a response within
+	// its TTL, after which it's refreshed when less than 10% of the TTL or 30
+	// seconds remain, so that the popular names don't miss the cache.  Zero
+	// disables prefetching.  It requires CacheEnabled.
+	CachePrefetchHits uint
+
+	// CachePrefetchMaxConcurrent is the maximum number of the prefetches
+	// running at once, see CachePrefetchHits.  If zero, 10 is used.
+	CachePrefetchMaxConcurrent uint
+
+	// CacheFile is the path to the file backing the cache, so that the cached
+	// responses survive restarts.  The items are loaded from it on
+	// initialization, unless expired, and written to it in the background.  If
+	// empty, the cache isn't persisted.  It requires CacheEnabled.
+	CacheFile string
+
+	// CacheFileMaxSize is the size of CacheFile in bytes, after which it's
+	// rewritten with the most recently used items of the cache.  If not
+	// positive, four times the cache size is used.
+	CacheFileMaxSize int
+
+	// CacheAggressiveNSEC makes the proxy synthesize the NXDOMAIN responses
+	// from the cached NSEC and NSEC3 records for the names they prove
+	// nonexistent, see RFC 8198.  Only the records of the responses validated
+	// as secure by the proxy itself are used, so it requires DNSSECValidate as
+	// well as CacheEnabled.
+	CacheAggressiveNSEC bool
+
+	// HandleCachedResponses makes the proxy also call ResponseHandler for the
+	// responses served from the cache.  See [ResponseHandler].
+	HandleCachedResponses bool
+
+	// ResolveSVCBAliases makes the proxy follow the AliasMode SVCB and HTTPS
+	// records in the responses and add the records of their targets to the
+	// additional section.  Each target is resolved and cached separately, so
+	// the chains are served from the cache with the TTL of each link kept.
+	ResolveSVCBAliases bool
+
+	// DNSSECValidate makes the proxy validate the DNSSEC signatures of the
+	// upstream responses itself, walking the DS and DNSKEY records down from
+	// the trust anchors.  The AD flag is set for the secure responses and
+	// cleared for the insecure ones, and the bogus ones are replaced with
+	// SERVFAIL.  The responses to the requests with the CD flag set aren't
+	// validated.
+	DNSSECValidate bool
+
+	// DNSSECTrustAnchors are the DS records of the keys trusted without
+	// validation, see DNSSECValidate.  The records for the zones other than the
+	// root one make the names within them validated from the closest of those.
+	// If empty, the key signing keys of the root zone are used.
+	DNSSECTrustAnchors []*dns.DS
+
+	// DNSSECNegativeTrustAnchors are the domain names, the responses for which
+	// and for their subdomains aren't validated, so that the zones with
+	// broken signatures are still resolved, see RFC 7646.
+	DNSSECNegativeTrustAnchors []string
+
 	// UseDNS64 enables DNS64 handling.  If true, proxy will translate IPv4
 	// answers into IPv6 answers using first of DNS64Prefs.  Note also that PTR
 	// requests for addresses within the specified networks are considered
@@ -246,6 +749,28 @@ type Config struct {
 	// PreferIPv6 tells the proxy to prefer IPv6 addresses when bootstrapping
 	// upstreams that use hostnames.
 	PreferIPv6 bool
+
+	// WarmUpUpstreams makes the proxy establish the connections to all the
+	// configured upstreams in background on start, so that the first requests
+	// don't wait for the bootstrapping and handshakes.
+	WarmUpUpstreams bool
+
+	// ForwardClientAddr makes the proxy pass the client address to the
+	// upstreams in the [EDNS0ClientAddrCode] option.  It discloses the client
+	// addresses, so it should only be enabled for the trusted upstreams, e.g.
+	// other proxies with [Config.ClientAddrProxies] configured.
+	ForwardClientAddr bool
+
+	// TCPFastOpen enables TCP Fast Open on the plain TCP and TLS listeners,
+	// where the platform supports it, so that the reconnecting clients can send
+	// their requests within the SYN.  See [Proxy.TCPFastOpenStats].
+	TCPFastOpen bool
+
+	// QUICFlowLabels makes the kernel set a stable flow label on the outgoing
+	// IPv6 packets of the DoQ and DoH3 listeners, where the platform supports
+	// it, so that the flow queuing disciplines, e.g. fq_codel, and the ECMP
+	// routers keep the packets of the same connection together.
+	QUICFlowLabels bool
 }
 
 // validateConfig verifies that the supplied configuration is valid and returns
@@ -275,6 +800,98 @@ func (p *Proxy) validateConfig() (err error) {
 		return fmt.Errorf("validating ratelimit: %w", err)
 	}
 
+	err = validateECSPolicies(p.ECSPolicies)
+	if err != nil {
+		return fmt.Errorf("validating ecs policies: %w", err)
+	}
+
+	err = checkInclusion(p.EDNSSubnetLenIPv4, 0, netutil.IPv4BitLen)
+	if err != nil {
+		return fmt.Errorf("edns subnet len ipv4 is invalid: %w", err)
+	}
+
+	err = checkInclusion(p.EDNSSubnetLenIPv6, 0, netutil.IPv6BitLen)
+	if err != nil {
+		return fmt.Errorf("edns subnet len ipv6 is invalid: %w", err)
+	}
+
+	err = validateAddrPreferences(p.AddrPreferences)
+	if err != nil {
+		return fmt.Errorf("validating address preferences: %w", err)
+	}
+
+	err = validateVirtualResolvers(p.VirtualResolvers)
+	if err != nil {
+		return fmt.Errorf("validating virtual resolvers: %w", err)
+	}
+
+	if p.RacePolicy > RacePolicyPriority {
+		return fmt.Errorf("bad race policy %s", p.RacePolicy)
+	}
+
+	if p.AddrShuffle > AddrShuffleRandom {
+		return fmt.Errorf("bad address shuffle %s", p.AddrShuffle)
+	}
+
+	if p.HedgeBudget > 1 {
+		return fmt.Errorf("hedge budget %v greater than 1", p.HedgeBudget)
+	}
+
+	err = p.validateProbe()
+	if err != nil {
+		return fmt.Errorf("validating probe: %w", err)
+	}
+
+	err = p.validateListenRebind()
+	if err != nil {
+		return fmt.Errorf("validating listen rebind: %w", err)
+	}
+
+	err = p.validateDNSSEC()
+	if err != nil {
+		return fmt.Errorf("validating dnssec: %w", err)
+	}
+
+	err = p.validateServFailBackoff()
+	if err != nil {
+		return fmt.Errorf("validating servfail backoff: %w", err)
+	}
+
+	err = p.validateServeStale()
+	if err != nil {
+		return fmt.Errorf("validating serve-stale: %w", err)
+	}
+
+	err = p.validateZeroTTLFloor()
+	if err != nil {
+		return fmt.Errorf("validating zero ttl floor: %w", err)
+	}
+
+	err = p.validateUpstreamBalancer()
+	if err != nil {
+		return fmt.Errorf("validating upstream mode: %w", err)
+	}
+
+	err = p.validateStagger()
+	if err != nil {
+		return fmt.Errorf("validating staggered mode: %w", err)
+	}
+
+	err = p.validateUpstreamHealth()
+	if err != nil {
+		return fmt.Errorf("validating upstream health checks: %w", err)
+	}
+
+	err = p.validateAnomaly()
+	if err != nil {
+		return fmt.Errorf("validating anomaly detection: %w", err)
+	}
+
+	err = p.validateSigning()
+	if err != nil {
+		return fmt.Errorf("validating signing keys: %w", err)
+	}
+
 	p.logConfigInfo()
 
 	return nil
@@ -283,7 +900,7 @@ func (p *Proxy) validateConfig() (err error) {
 // validateRatelimit validates ratelimit configuration and returns an error if
 // it's invalid.
 func (p *Proxy) validateRatelimit() (err error) {
-	if p.Ratelimit == 0 {
+	if p.Ratelimit == 0 && p.TLSHandshakeRatelimit == 0 {
 		return nil
 	}
 
@@ -319,6 +936,22 @@ func (p *Proxy) logConfigInfo() {
 		log.Info("Cache TTL override is enabled. Min=%d, Max=%d", p.CacheMinTTL, p.CacheMaxTTL)
 	}
 
+	if p.CacheNegativeMinTTL > 0 || p.CacheNegativeMaxTTL > 0 {
+		log.Info(
+			"dnsproxy: negative cache ttl override is enabled, min %d, max %d",
+			p.CacheNegativeMinTTL,
+			p.CacheNegativeMaxTTL,
+		)
+	}
+
+	if p.ZeroTTLFloor > 0 && len(p.ZeroTTLFloorDomains) > 0 {
+		log.Info(
+			"dnsproxy: raising zero ttls to %s for %d domains",
+			p.ZeroTTLFloor,
+			len(p.ZeroTTLFloorDomains),
+		)
+	}
+
 	if p.Ratelimit > 0 {
 		log.Info(
 			"Ratelimit is enabled and set to %d rps, IPv4 subnet mask len %d, IPv6 subnet mask len %d",
@@ -328,10 +961,45 @@ func (p *Proxy) logConfigInfo() {
 		)
 	}
 
+	if p.TLSHandshakeRatelimit > 0 {
+		log.Info(
+			"dnsproxy: tls handshake ratelimit is enabled and set to %d hps",
+			p.TLSHandshakeRatelimit,
+		)
+	}
+
 	if p.RefuseAny {
 		log.Info("dnsproxy: server will refuse requests of type ANY")
 	}
 
+	if p.hedger != nil {
+		log.Info("dnsproxy: hedging is enabled with budget %v", p.hedger.ratio)
+	}
+
+	if b := p.servFailBackoff; b != nil {
+		log.Info("dnsproxy: servfail backoff is enabled from %s to %s", b.initial, b.max)
+	}
+
+	if h := p.upstreamHealth; h != nil {
+		log.Info(
+			"dnsproxy: upstream health checks are enabled each %s, ejecting after %d failures",
+			p.HealthCheckInterval,
+			h.failures,
+		)
+	}
+
+	if s := p.signer; s != nil {
+		log.Info("dnsproxy: signing local responses for %d zones", len(s.keys))
+	}
+
+	if v := p.dnssecValidator; v != nil {
+		log.Info("dnsproxy: dnssec validation is enabled with %d trust anchors", len(v.anchors))
+	}
+
+	if r := p.upstreamRouter; r != nil {
+		log.Info("dnsproxy: %d upstream groups with %d routes", len(r.groups), len(r.routes))
+	}
+
 	if len(p.BogusNXDomain) > 0 {
 		log.Info("%d bogus-nxdomain IP specified", len(p.BogusNXDomain))
 	}
@@ -372,6 +1040,8 @@ func (p *Proxy) hasListenAddrs() bool {
 		p.TCPListenAddr != nil ||
 		p.TLSListenAddr != nil ||
 		p.HTTPSListenAddr != nil ||
+		p.HTTPListenAddr != nil ||
+		p.GRPCListenAddr != nil ||
 		p.QUICListenAddr != nil ||
 		p.DNSCryptUDPListenAddr != nil ||
 		p.DNSCryptTCPListenAddr != nil
@@ -0,0 +1,415 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+)
+
+// Severity is the severity of a configuration problem.
+type Severity uint8
+
+const (
+	// SeverityError means that the configuration can't be used.
+	SeverityError Severity = iota
+
+	// SeverityWarning means that the configuration can be used, but probably
+	// doesn't do what's intended.
+	SeverityWarning
+)
+
+// String implements the [fmt.Stringer] interface for Severity.
+func (s Severity) String() (str string) {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return fmt.Sprintf("!bad_severity_%d", uint8(s))
+	}
+}
+
+// ConfigProblem is a single problem found in a [Config].
+type ConfigProblem struct {
+	// Err is the description of the problem.
+	Err error
+
+	// Path is the path to the problematic field, e.g. "ECSPolicies[1]".
+	Path string
+
+	// Severity is the severity of the problem.
+	Severity Severity
+}
+
+// type check
+var _ error = (*ConfigProblem)(nil)
+
+// Error implements the error interface for *ConfigProblem.
+func (p *ConfigProblem) Error() (msg string) {
+	return fmt.Sprintf("%s: %s: %s", p.Severity, p.Path, p.Err)
+}
+
+// type check
+var _ errors.Wrapper = (*ConfigProblem)(nil)
+
+// Unwrap implements the [errors.Wrapper] interface for *ConfigProblem.
+func (p *ConfigProblem) Unwrap() (err error) {
+	return p.Err
+}
+
+// ConfigProblems is a list of problems found in a [Config].
+type ConfigProblems []*ConfigProblem
+
+// type check
+var _ error = ConfigProblems(nil)
+
+// Error implements the error interface for ConfigProblems.
+func (probs ConfigProblems) Error() (msg string) {
+	b := &strings.Builder{}
+	for i, p := range probs {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+
+		b.WriteString(p.Error())
+	}
+
+	return b.String()
+}
+
+// type check
+var _ errors.WrapperSlice = ConfigProblems(nil)
+
+// Unwrap implements the [errors.WrapperSlice] interface for ConfigProblems.
+func (probs ConfigProblems) Unwrap() (errs []error) {
+	errs = make([]error, 0, len(probs))
+	for _, p := range probs {
+		errs = append(errs, p)
+	}
+
+	return errs
+}
+
+// HasErrors returns true if probs contain any problems with [SeverityError].
+func (probs ConfigProblems) HasErrors() (ok bool) {
+	for _, p := range probs {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+
+	return false
+}
+
+// configValidator collects the problems of a configuration.
+type configValidator struct {
+	probs ConfigProblems
+}
+
+// add adds a problem with severity to v if err is not nil.
+func (v *configValidator) add(sev Severity, path string, err error) {
+	if err == nil {
+		return
+	}
+
+	v.probs = append(v.probs, &ConfigProblem{
+		Err:      err,
+		Path:     path,
+		Severity: sev,
+	})
+}
+
+// Validate checks the whole configuration and returns all the problems found
+// in it, unlike [New], which stops at the first one.  The returned error, if
+// not nil, is of type [ConfigProblems] and may contain only warnings; use
+// [ConfigProblems.HasErrors] to check if c can be used.  c must not be nil.
+func (c *Config) Validate() (err error) {
+	v := &configValidator{}
+
+	c.validateUpstreams(v)
+	c.validateServer(v)
+	c.validateClientPolicies(v)
+	c.validateVirtualResolvers(v)
+
+	for i, d := range c.CanaryDomains {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(d, "."))
+		v.add(SeverityWarning, fmt.Sprintf("CanaryDomains[%d]", i), err)
+	}
+
+	if c.CacheMinTTL > 0 && c.CacheMaxTTL > 0 && c.CacheMinTTL > c.CacheMaxTTL {
+		v.add(SeverityWarning, "CacheMinTTL", fmt.Errorf(
+			"value %d greater than CacheMaxTTL %d",
+			c.CacheMinTTL,
+			c.CacheMaxTTL,
+		))
+	}
+
+	if c.CacheNegativeMaxTTL > 0 && c.CacheNegativeMinTTL > c.CacheNegativeMaxTTL {
+		v.add(SeverityWarning, "CacheNegativeMinTTL", fmt.Errorf(
+			"value %d greater than CacheNegativeMaxTTL %d",
+			c.CacheNegativeMinTTL,
+			c.CacheNegativeMaxTTL,
+		))
+	}
+
+	if c.CacheSizeBytes > 0 && c.CacheLowWatermark > c.CacheSizeBytes {
+		v.add(SeverityWarning, "CacheLowWatermark", fmt.Errorf(
+			"value %d greater than CacheSizeBytes %d, using default",
+			c.CacheLowWatermark,
+			c.CacheSizeBytes,
+		))
+	}
+
+	v.add(SeverityError, "CacheServeStale", c.validateServeStale())
+	if c.CacheServeStale > 0 && c.CacheOptimistic {
+		v.add(
+			SeverityWarning,
+			"CacheServeStale",
+			errors.Error("ignored since CacheOptimistic is true"),
+		)
+	}
+
+	v.add(SeverityError, "ZeroTTLFloor", c.validateZeroTTLFloor())
+	if c.ZeroTTLFloor > 0 && len(c.ZeroTTLFloorDomains) == 0 {
+		v.add(
+			SeverityWarning,
+			"ZeroTTLFloor",
+			errors.Error("ignored since ZeroTTLFloorDomains is empty"),
+		)
+	}
+
+	if c.PoisonQueryThreshold > 0 && c.CrashLogSize <= 0 {
+		v.add(
+			SeverityWarning,
+			"PoisonQueryThreshold",
+			errors.Error("ignored since CrashLogSize is not positive"),
+		)
+	}
+
+	if !c.CacheEnabled {
+		c.validateCacheFeatures(v)
+	}
+
+	c.validateDNSSECAnchors(v)
+
+	if c.CacheAggressiveNSEC && !c.DNSSECValidate {
+		v.add(
+			SeverityWarning,
+			"CacheAggressiveNSEC",
+			errors.Error("ignored since DNSSECValidate is false"),
+		)
+	}
+
+	if c.AddrShuffle > AddrShuffleRandom {
+		v.add(SeverityError, "AddrShuffle", fmt.Errorf("bad value %s", c.AddrShuffle))
+	}
+
+	if len(v.probs) == 0 {
+		return nil
+	}
+
+	return v.probs
+}
+
+// validateCacheFeatures adds the problems of the features requiring the cache
+// to v.  It's only called when the cache is disabled.
+func (c *Config) validateCacheFeatures(v *configValidator) {
+	const errNoCache errors.Error = "ignored since CacheEnabled is false"
+
+	if c.CacheAggressiveNSEC {
+		v.add(SeverityWarning, "CacheAggressiveNSEC", errNoCache)
+	}
+
+	if c.CachePrefetchHits > 0 {
+		v.add(SeverityWarning, "CachePrefetchHits", errNoCache)
+	}
+
+	if c.CacheServeStale > 0 {
+		v.add(SeverityWarning, "CacheServeStale", errNoCache)
+	}
+
+	if c.CacheFile != "" {
+		v.add(SeverityWarning, "CacheFile", errNoCache)
+	}
+}
+
+// validateDNSSECAnchors adds the problems of the DNSSEC trust anchors to v.
+func (c *Config) validateDNSSECAnchors(v *configValidator) {
+	for i, ds := range c.DNSSECTrustAnchors {
+		v.add(SeverityError, fmt.Sprintf("DNSSECTrustAnchors[%d]", i), validateTrustAnchor(ds))
+	}
+
+	for i, name := range c.DNSSECNegativeTrustAnchors {
+		v.add(
+			SeverityError,
+			fmt.Sprintf("DNSSECNegativeTrustAnchors[%d]", i),
+			validateNegativeTrustAnchor(name),
+		)
+	}
+
+	if !c.DNSSECValidate && (len(c.DNSSECTrustAnchors) > 0 || len(c.DNSSECNegativeTrustAnchors) > 0) {
+		v.add(
+			SeverityWarning,
+			"DNSSECValidate",
+			errors.Error("trust anchors are ignored since it's false"),
+		)
+	}
+}
+
+// validateUpstreams adds the problems of the upstream configurations to v.
+func (c *Config) validateUpstreams(v *configValidator) {
+	if len(c.UpstreamGroups) > 0 || len(c.UpstreamRoutes) > 0 {
+		_, err := newUpstreamRouter(c)
+		v.add(SeverityError, "UpstreamGroups", err)
+	} else {
+		v.add(SeverityError, "UpstreamConfig", c.UpstreamConfig.validate())
+	}
+
+	c.validatePrivateUpstreams(v)
+
+	// Allow [Config.Fallbacks] to be nil, but not empty.
+	if err := c.Fallbacks.validate(); errors.Is(err, upstream.ErrNoUpstreams) {
+		v.add(SeverityError, "Fallbacks", err)
+	}
+
+	if c.RacePolicy > RacePolicyPriority {
+		v.add(SeverityError, "RacePolicy", fmt.Errorf("bad value %s", c.RacePolicy))
+	}
+
+	v.add(SeverityError, "ProbeInterval", c.validateProbe())
+	v.add(SeverityError, "ServFailBackoff", c.validateServFailBackoff())
+	v.add(SeverityError, "UpstreamMode", c.validateUpstreamBalancer())
+	v.add(SeverityError, "StaggerDelay", c.validateStagger())
+	v.add(SeverityError, "HealthCheckInterval", c.validateUpstreamHealth())
+	v.add(SeverityError, "AnomalyWindow", c.validateAnomaly())
+	v.add(SeverityError, "SigningKeys", c.validateSigning())
+
+	if c.HedgeBudget > 1 {
+		v.add(SeverityError, "HedgeBudget", fmt.Errorf("value %v greater than 1", c.HedgeBudget))
+	}
+
+	if c.HedgeRequests && c.UpstreamMode != UModeLoadBalance {
+		v.add(
+			SeverityWarning,
+			"HedgeRequests",
+			errors.Error("ignored since UpstreamMode isn't load balancing"),
+		)
+	}
+}
+
+// validatePrivateUpstreams adds the problems of the private RDNS upstream
+// configuration to v.
+func (c *Config) validatePrivateUpstreams(v *configValidator) {
+	if c.PrivateRDNSUpstreamConfig == nil && !c.UsePrivateRDNS {
+		return
+	}
+
+	privateNets := c.PrivateSubnets
+	if privateNets == nil {
+		privateNets = netutil.SubnetSetFunc(netutil.IsLocallyServed)
+	}
+
+	err := ValidatePrivateConfig(c.PrivateRDNSUpstreamConfig, privateNets)
+	if err != nil {
+		sev := SeverityWarning
+		if c.UsePrivateRDNS || errors.Is(err, upstream.ErrNoUpstreams) {
+			sev = SeverityError
+		}
+
+		v.add(sev, "PrivateRDNSUpstreamConfig", err)
+	}
+}
+
+// validateServer adds the problems of the server configuration to v.
+func (c *Config) validateServer(v *configValidator) {
+	if c.Ratelimit > 0 || c.TLSHandshakeRatelimit > 0 {
+		v.add(
+			SeverityError,
+			"RatelimitSubnetLenIPv4",
+			checkInclusion(c.RatelimitSubnetLenIPv4, 0, netutil.IPv4BitLen),
+		)
+		v.add(
+			SeverityError,
+			"RatelimitSubnetLenIPv6",
+			checkInclusion(c.RatelimitSubnetLenIPv6, 0, netutil.IPv6BitLen),
+		)
+	}
+
+	if c.TLSConfig == nil {
+		const errNoTLS errors.Error = "no tls config"
+
+		if c.TLSListenAddr != nil {
+			v.add(SeverityError, "TLSListenAddr", errNoTLS)
+		}
+
+		if c.HTTPSListenAddr != nil {
+			v.add(SeverityError, "HTTPSListenAddr", errNoTLS)
+		}
+
+		if c.QUICListenAddr != nil {
+			v.add(SeverityError, "QUICListenAddr", errNoTLS)
+		}
+	}
+
+	if (c.DNSCryptTCPListenAddr != nil || c.DNSCryptUDPListenAddr != nil) &&
+		(c.DNSCryptResolverCert == nil || c.DNSCryptProviderName == "") {
+		v.add(SeverityError, "DNSCryptResolverCert", errors.Error("no dnscrypt config"))
+	}
+
+	if c.Userinfo != nil && len(c.HTTPSListenAddr) == 0 && len(c.HTTPListenAddr) == 0 {
+		v.add(SeverityError, "Userinfo", errors.Error("no https addrs"))
+	}
+
+	v.add(SeverityError, "ListenRebindInterval", c.validateListenRebind())
+
+	if c.EDNSAddr != nil && !c.EnableEDNSClientSubnet {
+		v.add(
+			SeverityWarning,
+			"EDNSAddr",
+			errors.Error("ignored since EnableEDNSClientSubnet is false"),
+		)
+	}
+}
+
+// validateVirtualResolvers adds the problems of the virtual resolvers to v.
+func (c *Config) validateVirtualResolvers(v *configValidator) {
+	if len(c.VirtualResolvers) == 0 {
+		return
+	}
+
+	if len(c.TLSListenAddr) == 0 && len(c.HTTPSListenAddr) == 0 && len(c.HTTPListenAddr) == 0 {
+		v.add(
+			SeverityWarning,
+			"VirtualResolvers",
+			errors.Error("ignored since there are no tls, https, or http addrs"),
+		)
+	}
+
+	v.add(SeverityError, "VirtualResolvers", validateVirtualResolvers(c.VirtualResolvers))
+}
+
+// validateClientPolicies adds the problems of the per-client policies to v.
+func (c *Config) validateClientPolicies(v *configValidator) {
+	v.add(
+		SeverityError,
+		"EDNSSubnetLenIPv4",
+		checkInclusion(c.EDNSSubnetLenIPv4, 0, netutil.IPv4BitLen),
+	)
+	v.add(
+		SeverityError,
+		"EDNSSubnetLenIPv6",
+		checkInclusion(c.EDNSSubnetLenIPv6, 0, netutil.IPv6BitLen),
+	)
+
+	for i, pol := range c.ECSPolicies {
+		v.add(SeverityError, fmt.Sprintf("ECSPolicies[%d]", i), validateECSPolicy(pol))
+	}
+
+	for i, pref := range c.AddrPreferences {
+		v.add(SeverityError, fmt.Sprintf("AddrPreferences[%d]", i), validateAddrPreference(pref))
+	}
+}
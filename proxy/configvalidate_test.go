@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		c := &Config{
+			UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		}
+
+		assert.NoError(t, c.Validate())
+	})
+
+	t.Run("all_problems", func(t *testing.T) {
+		c := &Config{
+			UpstreamConfig:         &UpstreamConfig{},
+			UsePrivateRDNS:         true,
+			Fallbacks:              &UpstreamConfig{},
+			TLSListenAddr:          []*net.TCPAddr{{}},
+			Ratelimit:              10,
+			RatelimitSubnetLenIPv4: 33,
+			RatelimitSubnetLenIPv6: 64,
+			EDNSAddr:               net.IP{192, 0, 2, 1},
+			EDNSSubnetLenIPv6:      129,
+			ECSPolicies: []*ECSClientPolicy{{
+				Subnet: netip.MustParsePrefix("192.0.2.0/24"),
+			}, nil},
+			CacheMinTTL: 60,
+			CacheMaxTTL: 30,
+
+			CacheNegativeMinTTL: 60,
+			CacheNegativeMaxTTL: 30,
+
+			CacheSizeBytes:    1024,
+			CacheLowWatermark: 2048,
+
+			CacheAggressiveNSEC: true,
+			CachePrefetchHits:   10,
+			CacheFile:           "cache",
+
+			HedgeBudget: 2,
+
+			PoisonQueryThreshold: 3,
+
+			ListenRebindInterval: -1,
+
+			DNSSECNegativeTrustAnchors: []string{"bad..name"},
+		}
+
+		err := c.Validate()
+		require.Error(t, err)
+
+		probs := ConfigProblems{}
+		require.ErrorAs(t, err, &probs)
+
+		assert.True(t, probs.HasErrors())
+		assert.ErrorIs(t, err, upstream.ErrNoUpstreams)
+
+		got := map[string]Severity{}
+		for _, p := range probs {
+			got[p.Path] = p.Severity
+		}
+
+		assert.Equal(t, map[string]Severity{
+			"UpstreamConfig":                SeverityError,
+			"PrivateRDNSUpstreamConfig":     SeverityError,
+			"Fallbacks":                     SeverityError,
+			"RatelimitSubnetLenIPv4":        SeverityError,
+			"TLSListenAddr":                 SeverityError,
+			"EDNSAddr":                      SeverityWarning,
+			"EDNSSubnetLenIPv6":             SeverityError,
+			"ECSPolicies[1]":                SeverityError,
+			"CacheMinTTL":                   SeverityWarning,
+			"CacheNegativeMinTTL":           SeverityWarning,
+			"CacheLowWatermark":             SeverityWarning,
+			"CacheAggressiveNSEC":           SeverityWarning,
+			"CachePrefetchHits":             SeverityWarning,
+			"CacheFile":                     SeverityWarning,
+			"HedgeBudget":                   SeverityError,
+			"PoisonQueryThreshold":          SeverityWarning,
+			"ListenRebindInterval":          SeverityError,
+			"DNSSECNegativeTrustAnchors[0]": SeverityError,
+			"DNSSECValidate":                SeverityWarning,
+		}, got)
+	})
+
+	t.Run("warnings_only", func(t *testing.T) {
+		c := &Config{
+			UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+			EDNSAddr:       net.IP{192, 0, 2, 1},
+		}
+
+		probs := ConfigProblems{}
+		require.ErrorAs(t, c.Validate(), &probs)
+
+		assert.False(t, probs.HasErrors())
+	})
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// ValueKey is the key of a value of type T stored in a [DNSContext], so that
+// the handlers of the request, such as the filtering, routing, and logging
+// ones, can pass the metadata down the pipeline.  The keys are compared by
+// identity, so each one must be created once with [NewValueKey], usually as a
+// package-level variable of the package producing the values.
+type ValueKey[T any] struct {
+	name string
+}
+
+// NewValueKey returns a new key for the values of type T.  name is only used
+// to describe the values, e.g. in the query logs, and should be prefixed with
+// the name of the package creating the key, unless it's one of the common keys
+// declared in this package.
+func NewValueKey[T any](name string) (k *ValueKey[T]) {
+	return &ValueKey[T]{name: name}
+}
+
+// type check
+var _ fmt.Stringer = (*ValueKey[any])(nil)
+
+// String implements the [fmt.Stringer] interface for *ValueKey.
+func (k *ValueKey[T]) String() (s string) {
+	return k.name
+}
+
+// The common keys of the values set by the handlers of the request.  The
+// third-party handlers should use them for the metadata of the same meaning,
+// so that the handlers down the pipeline don't depend on the one setting it.
+var (
+	// KeyMatchedRule is the key of the name of the filtering or policy rule
+	// matched by the request.
+	KeyMatchedRule = NewValueKey[string]("matched_rule")
+
+	// KeyCategory is the key of the category of the requested domain, which
+	// the request has been blocked for.
+	KeyCategory = NewValueKey[string]("category")
+
+	// KeyPolicyTags is the key of the tags of the client, which the policies
+	// have been applied for.  The value must not be modified.
+	KeyPolicyTags = NewValueKey[[]string]("policy_tags")
+)
+
+// SetValue sets the value of dctx for k to v, replacing the previous one, if
+// any.  dctx must not be used concurrently.
+func SetValue[T any](dctx *DNSContext, k *ValueKey[T], v T) {
+	if dctx.values == nil {
+		dctx.values = map[fmt.Stringer]any{}
+	}
+
+	dctx.values[k] = v
+}
+
+// Value returns the value of dctx for k.  ok is false if it's not set.
+func Value[T any](dctx *DNSContext, k *ValueKey[T]) (v T, ok bool) {
+	v, ok = dctx.values[k].(T)
+
+	return v, ok
+}
+
+// DeleteValue removes the value of dctx for k, if any.  dctx must not be used
+// concurrently.
+func DeleteValue[T any](dctx *DNSContext, k *ValueKey[T]) {
+	delete(dctx.values, k)
+}
+
+// RangeValues calls f for each value of dctx along with the name of its key,
+// in the order of the names, until f returns false.  It's intended for the
+// handlers, which don't know the types of the values, such as the logging
+// ones.
+func (dctx *DNSContext) RangeValues(f func(name string, v any) (cont bool)) {
+	keys := make([]fmt.Stringer, 0, len(dctx.values))
+	for k := range dctx.values {
+		keys = append(keys, k)
+	}
+
+	slices.SortFunc(keys, func(a, b fmt.Stringer) (res int) {
+		return cmp.Compare(a.String(), b.String())
+	})
+
+	for _, k := range keys {
+		if !f(k.String(), dctx.values[k]) {
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValue(t *testing.T) {
+	// A key from another package with the same name as the common one.
+	otherKey := NewValueKey[int]("category")
+
+	dctx := &DNSContext{}
+
+	_, ok := Value(dctx, KeyCategory)
+	assert.False(t, ok)
+
+	SetValue(dctx, KeyCategory, "adult")
+	SetValue(dctx, KeyPolicyTags, []string{"kids"})
+	SetValue(dctx, otherKey, 42)
+
+	cat, ok := Value(dctx, KeyCategory)
+	assert.True(t, ok)
+	assert.Equal(t, "adult", cat)
+
+	n, ok := Value(dctx, otherKey)
+	assert.True(t, ok)
+	assert.Equal(t, 42, n)
+
+	var names []string
+	dctx.RangeValues(func(name string, _ any) (cont bool) {
+		names = append(names, name)
+
+		return true
+	})
+	assert.Equal(t, []string{"category", "category", "policy_tags"}, names)
+
+	DeleteValue(dctx, KeyCategory)
+
+	_, ok = Value(dctx, KeyCategory)
+	assert.False(t, ok)
+
+	n, ok = Value(dctx, otherKey)
+	assert.True(t, ok)
+	assert.Equal(t, 42, n)
+}
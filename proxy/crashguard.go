@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// maxPoisonQueries is the maximum number of distinct crashing requests tracked
+// for the quarantine.  The requests crashing after that are still reported, but
+// never quarantined, until the proxy is restarted.
+const maxPoisonQueries = 1024
+
+// The stages of handling a request reported in [CrashReport.Stage].
+const (
+	// CrashStageBefore is the stage of the preliminary checks of the request,
+	// including the [BeforeRequestHandler] and the rate limiting.
+	CrashStageBefore = "before"
+
+	// CrashStageValidate is the stage of answering the request by the proxy
+	// itself, if it's invalid or requests a special-use domain.
+	CrashStageValidate = "validate"
+
+	// CrashStageResolve is the stage of resolving the request with the
+	// [RequestHandler] or [Proxy.Resolve].
+	CrashStageResolve = "resolve"
+
+	// CrashStageRespond is the stage of writing the response to the client.
+	CrashStageRespond = "respond"
+)
+
+// CrashReport is a report of a panic recovered while handling a request.
+type CrashReport struct {
+	// Time is the time the panic occurred at.
+	Time time.Time
+
+	// Client is the address of the client that sent the request.
+	Client netip.AddrPort
+
+	// Proto is the protocol the request was received over.
+	Proto Proto
+
+	// Stage is the stage of handling the request the panic occurred at.  It's
+	// one of the CrashStage* constants.
+	Stage string
+
+	// Panic is the string representation of the recovered value.
+	Panic string
+
+	// Query is the request in the wire format.  It's nil if the request
+	// couldn't be packed.
+	Query []byte
+
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+
+	// Quarantined is true if the identical requests are refused since this
+	// one.
+	Quarantined bool
+}
+
+// crashGuard keeps the reports of the panics recovered while handling the
+// requests and the numbers of the crashes caused by the identical requests.
+// It's safe for concurrent use.
+type crashGuard struct {
+	// mu protects all the fields below.
+	mu *sync.Mutex
+
+	// reports is the ring buffer of the latest crash reports.
+	reports []*CrashReport
+
+	// crashes are the numbers of the crashes caused by the requests, keyed by
+	// their signatures, see [poisonSignature].
+	crashes map[string]uint
+
+	// next is the index of reports to put the next report at.
+	next int
+
+	// threshold is the number of crashes caused by the identical requests
+	// after which they are quarantined.  Zero disables the quarantine.
+	threshold uint
+}
+
+// newCrashGuard returns a new properly initialized *crashGuard or nil if the
+// recovery is disabled in c.
+func newCrashGuard(c *Config) (g *crashGuard) {
+	if c.CrashLogSize <= 0 {
+		return nil
+	}
+
+	return &crashGuard{
+		mu:        &sync.Mutex{},
+		reports:   make([]*CrashReport, 0, c.CrashLogSize),
+		crashes:   map[string]uint{},
+		threshold: c.PoisonQueryThreshold,
+	}
+}
+
+// poisonSignature returns the signature of req identifying the requests that
+// differ only in ID.  ok is false if req can't be packed.
+func poisonSignature(req *dns.Msg) (sig []byte, ok bool) {
+	sig, err := req.Pack()
+	if err != nil || len(sig) < uint16sz {
+		return nil, false
+	}
+
+	// Zero the ID, since the clients change it on retries.
+	sig[0], sig[1] = 0, 0
+
+	return sig, true
+}
+
+// isQuarantined returns true if the identical requests have crashed the
+// handling of req too many times.
+func (g *crashGuard) isQuarantined(req *dns.Msg) (ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.threshold == 0 || len(g.crashes) == 0 {
+		return false
+	}
+
+	sig, ok := poisonSignature(req)
+
+	return ok && g.crashes[string(sig)] >= g.threshold
+}
+
+// add stores the report r about the crash caused by req.
+func (g *crashGuard) add(r *CrashReport, req *dns.Msg) {
+	sig, ok := poisonSignature(req)
+	if ok {
+		r.Query = slices.Clone(sig)
+		binary.BigEndian.PutUint16(r.Query, req.Id)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if ok && g.threshold > 0 {
+		key := string(sig)
+		if n, has := g.crashes[key]; has || len(g.crashes) < maxPoisonQueries {
+			g.crashes[key] = n + 1
+			r.Quarantined = n+1 == g.threshold
+		}
+	}
+
+	if len(g.reports) < cap(g.reports) {
+		g.reports = append(g.reports, r)
+	} else {
+		g.reports[g.next] = r
+	}
+
+	g.next = (g.next + 1) % cap(g.reports)
+}
+
+// list returns the crash reports from the oldest to the newest.
+func (g *crashGuard) list() (reports []*CrashReport) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	reports = make([]*CrashReport, 0, len(g.reports))
+	if len(g.reports) == cap(g.reports) {
+		reports = append(reports, g.reports[g.next:]...)
+		reports = append(reports, g.reports[:g.next]...)
+	} else {
+		reports = append(reports, g.reports...)
+	}
+
+	return reports
+}
+
+// recoverRequest recovers the panic occurred while handling d at the stage
+// pointed by stage, reports it, and answers d with SERVFAIL, unless the panic
+// occurred while responding.  It must be deferred right in the function
+// handling the request.  It does nothing, so that the panic crashes the
+// program, if the recovery is disabled.
+func (p *Proxy) recoverRequest(d *DNSContext, stage *string) {
+	if p.crashGuard == nil {
+		return
+	}
+
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	r := &CrashReport{
+		Time:   time.Now(),
+		Client: d.Addr,
+		Proto:  d.Proto,
+		Stage:  *stage,
+		Panic:  fmt.Sprint(v),
+		Stack:  debug.Stack(),
+	}
+	p.crashGuard.add(r, d.Req)
+
+	log.Error("dnsproxy: recovered panic at stage %s handling request from %s: %s", r.Stage, d.Addr, r.Panic)
+	log.Debug("dnsproxy: panic stack trace:\n%s", r.Stack)
+	if r.Quarantined {
+		log.Info("dnsproxy: quarantined the requests identical to the one from %s", d.Addr)
+	}
+
+	if r.Stage != CrashStageRespond {
+		d.Res = p.messages.NewMsgSERVFAIL(d.Req)
+		p.respond(d)
+	}
+}
+
+// isQuarantined returns true if d should be refused since the identical
+// requests have crashed the handling too many times.
+func (p *Proxy) isQuarantined(d *DNSContext) (ok bool) {
+	return p.crashGuard != nil && p.crashGuard.isQuarantined(d.Req)
+}
+
+// CrashReports returns the reports of the latest panics recovered while
+// handling the requests, from the oldest to the newest.  It returns nil if the
+// recovery is disabled, see [Config.CrashLogSize].
+func (p *Proxy) CrashReports() (reports []*CrashReport) {
+	if p.crashGuard == nil {
+		return nil
+	}
+
+	return p.crashGuard.list()
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_CrashReports(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	const (
+		poisonHost = "poison.example."
+		otherHost  = "other.example."
+	)
+
+	handled := &atomic.Uint32{}
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		RequestHandler: func(p *Proxy, d *DNSContext) (err error) {
+			handled.Add(1)
+			if d.Req.Question[0].Name == poisonHost {
+				panic("poisoned")
+			}
+
+			return p.Resolve(d)
+		},
+		CrashLogSize:         2,
+		PoisonQueryThreshold: 2,
+	})
+
+	client := netip.MustParseAddrPort("192.0.2.1:53")
+	handle := func(t *testing.T, host string, id uint16) (resp *dns.Msg) {
+		t.Helper()
+
+		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		req.Id = id
+
+		dctx := &DNSContext{
+			Req:  req,
+			Addr: client,
+		}
+
+		require.NoError(t, p.handleDNSRequest(dctx))
+		require.NotNil(t, dctx.Res)
+
+		return dctx.Res
+	}
+
+	resp := handle(t, poisonHost, 1)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	reports := p.CrashReports()
+	require.Len(t, reports, 1)
+
+	r := reports[0]
+	assert.Equal(t, client, r.Client)
+	assert.Equal(t, CrashStageResolve, r.Stage)
+	assert.Equal(t, "poisoned", r.Panic)
+	assert.NotEmpty(t, r.Stack)
+	assert.False(t, r.Quarantined)
+
+	req := &dns.Msg{}
+	require.NoError(t, req.Unpack(r.Query))
+	assert.Equal(t, uint16(1), req.Id)
+	assert.Equal(t, poisonHost, req.Question[0].Name)
+
+	resp = handle(t, poisonHost, 2)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	reports = p.CrashReports()
+	require.Len(t, reports, 2)
+	assert.True(t, reports[1].Quarantined)
+
+	handled.Store(0)
+
+	resp = handle(t, poisonHost, 3)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	assert.Zero(t, handled.Load())
+
+	resp = handle(t, otherHost, 4)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, uint32(1), handled.Load())
+
+	t.Run("disabled", func(t *testing.T) {
+		noRecover := mustNew(t, &Config{
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{ups},
+			},
+			TrustedProxies: defaultTrustedProxies,
+			RequestHandler: func(_ *Proxy, _ *DNSContext) (err error) {
+				panic("poisoned")
+			},
+		})
+
+		assert.Panics(t, func() {
+			_ = noRecover.handleDNSRequest(&DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion(poisonHost, dns.TypeA),
+				Addr: client,
+			})
+		})
+		assert.Nil(t, noRecover.CrashReports())
+	})
+}
+
+func TestCrashGuard_list(t *testing.T) {
+	g := newCrashGuard(&Config{CrashLogSize: 2})
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+	for _, stage := range []string{CrashStageBefore, CrashStageValidate, CrashStageResolve} {
+		g.add(&CrashReport{Stage: stage}, req)
+	}
+
+	reports := g.list()
+	require.Len(t, reports, 2)
+
+	assert.Equal(t, CrashStageValidate, reports[0].Stage)
+	assert.Equal(t, CrashStageResolve, reports[1].Stage)
+	assert.False(t, g.isQuarantined(req))
+}
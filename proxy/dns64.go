@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"slices"
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -11,10 +12,17 @@ import (
 	"github.com/miekg/dns"
 )
 
+// nat64PrefixBitLens are the lengths of the NAT64 prefixes in bits, which the
+// IPv4 addresses can be embedded into.  See
+// https://datatracker.ietf.org/doc/html/rfc6052#section-2.2.
+var nat64PrefixBitLens = []int{32, 40, 48, 56, 64, 96}
+
 const (
-	// maxNAT64PrefixBitLen is the maximum length of a NAT64 prefix in bits.
-	// See https://datatracker.ietf.org/doc/html/rfc6147#section-5.2.
-	maxNAT64PrefixBitLen = 96
+	// nat64SuffixOctet is the index of the octet of an IPv4-embedded IPv6
+	// address reserved for the future use, which must be zero and is skipped
+	// when embedding.  See
+	// https://datatracker.ietf.org/doc/html/rfc6052#section-2.2.
+	nat64SuffixOctet = 8
 
 	// NAT64PrefixLength is the length of a NAT64 prefix in bytes.
 	NAT64PrefixLength = net.IPv6len - net.IPv4len
@@ -35,13 +43,29 @@ const (
 // Well-Known Prefix is used, just like Section 5.2 of RFC 6147 prescribes.  Any
 // configured set of prefixes discards the default Well-Known prefix unless it
 // is specified explicitly.  Each prefix also validated to be a valid IPv6 CIDR
-// with a maximum length of 96 bits.  The first specified prefix is then used to
-// synthesize AAAA records.
+// with one of the lengths allowed by Section 2.2 of RFC 6052.  The first
+// specified prefix is then used to synthesize AAAA records.
+//
+// The exclusion ranges are split by the address family.  If there are no IPv6
+// ones, the default ::ffff:0:0/96 is used, see Section 5.1.4 of RFC 6147.
 func (p *Proxy) setupDNS64() (err error) {
 	if !p.Config.UseDNS64 {
 		return nil
 	}
 
+	p.dns64Prefs, p.dns64ExclV6, p.dns64ExclV4 = nil, nil, nil
+	for _, pref := range p.Config.DNS64Exclude {
+		if pref.Addr().Is4() {
+			p.dns64ExclV4 = append(p.dns64ExclV4, pref.Masked())
+		} else {
+			p.dns64ExclV6 = append(p.dns64ExclV6, pref.Masked())
+		}
+	}
+
+	if len(p.dns64ExclV6) == 0 {
+		p.dns64ExclV6 = netutil.SliceSubnetSet{dns64DefaultExclusion}
+	}
+
 	if len(p.Config.DNS64Prefs) == 0 {
 		p.dns64Prefs = netutil.SliceSubnetSet{dns64WellKnownPref}
 
@@ -53,8 +77,13 @@ func (p *Proxy) setupDNS64() (err error) {
 			return fmt.Errorf("prefix at index %d: %q is not an IPv6 prefix", i, pref)
 		}
 
-		if pref.Bits() > maxNAT64PrefixBitLen {
-			return fmt.Errorf("prefix at index %d: %q is too long for DNS64", i, pref)
+		if !slices.Contains(nat64PrefixBitLens, pref.Bits()) {
+			return fmt.Errorf(
+				"prefix at index %d: %q: length must be one of %v",
+				i,
+				pref,
+				nat64PrefixBitLens,
+			)
 		}
 
 		p.dns64Prefs = append(p.dns64Prefs, pref.Masked())
@@ -109,7 +138,7 @@ func (p *Proxy) checkDNS64(req, resp *dns.Msg) (dns64Req *dns.Msg) {
 }
 
 // filterNAT64Answers filters out AAAA records that are within one of NAT64
-// exclusion prefixes.  hasAnswers is true if the filtered slice contains at
+// prefixes or IPv6 exclusion ranges.  hasAnswers is true if the filtered slice contains at
 // least a single AAAA answer not within the prefixes or a CNAME.
 //
 // TODO(e.burkov):  Remove prefs from args when old API is removed.
@@ -118,10 +147,10 @@ func (p *Proxy) filterNAT64Answers(rrs []dns.RR) (filtered []dns.RR, hasAnswers
 	for _, ans := range rrs {
 		switch ans := ans.(type) {
 		case *dns.AAAA:
-			addr, err := netutil.IPToAddrNoMapped(ans.AAAA)
+			addr, err := netutil.IPToAddr(ans.AAAA, netutil.AddrFamilyIPv6)
 			if err != nil {
 				log.Error("dnsproxy: bad aaaa record: %s", err)
-			} else if p.dns64Prefs.Contains(addr) {
+			} else if p.dns64Prefs.Contains(addr) || p.dns64ExclV6.Contains(addr) {
 				// Filter the record.
 				continue
 			} else {
@@ -169,7 +198,16 @@ func (p *Proxy) synthDNS64(origReq, origResp, resp *dns.Msg) (ok bool) {
 	}
 
 	newAns := make([]dns.RR, 0, len(resp.Answer))
+	hasSynth, hasExcluded := false, false
 	for _, ans := range resp.Answer {
+		if p.isExcludedA(ans) {
+			// A records with the excluded addresses aren't synthesized and
+			// must not be answered to AAAA queries as is.
+			hasExcluded = true
+
+			continue
+		}
+
 		rr := p.synthRR(ans, soaTTL)
 		if rr == nil {
 			// The error should have already been logged.
@@ -177,6 +215,13 @@ func (p *Proxy) synthDNS64(origReq, origResp, resp *dns.Msg) (ok bool) {
 		}
 
 		newAns = append(newAns, rr)
+		hasSynth = hasSynth || rr.Header().Rrtype == dns.TypeAAAA
+	}
+
+	if hasExcluded && !hasSynth {
+		// All the addresses are within the IPv4 exclusion ranges, so respond
+		// with the answer to the original query.
+		return false
 	}
 
 	origResp.Answer = newAns
@@ -190,6 +235,24 @@ func (p *Proxy) synthDNS64(origReq, origResp, resp *dns.Msg) (ok bool) {
 // DNS64.  See https://datatracker.ietf.org/doc/html/rfc6052#section-2.1.
 var dns64WellKnownPref = netip.MustParsePrefix("64:ff9b::/96")
 
+// dns64DefaultExclusion is the default IPv6 exclusion range of the addresses
+// in AAAA answers, which are the IPv4-mapped ones.  See
+// https://datatracker.ietf.org/doc/html/rfc6147#section-5.1.4.
+var dns64DefaultExclusion = netip.MustParsePrefix("::ffff:0:0/96")
+
+// isExcludedA returns true if rr is an A record with an address within one of
+// the IPv4 exclusion ranges.
+func (p *Proxy) isExcludedA(rr dns.RR) (ok bool) {
+	a, isA := rr.(*dns.A)
+	if !isA || len(p.dns64ExclV4) == 0 {
+		return false
+	}
+
+	addr, err := netutil.IPToAddr(a.A, netutil.AddrFamilyIPv4)
+
+	return err == nil && p.dns64ExclV4.Contains(addr)
+}
+
 // shouldStripDNS64 returns true if DNS64 is enabled and req is a PTR for a
 // reversed address within either one of custom DNS64 prefixes or the Well-Known
 // one.
@@ -230,20 +293,32 @@ func (p *Proxy) shouldStripDNS64(req *dns.Msg) (ok bool) {
 	return true
 }
 
-// mapDNS64 maps addr to IPv6 address using configured DNS64 prefix.  addr must
-// be a valid IPv4.  It panics, if there are no configured DNS64 prefixes,
-// because synthesis should not be performed unless DNS64 function enabled.
+// mapDNS64 maps addr to IPv6 address using configured DNS64 prefix as
+// described in Section 2.2 of RFC 6052.  addr must be a valid IPv4.  It panics,
+// if there are no configured DNS64 prefixes, because synthesis should not be
+// performed unless DNS64 function enabled.
 //
 // TODO(e.burkov):  Remove pref from args when old API is removed.
 func (p *Proxy) mapDNS64(addr netip.Addr) (mapped net.IP) {
 	// Don't mask the address here since it should have already been masked on
 	// initialization stage.
-	prefData := p.dns64Prefs[0].Addr().As16()
+	pref := p.dns64Prefs[0]
+	prefData := pref.Addr().As16()
 	addrData := addr.As4()
 
 	mapped = make(net.IP, net.IPv6len)
-	copy(mapped[:NAT64PrefixLength], prefData[:])
-	copy(mapped[NAT64PrefixLength:], addrData[:])
+	copy(mapped, prefData[:])
+
+	// Embed the address right after the prefix, skipping the reserved octet.
+	i := pref.Bits() / 8
+	for _, b := range addrData {
+		if i == nat64SuffixOctet {
+			i++
+		}
+
+		mapped[i] = b
+		i++
+	}
 
 	return mapped
 }
@@ -297,7 +372,7 @@ func (p *Proxy) performDNS64(
 	host := origReq.Question[0].Name
 	log.Debug("dnsproxy: received an empty aaaa response for %q, checking dns64", host)
 
-	dns64Resp, u, err := p.exchangeUpstreams(dns64Req, upstreams)
+	dns64Resp, u, _, err := p.exchangeUpstreams(dns64Req, upstreams)
 	if err != nil {
 		log.Error("dnsproxy: dns64 request failed: %s", err)
 
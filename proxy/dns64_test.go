@@ -395,3 +395,118 @@ func TestProxy_Resolve_dns64(t *testing.T) {
 		})
 	}
 }
+
+func TestProxy_mapDNS64(t *testing.T) {
+	// The examples are from RFC 6052 Section 2.4.
+	addr := netip.MustParseAddr("192.0.2.33")
+
+	testCases := []struct {
+		pref string
+		want string
+	}{{
+		pref: "2001:db8::/32",
+		want: "2001:db8:c000:221::",
+	}, {
+		pref: "2001:db8:100::/40",
+		want: "2001:db8:1c0:2:21::",
+	}, {
+		pref: "2001:db8:122::/48",
+		want: "2001:db8:122:c000:2:2100::",
+	}, {
+		pref: "2001:db8:122:300::/56",
+		want: "2001:db8:122:3c0:0:221::",
+	}, {
+		pref: "2001:db8:122:344::/64",
+		want: "2001:db8:122:344:c0:2:2100:0",
+	}, {
+		pref: "2001:db8:122:344::/96",
+		want: "2001:db8:122:344::c000:221",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.pref, func(t *testing.T) {
+			p := mustNew(t, &Config{
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{&fakeUpstream{}},
+				},
+				TrustedProxies: defaultTrustedProxies,
+				UseDNS64:       true,
+				DNS64Prefs:     []netip.Prefix{netip.MustParsePrefix(tc.pref)},
+			})
+
+			assert.Equal(t, net.ParseIP(tc.want), p.mapDNS64(addr))
+		})
+	}
+
+	_, err := New(&Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{&fakeUpstream{}},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		UseDNS64:       true,
+		DNS64Prefs:     []netip.Prefix{netip.MustParsePrefix("2001:db8::/80")},
+	})
+	assert.Error(t, err)
+}
+
+func TestProxy_Resolve_dns64Exclude(t *testing.T) {
+	const (
+		mappedDomain   = "mapped.example."
+		excludedDomain = "excluded.example."
+	)
+
+	answers := map[string][]dns.RR{
+		mappedDomain + " AAAA": {
+			newRR(t, mappedDomain, dns.TypeAAAA, 3600, net.ParseIP("::ffff:1.2.3.4")),
+		},
+		mappedDomain + " A": {
+			newRR(t, mappedDomain, dns.TypeA, 3600, net.IP{1, 2, 3, 4}),
+		},
+		excludedDomain + " A": {
+			newRR(t, excludedDomain, dns.TypeA, 3600, net.IP{10, 0, 0, 1}),
+		},
+	}
+
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			q := req.Question[0]
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = answers[q.Name+" "+dns.Type(q.Qtype).String()]
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		UseDNS64:       true,
+		DNS64Exclude:   []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+
+	resolve := func(t *testing.T, name string) (ans []dns.RR) {
+		t.Helper()
+
+		d := p.newDNSContext(ProtoUDP, (&dns.Msg{}).SetQuestion(name, dns.TypeAAAA))
+		require.NoError(t, p.Resolve(d))
+		require.NotNil(t, d.Res)
+
+		return d.Res.Answer
+	}
+
+	t.Run("ipv4_mapped", func(t *testing.T) {
+		ans := resolve(t, mappedDomain)
+		require.Len(t, ans, 1)
+
+		aaaa := testutil.RequireTypeAssert[*dns.AAAA](t, ans[0])
+		assert.Equal(t, net.ParseIP("64:ff9b::102:304"), aaaa.AAAA)
+	})
+
+	t.Run("ipv4_excluded", func(t *testing.T) {
+		assert.Empty(t, resolve(t, excludedDomain))
+	})
+}
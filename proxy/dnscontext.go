@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"net/netip"
@@ -15,7 +16,7 @@ import (
 // DNSContext represents a DNS request message context
 type DNSContext struct {
 	// Conn is the underlying client connection.  It is nil if Proto is
-	// ProtoDNSCrypt, ProtoHTTPS, or ProtoQUIC.
+	// ProtoDNSCrypt, ProtoHTTPS, ProtoHTTP, ProtoGRPC, or ProtoQUIC.
 	Conn net.Conn
 
 	// QUICConnection is the QUIC session from which we got the query.  For
@@ -33,15 +34,21 @@ type DNSContext struct {
 	// DNSCryptResponseWriter - necessary to respond to a DNSCrypt query
 	DNSCryptResponseWriter dnscrypt.ResponseWriter
 
-	// HTTPResponseWriter - HTTP response writer (for DoH only)
+	// HTTPResponseWriter - HTTP response writer (for DoH and DNS-over-gRPC
+	// only)
 	HTTPResponseWriter http.ResponseWriter
 
-	// HTTPRequest - HTTP request (for DoH only)
+	// HTTPRequest - HTTP request (for DoH and DNS-over-gRPC only)
 	HTTPRequest *http.Request
 
 	// ReqECS is the EDNS Client Subnet used in the request.
 	ReqECS *net.IPNet
 
+	// VirtualResolver is the virtual resolver selected by the server name the
+	// client presented.  It's nil if there is none.  For [ProtoTLS],
+	// [ProtoHTTPS], and [ProtoHTTP] only.
+	VirtualResolver *VirtualResolver
+
 	// CustomUpstreamConfig is the upstreams configuration used only for current
 	// request.  The Resolve method of Proxy uses it instead of the default
 	// servers if it's not nil.
@@ -73,6 +80,10 @@ type DNSContext struct {
 	// server or, if the upstream server is unavailable, to a fallback server.
 	QueryDuration time.Duration
 
+	// Provenance describes where the response has come from.  It's filled by
+	// the proxy while resolving the request and responding to it.
+	Provenance Provenance
+
 	// DoQVersion is the DoQ protocol version. It can (and should) be read from
 	// ALPN, but in the current version we also use the way DNS messages are
 	// encoded as a signal.
@@ -83,6 +94,18 @@ type DNSContext struct {
 	// instance.
 	RequestID uint64
 
+	// stale is the expired cached response to serve if the upstreams fail to
+	// resolve the request, see [Config.CacheServeStale].
+	stale *staleResponse
+
+	// values are the values set by the handlers of the request by their keys,
+	// see [ValueKey].
+	values map[fmt.Stringer]any
+
+	// svcbAliasDepth is the number of the AliasMode records followed to get
+	// to the request, see [Proxy.resolveSVCBAliases].
+	svcbAliasDepth uint
+
 	// udpSize is the UDP buffer size from request's EDNS0 RR if presented,
 	// or default otherwise.
 	udpSize uint16
@@ -99,6 +122,10 @@ type DNSContext struct {
 
 	// doBit is the DNSSEC OK flag from request's EDNS0 RR if presented.
 	doBit bool
+
+	// dnssecSecure is true if the response has been validated as secure by
+	// the proxy itself, as opposed to having the AD flag set by the upstream.
+	dnssecSecure bool
 }
 
 // newDNSContext returns a new properly initialized *DNSContext.
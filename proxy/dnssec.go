@@ -0,0 +1,869 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// dnssecMaxZones is the maximum number of the validated delegations cached at
+// once, so that the requests for the random names don't make the cache take
+// too much memory.
+const dnssecMaxZones = 10_000
+
+// errBogus is returned when the DNSSEC validation of a response fails.
+const errBogus errors.Error = "bogus"
+
+// rootTrustAnchors are the DS records of the key signing keys of the root zone,
+// see https://data.iana.org/root-anchors/root-anchors.xml.
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// supportedDNSKEYAlgorithms are the DNSKEY algorithms, the signatures of which
+// can be verified.  The zones signed only with the other ones are treated as
+// insecure, see RFC 4035 Section 5.2.
+var supportedDNSKEYAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+// supportedDigestTypes are the DS digest types, which can be checked.
+var supportedDigestTypes = map[uint8]bool{
+	dns.SHA1:   true,
+	dns.SHA256: true,
+	dns.SHA384: true,
+}
+
+// dnssecExchangeFunc sends req to the upstreams and returns the response.
+type dnssecExchangeFunc func(req *dns.Msg) (resp *dns.Msg, err error)
+
+// dnssecZone is the validated delegation to a name.
+type dnssecZone struct {
+	// expire is the time after which the delegation must be validated again.
+	expire time.Time
+
+	// keys are the validated DNSKEY records of the zone with the apex at the
+	// name.  It's nil if the name isn't a zone cut or the zone is insecure.
+	keys []*dns.DNSKEY
+
+	// insecure is true if the name is a delegation to an unsigned zone.
+	insecure bool
+
+	// nonexistent is true if the name doesn't exist, so neither do the zones
+	// below it.
+	nonexistent bool
+}
+
+// dnssecValidator validates the DNSSEC signatures of the responses from the
+// configured trust anchors down to the signers of the records, see RFC 4035
+// Section 5.  It's safe for concurrent use.
+type dnssecValidator struct {
+	// mu protects zones.
+	mu *sync.Mutex
+
+	// zones are the validated delegations by the lowercased names.
+	zones map[string]*dnssecZone
+
+	// anchors are the trust anchors by the lowercased zone names.
+	anchors map[string][]*dns.DS
+
+	// negativeAnchors are the lowercased names of the domains, the validation
+	// of which is disabled, see RFC 7646.
+	negativeAnchors []string
+}
+
+// newDNSSECValidator returns a new properly initialized *dnssecValidator or nil
+// if the validation is disabled in c.
+func newDNSSECValidator(c *Config) (v *dnssecValidator) {
+	if !c.DNSSECValidate {
+		return nil
+	}
+
+	anchors := c.DNSSECTrustAnchors
+	if len(anchors) == 0 {
+		anchors = defaultTrustAnchors()
+	}
+
+	v = &dnssecValidator{
+		mu:      &sync.Mutex{},
+		zones:   map[string]*dnssecZone{},
+		anchors: map[string][]*dns.DS{},
+	}
+
+	for _, ds := range anchors {
+		if ds == nil {
+			// Reported by [Config.validateDNSSEC].
+			continue
+		}
+
+		zone := strings.ToLower(dns.Fqdn(ds.Hdr.Name))
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+
+	for _, name := range c.DNSSECNegativeTrustAnchors {
+		v.negativeAnchors = append(v.negativeAnchors, strings.ToLower(dns.Fqdn(name)))
+	}
+
+	return v
+}
+
+// defaultTrustAnchors returns the parsed [rootTrustAnchors].
+func defaultTrustAnchors() (anchors []*dns.DS) {
+	for _, s := range rootTrustAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(fmt.Errorf("parsing root trust anchor: %w", err))
+		}
+
+		anchors = append(anchors, rr.(*dns.DS))
+	}
+
+	return anchors
+}
+
+// validateDNSSEC returns an error if the DNSSEC validation configuration of c
+// is invalid.
+func (c *Config) validateDNSSEC() (err error) {
+	for i, ds := range c.DNSSECTrustAnchors {
+		err = validateTrustAnchor(ds)
+		if err != nil {
+			return fmt.Errorf("trust anchor at index %d: %w", i, err)
+		}
+	}
+
+	for i, name := range c.DNSSECNegativeTrustAnchors {
+		err = validateNegativeTrustAnchor(name)
+		if err != nil {
+			return fmt.Errorf("negative trust anchor at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validateTrustAnchor returns an error if ds can't be used as a trust anchor.
+func validateTrustAnchor(ds *dns.DS) (err error) {
+	if ds == nil {
+		return errors.Error("nil record")
+	} else if _, ok := dns.IsDomainName(ds.Hdr.Name); !ok {
+		return fmt.Errorf("bad owner name %q", ds.Hdr.Name)
+	}
+
+	return nil
+}
+
+// validateNegativeTrustAnchor returns an error if name can't be used as a
+// negative trust anchor.
+func validateNegativeTrustAnchor(name string) (err error) {
+	if name == "." {
+		// Allow disabling the validation for all the names.
+		return nil
+	}
+
+	// Don't wrap the error since it's informative enough as is.
+	return netutil.ValidateDomainName(strings.TrimSuffix(name, "."))
+}
+
+// clear removes the cached delegations from v.
+func (v *dnssecValidator) clear() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.zones = map[string]*dnssecZone{}
+}
+
+// validate validates resp to req.  It returns true if resp is secure, false if
+// it's insecure, and an error if it's bogus or can't be validated.  exchange
+// is used to get the DS and DNSKEY records.
+func (v *dnssecValidator) validate(
+	req *dns.Msg,
+	resp *dns.Msg,
+	now time.Time,
+	exchange dnssecExchangeFunc,
+) (secure bool, err error) {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return false, nil
+	}
+
+	name := strings.ToLower(dns.Fqdn(q.Name))
+	if v.isNegative(name) {
+		return false, nil
+	}
+
+	secure = true
+	var positive bool
+	var nextClosers []string
+	var dnames []*dns.DNAME
+	for _, set := range rrSets(resp.Answer) {
+		owner := strings.ToLower(set[0].Header().Name)
+		typ := set[0].Header().Rrtype
+		if owner == name && (typ == q.Qtype || q.Qtype == dns.TypeANY) {
+			positive = true
+		}
+
+		if typ == dns.TypeCNAME && owner == name {
+			name = strings.ToLower(set[0].(*dns.CNAME).Target)
+		}
+
+		if isSynthesizedCNAME(set, dnames) {
+			// The CNAME records synthesized from the validated DNAME ones
+			// aren't signed, see RFC 6672 Section 5.3.3.
+			continue
+		}
+
+		var sig *dns.RRSIG
+		sig, err = v.validateRRSet(set, resp.Answer, now, exchange)
+		if err != nil {
+			return false, err
+		} else if sig == nil {
+			secure = false
+		} else if labels := int(sig.Labels); labels < dns.CountLabel(owner) {
+			// The name just below the wildcard is the next closer one.
+			nextClosers = append(nextClosers, ancestor(owner, labels+1))
+		} else if typ == dns.TypeDNAME {
+			dnames = append(dnames, set[0].(*dns.DNAME))
+		}
+	}
+
+	// The answers expanded from the wildcards must come with the proof that
+	// there is no closer match, see RFC 4035 Section 5.3.4 and RFC 5155
+	// Section 8.8.
+	for _, nextCloser := range nextClosers {
+		var denied bool
+		denied, err = v.validateDenial(resp, nextCloser, q.Qtype, true, now, exchange)
+		if err != nil || !denied {
+			return false, err
+		}
+	}
+
+	if positive {
+		return secure, nil
+	}
+
+	denied, err := v.validateDenial(resp, name, q.Qtype, false, now, exchange)
+
+	return secure && denied, err
+}
+
+// validateRRSet validates the signatures of set from msgRRs.  It returns the
+// valid signature or nil if the zone of set is insecure.
+func (v *dnssecValidator) validateRRSet(
+	set []dns.RR,
+	msgRRs []dns.RR,
+	now time.Time,
+	exchange dnssecExchangeFunc,
+) (sig *dns.RRSIG, err error) {
+	hdr := set[0].Header()
+	name := strings.ToLower(hdr.Name)
+	if hdr.Rrtype == dns.TypeDS {
+		// The DS records are signed by the parent zone.
+		name = ancestor(name, dns.CountLabel(name)-1)
+	}
+
+	zone, keys, err := v.zoneKeys(name, now, exchange)
+	if err != nil || keys == nil {
+		return nil, err
+	}
+
+	return verifyRRSet(set, msgRRs, zone, keys, now)
+}
+
+// validateDenial validates the negative response resp for the records of
+// qtype with name.  If wildcard is true, it validates the proof that the next
+// closer name of the wildcard positive response, name, doesn't exist.  It
+// returns false if the zone of name is insecure.
+func (v *dnssecValidator) validateDenial(
+	resp *dns.Msg,
+	name string,
+	qtype uint16,
+	wildcard bool,
+	now time.Time,
+	exchange dnssecExchangeFunc,
+) (secure bool, err error) {
+	zoneName := name
+	if qtype == dns.TypeDS || wildcard {
+		// The DS records are served by the parent zone, and the next closer
+		// name doesn't exist, unlike its parent, the closest encloser.
+		zoneName = ancestor(name, dns.CountLabel(name)-1)
+	}
+
+	zone, keys, err := v.zoneKeys(zoneName, now, exchange)
+	if err != nil || keys == nil {
+		return false, err
+	}
+
+	z, err := verifyDenial(resp, zone, keys, now, wildcard)
+	if err != nil {
+		return false, fmt.Errorf("denial of %s: %w", name, err)
+	}
+
+	switch {
+	case wildcard:
+		if z.nsecDenial(name, time.Time{}) == nil && z.nsec3Denial(name, time.Time{}) == nil {
+			return false, fmt.Errorf("%w: no wildcard proof for %s", errBogus, name)
+		}
+	case resp.Rcode == dns.RcodeNameError:
+		if name == zone || (z.nsecProof(name, time.Time{}) == nil && z.nsec3Proof(name, zone, time.Time{}) == nil) {
+			return false, fmt.Errorf("%w: no nxdomain proof for %s", errBogus, name)
+		}
+	default:
+		if !z.provesNoData(name, qtype, time.Time{}) {
+			return false, fmt.Errorf("%w: no nodata proof for %s", errBogus, name)
+		}
+	}
+
+	return true, nil
+}
+
+// isNegative returns true if name is within one of the negative trust anchors.
+func (v *dnssecValidator) isNegative(name string) (ok bool) {
+	for _, nta := range v.negativeAnchors {
+		if dns.IsSubDomain(nta, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// zoneKeys returns the apex name and the validated keys of the deepest zone
+// containing name, walking the delegations down from the closest trust anchor.
+// keys are nil if the zone is insecure.
+func (v *dnssecValidator) zoneKeys(
+	name string,
+	now time.Time,
+	exchange dnssecExchangeFunc,
+) (zone string, keys []*dns.DNSKEY, err error) {
+	if v.isNegative(name) {
+		return "", nil, nil
+	}
+
+	n := dns.CountLabel(name)
+	for ; n >= 0; n-- {
+		zone = ancestor(name, n)
+		if v.anchors[zone] != nil {
+			break
+		}
+	}
+
+	if n < 0 {
+		// There is no trust anchor for the name.
+		return "", nil, nil
+	}
+
+	keys, err = v.anchorKeys(zone, now, exchange)
+	if err != nil || keys == nil {
+		return zone, nil, err
+	}
+
+	for n++; n <= dns.CountLabel(name); n++ {
+		child := ancestor(name, n)
+
+		var z *dnssecZone
+		z, err = v.delegation(child, zone, keys, now, exchange)
+		switch {
+		case err != nil:
+			return "", nil, err
+		case z.nonexistent:
+			return zone, keys, nil
+		case z.insecure:
+			return child, nil, nil
+		case z.keys != nil:
+			zone, keys = child, z.keys
+		}
+	}
+
+	return zone, keys, nil
+}
+
+// anchorKeys returns the keys of zone validated with its trust anchors.
+func (v *dnssecValidator) anchorKeys(
+	zone string,
+	now time.Time,
+	exchange dnssecExchangeFunc,
+) (keys []*dns.DNSKEY, err error) {
+	if z := v.cached(zone, now); z != nil {
+		return z.keys, nil
+	}
+
+	resp, err := exchange(newDNSSECRequest(zone, dns.TypeDNSKEY))
+	if err != nil {
+		return nil, fmt.Errorf("getting dnskey of %s: %w", zone, err)
+	}
+
+	keys, ttl, err := verifyKeys(zone, resp, v.anchors[zone], now)
+	if err != nil {
+		return nil, fmt.Errorf("dnskey of %s: %w", zone, err)
+	}
+
+	v.store(zone, &dnssecZone{
+		expire:   now.Add(time.Duration(ttl) * time.Second),
+		keys:     keys,
+		insecure: keys == nil,
+	}, now)
+
+	return keys, nil
+}
+
+// delegation returns the validated delegation to child from its parent zone
+// with the apex name parent and keys.
+func (v *dnssecValidator) delegation(
+	child string,
+	parent string,
+	keys []*dns.DNSKEY,
+	now time.Time,
+	exchange dnssecExchangeFunc,
+) (z *dnssecZone, err error) {
+	if z = v.cached(child, now); z != nil {
+		return z, nil
+	}
+
+	resp, err := exchange(newDNSSECRequest(child, dns.TypeDS))
+	if err != nil {
+		return nil, fmt.Errorf("getting ds of %s: %w", child, err)
+	}
+
+	var ttl uint32
+	if set := rrsOfType(resp.Answer, child, dns.TypeDS); len(set) > 0 {
+		z, ttl, err = v.secureDelegation(child, parent, keys, resp, set, now, exchange)
+	} else {
+		z, ttl, err = v.unsignedDelegation(child, parent, keys, resp, now)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("ds of %s: %w", child, err)
+	}
+
+	z.expire = now.Add(time.Duration(ttl) * time.Second)
+	v.store(child, z, now)
+
+	return z, nil
+}
+
+// secureDelegation returns the delegation to child with the DS records set
+// from resp signed by the parent zone with keys, and its TTL.
+func (v *dnssecValidator) secureDelegation(
+	child string,
+	parent string,
+	keys []*dns.DNSKEY,
+	resp *dns.Msg,
+	set []dns.RR,
+	now time.Time,
+	exchange dnssecExchangeFunc,
+) (z *dnssecZone, ttl uint32, err error) {
+	sig, err := verifyRRSet(set, resp.Answer, parent, keys, now)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ds := make([]*dns.DS, 0, len(set))
+	for _, rr := range set {
+		ds = append(ds, rr.(*dns.DS))
+	}
+
+	keysResp, err := exchange(newDNSSECRequest(child, dns.TypeDNSKEY))
+	if err != nil {
+		return nil, 0, fmt.Errorf("getting dnskey: %w", err)
+	}
+
+	childKeys, keysTTL, err := verifyKeys(child, keysResp, ds, now)
+	if err != nil {
+		return nil, 0, fmt.Errorf("dnskey: %w", err)
+	}
+
+	z = &dnssecZone{
+		keys:     childKeys,
+		insecure: childKeys == nil,
+	}
+
+	return z, min(rrSetTTL(set, sig, now), keysTTL), nil
+}
+
+// unsignedDelegation returns the delegation to child proven by the negative
+// response resp signed by the parent zone with keys, and its TTL.
+func (v *dnssecValidator) unsignedDelegation(
+	child string,
+	parent string,
+	keys []*dns.DNSKEY,
+	resp *dns.Msg,
+	now time.Time,
+) (z *dnssecZone, ttl uint32, err error) {
+	if rrs := rrsOfType(resp.Answer, child, dns.TypeCNAME); len(rrs) > 0 {
+		// The names having CNAME records can't be zone cuts, and the records
+		// themselves are validated along with the response.
+		return &dnssecZone{}, rrs[0].Header().Ttl, nil
+	}
+
+	nz, err := verifyDenial(resp, parent, keys, now, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ttl = min(nz.soa[0].Header().Ttl, nz.soa[0].(*dns.SOA).Minttl)
+	if resp.Rcode == dns.RcodeNameError {
+		return &dnssecZone{nonexistent: true}, ttl, nil
+	}
+
+	types, match, optOut := nz.matchTypes(child, time.Time{})
+	switch {
+	case match && slices.Contains(types, dns.TypeDS):
+		return nil, 0, fmt.Errorf("%w: ds denied by record having it", errBogus)
+	case match && slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA):
+		return &dnssecZone{insecure: true}, ttl, nil
+	case optOut:
+		// The unsigned delegations may be covered by the Opt-Out NSEC3 records,
+		// see RFC 5155 Section 6.
+		return &dnssecZone{insecure: true}, ttl, nil
+	default:
+		// The name isn't a zone cut, so the records under it are signed by the
+		// parent zone.
+		return &dnssecZone{}, ttl, nil
+	}
+}
+
+// cached returns the unexpired delegation to name, if any.
+func (v *dnssecValidator) cached(name string, now time.Time) (z *dnssecZone) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	z = v.zones[name]
+	if z == nil || !now.Before(z.expire) {
+		return nil
+	}
+
+	return z
+}
+
+// store caches the delegation z to name.  If there is no space for it, the
+// delegations expired at now are removed, and then the ones expiring the
+// soonest.
+func (v *dnssecValidator) store(name string, z *dnssecZone, now time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.zones[name]; !ok && len(v.zones) >= dnssecMaxZones {
+		v.evict(now)
+	}
+
+	v.zones[name] = z
+}
+
+// evict removes the delegations expired at now and, if there is still no space
+// for another one, the ones expiring the soonest.  v.mu must be locked.
+func (v *dnssecValidator) evict(now time.Time) {
+	for n, cached := range v.zones {
+		if !now.Before(cached.expire) {
+			delete(v.zones, n)
+		}
+	}
+
+	for len(v.zones) >= dnssecMaxZones {
+		var soonest string
+		var expire time.Time
+		for n, cached := range v.zones {
+			if soonest == "" || cached.expire.Before(expire) {
+				soonest, expire = n, cached.expire
+			}
+		}
+
+		delete(v.zones, soonest)
+	}
+}
+
+// verifyKeys returns the DNSKEY records from resp, if the ones matching any of
+// ds sign them, and their TTL.  keys are nil if none of ds are supported, so
+// that the zone is insecure.
+func verifyKeys(
+	zone string,
+	resp *dns.Msg,
+	ds []*dns.DS,
+	now time.Time,
+) (keys []*dns.DNSKEY, ttl uint32, err error) {
+	set := rrsOfType(resp.Answer, zone, dns.TypeDNSKEY)
+	for _, rr := range set {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	var supported bool
+	for _, d := range ds {
+		if !supportedDigestTypes[d.DigestType] || !supportedDNSKEYAlgorithms[d.Algorithm] {
+			continue
+		}
+
+		supported = true
+		for _, k := range keys {
+			if k.KeyTag() != d.KeyTag || k.Algorithm != d.Algorithm {
+				continue
+			}
+
+			kd := k.ToDS(d.DigestType)
+			if kd == nil || !strings.EqualFold(kd.Digest, d.Digest) {
+				continue
+			}
+
+			sig, vErr := verifyRRSet(set, resp.Answer, zone, []*dns.DNSKEY{k}, now)
+			if vErr == nil {
+				return keys, rrSetTTL(set, sig, now), nil
+			}
+		}
+	}
+
+	if !supported {
+		return nil, setTTL(ds), nil
+	}
+
+	return nil, 0, fmt.Errorf("%w: no valid key signing keys", errBogus)
+}
+
+// verifyDenial verifies the signatures of the SOA, NSEC, and NSEC3 records from
+// the authority section of resp by the zone with the apex name zone and keys,
+// and returns the zone made of them.  The SOA record is only required if
+// wildcard is false, since the wildcard positive responses don't have it.
+func verifyDenial(
+	resp *dns.Msg,
+	zone string,
+	keys []*dns.DNSKEY,
+	now time.Time,
+	wildcard bool,
+) (z *nsecZone, err error) {
+	var hasSOA bool
+	for _, set := range rrSets(resp.Ns) {
+		switch set[0].Header().Rrtype {
+		case dns.TypeSOA:
+			hasSOA = strings.EqualFold(set[0].Header().Name, zone)
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			// Go on.
+		default:
+			continue
+		}
+
+		_, err = verifyRRSet(set, resp.Ns, zone, keys, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Reuse the aggressive NSEC caching logic to check the proofs.  The
+	// records are only used once, so their TTLs don't matter.
+	c := newNSECCache()
+	if wildcard {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		z = newNSECZone()
+		c.setRecords(z, resp.Ns, zone, math.MaxUint32, time.Time{})
+
+		return z, nil
+	} else if !hasSOA {
+		return nil, fmt.Errorf("%w: no soa of %s", errBogus, zone)
+	}
+
+	c.set(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: resp.Rcode, AuthenticatedData: true},
+		Ns:     resp.Ns,
+	}, time.Time{})
+
+	z = c.zones[zone]
+	if z == nil {
+		return nil, fmt.Errorf("%w: no signed soa of %s", errBogus, zone)
+	}
+
+	return z, nil
+}
+
+// verifyRRSet returns the signature of set from msgRRs made by the zone with
+// the apex name signer and one of keys, which is valid at now.
+func verifyRRSet(
+	set []dns.RR,
+	msgRRs []dns.RR,
+	signer string,
+	keys []*dns.DNSKEY,
+	now time.Time,
+) (sig *dns.RRSIG, err error) {
+	hdr := set[0].Header()
+	for _, rr := range findSigs(msgRRs, hdr.Name, signer, hdr.Rrtype) {
+		sig = rr.(*dns.RRSIG)
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && sig.Verify(k, set) == nil {
+				return sig, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf(
+		"%w: no valid signature of %s %s by %s",
+		errBogus,
+		hdr.Name,
+		dns.Type(hdr.Rrtype),
+		signer,
+	)
+}
+
+// rrSets returns the RRsets of rrs except the signatures and the OPT records,
+// in the order of their first records.
+func rrSets(rrs []dns.RR) (sets [][]dns.RR) {
+	type setKey struct {
+		name string
+		typ  uint16
+	}
+
+	idx := map[setKey]int{}
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		k := setKey{name: strings.ToLower(hdr.Name), typ: hdr.Rrtype}
+		if i, ok := idx[k]; ok {
+			sets[i] = append(sets[i], rr)
+		} else {
+			idx[k] = len(sets)
+			sets = append(sets, []dns.RR{rr})
+		}
+	}
+
+	return sets
+}
+
+// isSynthesizedCNAME returns true if set is a single CNAME record synthesized
+// from one of dnames, see RFC 6672 Section 3.1.
+func isSynthesizedCNAME(set []dns.RR, dnames []*dns.DNAME) (ok bool) {
+	cname, ok := set[0].(*dns.CNAME)
+	if !ok || len(set) != 1 {
+		return false
+	}
+
+	owner := strings.ToLower(cname.Hdr.Name)
+	for _, d := range dnames {
+		dOwner := strings.ToLower(d.Hdr.Name)
+		if owner == dOwner || !dns.IsSubDomain(dOwner, owner) {
+			continue
+		}
+
+		// Replace the owner of the DNAME record in the owner of the CNAME one
+		// with the target of the DNAME record.
+		labels := dns.SplitDomainName(owner)[:dns.CountLabel(owner)-dns.CountLabel(dOwner)]
+		labels = append(labels, dns.SplitDomainName(d.Target)...)
+		if strings.EqualFold(cname.Target, dns.Fqdn(strings.Join(labels, "."))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rrsOfType returns the records of typ with name from rrs.
+func rrsOfType(rrs []dns.RR, name string, typ uint16) (res []dns.RR) {
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == typ && strings.EqualFold(hdr.Name, name) {
+			res = append(res, rr)
+		}
+	}
+
+	return res
+}
+
+// rrSetTTL returns the time in seconds for which the validated set with sig
+// can be used, see RFC 4035 Section 5.3.3.
+func rrSetTTL(set []dns.RR, sig *dns.RRSIG, now time.Time) (ttl uint32) {
+	ttl = min(setTTL(set), sig.OrigTtl)
+
+	// The expiration time is a serial number, see RFC 4034 Section 3.1.5.
+	left := int64(sig.Expiration) - now.Unix()
+	if left < int64(ttl) {
+		ttl = uint32(max(left, 0))
+	}
+
+	return ttl
+}
+
+// setTTL returns the minimum TTL of rrs.
+func setTTL[T dns.RR](rrs []T) (ttl uint32) {
+	if len(rrs) == 0 {
+		return 0
+	}
+
+	ttl = rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+
+	return ttl
+}
+
+// newDNSSECRequest returns a new request for the records of qtype with name
+// used for validation.  The upstreams are asked not to validate the response
+// themselves, since it's validated with the configured trust anchors.
+func newDNSSECRequest(name string, qtype uint16) (req *dns.Msg) {
+	req = (&dns.Msg{}).SetQuestion(name, qtype)
+	req.CheckingDisabled = true
+	req.SetEdns0(defaultUDPBufSize, true)
+
+	return req
+}
+
+// validateDNSSECResp validates resp to the request from d.  It returns resp with
+// the AD flag set if it's secure or cleared if it's insecure, and the SERVFAIL
+// response if it's bogus or can't be validated.  The responses to the requests
+// with the CD flag set aren't validated.
+func (p *Proxy) validateDNSSECResp(d *DNSContext, resp *dns.Msg) (validated *dns.Msg) {
+	d.dnssecSecure = false
+	if p.dnssecValidator == nil || resp == nil || d.Req.CheckingDisabled {
+		return resp
+	} else if d.RequestedPrivateRDNS != (netip.Prefix{}) {
+		// The locally served zones are usually unsigned and their delegations
+		// aren't known to the private upstreams.
+		return resp
+	}
+
+	exchange := func(req *dns.Msg) (resp *dns.Msg, err error) {
+		sub := &DNSContext{
+			Req:                  req,
+			Addr:                 d.Addr,
+			CustomUpstreamConfig: d.CustomUpstreamConfig,
+		}
+
+		ups, g, _ := p.selectUpstreams(sub)
+		resp, _, _, err = p.exchangeRouted(req, ups, g)
+		if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("rcode %s", dns.RcodeToString[resp.Rcode])
+		}
+
+		return resp, err
+	}
+
+	secure, err := p.dnssecValidator.validate(d.Req, resp, p.time.Now(), exchange)
+	if err != nil {
+		log.Debug("dnsproxy: dnssec: validating %s: %s", d.Req.Question[0].Name, err)
+
+		return p.messages.NewMsgSERVFAIL(d.Req)
+	}
+
+	resp.AuthenticatedData = secure
+	d.dnssecSecure = secure
+
+	return resp
+}
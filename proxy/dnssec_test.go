@@ -0,0 +1,383 @@
+package proxy
+
+import (
+	"crypto"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZoneSigner signs the records of the zone example. with a real key.
+type testZoneSigner struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+// newTestZoneSigner returns a new *testZoneSigner with a generated key.
+func newTestZoneSigner(t *testing.T) (s *testZoneSigner) {
+	t.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   "example.",
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+
+	return &testZoneSigner{key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the set rrs along with its signature.
+func (s *testZoneSigner) sign(t *testing.T, rrs ...dns.RR) (signed []dns.RR) {
+	t.Helper()
+
+	hdr := rrs[0].Header()
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:  hdr.Name,
+			Class: dns.ClassINET,
+			Ttl:   hdr.Ttl,
+		},
+		Algorithm:  s.key.Algorithm,
+		KeyTag:     s.key.KeyTag(),
+		SignerName: s.key.Hdr.Name,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+
+	require.NoError(t, sig.Sign(s.priv, rrs))
+
+	return append(rrs, sig)
+}
+
+// wildcard returns the set rrs of the wildcard owner name along with its
+// signature, both expanded to name.
+func (s *testZoneSigner) wildcard(t *testing.T, name string, rrs ...dns.RR) (expanded []dns.RR) {
+	t.Helper()
+
+	expanded = s.sign(t, rrs...)
+	for _, rr := range expanded {
+		rr.Header().Name = name
+	}
+
+	return expanded
+}
+
+// noData returns the signed proof that name has only the A records.
+func (s *testZoneSigner) noData(t *testing.T, name string) (rrs []dns.RR) {
+	t.Helper()
+
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   "example.",
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Ns:     "ns.example.",
+		Mbox:   "hostmaster.example.",
+		Minttl: 300,
+	}
+
+	nsec := &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    300,
+		},
+		NextDomain: `\000.` + name,
+		TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+	}
+
+	return append(s.sign(t, soa), s.sign(t, nsec)...)
+}
+
+func TestProxy_Resolve_dnssec(t *testing.T) {
+	signer := newTestZoneSigner(t)
+
+	newA := func(name string) (rr dns.RR) {
+		return &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    defaultTestTTL,
+			},
+			A: net.IP{192, 0, 2, 1},
+		}
+	}
+
+	// The names below d.example are the aliases of the ones below example.
+	dname := &dns.DNAME{
+		Hdr: dns.RR_Header{
+			Name:   "d.example.",
+			Rrtype: dns.TypeDNAME,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		Target: "example.",
+	}
+
+	// The zone example contains the wildcard *.w.example and no other names
+	// below w.example.
+	wildcardProofs := map[string][]dns.RR{
+		"host.w.example.":    signer.sign(t, newTestNSEC("*.w.example.", "www.example.", dns.TypeA)[0]),
+		"nocover.w.example.": signer.sign(t, newTestNSEC("*.w.example.", "a.w.example.", dns.TypeA)[0]),
+	}
+
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+
+			switch q := req.Question[0]; {
+			case q.Qtype == dns.TypeDNSKEY && q.Name == "example.":
+				resp.Answer = signer.sign(t, dns.Copy(signer.key))
+			case q.Qtype != dns.TypeA:
+				resp.Ns = signer.noData(t, q.Name)
+			case q.Name == "www.example.":
+				resp.Answer = signer.sign(t, newA(q.Name))
+			case strings.HasSuffix(q.Name, ".d.example."):
+				// The CNAME record synthesized from the DNAME one isn't
+				// signed.
+				resp.Answer = append(signer.sign(t, dname), &dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:   q.Name,
+						Rrtype: dns.TypeCNAME,
+						Class:  dns.ClassINET,
+						Ttl:    defaultTestTTL,
+					},
+					Target: "www.example.",
+				})
+				resp.Answer = append(resp.Answer, signer.sign(t, newA("www.example."))...)
+			case strings.HasSuffix(q.Name, ".w.example."):
+				resp.Answer = signer.wildcard(t, q.Name, newA("*.w.example."))
+				resp.Ns = wildcardProofs[q.Name]
+			default:
+				// Unsigned, so bogus unless the validation is disabled.
+				resp.Answer = []dns.RR{newA(q.Name)}
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr:              []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:             &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:             defaultTrustedProxies,
+		DNSSECValidate:             true,
+		DNSSECTrustAnchors:         []*dns.DS{signer.key.ToDS(dns.SHA256)},
+		DNSSECNegativeTrustAnchors: []string{"nta.example"},
+	})
+
+	testCases := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		cd        bool
+		wantRcode int
+		wantAD    bool
+	}{{
+		name:      "secure",
+		qname:     "www.example.",
+		qtype:     dns.TypeA,
+		cd:        false,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    true,
+	}, {
+		name:      "secure_nodata",
+		qname:     "www.example.",
+		qtype:     dns.TypeAAAA,
+		cd:        false,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    true,
+	}, {
+		name:      "wildcard",
+		qname:     "host.w.example.",
+		qtype:     dns.TypeA,
+		cd:        false,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    true,
+	}, {
+		name:      "wildcard_not_covered",
+		qname:     "nocover.w.example.",
+		qtype:     dns.TypeA,
+		cd:        false,
+		wantRcode: dns.RcodeServerFailure,
+		wantAD:    false,
+	}, {
+		name:      "wildcard_no_proof",
+		qname:     "noproof.w.example.",
+		qtype:     dns.TypeA,
+		cd:        false,
+		wantRcode: dns.RcodeServerFailure,
+		wantAD:    false,
+	}, {
+		name:      "dname",
+		qname:     "www.d.example.",
+		qtype:     dns.TypeA,
+		cd:        false,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    true,
+	}, {
+		name:      "dname_mismatch",
+		qname:     "other.d.example.",
+		qtype:     dns.TypeA,
+		cd:        false,
+		wantRcode: dns.RcodeServerFailure,
+		wantAD:    false,
+	}, {
+		name:      "bogus",
+		qname:     "bad.example.",
+		qtype:     dns.TypeA,
+		cd:        false,
+		wantRcode: dns.RcodeServerFailure,
+		wantAD:    false,
+	}, {
+		name:      "checking_disabled",
+		qname:     "bad.example.",
+		qtype:     dns.TypeA,
+		cd:        true,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    false,
+	}, {
+		name:      "negative_trust_anchor",
+		qname:     "host.nta.example.",
+		qtype:     dns.TypeA,
+		cd:        false,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    false,
+	}, {
+		name:      "no_trust_anchor",
+		qname:     "www.example.org.",
+		qtype:     dns.TypeA,
+		cd:        false,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.qname, tc.qtype)
+			req.CheckingDisabled = tc.cd
+
+			// Ask for the AD flag, see RFC 6840 Section 5.7.
+			req.AuthenticatedData = true
+
+			dctx := &DNSContext{
+				Req:  req,
+				Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+			}
+
+			require.NoError(t, p.Resolve(dctx))
+			require.NotNil(t, dctx.Res)
+
+			assert.Equal(t, tc.wantRcode, dctx.Res.Rcode)
+			assert.Equal(t, tc.wantAD, dctx.Res.AuthenticatedData)
+		})
+	}
+
+	t.Run("bad_key", func(t *testing.T) {
+		// The key not matching the trust anchor makes all the responses
+		// within the zone bogus.
+		other := newTestZoneSigner(t)
+
+		pp := mustNew(t, &Config{
+			UDPListenAddr:      []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:     &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies:     defaultTrustedProxies,
+			DNSSECValidate:     true,
+			DNSSECTrustAnchors: []*dns.DS{other.key.ToDS(dns.SHA256)},
+		})
+
+		dctx := &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion("www.example.", dns.TypeA),
+			Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		require.NoError(t, pp.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+
+		assert.Equal(t, dns.RcodeServerFailure, dctx.Res.Rcode)
+	})
+}
+
+func TestDNSSECValidator_store(t *testing.T) {
+	now := time.Now()
+
+	newValidator := func(t *testing.T, expire func(i int) (e time.Time)) (v *dnssecValidator) {
+		t.Helper()
+
+		v = newDNSSECValidator(&Config{DNSSECValidate: true})
+		require.NotNil(t, v)
+
+		for i := range dnssecMaxZones {
+			v.zones[fmt.Sprintf("zone-%d.", i)] = &dnssecZone{expire: expire(i)}
+		}
+
+		return v
+	}
+
+	z := &dnssecZone{expire: now.Add(time.Minute)}
+
+	t.Run("expired", func(t *testing.T) {
+		v := newValidator(t, func(i int) (e time.Time) {
+			if i%2 == 0 {
+				return now.Add(-time.Second)
+			}
+
+			return now.Add(time.Hour)
+		})
+
+		v.store("new.", z, now)
+
+		assert.Len(t, v.zones, dnssecMaxZones/2+1)
+		assert.Same(t, z, v.cached("new.", now))
+		assert.Nil(t, v.cached("zone-0.", now))
+		assert.NotNil(t, v.cached("zone-1.", now))
+	})
+
+	t.Run("soonest", func(t *testing.T) {
+		// The zone-0. expires the soonest and all the others later than the
+		// new one.
+		v := newValidator(t, func(i int) (e time.Time) {
+			return now.Add(time.Hour + time.Duration(i)*time.Second)
+		})
+
+		v.store("new.", z, now)
+
+		assert.Len(t, v.zones, dnssecMaxZones)
+		assert.Same(t, z, v.cached("new.", now))
+		assert.Nil(t, v.cached("zone-0.", now))
+		assert.NotNil(t, v.cached("zone-1.", now))
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		v := newValidator(t, func(i int) (e time.Time) { return now.Add(time.Hour) })
+
+		v.store("zone-0.", z, now)
+
+		assert.Len(t, v.zones, dnssecMaxZones)
+		assert.Same(t, z, v.cached("zone-0.", now))
+	})
+}
@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"cmp"
+	"crypto"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultSignatureValidity is the default validity period of the
+	// signatures made by the proxy, see [Config.SignatureValidity].
+	defaultSignatureValidity = 24 * time.Hour
+
+	// signatureInceptionSkew is the time the inception of the signatures made
+	// by the proxy is set back by, so that the validators with the clocks
+	// running behind accept them.
+	signatureInceptionSkew = time.Hour
+
+	// typeNXNAME is the pseudo-type in the type bitmap of the NSEC record
+	// signaling the name doesn't exist, see RFC 9824.
+	typeNXNAME uint16 = 128
+)
+
+// SigningKey is a zone signing key used to sign the locally generated
+// responses for the names within its zone, see [Config.SigningKeys].
+type SigningKey struct {
+	// DNSKEY is the public part of the key.  Its owner name is the apex of the
+	// zone it signs.  It must not be nil and must have the zone key flag set.
+	DNSKEY *dns.DNSKEY
+
+	// PrivateKey is the private part of the key matching DNSKEY, e.g. read with
+	// [dns.DNSKEY.ReadPrivateKey].  It must not be nil.
+	PrivateKey crypto.Signer
+}
+
+// validateSigning returns an error if the online signing configuration of c is
+// invalid.
+func (c *Config) validateSigning() (err error) {
+	if c.SignatureValidity < 0 {
+		return errors.Error("negative signature validity")
+	}
+
+	zones := map[string]struct{}{}
+	for i, k := range c.SigningKeys {
+		err = k.validate()
+		if err != nil {
+			return fmt.Errorf("key at index %d: %w", i, err)
+		}
+
+		zone := strings.ToLower(dns.Fqdn(k.DNSKEY.Hdr.Name))
+		if _, ok := zones[zone]; ok {
+			return fmt.Errorf("key at index %d: duplicate zone %q", i, zone)
+		}
+
+		zones[zone] = struct{}{}
+	}
+
+	return nil
+}
+
+// validate returns an error if k can't be used for signing.  It signs the
+// DNSKEY itself to make sure the private key matches it.
+func (k *SigningKey) validate() (err error) {
+	switch {
+	case k == nil:
+		return errors.Error("no key")
+	case k.DNSKEY == nil:
+		return errors.Error("no dnskey")
+	case k.PrivateKey == nil:
+		return errors.Error("no private key")
+	case k.DNSKEY.Flags&dns.ZONE == 0:
+		return errors.Error("not a zone key")
+	}
+
+	set := []dns.RR{k.DNSKEY}
+	sig := &dns.RRSIG{
+		KeyTag:     k.DNSKEY.KeyTag(),
+		SignerName: k.DNSKEY.Hdr.Name,
+		Algorithm:  k.DNSKEY.Algorithm,
+	}
+
+	err = sig.Sign(k.PrivateKey, set)
+	if err != nil {
+		return fmt.Errorf("signing: %w", err)
+	}
+
+	err = sig.Verify(k.DNSKEY, set)
+	if err != nil {
+		return fmt.Errorf("private key doesn't match dnskey: %w", err)
+	}
+
+	return nil
+}
+
+// signingKey is a [SigningKey] prepared for signing.
+type signingKey struct {
+	// dnskey is the public part of the key.
+	dnskey *dns.DNSKEY
+
+	// priv is the private part of the key.
+	priv crypto.Signer
+
+	// zone is the lowercased FQDN of the zone apex.
+	zone string
+
+	// tag is the key tag of dnskey.
+	tag uint16
+}
+
+// responseSigner signs the locally generated responses.  It's safe for
+// concurrent use.
+type responseSigner struct {
+	// keys are the keys sorted from the most specific zone to the least
+	// specific one.
+	keys []*signingKey
+
+	// validity is the validity period of the signatures.
+	validity time.Duration
+}
+
+// newResponseSigner returns a new properly initialized *responseSigner or nil if
+// there are no signing keys in c.
+func newResponseSigner(c *Config) (s *responseSigner) {
+	if len(c.SigningKeys) == 0 {
+		return nil
+	}
+
+	s = &responseSigner{
+		keys:     make([]*signingKey, 0, len(c.SigningKeys)),
+		validity: cmp.Or(c.SignatureValidity, defaultSignatureValidity),
+	}
+
+	for _, k := range c.SigningKeys {
+		zone := strings.ToLower(dns.Fqdn(k.DNSKEY.Hdr.Name))
+		dnskey := dns.Copy(k.DNSKEY).(*dns.DNSKEY)
+		dnskey.Hdr.Name = zone
+
+		s.keys = append(s.keys, &signingKey{
+			dnskey: dnskey,
+			priv:   k.PrivateKey,
+			zone:   zone,
+			tag:    dnskey.KeyTag(),
+		})
+	}
+
+	slices.SortStableFunc(s.keys, func(a, b *signingKey) (res int) {
+		return cmp.Compare(dns.CountLabel(b.zone), dns.CountLabel(a.zone))
+	})
+
+	return s
+}
+
+// keyFor returns the key of the most specific zone containing name, or nil if
+// there is none.
+func (s *responseSigner) keyFor(name string) (k *signingKey) {
+	for _, k = range s.keys {
+		if dns.IsSubDomain(k.zone, name) {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// signResponse signs the locally generated response of d for the names within
+// the zones of [Config.SigningKeys], if the client has requested the DNSSEC
+// records.
+func (p *Proxy) signResponse(d *DNSContext) {
+	if p.signer == nil || d.Res == nil || d.Provenance.Source != SourceLocal {
+		return
+	}
+
+	opt := d.Req.IsEdns0()
+	if opt == nil || !opt.Do() || len(d.Req.Question) != 1 {
+		return
+	}
+
+	// Copy the response, since the handlers may share the records with their
+	// data.
+	d.Res = d.Res.Copy()
+	p.signer.sign(d.Req.Question[0], d.Res, p.time.Now())
+}
+
+// sign adds the signatures to resp, which is the response to q, if q is within
+// one of the zones of s.  The DNSKEY is added to the responses for the zone
+// apex, and the nonexistence of the name or type is denied with a compact
+// NSEC record, see [responseSigner.deny].
+func (s *responseSigner) sign(q dns.Question, resp *dns.Msg, now time.Time) {
+	k := s.keyFor(q.Name)
+	if k == nil || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return
+	}
+
+	isApex := strings.EqualFold(q.Name, k.zone)
+	if isApex && q.Qtype == dns.TypeDNSKEY && !hasType(resp.Answer, dns.TypeDNSKEY) {
+		dnskey := dns.Copy(k.dnskey)
+		dnskey.Header().Name = q.Name
+
+		resp.Rcode = dns.RcodeSuccess
+		resp.Answer = append(resp.Answer, dnskey)
+		resp.Ns = nil
+	}
+
+	if len(resp.Answer) == 0 {
+		s.deny(q, resp, k)
+	}
+
+	resp.Answer = s.signSection(resp.Answer, now)
+	resp.Ns = s.signSection(resp.Ns, now)
+}
+
+// deny adds the NSEC record denying the existence of the name or the type
+// requested with q to the negative resp signed with k.  The NXDOMAIN response
+// is turned into a NODATA one with the NXNAME pseudo-type in the type bitmap,
+// since the compact denial of existence can't prove the absence of the
+// wildcards, see RFC 9824.  The types actually existing at the name aren't
+// known, so only the RRSIG and NSEC ones are listed.
+func (s *responseSigner) deny(q dns.Question, resp *dns.Msg, k *signingKey) {
+	types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	if resp.Rcode == dns.RcodeNameError {
+		types = append(types, typeNXNAME)
+		resp.Rcode = dns.RcodeSuccess
+	}
+
+	// Use the negative caching TTL of the zone, see RFC 9077.
+	ttl := k.dnskey.Hdr.Ttl
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = min(soa.Hdr.Ttl, soa.Minttl)
+
+			break
+		}
+	}
+
+	resp.Ns = append(resp.Ns, &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		NextDomain: `\000.` + q.Name,
+		TypeBitMap: types,
+	})
+}
+
+// signSection returns rrs with the signatures of its RRsets within the zones of
+// s added.  The RRsets already signed are left as is.
+func (s *responseSigner) signSection(rrs []dns.RR, now time.Time) (signed []dns.RR) {
+	type setKey struct {
+		name  string
+		class uint16
+		typ   uint16
+	}
+
+	var keys []setKey
+	sets := map[setKey][]dns.RR{}
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		switch hdr.Rrtype {
+		case dns.TypeOPT:
+			continue
+		case dns.TypeRRSIG:
+			covered := setKey{
+				name:  strings.ToLower(hdr.Name),
+				class: hdr.Class,
+				typ:   rr.(*dns.RRSIG).TypeCovered,
+			}
+
+			// Mark the RRset as already signed.
+			sets[covered] = nil
+			keys = append(keys, covered)
+
+			continue
+		}
+
+		key := setKey{name: strings.ToLower(hdr.Name), class: hdr.Class, typ: hdr.Rrtype}
+		if set, ok := sets[key]; ok && set == nil {
+			continue
+		} else if !ok {
+			keys = append(keys, key)
+		}
+
+		sets[key] = append(sets[key], rr)
+	}
+
+	signed = rrs
+	for _, key := range keys {
+		set := sets[key]
+		if len(set) == 0 {
+			continue
+		}
+
+		// Mark the RRset as processed, since the key may be duplicated.
+		sets[key] = nil
+
+		k := s.keyFor(key.name)
+		if k == nil {
+			continue
+		}
+
+		sig, err := k.signSet(set, now, s.validity)
+		if err != nil {
+			log.Debug("dnsproxy: signing %s %s: %s", key.name, dns.Type(key.typ), err)
+
+			continue
+		}
+
+		signed = append(signed, sig)
+	}
+
+	return signed
+}
+
+// signSet returns the signature of set made with k, which is valid until
+// validity after now.  The TTLs of set are set to the minimum one, see RFC
+// 2181.
+func (k *signingKey) signSet(
+	set []dns.RR,
+	now time.Time,
+	validity time.Duration,
+) (sig *dns.RRSIG, err error) {
+	ttl := set[0].Header().Ttl
+	for _, rr := range set[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+
+	for _, rr := range set {
+		rr.Header().Ttl = ttl
+	}
+
+	sig = &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Ttl: ttl,
+		},
+		KeyTag:     k.tag,
+		SignerName: k.zone,
+		Algorithm:  k.dnskey.Algorithm,
+		Inception:  uint32(now.Add(-signatureInceptionSkew).Unix()),
+		Expiration: uint32(now.Add(validity).Unix()),
+	}
+
+	err = sig.Sign(k.priv, set)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return sig, nil
+}
+
+// hasType returns true if rrs contain a record of type typ.
+func hasType(rrs []dns.RR, typ uint16) (ok bool) {
+	return slices.ContainsFunc(rrs, func(rr dns.RR) (found bool) {
+		return rr.Header().Rrtype == typ
+	})
+}
@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSigningKey returns a new ECDSA P-256 zone signing key for zone.
+func newTestSigningKey(t *testing.T, zone string) (k *SigningKey) {
+	t.Helper()
+
+	dnskey := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := dnskey.Generate(256)
+	require.NoError(t, err)
+
+	signer, ok := priv.(crypto.Signer)
+	require.True(t, ok)
+
+	return &SigningKey{
+		DNSKEY:     dnskey,
+		PrivateKey: signer,
+	}
+}
+
+// requireSigned verifies the signatures of all the RRsets in rrs with k and
+// returns the number of the verified RRsets.
+func requireSigned(t *testing.T, k *SigningKey, rrs []dns.RR, now time.Time) (n int) {
+	t.Helper()
+
+	for _, rr := range rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+
+		var set []dns.RR
+		for _, other := range rrs {
+			hdr := other.Header()
+			if hdr.Rrtype == sig.TypeCovered && hdr.Name == sig.Hdr.Name {
+				set = append(set, other)
+			}
+		}
+
+		require.NoError(t, sig.Verify(k.DNSKEY, set))
+		require.True(t, sig.ValidityPeriod(now))
+
+		n++
+	}
+
+	return n
+}
+
+func TestResponseSigner_sign(t *testing.T) {
+	k := newTestSigningKey(t, "example.org.")
+	s := newResponseSigner(&Config{SigningKeys: []*SigningKey{k}})
+	now := time.Now()
+
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   "example.org.",
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Ns:     "ns.example.org.",
+		Mbox:   "hostmaster.example.org.",
+		Minttl: 300,
+	}
+
+	newA := func(name string, ttl uint32) (rr dns.RR) {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IP{192, 0, 2, 1},
+		}
+	}
+
+	t.Run("positive", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("www.example.org.", dns.TypeA)
+		resp := (&dns.Msg{}).SetReply(req)
+		resp.Answer = []dns.RR{newA("www.example.org.", 60), newA("www.example.org.", 30)}
+
+		s.sign(req.Question[0], resp, now)
+
+		require.Len(t, resp.Answer, 3)
+		assert.Equal(t, 1, requireSigned(t, k, resp.Answer, now))
+		assert.Equal(t, uint32(30), resp.Answer[0].Header().Ttl)
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("none.example.org.", dns.TypeA)
+		resp := (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+		resp.Ns = []dns.RR{dns.Copy(soa)}
+
+		s.sign(req.Question[0], resp, now)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Equal(t, 2, requireSigned(t, k, resp.Ns, now))
+
+		nsec := testutil.RequireTypeAssert[*dns.NSEC](t, resp.Ns[1])
+		assert.Equal(t, "none.example.org.", nsec.Hdr.Name)
+		assert.Equal(t, `\000.none.example.org.`, nsec.NextDomain)
+		assert.Equal(t, []uint16{dns.TypeRRSIG, dns.TypeNSEC, typeNXNAME}, nsec.TypeBitMap)
+		assert.Equal(t, uint32(300), nsec.Hdr.Ttl)
+	})
+
+	t.Run("nodata", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("www.example.org.", dns.TypeAAAA)
+		resp := (&dns.Msg{}).SetReply(req)
+		resp.Ns = []dns.RR{dns.Copy(soa)}
+
+		s.sign(req.Question[0], resp, now)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Equal(t, 2, requireSigned(t, k, resp.Ns, now))
+
+		nsec := testutil.RequireTypeAssert[*dns.NSEC](t, resp.Ns[1])
+		assert.Equal(t, []uint16{dns.TypeRRSIG, dns.TypeNSEC}, nsec.TypeBitMap)
+	})
+
+	t.Run("dnskey", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("EXAMPLE.org.", dns.TypeDNSKEY)
+		resp := (&dns.Msg{}).SetReply(req)
+		resp.Ns = []dns.RR{dns.Copy(soa)}
+
+		s.sign(req.Question[0], resp, now)
+
+		require.Len(t, resp.Answer, 2)
+		assert.Empty(t, resp.Ns)
+		assert.Equal(t, 1, requireSigned(t, k, resp.Answer, now))
+	})
+
+	t.Run("already_signed", func(t *testing.T) {
+		sig := &dns.RRSIG{
+			Hdr: dns.RR_Header{
+				Name:   "www.example.org.",
+				Rrtype: dns.TypeRRSIG,
+				Class:  dns.ClassINET,
+			},
+			TypeCovered: dns.TypeA,
+		}
+
+		req := (&dns.Msg{}).SetQuestion("www.example.org.", dns.TypeA)
+		resp := (&dns.Msg{}).SetReply(req)
+		resp.Answer = []dns.RR{newA("www.example.org.", 60), sig}
+
+		s.sign(req.Question[0], resp, now)
+
+		assert.Equal(t, []dns.RR{newA("www.example.org.", 60), sig}, resp.Answer)
+	})
+
+	t.Run("other_zone", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("www.example.com.", dns.TypeA)
+		resp := (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+
+		s.sign(req.Question[0], resp, now)
+
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+		assert.Empty(t, resp.Ns)
+	})
+}
+
+func TestProxy_signResponse(t *testing.T) {
+	k := newTestSigningKey(t, "example.org.")
+
+	p := mustNew(t, &Config{
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{&fakeUpstream{
+				onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+					return (&dns.Msg{}).SetReply(m), nil
+				},
+				onAddress: func() (addr string) { return "upstream" },
+				onClose:   func() (err error) { return nil },
+			}},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		BeforeRequestHandler: &testBeforeRequestHandler{
+			onHandleBefore: func(_ *Proxy, dctx *DNSContext) (err error) {
+				if !dns.IsSubDomain("example.org.", dctx.Req.Question[0].Name) {
+					return nil
+				}
+
+				return &BeforeRequestError{
+					Err:      errors.Error("local zone"),
+					Response: (&dns.Msg{}).SetRcode(dctx.Req, dns.RcodeNameError),
+				}
+			},
+		},
+		SigningKeys: []*SigningKey{k},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	client := &dns.Client{Net: string(ProtoTCP), Timeout: time.Second}
+	addr := p.Addr(ProtoTCP).String()
+
+	testCases := []struct {
+		name      string
+		qname     string
+		do        bool
+		wantRcode int
+		wantNs    int
+	}{{
+		name:      "signed",
+		qname:     "none.example.org.",
+		do:        true,
+		wantRcode: dns.RcodeSuccess,
+		wantNs:    2,
+	}, {
+		name:      "no_do",
+		qname:     "none.example.org.",
+		do:        false,
+		wantRcode: dns.RcodeNameError,
+		wantNs:    0,
+	}, {
+		name:      "upstream",
+		qname:     "example.com.",
+		do:        true,
+		wantRcode: dns.RcodeSuccess,
+		wantNs:    0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.qname, dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, tc.do)
+
+			resp, _, err := client.Exchange(req, addr)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			require.Len(t, resp.Ns, tc.wantNs)
+			assert.Equal(t, tc.wantNs/2, requireSigned(t, k, resp.Ns, time.Now()))
+		})
+	}
+}
+
+func TestConfig_validateSigning(t *testing.T) {
+	k := newTestSigningKey(t, "example.org.")
+	other := newTestSigningKey(t, "example.org.")
+
+	notZone := dns.Copy(k.DNSKEY).(*dns.DNSKEY)
+	notZone.Flags = 0
+
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &Config{SigningKeys: []*SigningKey{k}},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &Config{SignatureValidity: -1},
+		name:       "negative_validity",
+		wantErrMsg: "negative signature validity",
+	}, {
+		conf:       &Config{SigningKeys: []*SigningKey{{PrivateKey: k.PrivateKey}}},
+		name:       "no_dnskey",
+		wantErrMsg: "key at index 0: no dnskey",
+	}, {
+		conf: &Config{
+			SigningKeys: []*SigningKey{{DNSKEY: notZone, PrivateKey: k.PrivateKey}},
+		},
+		name:       "not_zone_key",
+		wantErrMsg: "key at index 0: not a zone key",
+	}, {
+		conf: &Config{
+			SigningKeys: []*SigningKey{{DNSKEY: k.DNSKEY, PrivateKey: other.PrivateKey}},
+		},
+		name:       "mismatch",
+		wantErrMsg: "key at index 0: private key doesn't match dnskey: dns: bad signature",
+	}, {
+		conf:       &Config{SigningKeys: []*SigningKey{k, other}},
+		name:       "duplicate",
+		wantErrMsg: `key at index 1: duplicate zone "example.org."`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validateSigning())
+		})
+	}
+}
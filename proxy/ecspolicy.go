@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// ECSPolicy defines how the EDNS Client Subnet option is handled for requests
+// from a particular client.
+type ECSPolicy uint8
+
+const (
+	// ECSPolicyDefault handles the option according to
+	// [Config.EnableEDNSClientSubnet].
+	ECSPolicyDefault ECSPolicy = iota
+
+	// ECSPolicyStrip removes the option from the request and never adds one.
+	ECSPolicyStrip
+
+	// ECSPolicyTruncate handles the option like [ECSPolicyDefault], but
+	// truncates the resulting subnet to at most [ecsTruncateLenIPv4] or
+	// [ecsTruncateLenIPv6] bits.  The option sent by the client itself is
+	// truncated even if the EDNS Client Subnet is disabled.
+	ECSPolicyTruncate
+
+	// ECSPolicyPassThrough sends the option received from the client as is and
+	// never adds one.
+	ECSPolicyPassThrough
+)
+
+const (
+	// ecsTruncateLenIPv4 is the maximum length of the IPv4 subnet sent for the
+	// clients with [ECSPolicyTruncate].
+	ecsTruncateLenIPv4 = 16
+
+	// ecsTruncateLenIPv6 is the maximum length of the IPv6 subnet sent for the
+	// clients with [ECSPolicyTruncate].
+	ecsTruncateLenIPv6 = 56
+)
+
+// String implements the [fmt.Stringer] interface for ECSPolicy.
+func (pol ECSPolicy) String() (s string) {
+	switch pol {
+	case ECSPolicyDefault:
+		return "default"
+	case ECSPolicyStrip:
+		return "strip"
+	case ECSPolicyTruncate:
+		return "truncate"
+	case ECSPolicyPassThrough:
+		return "pass"
+	default:
+		return fmt.Sprintf("!bad_ecs_policy_%d", uint8(pol))
+	}
+}
+
+// ParseECSPolicy parses the ECS policy from its string representation as
+// returned by [ECSPolicy.String].
+func ParseECSPolicy(s string) (pol ECSPolicy, err error) {
+	for pol = ECSPolicyDefault; pol <= ECSPolicyPassThrough; pol++ {
+		if pol.String() == s {
+			return pol, nil
+		}
+	}
+
+	return ECSPolicyDefault, fmt.Errorf("unknown ecs policy %q", s)
+}
+
+// ECSClientPolicy is the EDNS Client Subnet policy for the clients within a
+// subnet.
+type ECSClientPolicy struct {
+	// Subnet is the subnet of the clients the policy applies to.  It must be
+	// valid.
+	Subnet netip.Prefix
+
+	// Policy is the policy applied to the requests from the clients within
+	// Subnet.
+	Policy ECSPolicy
+}
+
+// validateECSPolicies returns an error if any of policies is invalid.
+func validateECSPolicies(policies []*ECSClientPolicy) (err error) {
+	var errs []error
+	for i, pol := range policies {
+		err = validateECSPolicy(pol)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy at index %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateECSPolicy returns an error if pol is invalid.
+func validateECSPolicy(pol *ECSClientPolicy) (err error) {
+	switch {
+	case pol == nil:
+		return errors.Error("policy is nil")
+	case !pol.Subnet.IsValid():
+		return fmt.Errorf("bad subnet %s", pol.Subnet)
+	case pol.Policy > ECSPolicyPassThrough:
+		return fmt.Errorf("bad policy %s", pol.Policy)
+	default:
+		return nil
+	}
+}
+
+// sortECSPolicies returns a copy of policies sorted from the most specific
+// subnet to the least specific one, so that the first matching policy is the
+// one of the longest matching prefix.
+func sortECSPolicies(policies []*ECSClientPolicy) (sorted []*ECSClientPolicy) {
+	if len(policies) == 0 {
+		return nil
+	}
+
+	sorted = slices.Clone(policies)
+	slices.SortStableFunc(sorted, func(a, b *ECSClientPolicy) (res int) {
+		return b.Subnet.Bits() - a.Subnet.Bits()
+	})
+
+	return sorted
+}
+
+// ecsPolicy returns the ECS policy for the client with addr.
+func (p *Proxy) ecsPolicy(addr netip.Addr) (pol ECSPolicy) {
+	addr = addr.Unmap()
+	for _, cp := range p.ecsPolicies {
+		if cp.Subnet.Contains(addr) {
+			return cp.Policy
+		}
+	}
+
+	return ECSPolicyDefault
+}
+
+// processECS handles the EDNS Client Subnet option of the request in dctx
+// according to the configuration and the policy of the client.
+func (p *Proxy) processECS(dctx *DNSContext) {
+	pol := p.ecsPolicy(dctx.Addr.Addr())
+	lenIPv4 := cmp.Or(p.EDNSSubnetLenIPv4, defaultECSv4)
+	lenIPv6 := cmp.Or(p.EDNSSubnetLenIPv6, defaultECSv6)
+
+	switch pol {
+	case ECSPolicyStrip:
+		removeECS(dctx.Req)
+
+		log.Debug("dnsproxy: ecs policy %s: removed ecs", pol)
+	case ECSPolicyPassThrough:
+		if p.EnableEDNSClientSubnet {
+			dctx.ReqECS = ecsFromReq(dctx.Req)
+		}
+	case ECSPolicyTruncate:
+		if p.EnableEDNSClientSubnet {
+			dctx.processECS(p.EDNSAddr, lenIPv4, lenIPv6)
+		}
+
+		subnet := truncateECS(dctx.Req, ecsTruncateLenIPv4, ecsTruncateLenIPv6)
+		if p.EnableEDNSClientSubnet {
+			dctx.ReqECS = subnet
+		}
+
+		log.Debug("dnsproxy: ecs policy %s: sending ecs %s", pol, subnet)
+	default:
+		if p.EnableEDNSClientSubnet {
+			dctx.processECS(p.EDNSAddr, lenIPv4, lenIPv6)
+		}
+	}
+}
+
+// ecsFromReq returns the non-empty subnet from EDNS Client Subnet option of
+// req, if any.
+func ecsFromReq(req *dns.Msg) (subnet *net.IPNet) {
+	subnet, _ = ecsFromMsg(req)
+	if subnet == nil {
+		return nil
+	}
+
+	if ones, _ := subnet.Mask.Size(); ones == 0 {
+		return nil
+	}
+
+	return subnet
+}
+
+// removeECS removes all the EDNS Client Subnet options from m.
+func removeECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	opt.Option = slices.DeleteFunc(opt.Option, func(e dns.EDNS0) (ok bool) {
+		return e.Option() == dns.EDNS0SUBNET
+	})
+}
+
+// truncateECS shortens the source prefix of the EDNS Client Subnet option of m
+// to at most lenIPv4 or lenIPv6 bits depending on its family.  It returns the
+// resulting subnet or nil if there is no option.
+func truncateECS(m *dns.Msg, lenIPv4, lenIPv6 int) (subnet *net.IPNet) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, e := range opt.Option {
+		sn, ok := e.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+
+		var ip net.IP
+		var maxLen, bitLen int
+		switch sn.Family {
+		case 1:
+			ip, maxLen, bitLen = sn.Address.To4(), lenIPv4, netutil.IPv4BitLen
+		case 2:
+			ip, maxLen, bitLen = sn.Address.To16(), lenIPv6, netutil.IPv6BitLen
+		default:
+			continue
+		}
+
+		if ip == nil {
+			continue
+		}
+
+		ones := min(int(sn.SourceNetmask), maxLen)
+		mask := net.CIDRMask(ones, bitLen)
+
+		sn.SourceNetmask = uint8(ones)
+		sn.Address = ip.Mask(mask)
+
+		return &net.IPNet{IP: sn.Address, Mask: mask}
+	}
+
+	return nil
+}
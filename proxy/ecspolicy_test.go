@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseECSPolicy(t *testing.T) {
+	for pol := ECSPolicyDefault; pol <= ECSPolicyPassThrough; pol++ {
+		got, err := ParseECSPolicy(pol.String())
+		require.NoError(t, err)
+
+		assert.Equal(t, pol, got)
+	}
+
+	_, err := ParseECSPolicy("bad")
+	assert.Error(t, err)
+}
+
+func TestProxy_processECS_policies(t *testing.T) {
+	p := &Proxy{
+		Config: Config{
+			EnableEDNSClientSubnet: true,
+		},
+		ecsPolicies: sortECSPolicies([]*ECSClientPolicy{{
+			Subnet: netip.MustParsePrefix("1.0.0.0/8"),
+			Policy: ECSPolicyTruncate,
+		}, {
+			Subnet: netip.MustParsePrefix("1.2.0.0/16"),
+			Policy: ECSPolicyStrip,
+		}, {
+			Subnet: netip.MustParsePrefix("1.3.0.0/16"),
+			Policy: ECSPolicyPassThrough,
+		}}),
+	}
+
+	clientECS := netip.MustParsePrefix("4.3.2.0/24")
+
+	testCases := []struct {
+		wantECS  *net.IPNet
+		cliAddr  netip.Addr
+		reqECS   netip.Prefix
+		name     string
+		wantBits int
+	}{{
+		wantECS:  nil,
+		cliAddr:  netip.MustParseAddr("1.2.3.4"),
+		reqECS:   clientECS,
+		name:     "strip",
+		wantBits: -1,
+	}, {
+		wantECS: &net.IPNet{
+			IP:   net.IP{1, 1, 0, 0},
+			Mask: net.CIDRMask(16, 32),
+		},
+		cliAddr:  netip.MustParseAddr("1.1.3.4"),
+		reqECS:   netip.Prefix{},
+		name:     "truncate_own",
+		wantBits: 16,
+	}, {
+		wantECS: &net.IPNet{
+			IP:   net.IP{4, 3, 0, 0},
+			Mask: net.CIDRMask(16, 32),
+		},
+		cliAddr:  netip.MustParseAddr("1.1.3.4"),
+		reqECS:   clientECS,
+		name:     "truncate_client",
+		wantBits: 16,
+	}, {
+		wantECS: &net.IPNet{
+			IP:   net.IP{4, 3, 2, 0},
+			Mask: net.CIDRMask(24, 32),
+		},
+		cliAddr:  netip.MustParseAddr("1.3.3.4"),
+		reqECS:   clientECS,
+		name:     "pass_client",
+		wantBits: 24,
+	}, {
+		wantECS:  nil,
+		cliAddr:  netip.MustParseAddr("1.3.3.4"),
+		reqECS:   netip.Prefix{},
+		name:     "pass_none",
+		wantBits: -1,
+	}, {
+		wantECS: &net.IPNet{
+			IP:   net.IP{2, 2, 3, 0},
+			Mask: net.CIDRMask(24, 32),
+		},
+		cliAddr:  netip.MustParseAddr("2.2.3.4"),
+		reqECS:   netip.Prefix{},
+		name:     "default",
+		wantBits: 24,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA)
+			if tc.reqECS.IsValid() {
+				setECS(req, tc.reqECS.Addr().AsSlice(), 0, defaultECSv4, defaultECSv6)
+				truncateECS(req, tc.reqECS.Bits(), tc.reqECS.Bits())
+			}
+
+			dctx := &DNSContext{
+				Req:  req,
+				Addr: netip.AddrPortFrom(tc.cliAddr, 53),
+			}
+
+			p.processECS(dctx)
+			assert.Equal(t, tc.wantECS, dctx.ReqECS)
+
+			subnet, _ := ecsFromMsg(req)
+			if tc.wantBits < 0 {
+				assert.Nil(t, subnet)
+
+				return
+			}
+
+			require.NotNil(t, subnet)
+
+			ones, _ := subnet.Mask.Size()
+			assert.Equal(t, tc.wantBits, ones)
+		})
+	}
+}
+
+func TestProxy_processECS_subnetLens(t *testing.T) {
+	p := &Proxy{
+		Config: Config{
+			EnableEDNSClientSubnet: true,
+			EDNSSubnetLenIPv4:      16,
+			EDNSSubnetLenIPv6:      48,
+		},
+	}
+
+	testCases := []struct {
+		cliAddr netip.Addr
+		want    *net.IPNet
+		name    string
+	}{{
+		cliAddr: netip.MustParseAddr("2.2.3.4"),
+		want: &net.IPNet{
+			IP:   net.IP{2, 2, 0, 0},
+			Mask: net.CIDRMask(16, 32),
+		},
+		name: "ipv4",
+	}, {
+		cliAddr: netip.MustParseAddr("2a00:1450:4001:82b::200e"),
+		want: &net.IPNet{
+			IP:   net.ParseIP("2a00:1450:4001::"),
+			Mask: net.CIDRMask(48, 128),
+		},
+		name: "ipv6",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA),
+				Addr: netip.AddrPortFrom(tc.cliAddr, 53),
+			}
+
+			p.processECS(dctx)
+			assert.Equal(t, tc.want, dctx.ReqECS)
+
+			subnet, _ := ecsFromMsg(dctx.Req)
+			assert.Equal(t, tc.want, subnet)
+		})
+	}
+}
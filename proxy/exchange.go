@@ -12,19 +12,26 @@ import (
 )
 
 // exchangeUpstreams resolves req using the given upstreams.  It returns the DNS
-// response, the upstream that successfully resolved the request, and the error
-// if any.
+// response, the upstream that successfully resolved the request, the number of
+// the upstreams the request has been sent to, and the error if any.
 func (p *Proxy) exchangeUpstreams(
 	req *dns.Msg,
 	ups []upstream.Upstream,
-) (resp *dns.Msg, u upstream.Upstream, err error) {
-	switch p.UpstreamMode {
+) (resp *dns.Msg, u upstream.Upstream, attempts int, err error) {
+	mode := p.upstreamMode(req, p.UpstreamMode)
+	switch mode {
 	case UModeParallel:
-		return upstream.ExchangeParallel(ups, req)
+		resp, u, err = p.exchangeParallel(req, ups)
+
+		return resp, u, len(ups), err
+	case UModeStaggered:
+		return p.exchangeStaggered(req, ups)
 	case UModeFastestAddr:
 		switch req.Question[0].Qtype {
 		case dns.TypeA, dns.TypeAAAA:
-			return p.fastestAddr.ExchangeFastest(req, ups)
+			resp, u, err = p.fastestAddr.ExchangeFastest(req, ups)
+
+			return resp, u, len(ups), err
 		default:
 			// Go on to the load-balancing mode.
 		}
@@ -37,32 +44,109 @@ func (p *Proxy) exchangeUpstreams(
 		resp, _, err = exchange(u, req, p.time)
 		// TODO(e.burkov):  p.updateRTT(u.Address(), elapsed)
 
-		return resp, u, err
+		return resp, u, 1, err
+	}
+
+	if b := p.balancers[mode]; b != nil {
+		return p.exchangeBalanced(req, ups, b)
+	}
+
+	if p.hedger != nil {
+		p.hedger.deposit()
+	}
+
+	return p.exchangeWeighted(req, ups, p.calcWeights(ups))
+}
+
+// exchangeWeighted resolves req using ups, trying them in a random order
+// according to weights, each corresponding to the upstream with the same index,
+// until one succeeds.  It also hedges the requests if enabled.
+func (p *Proxy) exchangeWeighted(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+	weights []float64,
+) (resp *dns.Msg, u upstream.Upstream, attempts int, err error) {
+	if p.upstreamHealth != nil {
+		p.upstreamHealth.exclude(ups, weights)
 	}
 
-	w := sampleuv.NewWeighted(p.calcWeights(ups), p.randSrc)
+	w := sampleuv.NewWeighted(weights, p.randSrc)
+
 	var errs []error
 	for i, ok := w.Take(); ok; i, ok = w.Take() {
 		u = ups[i]
 
-		var elapsed time.Duration
-		resp, elapsed, err = exchange(u, req, p.time)
-		if err == nil {
-			p.updateRTT(u.Address(), elapsed)
+		if p.hedger != nil {
+			var n int
+			resp, u, n, err = p.exchangeHedged(req, u, takeNext(w, ups))
+			attempts += n
+		} else {
+			var elapsed time.Duration
+			resp, elapsed, err = exchange(u, req, p.time)
+			p.recordRTT(u.Address(), elapsed, err)
+			attempts++
+		}
 
-			return resp, u, nil
+		if err == nil {
+			return resp, u, attempts, nil
 		}
 
 		errs = append(errs, err)
+	}
+
+	err = fmt.Errorf("all upstreams failed to exchange request: %w", errors.Join(errs...))
 
+	return nil, nil, attempts, err
+}
+
+// exchangeRouted resolves req using g if it's not nil, and using ups
+// otherwise.
+func (p *Proxy) exchangeRouted(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+	g *upstreamGroup,
+) (resp *dns.Msg, u upstream.Upstream, attempts int, err error) {
+	if g != nil {
+		return p.exchangeGroup(req, g)
+	}
+
+	return p.exchangeUpstreams(req, ups)
+}
+
+// takeNext returns a function that takes the next upstream from ups using w.
+func takeNext(w sampleuv.Weighted, ups []upstream.Upstream) (next func() (u upstream.Upstream, ok bool)) {
+	return func() (u upstream.Upstream, ok bool) {
+		i, ok := w.Take()
+		if !ok {
+			return nil, false
+		}
+
+		return ups[i], true
+	}
+}
+
+// recordRTT updates the round-trip time statistics of the upstream with
+// address after an exchange, which took elapsed and returned err.
+func (p *Proxy) recordRTT(address string, elapsed time.Duration, err error) {
+	if err != nil {
 		// TODO(e.burkov):  Use the actual configured timeout or, perhaps, the
 		// actual measured elapsed time.
-		p.updateRTT(u.Address(), defaultTimeout)
+		p.updateRTT(address, defaultTimeout)
+		if p.upstreamHealth != nil {
+			p.upstreamHealth.record(address, err, p.time.Now())
+		}
+
+		return
 	}
 
-	err = fmt.Errorf("all upstreams failed to exchange request: %w", errors.Join(errs...))
+	p.updateRTT(address, elapsed)
+	if p.upstreamHealth != nil {
+		p.upstreamHealth.record(address, nil, p.time.Now())
+	}
 
-	return nil, nil, err
+	if p.hedger != nil {
+		p.hedger.record(address, elapsed)
+	}
 }
 
 // exchange returns the result of the DNS request exchange with the given
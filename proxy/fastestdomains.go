@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// fastestDomains decides whether the fastest address selection is used for the
+// domains, see [Config.FastestDomains] and [Config.FastestExcludeDomains].
+type fastestDomains struct {
+	// rules maps the lowercased FQDNs to true if the fastest address selection
+	// is forced for them and their subdomains, and to false if it's disabled.
+	rules map[string]bool
+}
+
+// newFastestDomains returns the per-domain rules of the fastest address
+// selection from c, or nil if there are none.
+func newFastestDomains(c *Config) (d *fastestDomains) {
+	if len(c.FastestDomains) == 0 && len(c.FastestExcludeDomains) == 0 {
+		return nil
+	}
+
+	d = &fastestDomains{
+		rules: make(map[string]bool, len(c.FastestDomains)+len(c.FastestExcludeDomains)),
+	}
+
+	for _, name := range c.FastestDomains {
+		d.rules[dns.Fqdn(strings.ToLower(name))] = true
+	}
+
+	// Let the exclusions win over the same domains.
+	for _, name := range c.FastestExcludeDomains {
+		d.rules[dns.Fqdn(strings.ToLower(name))] = false
+	}
+
+	return d
+}
+
+// mode returns the upstream mode to resolve the request for host in, which is
+// a lowercased FQDN, if the configured mode is def.  The rule of the closest
+// domain of host is applied, if any.  d may be nil.
+func (d *fastestDomains) mode(host string, def UpstreamModeType) (m UpstreamModeType) {
+	if d == nil {
+		return def
+	}
+
+	for name := host; name != ""; {
+		forced, ok := d.rules[name]
+		if !ok {
+			_, name, _ = strings.Cut(name, ".")
+
+			continue
+		}
+
+		switch {
+		case forced:
+			return UModeFastestAddr
+		case def == UModeFastestAddr:
+			return UModeLoadBalance
+		default:
+			return def
+		}
+	}
+
+	return def
+}
+
+// upstreamMode returns the mode to resolve req with if the configured mode is
+// def.  req must have exactly one question.
+func (p *Proxy) upstreamMode(req *dns.Msg, def UpstreamModeType) (m UpstreamModeType) {
+	return p.fastestDomains.mode(strings.ToLower(req.Question[0].Name), def)
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFastestDomains_mode(t *testing.T) {
+	d := newFastestDomains(&Config{
+		FastestDomains:        []string{"cdn.example", "Video.Example.ORG", "both.example"},
+		FastestExcludeDomains: []string{"static.cdn.example", "both.example"},
+	})
+
+	testCases := []struct {
+		name string
+		host string
+		def  UpstreamModeType
+		want UpstreamModeType
+	}{{
+		name: "forced",
+		host: "cdn.example.",
+		def:  UModeLoadBalance,
+		want: UModeFastestAddr,
+	}, {
+		name: "forced_subdomain",
+		host: "img.video.example.org.",
+		def:  UModeParallel,
+		want: UModeFastestAddr,
+	}, {
+		name: "excluded_subdomain",
+		host: "a.static.cdn.example.",
+		def:  UModeFastestAddr,
+		want: UModeLoadBalance,
+	}, {
+		name: "excluded_not_fastest",
+		host: "static.cdn.example.",
+		def:  UModeParallel,
+		want: UModeParallel,
+	}, {
+		name: "exclusion_wins",
+		host: "both.example.",
+		def:  UModeLoadBalance,
+		want: UModeLoadBalance,
+	}, {
+		name: "unmatched",
+		host: "example.net.",
+		def:  UModeFastestAddr,
+		want: UModeFastestAddr,
+	}, {
+		name: "root",
+		host: ".",
+		def:  UModeLoadBalance,
+		want: UModeLoadBalance,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, d.mode(tc.host, tc.def))
+		})
+	}
+
+	t.Run("nil", func(t *testing.T) {
+		var nilDomains *fastestDomains
+
+		assert.Nil(t, newFastestDomains(&Config{}))
+		assert.Equal(t, UModeParallel, nilDomains.mode("cdn.example.", UModeParallel))
+	})
+}
@@ -0,0 +1,17 @@
+package proxy
+
+// TCPFastOpenStats contains the counters of TCP Fast Open, see
+// [Config.TCPFastOpen].
+type TCPFastOpenStats struct {
+	// Accepted is the number of the connections accepted by the plain TCP and
+	// TLS listeners with the data within the SYN.
+	Accepted uint64
+}
+
+// TCPFastOpenStats returns the counters of TCP Fast Open.  It returns empty
+// stats if TCP Fast Open is disabled or not supported.
+func (p *Proxy) TCPFastOpenStats() (s TCPFastOpenStats) {
+	return TCPFastOpenStats{
+		Accepted: p.fastOpenAccepted.Load(),
+	}
+}
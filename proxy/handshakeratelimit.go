@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	rate "github.com/beefsack/go-rate"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// HandshakeRatelimitStats contains the counters of the TLS handshake rate
+// limiter.
+type HandshakeRatelimitStats struct {
+	// Accepted is the number of connections allowed to proceed to the TLS
+	// handshake.
+	Accepted uint64
+
+	// Rejected is the number of connections closed due to the rate limit.
+	Rejected uint64
+}
+
+// handshakeLimiter limits the rate of new TLS handshakes per source subnet.
+// It's safe for concurrent use.
+type handshakeLimiter struct {
+	// bucketsLock protects buckets.
+	bucketsLock *sync.Mutex
+
+	// buckets stores the rate limiters for source subnets.
+	buckets *gocache.Cache
+
+	// allowlist is the set of subnets excluded from rate limiting.
+	allowlist netutil.SliceSubnetSet
+
+	// accepted is the number of connections allowed to proceed.
+	accepted *atomic.Uint64
+
+	// rejected is the number of connections closed due to the rate limit.
+	rejected *atomic.Uint64
+
+	// rps is the maximum number of handshakes per second per subnet.
+	rps int
+
+	// subnetLenIPv4 is the length of the IPv4 subnet to group sources by.
+	subnetLenIPv4 int
+
+	// subnetLenIPv6 is the length of the IPv6 subnet to group sources by.
+	subnetLenIPv6 int
+}
+
+// newHandshakeLimiter returns a new properly initialized *handshakeLimiter or
+// nil if the handshake rate limiting is disabled in c.
+func newHandshakeLimiter(c *Config) (l *handshakeLimiter) {
+	if c.TLSHandshakeRatelimit <= 0 {
+		return nil
+	}
+
+	return &handshakeLimiter{
+		bucketsLock:   &sync.Mutex{},
+		buckets:       gocache.New(time.Hour, time.Hour),
+		allowlist:     netutil.SliceSubnetSet(c.TLSHandshakeRatelimitAllowlist),
+		accepted:      &atomic.Uint64{},
+		rejected:      &atomic.Uint64{},
+		rps:           c.TLSHandshakeRatelimit,
+		subnetLenIPv4: c.RatelimitSubnetLenIPv4,
+		subnetLenIPv6: c.RatelimitSubnetLenIPv6,
+	}
+}
+
+// allow returns true if a new handshake from addr is allowed.
+func (l *handshakeLimiter) allow(addr netip.Addr) (ok bool) {
+	addr = addr.Unmap()
+	if l.allowlist.Contains(addr) {
+		l.accepted.Add(1)
+
+		return true
+	}
+
+	var pref netip.Prefix
+	if addr.Is4() {
+		pref = netip.PrefixFrom(addr, l.subnetLenIPv4)
+	} else {
+		pref = netip.PrefixFrom(addr, l.subnetLenIPv6)
+	}
+
+	key := pref.Masked().Addr().String()
+
+	l.bucketsLock.Lock()
+	defer l.bucketsLock.Unlock()
+
+	var rl *rate.RateLimiter
+	if v, found := l.buckets.Get(key); found {
+		rl = v.(*rate.RateLimiter)
+	} else {
+		rl = rate.New(l.rps, time.Second)
+		l.buckets.Set(key, rl, time.Hour)
+	}
+
+	if ok, _ = rl.Try(); ok {
+		l.accepted.Add(1)
+	} else {
+		l.rejected.Add(1)
+	}
+
+	return ok
+}
+
+// stats returns the current counters of l.
+func (l *handshakeLimiter) stats() (s HandshakeRatelimitStats) {
+	return HandshakeRatelimitStats{
+		Accepted: l.accepted.Load(),
+		Rejected: l.rejected.Load(),
+	}
+}
+
+// limitedListener is a [net.Listener] that closes the accepted connections
+// exceeding the handshake rate limit before returning them to the TLS layer,
+// so that no handshake work is done for them.
+type limitedListener struct {
+	net.Listener
+
+	// limiter decides whether the connection may proceed.
+	limiter *handshakeLimiter
+}
+
+// type check
+var _ net.Listener = (*limitedListener)(nil)
+
+// Accept implements the [net.Listener] interface for *limitedListener.
+func (l *limitedListener) Accept() (conn net.Conn, err error) {
+	for {
+		conn, err = l.Listener.Accept()
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is and
+			// callers check it for [net.ErrClosed].
+			return nil, err
+		}
+
+		addr := netutil.NetAddrToAddrPort(conn.RemoteAddr())
+		if l.limiter.allow(addr.Addr()) {
+			return conn, nil
+		}
+
+		log.Debug("dnsproxy: tls handshake ratelimit: dropping conn from %s", addr)
+
+		err = conn.Close()
+		if err != nil {
+			logWithNonCrit(err, "dnsproxy: tls handshake ratelimit: closing conn")
+		}
+	}
+}
+
+// limitHandshakes wraps l with the handshake rate limiter of p, if any.
+func (p *Proxy) limitHandshakes(l net.Listener) (wrapped net.Listener) {
+	if p.handshakeLimiter == nil {
+		return l
+	}
+
+	return &limitedListener{
+		Listener: l,
+		limiter:  p.handshakeLimiter,
+	}
+}
+
+// TLSHandshakeStats returns the counters of the TLS handshake rate limiter.
+// It returns empty stats if the limiter is disabled.
+func (p *Proxy) TLSHandshakeStats() (s HandshakeRatelimitStats) {
+	if p.handshakeLimiter == nil {
+		return HandshakeRatelimitStats{}
+	}
+
+	return p.handshakeLimiter.stats()
+}
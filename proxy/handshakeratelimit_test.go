@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeLimiter_allow(t *testing.T) {
+	l := newHandshakeLimiter(&Config{
+		TLSHandshakeRatelimit: 1,
+		TLSHandshakeRatelimitAllowlist: []netip.Prefix{
+			netip.MustParsePrefix("192.0.2.0/24"),
+		},
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+	require.NotNil(t, l)
+
+	limited := netip.MustParseAddr("198.51.100.1")
+	sameSubnet := netip.MustParseAddr("198.51.100.2")
+	allowed := netip.MustParseAddr("192.0.2.1")
+
+	assert.True(t, l.allow(limited))
+	assert.False(t, l.allow(limited))
+	assert.False(t, l.allow(sameSubnet))
+
+	assert.True(t, l.allow(allowed))
+	assert.True(t, l.allow(allowed))
+
+	assert.Equal(t, HandshakeRatelimitStats{Accepted: 3, Rejected: 2}, l.stats())
+}
+
+func TestNewHandshakeLimiter_disabled(t *testing.T) {
+	assert.Nil(t, newHandshakeLimiter(&Config{}))
+}
+
+func TestLimitedListener(t *testing.T) {
+	tcpListen, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(localhostAnyPort))
+	require.NoError(t, err)
+
+	p := &Proxy{
+		handshakeLimiter: newHandshakeLimiter(&Config{
+			TLSHandshakeRatelimit:  1,
+			RatelimitSubnetLenIPv4: 32,
+			RatelimitSubnetLenIPv6: 128,
+		}),
+	}
+
+	l := p.limitHandshakes(tcpListen)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, aErr := l.Accept()
+			if aErr != nil {
+				close(accepted)
+
+				return
+			}
+
+			accepted <- conn
+		}
+	}()
+
+	addr := tcpListen.Addr().String()
+
+	first, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, first.Close)
+
+	conn := <-accepted
+	require.NotNil(t, conn)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	second, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, second.Close)
+
+	// The second connection is closed by the listener right after accepting.
+	_, err = second.Read(make([]byte, 1))
+	require.Error(t, err)
+
+	assert.Equal(t, HandshakeRatelimitStats{Accepted: 1, Rejected: 1}, p.TLSHandshakeStats())
+}
@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultHedgeBudget is the default share of the requests that may be
+	// hedged, see [Config.HedgeBudget].
+	defaultHedgeBudget = 0.1
+
+	// hedgeBurst is the maximum number of the hedged requests the budget may
+	// accumulate, so that a long quiet period doesn't allow a burst of them.
+	hedgeBurst = 10
+
+	// hedgeWindowSize is the number of the latest round-trip times of each
+	// upstream the hedging delay is calculated from.
+	hedgeWindowSize = 64
+
+	// hedgeMinSamples is the minimum number of the round-trip times of an
+	// upstream required to hedge the requests to it.
+	hedgeMinSamples = 16
+
+	// hedgePercentile is the percentile of the round-trip times of an upstream
+	// used as its hedging delay.
+	hedgePercentile = 0.95
+)
+
+// latencyWindow is the ring buffer of the latest round-trip times of an
+// upstream.
+type latencyWindow struct {
+	// rtts are the round-trip times.
+	rtts []time.Duration
+
+	// next is the index in rtts the next round-trip time is written to.
+	next int
+}
+
+// add adds rtt to w, replacing the oldest one if w is full.
+func (w *latencyWindow) add(rtt time.Duration) {
+	if len(w.rtts) < hedgeWindowSize {
+		w.rtts = append(w.rtts, rtt)
+
+		return
+	}
+
+	w.rtts[w.next] = rtt
+	w.next = (w.next + 1) % hedgeWindowSize
+}
+
+// percentile returns the round-trip time below which the share q of the
+// round-trip times of w fall.  w must not be empty.
+func (w *latencyWindow) percentile(q float64) (rtt time.Duration) {
+	sorted := slices.Clone(w.rtts)
+	slices.Sort(sorted)
+
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+// hedger decides when the request to an upstream should be hedged, i.e. sent to
+// another upstream as well, and limits the number of the hedged requests with
+// a retry budget.  It's safe for concurrent use.
+type hedger struct {
+	// mu protects all the fields below.
+	mu *sync.Mutex
+
+	// windows are the latest round-trip times of the upstreams by their
+	// addresses.
+	windows map[string]*latencyWindow
+
+	// ratio is the amount the balance grows by with each request.
+	ratio float64
+
+	// balance is the number of the hedged requests currently allowed.
+	balance float64
+}
+
+// newHedger returns a new properly initialized *hedger or nil if the hedging
+// is disabled in c.
+func newHedger(c *Config) (h *hedger) {
+	if !c.HedgeRequests || c.UpstreamMode != UModeLoadBalance {
+		return nil
+	}
+
+	ratio := c.HedgeBudget
+	if ratio <= 0 {
+		ratio = defaultHedgeBudget
+	}
+
+	return &hedger{
+		mu:      &sync.Mutex{},
+		windows: map[string]*latencyWindow{},
+		ratio:   ratio,
+	}
+}
+
+// record adds the round-trip time of a successful exchange with the upstream
+// with addr.
+func (h *hedger) record(addr string, rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w := h.windows[addr]
+	if w == nil {
+		w = &latencyWindow{}
+		h.windows[addr] = w
+	}
+
+	w.add(rtt)
+}
+
+// delay returns the time to wait for the upstream with addr before hedging
+// the request.  ok is false if there isn't enough history for the upstream.
+func (h *hedger) delay(addr string) (d time.Duration, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w := h.windows[addr]
+	if w == nil || len(w.rtts) < hedgeMinSamples {
+		return 0, false
+	}
+
+	return w.percentile(hedgePercentile), true
+}
+
+// deposit replenishes the budget for a single request.
+func (h *hedger) deposit() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.balance = min(h.balance+h.ratio, hedgeBurst)
+}
+
+// withdraw returns true if the budget allows one more hedged request and
+// takes it from the budget.
+func (h *hedger) withdraw() (ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.balance < 1 {
+		return false
+	}
+
+	h.balance--
+
+	return true
+}
+
+// refund returns the hedged request taken by withdraw, but not made, to the
+// budget.
+func (h *hedger) refund() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.balance++
+}
+
+// hedgeResult is the result of a single exchange within a hedged request.
+type hedgeResult struct {
+	resp *dns.Msg
+	u    upstream.Upstream
+	err  error
+}
+
+// exchangeHedged resolves req using u and, if u hasn't responded within its
+// hedging delay and the budget allows, also using the upstream returned by
+// next, if any.  It returns the first successful response and the number of
+// the upstreams used.
+func (p *Proxy) exchangeHedged(
+	req *dns.Msg,
+	u upstream.Upstream,
+	next func() (u upstream.Upstream, ok bool),
+) (resp *dns.Msg, used upstream.Upstream, attempts int, err error) {
+	// Buffer the channel to not leak the goroutine of the exchange, the
+	// result of which isn't waited for.
+	resCh := make(chan *hedgeResult, 2)
+	go p.hedgeExchange(req.Copy(), u, resCh)
+	attempts = 1
+
+	var timerCh <-chan time.Time
+	if d, ok := p.hedger.delay(u.Address()); ok {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		timerCh = timer.C
+	}
+
+	var errs []error
+	for pending := 1; pending > 0; {
+		select {
+		case res := <-resCh:
+			pending--
+			if res.err == nil {
+				return res.resp, res.u, attempts, nil
+			}
+
+			errs = append(errs, res.err)
+		case <-timerCh:
+			timerCh = nil
+			if p.startHedge(req, u, next, resCh) {
+				pending++
+				attempts++
+			}
+		}
+	}
+
+	return nil, nil, attempts, fmt.Errorf("hedged exchange: %w", errors.Join(errs...))
+}
+
+// startHedge starts exchanging req with the upstream returned by next, if
+// there is one and the budget allows it.  slow is the upstream the request has
+// been sent to first.
+func (p *Proxy) startHedge(
+	req *dns.Msg,
+	slow upstream.Upstream,
+	next func() (u upstream.Upstream, ok bool),
+	resCh chan<- *hedgeResult,
+) (ok bool) {
+	if !p.hedger.withdraw() {
+		return false
+	}
+
+	u, ok := next()
+	if !ok {
+		p.hedger.refund()
+
+		return false
+	}
+
+	log.Debug("dnsproxy: hedging request to %s with %s", slow.Address(), u.Address())
+
+	go p.hedgeExchange(req.Copy(), u, resCh)
+
+	return true
+}
+
+// hedgeExchange exchanges req with u, records the round-trip time, and sends
+// the result to resCh.  req must not be used elsewhere, since the upstreams
+// may modify it, e.g. the DoH ones reset its ID during the exchange, and the
+// slower exchange keeps running after the faster one has returned.
+func (p *Proxy) hedgeExchange(req *dns.Msg, u upstream.Upstream, resCh chan<- *hedgeResult) {
+	defer log.OnPanic("dnsproxy: hedging")
+
+	resp, elapsed, err := exchange(u, req, p.time)
+	p.recordRTT(u.Address(), elapsed, err)
+
+	resCh <- &hedgeResult{
+		resp: resp,
+		u:    u,
+		err:  err,
+	}
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	w := &latencyWindow{}
+	for i := range hedgeWindowSize {
+		w.add(time.Duration(i+1) * time.Millisecond)
+	}
+
+	assert.Equal(t, 60*time.Millisecond, w.percentile(hedgePercentile))
+
+	// Replace the lowest round-trip times.
+	for range hedgeWindowSize / 2 {
+		w.add(time.Second)
+	}
+
+	assert.Len(t, w.rtts, hedgeWindowSize)
+	assert.Equal(t, time.Second, w.percentile(hedgePercentile))
+}
+
+func TestHedger_budget(t *testing.T) {
+	h := newHedger(&Config{HedgeRequests: true, HedgeBudget: 0.5})
+	require.NotNil(t, h)
+
+	h.deposit()
+	assert.False(t, h.withdraw())
+
+	h.deposit()
+	assert.True(t, h.withdraw())
+	assert.False(t, h.withdraw())
+
+	for range 100 {
+		h.deposit()
+	}
+
+	for range hedgeBurst {
+		require.True(t, h.withdraw())
+	}
+
+	assert.False(t, h.withdraw())
+
+	assert.Nil(t, newHedger(&Config{HedgeRequests: false}))
+	assert.Nil(t, newHedger(&Config{HedgeRequests: true, UpstreamMode: UModeParallel}))
+}
+
+// newDelayedUpstream returns an [upstream.Upstream] with addr that responds
+// after delay.
+func newDelayedUpstream(addr string, delay time.Duration) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			time.Sleep(delay)
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (a string) { return addr },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_exchangeHedged(t *testing.T) {
+	slow := newDelayedUpstream("slow", 200*time.Millisecond)
+	fast := newDelayedUpstream("fast", 0)
+
+	newProxy := func(t *testing.T) (p *Proxy) {
+		t.Helper()
+
+		p = mustNew(t, &Config{
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{slow, fast},
+			},
+			TrustedProxies: defaultTrustedProxies,
+			HedgeRequests:  true,
+			HedgeBudget:    1,
+		})
+
+		for range hedgeMinSamples {
+			p.hedger.record(slow.Address(), time.Millisecond)
+		}
+
+		return p
+	}
+
+	next := func() (u upstream.Upstream, ok bool) { return fast, true }
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+	t.Run("hedged", func(t *testing.T) {
+		p := newProxy(t)
+		p.hedger.deposit()
+
+		resp, u, attempts, err := p.exchangeHedged(req, slow, next)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Same(t, fast, u)
+		assert.Equal(t, 2, attempts)
+	})
+
+	t.Run("no_budget", func(t *testing.T) {
+		p := newProxy(t)
+
+		resp, u, attempts, err := p.exchangeHedged(req, slow, next)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Same(t, slow, u)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("no_history", func(t *testing.T) {
+		p := newProxy(t)
+		p.hedger.deposit()
+
+		resp, u, attempts, err := p.exchangeHedged(req, fast, next)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Same(t, fast, u)
+		assert.Equal(t, 1, attempts)
+	})
+}
+
+// newTestDoHUpstream returns a DoH upstream of a test server responding after
+// delay.
+func newTestDoHUpstream(t *testing.T, delay time.Duration) (u upstream.Upstream) {
+	t.Helper()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b []byte
+		var err error
+		if r.Method == http.MethodGet {
+			b, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			b, err = io.ReadAll(r.Body)
+		}
+
+		req := &dns.Msg{}
+		if err == nil {
+			err = req.Unpack(b)
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		time.Sleep(delay)
+
+		b, err = (&dns.Msg{}).SetReply(req).Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(b)
+	})
+
+	srv := httptest.NewUnstartedServer(h)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	addr := "https://" + srv.Listener.Addr().String() + "/dns-query"
+	u, err := upstream.AddressToUpstream(addr, &upstream.Options{
+		InsecureSkipVerify: true,
+		Timeout:            time.Second,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	return u
+}
+
+func TestProxy_exchangeHedged_doh(t *testing.T) {
+	// Both DoH upstreams reset the ID of the request during the exchange, and
+	// the slow one keeps doing it after the fast one has responded, which is
+	// detected by the race detector unless each one has its own request.
+	slow := newTestDoHUpstream(t, 50*time.Millisecond)
+	fast := newTestDoHUpstream(t, 0)
+
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{slow, fast},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		HedgeRequests:  true,
+		HedgeBudget:    1,
+	})
+
+	next := func() (u upstream.Upstream, ok bool) { return fast, true }
+
+	for i := range 5 {
+		for range hedgeMinSamples {
+			p.hedger.record(slow.Address(), time.Millisecond)
+		}
+
+		p.hedger.deposit()
+
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+		req.Id = uint16(1000 + i)
+
+		resp, u, _, err := p.exchangeHedged(req, slow, next)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Same(t, fast, u)
+		assert.Equal(t, req.Id, resp.Id)
+		assert.Equal(t, uint16(1000+i), req.Id)
+	}
+}
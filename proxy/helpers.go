@@ -99,21 +99,22 @@ func ecsFromMsg(m *dns.Msg) (subnet *net.IPNet, scope int) {
 	return nil, 0
 }
 
-// setECS sets the EDNS client subnet option based on ip and scope into m.  It
-// returns masked IP and mask length.
-func setECS(m *dns.Msg, ip net.IP, scope uint8) (subnet *net.IPNet) {
-	const (
-		// defaultECSv4 is the default length of network mask for IPv4 address
-		// in ECS option.
-		defaultECSv4 = 24
-
-		// defaultECSv6 is the default length of network mask for IPv6 address
-		// in ECS.  The size of 7 octets is chosen as a reasonable minimum since
-		// at least Google's public DNS refuses requests containing the options
-		// with longer network masks.
-		defaultECSv6 = 56
-	)
+const (
+	// defaultECSv4 is the default length of network mask for IPv4 address in
+	// ECS option.
+	defaultECSv4 = 24
+
+	// defaultECSv6 is the default length of network mask for IPv6 address in
+	// ECS.  The size of 7 octets is chosen as a reasonable minimum since at
+	// least Google's public DNS refuses requests containing the options with
+	// longer network masks.
+	defaultECSv6 = 56
+)
 
+// setECS sets the EDNS client subnet option based on ip and scope into m.  The
+// subnet is lenIPv4 or lenIPv6 bits long depending on the family of ip.  It
+// returns masked IP and mask length.
+func setECS(m *dns.Msg, ip net.IP, scope uint8, lenIPv4, lenIPv6 int) (subnet *net.IPNet) {
 	e := &dns.EDNS0_SUBNET{
 		Code:        dns.EDNS0SUBNET,
 		SourceScope: scope,
@@ -122,14 +123,14 @@ func setECS(m *dns.Msg, ip net.IP, scope uint8) (subnet *net.IPNet) {
 	subnet = &net.IPNet{}
 	if ip4 := ip.To4(); ip4 != nil {
 		e.Family = 1
-		e.SourceNetmask = defaultECSv4
-		subnet.Mask = net.CIDRMask(defaultECSv4, netutil.IPv4BitLen)
+		e.SourceNetmask = uint8(lenIPv4)
+		subnet.Mask = net.CIDRMask(lenIPv4, netutil.IPv4BitLen)
 		ip = ip4
 	} else {
 		// Assume the IP address has already been validated.
 		e.Family = 2
-		e.SourceNetmask = defaultECSv6
-		subnet.Mask = net.CIDRMask(defaultECSv6, netutil.IPv6BitLen)
+		e.SourceNetmask = uint8(lenIPv6)
+		subnet.Mask = net.CIDRMask(lenIPv6, netutil.IPv6BitLen)
 	}
 	subnet.IP = ip.Mask(subnet.Mask)
 	e.Address = subnet.IP
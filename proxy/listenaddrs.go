@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net"
+)
+
+// sharedTCPAddr returns the address to bind the TCP listener for a to.  If the
+// port of a is zero and one of udpAddrs has the same IP address and zero port
+// as well, the port already bound by the corresponding listener from udpConns
+// is used, so that both protocols of an ephemeral address are served on the
+// same port.  Otherwise, a itself is returned.  udpConns must be the listeners
+// created for udpAddrs, in the same order.
+func sharedTCPAddr(a *net.TCPAddr, udpAddrs []*net.UDPAddr, udpConns []*net.UDPConn) (res *net.TCPAddr) {
+	if a.Port != 0 {
+		return a
+	}
+
+	for i, ua := range udpAddrs {
+		if i >= len(udpConns) || ua.Port != 0 || !ua.IP.Equal(a.IP) || ua.Zone != a.Zone {
+			continue
+		}
+
+		bound, ok := udpConns[i].LocalAddr().(*net.UDPAddr)
+		if !ok {
+			return a
+		}
+
+		return &net.TCPAddr{
+			IP:   a.IP,
+			Port: bound.Port,
+			Zone: a.Zone,
+		}
+	}
+
+	return a
+}
+
+// Ready returns a channel, which is closed when p has been started and all its
+// listeners are bound, so that their actual addresses, e.g. for the ones
+// configured with zero ports, are available via [Proxy.Addrs] and
+// [Proxy.Addr].  A new channel is returned after p is shut down.
+func (p *Proxy) Ready() (ready <-chan struct{}) {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.ready
+}
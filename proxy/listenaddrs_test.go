@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Ready(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: nil,
+		onAddress:  func() (addr string) { return "upstream" },
+		onClose:    func() (err error) { return nil },
+	}
+
+	p, err := New(&Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: defaultTrustedProxies,
+	})
+	require.NoError(t, err)
+
+	ready := p.Ready()
+	require.NotNil(t, ready)
+
+	select {
+	case <-ready:
+		t.Fatal("ready before start")
+	default:
+		// Go on.
+	}
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+
+	<-ready
+
+	udpAddr := testutil.RequireTypeAssert[*net.UDPAddr](t, p.Addr(ProtoUDP))
+	tcpAddr := testutil.RequireTypeAssert[*net.TCPAddr](t, p.Addr(ProtoTCP))
+
+	assert.NotZero(t, udpAddr.Port)
+	assert.Equal(t, udpAddr.Port, tcpAddr.Port)
+
+	require.NoError(t, p.Shutdown(ctx))
+
+	select {
+	case <-p.Ready():
+		t.Fatal("ready after shutdown")
+	default:
+		// Go on.
+	}
+}
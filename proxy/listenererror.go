@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ListenerErrorCode is the kind of a listener failure, see [ListenerError].
+type ListenerErrorCode uint8
+
+// ListenerErrorCode values.
+const (
+	// ListenerErrorBind means that the listener couldn't be bound to its
+	// address, e.g. because the address is in use or isn't assigned to any
+	// interface.  [Proxy.Start] fails after reporting it.
+	ListenerErrorBind ListenerErrorCode = iota + 1
+
+	// ListenerErrorAccept means that the listener has failed to accept a
+	// connection and has stopped serving.
+	ListenerErrorAccept
+
+	// ListenerErrorRead means that the UDP listener has failed to read a
+	// packet and has stopped serving.
+	ListenerErrorRead
+
+	// ListenerErrorTLSHandshake means that the TLS handshake with a client
+	// has failed.  The listener keeps serving.
+	ListenerErrorTLSHandshake
+
+	// ListenerErrorQUIC means that a QUIC connection with a client has failed.
+	// The listener keeps serving.
+	ListenerErrorQUIC
+)
+
+// String implements the [fmt.Stringer] interface for ListenerErrorCode.
+func (c ListenerErrorCode) String() (str string) {
+	switch c {
+	case ListenerErrorBind:
+		return "bind"
+	case ListenerErrorAccept:
+		return "accept"
+	case ListenerErrorRead:
+		return "read"
+	case ListenerErrorTLSHandshake:
+		return "tls_handshake"
+	case ListenerErrorQUIC:
+		return "quic"
+	default:
+		return fmt.Sprintf("!bad_listener_error_code_%d", c)
+	}
+}
+
+// ListenerError describes a failure of a listener, see
+// [Config.OnListenerError].
+type ListenerError struct {
+	// Err is the underlying error.
+	Err error
+
+	// Addr is the address of the listener.  For [ListenerErrorBind] it's the
+	// configured address, which may have a zero port.
+	Addr net.Addr
+
+	// Proto is the protocol of the listener.
+	Proto Proto
+
+	// Code is the kind of the failure.
+	Code ListenerErrorCode
+}
+
+// type check
+var _ error = (*ListenerError)(nil)
+
+// Error implements the [error] interface for *ListenerError.
+func (e *ListenerError) Error() (msg string) {
+	return fmt.Sprintf("%s listener %s: %s: %s", e.Proto, e.Addr, e.Code, e.Err)
+}
+
+// type check
+var _ errors.Wrapper = (*ListenerError)(nil)
+
+// Unwrap implements the [errors.Wrapper] interface for *ListenerError.
+func (e *ListenerError) Unwrap() (unwrapped error) {
+	return e.Err
+}
+
+// reportListenerError reports the failure of the listener for proto on addr to
+// [Config.OnListenerError], if it's set.
+func (p *Proxy) reportListenerError(proto Proto, addr net.Addr, code ListenerErrorCode, err error) {
+	if p.OnListenerError == nil {
+		return
+	}
+
+	p.OnListenerError(&ListenerError{
+		Err:   err,
+		Addr:  addr,
+		Proto: proto,
+		Code:  code,
+	})
+}
+
+// handshakeTLS performs the TLS handshake with the client on conn accepted by
+// the listener for proto.  The critical failures are logged and reported, see
+// [isNonCritical].
+func (p *Proxy) handshakeTLS(conn *tls.Conn, proto Proto) (err error) {
+	err = conn.SetDeadline(time.Now().Add(defaultTimeout))
+	if err != nil {
+		// Consider deadline errors non-critical.
+		logWithNonCrit(err, "handling tls: setting deadline")
+	}
+
+	err = conn.Handshake()
+	if err == nil {
+		return nil
+	}
+
+	logWithNonCrit(err, fmt.Sprintf("handling %s: tls handshake with %s", proto, conn.RemoteAddr()))
+	if !isNonCritical(err) {
+		p.reportListenerError(proto, conn.LocalAddr(), ListenerErrorTLSHandshake, err)
+	}
+
+	return err
+}
+
+// serveHTTP serves the connections accepted by l with srv, and logs and reports
+// the failure, if any.  It's intended to be used as a goroutine.
+func (p *Proxy) serveHTTP(srv *http.Server, l net.Listener, proto Proto) {
+	err := srv.Serve(l)
+	if err == nil || errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed) {
+		return
+	}
+
+	log.Error("dnsproxy: serving %s on %s: %s", proto, l.Addr(), err)
+	p.reportListenerError(proto, l.Addr(), ListenerErrorAccept, err)
+}
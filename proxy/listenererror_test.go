@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerError(t *testing.T) {
+	const errTest errors.Error = "test"
+
+	e := &ListenerError{
+		Err:   errTest,
+		Addr:  &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 853},
+		Proto: ProtoTLS,
+		Code:  ListenerErrorTLSHandshake,
+	}
+
+	testutil.AssertErrorMsg(t, "tls listener 127.0.0.1:853: tls_handshake: test", e)
+	assert.ErrorIs(t, e, errTest)
+
+	assert.Equal(t, "!bad_listener_error_code_0", ListenerErrorCode(0).String())
+}
+
+func TestProxy_OnListenerError(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	newConf := func(errCh chan *ListenerError) (c *Config) {
+		return &Config{
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies: defaultTrustedProxies,
+			OnListenerError: func(e *ListenerError) {
+				errCh <- e
+			},
+		}
+	}
+
+	t.Run("bind", func(t *testing.T) {
+		l, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(localhostAnyPort))
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, l.Close)
+
+		errCh := make(chan *ListenerError, 1)
+		conf := newConf(errCh)
+		conf.TCPListenAddr = []*net.TCPAddr{l.Addr().(*net.TCPAddr)}
+
+		p := mustNew(t, conf)
+		require.Error(t, p.Start(context.Background()))
+
+		e, _ := testutil.RequireReceive(t, errCh, time.Second)
+		assert.Equal(t, ProtoTCP, e.Proto)
+		assert.Equal(t, ListenerErrorBind, e.Code)
+		assert.Equal(t, l.Addr().String(), e.Addr.String())
+	})
+
+	t.Run("tls_handshake", func(t *testing.T) {
+		tlsConf, _ := newTLSConfig(t)
+
+		errCh := make(chan *ListenerError, 1)
+		conf := newConf(errCh)
+		conf.TLSListenAddr = []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)}
+		conf.TLSConfig = tlsConf
+
+		p := mustNew(t, conf)
+
+		ctx := context.Background()
+		require.NoError(t, p.Start(ctx))
+		testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+		// Send a plain DNS request to the TLS listener.
+		addr := p.Addr(ProtoTLS).String()
+		client := &dns.Client{Net: string(ProtoTCP), Timeout: time.Second}
+		_, _, _ = client.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA), addr)
+
+		e, _ := testutil.RequireReceive(t, errCh, time.Second)
+		assert.Equal(t, ProtoTLS, e.Proto)
+		assert.Equal(t, ListenerErrorTLSHandshake, e.Code)
+		assert.Equal(t, addr, e.Addr.String())
+	})
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// interfaceAddrsFunc returns the addresses of the network interfaces of the
+// system.  [net.InterfaceAddrs] is used by default.
+type interfaceAddrsFunc func() (addrs []net.Addr, err error)
+
+// validateListenRebind returns an error if the listener rebinding
+// configuration of c is invalid.
+func (c *Config) validateListenRebind() (err error) {
+	if c.ListenRebindInterval < 0 {
+		return errors.Error("negative interval")
+	}
+
+	return nil
+}
+
+// listenWatchIPs returns the specific IP addresses the plain DNS listeners of
+// p are bound to, which are the ones affected by the addresses disappearing
+// from the interfaces.
+func (p *Proxy) listenWatchIPs() (ips map[netip.Addr]bool) {
+	ips = map[netip.Addr]bool{}
+	for _, a := range p.UDPListenAddr {
+		if ip, ok := netip.AddrFromSlice(a.IP); ok && !ip.IsUnspecified() {
+			ips[ip.Unmap()] = true
+		}
+	}
+
+	for _, a := range p.TCPListenAddr {
+		if ip, ok := netip.AddrFromSlice(a.IP); ok && !ip.IsUnspecified() {
+			ips[ip.Unmap()] = true
+		}
+	}
+
+	return ips
+}
+
+// watchListenAddrs checks the addresses of the network interfaces each
+// [Config.ListenRebindInterval] and rebinds the plain DNS listeners bound to
+// the ones which have reappeared, until stop is closed.  present are the
+// watched addresses, all of which are considered present initially.  It's
+// intended to be used as a goroutine.
+func (p *Proxy) watchListenAddrs(present map[netip.Addr]bool, stop <-chan struct{}) {
+	defer log.OnPanic("dnsproxy: watching listen addrs")
+
+	ticker := time.NewTicker(p.ListenRebindInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.checkListenAddrs(present, stop)
+		}
+	}
+}
+
+// checkListenAddrs updates present with the current addresses of the network
+// interfaces and rebinds the listeners bound to the reappeared ones, unless
+// stop is closed.  Once rebinding fails, the address is considered absent, so
+// that it's retried the next time.
+func (p *Proxy) checkListenAddrs(present map[netip.Addr]bool, stop <-chan struct{}) {
+	current, err := p.ifaceIPs()
+	if err != nil {
+		log.Error("dnsproxy: listen addrs: %s", err)
+
+		return
+	}
+
+	var reappeared []netip.Addr
+	for ip, was := range present {
+		switch is := current[ip]; {
+		case was && !is:
+			log.Info("dnsproxy: listen addrs: %s disappeared", ip)
+		case !was && is:
+			reappeared = append(reappeared, ip)
+		}
+
+		present[ip] = current[ip]
+	}
+
+	if len(reappeared) == 0 {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	select {
+	case <-stop:
+		// The proxy has been shut down while checking.
+		return
+	default:
+	}
+
+	for _, ip := range reappeared {
+		log.Info("dnsproxy: listen addrs: %s reappeared; rebinding", ip)
+
+		err = p.rebindListeners(ip)
+		if err != nil {
+			log.Error("dnsproxy: listen addrs: rebinding %s: %s", ip, err)
+
+			present[ip] = false
+		}
+	}
+}
+
+// ifaceIPs returns the set of the IP addresses of the network interfaces.
+func (p *Proxy) ifaceIPs() (ips map[netip.Addr]bool, err error) {
+	addrs, err := p.interfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("getting interface addrs: %w", err)
+	}
+
+	ips = make(map[netip.Addr]bool, len(addrs))
+	for _, a := range addrs {
+		var ip net.IP
+		switch a := a.(type) {
+		case *net.IPNet:
+			ip = a.IP
+		case *net.IPAddr:
+			ip = a.IP
+		}
+
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			ips[addr.Unmap()] = true
+		}
+	}
+
+	return ips, nil
+}
+
+// rebindListeners replaces the plain DNS listeners bound to ip with the new
+// ones bound to the same addresses and starts serving them.  The new sockets
+// are bound before the old ones are closed, which relies on SO_REUSEPORT, so
+// that the old ones are kept serving if it fails.  p.RWMutex must be locked.
+func (p *Proxy) rebindListeners(ip netip.Addr) (err error) {
+	ctx := context.Background()
+
+	var errs []error
+	for i, l := range p.udpListen {
+		addr, ok := l.LocalAddr().(*net.UDPAddr)
+		if !ok || addr.AddrPort().Addr().Unmap() != ip {
+			continue
+		}
+
+		conn, uErr := p.udpCreate(ctx, addr)
+		if uErr != nil {
+			p.reportListenerError(ProtoUDP, addr, ListenerErrorBind, uErr)
+			errs = append(errs, uErr)
+
+			continue
+		}
+
+		p.udpListen[i] = conn
+		go p.udpPacketLoop(conn, p.requestsSema)
+
+		errs = closeAll(errs, l)
+	}
+
+	for i, l := range p.tcpListen {
+		addr, ok := l.Addr().(*net.TCPAddr)
+		if !ok || addr.AddrPort().Addr().Unmap() != ip {
+			continue
+		}
+
+		lsnr, tErr := p.tcpCreate(ctx, addr)
+		if tErr != nil {
+			p.reportListenerError(ProtoTCP, addr, ListenerErrorBind, tErr)
+			errs = append(errs, tErr)
+
+			continue
+		}
+
+		p.tcpListen[i] = lsnr
+		go p.tcpPacketLoop(lsnr, ProtoTCP, p.requestsSema)
+
+		errs = closeAll(errs, l)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_watchListenAddrs(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTestTTL,
+				},
+				A: net.IP{8, 8, 8, 8},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr:        []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:        []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:       &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:       defaultTrustedProxies,
+		ListenRebindInterval: 10 * time.Millisecond,
+	})
+
+	var up atomic.Bool
+	up.Store(true)
+	p.interfaceAddrs = func() (addrs []net.Addr, err error) {
+		if !up.Load() {
+			return nil, nil
+		}
+
+		return []net.Addr{&net.IPNet{IP: net.ParseIP(listenIP), Mask: net.CIDRMask(8, 32)}}, nil
+	}
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	listeners := func() (udp *net.UDPConn, tcp net.Listener) {
+		p.RLock()
+		defer p.RUnlock()
+
+		return p.udpListen[0], p.tcpListen[0]
+	}
+
+	oldUDP, oldTCP := listeners()
+	udpAddr := p.Addr(ProtoUDP)
+	tcpAddr := p.Addr(ProtoTCP)
+
+	// Let the watcher notice the disappearance.
+	up.Store(false)
+	time.Sleep(50 * time.Millisecond)
+
+	udp, tcp := listeners()
+	require.Same(t, oldUDP, udp)
+	require.Equal(t, oldTCP, tcp)
+
+	up.Store(true)
+	require.Eventually(t, func() (ok bool) {
+		udp, tcp := listeners()
+
+		return udp != oldUDP && tcp != oldTCP
+	}, time.Second, 10*time.Millisecond)
+
+	// The listeners are rebound to the same addresses.
+	assert.Equal(t, udpAddr.String(), p.Addr(ProtoUDP).String())
+	assert.Equal(t, tcpAddr.String(), p.Addr(ProtoTCP).String())
+
+	for _, proto := range []string{"udp", "tcp"} {
+		addr := udpAddr.String()
+		if proto == "tcp" {
+			addr = tcpAddr.String()
+		}
+
+		conn, err := dns.Dial(proto, addr)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		sendTestMessages(t, conn)
+	}
+}
+
+func TestConfig_validateListenRebind(t *testing.T) {
+	assert.NoError(t, (&Config{}).validateListenRebind())
+
+	c := &Config{ListenRebindInterval: -time.Second}
+	testutil.AssertErrorMsg(t, "negative interval", c.validateListenRebind())
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/bruceluk/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// LookupResult is the result of a typed lookup, such as [Proxy.LookupA].
+type LookupResult[T any] struct {
+	// Records are the records of the requested type from the answer section.
+	// The records of other types, e.g. CNAME, are omitted.
+	Records []T
+
+	// Upstream is the address of the upstream, which has resolved the request
+	// or which the cached response has been received from.  It's empty if the
+	// response has been generated by the proxy itself.
+	Upstream string
+
+	// Rcode is the response code.  Records are empty if it's not
+	// [dns.RcodeSuccess].
+	Rcode int
+
+	// Cached is true if the response has been served from the cache.
+	Cached bool
+}
+
+// AddrRecord is an A or AAAA record.
+type AddrRecord struct {
+	// Addr is the IP address.
+	Addr netip.Addr
+
+	// TTL is the time-to-live of the record.
+	TTL time.Duration
+}
+
+// TXTRecord is a TXT record.
+type TXTRecord struct {
+	// Text are the character strings of the record.
+	Text []string
+
+	// TTL is the time-to-live of the record.
+	TTL time.Duration
+}
+
+// SRVRecord is an SRV record.
+type SRVRecord struct {
+	// Target is the domain name of the target host.
+	Target string
+
+	// TTL is the time-to-live of the record.
+	TTL time.Duration
+
+	// Priority is the priority of the target host, lower values are
+	// preferred.
+	Priority uint16
+
+	// Weight is the relative weight among the targets with the same priority.
+	Weight uint16
+
+	// Port is the port of the service on the target host.
+	Port uint16
+}
+
+// HTTPSRecord is an HTTPS record.  Only the commonly used parameters are
+// parsed.
+type HTTPSRecord struct {
+	// Target is the domain name of the alternative endpoint.  It's "." if the
+	// endpoint is the owner name itself.
+	Target string
+
+	// ALPN are the protocol identifiers supported by the endpoint.
+	ALPN []string
+
+	// IPv4Hints are the IPv4 addresses of the endpoint.
+	IPv4Hints []netip.Addr
+
+	// IPv6Hints are the IPv6 addresses of the endpoint.
+	IPv6Hints []netip.Addr
+
+	// TTL is the time-to-live of the record.
+	TTL time.Duration
+
+	// Priority is the priority of the record, zero means the alias mode.
+	Priority uint16
+
+	// Port is the alternative port of the endpoint, if any.
+	Port uint16
+}
+
+// LookupA resolves the IPv4 addresses of name.
+func (p *Proxy) LookupA(
+	ctx context.Context,
+	name string,
+) (res *LookupResult[AddrRecord], err error) {
+	return lookupRecords(ctx, p, name, dns.TypeA, addrRecordFromRR)
+}
+
+// LookupAAAA resolves the IPv6 addresses of name.
+func (p *Proxy) LookupAAAA(
+	ctx context.Context,
+	name string,
+) (res *LookupResult[AddrRecord], err error) {
+	return lookupRecords(ctx, p, name, dns.TypeAAAA, addrRecordFromRR)
+}
+
+// LookupTXT resolves the TXT records of name.
+func (p *Proxy) LookupTXT(
+	ctx context.Context,
+	name string,
+) (res *LookupResult[TXTRecord], err error) {
+	return lookupRecords(ctx, p, name, dns.TypeTXT, func(rr dns.RR) (rec TXTRecord, ok bool) {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			return TXTRecord{}, false
+		}
+
+		return TXTRecord{Text: txt.Txt, TTL: rrTTL(rr)}, true
+	})
+}
+
+// LookupSRV resolves the SRV records of name, e.g. "_sip._udp.example.org".
+func (p *Proxy) LookupSRV(
+	ctx context.Context,
+	name string,
+) (res *LookupResult[SRVRecord], err error) {
+	return lookupRecords(ctx, p, name, dns.TypeSRV, func(rr dns.RR) (rec SRVRecord, ok bool) {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			return SRVRecord{}, false
+		}
+
+		return SRVRecord{
+			Target:   srv.Target,
+			TTL:      rrTTL(rr),
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+			Port:     srv.Port,
+		}, true
+	})
+}
+
+// LookupHTTPS resolves the HTTPS records of name.
+func (p *Proxy) LookupHTTPS(
+	ctx context.Context,
+	name string,
+) (res *LookupResult[HTTPSRecord], err error) {
+	return lookupRecords(ctx, p, name, dns.TypeHTTPS, httpsRecordFromRR)
+}
+
+// errNoResponse is returned by [lookupRecords] when the request is resolved
+// without a response.
+const errNoResponse errors.Error = "no response"
+
+// lookupRecords resolves the records of qtype for name with p and converts
+// the ones conv accepts.  It returns early if ctx is canceled, but the request
+// itself is still resolved in the background.
+func lookupRecords[T any](
+	ctx context.Context,
+	p *Proxy,
+	name string,
+	qtype uint16,
+	conv func(rr dns.RR) (rec T, ok bool),
+) (res *LookupResult[T], err error) {
+	if name == "" {
+		return nil, ErrEmptyHost
+	}
+
+	req := (&dns.Msg{}).SetQuestion(dns.Fqdn(name), qtype)
+	dctx := p.newDNSContext(ProtoUDP, req)
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer log.OnPanic("dnsproxy: looking up records")
+
+		errCh <- p.Resolve(dctx)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case err = <-errCh:
+		// Go on.
+	}
+
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	} else if dctx.Res == nil {
+		return nil, errNoResponse
+	}
+
+	res = &LookupResult[T]{
+		Upstream: dctx.CachedUpstreamAddr,
+		Rcode:    dctx.Res.Rcode,
+		Cached:   dctx.CachedUpstreamAddr != "",
+	}
+
+	if dctx.Upstream != nil {
+		res.Upstream = dctx.Upstream.Address()
+	}
+
+	if res.Rcode != dns.RcodeSuccess {
+		return res, nil
+	}
+
+	for _, rr := range dctx.Res.Answer {
+		if rec, ok := conv(rr); ok {
+			res.Records = append(res.Records, rec)
+		}
+	}
+
+	return res, nil
+}
+
+// rrTTL returns the TTL of rr as a duration.
+func rrTTL(rr dns.RR) (ttl time.Duration) {
+	return time.Duration(rr.Header().Ttl) * time.Second
+}
+
+// addrRecordFromRR converts an A or AAAA record into an [AddrRecord].
+func addrRecordFromRR(rr dns.RR) (rec AddrRecord, ok bool) {
+	addr := proxyutil.IPFromRR(rr)
+	if !addr.IsValid() {
+		return AddrRecord{}, false
+	}
+
+	return AddrRecord{Addr: addr, TTL: rrTTL(rr)}, true
+}
+
+// httpsRecordFromRR converts an HTTPS record into an [HTTPSRecord].
+func httpsRecordFromRR(rr dns.RR) (rec HTTPSRecord, ok bool) {
+	https, ok := rr.(*dns.HTTPS)
+	if !ok {
+		return HTTPSRecord{}, false
+	}
+
+	rec = HTTPSRecord{
+		Target:   https.Target,
+		TTL:      rrTTL(rr),
+		Priority: https.Priority,
+	}
+
+	for _, kv := range https.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBAlpn:
+			rec.ALPN = kv.Alpn
+		case *dns.SVCBPort:
+			rec.Port = kv.Port
+		case *dns.SVCBIPv4Hint:
+			rec.IPv4Hints = appendHintAddrs(rec.IPv4Hints, kv.Hint)
+		case *dns.SVCBIPv6Hint:
+			rec.IPv6Hints = appendHintAddrs(rec.IPv6Hints, kv.Hint)
+		default:
+			// Skip the other parameters.
+		}
+	}
+
+	return rec, true
+}
+
+// appendHintAddrs appends the valid addresses from ips to addrs.
+func appendHintAddrs(addrs []netip.Addr, ips []net.IP) (res []netip.Addr) {
+	res = addrs
+	for _, ip := range ips {
+		addr, err := netutil.IPToAddrNoMapped(ip)
+		if err == nil {
+			res = append(res, addr)
+		}
+	}
+
+	return res
+}
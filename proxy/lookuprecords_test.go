@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_LookupRecords(t *testing.T) {
+	const (
+		host    = "example.org."
+		upsAddr = "upstream"
+	)
+
+	records := map[uint16][]string{
+		dns.TypeA: {
+			host + " 60 IN CNAME cdn.example.org.",
+			"cdn.example.org. 30 IN A 192.0.2.1",
+		},
+		dns.TypeAAAA: {host + " 60 IN AAAA 2001:db8::1"},
+		dns.TypeTXT:  {host + ` 60 IN TXT "v=spf1" "-all"`},
+		dns.TypeSRV:  {host + " 60 IN SRV 10 5 5060 sip.example.org."},
+		dns.TypeHTTPS: {
+			host + ` 60 IN HTTPS 1 . alpn="h3,h2" port=8443 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1`,
+		},
+	}
+
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			for _, s := range records[req.Question[0].Qtype] {
+				rr, rrErr := dns.NewRR(s)
+				if rrErr != nil {
+					return nil, rrErr
+				}
+
+				resp.Answer = append(resp.Answer, rr)
+			}
+
+			if req.Question[0].Name != host {
+				resp.Rcode = dns.RcodeNameError
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return upsAddr },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: defaultCacheSize,
+	})
+
+	ctx := context.Background()
+
+	t.Run("a", func(t *testing.T) {
+		res, err := p.LookupA(ctx, "example.org")
+		require.NoError(t, err)
+
+		assert.Equal(t, &LookupResult[AddrRecord]{
+			Records: []AddrRecord{{
+				Addr: netip.MustParseAddr("192.0.2.1"),
+				TTL:  30 * time.Second,
+			}},
+			Upstream: upsAddr,
+			Rcode:    dns.RcodeSuccess,
+			Cached:   false,
+		}, res)
+
+		res, err = p.LookupA(ctx, "example.org")
+		require.NoError(t, err)
+
+		assert.True(t, res.Cached)
+		assert.Equal(t, upsAddr, res.Upstream)
+		require.Len(t, res.Records, 1)
+	})
+
+	t.Run("aaaa", func(t *testing.T) {
+		res, err := p.LookupAAAA(ctx, "example.org")
+		require.NoError(t, err)
+
+		assert.Equal(t, []AddrRecord{{
+			Addr: netip.MustParseAddr("2001:db8::1"),
+			TTL:  time.Minute,
+		}}, res.Records)
+	})
+
+	t.Run("txt", func(t *testing.T) {
+		res, err := p.LookupTXT(ctx, "example.org")
+		require.NoError(t, err)
+
+		assert.Equal(t, []TXTRecord{{
+			Text: []string{"v=spf1", "-all"},
+			TTL:  time.Minute,
+		}}, res.Records)
+	})
+
+	t.Run("srv", func(t *testing.T) {
+		res, err := p.LookupSRV(ctx, "example.org")
+		require.NoError(t, err)
+
+		assert.Equal(t, []SRVRecord{{
+			Target:   "sip.example.org.",
+			TTL:      time.Minute,
+			Priority: 10,
+			Weight:   5,
+			Port:     5060,
+		}}, res.Records)
+	})
+
+	t.Run("https", func(t *testing.T) {
+		res, err := p.LookupHTTPS(ctx, "example.org")
+		require.NoError(t, err)
+
+		assert.Equal(t, []HTTPSRecord{{
+			Target:    ".",
+			ALPN:      []string{"h3", "h2"},
+			IPv4Hints: []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+			IPv6Hints: []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+			TTL:       time.Minute,
+			Priority:  1,
+			Port:      8443,
+		}}, res.Records)
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		res, err := p.LookupA(ctx, "nonexistent.example")
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeNameError, res.Rcode)
+		assert.Empty(t, res.Records)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		_, err := p.LookupA(ctx, "")
+		assert.ErrorIs(t, err, ErrEmptyHost)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := p.LookupA(canceledCtx, "example.org")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
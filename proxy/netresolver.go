@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// NetResolver returns a resolver from the standard library, which resolves all
+// the lookups through p, so that Go programs can use the proxied resolution for
+// their own dials, e.g. by setting it to [net.Dialer.Resolver].  The network
+// and the address of the configured nameservers are ignored.
+func (p *Proxy) NetResolver() (r *net.Resolver) {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial:     p.dialNetResolver,
+	}
+}
+
+// dialNetResolver implements the [net.Resolver.Dial] hook for *Proxy.  It
+// returns one end of the in-memory connection, the requests written to which
+// are resolved by p.  The returned connection isn't a [net.PacketConn], so the
+// resolver uses the TCP framing for messages.
+func (p *Proxy) dialNetResolver(_ context.Context, _, _ string) (conn net.Conn, err error) {
+	conn, srvConn := net.Pipe()
+
+	go p.serveNetResolverConn(srvConn)
+
+	return conn, nil
+}
+
+// serveNetResolverConn resolves the requests read from conn and writes the
+// responses back until the other end of it is closed.
+func (p *Proxy) serveNetResolverConn(conn net.Conn) {
+	defer log.OnPanic("dnsproxy: serving net resolver")
+
+	dnsConn := &dns.Conn{Conn: conn}
+	defer func() {
+		err := dnsConn.Close()
+		if err != nil {
+			log.Debug("dnsproxy: closing net resolver conn: %s", err)
+		}
+	}()
+
+	for {
+		req, err := dnsConn.ReadMsg()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				log.Debug("dnsproxy: reading net resolver request: %s", err)
+			}
+
+			return
+		}
+
+		err = dnsConn.WriteMsg(p.resolveForNetResolver(req))
+		if err != nil {
+			log.Debug("dnsproxy: writing net resolver response: %s", err)
+
+			return
+		}
+	}
+}
+
+// resolveForNetResolver resolves req with p and returns the response, which is
+// never nil.
+func (p *Proxy) resolveForNetResolver(req *dns.Msg) (resp *dns.Msg) {
+	dctx := p.newDNSContext(ProtoTCP, req)
+	err := p.Resolve(dctx)
+	if err != nil {
+		log.Debug("dnsproxy: net resolver: resolving: %s", err)
+	}
+
+	resp = dctx.Res
+	if resp == nil {
+		return p.messages.NewMsgSERVFAIL(req)
+	}
+
+	// The resolver from the standard library requires the ID of the response to
+	// match the request's one.
+	resp.Id = req.Id
+
+	return resp
+}
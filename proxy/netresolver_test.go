@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_NetResolver(t *testing.T) {
+	const host = "resolver.example."
+
+	wantAddr := netip.MustParseAddr("192.0.2.1")
+
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+
+			q := req.Question[0]
+			switch {
+			case q.Name != host:
+				resp.Rcode = dns.RcodeNameError
+			case q.Qtype == dns.TypeA:
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					A: wantAddr.AsSlice(),
+				})
+			default:
+				// Go on.
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: defaultCacheSize,
+	})
+
+	r := p.NetResolver()
+	ctx := context.Background()
+
+	t.Run("success", func(t *testing.T) {
+		// Resolve twice to check the cached responses as well.
+		for range 2 {
+			addrs, err := r.LookupNetIP(ctx, "ip", host)
+			require.NoError(t, err)
+
+			assert.Equal(t, []netip.Addr{wantAddr}, addrs)
+		}
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		_, err := r.LookupNetIP(ctx, "ip4", "nonexistent.example.")
+
+		dnsErr := &net.DNSError{}
+		require.ErrorAs(t, err, &dnsErr)
+
+		assert.True(t, dnsErr.IsNotFound)
+	})
+}
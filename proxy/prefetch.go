@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// defaultPrefetchMaxConcurrent is the default maximum number of the
+	// prefetches running at once, see [Config.CachePrefetchMaxConcurrent].
+	defaultPrefetchMaxConcurrent = 10
+
+	// prefetchMaxKeys is the maximum number of the cache keys tracked at once,
+	// so that the requests for the random names don't make the tracking take
+	// too much memory.
+	prefetchMaxKeys = 10_000
+
+	// prefetchMinTTL is the remaining TTL in seconds below which a popular
+	// cached response is refreshed.
+	prefetchMinTTL = 30
+
+	// prefetchTTLDivisor defines the share of the initial TTL of a popular
+	// cached response, below which the remaining TTL makes it refreshed.
+	prefetchTTLDivisor = 10
+)
+
+// prefetchStats is the popularity of a cached response within its lifetime.
+type prefetchStats struct {
+	// expire is the expiration time of the cached response.
+	expire time.Time
+
+	// initialTTL is the TTL of the cached response at its first hit.
+	initialTTL uint32
+
+	// hits is the number of the hits of the cached response.
+	hits uint
+
+	// prefetched is true if the cached response has already been refreshed.
+	prefetched bool
+}
+
+// prefetcher tracks the hits of the cached responses and decides when the
+// popular ones should be refreshed before they expire, so that the requests
+// for them never miss the cache.  It's safe for concurrent use.
+type prefetcher struct {
+	// mu protects stats.
+	mu *sync.Mutex
+
+	// stats are the popularities of the cached responses by their
+	// hex-encoded cache keys.
+	stats map[string]*prefetchStats
+
+	// slots limits the number of the prefetches running at once.
+	slots chan unit
+
+	// hits is the number of hits after which a cached response is considered
+	// popular.
+	hits uint
+}
+
+// newPrefetcher returns a new properly initialized *prefetcher or nil if the
+// prefetching is disabled in c.
+func newPrefetcher(c *Config) (p *prefetcher) {
+	if c.CachePrefetchHits == 0 {
+		return nil
+	}
+
+	maxConcurrent := c.CachePrefetchMaxConcurrent
+	if maxConcurrent == 0 {
+		maxConcurrent = defaultPrefetchMaxConcurrent
+	}
+
+	return &prefetcher{
+		mu:    &sync.Mutex{},
+		stats: map[string]*prefetchStats{},
+		slots: make(chan unit, maxConcurrent),
+		hits:  c.CachePrefetchHits,
+	}
+}
+
+// hit records a hit of the cached response with key and the remaining ttl in
+// seconds.  It returns true if the response should be refreshed now, in which
+// case the caller must call [prefetcher.done] once it's refreshed.
+func (p *prefetcher) hit(key []byte, ttl uint32, now time.Time) (ok bool) {
+	k := hex.EncodeToString(key)
+	expire := now.Add(time.Duration(ttl) * time.Second)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.stats[k]
+	if s == nil || expire.Sub(s.expire) > time.Second {
+		// The response has been cached again since the last hit, so start
+		// counting anew.
+		if s == nil && !p.reserve(now) {
+			return false
+		}
+
+		s = &prefetchStats{
+			expire:     expire,
+			initialTTL: ttl,
+		}
+		p.stats[k] = s
+	}
+
+	s.hits++
+	if s.prefetched || s.hits < p.hits {
+		return false
+	} else if ttl >= prefetchMinTTL && ttl > s.initialTTL/prefetchTTLDivisor {
+		return false
+	}
+
+	select {
+	case p.slots <- unit{}:
+		s.prefetched = true
+
+		return true
+	default:
+		log.Debug("dnsproxy: prefetch: too many prefetches; skipping")
+
+		return false
+	}
+}
+
+// done releases the slot taken by the prefetch of the response with key and
+// starts counting its hits anew, since it's been refreshed.
+func (p *prefetcher) done(key []byte) {
+	defer func() { <-p.slots }()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.stats, hex.EncodeToString(key))
+}
+
+// reserve returns true if there is space for another key, removing the ones of
+// the expired responses if needed.  p.mu must be locked.
+func (p *prefetcher) reserve(now time.Time) (ok bool) {
+	if len(p.stats) < prefetchMaxKeys {
+		return true
+	}
+
+	for k, s := range p.stats {
+		if !now.Before(s.expire) {
+			delete(p.stats, k)
+		}
+	}
+
+	return len(p.stats) < prefetchMaxKeys
+}
+
+// prefetch refreshes the cached response to the request from d with key in a
+// separate goroutine if it's popular and about to expire.  ttl is the
+// remaining TTL of the response in seconds.
+func (p *Proxy) prefetch(d *DNSContext, key []byte, ttl uint32) {
+	if p.prefetcher == nil || !p.prefetcher.hit(key, ttl, p.time.Now()) {
+		return
+	}
+
+	log.Debug("dnsproxy: prefetch: refreshing response with ttl %d", ttl)
+
+	dctx := cloneForRefresh(d)
+	go func() {
+		defer p.prefetcher.done(key)
+
+		p.shortFlighter.ResolveOnce(dctx, key)
+	}()
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetcher_hit(t *testing.T) {
+	p := newPrefetcher(&Config{
+		CachePrefetchHits:          3,
+		CachePrefetchMaxConcurrent: 1,
+	})
+	require.NotNil(t, p)
+
+	key := []byte("key")
+	otherKey := []byte("other")
+	now := time.Now()
+
+	// The response isn't popular yet.
+	assert.False(t, p.hit(key, 1000, now))
+	assert.False(t, p.hit(key, 990, now.Add(10*time.Second)))
+
+	// The response is popular, but more than 10% of its TTL remains.
+	assert.False(t, p.hit(key, 500, now.Add(500*time.Second)))
+
+	// The response is about to expire.
+	assert.True(t, p.hit(key, 90, now.Add(910*time.Second)))
+
+	// It's only refreshed once.
+	assert.False(t, p.hit(key, 80, now.Add(920*time.Second)))
+
+	// Too many prefetches are running.
+	for range 3 {
+		assert.False(t, p.hit(otherKey, 10, now))
+	}
+
+	p.done(key)
+
+	assert.True(t, p.hit(otherKey, 10, now))
+
+	// The refreshed response is counted anew.
+	assert.False(t, p.hit(key, 1000, now.Add(920*time.Second)))
+
+	assert.Nil(t, newPrefetcher(&Config{}))
+}
+
+func TestProxy_Resolve_prefetch(t *testing.T) {
+	const host = "popular.example."
+
+	var exchanges atomic.Uint32
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   host,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    10,
+				},
+				A: net.IP{192, 0, 2, 1},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr:     []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:    &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:    defaultTrustedProxies,
+		CacheEnabled:      true,
+		CachePrefetchHits: 2,
+	})
+
+	resolve := func(t *testing.T) {
+		t.Helper()
+
+		dctx := &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion(host, dns.TypeA),
+			Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+		require.Len(t, dctx.Res.Answer, 1)
+	}
+
+	resolve(t)
+	resolve(t)
+	assert.Equal(t, uint32(1), exchanges.Load())
+
+	// The second hit makes the response popular, and it's refreshed, since its
+	// TTL is less than 30 seconds.
+	resolve(t)
+	assert.Eventually(t, func() (ok bool) {
+		return exchanges.Load() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// The refreshed response isn't refreshed again until it's popular again.
+	assert.Eventually(t, func() (ok bool) {
+		return len(p.prefetcher.slots) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	resolve(t)
+	assert.Equal(t, uint32(2), exchanges.Load())
+}
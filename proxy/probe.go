@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// validateProbe returns an error if the latency probing configuration of c is
+// invalid.
+func (c *Config) validateProbe() (err error) {
+	if c.ProbeInterval < 0 {
+		return errors.Error("negative interval")
+	}
+
+	if c.ProbeDomain == "" {
+		return nil
+	}
+
+	err = netutil.ValidateDomainName(strings.TrimSuffix(c.ProbeDomain, "."))
+	if err != nil {
+		return fmt.Errorf("domain: %w", err)
+	}
+
+	return nil
+}
+
+// probeUpstreams probes all the upstreams of p each [Config.ProbeInterval]
+// until stop is closed.  It's intended to be used as a goroutine.
+func (p *Proxy) probeUpstreams(stop <-chan struct{}) {
+	defer log.OnPanic("dnsproxy: probing upstreams")
+
+	ticker := time.NewTicker(p.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.probeOnce()
+		}
+	}
+}
+
+// probeOnce sends a probe to each upstream of p in parallel, updates their
+// round-trip time statistics, and waits for all of them to finish.
+func (p *Proxy) probeOnce() {
+	ups := p.allUpstreams()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(len(ups))
+	for _, u := range ups {
+		go p.probe(u, wg)
+	}
+
+	wg.Wait()
+}
+
+// probe sends a probe to u and updates its round-trip time statistics.  The
+// failed probes are accounted just like the failed requests.  It's intended to
+// be used as a goroutine.
+func (p *Proxy) probe(u upstream.Upstream, wg *sync.WaitGroup) {
+	defer log.OnPanic("dnsproxy: probing upstream")
+	defer wg.Done()
+
+	req := p.newProbeRequest()
+	addr := u.Address()
+
+	start := p.time.Now()
+	_, err := u.Exchange(req)
+	elapsed := p.time.Now().Sub(start)
+
+	switch {
+	case err == nil:
+		p.updateRTT(addr, elapsed)
+	case errors.Is(err, upstream.ErrIterativeQType):
+		// The iterative resolver can't be probed with the default request,
+		// don't account it.
+	default:
+		log.Debug("dnsproxy: probing %s: %s", addr, err)
+
+		p.updateRTT(addr, defaultTimeout)
+	}
+}
+
+// newProbeRequest returns a new request to probe the upstreams with.  It's a
+// request for the A records of [Config.ProbeDomain], if set, or for the root
+// name servers otherwise.
+func (p *Proxy) newProbeRequest() (req *dns.Msg) {
+	if p.ProbeDomain == "" {
+		return (&dns.Msg{}).SetQuestion(".", dns.TypeNS)
+	}
+
+	return (&dns.Msg{}).SetQuestion(dns.Fqdn(p.ProbeDomain), dns.TypeA)
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_probeUpstreams(t *testing.T) {
+	const probeDomain = "probe.example"
+
+	var probed atomic.Uint32
+	var badQuestion atomic.Bool
+	ok := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			q := req.Question[0]
+			if q.Name != probeDomain+"." || q.Qtype != dns.TypeA {
+				badQuestion.Store(true)
+			}
+
+			probed.Add(1)
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "ok" },
+		onClose:   func() (err error) { return nil },
+	}
+	failing := &fakeUpstream{
+		onExchange: func(_ *dns.Msg) (resp *dns.Msg, err error) {
+			return nil, errors.Error("test error")
+		},
+		onAddress: func() (addr string) { return "failing" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ok, failing},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		ProbeInterval:  10 * time.Millisecond,
+		ProbeDomain:    probeDomain,
+	})
+
+	ctx := context.Background()
+	err := p.Start(ctx)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() (done bool) {
+		return probed.Load() >= 2
+	}, time.Second, 10*time.Millisecond)
+
+	err = p.Shutdown(ctx)
+	require.NoError(t, err)
+
+	assert.False(t, badQuestion.Load())
+
+	p.rttLock.Lock()
+	defer p.rttLock.Unlock()
+
+	okStats, failingStats := p.upstreamRTTStats["ok"], p.upstreamRTTStats["failing"]
+	assert.Positive(t, okStats.reqNum)
+	assert.Positive(t, failingStats.reqNum)
+
+	// The failed probes are accounted with the default timeout.
+	assert.Equal(t, float64(defaultTimeout.Microseconds()), failingStats.rttSum/failingStats.reqNum)
+	assert.Less(t, okStats.rttSum/okStats.reqNum, float64(defaultTimeout.Microseconds()))
+}
+
+func TestConfig_validateProbe(t *testing.T) {
+	testCases := []struct {
+		name       string
+		domain     string
+		wantErrMsg string
+		interval   time.Duration
+	}{{
+		name:       "disabled",
+		domain:     "",
+		wantErrMsg: "",
+		interval:   0,
+	}, {
+		name:       "valid",
+		domain:     "probe.example.",
+		wantErrMsg: "",
+		interval:   time.Second,
+	}, {
+		name:       "negative",
+		domain:     "",
+		wantErrMsg: "negative interval",
+		interval:   -time.Second,
+	}, {
+		name:   "bad_domain",
+		domain: "!!!",
+		wantErrMsg: `domain: bad domain name "!!!": bad top-level domain name ` +
+			`label "!!!": bad top-level domain name label rune '!'`,
+		interval: time.Second,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Config{
+				ProbeInterval: tc.interval,
+				ProbeDomain:   tc.domain,
+			}
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, c.validateProbe())
+		})
+	}
+}
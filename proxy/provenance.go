@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+)
+
+// Source is the source of the response to a request.
+type Source uint8
+
+const (
+	// SourceNone means that there is no response yet.
+	SourceNone Source = iota
+
+	// SourceUpstream means that the response has been received from one of
+	// the upstreams.
+	SourceUpstream
+
+	// SourceFallback means that the response has been received from one of
+	// the fallback upstreams, since the upstreams have failed.
+	SourceFallback
+
+	// SourceCache means that the response has been taken from the cache.
+	SourceCache
+
+	// SourceLocal means that the response has been generated by the proxy
+	// itself or by a handler, e.g. for an invalid request or when all the
+	// upstreams have failed.
+	SourceLocal
+)
+
+// String implements the [fmt.Stringer] interface for Source.
+func (s Source) String() (str string) {
+	switch s {
+	case SourceNone:
+		return "none"
+	case SourceUpstream:
+		return "upstream"
+	case SourceFallback:
+		return "fallback"
+	case SourceCache:
+		return "cache"
+	case SourceLocal:
+		return "local"
+	default:
+		return fmt.Sprintf("!bad_source_%d", uint8(s))
+	}
+}
+
+// Provenance describes where the response to a request has come from.
+type Provenance struct {
+	// UpstreamAddr is the address of the upstream that has resolved the
+	// request.  For [SourceCache] it's the address of the upstream the
+	// response has been cached with.  It's empty if no upstream has responded.
+	UpstreamAddr string
+
+	// UpstreamProto is the protocol of the upstream that has resolved the
+	// request, e.g. "udp", "tls", or "https".  It's empty if UpstreamAddr is.
+	UpstreamProto string
+
+	// RTT is the total time spent exchanging with the upstreams, including the
+	// failed attempts and the fallback upstreams.
+	RTT time.Duration
+
+	// Attempts is the number of the upstreams, including the fallback ones,
+	// the request has been sent to.
+	Attempts int
+
+	// Source is the source of the response.
+	Source Source
+
+	// Stale is true if the response has been taken from the cache after its
+	// expiration, see [Config.CacheOptimistic].  It's only set for
+	// [SourceCache].
+	Stale bool
+}
+
+// String implements the [fmt.Stringer] interface for Provenance.
+func (prov Provenance) String() (s string) {
+	switch prov.Source {
+	case SourceUpstream, SourceFallback:
+		return fmt.Sprintf(
+			"%s %s in %d attempts, rtt %s",
+			prov.Source,
+			prov.UpstreamAddr,
+			prov.Attempts,
+			prov.RTT,
+		)
+	case SourceCache:
+		if prov.Stale {
+			return fmt.Sprintf("stale cache of %s", prov.UpstreamAddr)
+		}
+
+		return fmt.Sprintf("cache of %s", prov.UpstreamAddr)
+	default:
+		return prov.Source.String()
+	}
+}
+
+// setUpstream sets the upstream address and protocol of prov from u.  It does
+// nothing if u is nil.
+func (prov *Provenance) setUpstream(u upstream.Upstream) {
+	if u == nil {
+		return
+	}
+
+	prov.setUpstreamAddr(u.Address())
+}
+
+// setUpstreamAddr sets the upstream address and protocol of prov from addr as
+// returned by [upstream.Upstream.Address].
+func (prov *Provenance) setUpstreamAddr(addr string) {
+	prov.UpstreamAddr = addr
+	if addr == "" {
+		prov.UpstreamProto = ""
+
+		return
+	}
+
+	// Plain DNS-over-UDP upstreams have no scheme in their addresses.
+	prov.UpstreamProto = "udp"
+	if scheme, _, ok := strings.Cut(addr, "://"); ok {
+		prov.UpstreamProto = scheme
+	}
+}
+
+// setLocalSource marks the response of d as generated locally if d has a
+// response of unknown source.
+func (d *DNSContext) setLocalSource() {
+	if d.Res != nil && d.Provenance.Source == SourceNone {
+		d.Provenance.Source = SourceLocal
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_provenance(t *testing.T) {
+	failing := &fakeUpstream{
+		onExchange: func(_ *dns.Msg) (resp *dns.Msg, err error) {
+			return nil, assert.AnError
+		},
+		onAddress: func() (addr string) { return "tls://failing.example" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	const fallbackAddr = "192.0.2.53:53"
+	fallback := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(m)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   m.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{192, 0, 2, 1},
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return fallbackAddr },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{failing},
+		},
+		Fallbacks: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{fallback},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+	})
+
+	newCtx := func() (d *DNSContext) {
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+		return p.newDNSContext(ProtoUDP, req)
+	}
+
+	t.Run("fallback", func(t *testing.T) {
+		d := newCtx()
+		require.NoError(t, p.Resolve(d))
+
+		prov := d.Provenance
+		assert.Equal(t, SourceFallback, prov.Source)
+		assert.Equal(t, fallbackAddr, prov.UpstreamAddr)
+		assert.Equal(t, "udp", prov.UpstreamProto)
+		assert.Equal(t, 2, prov.Attempts)
+		assert.Positive(t, prov.RTT)
+		assert.False(t, prov.Stale)
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		d := newCtx()
+		require.NoError(t, p.Resolve(d))
+
+		assert.Equal(t, Provenance{
+			UpstreamAddr:  fallbackAddr,
+			UpstreamProto: "udp",
+			Source:        SourceCache,
+		}, d.Provenance)
+	})
+
+	t.Run("local", func(t *testing.T) {
+		d := newCtx()
+		d.Res = p.messages.NewMsgNXDOMAIN(d.Req)
+		d.setLocalSource()
+
+		assert.Equal(t, Provenance{Source: SourceLocal}, d.Provenance)
+	})
+}
+
+func TestProvenance_setUpstreamAddr(t *testing.T) {
+	testCases := []struct {
+		name      string
+		addr      string
+		wantProto string
+	}{{
+		name:      "plain_udp",
+		addr:      "192.0.2.1:53",
+		wantProto: "udp",
+	}, {
+		name:      "tcp",
+		addr:      "tcp://192.0.2.1:53",
+		wantProto: "tcp",
+	}, {
+		name:      "https",
+		addr:      "https://dns.example/dns-query",
+		wantProto: "https",
+	}, {
+		name:      "empty",
+		addr:      "",
+		wantProto: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			prov := &Provenance{}
+			prov.setUpstreamAddr(tc.addr)
+
+			assert.Equal(t, tc.addr, prov.UpstreamAddr)
+			assert.Equal(t, tc.wantProto, prov.UpstreamProto)
+		})
+	}
+}
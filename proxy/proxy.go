@@ -15,6 +15,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/AdguardTeam/golibs/container"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -49,6 +50,13 @@ const (
 	ProtoTLS Proto = "tls"
 	// ProtoHTTPS is the DNS-over-HTTPS (DoH) protocol.
 	ProtoHTTPS Proto = "https"
+
+	// ProtoHTTP is the DNS-over-HTTPS protocol without TLS, which is expected
+	// to be terminated by a reverse proxy.
+	ProtoHTTP Proto = "http"
+
+	// ProtoGRPC is the DNS-over-gRPC protocol, see [Config.GRPCListenAddr].
+	ProtoGRPC Proto = "grpc"
 	// ProtoQUIC is the DNS-over-QUIC (DoQ) protocol.
 	ProtoQUIC Proto = "quic"
 	// ProtoDNSCrypt is the DNSCrypt protocol.
@@ -95,6 +103,19 @@ type Proxy struct {
 	// ratelimitBuckets is a storage for ratelimiters for individual IPs.
 	ratelimitBuckets *gocache.Cache
 
+	// handshakeLimiter limits the rate of new TLS handshakes.  It is nil if
+	// the limiting is disabled.
+	handshakeLimiter *handshakeLimiter
+
+	// topStats tracks the heaviest domains and clients.  It is nil if the
+	// tracking is disabled.
+	topStats *topStats
+
+	// crashGuard recovers the panics occurred while handling the requests and
+	// quarantines the requests causing them.  It is nil if the recovery is
+	// disabled.
+	crashGuard *crashGuard
+
 	// fastestAddr finds the fastest IP address for the resolved domain.
 	fastestAddr *fastip.FastestAddr
 
@@ -103,6 +124,14 @@ type Proxy struct {
 	// TODO(d.kolyshev): Move this cache to [Proxy.UpstreamConfig] field.
 	cache *cache
 
+	// nsecCache synthesizes the NXDOMAIN responses from the cached NSEC and
+	// NSEC3 records.  It is disabled if nil.
+	nsecCache *nsecCache
+
+	// prefetcher decides when the popular cached responses are refreshed.  It
+	// is disabled if nil.
+	prefetcher *prefetcher
+
 	// shortFlighter is used to resolve the expired cached requests without
 	// repetitions.
 	shortFlighter *optimisticResolver
@@ -147,6 +176,18 @@ type Proxy struct {
 	// httpsServer serves queries received over HTTPS.
 	httpsServer *http.Server
 
+	// httpListen are the listened plain HTTP connections.
+	httpListen []net.Listener
+
+	// httpServer serves queries received over plain HTTP.
+	httpServer *http.Server
+
+	// grpcListen are the listened DNS-over-gRPC connections.
+	grpcListen []net.Listener
+
+	// grpcServer serves queries received over gRPC.
+	grpcServer *http.Server
+
 	// h3Server serves queries received over HTTP/3.
 	h3Server *http3.Server
 
@@ -166,17 +207,119 @@ type Proxy struct {
 	// empty.
 	dns64Prefs netutil.SliceSubnetSet
 
+	// dns64ExclV6 is the set of IPv6 exclusion ranges, the AAAA answers within
+	// which are treated as absent by the DNS64 function.
+	dns64ExclV6 netutil.SliceSubnetSet
+
+	// dns64ExclV4 is the set of IPv4 exclusion ranges, the A answers within
+	// which aren't synthesized into AAAA ones by the DNS64 function.
+	dns64ExclV4 netutil.SliceSubnetSet
+
+	// ecsPolicies are the per-client EDNS Client Subnet policies sorted from
+	// the most specific subnet to the least specific one.
+	ecsPolicies []*ECSClientPolicy
+
+	// addrPreferences are the per-client address preferences sorted from the
+	// most specific subnet to the least specific one.
+	addrPreferences []*AddrClientPreference
+
 	// Config is the proxy configuration.
 	//
 	// TODO(a.garipov): Remove this embed and create a proper initializer.
 	Config
 
+	// virtualResolvers maps the lowercased server names to the DNS-over-TLS
+	// virtual resolvers.
+	virtualResolvers map[string]*VirtualResolver
+
+	// canaryDomains is the set of lowercased FQDNs answered with NXDOMAIN.
+	canaryDomains *container.MapSet[string]
+
+	// zeroTTLFloor raises the zero TTLs of the upstream responses for the
+	// configured domains.  It's nil if disabled.
+	zeroTTLFloor *zeroTTLFloor
+
+	// fastestDomains are the per-domain rules of the fastest address
+	// selection.  It's nil if there are none.
+	fastestDomains *fastestDomains
+
+	// selfHostname is the lowercased FQDN of [Config.SelfHostname].  It's empty
+	// if the requests for the proxy's own hostname aren't answered.
+	selfHostname string
+
+	// udpInflight tracks the UDP queries being resolved to handle the
+	// retransmissions.
+	udpInflight *udpInflight
+
+	// hedger hedges the requests to the slow upstreams.  It's nil if hedging
+	// is disabled.
+	hedger *hedger
+
+	// servFailBackoff suppresses the requests for the recently failed
+	// questions.  It's nil if the suppression is disabled.
+	servFailBackoff *servFailBackoff
+
+	// balancers order the upstreams in the balancing upstream modes.
+	balancers map[UpstreamModeType]UpstreamBalancer
+
+	// upstreamHealth ejects the failing upstreams.  It's nil if the health
+	// checks are disabled.
+	upstreamHealth *upstreamHealth
+
+	// anomalies collects the per-client statistics of the requests.  It's nil
+	// if the collection is disabled.
+	anomalies *anomalyDetector
+
+	// signer signs the locally generated responses.  It's nil if there are no
+	// signing keys.
+	signer *responseSigner
+
+	// dnssecValidator validates the DNSSEC signatures of the upstream
+	// responses.  It's nil if the validation is disabled.
+	dnssecValidator *dnssecValidator
+
+	// upstreamRouter routes the requests to the upstream groups.  It's nil if
+	// there are no upstream groups.
+	upstreamRouter *upstreamRouter
+
+	// probeStop stops probing the upstreams when closed.  It's nil if probing
+	// is disabled or the proxy isn't started.
+	probeStop chan struct{}
+
+	// healthStop stops checking the health of the upstreams when closed.  It's
+	// nil if the health checks are disabled or the proxy isn't started.
+	healthStop chan struct{}
+
+	// fastestFlushStop stops flushing the ping results of fastestAddr when
+	// closed.  It's nil if flushing is disabled or the proxy isn't started.
+	fastestFlushStop chan struct{}
+
+	// listenWatchStop stops watching the addresses of the listeners when
+	// closed.  It's nil if watching is disabled or the proxy isn't started.
+	listenWatchStop chan struct{}
+
+	// interfaceAddrs returns the addresses of the network interfaces to watch
+	// the addresses of the listeners.
+	interfaceAddrs interfaceAddrsFunc
+
 	// udpOOBSize is the size of the out-of-band data for UDP connections.
 	udpOOBSize int
 
 	// counter counts message contexts created with [Proxy.newDNSContext].
 	counter atomic.Uint64
 
+	// addrShuffleCounter counts the responses with the shuffled address
+	// records for [AddrShuffleRoundRobin].
+	addrShuffleCounter atomic.Uint64
+
+	// fastOpenAccepted counts the TCP connections accepted with the data
+	// within the SYN, see [Config.TCPFastOpen].
+	fastOpenAccepted atomic.Uint64
+
+	// quicECN counts the ECN marks of the packets received by the QUIC
+	// listeners, see [Proxy.QUICECNStats].
+	quicECN quicECNCounters
+
 	// RWMutex protects the whole proxy.
 	//
 	// TODO(e.burkov):  Find out what exactly it protects and name it properly.
@@ -191,6 +334,10 @@ type Proxy struct {
 	// TODO(e.burkov):  Make it a pointer.
 	rttLock sync.Mutex
 
+	// ready is closed when the proxy has been started.  It's replaced with a
+	// new channel on shutdown.
+	ready chan struct{}
+
 	// started indicates if the proxy has been started.
 	started bool
 }
@@ -223,11 +370,37 @@ func New(c *Config) (p *Proxy, err error) {
 		},
 		udpOOBSize: proxynetutil.UDPGetOOBSize(),
 		time:       realClock{},
+
+		interfaceAddrs: net.InterfaceAddrs,
 		messages: cmp.Or[MessageConstructor](
 			c.MessageConstructor,
 			defaultMessageConstructor{},
 		),
-		recDetector: newRecursionDetector(recursionTTL, cachedRecurrentReqNum),
+		recDetector:      newRecursionDetector(recursionTTL, cachedRecurrentReqNum),
+		handshakeLimiter: newHandshakeLimiter(c),
+		topStats:         newTopStats(c),
+		crashGuard:       newCrashGuard(c),
+		ecsPolicies:      sortECSPolicies(c.ECSPolicies),
+		addrPreferences:  sortAddrPreferences(c.AddrPreferences),
+		udpInflight:      newUDPInflight(),
+		hedger:           newHedger(c),
+		servFailBackoff:  newServFailBackoff(c),
+		balancers:        newUpstreamBalancers(c, nil),
+		upstreamHealth:   newUpstreamHealth(c),
+		anomalies:        newAnomalyDetector(c),
+		signer:           newResponseSigner(c),
+		dnssecValidator:  newDNSSECValidator(c),
+		canaryDomains:    newCanaryDomains(c.CanaryDomains),
+		fastestDomains:   newFastestDomains(c),
+		zeroTTLFloor:     newZeroTTLFloor(c),
+		selfHostname:     normalizeSelfHostname(c.SelfHostname),
+		virtualResolvers: newVirtualResolvers(c.VirtualResolvers),
+		ready:            make(chan struct{}),
+	}
+
+	err = p.initUpstreamRouter()
+	if err != nil {
+		return nil, fmt.Errorf("upstream groups: %w", err)
 	}
 
 	// TODO(e.burkov):  Validate config separately and add the contract to the
@@ -253,13 +426,10 @@ func New(c *Config) (p *Proxy, err error) {
 		p.requestsSema = syncutil.EmptySemaphore{}
 	}
 
-	if p.UpstreamMode == UModeFastestAddr {
+	if p.usesFastestAddr() {
 		log.Info("dnsproxy: fastest ip is enabled")
 
-		p.fastestAddr = fastip.NewFastestAddr()
-		if timeout := p.FastestPingTimeout; timeout > 0 {
-			p.fastestAddr.PingWaitTimeout = timeout
-		}
+		p.fastestAddr = p.newFastestAddr()
 	}
 
 	err = p.setupDNS64()
@@ -277,12 +447,19 @@ func New(c *Config) (p *Proxy, err error) {
 //
 // Deprecated:  Use the [New] function instead.
 func (p *Proxy) Init() (err error) {
+	err = p.initUpstreamRouter()
+	if err != nil {
+		return fmt.Errorf("upstream groups: %w", err)
+	}
+
 	// TODO(s.chzhen):  Consider moving to [Proxy.validateConfig].
 	err = p.validateBasicAuth()
 	if err != nil {
 		return fmt.Errorf("basic auth: %w", err)
 	}
 
+	// The cache of the NSEC records depends on the validator.
+	p.dnssecValidator = newDNSSECValidator(&p.Config)
 	p.initCache()
 
 	if p.MaxGoroutines > 0 {
@@ -294,6 +471,18 @@ func (p *Proxy) Init() (err error) {
 	}
 
 	p.udpOOBSize = proxynetutil.UDPGetOOBSize()
+	p.udpInflight = newUDPInflight()
+	p.hedger = newHedger(&p.Config)
+	p.servFailBackoff = newServFailBackoff(&p.Config)
+	p.balancers = newUpstreamBalancers(&p.Config, p.randSrc)
+	p.upstreamHealth = newUpstreamHealth(&p.Config)
+	p.anomalies = newAnomalyDetector(&p.Config)
+	p.signer = newResponseSigner(&p.Config)
+	p.canaryDomains = newCanaryDomains(p.CanaryDomains)
+	p.fastestDomains = newFastestDomains(&p.Config)
+	p.zeroTTLFloor = newZeroTTLFloor(&p.Config)
+	p.selfHostname = normalizeSelfHostname(p.SelfHostname)
+	p.virtualResolvers = newVirtualResolvers(p.VirtualResolvers)
 	p.bytesPool = &sync.Pool{
 		New: func() interface{} {
 			// 2 bytes may be used to store packet length (see TCP/TLS)
@@ -303,13 +492,10 @@ func (p *Proxy) Init() (err error) {
 		},
 	}
 
-	if p.UpstreamMode == UModeFastestAddr {
+	if p.usesFastestAddr() {
 		log.Info("dnsproxy: fastest ip is enabled")
 
-		p.fastestAddr = fastip.NewFastestAddr()
-		if timeout := p.FastestPingTimeout; timeout > 0 {
-			p.fastestAddr.PingWaitTimeout = timeout
-		}
+		p.fastestAddr = p.newFastestAddr()
 	}
 
 	err = p.setupDNS64()
@@ -321,6 +507,13 @@ func (p *Proxy) Init() (err error) {
 	slices.SortFunc(p.RatelimitWhitelist, netip.Addr.Compare)
 
 	p.time = realClock{}
+	p.interfaceAddrs = net.InterfaceAddrs
+	p.handshakeLimiter = newHandshakeLimiter(&p.Config)
+	p.topStats = newTopStats(&p.Config)
+	p.crashGuard = newCrashGuard(&p.Config)
+	p.ecsPolicies = sortECSPolicies(p.ECSPolicies)
+	p.addrPreferences = sortAddrPreferences(p.AddrPreferences)
+	p.ready = make(chan struct{})
 
 	return nil
 }
@@ -333,7 +526,7 @@ func (p *Proxy) validateBasicAuth() (err error) {
 		return nil
 	}
 
-	if len(conf.HTTPSListenAddr) == 0 {
+	if len(conf.HTTPSListenAddr) == 0 && len(conf.HTTPListenAddr) == 0 {
 		return errors.Error("no https addrs")
 	}
 
@@ -360,16 +553,159 @@ func (p *Proxy) Start(ctx context.Context) (err error) {
 		return err
 	}
 
+	f := p.cacheFile()
+	if f != nil {
+		err = f.start()
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+	}
+
 	err = p.startListeners(ctx)
 	if err != nil {
+		if f != nil {
+			err = errors.WithDeferred(err, f.Close())
+		}
+
 		return fmt.Errorf("starting listeners: %w", err)
 	}
 
 	p.started = true
+	close(p.ready)
+
+	if p.WarmUpUpstreams {
+		go p.warmUpUpstreams()
+	}
+
+	if p.ProbeInterval > 0 {
+		p.probeStop = make(chan struct{})
+		go p.probeUpstreams(p.probeStop)
+	}
+
+	if p.upstreamHealth != nil {
+		p.healthStop = make(chan struct{})
+		go p.checkUpstreams(p.healthStop)
+	}
+
+	if p.fastestAddr != nil && p.FastestCacheFile != "" && p.FastestCacheFlushInterval > 0 {
+		p.fastestFlushStop = make(chan struct{})
+		go p.flushFastestAddr(p.fastestFlushStop)
+	}
+
+	if ips := p.listenWatchIPs(); p.ListenRebindInterval > 0 && len(ips) > 0 {
+		p.listenWatchStop = make(chan struct{})
+		go p.watchListenAddrs(ips, p.listenWatchStop)
+	}
+
+	if f := p.ownFastestAddr(); f != nil {
+		f.Start()
+	}
 
 	return nil
 }
 
+// FastestAddrFinder returns the fastest address finder used by p, or nil if p
+// doesn't use [UModeFastestAddr].  It must only be called after p is
+// initialized.
+func (p *Proxy) FastestAddrFinder() (f *fastip.FastestAddr) {
+	return p.fastestAddr
+}
+
+// ownFastestAddr returns the fastest address finder created by p, which p is
+// responsible for starting and closing, or nil if there is none.
+func (p *Proxy) ownFastestAddr() (f *fastip.FastestAddr) {
+	if p.FastestAddr != nil {
+		return nil
+	}
+
+	return p.fastestAddr
+}
+
+// usesFastestAddr returns true if the fastest address selection is used for
+// any request.
+func (p *Proxy) usesFastestAddr() (ok bool) {
+	return p.UpstreamMode == UModeFastestAddr ||
+		p.upstreamRouter.usesFastestAddr() ||
+		len(p.FastestDomains) > 0
+}
+
+// newFastestAddr returns the fastest address finder for [UModeFastestAddr].
+func (p *Proxy) newFastestAddr() (f *fastip.FastestAddr) {
+	if p.FastestAddr != nil {
+		return p.FastestAddr
+	}
+
+	f = fastip.NewFastestAddr()
+	if timeout := p.FastestPingTimeout; timeout > 0 {
+		f.PingWaitTimeout = timeout
+	}
+
+	f.PingMode = p.FastestPingMode
+	f.PreferIPv6Within = p.FastestPreferIPv6Within
+	f.PortsByDomain = p.FastestPortsByDomain
+	if p.FastestProbeTLS {
+		f.Prober = &fastip.TCPProber{
+			Dialer:   &net.Dialer{},
+			ProbeTLS: true,
+		}
+	}
+
+	f.RefreshInterval = p.FastestRefreshInterval
+	f.RefreshConcurrency = p.FastestRefreshConcurrency
+	if p.FastestSampleWindow > 0 {
+		f.SampleWindow = p.FastestSampleWindow
+	}
+
+	f.Strategy = p.FastestStrategy
+	if window := p.FastestStrategyWindow; window > 0 {
+		f.StrategyWindow = window
+	}
+
+	f.CachePersistPath = p.FastestCacheFile
+
+	err := f.Load()
+	if err != nil {
+		log.Error("dnsproxy: loading fastest addr cache: %s", err)
+	}
+
+	if p.FastestMetrics != nil {
+		f.Metrics = p.FastestMetrics
+	}
+
+	return f
+}
+
+// flushFastestAddr periodically writes the ping results of p.fastestAddr to
+// the file until stop is closed.  It's intended to be used as a goroutine.
+func (p *Proxy) flushFastestAddr(stop <-chan struct{}) {
+	defer log.OnPanic("dnsproxy: flushing fastest addr cache")
+
+	ticker := time.NewTicker(p.FastestCacheFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := p.fastestAddr.Flush()
+			if err != nil {
+				log.Error("dnsproxy: flushing fastest addr cache: %s", err)
+			}
+		}
+	}
+}
+
+// cacheFile returns the file backing the cache of p or nil if there is none.
+func (p *Proxy) cacheFile() (f *cacheFile) {
+	if p.cache == nil {
+		return nil
+	}
+
+	return p.cache.file
+}
+
 // closeAll closes all closers and appends the occurred errors to errs.
 func closeAll[C io.Closer](errs []error, closers ...C) (appended []error) {
 	for _, c := range closers {
@@ -397,7 +733,39 @@ func (p *Proxy) Shutdown(_ context.Context) (err error) {
 		return nil
 	}
 
-	errs := closeAll(nil, p.tcpListen...)
+	if p.probeStop != nil {
+		close(p.probeStop)
+		p.probeStop = nil
+	}
+
+	if p.healthStop != nil {
+		close(p.healthStop)
+		p.healthStop = nil
+	}
+
+	if p.fastestFlushStop != nil {
+		close(p.fastestFlushStop)
+		p.fastestFlushStop = nil
+	}
+
+	if p.fastestAddr != nil {
+		err = p.fastestAddr.Flush()
+		if err != nil {
+			log.Error("dnsproxy: flushing fastest addr cache: %s", err)
+		}
+	}
+
+	if p.listenWatchStop != nil {
+		close(p.listenWatchStop)
+		p.listenWatchStop = nil
+	}
+
+	var errs []error
+	if f := p.ownFastestAddr(); f != nil {
+		errs = closeAll(errs, f)
+	}
+
+	errs = closeAll(errs, p.tcpListen...)
 	p.tcpListen = nil
 
 	errs = closeAll(errs, p.udpListen...)
@@ -414,6 +782,22 @@ func (p *Proxy) Shutdown(_ context.Context) (err error) {
 		p.httpsListen = nil
 	}
 
+	if p.httpServer != nil {
+		errs = closeAll(errs, p.httpServer)
+		p.httpServer = nil
+
+		// No need to close these since they're closed by httpServer.Close().
+		p.httpListen = nil
+	}
+
+	if p.grpcServer != nil {
+		errs = closeAll(errs, p.grpcServer)
+		p.grpcServer = nil
+
+		// No need to close these since they're closed by grpcServer.Close().
+		p.grpcListen = nil
+	}
+
 	if p.h3Server != nil {
 		errs = closeAll(errs, p.h3Server)
 		p.h3Server = nil
@@ -437,6 +821,12 @@ func (p *Proxy) Shutdown(_ context.Context) (err error) {
 	errs = closeAll(errs, p.dnsCryptTCPListen...)
 	p.dnsCryptTCPListen = nil
 
+	// Close the cache file after the listeners, so that it gets the responses
+	// to the last requests.
+	if f := p.cacheFile(); f != nil {
+		errs = closeAll(errs, f)
+	}
+
 	for _, u := range []*UpstreamConfig{
 		p.UpstreamConfig,
 		p.PrivateRDNSUpstreamConfig,
@@ -447,7 +837,12 @@ func (p *Proxy) Shutdown(_ context.Context) (err error) {
 		}
 	}
 
+	if p.upstreamRouter != nil {
+		errs = closeAll(errs, p.upstreamRouter.fallbackUpstreams()...)
+	}
+
 	p.started = false
+	p.ready = make(chan struct{})
 
 	log.Println("dnsproxy: stopped dns proxy server")
 
@@ -459,105 +854,73 @@ func (p *Proxy) Shutdown(_ context.Context) (err error) {
 }
 
 // Addrs returns all listen addresses for the specified proto or nil if the proxy does not listen to it.
-// proto must be "tcp", "tls", "https", "quic", or "udp"
+// proto must be "tcp", "tls", "https", "http", "grpc", "quic", "dnscrypt", or "udp"
 func (p *Proxy) Addrs(proto Proto) []net.Addr {
 	p.RLock()
 	defer p.RUnlock()
 
-	var addrs []net.Addr
-
 	switch proto {
 	case ProtoTCP:
-		for _, l := range p.tcpListen {
-			addrs = append(addrs, l.Addr())
-		}
-
+		return listenerAddrs(p.tcpListen)
 	case ProtoTLS:
-		for _, l := range p.tlsListen {
-			addrs = append(addrs, l.Addr())
-		}
-
+		return listenerAddrs(p.tlsListen)
 	case ProtoHTTPS:
-		for _, l := range p.httpsListen {
-			addrs = append(addrs, l.Addr())
-		}
-
+		return listenerAddrs(p.httpsListen)
+	case ProtoHTTP:
+		return listenerAddrs(p.httpListen)
+	case ProtoGRPC:
+		return listenerAddrs(p.grpcListen)
 	case ProtoUDP:
-		for _, l := range p.udpListen {
-			addrs = append(addrs, l.LocalAddr())
-		}
-
+		return connAddrs(p.udpListen)
 	case ProtoQUIC:
-		for _, l := range p.quicListen {
-			addrs = append(addrs, l.Addr())
-		}
-
+		return listenerAddrs(p.quicListen)
 	case ProtoDNSCrypt:
 		// Using only UDP addrs here
 		// TODO: to do it better we should either do ProtoDNSCryptTCP/ProtoDNSCryptUDP
 		// or we should change the configuration so that it was not possible to
 		// set different ports for TCP/UDP listeners.
-		for _, l := range p.dnsCryptUDPListen {
-			addrs = append(addrs, l.LocalAddr())
-		}
-
+		return connAddrs(p.dnsCryptUDPListen)
 	default:
-		panic("proto must be 'tcp', 'tls', 'https', 'quic', 'dnscrypt' or 'udp'")
+		panic("proto must be 'tcp', 'tls', 'https', 'http', 'grpc', 'quic', 'dnscrypt' or 'udp'")
 	}
-
-	return addrs
 }
 
-// Addr returns the first listen address for the specified proto or null if the proxy does not listen to it
-// proto must be "tcp", "tls", "https", "quic", or "udp"
-func (p *Proxy) Addr(proto Proto) net.Addr {
-	p.RLock()
-	defer p.RUnlock()
-	switch proto {
-	case ProtoTCP:
-		if len(p.tcpListen) == 0 {
-			return nil
-		}
-		return p.tcpListen[0].Addr()
-
-	case ProtoTLS:
-		if len(p.tlsListen) == 0 {
-			return nil
-		}
-		return p.tlsListen[0].Addr()
+// listenerAddrs returns the addresses of listeners.
+func listenerAddrs[T interface{ Addr() net.Addr }](listeners []T) (addrs []net.Addr) {
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr())
+	}
 
-	case ProtoHTTPS:
-		if len(p.httpsListen) == 0 {
-			return nil
-		}
-		return p.httpsListen[0].Addr()
+	return addrs
+}
 
-	case ProtoUDP:
-		if len(p.udpListen) == 0 {
-			return nil
-		}
-		return p.udpListen[0].LocalAddr()
+// connAddrs returns the local addresses of conns.
+func connAddrs(conns []*net.UDPConn) (addrs []net.Addr) {
+	for _, c := range conns {
+		addrs = append(addrs, c.LocalAddr())
+	}
 
-	case ProtoQUIC:
-		if len(p.quicListen) == 0 {
-			return nil
-		}
-		return p.quicListen[0].Addr()
+	return addrs
+}
 
-	case ProtoDNSCrypt:
-		if len(p.dnsCryptUDPListen) == 0 {
-			return nil
-		}
-		return p.dnsCryptUDPListen[0].LocalAddr()
-	default:
-		panic("proto must be 'tcp', 'tls', 'https', 'quic', 'dnscrypt' or 'udp'")
+// Addr returns the first listen address for the specified proto or null if the proxy does not listen to it
+// proto must be "tcp", "tls", "https", "http", "grpc", "quic", "dnscrypt", or "udp"
+func (p *Proxy) Addr(proto Proto) net.Addr {
+	addrs := p.Addrs(proto)
+	if len(addrs) == 0 {
+		return nil
 	}
+
+	return addrs[0]
 }
 
 // selectUpstreams returns the upstreams to use for the specified host.  It
-// firstly considers custom upstreams if those aren't empty and then the
-// configured ones.  The returned slice may be empty or nil.
-func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, isPrivate bool) {
+// firstly considers custom upstreams if those aren't empty, then the upstream
+// group the request is routed to, and then the configured ones.  g is the
+// group, if used.  The returned slice may be empty or nil.
+func (p *Proxy) selectUpstreams(
+	d *DNSContext,
+) (upstreams []upstream.Upstream, g *upstreamGroup, isPrivate bool) {
 	q := d.Req.Question[0]
 	host := q.Name
 
@@ -569,7 +932,7 @@ func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, i
 			upstreams = private.getUpstreamsForDomain(host)
 		}
 
-		return upstreams, true
+		return upstreams, nil, true
 	}
 
 	getUpstreams := (*UpstreamConfig).getUpstreamsForDomain
@@ -581,12 +944,18 @@ func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, i
 		// Try to use custom.
 		upstreams = getUpstreams(custom.upstream, host)
 		if len(upstreams) > 0 {
-			return upstreams, false
+			return upstreams, nil, false
 		}
 	}
 
+	if p.upstreamRouter != nil {
+		g = p.upstreamRouter.route(host, d.Addr.Addr())
+
+		return g.ups, g, false
+	}
+
 	// Use configured.
-	return getUpstreams(p.UpstreamConfig, host), false
+	return getUpstreams(p.UpstreamConfig, host), nil, false
 }
 
 // replyFromUpstream tries to resolve the request via configured upstream
@@ -594,9 +963,10 @@ func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, i
 func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 	req := d.Req
 
-	upstreams, isPrivate := p.selectUpstreams(d)
+	upstreams, group, isPrivate := p.selectUpstreams(d)
 	if len(upstreams) == 0 {
 		d.Res = p.messages.NewMsgNXDOMAIN(req)
+		d.Provenance = Provenance{Source: SourceLocal}
 
 		return false, fmt.Errorf("selecting upstream: %w", upstream.ErrNoUpstreams)
 	}
@@ -605,32 +975,49 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 		p.recDetector.add(d.Req)
 	}
 
+	backoffKey, err := p.checkServFailBackoff(d, group)
+	if err != nil {
+		return false, err
+	}
+
 	start := time.Now()
+	exchStart := start
 	src := "upstream"
 
 	// Perform the DNS request.
-	resp, u, err := p.exchangeUpstreams(req, upstreams)
+	resp, u, attempts, err := p.exchangeRouted(req, upstreams, group)
+	resp = p.validateDNSSECResp(d, resp)
+	prov := Provenance{Attempts: attempts, Source: SourceUpstream}
 	if dns64Ups := p.performDNS64(req, resp, upstreams); dns64Ups != nil {
 		u = dns64Ups
+
+		// The synthesized records aren't signed, see RFC 6147 Section 5.5.
+		resp.AuthenticatedData = false
 	} else if p.isBogusNXDomain(resp) {
 		log.Debug("dnsproxy: replying from upstream: response contains bogus-nxdomain ip")
 		resp = p.messages.NewMsgNXDOMAIN(req)
 	}
 
-	if err != nil && !isPrivate && p.Fallbacks != nil {
+	var fallbacks []upstream.Upstream
+	if err != nil && !isPrivate {
+		fallbacks = p.selectFallbacks(req.Question[0].Name, group)
+	}
+
+	if len(fallbacks) > 0 {
 		log.Debug("dnsproxy: replying from upstream: using fallback due to %s", err)
 
 		// Reset the timer.
 		start = time.Now()
 		src = "fallback"
+		prov.Source = SourceFallback
+		prov.Attempts += len(fallbacks)
 
-		// upstreams mustn't appear empty since they have been validated when
-		// creating proxy.
-		upstreams = p.Fallbacks.getUpstreamsForDomain(req.Question[0].Name)
-
-		resp, u, err = upstream.ExchangeParallel(upstreams, req)
+		resp, u, err = upstream.ExchangeParallel(fallbacks, req)
+		resp = p.validateDNSSECResp(d, resp)
 	}
 
+	prov.RTT = time.Since(exchStart)
+
 	if err != nil {
 		log.Debug("dnsproxy: replying from %s: %s", src, err)
 	}
@@ -640,6 +1027,9 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 		log.Debug("dnsproxy: replying from %s: rtt is %s", src, d.QueryDuration)
 	}
 
+	p.recordServFailBackoff(backoffKey, resp)
+
+	d.Provenance = prov
 	p.handleExchangeResult(d, req, resp, u)
 
 	return resp != nil, err
@@ -652,14 +1042,19 @@ func (p *Proxy) handleExchangeResult(d *DNSContext, req, resp *dns.Msg, u upstre
 	if resp == nil {
 		d.Res = p.messages.NewMsgSERVFAIL(req)
 		d.hasEDNS0 = false
+		d.Provenance.Source = SourceLocal
 
 		return
 	}
 
 	d.Upstream = u
 	d.Res = resp
+	d.Provenance.setUpstream(u)
 
 	p.setMinMaxTTL(resp)
+	if len(req.Question) > 0 {
+		p.zeroTTLFloor.apply(req.Question[0], resp)
+	}
 	if len(req.Question) > 0 && len(resp.Question) == 0 {
 		// Explicitly construct the question section since some upstreams may
 		// respond with invalidly constructed messages which cause out-of-range
@@ -689,9 +1084,7 @@ const defaultUDPBufSize = 2048
 // Resolve is the default resolving method used by the DNS proxy to query
 // upstream servers.  It expects dctx is filled with the request, the client's
 func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
-	if p.EnableEDNSClientSubnet {
-		dctx.processECS(p.EDNSAddr)
-	}
+	p.processECS(dctx)
 
 	dctx.calcFlagsAndSize()
 
@@ -700,9 +1093,8 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 	// desired result for user specifying CD flag.
 	cacheWorks := p.cacheWorks(dctx)
 	if cacheWorks {
-		if p.replyFromCache(dctx) {
-			// Complete the response from cache.
-			dctx.scrub()
+		if p.replyFromCache(dctx) || p.replyFromNSEC(dctx) {
+			p.completeFromCache(dctx)
 
 			return nil
 		}
@@ -712,8 +1104,20 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 		addDO(dctx.Req)
 	}
 
+	if p.dnssecValidator != nil && !dctx.Req.CheckingDisabled {
+		// Request the signatures to validate them.
+		addDO(dctx.Req)
+	}
+
+	p.addClientAddr(dctx)
+
 	var ok bool
 	ok, err = p.replyFromUpstream(dctx)
+	if cacheWorks && p.replyFromStale(dctx, err) {
+		p.completeFromCache(dctx)
+
+		return nil
+	}
 
 	// Don't cache the responses having CD flag, just like Dnsmasq does.  It
 	// prevents the cache from being poisoned with unvalidated answers which may
@@ -723,12 +1127,16 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 	if cacheWorks && ok && !dctx.Res.CheckingDisabled {
 		// Cache the response with DNSSEC RRs.
 		p.cacheResp(dctx)
+		p.cacheNSEC(dctx)
 	}
 
 	// It is possible that the response is nil if the upstream hasn't been
 	// chosen.
 	if dctx.Res != nil {
 		filterMsg(dctx.Res, dctx.Res, dctx.adBit, dctx.doBit, 0)
+		p.applyAddrPreference(dctx)
+		p.shuffleAddrs(dctx)
+		p.resolveSVCBAliases(dctx)
 	}
 
 	// Complete the response.
@@ -741,6 +1149,19 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 	return err
 }
 
+// completeFromCache completes the response from cache in dctx and passes it to
+// the response handler, if [Config.HandleCachedResponses] is set.
+func (p *Proxy) completeFromCache(dctx *DNSContext) {
+	p.applyAddrPreference(dctx)
+	p.shuffleAddrs(dctx)
+	p.resolveSVCBAliases(dctx)
+	dctx.scrub()
+
+	if p.ResponseHandler != nil && p.HandleCachedResponses {
+		p.ResponseHandler(dctx, nil)
+	}
+}
+
 // cacheWorks returns true if the cache works for the given context.  If not, it
 // returns false and logs the reason why.
 func (p *Proxy) cacheWorks(dctx *DNSContext) (ok bool) {
@@ -772,8 +1193,10 @@ func (p *Proxy) cacheWorks(dctx *DNSContext) (ok bool) {
 	return false
 }
 
-// processECS adds EDNS Client Subnet data into the request from d.
-func (dctx *DNSContext) processECS(cliIP net.IP) {
+// processECS adds EDNS Client Subnet data into the request from d.  The added
+// subnet is lenIPv4 or lenIPv6 bits long depending on the family of the
+// client's address.
+func (dctx *DNSContext) processECS(cliIP net.IP, lenIPv4, lenIPv6 int) {
 	if ecs, _ := ecsFromMsg(dctx.Req); ecs != nil {
 		if ones, _ := ecs.Mask.Size(); ones != 0 {
 			dctx.ReqECS = ecs
@@ -795,7 +1218,7 @@ func (dctx *DNSContext) processECS(cliIP net.IP) {
 	if !netutil.IsSpecialPurpose(cliAddr) {
 		// A Stub Resolver MUST set SCOPE PREFIX-LENGTH to 0.  See RFC 7871
 		// Section 6.
-		dctx.ReqECS = setECS(dctx.Req, cliIP, 0)
+		dctx.ReqECS = setECS(dctx.Req, cliIP, 0, lenIPv4, lenIPv6)
 
 		log.Debug("dnsproxy: setting ecs: %s", dctx.ReqECS)
 	}
@@ -18,7 +18,6 @@ import (
 	"testing"
 	"time"
 
-	glcache "github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
@@ -201,7 +200,7 @@ func (u *testUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 		u.ecsReqMask, _ = ecs.Mask.Size()
 	}
 	if u.ecsIP != nil {
-		setECS(resp, u.ecsIP, 24)
+		setECS(resp, u.ecsIP, 24, defaultECSv4, defaultECSv6)
 	}
 
 	return resp, nil
@@ -511,7 +510,7 @@ func TestProxy_Resolve_dnssecCache(t *testing.T) {
 		}
 
 		t.Run(tc.name, func(t *testing.T) {
-			t.Cleanup(p.cache.items.Clear)
+			t.Cleanup(p.cache.items.clear)
 			err = p.Resolve(dctx)
 			require.NoError(t, err)
 
@@ -533,15 +532,23 @@ func TestProxy_Resolve_dnssecCache(t *testing.T) {
 				t.Fatalf("wanted length has unexpected value %d", tc.wantLen)
 			}
 
-			cached, expired, key := p.cache.get(dctx.Req)
+			// The signatures are only cached for the clients requesting them.
+			cached, expired, key := p.cache.get(dctx.Req, tc.edns)
 			require.NotNil(t, cached)
-			require.Len(t, cached.m.Answer, 2)
 			assert.False(t, expired)
-			assert.Equal(t, key, msgToKey(dctx.Req))
+			assert.Equal(t, key, msgToKey(dctx.Req, tc.edns))
 
 			// Just make it match.
 			cached.m.Answer[0].Header().Ttl = defaultTestTTL
 			assert.Equal(t, tc.wantAns.String(), cached.m.Answer[0].String())
+
+			if !tc.edns {
+				require.Len(t, cached.m.Answer, 1)
+
+				return
+			}
+
+			require.Len(t, cached.m.Answer, 2)
 			assert.Equal(t, rrsig.String(), cached.m.Answer[1].String())
 		})
 
@@ -1126,7 +1133,7 @@ func TestECS(t *testing.T) {
 		ip := net.IP{1, 2, 3, 4}
 
 		m := &dns.Msg{}
-		subnet := setECS(m, ip, 16)
+		subnet := setECS(m, ip, 16, defaultECSv4, defaultECSv6)
 
 		ones, _ := subnet.Mask.Size()
 		assert.Equal(t, 24, ones)
@@ -1144,7 +1151,7 @@ func TestECS(t *testing.T) {
 		ip := net.IP{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
 
 		m := &dns.Msg{}
-		subnet := setECS(m, ip, 48)
+		subnet := setECS(m, ip, 48, defaultECSv4, defaultECSv6)
 
 		ones, _ := subnet.Mask.Size()
 		assert.Equal(t, 56, ones)
@@ -1313,13 +1320,13 @@ func TestECSProxyCacheMinMaxTTL(t *testing.T) {
 	require.NoError(t, err)
 
 	// get from cache - check min TTL
-	ci, expired, key := prx.cache.getWithSubnet(d.Req, &net.IPNet{
+	ci, expired, key := prx.cache.getWithSubnet(d.Req, false, &net.IPNet{
 		IP:   clientIP,
 		Mask: net.CIDRMask(24, netutil.IPv4BitLen),
 	})
 	assert.False(t, expired)
 
-	assert.Equal(t, key, msgToKeyWithSubnet(d.Req, clientIP, 24))
+	assert.Equal(t, key, msgToKeyWithSubnet(d.Req, false, clientIP, 24))
 	assert.True(t, ci.m.Answer[0].Header().Ttl == prx.CacheMinTTL)
 
 	// 2nd request
@@ -1339,12 +1346,12 @@ func TestECSProxyCacheMinMaxTTL(t *testing.T) {
 	require.NoError(t, err)
 
 	// get from cache - check max TTL
-	ci, expired, key = prx.cache.getWithSubnet(d.Req, &net.IPNet{
+	ci, expired, key = prx.cache.getWithSubnet(d.Req, false, &net.IPNet{
 		IP:   clientIP,
 		Mask: net.CIDRMask(24, netutil.IPv4BitLen),
 	})
 	assert.False(t, expired)
-	assert.Equal(t, key, msgToKeyWithSubnet(d.Req, clientIP, 24))
+	assert.Equal(t, key, msgToKeyWithSubnet(d.Req, false, clientIP, 24))
 	assert.True(t, ci.m.Answer[0].Header().Ttl == prx.CacheMaxTTL)
 }
 
@@ -1415,15 +1422,13 @@ func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 
 	// Add expired response into cache.
 	req := firstCtx.Req
-	key := msgToKey(req)
+	key := msgToKey(req, false)
 	data := (&cacheItem{
 		m: buildResp(req, 0),
 		u: testUpsAddr,
 	}).pack()
-	items := glcache.New(glcache.Config{
-		EnableLRU: true,
-	})
-	items.Set(key, data)
+	items := newCacheStore(0)
+	items.set(key, data)
 	p.cache.items = items
 
 	err := p.Resolve(firstCtx)
@@ -1446,8 +1451,8 @@ func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 	<-out
 
 	// Should be served from cache.
-	data = p.cache.items.Get(msgToKey(firstCtx.Req))
-	unpacked, expired := p.cache.unpackItem(data, firstCtx.Req)
+	data = p.cache.items.get(msgToKey(firstCtx.Req, false))
+	unpacked, expired := p.cache.unpackItem(data, firstCtx.Req, false)
 	require.False(t, expired)
 	require.NotNil(t, unpacked)
 	require.Len(t, unpacked.m.Answer, 1)
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"maps"
 	"net"
 	"slices"
 
@@ -28,13 +29,13 @@ func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
 
 	// TODO(d.kolyshev): Use EnableEDNSClientSubnet from dctxCache.
 	if !p.Config.EnableEDNSClientSubnet {
-		ci, expired, key = dctxCache.get(d.Req)
+		ci, expired, key = dctxCache.get(d.Req, d.doBit)
 		hitMsg = "serving cached response"
 	} else if d.ReqECS != nil {
-		ci, expired, key = dctxCache.getWithSubnet(d.Req, d.ReqECS)
+		ci, expired, key = dctxCache.getWithSubnet(d.Req, d.doBit, d.ReqECS)
 		hitMsg = "serving response from subnet cache"
 	} else {
-		ci, expired, key = dctxCache.get(d.Req)
+		ci, expired, key = dctxCache.get(d.Req, d.doBit)
 		hitMsg = "serving response from general cache"
 	}
 
@@ -42,30 +43,48 @@ func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
 		return hit
 	}
 
+	if expired && !dctxCache.optimistic {
+		return p.holdStale(d, dctxCache, ci, key)
+	}
+
 	d.Res = ci.m
 	d.CachedUpstreamAddr = ci.u
+	d.Provenance = Provenance{
+		Source: SourceCache,
+		Stale:  expired,
+	}
+	d.Provenance.setUpstreamAddr(ci.u)
 
 	log.Debug("dnsproxy: cache: %s", hitMsg)
 
 	if dctxCache.optimistic && expired {
-		// Build a reduced clone of the current context to avoid data race.
-		minCtxClone := &DNSContext{
-			// It is only read inside the optimistic resolver.
-			CustomUpstreamConfig: d.CustomUpstreamConfig,
-			ReqECS:               cloneIPNet(d.ReqECS),
-			IsPrivateClient:      d.IsPrivateClient,
-		}
-		if d.Req != nil {
-			minCtxClone.Req = d.Req.Copy()
-			addDO(minCtxClone.Req)
-		}
-
-		go p.shortFlighter.ResolveOnce(minCtxClone, key)
+		go p.shortFlighter.ResolveOnce(cloneForRefresh(d), key)
+	} else if !expired {
+		p.prefetch(d, key, ci.ttl)
 	}
 
 	return hit
 }
 
+// cloneForRefresh builds a reduced clone of d to resolve its request again in a
+// separate goroutine without a data race.
+func cloneForRefresh(d *DNSContext) (clone *DNSContext) {
+	clone = &DNSContext{
+		// It is only read inside the optimistic resolver.
+		CustomUpstreamConfig: d.CustomUpstreamConfig,
+		ReqECS:               cloneIPNet(d.ReqECS),
+		IsPrivateClient:      d.IsPrivateClient,
+		values:               maps.Clone(d.values),
+		doBit:                d.doBit,
+	}
+	if d.Req != nil {
+		clone.Req = d.Req.Copy()
+		addDO(clone.Req)
+	}
+
+	return clone
+}
+
 // cloneIPNet returns a deep clone of n.
 func cloneIPNet(n *net.IPNet) (clone *net.IPNet) {
 	if n == nil {
@@ -84,7 +103,7 @@ func (p *Proxy) cacheResp(d *DNSContext) {
 	dctxCache := p.cacheForContext(d)
 
 	if !p.EnableEDNSClientSubnet {
-		dctxCache.set(d.Res, d.Upstream)
+		dctxCache.set(d.Res, d.Upstream, d.doBit)
 
 		return
 	}
@@ -120,21 +139,46 @@ func (p *Proxy) cacheResp(d *DNSContext) {
 
 		log.Debug("dnsproxy: cache: ecs option in response: %s", ecs)
 
-		dctxCache.setWithSubnet(d.Res, d.Upstream, ecs)
+		dctxCache.setWithSubnet(d.Res, d.Upstream, d.doBit, ecs)
 	case d.ReqECS != nil:
 		// Cache the response for all subnets since the server doesn't support
 		// EDNS Client Subnet option.
-		dctxCache.setWithSubnet(d.Res, d.Upstream, &net.IPNet{IP: nil, Mask: nil})
+		dctxCache.setWithSubnet(d.Res, d.Upstream, d.doBit, &net.IPNet{IP: nil, Mask: nil})
 	default:
-		dctxCache.set(d.Res, d.Upstream)
+		dctxCache.set(d.Res, d.Upstream, d.doBit)
 	}
 }
 
+// CacheStats returns the statistics of the DNS cache of p.  It returns empty
+// stats if the cache is disabled.
+func (p *Proxy) CacheStats() (s CacheStats) {
+	if p.cache == nil {
+		return CacheStats{}
+	}
+
+	return p.cache.stats()
+}
+
 // ClearCache clears the DNS cache of p.
 func (p *Proxy) ClearCache() {
+	if p.dnssecValidator != nil {
+		p.dnssecValidator.clear()
+	}
+
 	if p.cache != nil {
 		p.cache.clearItems()
 		p.cache.clearItemsWithSubnet()
+
+		if p.nsecCache != nil {
+			p.nsecCache.clear()
+		}
+
+		p.cache.clearStale()
+
+		if p.cache.file != nil {
+			p.cache.file.clear()
+		}
+
 		log.Debug("dnsproxy: cache: cleared")
 	}
 }
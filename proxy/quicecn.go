@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/internal/bootstrap"
+	proxynetutil "github.com/bruceluk/dnsproxy/internal/netutil"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// QUICECNStats contains the counters of Explicit Congestion Notification on
+// the DoQ and DoH3 listeners.  The listeners mark the outgoing packets as
+// ECN-capable and report the congestion experienced by the received packets
+// to the clients, where the platform supports it.
+type QUICECNStats struct {
+	// ECT is the number of the received packets marked as ECN-capable, either
+	// with ECT(0) or ECT(1).
+	ECT uint64
+
+	// CE is the number of the received packets marked by the network as
+	// having experienced congestion.
+	CE uint64
+
+	// Failed is the number of the connections, on which the ECN validation
+	// has failed, so that ECN was disabled for them, e.g. because a middlebox
+	// on the path clears the marks.
+	Failed uint64
+}
+
+// quicECNCounters are the counters of Explicit Congestion Notification on the
+// QUIC listeners.
+type quicECNCounters struct {
+	// ect counts the received packets marked with ECT(0) or ECT(1).
+	ect atomic.Uint64
+
+	// ce counts the received packets marked with CE.
+	ce atomic.Uint64
+
+	// failed counts the connections, on which the ECN validation has failed.
+	failed atomic.Uint64
+}
+
+// countPacket updates the counters with the ECN mark of a received packet.
+func (c *quicECNCounters) countPacket(ecn logging.ECN) {
+	switch ecn {
+	case logging.ECT0, logging.ECT1:
+		c.ect.Add(1)
+	case logging.ECNCE:
+		c.ce.Add(1)
+	default:
+		// Go on.
+	}
+}
+
+// newTracer returns a [quic.Config.Tracer] function updating c.
+func (c *quicECNCounters) newTracer() (
+	tracer func(ctx context.Context, p logging.Perspective, id quic.ConnectionID) (t *logging.ConnectionTracer),
+) {
+	return func(
+		_ context.Context,
+		_ logging.Perspective,
+		_ quic.ConnectionID,
+	) (t *logging.ConnectionTracer) {
+		return &logging.ConnectionTracer{
+			ReceivedLongHeaderPacket: func(
+				_ *logging.ExtendedHeader,
+				_ logging.ByteCount,
+				ecn logging.ECN,
+				_ []logging.Frame,
+			) {
+				c.countPacket(ecn)
+			},
+			ReceivedShortHeaderPacket: func(
+				_ *logging.ShortHeader,
+				_ logging.ByteCount,
+				ecn logging.ECN,
+				_ []logging.Frame,
+			) {
+				c.countPacket(ecn)
+			},
+			ECNStateUpdated: func(state logging.ECNState, _ logging.ECNStateTrigger) {
+				if state == logging.ECNStateFailed {
+					c.failed.Add(1)
+				}
+			},
+		}
+	}
+}
+
+// QUICECNStats returns the counters of Explicit Congestion Notification on the
+// DoQ and DoH3 listeners.  It returns empty stats if there are no such
+// listeners or ECN isn't supported.
+func (p *Proxy) QUICECNStats() (s QUICECNStats) {
+	return QUICECNStats{
+		ECT:    p.quicECN.ect.Load(),
+		CE:     p.quicECN.ce.Load(),
+		Failed: p.quicECN.failed.Load(),
+	}
+}
+
+// listenQUICConn returns a UDP connection for a QUIC listener bound to addr.
+// The stable IPv6 flow labels are enabled on it, if [Config.QUICFlowLabels] is
+// set.
+func (p *Proxy) listenQUICConn(addr *net.UDPAddr) (conn *net.UDPConn, err error) {
+	lc := &net.ListenConfig{}
+	if p.QUICFlowLabels {
+		lc.Control = proxynetutil.ListenControlFlowLabel()
+		if lc.Control == nil {
+			log.Debug("dnsproxy: ipv6 flow labels aren't supported, not setting for %s", addr)
+		}
+	}
+
+	c, err := lc.ListenPacket(context.Background(), bootstrap.NetworkUDP, addr.String())
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	conn, ok := c.(*net.UDPConn)
+	if !ok {
+		_ = c.Close()
+
+		return nil, fmt.Errorf("unexpected conn type %T", c)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_QUICECNStats(t *testing.T) {
+	p := &Proxy{}
+	tracer := p.quicECN.newTracer()(context.Background(), logging.PerspectiveServer, quic.ConnectionID{})
+
+	for _, ecn := range []logging.ECN{
+		logging.ECNUnsupported,
+		logging.ECTNot,
+		logging.ECT0,
+		logging.ECT1,
+		logging.ECNCE,
+	} {
+		tracer.ReceivedShortHeaderPacket(&logging.ShortHeader{}, 0, ecn, nil)
+	}
+
+	tracer.ReceivedLongHeaderPacket(&logging.ExtendedHeader{}, 0, logging.ECNCE, nil)
+	tracer.ECNStateUpdated(logging.ECNStateCapable, logging.ECNTriggerNoTrigger)
+	tracer.ECNStateUpdated(logging.ECNStateFailed, logging.ECNFailedNoECNCounts)
+
+	assert.Equal(t, QUICECNStats{ECT: 2, CE: 2, Failed: 1}, p.QUICECNStats())
+}
+
+func TestProxy_quicFlowLabels(t *testing.T) {
+	serverConfig, caPem := newTLSConfig(t)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	tlsConfig := &tls.Config{
+		ServerName: tlsServerName,
+		RootCAs:    roots,
+		NextProtos: []string{NextProtoDQ},
+	}
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	listenAddr := netip.AddrPortFrom(netip.IPv6Loopback(), 0)
+	p := mustNew(t, &Config{
+		QUICListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(listenAddr)},
+		TLSConfig:      serverConfig,
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+		QUICFlowLabels: true,
+	})
+
+	ctx := context.Background()
+	err := p.Start(ctx)
+	if err != nil {
+		t.Skipf("ipv6 isn't available: %s", err)
+	}
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	addr := testutil.RequireTypeAssert[*net.UDPAddr](t, p.Addr(ProtoQUIC))
+
+	conn, err := quic.DialAddrEarly(ctx, addr.String(), tlsConfig, nil)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return conn.CloseWithError(DoQCodeNoError, "")
+	})
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	resp := sendQUICMessage(t, req, conn, DoQv1)
+	require.NotNil(t, resp)
+
+	assert.Equal(t, req.Id, resp.Id)
+	assert.Zero(t, p.QUICECNStats().CE)
+}
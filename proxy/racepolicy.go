@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// RacePolicy defines which response is used when the upstreams queried in
+// parallel, see [UModeParallel], return different responses to the same
+// request.
+type RacePolicy uint8
+
+const (
+	// RacePolicyFirst uses the first successful response.  The rest of the
+	// responses are still received and compared with it to detect the
+	// disagreements, but the request isn't delayed by them.
+	RacePolicyFirst RacePolicy = iota
+
+	// RacePolicyMajority waits for all the upstreams and uses the response
+	// returned by the most of them.  Ties are resolved in favor of the
+	// response that arrived first.
+	RacePolicyMajority
+
+	// RacePolicyPriority waits for all the upstreams and uses the successful
+	// response of the upstream that goes first in the configuration.
+	RacePolicyPriority
+)
+
+// String implements the [fmt.Stringer] interface for RacePolicy.
+func (pol RacePolicy) String() (s string) {
+	switch pol {
+	case RacePolicyFirst:
+		return "first"
+	case RacePolicyMajority:
+		return "majority"
+	case RacePolicyPriority:
+		return "priority"
+	default:
+		return fmt.Sprintf("!bad_race_policy_%d", uint8(pol))
+	}
+}
+
+// ParseRacePolicy parses the race policy from its string representation as
+// returned by [RacePolicy.String].
+func ParseRacePolicy(s string) (pol RacePolicy, err error) {
+	for pol = RacePolicyFirst; pol <= RacePolicyPriority; pol++ {
+		if pol.String() == s {
+			return pol, nil
+		}
+	}
+
+	return RacePolicyFirst, fmt.Errorf("unknown race policy %q", s)
+}
+
+// RaceResponse is a successful response of a single upstream to a request
+// sent to several upstreams in parallel.
+type RaceResponse struct {
+	// Resp is the response of the upstream.
+	Resp *dns.Msg
+
+	// Upstream is the upstream that returned Resp.
+	Upstream upstream.Upstream
+
+	// idx is the index of Upstream within the upstreams queried.
+	idx int
+}
+
+// RaceDisagreement describes the different responses of the upstreams to the
+// same request sent to them in parallel.  Responses differ if they have
+// different response codes or different resource record sets in the answer
+// section, the TTLs and the order of the records aren't considered.
+type RaceDisagreement struct {
+	// Req is the request sent to the upstreams.
+	Req *dns.Msg
+
+	// Chosen is the response used to answer the request.  It's one of
+	// Responses.
+	Chosen *RaceResponse
+
+	// Responses are all the successful responses in the order of arrival.
+	Responses []*RaceResponse
+
+	// Policy is the policy Chosen has been chosen with.
+	Policy RacePolicy
+}
+
+// raceResult is the result of a single upstream exchange within a race.
+type raceResult struct {
+	resp *RaceResponse
+	err  error
+}
+
+// exchangeParallel resolves req using all of ups in parallel and chooses the
+// response according to [Config.RacePolicy].  The disagreements between the
+// upstreams are logged and reported to [Config.OnRaceDisagreement].
+func (p *Proxy) exchangeParallel(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+) (resp *dns.Msg, u upstream.Upstream, err error) {
+	if p.upstreamHealth != nil {
+		ups = p.upstreamHealth.filter(ups)
+	}
+
+	if len(ups) < 2 {
+		return upstream.ExchangeParallel(ups, req)
+	}
+
+	resCh := make(chan *raceResult, len(ups))
+	for i, up := range ups {
+		go p.raceExchange(req, i, up, resCh)
+	}
+
+	var received []*RaceResponse
+	var errs []error
+	for range ups {
+		res := <-resCh
+		if res.err != nil {
+			errs = append(errs, res.err)
+
+			continue
+		}
+
+		received = append(received, res.resp)
+		if p.RacePolicy == RacePolicyFirst {
+			// Don't wait for the rest of the upstreams, compare their
+			// responses in background.  Copy the messages, since those may be
+			// modified while answering the client.
+			first := &RaceResponse{
+				Resp:     res.resp.Resp.Copy(),
+				Upstream: res.resp.Upstream,
+				idx:      res.resp.idx,
+			}
+			go p.checkRaceLate(req.Copy(), first, resCh, len(ups)-len(errs)-1)
+
+			return res.resp.Resp, res.resp.Upstream, nil
+		}
+	}
+
+	if len(received) == 0 {
+		return nil, nil, fmt.Errorf("all upstreams failed: %w", errors.Join(errs...))
+	}
+
+	chosen := chooseRaceResponse(p.RacePolicy, received)
+	p.checkRace(req, chosen, received)
+
+	return chosen.Resp, chosen.Upstream, nil
+}
+
+// raceExchange exchanges req with u and sends the result to resCh.  idx is the
+// index of u within the upstreams queried.  It's intended to be used as a
+// goroutine.
+func (p *Proxy) raceExchange(req *dns.Msg, idx int, u upstream.Upstream, resCh chan<- *raceResult) {
+	defer log.OnPanic("dnsproxy: racing upstreams")
+
+	resp, _, err := exchange(u, req, p.time)
+	if err == nil && resp == nil {
+		err = upstream.ErrNoReply
+	}
+
+	if err != nil {
+		resCh <- &raceResult{err: err}
+
+		return
+	}
+
+	resCh <- &raceResult{
+		resp: &RaceResponse{
+			Resp:     resp,
+			Upstream: u,
+			idx:      idx,
+		},
+	}
+}
+
+// checkRaceLate receives the rest left results from resCh and compares them
+// with first, which has already been used to answer req.  req and first must
+// not be used by anything else.  It's intended to be used as a goroutine.
+func (p *Proxy) checkRaceLate(req *dns.Msg, first *RaceResponse, resCh <-chan *raceResult, left int) {
+	defer log.OnPanic("dnsproxy: checking race")
+
+	received := []*RaceResponse{first}
+	for range left {
+		res := <-resCh
+		if res.err == nil {
+			received = append(received, res.resp)
+		}
+	}
+
+	p.checkRace(req, first, received)
+}
+
+// checkRace logs and reports the disagreement between the received responses
+// to req, if any.
+func (p *Proxy) checkRace(req *dns.Msg, chosen *RaceResponse, received []*RaceResponse) {
+	chosenKey := raceKey(chosen.Resp)
+	agreed := true
+	for _, r := range received {
+		if raceKey(r.Resp) != chosenKey {
+			agreed = false
+
+			break
+		}
+	}
+
+	if agreed {
+		return
+	}
+
+	log.Debug(
+		"dnsproxy: %d upstreams disagree on %s; using response of %s with policy %s",
+		len(received),
+		req.Question[0].String(),
+		chosen.Upstream.Address(),
+		p.RacePolicy,
+	)
+
+	if p.OnRaceDisagreement != nil {
+		p.OnRaceDisagreement(&RaceDisagreement{
+			Req:       req,
+			Chosen:    chosen,
+			Responses: received,
+			Policy:    p.RacePolicy,
+		})
+	}
+}
+
+// chooseRaceResponse returns the response chosen from received according to
+// pol.  received must not be empty.
+func chooseRaceResponse(pol RacePolicy, received []*RaceResponse) (chosen *RaceResponse) {
+	switch pol {
+	case RacePolicyMajority:
+		return majorityResponse(received)
+	case RacePolicyPriority:
+		return slices.MinFunc(received, func(a, b *RaceResponse) (res int) {
+			return a.idx - b.idx
+		})
+	default:
+		return received[0]
+	}
+}
+
+// majorityResponse returns the earliest response among the ones equal to the
+// most of received.  received must not be empty.
+func majorityResponse(received []*RaceResponse) (chosen *RaceResponse) {
+	counts := make(map[string]int, len(received))
+	for _, r := range received {
+		counts[raceKey(r.Resp)]++
+	}
+
+	maxCount := 0
+	for _, r := range received {
+		// Use the strict comparison to prefer the earliest response.
+		if n := counts[raceKey(r.Resp)]; n > maxCount {
+			chosen, maxCount = r, n
+		}
+	}
+
+	return chosen
+}
+
+// raceKey returns the string, which is equal for the responses with the same
+// response code and the same set of answer records.
+func raceKey(resp *dns.Msg) (key string) {
+	rrs := make([]string, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rrs = append(rrs, strings.ToLower(rr.String()))
+	}
+
+	slices.Sort(rrs)
+
+	return dns.RcodeToString[resp.Rcode] + "\n" + strings.Join(rrs, "\n")
+}
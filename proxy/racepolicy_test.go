@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRaceUpstream returns an upstream answering with a single A record
+// containing ip.  If wait is not nil, the upstream doesn't respond until it's
+// closed.
+func newRaceUpstream(name string, ip net.IP, wait <-chan struct{}) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if wait != nil {
+				<-wait
+			}
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    uint32(len(name)),
+				},
+				A: ip,
+			})
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return name },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestChooseRaceResponse(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+	ipA, ipB := net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}
+
+	// The responses in the order of arrival, the index is the position of the
+	// upstream in the configuration.
+	var received []*RaceResponse
+	for i, up := range []struct {
+		ip  net.IP
+		idx int
+	}{{
+		ip:  ipA,
+		idx: 2,
+	}, {
+		ip:  ipB,
+		idx: 1,
+	}, {
+		ip:  ipB,
+		idx: 0,
+	}} {
+		u := newRaceUpstream("upstream"+string(rune('a'+i)), up.ip, nil)
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+
+		received = append(received, &RaceResponse{Resp: resp, Upstream: u, idx: up.idx})
+	}
+
+	testCases := []struct {
+		want *RaceResponse
+		name string
+		pol  RacePolicy
+	}{{
+		want: received[0],
+		name: "first",
+		pol:  RacePolicyFirst,
+	}, {
+		want: received[1],
+		name: "majority",
+		pol:  RacePolicyMajority,
+	}, {
+		want: received[2],
+		name: "priority",
+		pol:  RacePolicyPriority,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Same(t, tc.want, chooseRaceResponse(tc.pol, received))
+		})
+	}
+}
+
+func TestRaceKey(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	ip := net.IP{192, 0, 2, 1}
+
+	// The names have different lengths, so the TTLs differ.
+	a, err := newRaceUpstream("a", ip, nil).Exchange(req)
+	require.NoError(t, err)
+
+	b, err := newRaceUpstream("bb", ip, nil).Exchange(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, raceKey(a), raceKey(b))
+
+	b.Rcode = dns.RcodeServerFailure
+	assert.NotEqual(t, raceKey(a), raceKey(b))
+}
+
+func TestProxy_exchangeParallel_disagreement(t *testing.T) {
+	wait := make(chan struct{})
+	fast := newRaceUpstream("fast", net.IP{192, 0, 2, 1}, nil)
+	slow := newRaceUpstream("slow", net.IP{192, 0, 2, 2}, wait)
+
+	disagreements := make(chan *RaceDisagreement, 1)
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{fast, slow},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		UpstreamMode:   UModeParallel,
+		RacePolicy:     RacePolicyFirst,
+		OnRaceDisagreement: func(d *RaceDisagreement) {
+			disagreements <- d
+		},
+	})
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	resp, u, _, err := p.exchangeUpstreams(req, p.UpstreamConfig.Upstreams)
+	require.NoError(t, err)
+
+	assert.Same(t, fast, u)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, net.IP{192, 0, 2, 1}, resp.Answer[0].(*dns.A).A.To4())
+
+	// Let the slow upstream respond only after the fast response is used.
+	close(wait)
+
+	d, _ := testutil.RequireReceive(t, disagreements, time.Second)
+	require.Len(t, d.Responses, 2)
+
+	assert.Same(t, fast, d.Chosen.Upstream)
+	assert.Same(t, slow, d.Responses[1].Upstream)
+	assert.Equal(t, RacePolicyFirst, d.Policy)
+}
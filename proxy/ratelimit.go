@@ -3,13 +3,82 @@ package proxy
 import (
 	"net/netip"
 	"slices"
+	"sync"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
-	rate "github.com/beefsack/go-rate"
 	gocache "github.com/patrickmn/go-cache"
 )
 
+// ratelimitInterval is the interval the requests are counted within by
+// [Config.Ratelimit].
+const ratelimitInterval = time.Second
+
+// subnetLimiter limits the rate of the requests from a single subnet allowing at
+// most limit requests within [ratelimitInterval].  It's the same sliding-window
+// algorithm as the one of the go-rate limiters used for the TLS handshakes, but
+// it keeps the times of the requests accessible, so that they can be exported.
+// It's safe for concurrent use.
+type subnetLimiter struct {
+	// mu protects times and next.
+	mu *sync.Mutex
+
+	// times is the ring buffer of the times of the latest allowed requests.
+	times []time.Time
+
+	// next is the index in times of the oldest request, once times is full.
+	next int
+
+	// limit is the maximum number of the requests within the interval.
+	limit int
+}
+
+// newSubnetLimiter returns a new properly initialized *subnetLimiter.
+func newSubnetLimiter(limit int) (l *subnetLimiter) {
+	return &subnetLimiter{
+		mu:    &sync.Mutex{},
+		times: make([]time.Time, 0, limit),
+		limit: limit,
+	}
+}
+
+// try returns true if the request at now is allowed and accounts it.
+func (l *subnetLimiter) try(now time.Time) (ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.times) < l.limit {
+		l.times = append(l.times, now)
+
+		return true
+	}
+
+	if now.Sub(l.times[l.next]) < ratelimitInterval {
+		return false
+	}
+
+	l.times[l.next] = now
+	l.next = (l.next + 1) % l.limit
+
+	return true
+}
+
+// recent returns the times of the requests accounted within the interval
+// before now, the oldest first.
+func (l *subnetLimiter) recent(now time.Time) (times []time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := range l.times {
+		t := l.times[(l.next+i)%len(l.times)]
+		if now.Sub(t) < ratelimitInterval {
+			times = append(times, t)
+		}
+	}
+
+	return times
+}
+
 func (p *Proxy) limiterForIP(ip string) interface{} {
 	p.ratelimitLock.Lock()
 	defer p.ratelimitLock.Unlock()
@@ -20,7 +89,7 @@ func (p *Proxy) limiterForIP(ip string) interface{} {
 	// check if ratelimiter for that IP already exists, if not, create
 	value, found := p.ratelimitBuckets.Get(ip)
 	if !found {
-		value = rate.New(p.Ratelimit, time.Second)
+		value = newSubnetLimiter(p.Ratelimit)
 		p.ratelimitBuckets.Set(ip, value, time.Hour)
 	}
 
@@ -51,14 +120,12 @@ func (p *Proxy) isRatelimited(addr netip.Addr) (ok bool) {
 	// TODO(s.chzhen):  Improve caching.  Decrease allocations.
 	ipStr := pref.Addr().String()
 	value := p.limiterForIP(ipStr)
-	rl, ok := value.(*rate.RateLimiter)
+	rl, ok := value.(*subnetLimiter)
 	if !ok {
 		log.Error("dnsproxy: %T found in ratelimit cache", value)
 
 		return false
 	}
 
-	allow, _ := rl.Try()
-
-	return !allow
+	return !rl.try(time.Now())
 }
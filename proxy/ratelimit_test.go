@@ -8,7 +8,9 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/golibs/testutil"
+	rate "github.com/beefsack/go-rate"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -95,3 +97,31 @@ func TestWhitelist(t *testing.T) {
 		t.Fatal("Second request must have been allowed due to whitelist")
 	}
 }
+
+func TestSubnetLimiter(t *testing.T) {
+	const limit = 3
+
+	l := newSubnetLimiter(limit)
+	start := time.Now()
+
+	for i := range limit {
+		assert.True(t, l.try(start.Add(time.Duration(i)*100*time.Millisecond)))
+	}
+
+	assert.False(t, l.try(start.Add(500*time.Millisecond)))
+
+	// The oldest request leaves the window, which frees a single slot.
+	assert.True(t, l.try(start.Add(ratelimitInterval)))
+	assert.False(t, l.try(start.Add(ratelimitInterval+50*time.Millisecond)))
+	assert.True(t, l.try(start.Add(ratelimitInterval+100*time.Millisecond)))
+
+	t.Run("same_as_go_rate", func(t *testing.T) {
+		goRate := rate.New(limit, ratelimitInterval)
+		sl := newSubnetLimiter(limit)
+
+		for i := range 2 * limit {
+			want, _ := goRate.Try()
+			assert.Equal(t, want, sl.try(time.Now()), "request %d", i)
+		}
+	})
+}
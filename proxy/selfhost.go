@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+const (
+	// ddrDomain is the special-use domain name clients query for the SVCB
+	// records of the encrypted resolvers to discover them, see RFC 9462.
+	ddrDomain = "_dns.resolver.arpa."
+
+	// selfDoHPath is the URI template of the DoH endpoints advertised for
+	// [Config.SelfHostname].
+	selfDoHPath = "/dns-query{?dns}"
+
+	// selfTTL is the TTL of the records for [Config.SelfHostname] in seconds.
+	selfTTL = 300
+)
+
+// normalizeSelfHostname returns the lowercased FQDN of hostname or an empty
+// string if hostname is empty.
+func normalizeSelfHostname(hostname string) (fqdn string) {
+	if hostname == "" {
+		return ""
+	}
+
+	return dns.Fqdn(strings.ToLower(hostname))
+}
+
+// isSelfHost returns true if req is a request, which is answered by the proxy
+// itself because of [Config.SelfHostname].  req must have exactly one
+// question.
+func (p *Proxy) isSelfHost(req *dns.Msg) (ok bool) {
+	if p.selfHostname == "" {
+		return false
+	}
+
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	if q.Qtype == dns.TypeSVCB {
+		return name == ddrDomain || name == "_dns."+p.selfHostname
+	}
+
+	return name == p.selfHostname
+}
+
+// newSelfHostResponse returns the response to req for [Config.SelfHostname]
+// with the addresses and the encrypted endpoints of p.  req must be a request
+// for which [Proxy.isSelfHost] returns true.
+func (p *Proxy) newSelfHostResponse(req *dns.Msg) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.RecursionAvailable = true
+
+	q := req.Question[0]
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		for _, addr := range p.selfAddrs() {
+			if rr := newSelfAddrRR(q, addr); rr != nil {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+	case dns.TypeHTTPS:
+		if port, ok := p.firstPort(ProtoHTTPS); ok {
+			resp.Answer = append(resp.Answer, &dns.HTTPS{
+				SVCB: newSelfSVCB(newSelfHdr(q, dns.TypeHTTPS), 1, ".", p.dohALPN(), port, true),
+			})
+		}
+	case dns.TypeSVCB:
+		resp.Answer = p.appendSelfSVCBs(resp.Answer, q)
+	default:
+		// Respond with NODATA to the other types.
+	}
+
+	return resp
+}
+
+// selfAddrs returns the IP addresses to answer for [Config.SelfHostname].
+// Those are either [Config.SelfAddrs] or the specified addresses of the
+// listeners.
+func (p *Proxy) selfAddrs() (addrs []netip.Addr) {
+	if len(p.SelfAddrs) > 0 {
+		return p.SelfAddrs
+	}
+
+	for _, proto := range []Proto{ProtoUDP, ProtoTCP, ProtoTLS, ProtoHTTPS, ProtoQUIC} {
+		for _, a := range p.Addrs(proto) {
+			addr := netutil.NetAddrToAddrPort(a).Addr().Unmap()
+			if addr.IsValid() && !addr.IsUnspecified() && !slices.Contains(addrs, addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	return addrs
+}
+
+// newSelfAddrRR returns an A or AAAA record for the question q with addr, or
+// nil if the family of addr doesn't match the type of q.
+func newSelfAddrRR(q dns.Question, addr netip.Addr) (rr dns.RR) {
+	hdr := newSelfHdr(q, q.Qtype)
+
+	switch {
+	case q.Qtype == dns.TypeA && addr.Is4():
+		return &dns.A{Hdr: hdr, A: addr.AsSlice()}
+	case q.Qtype == dns.TypeAAAA && addr.Is6():
+		return &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()}
+	default:
+		return nil
+	}
+}
+
+// appendSelfSVCBs appends the SVCB records of the encrypted endpoints of p for
+// the question q to rrs and returns the result.
+func (p *Proxy) appendSelfSVCBs(rrs []dns.RR, q dns.Question) (res []dns.RR) {
+	res = rrs
+
+	endpoints := []struct {
+		alpn  []string
+		proto Proto
+		doh   bool
+	}{{
+		alpn:  []string{"dot"},
+		proto: ProtoTLS,
+	}, {
+		alpn:  p.dohALPN(),
+		proto: ProtoHTTPS,
+		doh:   true,
+	}, {
+		alpn:  []string{"doq"},
+		proto: ProtoQUIC,
+	}}
+
+	prio := uint16(1)
+	for _, e := range endpoints {
+		port, ok := p.firstPort(e.proto)
+		if !ok {
+			continue
+		}
+
+		svcb := newSelfSVCB(newSelfHdr(q, dns.TypeSVCB), prio, p.selfHostname, e.alpn, port, e.doh)
+		res = append(res, &svcb)
+		prio++
+	}
+
+	return res
+}
+
+// newSelfHdr returns the header of a record of rrtype answering q.
+func newSelfHdr(q dns.Question, rrtype uint16) (hdr dns.RR_Header) {
+	return dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    selfTTL,
+	}
+}
+
+// newSelfSVCB returns the SVCB record data of an encrypted endpoint.  doh adds
+// the DoH path.
+func newSelfSVCB(
+	hdr dns.RR_Header,
+	prio uint16,
+	target string,
+	alpn []string,
+	port uint16,
+	doh bool,
+) (svcb dns.SVCB) {
+	svcb = dns.SVCB{
+		Hdr:      hdr,
+		Priority: prio,
+		Target:   target,
+		Value: []dns.SVCBKeyValue{
+			&dns.SVCBAlpn{Alpn: alpn},
+			&dns.SVCBPort{Port: port},
+		},
+	}
+
+	if doh {
+		svcb.Value = append(svcb.Value, &dns.SVCBDoHPath{Template: selfDoHPath})
+	}
+
+	return svcb
+}
+
+// dohALPN returns the ALPN identifiers of the DoH endpoint of p.
+func (p *Proxy) dohALPN() (alpn []string) {
+	if p.HTTP3 {
+		return []string{"h3", "h2"}
+	}
+
+	return []string{"h2"}
+}
+
+// firstPort returns the port of the first listener of p for proto.
+func (p *Proxy) firstPort(proto Proto) (port uint16, ok bool) {
+	addr := p.Addr(proto)
+	if addr == nil {
+		return 0, false
+	}
+
+	return netutil.NetAddrToAddrPort(addr).Port(), true
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_selfHostname(t *testing.T) {
+	const hostname = "dns.example"
+
+	tlsConf, _ := newTLSConfig(t)
+	selfAddr := netip.MustParseAddr("192.0.2.1")
+
+	var resolved []string
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resolved = append(resolved, req.Question[0].Name)
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr:   []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TLSListenAddr:   []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		HTTPSListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		TLSConfig:       tlsConf,
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		SelfHostname:   "DNS.example.",
+		SelfAddrs:      []netip.Addr{selfAddr},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	tlsPort := uint16(p.Addr(ProtoTLS).(*net.TCPAddr).Port)
+	httpsPort := uint16(p.Addr(ProtoHTTPS).(*net.TCPAddr).Port)
+
+	resolve := func(t *testing.T, name string, qtype uint16) (resp *dns.Msg) {
+		t.Helper()
+
+		dctx := &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion(name, qtype),
+			Addr: netip.MustParseAddrPort("203.0.113.1:53"),
+		}
+		require.NoError(t, p.handleDNSRequest(dctx))
+		require.NotNil(t, dctx.Res)
+
+		return dctx.Res
+	}
+
+	t.Run("a", func(t *testing.T) {
+		resp := resolve(t, hostname+".", dns.TypeA)
+		require.Len(t, resp.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+		assert.Equal(t, selfAddr.AsSlice(), []byte(a.A.To4()))
+	})
+
+	t.Run("aaaa", func(t *testing.T) {
+		resp := resolve(t, hostname+".", dns.TypeAAAA)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Empty(t, resp.Answer)
+	})
+
+	t.Run("https", func(t *testing.T) {
+		resp := resolve(t, hostname+".", dns.TypeHTTPS)
+		require.Len(t, resp.Answer, 1)
+
+		https := testutil.RequireTypeAssert[*dns.HTTPS](t, resp.Answer[0])
+		assert.Equal(t, ".", https.Target)
+		assert.Contains(t, https.Value, &dns.SVCBPort{Port: httpsPort})
+		assert.Contains(t, https.Value, &dns.SVCBDoHPath{Template: selfDoHPath})
+	})
+
+	t.Run("ddr", func(t *testing.T) {
+		resp := resolve(t, ddrDomain, dns.TypeSVCB)
+		require.Len(t, resp.Answer, 2)
+
+		dot := testutil.RequireTypeAssert[*dns.SVCB](t, resp.Answer[0])
+		assert.Equal(t, hostname+".", dot.Target)
+		assert.Equal(t, uint16(1), dot.Priority)
+		assert.Contains(t, dot.Value, &dns.SVCBAlpn{Alpn: []string{"dot"}})
+		assert.Contains(t, dot.Value, &dns.SVCBPort{Port: tlsPort})
+
+		doh := testutil.RequireTypeAssert[*dns.SVCB](t, resp.Answer[1])
+		assert.Equal(t, uint16(2), doh.Priority)
+		assert.Contains(t, doh.Value, &dns.SVCBPort{Port: httpsPort})
+		assert.Contains(t, doh.Value, &dns.SVCBDoHPath{Template: selfDoHPath})
+	})
+
+	t.Run("other", func(t *testing.T) {
+		require.Empty(t, resolved)
+
+		_ = resolve(t, "www."+hostname+".", dns.TypeA)
+
+		assert.Equal(t, []string{"www." + hostname + "."}, resolved)
+	})
+}
@@ -9,12 +9,16 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
+	proxynetutil "github.com/bruceluk/dnsproxy/internal/netutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 )
 
 // startListeners configures and starts listener loops
 func (p *Proxy) startListeners(ctx context.Context) error {
+	log.Info("dnsproxy: supported socket options: %s", proxynetutil.Capabilities())
+
 	err := p.createUDPListeners(ctx)
 	if err != nil {
 		return err
@@ -25,7 +29,7 @@ func (p *Proxy) startListeners(ctx context.Context) error {
 		return err
 	}
 
-	err = p.createTLSListeners()
+	err = p.createTLSListeners(ctx)
 	if err != nil {
 		return err
 	}
@@ -35,6 +39,16 @@ func (p *Proxy) startListeners(ctx context.Context) error {
 		return err
 	}
 
+	err = p.createHTTPListeners()
+	if err != nil {
+		return err
+	}
+
+	err = p.createGRPCListeners()
+	if err != nil {
+		return err
+	}
+
 	err = p.createQUICListeners()
 	if err != nil {
 		return err
@@ -57,12 +71,22 @@ func (p *Proxy) startListeners(ctx context.Context) error {
 		go p.tcpPacketLoop(l, ProtoTLS, p.requestsSema)
 	}
 
+	// Pass the servers explicitly, since Shutdown may reset the fields before
+	// the goroutines start.
 	for _, l := range p.httpsListen {
-		go func(l net.Listener) { _ = p.httpsServer.Serve(l) }(l)
+		go p.serveHTTP(p.httpsServer, l, ProtoHTTPS)
+	}
+
+	for _, l := range p.httpListen {
+		go p.serveHTTP(p.httpServer, l, ProtoHTTP)
+	}
+
+	for _, l := range p.grpcListen {
+		go p.serveHTTP(p.grpcServer, l, ProtoGRPC)
 	}
 
 	for _, l := range p.h3Listen {
-		go func(l *quic.EarlyListener) { _ = p.h3Server.ServeListener(l) }(l)
+		go func(srv *http3.Server, l *quic.EarlyListener) { _ = srv.ServeListener(l) }(p.h3Server, l)
 	}
 
 	for _, l := range p.quicListen {
@@ -83,7 +107,8 @@ func (p *Proxy) startListeners(ctx context.Context) error {
 // handleDNSRequest processes the context.  The only error it returns is the one
 // from the [RequestHandler], or [Resolve] if the [RequestHandler] is not set.
 // d is left without a response as the documentation to [BeforeRequestHandler]
-// says, and if it's ratelimited.
+// says, and if it's ratelimited.  The requests quarantined after crashing the
+// handling are refused, see [Config.PoisonQueryThreshold].
 func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 	p.logDNSMessage(d.Req)
 
@@ -93,6 +118,21 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 		return nil
 	}
 
+	stage := CrashStageBefore
+	defer p.recoverRequest(d, &stage)
+
+	if p.isQuarantined(d) {
+		log.Debug("dnsproxy: refusing quarantined request from %s", d.Addr)
+
+		d.Res = (&dns.Msg{}).SetRcode(d.Req, dns.RcodeRefused)
+		stage = CrashStageRespond
+		p.respond(d)
+
+		return nil
+	}
+
+	p.restoreClientAddr(d)
+
 	ip := d.Addr.Addr()
 	d.IsPrivateClient = p.privateNets.Contains(ip)
 
@@ -111,8 +151,12 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 		return nil
 	}
 
+	stage = CrashStageValidate
 	d.Res = p.validateRequest(d)
 	if d.Res == nil {
+		stage = CrashStageResolve
+		p.countTop(d)
+
 		if p.RequestHandler != nil {
 			err = errors.Annotate(p.RequestHandler(p, d), "using request handler: %w")
 		} else {
@@ -120,14 +164,25 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 		}
 	}
 
+	d.setLocalSource()
+	p.signResponse(d)
+	if d.Res != nil {
+		log.Debug("dnsproxy: answering %s from %s", d.Addr, d.Provenance)
+	}
+
+	if len(d.Req.Question) == 1 {
+		p.recordAnomaly(d)
+	}
+
+	stage = CrashStageRespond
 	p.logDNSMessage(d.Res)
 	p.respond(d)
 
 	return err
 }
 
-// validateRequest returns a response for invalid request or nil if the request
-// is ok.
+// validateRequest returns a response for invalid request or for the one
+// answered by the proxy itself, or nil if the request should be resolved.
 func (p *Proxy) validateRequest(d *DNSContext) (resp *dns.Msg) {
 	switch {
 	case len(d.Req.Question) != 1:
@@ -141,6 +196,14 @@ func (p *Proxy) validateRequest(d *DNSContext) (resp *dns.Msg) {
 		log.Debug("dnsproxy: refusing type=ANY request")
 
 		return p.messages.NewMsgNOTIMPLEMENTED(d.Req)
+	case p.isCanary(d.Req):
+		log.Debug("dnsproxy: %s requests canary domain %q", d.Addr, d.Req.Question[0].Name)
+
+		return p.messages.NewMsgNXDOMAIN(d.Req)
+	case p.isSelfHost(d.Req):
+		log.Debug("dnsproxy: %s requests self hostname %q", d.Addr, d.Req.Question[0].Name)
+
+		return p.newSelfHostResponse(d.Req)
 	case p.recDetector.check(d.Req):
 		log.Debug("dnsproxy: recursion detected resolving %q", d.Req.Question[0].Name)
 
@@ -202,8 +265,10 @@ func (p *Proxy) respond(d *DNSContext) {
 		err = p.respondTCP(d)
 	case ProtoTLS:
 		err = p.respondTCP(d)
-	case ProtoHTTPS:
+	case ProtoHTTPS, ProtoHTTP:
 		err = p.respondHTTPS(d)
+	case ProtoGRPC:
+		err = p.respondGRPC(d)
 	case ProtoQUIC:
 		err = p.respondQUIC(d)
 	case ProtoDNSCrypt:
@@ -228,6 +293,21 @@ func (p *Proxy) setMinMaxTTL(r *dns.Msg) {
 			rr.Header().Ttl = newTTL
 		}
 	}
+
+	if len(r.Question) != 1 || !isNegative(r) {
+		return
+	}
+
+	// Set the TTL of the SOA record to the negative TTL, so that the clients
+	// cache the negative response for the same time.
+	//
+	// See https://datatracker.ietf.org/doc/html/rfc2308#section-5.
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := negativeTTL(soa)
+			soa.Hdr.Ttl = respectTTLOverrides(ttl, p.CacheNegativeMinTTL, p.CacheNegativeMaxTTL)
+		}
+	}
 }
 
 func (p *Proxy) logDNSMessage(m *dns.Msg) {
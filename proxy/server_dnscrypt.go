@@ -38,6 +38,8 @@ func (p *Proxy) createDNSCryptListeners() (err error) {
 		log.Info("Creating a DNSCrypt UDP listener")
 		udpListen, lErr := net.ListenUDP("udp", a)
 		if lErr != nil {
+			p.reportListenerError(ProtoDNSCrypt, a, ListenerErrorBind, lErr)
+
 			return fmt.Errorf("listening to dnscrypt udp socket: %w", lErr)
 		}
 
@@ -46,9 +48,12 @@ func (p *Proxy) createDNSCryptListeners() (err error) {
 	}
 
 	for _, a := range p.DNSCryptTCPListenAddr {
+		a = sharedTCPAddr(a, p.DNSCryptUDPListenAddr, p.dnsCryptUDPListen)
 		log.Info("Creating a DNSCrypt TCP listener")
 		tcpListen, lErr := net.ListenTCP("tcp", a)
 		if lErr != nil {
+			p.reportListenerError(ProtoDNSCrypt, a, ListenerErrorBind, lErr)
+
 			return fmt.Errorf("listening to dnscrypt tcp socket: %w", lErr)
 		}
 
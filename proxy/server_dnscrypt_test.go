@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net"
 	"testing"
-	"time"
 
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/ameshkov/dnscrypt/v2"
@@ -14,18 +13,6 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func getFreePort() uint {
-	l, _ := net.Listen("tcp", "127.0.0.1:0")
-	port := uint(l.Addr().(*net.TCPAddr).Port)
-
-	// stop listening immediately
-	_ = l.Close()
-
-	// sleep for 100ms (may be necessary on Windows)
-	time.Sleep(100 * time.Millisecond)
-	return port
-}
-
 func createTestDNSCryptProxy(t *testing.T) (*Proxy, dnscrypt.ResolverConfig) {
 	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
 	assert.NoError(t, err)
@@ -33,13 +20,12 @@ func createTestDNSCryptProxy(t *testing.T) (*Proxy, dnscrypt.ResolverConfig) {
 	cert, err := rc.CreateCert()
 	assert.NoError(t, err)
 
-	port := getFreePort()
 	p := mustNew(t, &Config{
 		DNSCryptUDPListenAddr: []*net.UDPAddr{{
-			Port: int(port), IP: net.ParseIP(listenIP),
+			Port: 0, IP: net.ParseIP(listenIP),
 		}},
 		DNSCryptTCPListenAddr: []*net.TCPAddr{{
-			Port: int(port), IP: net.ParseIP(listenIP),
+			Port: 0, IP: net.ParseIP(listenIP),
 		}},
 		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
 		TrustedProxies:         defaultTrustedProxies,
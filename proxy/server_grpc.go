@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/internal/dnsgrpc"
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// createGRPCListeners creates the DNS-over-gRPC listeners and the server for
+// them.  The listeners use TLS if it's configured.
+func (p *Proxy) createGRPCListeners() (err error) {
+	if len(p.GRPCListenAddr) == 0 {
+		return nil
+	}
+
+	var hdlr http.Handler = http.HandlerFunc(p.serveGRPC)
+	if p.TLSConfig == nil {
+		hdlr = h2c.NewHandler(hdlr, &http2.Server{})
+	}
+
+	p.grpcServer = &http.Server{
+		Handler:           hdlr,
+		ReadHeaderTimeout: defaultTimeout,
+		WriteTimeout:      defaultTimeout,
+	}
+
+	for _, addr := range p.GRPCListenAddr {
+		tcpListen, lErr := net.ListenTCP("tcp", addr)
+		if lErr != nil {
+			p.reportListenerError(ProtoGRPC, addr, ListenerErrorBind, lErr)
+
+			return fmt.Errorf("failed to start grpc server on %s: %w", addr, lErr)
+		}
+
+		var l net.Listener = tcpListen
+		scheme := "grpc"
+		if p.TLSConfig != nil {
+			l = tls.NewListener(p.limitHandshakes(tcpListen), p.listenTLSConfig(http2.NextProtoTLS))
+			scheme = "grpcs"
+		}
+
+		log.Info("dnsproxy: listening to %s://%s", scheme, tcpListen.Addr())
+
+		p.grpcListen = append(p.grpcListen, l)
+	}
+
+	return nil
+}
+
+// serveGRPC handles the calls of the Query method of the DNS-over-gRPC
+// service.  The errors are reported with the gRPC statuses.
+func (p *Proxy) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	log.Debug("dnsproxy: incoming grpc request on %s", r.URL.Path)
+
+	if r.URL.Path != dnsgrpc.Path {
+		writeGRPCError(w, dnsgrpc.StatusUnimplemented, "unknown method")
+
+		return
+	} else if r.Method != http.MethodPost || r.Header.Get(httphdr.ContentType) != dnsgrpc.ContentType {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+
+		return
+	}
+
+	raddr, err := p.clientAddr(r)
+	if err != nil {
+		log.Debug("dnsproxy: warning: getting real ip: %s", err)
+	}
+
+	defer log.OnCloserError(r.Body, log.DEBUG)
+
+	data, err := dnsgrpc.ReadFrame(r.Body)
+	if err != nil {
+		log.Debug("dnsproxy: reading grpc request: %s", err)
+		writeGRPCError(w, dnsgrpc.StatusInvalidArgument, "bad request message")
+
+		return
+	}
+
+	req := &dns.Msg{}
+	if err = req.Unpack(data); err != nil {
+		log.Debug("dnsproxy: unpacking grpc msg: %s", err)
+		writeGRPCError(w, dnsgrpc.StatusInvalidArgument, "bad dns message")
+
+		return
+	}
+
+	d := p.newDNSContext(ProtoGRPC, req)
+	d.Addr = raddr
+	d.HTTPRequest = r
+	d.HTTPResponseWriter = w
+
+	err = p.handleDNSRequest(d)
+	if err != nil {
+		log.Debug("dnsproxy: handling dns (%s) request: %s", d.Proto, err)
+	}
+
+	if d.Res == nil {
+		// The request has been dropped, so respond with an error to not leave
+		// the client waiting.
+		writeGRPCError(w, dnsgrpc.StatusUnavailable, "no response")
+	}
+}
+
+// respondGRPC writes the response to the DNS-over-gRPC client.  It does nothing
+// if there is no response, since serveGRPC reports it.
+func (p *Proxy) respondGRPC(d *DNSContext) (err error) {
+	resp := d.Res
+	if resp == nil {
+		return nil
+	}
+
+	w := d.HTTPResponseWriter
+
+	packed, err := resp.Pack()
+	if err != nil {
+		writeGRPCError(w, dnsgrpc.StatusInternal, "packing response")
+
+		return fmt.Errorf("packing message: %w", err)
+	}
+
+	w.Header().Set(httphdr.ContentType, dnsgrpc.ContentType)
+	w.WriteHeader(http.StatusOK)
+
+	_, err = w.Write(dnsgrpc.AppendFrame(nil, packed))
+	w.Header().Set(http.TrailerPrefix+dnsgrpc.HdrStatus, dnsgrpc.StatusOK.String())
+
+	return err
+}
+
+// writeGRPCError writes the gRPC response without messages, which carries the
+// status in the headers.
+func writeGRPCError(w http.ResponseWriter, st dnsgrpc.Status, msg string) {
+	h := w.Header()
+	h.Set(httphdr.ContentType, dnsgrpc.ContentType)
+	h.Set(dnsgrpc.HdrStatus, st.String())
+	h.Set(dnsgrpc.HdrMessage, msg)
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_gRPC(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	dnsProxy := mustNew(t, &Config{
+		GRPCListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+	})
+
+	var gotCtx *DNSContext
+	dnsProxy.RequestHandler = func(_ *Proxy, d *DNSContext) (err error) {
+		gotCtx = d
+		if d.Req.Question[0].Name == "drop.example." {
+			return errors.Error("dropped")
+		}
+
+		return dnsProxy.Resolve(d)
+	}
+
+	ctx := context.Background()
+	err := dnsProxy.Start(ctx)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return dnsProxy.Shutdown(ctx) })
+
+	u, err := upstream.AddressToUpstream("grpc://"+dnsProxy.Addr(ProtoGRPC).String(), nil)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	t.Run("success", func(t *testing.T) {
+		msg := newTestMessage()
+
+		resp, uErr := u.Exchange(msg)
+		require.NoError(t, uErr)
+
+		assert.Equal(t, msg.Id, resp.Id)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Equal(t, ProtoGRPC, gotCtx.Proto)
+		assert.True(t, gotCtx.Addr.Addr().IsLoopback())
+	})
+
+	t.Run("dropped", func(t *testing.T) {
+		msg := newHostTestMessage("drop.example")
+
+		_, uErr := u.Exchange(msg)
+		testutil.AssertErrorMsg(
+			t,
+			"response from grpc://"+dnsProxy.Addr(ProtoGRPC).String()+": grpc status 14: no response",
+			uErr,
+		)
+	})
+}
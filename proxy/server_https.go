@@ -17,6 +17,7 @@ import (
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // listenHTTP creates instances of TLS listeners that will be used to run an
@@ -25,14 +26,14 @@ import (
 func (p *Proxy) listenHTTP(addr *net.TCPAddr) (laddr *net.TCPAddr, err error) {
 	tcpListen, err := net.ListenTCP("tcp", addr)
 	if err != nil {
+		p.reportListenerError(ProtoHTTPS, addr, ListenerErrorBind, err)
+
 		return nil, fmt.Errorf("tcp listener: %w", err)
 	}
 	log.Info("Listening to https://%s", tcpListen.Addr())
 
-	tlsConfig := p.TLSConfig.Clone()
-	tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
-
-	tlsListen := tls.NewListener(tcpListen, tlsConfig)
+	tlsConfig := p.listenTLSConfig(http2.NextProtoTLS, "http/1.1")
+	tlsListen := tls.NewListener(p.limitHandshakes(tcpListen), tlsConfig)
 	p.httpsListen = append(p.httpsListen, tlsListen)
 
 	return tcpListen.Addr().(*net.TCPAddr), nil
@@ -41,9 +42,19 @@ func (p *Proxy) listenHTTP(addr *net.TCPAddr) (laddr *net.TCPAddr, err error) {
 // listenH3 creates instances of QUIC listeners that will be used for running
 // an HTTP/3 server.
 func (p *Proxy) listenH3(addr *net.UDPAddr) (err error) {
-	tlsConfig := p.TLSConfig.Clone()
-	tlsConfig.NextProtos = []string{"h3"}
-	quicListen, err := quic.ListenAddrEarly(addr.String(), tlsConfig, newServerQUICConfig())
+	conn, err := p.listenQUICConn(addr)
+	if err != nil {
+		p.reportListenerError(ProtoHTTPS, addr, ListenerErrorBind, err)
+
+		return fmt.Errorf("listening to %s: %w", addr, err)
+	}
+
+	// Unlike [quic.ListenAddrEarly], the listener doesn't close conn, so close
+	// it along with the DoQ ones.
+	p.quicConns = append(p.quicConns, conn)
+
+	tlsConfig := p.listenTLSConfig("h3")
+	quicListen, err := quic.ListenEarly(conn, tlsConfig, p.newServerQUICConfig())
 	if err != nil {
 		return fmt.Errorf("quic listener: %w", err)
 	}
@@ -90,6 +101,34 @@ func (p *Proxy) createHTTPSListeners() (err error) {
 	return nil
 }
 
+// createHTTPListeners creates the plain HTTP listeners and the server for them.
+func (p *Proxy) createHTTPListeners() (err error) {
+	if len(p.HTTPListenAddr) == 0 {
+		return nil
+	}
+
+	p.httpServer = &http.Server{
+		Handler:           h2c.NewHandler(p, &http2.Server{}),
+		ReadHeaderTimeout: defaultTimeout,
+		WriteTimeout:      defaultTimeout,
+	}
+
+	for _, addr := range p.HTTPListenAddr {
+		l, lErr := net.ListenTCP("tcp", addr)
+		if lErr != nil {
+			p.reportListenerError(ProtoHTTP, addr, ListenerErrorBind, lErr)
+
+			return fmt.Errorf("failed to start HTTP server on %s: %w", addr, lErr)
+		}
+
+		log.Info("dnsproxy: listening to http://%s", l.Addr())
+
+		p.httpListen = append(p.httpListen, l)
+	}
+
+	return nil
+}
+
 // ServeHTTP is the http.Handler implementation that handles DoH queries.
 // Here is what it returns:
 //
@@ -100,7 +139,7 @@ func (p *Proxy) createHTTPSListeners() (err error) {
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Debug("dnsproxy: incoming https request on %s", r.URL)
 
-	raddr, prx, err := remoteAddr(r)
+	raddr, err := p.clientAddr(r)
 	if err != nil {
 		log.Debug("dnsproxy: warning: getting real ip: %s", err)
 	}
@@ -154,19 +193,16 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	d := p.newDNSContext(ProtoHTTPS, req)
+	proto := ProtoHTTPS
+	if r.TLS == nil {
+		proto = ProtoHTTP
+	}
+
+	d := p.newDNSContext(proto, req)
 	d.Addr = raddr
 	d.HTTPRequest = r
 	d.HTTPResponseWriter = w
-
-	if prx.IsValid() {
-		log.Debug("dnsproxy: request came from proxy server %s", prx)
-
-		if !p.TrustedProxies.Contains(prx.Addr()) {
-			log.Debug("dnsproxy: proxy %s is not trusted, using original remote addr", prx)
-			d.Addr = prx
-		}
-	}
+	p.setVirtualResolver(d, requestServerName(r))
 
 	err = p.handleDNSRequest(d)
 	if err != nil {
@@ -238,6 +274,27 @@ func (p *Proxy) respondHTTPS(d *DNSContext) (err error) {
 	return err
 }
 
+// clientAddr returns the address of the client that sent r.  The headers
+// describing the client are only taken into account if the request came
+// directly from one of the trusted proxies, so that the clients can't spoof
+// their addresses.
+func (p *Proxy) clientAddr(r *http.Request) (addr netip.AddrPort, err error) {
+	addr, prx, err := remoteAddr(r)
+	if err != nil || !prx.IsValid() {
+		return addr, err
+	}
+
+	log.Debug("dnsproxy: request came from proxy server %s", prx)
+
+	if p.TrustedProxies == nil || !p.TrustedProxies.Contains(prx.Addr()) {
+		log.Debug("dnsproxy: proxy %s is not trusted, using original remote addr", prx)
+
+		return prx, nil
+	}
+
+	return addr, nil
+}
+
 // realIPFromHdrs extracts the actual client's IP address from the first
 // suitable r's header.  It returns an error if r doesn't contain any
 // information about real client's IP address.  Current headers priority is:
@@ -246,6 +303,7 @@ func (p *Proxy) respondHTTPS(d *DNSContext) (err error) {
 //  2. [httphdr.TrueClientIP]
 //  3. [httphdr.XRealIP]
 //  4. [httphdr.XForwardedFor]
+//  5. [httphdr.Forwarded]
 func realIPFromHdrs(r *http.Request) (realIP netip.Addr, err error) {
 	for _, h := range []string{
 		httphdr.CFConnectingIP,
@@ -264,7 +322,46 @@ func realIPFromHdrs(r *http.Request) (realIP netip.Addr, err error) {
 		xff = xff[:firstComma]
 	}
 
-	return netip.ParseAddr(strings.TrimSpace(xff))
+	realIP, err = netip.ParseAddr(strings.TrimSpace(xff))
+	if err == nil {
+		return realIP, nil
+	}
+
+	fwd := r.Header.Get(httphdr.Forwarded)
+	if fwd == "" {
+		return netip.Addr{}, err
+	}
+
+	return forwardedFor(fwd)
+}
+
+// forwardedFor returns the IP address from the "for" parameter of the first
+// element of the Forwarded header value as defined by RFC 7239.  Obfuscated
+// identifiers and "unknown" aren't supported.
+func forwardedFor(fwd string) (ip netip.Addr, err error) {
+	elem, _, _ := strings.Cut(fwd, ",")
+	for _, pair := range strings.Split(elem, ";") {
+		name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !strings.EqualFold(name, "for") {
+			continue
+		}
+
+		val = strings.Trim(val, `"`)
+		if strings.HasPrefix(val, "[") || strings.Count(val, ":") == 1 {
+			var ap netip.AddrPort
+			ap, err = netip.ParseAddrPort(val)
+			if err == nil {
+				return ap.Addr(), nil
+			}
+
+			// The port is optional for the IPv6 addresses in brackets.
+			val = strings.TrimSuffix(strings.TrimPrefix(val, "["), "]")
+		}
+
+		return netip.ParseAddr(val)
+	}
+
+	return netip.Addr{}, fmt.Errorf("no for parameter in forwarded header %q", fwd)
 }
 
 // remoteAddr returns the real client's address and the IP address of the latest
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -14,12 +15,15 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
 )
 
 func TestHttpsProxy(t *testing.T) {
@@ -127,6 +131,98 @@ func TestProxy_trustedProxies(t *testing.T) {
 	})
 }
 
+func TestProxy_plainHTTP(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	dnsProxy := mustNew(t, &Config{
+		HTTPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: netip.MustParsePrefix("127.0.0.1/32"),
+	})
+
+	var gotCtx *DNSContext
+	dnsProxy.RequestHandler = func(_ *Proxy, d *DNSContext) (err error) {
+		gotCtx = d
+
+		return dnsProxy.Resolve(d)
+	}
+
+	ctx := context.Background()
+	err := dnsProxy.Start(ctx)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return dnsProxy.Shutdown(ctx) })
+
+	clientAddr := netip.MustParseAddr("1.2.3.4")
+
+	testCases := []struct {
+		transport http.RoundTripper
+		name      string
+		wantMajor int
+	}{{
+		transport: &http.Transport{},
+		name:      "http1",
+		wantMajor: 1,
+	}, {
+		transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(
+				ctx context.Context,
+				network string,
+				addr string,
+				_ *tls.Config,
+			) (conn net.Conn, err error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+		name:      "h2c",
+		wantMajor: 2,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := newTestMessage()
+			packed, err := msg.Pack()
+			require.NoError(t, err)
+
+			u := &url.URL{
+				Scheme: "http",
+				Host:   dnsProxy.Addr(ProtoHTTP).String(),
+				Path:   "/dns-query",
+			}
+
+			req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(packed))
+			require.NoError(t, err)
+
+			req.Header.Set("Content-Type", "application/dns-message")
+			req.Header.Set("X-Forwarded-For", clientAddr.String())
+
+			client := &http.Client{Transport: tc.transport}
+			httpResp, err := client.Do(req)
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, httpResp.Body.Close)
+
+			assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+			assert.Equal(t, tc.wantMajor, httpResp.ProtoMajor)
+
+			body, err := io.ReadAll(httpResp.Body)
+			require.NoError(t, err)
+
+			resp := &dns.Msg{}
+			require.NoError(t, resp.Unpack(body))
+
+			assert.Equal(t, msg.Id, resp.Id)
+			assert.Equal(t, ProtoHTTP, gotCtx.Proto)
+			assert.Equal(t, clientAddr, gotCtx.Addr.Addr())
+		})
+	}
+}
+
 func TestAddrsFromRequest(t *testing.T) {
 	var (
 		theIP     = netip.AddrFrom4([4]byte{1, 2, 3, 4})
@@ -223,6 +319,42 @@ func TestAddrsFromRequest(t *testing.T) {
 		},
 		wantIP:  theIP,
 		wantErr: "",
+	}, {
+		name: "forwarded",
+		hdrs: map[string]string{
+			"Forwarded": "for=" + theIPStr + ";proto=https, for=" + anotherIPStr,
+		},
+		wantIP:  theIP,
+		wantErr: "",
+	}, {
+		name: "forwarded_ipv6",
+		hdrs: map[string]string{
+			"Forwarded": `proto=https;For="[2001:db8::1]:4711"`,
+		},
+		wantIP:  netip.MustParseAddr("2001:db8::1"),
+		wantErr: "",
+	}, {
+		name: "forwarded_ipv4_port",
+		hdrs: map[string]string{
+			"Forwarded": `for="` + theIPStr + `:4711"`,
+		},
+		wantIP:  theIP,
+		wantErr: "",
+	}, {
+		name: "forwarded_priority",
+		hdrs: map[string]string{
+			"X-Forwarded-For": theIPStr,
+			"Forwarded":       "for=" + anotherIPStr,
+		},
+		wantIP:  theIP,
+		wantErr: "",
+	}, {
+		name: "forwarded_no_for",
+		hdrs: map[string]string{
+			"Forwarded": "proto=https",
+		},
+		wantIP:  netip.Addr{},
+		wantErr: `no for parameter in forwarded header "proto=https"`,
 	}}
 
 	for _, tc := range testCases {
@@ -243,6 +375,48 @@ func TestAddrsFromRequest(t *testing.T) {
 	}
 }
 
+func TestProxy_clientAddr(t *testing.T) {
+	var (
+		clientAddr = netip.MustParseAddrPort("1.2.3.4:0")
+		peerAddr   = netip.MustParseAddrPort("192.0.2.1:1234")
+	)
+
+	r, err := http.NewRequest(http.MethodGet, "localhost", nil)
+	require.NoError(t, err)
+
+	r.RemoteAddr = peerAddr.String()
+	r.Header.Set("Forwarded", "for="+clientAddr.Addr().String())
+
+	testCases := []struct {
+		trusted  netutil.SubnetSet
+		name     string
+		wantAddr netip.AddrPort
+	}{{
+		trusted:  nil,
+		name:     "nil",
+		wantAddr: peerAddr,
+	}, {
+		trusted:  netip.MustParsePrefix("198.51.100.0/24"),
+		name:     "not_trusted",
+		wantAddr: peerAddr,
+	}, {
+		trusted:  netip.MustParsePrefix("192.0.2.0/24"),
+		name:     "trusted",
+		wantAddr: clientAddr,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: Config{TrustedProxies: tc.trusted}}
+
+			addr, addrErr := p.clientAddr(r)
+			require.NoError(t, addrErr)
+
+			assert.Equal(t, tc.wantAddr, addr)
+		})
+	}
+}
+
 func TestRemoteAddr(t *testing.T) {
 	const thePort = 4321
 
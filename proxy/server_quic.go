@@ -14,7 +14,6 @@ import (
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/bluele/gcache"
-	"github.com/bruceluk/dnsproxy/internal/bootstrap"
 	"github.com/bruceluk/dnsproxy/proxyutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
@@ -28,8 +27,22 @@ const NextProtoDQ = "doq"
 
 // compatProtoDQ is a list of ALPN tokens used by a QUIC connection.
 // NextProtoDQ is the latest draft version supported by dnsproxy, but it also
-// includes previous drafts.
-var compatProtoDQ = []string{NextProtoDQ, "doq-i02", "doq-i00", "dq"}
+// includes previous drafts.  The tokens are sorted from the newest version to
+// the oldest one, so that the newest version supported by the client is
+// selected.
+var compatProtoDQ = []string{NextProtoDQ, "doq-i11", "doq-i02", "doq-i00", "dq"}
+
+// isUnprefixedProtoDQ returns true if the DoQ version with the ALPN token proto
+// sends the DNS messages without the 2-octet length prefix.  The prefix has
+// been introduced in the draft version 03.
+func isUnprefixedProtoDQ(proto string) (ok bool) {
+	switch proto {
+	case "doq-i02", "doq-i00", "dq":
+		return true
+	default:
+		return false
+	}
+}
 
 // maxQUICIdleTimeout is maximum QUIC idle timeout.  The default value in
 // quic-go is 30 seconds, but our internal tests show that a higher value works
@@ -66,8 +79,10 @@ func (p *Proxy) createQUICListeners() error {
 	for _, a := range p.QUICListenAddr {
 		log.Info("creating listener quic://%s", a)
 
-		conn, err := net.ListenUDP(bootstrap.NetworkUDP, a)
+		conn, err := p.listenQUICConn(a)
 		if err != nil {
+			p.reportListenerError(ProtoQUIC, a, ListenerErrorBind, err)
+
 			return fmt.Errorf("listening to %s: %w", a, err)
 		}
 
@@ -83,7 +98,7 @@ func (p *Proxy) createQUICListeners() error {
 		tlsConfig.NextProtos = compatProtoDQ
 		quicListen, err := transport.ListenEarly(
 			tlsConfig,
-			newServerQUICConfig(),
+			p.newServerQUICConfig(),
 		)
 		if err != nil {
 			return fmt.Errorf("quic listener: %w", err)
@@ -110,6 +125,7 @@ func (p *Proxy) quicPacketLoop(l *quic.EarlyListener, reqSema syncutil.Semaphore
 				log.Debug("accepting quic conn: closed or timed out: %s", err)
 			} else {
 				log.Error("accepting quic conn: %s", err)
+				p.reportListenerError(ProtoQUIC, l.Addr(), ListenerErrorAccept, err)
 			}
 
 			break
@@ -148,6 +164,7 @@ func (p *Proxy) handleQUICConnection(conn quic.Connection, reqSema syncutil.Sema
 				log.Debug("accepting quic stream: closed or timed out: %s", err)
 			} else {
 				log.Error("accepting quic stream: %s", err)
+				p.reportListenerError(ProtoQUIC, conn.LocalAddr(), ListenerErrorQUIC, err)
 			}
 
 			// Close the connection to make sure resources are freed.
@@ -203,17 +220,18 @@ func (p *Proxy) handleQUICStream(stream quic.Stream, conn quic.Connection) {
 		return
 	}
 
-	// In theory, we should use ALPN to get the DoQ version properly. However,
-	// since there are not too many versions now, we only check how the DNS
-	// query is encoded. If it's sent with a 2-byte prefix, we consider this a
-	// DoQ v1. Otherwise, a draft version.
+	// The old drafts are detected by ALPN.  Otherwise, we check how the DNS
+	// query is encoded, since some clients don't follow the negotiated
+	// version.  If it's sent with a 2-byte prefix, we consider this a DoQ v1.
+	// Otherwise, a draft version.
 	doqVersion := DoQv1
 	req := &dns.Msg{}
 
 	// Note that we support both the old drafts and the new RFC. In the old
 	// draft DNS messages were not prefixed with the message length.
+	unprefixed := isUnprefixedProtoDQ(conn.ConnectionState().TLS.NegotiatedProtocol)
 	packetLen := binary.BigEndian.Uint16(buf[:2])
-	if packetLen == uint16(n-2) {
+	if !unprefixed && packetLen == uint16(n-2) {
 		err = req.Unpack(buf[2:])
 	} else {
 		err = req.Unpack(buf)
@@ -407,14 +425,16 @@ func closeQUICConn(conn quic.Connection, code quic.ApplicationErrorCode) {
 }
 
 // newServerQUICConfig creates *quic.Config populated with the default settings.
-// This function is supposed to be used for both DoQ and DoH3 server.
-func newServerQUICConfig() (conf *quic.Config) {
+// This function is supposed to be used for both DoQ and DoH3 server.  The ECN
+// marks of the received packets are counted, see [Proxy.QUICECNStats].
+func (p *Proxy) newServerQUICConfig() (conf *quic.Config) {
 	return &quic.Config{
 		MaxIdleTimeout:        maxQUICIdleTimeout,
 		MaxIncomingStreams:    math.MaxUint16,
 		MaxIncomingUniStreams: math.MaxUint16,
 		// Enable 0-RTT by default for all connections on the server-side.
 		Allow0RTT: true,
+		Tracer:    p.quicECN.newTracer(),
 	}
 }
 
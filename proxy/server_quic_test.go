@@ -86,6 +86,82 @@ func TestQuicProxy(t *testing.T) {
 	})
 }
 
+func TestQuicProxy_drafts(t *testing.T) {
+	serverConfig, caPem := newTLSConfig(t)
+	dnsProxy := mustNew(t, &Config{
+		QUICListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TLSConfig:      serverConfig,
+		UpstreamConfig: newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies: defaultTrustedProxies,
+		// Make sure the request does not go to any real upstream.
+		RequestHandler: func(_ *Proxy, d *DNSContext) (err error) {
+			resp := (&dns.Msg{}).SetReply(d.Req)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   d.Req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+				},
+				A: net.IP{8, 8, 8, 8},
+			}}
+			d.Res = resp
+
+			return nil
+		},
+	})
+
+	ctx := context.Background()
+	err := dnsProxy.Start(ctx)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return dnsProxy.Shutdown(ctx) })
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+
+	testCases := []struct {
+		name        string
+		wantProto   string
+		clientProto []string
+		wantVersion DoQVersion
+	}{{
+		name:        "newest_common",
+		wantProto:   "doq-i11",
+		clientProto: []string{"doq-i00", "doq-i11", "doq-i02"},
+		wantVersion: DoQv1,
+	}, {
+		name:        "rfc",
+		wantProto:   NextProtoDQ,
+		clientProto: []string{"doq-i02", NextProtoDQ},
+		wantVersion: DoQv1,
+	}, {
+		name:        "unprefixed_draft",
+		wantProto:   "doq-i02",
+		clientProto: []string{"doq-i02"},
+		wantVersion: DoQv1Draft,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tlsConfig := &tls.Config{
+				ServerName: tlsServerName,
+				RootCAs:    roots,
+				NextProtos: tc.clientProto,
+			}
+
+			addr := dnsProxy.Addr(ProtoQUIC)
+			conn, dialErr := quic.DialAddrEarly(ctx, addr.String(), tlsConfig, nil)
+			require.NoError(t, dialErr)
+			testutil.CleanupAndRequireSuccess(t, func() (err error) {
+				return conn.CloseWithError(DoQCodeNoError, "")
+			})
+
+			require.Equal(t, tc.wantProto, conn.ConnectionState().TLS.NegotiatedProtocol)
+
+			sendTestQUICMessage(t, conn, tc.wantVersion)
+		})
+	}
+}
+
 func TestQuicProxy_largePackets(t *testing.T) {
 	serverConfig, caPem := newTLSConfig(t)
 	dnsProxy := mustNew(t, &Config{
@@ -19,37 +19,66 @@ import (
 
 func (p *Proxy) createTCPListeners(ctx context.Context) (err error) {
 	for _, a := range p.TCPListenAddr {
-		log.Info("dnsproxy: creating tcp server socket %s", a)
+		a = sharedTCPAddr(a, p.UDPListenAddr, p.udpListen)
 
-		lsnr, lErr := proxynetutil.ListenConfig().Listen(ctx, "tcp", a.String())
-		if lErr != nil {
-			return fmt.Errorf("listening to tcp socket: %w", lErr)
-		}
+		tcpListener, tErr := p.tcpCreate(ctx, a)
+		if tErr != nil {
+			p.reportListenerError(ProtoTCP, a, ListenerErrorBind, tErr)
 
-		tcpListener, ok := lsnr.(*net.TCPListener)
-		if !ok {
-			return fmt.Errorf("wrong listener type on tcp addr %s: %T", a, lsnr)
+			// Don't wrap the error since it's informative enough as is.
+			return tErr
 		}
 
 		p.tcpListen = append(p.tcpListen, tcpListener)
-
-		log.Info("dnsproxy: listening to tcp://%s", tcpListener.Addr())
 	}
 
 	return nil
 }
 
-func (p *Proxy) createTLSListeners() (err error) {
+// tcpCreate creates a TCP listening socket bound to a.
+func (p *Proxy) tcpCreate(ctx context.Context, a *net.TCPAddr) (l *net.TCPListener, err error) {
+	log.Info("dnsproxy: creating tcp server socket %s", a)
+
+	lc := proxynetutil.ListenConfig()
+	if p.TCPFastOpen {
+		lc = proxynetutil.ListenConfigFastOpen()
+	}
+
+	lsnr, err := lc.Listen(ctx, "tcp", a.String())
+	if err != nil {
+		return nil, fmt.Errorf("listening to tcp socket: %w", err)
+	}
+
+	l, ok := lsnr.(*net.TCPListener)
+	if !ok {
+		_ = lsnr.Close()
+
+		return nil, fmt.Errorf("wrong listener type on tcp addr %s: %T", a, lsnr)
+	}
+
+	log.Info("dnsproxy: listening to tcp://%s", l.Addr())
+
+	return l, nil
+}
+
+func (p *Proxy) createTLSListeners(ctx context.Context) (err error) {
+	lc := &net.ListenConfig{}
+	if p.TCPFastOpen {
+		lc.Control = proxynetutil.ListenControlFastOpen()
+	}
+
 	for _, a := range p.TLSListenAddr {
 		log.Info("dnsproxy: creating tls server socket %s", a)
 
-		var tcpListen *net.TCPListener
-		tcpListen, err = net.ListenTCP("tcp", a)
+		var tcpListen net.Listener
+		tcpListen, err = lc.Listen(ctx, "tcp", a.String())
 		if err != nil {
+			p.reportListenerError(ProtoTLS, a, ListenerErrorBind, err)
+
 			return fmt.Errorf("listening on tls addr %s: %w", a, err)
 		}
 
-		l := tls.NewListener(tcpListen, p.TLSConfig)
+		l := tls.NewListener(p.limitHandshakes(tcpListen), p.listenTLSConfig())
 		p.tlsListen = append(p.tlsListen, l)
 
 		log.Info("dnsproxy: listening to tls://%s", l.Addr())
@@ -72,11 +101,16 @@ func (p *Proxy) tcpPacketLoop(l net.Listener, proto Proto, reqSema syncutil.Sema
 				log.Debug("dnsproxy: tcp connection %s closed", l.Addr())
 			} else {
 				log.Error("dnsproxy: reading from tcp: %s", err)
+				p.reportListenerError(proto, l.Addr(), ListenerErrorAccept, err)
 			}
 
 			break
 		}
 
+		if p.TCPFastOpen && proxynetutil.FastOpenUsed(clientConn) {
+			p.fastOpenAccepted.Add(1)
+		}
+
 		// TODO(d.kolyshev): Pass and use context from above.
 		err = reqSema.Acquire(context.Background())
 		if err != nil {
@@ -106,6 +140,10 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto Proto) {
 		}
 	}()
 
+	if tlsConn, ok := conn.(*tls.Conn); ok && p.handshakeTLS(tlsConn, proto) != nil {
+		return
+	}
+
 	for {
 		p.RLock()
 		if !p.started {
@@ -137,6 +175,9 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto Proto) {
 		d := p.newDNSContext(proto, req)
 		d.Addr = netutil.NetAddrToAddrPort(conn.RemoteAddr())
 		d.Conn = conn
+		if proto == ProtoTLS {
+			p.setVirtualResolver(d, connServerName(conn))
+		}
 
 		err = p.handleDNSRequest(d)
 		if err != nil {
@@ -174,15 +215,33 @@ func readPrefixed(conn net.Conn) (b []byte, err error) {
 // logWithNonCrit logs the error on the appropriate level depending on whether
 // err is a critical error or not.
 func logWithNonCrit(err error, msg string) {
-	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isEPIPE(err) {
+	if isConnClosed(err) {
 		log.Debug("%s: connection is closed; original error: %s", msg, err)
-	} else if netErr := net.Error(nil); errors.As(err, &netErr) && netErr.Timeout() {
+	} else if isTimeout(err) {
 		log.Debug("%s: connection timed out; original error: %s", msg, err)
 	} else {
 		log.Error("%s: %s", msg, err)
 	}
 }
 
+// isNonCritical returns true if err only means that the connection has been
+// closed or has timed out.
+func isNonCritical(err error) (ok bool) {
+	return isConnClosed(err) || isTimeout(err)
+}
+
+// isConnClosed returns true if err means that the connection has been closed.
+func isConnClosed(err error) (ok bool) {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isEPIPE(err)
+}
+
+// isTimeout returns true if err is a network timeout.
+func isTimeout(err error) (ok bool) {
+	netErr := net.Error(nil)
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 // Writes a response to the TCP (or TLS) client
 func (p *Proxy) respondTCP(d *DNSContext) error {
 	resp := d.Res
@@ -19,6 +19,8 @@ func (p *Proxy) createUDPListeners(ctx context.Context) (err error) {
 		var pc *net.UDPConn
 		pc, sErr := p.udpCreate(ctx, a)
 		if sErr != nil {
+			p.reportListenerError(ProtoUDP, a, ListenerErrorBind, sErr)
+
 			return fmt.Errorf("listening on udp addr %s: %w", a, sErr)
 		}
 
@@ -49,9 +51,15 @@ func (p *Proxy) udpCreate(ctx context.Context, udpAddr *net.UDPAddr) (*net.UDPCo
 
 	err = proxynetutil.UDPSetOptions(udpListen)
 	if err != nil {
-		_ = udpListen.Close()
+		if proxynetutil.Capabilities().PktInfo {
+			_ = udpListen.Close()
 
-		return nil, fmt.Errorf("setting udp opts: %w", err)
+			return nil, fmt.Errorf("setting udp opts: %w", err)
+		}
+
+		// The destination addresses of the requests are only needed to respond
+		// from the same address when listening on an unspecified one.
+		log.Info("dnsproxy: warning: udp destination addresses not supported: %s", err)
 	}
 
 	log.Info("dnsproxy: listening to udp://%s", udpListen.LocalAddr())
@@ -99,6 +107,7 @@ func (p *Proxy) udpPacketLoop(conn *net.UDPConn, reqSema syncutil.Semaphore) {
 				log.Debug("dnsproxy: udp connection %s closed", conn.LocalAddr())
 			} else {
 				log.Error("dnsproxy: reading from udp: %s", err)
+				p.reportListenerError(ProtoUDP, conn.LocalAddr(), ListenerErrorRead, err)
 			}
 
 			break
@@ -106,7 +115,9 @@ func (p *Proxy) udpPacketLoop(conn *net.UDPConn, reqSema syncutil.Semaphore) {
 	}
 }
 
-// udpHandlePacket processes the incoming UDP packet and sends a DNS response
+// udpHandlePacket processes the incoming UDP packet and sends a DNS response.
+// The retransmissions of a query being resolved are answered with the same
+// response once it's ready.
 func (p *Proxy) udpHandlePacket(
 	packet []byte,
 	localIP netip.Addr,
@@ -128,6 +139,17 @@ func (p *Proxy) udpHandlePacket(
 	d.Conn = conn
 	d.localIP = localIP
 
+	k, ok := newUDPQueryKey(d)
+	if ok {
+		if !p.udpInflight.start(k, d) {
+			log.Debug("dnsproxy: udp retransmission from %s; waiting for resolution", d.Addr)
+
+			return
+		}
+
+		defer func() { p.respondRetransmits(d, p.udpInflight.finish(k)) }()
+	}
+
 	err = p.handleDNSRequest(d)
 	if err != nil {
 		log.Debug("dnsproxy: handling dns (proto %s) request: %s", d.Proto, err)
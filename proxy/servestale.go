@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"cmp"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+const (
+	// defaultCacheStaleTTL is the default TTL of the stale responses, see
+	// [Config.CacheStaleTTL].  It's the value recommended by RFC 8767.
+	defaultCacheStaleTTL = 30 * time.Second
+
+	// staleRefreshInterval is the minimum time between the background refreshes
+	// of a stale item after the upstreams have failed to resolve it.  It's the
+	// failure recheck timer of RFC 8767.
+	staleRefreshInterval = 30 * time.Second
+)
+
+// staleResponse is an expired cached response kept in case the upstreams fail
+// to resolve the request.
+type staleResponse struct {
+	// item is the expired cache item.
+	item *cacheItem
+
+	// cache is the cache item is taken from.
+	cache *cache
+
+	// key is the key of item in cache.
+	key []byte
+}
+
+// validateServeStale returns an error if the serve-stale configuration of c is
+// invalid.
+func (c *Config) validateServeStale() (err error) {
+	switch {
+	case c.CacheServeStale < 0:
+		return errors.Error("negative max staleness")
+	case c.CacheStaleTTL < 0:
+		return errors.Error("negative stale ttl")
+	default:
+		return nil
+	}
+}
+
+// setServeStale makes c return the items expired no longer than staleMax ago
+// with ttl, or with [defaultCacheStaleTTL] if ttl is zero.
+func (c *cache) setServeStale(staleMax, ttl time.Duration) {
+	c.staleMax = staleMax
+	c.staleTTL = max(uint32(cmp.Or(ttl, defaultCacheStaleTTL)/time.Second), 1)
+	c.staleRefreshes = gocache.New(staleMax, staleMax)
+	c.staleLock = &sync.Mutex{}
+}
+
+// isStale returns true if the item expired at expire may still be returned at
+// now.  Both are Unix times in seconds.
+func (c *cache) isStale(expire, now int64) (ok bool) {
+	return c.staleMax > 0 && now-expire < int64(c.staleMax/time.Second)
+}
+
+// failingStale returns true if the upstreams have recently failed to resolve
+// the stale item with key, so that it should be served right away.  refresh is
+// true if the item should be refreshed in background at now.
+func (c *cache) failingStale(key []byte, now time.Time) (failing, refresh bool) {
+	c.staleLock.Lock()
+	defer c.staleLock.Unlock()
+
+	v, ok := c.staleRefreshes.Get(string(key))
+	if !ok {
+		return false, false
+	}
+
+	if now.Before(v.(time.Time)) {
+		return true, false
+	}
+
+	c.staleRefreshes.SetDefault(string(key), now.Add(staleRefreshInterval))
+
+	return true, true
+}
+
+// setStaleFailed records that the upstreams have failed to resolve the stale
+// item with key at now.
+func (c *cache) setStaleFailed(key []byte, now time.Time) {
+	c.staleLock.Lock()
+	defer c.staleLock.Unlock()
+
+	c.staleRefreshes.SetDefault(string(key), now.Add(staleRefreshInterval))
+}
+
+// setStaleRefreshed records that the stale item with key has been refreshed.
+func (c *cache) setStaleRefreshed(key []byte) {
+	c.staleLock.Lock()
+	defer c.staleLock.Unlock()
+
+	c.staleRefreshes.Delete(string(key))
+}
+
+// clearStale forgets the failures of the stale items, if c serves them.
+func (c *cache) clearStale() {
+	if c.staleRefreshes == nil {
+		return
+	}
+
+	c.staleLock.Lock()
+	defer c.staleLock.Unlock()
+
+	c.staleRefreshes.Flush()
+}
+
+// holdStale keeps the stale item ci with key from c in d to serve it if the
+// upstreams fail to resolve the request.  If they have recently failed, ci is
+// served right away, the request is resolved in background to refresh it, and
+// served is true.
+func (p *Proxy) holdStale(d *DNSContext, c *cache, ci *cacheItem, key []byte) (served bool) {
+	d.stale = &staleResponse{
+		item:  ci,
+		cache: c,
+		key:   key,
+	}
+
+	failing, refresh := c.failingStale(key, p.time.Now())
+	if !failing {
+		return false
+	}
+
+	log.Debug("dnsproxy: cache: upstreams failed recently; serving stale response")
+
+	p.serveStale(d)
+	if refresh {
+		go p.refreshStale(cloneForRefresh(d), c, key)
+	}
+
+	return true
+}
+
+// replyFromStale serves the stale response held in d if the upstreams have
+// failed to resolve the request with err or with a SERVFAIL response.  It
+// returns true if the stale response is served.
+func (p *Proxy) replyFromStale(d *DNSContext, err error) (served bool) {
+	s := d.stale
+	if s == nil || (err == nil && d.Res != nil && d.Res.Rcode != dns.RcodeServerFailure) {
+		return false
+	}
+
+	log.Debug("dnsproxy: cache: upstreams failed: %v; serving stale response", err)
+
+	s.cache.setStaleFailed(s.key, p.time.Now())
+	p.serveStale(d)
+
+	return true
+}
+
+// serveStale sets the stale response held in d as the response.
+func (p *Proxy) serveStale(d *DNSContext) {
+	ci := d.stale.item
+
+	d.Res = ci.m
+	d.Upstream = nil
+	d.CachedUpstreamAddr = ci.u
+	d.Provenance = Provenance{
+		Source: SourceCache,
+		Stale:  true,
+	}
+	d.Provenance.setUpstreamAddr(ci.u)
+}
+
+// refreshStale resolves the request from d to refresh the stale item with key
+// in c.  It's intended to be used as a goroutine.  Do not pass the *DNSContext
+// which is used elsewhere since it isn't intended to be used concurrently.
+func (p *Proxy) refreshStale(d *DNSContext, c *cache, key []byte) {
+	defer log.OnPanic("dnsproxy: cache: refreshing stale response")
+
+	ok, err := p.replyFromUpstream(d)
+	if err != nil || !ok || d.Res.Rcode == dns.RcodeServerFailure {
+		log.Debug("dnsproxy: cache: refreshing stale response: upstreams failed: %v", err)
+
+		return
+	}
+
+	p.cacheResp(d)
+	c.setStaleRefreshed(key)
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_serveStale(t *testing.T) {
+	const host = "example.org."
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   net.IP{192, 0, 2, 1},
+	}}
+
+	c := newCache(testCacheSize, false, false)
+	c.setServeStale(time.Hour, 0)
+
+	testCases := []struct {
+		name      string
+		expiredAt time.Duration
+		wantTTL   uint32
+	}{{
+		name:      "stale",
+		expiredAt: -time.Minute,
+		wantTTL:   uint32(defaultCacheStaleTTL / time.Second),
+	}, {
+		name:      "too_stale",
+		expiredAt: -2 * time.Hour,
+		wantTTL:   0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key := msgToKey(req, false)
+			data := (&cacheItem{m: resp, u: testUpsAddr}).pack()
+			expire := time.Now().Add(tc.expiredAt).Unix()
+			binary.BigEndian.PutUint32(data, uint32(expire))
+
+			c.items.set(key, data)
+			t.Cleanup(c.items.clear)
+
+			ci, expired, _ := c.get(req, false)
+			assert.True(t, expired)
+
+			if tc.wantTTL == 0 {
+				assert.Nil(t, ci)
+				assert.Nil(t, c.items.get(key))
+
+				return
+			}
+
+			require.NotNil(t, ci)
+			require.Len(t, ci.m.Answer, 1)
+
+			assert.Equal(t, tc.wantTTL, ci.m.Answer[0].Header().Ttl)
+		})
+	}
+}
+
+func TestProxy_Resolve_serveStale(t *testing.T) {
+	const (
+		host   = "example.org."
+		ttl    = 60
+		upsErr = errors.Error("unreachable")
+	)
+
+	var failing atomic.Bool
+	exchanged := make(chan unit, 1)
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			defer func() { exchanged <- unit{} }()
+
+			if failing.Load() {
+				return nil, upsErr
+			}
+
+			resp = (&dns.Msg{}).SetReply(m)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   host,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				A: net.IP{192, 0, 2, 2},
+			}}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr:   []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:  &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:  defaultTrustedProxies,
+		CacheEnabled:    true,
+		CacheSizeBytes:  testCacheSize,
+		CacheServeStale: time.Hour,
+	})
+
+	var nowUnix atomic.Int64
+	nowUnix.Store(time.Now().Unix())
+	p.time = &fakeClock{onNow: func() (n time.Time) { return time.Unix(nowUnix.Load(), 0) }}
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	stale := (&dns.Msg{}).SetReply(req)
+	stale.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   net.IP{192, 0, 2, 1},
+	}}
+	p.cache.items.set(msgToKey(req, false), (&cacheItem{m: stale, u: testUpsAddr}).pack())
+
+	resolve := func(t *testing.T) (d *DNSContext) {
+		t.Helper()
+
+		d = &DNSContext{Req: (&dns.Msg{}).SetQuestion(host, dns.TypeA)}
+		require.NoError(t, p.Resolve(d))
+		require.NotNil(t, d.Res)
+		require.Len(t, d.Res.Answer, 1)
+
+		return d
+	}
+
+	failing.Store(true)
+
+	t.Run("upstream_failed", func(t *testing.T) {
+		d := resolve(t)
+		testutil.RequireReceive(t, exchanged, time.Second)
+
+		assert.Equal(t, SourceCache, d.Provenance.Source)
+		assert.True(t, d.Provenance.Stale)
+		assert.Equal(t, testUpsAddr, d.CachedUpstreamAddr)
+		assert.Equal(t, uint32(defaultCacheStaleTTL/time.Second), d.Res.Answer[0].Header().Ttl)
+	})
+
+	t.Run("failed_recently", func(t *testing.T) {
+		d := resolve(t)
+		assert.Empty(t, exchanged)
+
+		assert.True(t, d.Provenance.Stale)
+	})
+
+	failing.Store(false)
+	nowUnix.Add(int64(staleRefreshInterval / time.Second))
+
+	t.Run("refresh", func(t *testing.T) {
+		d := resolve(t)
+		assert.True(t, d.Provenance.Stale)
+
+		testutil.RequireReceive(t, exchanged, time.Second)
+		require.Eventually(t, func() (ok bool) {
+			ci, expired, _ := p.cache.get(req, false)
+
+			return ci != nil && !expired
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("refreshed", func(t *testing.T) {
+		d := resolve(t)
+		assert.Empty(t, exchanged)
+
+		assert.False(t, d.Provenance.Stale)
+		assert.Equal(t, net.IP{192, 0, 2, 2}.To4(), d.Res.Answer[0].(*dns.A).A.To4())
+	})
+}
+
+func TestConfig_validateServeStale(t *testing.T) {
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &Config{CacheServeStale: time.Hour, CacheStaleTTL: time.Minute},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &Config{CacheServeStale: -1},
+		name:       "negative_max",
+		wantErrMsg: "negative max staleness",
+	}, {
+		conf:       &Config{CacheStaleTTL: -1},
+		name:       "negative_ttl",
+		wantErrMsg: "negative stale ttl",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validateServeStale())
+		})
+	}
+}
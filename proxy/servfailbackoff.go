@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+const (
+	// defaultServFailBackoffMax is the default maximum time the requests for a
+	// failing question are suppressed for, see [Config.ServFailBackoffMax].
+	// It's the upper constraint given by RFC 9520.
+	defaultServFailBackoffMax = 5 * time.Minute
+
+	// servFailBackoffMaxQuestions is the maximum number of the failing
+	// questions tracked at once, so that the requests for the random names
+	// don't make the tracking take too much memory.
+	servFailBackoffMaxQuestions = 10_000
+)
+
+// ErrServFailBackoff is returned when the request isn't sent to the upstreams,
+// since its question has recently failed to be resolved.
+const ErrServFailBackoff errors.Error = "question failed recently"
+
+// servFailEntry is the state of a failing question.
+type servFailEntry struct {
+	// until is the time until which the requests for the question are
+	// suppressed.
+	until time.Time
+
+	// failures is the number of the consecutive failures to resolve the
+	// question.
+	failures uint
+}
+
+// servFailBackoff suppresses the upstream requests for the questions that have
+// recently failed to be resolved, with the suppression time growing
+// exponentially with each consecutive failure, see RFC 9520.  It's safe for
+// concurrent use.
+type servFailBackoff struct {
+	// mu protects entries.
+	mu *sync.Mutex
+
+	// entries are the states of the failing questions by their keys, see
+	// [servFailKey].
+	entries *gocache.Cache
+
+	// initial is the time the requests are suppressed for after the first
+	// failure.
+	initial time.Duration
+
+	// max is the maximum time the requests are suppressed for.
+	max time.Duration
+}
+
+// newServFailBackoff returns a new properly initialized *servFailBackoff or nil
+// if the suppression is disabled in c.
+func newServFailBackoff(c *Config) (b *servFailBackoff) {
+	if c.ServFailBackoff <= 0 {
+		return nil
+	}
+
+	maxBackoff := c.ServFailBackoffMax
+	if maxBackoff <= 0 {
+		maxBackoff = defaultServFailBackoffMax
+	}
+
+	return &servFailBackoff{
+		mu:      &sync.Mutex{},
+		entries: gocache.New(gocache.NoExpiration, 2*maxBackoff),
+		initial: min(c.ServFailBackoff, maxBackoff),
+		max:     maxBackoff,
+	}
+}
+
+// validateServFailBackoff returns an error if the SERVFAIL backoff
+// configuration of c is invalid.
+func (c *Config) validateServFailBackoff() (err error) {
+	if c.ServFailBackoff < 0 {
+		return errors.Error("negative backoff")
+	}
+
+	if c.ServFailBackoffMax > 0 && c.ServFailBackoff > c.ServFailBackoffMax {
+		return fmt.Errorf(
+			"backoff %s greater than max %s",
+			c.ServFailBackoff,
+			c.ServFailBackoffMax,
+		)
+	}
+
+	return nil
+}
+
+// servFailKey returns the key of the question q sent to the upstream group
+// with groupName, which is empty if there are no groups.
+func servFailKey(groupName string, q dns.Question) (key string) {
+	return fmt.Sprintf("%s %d %d %s", groupName, q.Qclass, q.Qtype, strings.ToLower(q.Name))
+}
+
+// suppressed returns the time left until the requests for the question with
+// key may be sent to the upstreams again, or zero if they may be sent now.
+func (b *servFailBackoff) suppressed(key string, now time.Time) (left time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	v, ok := b.entries.Get(key)
+	if !ok {
+		return 0
+	}
+
+	return max(v.(*servFailEntry).until.Sub(now), 0)
+}
+
+// record updates the state of the question with key after it has been
+// resolved, successfully or not, at now.
+func (b *servFailBackoff) record(key string, failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.entries.Delete(key)
+
+		return
+	}
+
+	e := &servFailEntry{}
+	if v, ok := b.entries.Get(key); ok {
+		e = v.(*servFailEntry)
+	} else if b.entries.ItemCount() >= servFailBackoffMaxQuestions {
+		log.Debug("dnsproxy: servfail backoff: too many failing questions; not tracking %s", key)
+
+		return
+	}
+
+	backoff := b.initial
+	for i := uint(0); i < e.failures && backoff < b.max; i++ {
+		backoff *= 2
+	}
+
+	backoff = min(backoff, b.max)
+	e.failures++
+	e.until = now.Add(backoff)
+
+	// Forget the question once it hasn't failed for a while, so that the next
+	// failure starts over.
+	b.entries.Set(key, e, backoff+b.max)
+}
+
+// isServFail returns true if resp, which may be nil, means that the request
+// has failed to be resolved.
+func isServFail(resp *dns.Msg) (ok bool) {
+	return resp == nil || resp.Rcode == dns.RcodeServerFailure
+}
+
+// checkServFailBackoff returns the key of the question of d sent to the
+// upstream group g, which may be nil, or an empty string if the backoff isn't
+// used for d.  If the requests for the question are currently suppressed, it
+// sets the SERVFAIL response to d and returns an error.
+func (p *Proxy) checkServFailBackoff(d *DNSContext, g *upstreamGroup) (key string, err error) {
+	// Don't track the requests with the custom upstreams, since those may
+	// resolve the question differently.
+	if p.servFailBackoff == nil || d.CustomUpstreamConfig != nil {
+		return "", nil
+	}
+
+	var groupName string
+	if g != nil {
+		groupName = g.Name
+	}
+
+	key = servFailKey(groupName, d.Req.Question[0])
+	left := p.servFailBackoff.suppressed(key, p.time.Now())
+	if left == 0 {
+		return key, nil
+	}
+
+	d.Res = p.messages.NewMsgSERVFAIL(d.Req)
+	d.hasEDNS0 = false
+	d.Provenance = Provenance{Source: SourceLocal}
+
+	return "", fmt.Errorf("%w: retrying in %s", ErrServFailBackoff, left)
+}
+
+// recordServFailBackoff updates the state of the question with key, as
+// returned by [Proxy.checkServFailBackoff], after it has been resolved with
+// resp, which may be nil.
+func (p *Proxy) recordServFailBackoff(key string, resp *dns.Msg) {
+	if key == "" {
+		return
+	}
+
+	p.servFailBackoff.record(key, isServFail(resp), p.time.Now())
+}
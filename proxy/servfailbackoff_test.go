@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServFailBackoff(t *testing.T) {
+	b := newServFailBackoff(&Config{
+		ServFailBackoff:    time.Second,
+		ServFailBackoffMax: 3 * time.Second,
+	})
+	require.NotNil(t, b)
+
+	const key = "key"
+
+	now := time.Now()
+	assert.Zero(t, b.suppressed(key, now))
+
+	for _, want := range []time.Duration{
+		time.Second,
+		2 * time.Second,
+		3 * time.Second,
+		3 * time.Second,
+	} {
+		b.record(key, true, now)
+		assert.Equal(t, want, b.suppressed(key, now))
+	}
+
+	assert.Zero(t, b.suppressed(key, now.Add(3*time.Second)))
+
+	b.record(key, false, now)
+	assert.Zero(t, b.suppressed(key, now))
+
+	b.record(key, true, now)
+	assert.Equal(t, time.Second, b.suppressed(key, now))
+
+	assert.Nil(t, newServFailBackoff(&Config{}))
+}
+
+func TestProxy_replyFromUpstream_servFailBackoff(t *testing.T) {
+	var exchanges int
+	rcode := dns.RcodeServerFailure
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges++
+
+			return (&dns.Msg{}).SetRcode(m, rcode), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr:   []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:  &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:  defaultTrustedProxies,
+		ServFailBackoff: time.Minute,
+	})
+
+	now := time.Now()
+	p.time = &fakeClock{onNow: func() (n time.Time) { return now }}
+
+	resolve := func(t *testing.T, host string) (resp *dns.Msg, err error) {
+		t.Helper()
+
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion(host, dns.TypeA)}
+		_, err = p.replyFromUpstream(d)
+		require.NotNil(t, d.Res)
+
+		return d.Res, err
+	}
+
+	resp, err := resolve(t, "broken.example.")
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.Equal(t, 1, exchanges)
+
+	resp, err = resolve(t, "BROKEN.example.")
+	assert.ErrorIs(t, err, ErrServFailBackoff)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.Equal(t, 1, exchanges)
+
+	_, err = resolve(t, "other.example.")
+	require.NoError(t, err)
+	assert.Equal(t, 2, exchanges)
+
+	now = now.Add(time.Minute)
+	rcode = dns.RcodeSuccess
+
+	resp, err = resolve(t, "broken.example.")
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 3, exchanges)
+
+	_, err = resolve(t, "broken.example.")
+	require.NoError(t, err)
+	assert.Equal(t, 4, exchanges)
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// defaultStaggerDelay is the default delay between sending the request to the
+// upstreams in [UModeStaggered], see [Config.StaggerDelay].
+const defaultStaggerDelay = 100 * time.Millisecond
+
+// validateStagger returns an error if the staggered mode configuration of c
+// is invalid.
+func (c *Config) validateStagger() (err error) {
+	if c.StaggerDelay < 0 {
+		return errors.Error("negative delay")
+	} else if c.StaggerUpstreams < 0 {
+		return errors.Error("negative number of upstreams")
+	}
+
+	return nil
+}
+
+// exchangeStaggered resolves req using up to [Config.StaggerUpstreams] of ups,
+// starting with the fastest one and sending the request to the next one each
+// [Config.StaggerDelay] or once the previous one has failed, until the first
+// valid response is received.  The upstreams not requested by then are
+// skipped, and the responses of the ones still in progress are discarded.
+func (p *Proxy) exchangeStaggered(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+) (resp *dns.Msg, u upstream.Upstream, attempts int, err error) {
+	if p.upstreamHealth != nil {
+		ups = p.upstreamHealth.filter(ups)
+	}
+
+	ups = p.sortByRTT(ups)
+	if n := p.StaggerUpstreams; n > 0 && n < len(ups) {
+		ups = ups[:n]
+	}
+
+	delay := cmp.Or(p.StaggerDelay, defaultStaggerDelay)
+
+	// Buffer the channel to not leak the goroutines of the exchanges, the
+	// results of which aren't waited for.
+	resCh := make(chan *hedgeResult, len(ups))
+	launch := func() {
+		go p.hedgeExchange(req, ups[attempts], resCh)
+		attempts++
+	}
+
+	launch()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var invalid *hedgeResult
+	var errs []error
+	for received := 0; received < attempts; {
+		select {
+		case res := <-resCh:
+			received++
+			if res.err == nil && res.resp == nil {
+				res.err = upstream.ErrNoReply
+			}
+
+			if res.err == nil && isValidStaggered(res.resp) {
+				return res.resp, res.u, attempts, nil
+			}
+
+			if res.err != nil {
+				errs = append(errs, res.err)
+			} else if invalid == nil {
+				invalid = res
+			}
+
+			// Don't wait for the delay since the upstream has already failed.
+			if attempts < len(ups) {
+				launch()
+				resetTimer(timer, delay)
+			}
+		case <-timer.C:
+			if attempts < len(ups) {
+				log.Debug("dnsproxy: staggering request to %s", ups[attempts].Address())
+
+				launch()
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	if invalid != nil {
+		return invalid.resp, invalid.u, attempts, nil
+	}
+
+	err = fmt.Errorf("staggered exchange: %w", errors.Join(errs...))
+
+	return nil, nil, attempts, err
+}
+
+// isValidStaggered returns true if resp is a valid response to be used in
+// [UModeStaggered] right away.  The SERVFAIL and REFUSED responses are only
+// used if no upstream has responded otherwise.
+func isValidStaggered(resp *dns.Msg) (ok bool) {
+	return resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+}
+
+// sortByRTT returns a copy of ups sorted by their average round-trip times.
+// The upstreams not requested yet go first, so that those get measured.
+func (p *Proxy) sortByRTT(ups []upstream.Upstream) (sorted []upstream.Upstream) {
+	rtts := make(map[upstream.Upstream]float64, len(ups))
+
+	p.rttLock.Lock()
+	for _, u := range ups {
+		stat := p.upstreamRTTStats[u.Address()]
+		if stat.reqNum > 0 {
+			rtts[u] = stat.rttSum / stat.reqNum
+		}
+	}
+	p.rttLock.Unlock()
+
+	sorted = slices.Clone(ups)
+	slices.SortStableFunc(sorted, func(a, b upstream.Upstream) (res int) {
+		return cmp.Compare(rtts[a], rtts[b])
+	})
+
+	return sorted
+}
+
+// resetTimer stops t, drains its channel if needed, and resets it to fire
+// after d.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+
+	t.Reset(d)
+}
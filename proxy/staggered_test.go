@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newStaggeredProxy returns a new proxy in [UModeStaggered] with ups and the
+// specified settings.
+func newStaggeredProxy(
+	t *testing.T,
+	ups []upstream.Upstream,
+	n int,
+	delay time.Duration,
+) (p *Proxy) {
+	t.Helper()
+
+	return mustNew(t, &Config{
+		UDPListenAddr:    []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:   &UpstreamConfig{Upstreams: ups},
+		TrustedProxies:   defaultTrustedProxies,
+		UpstreamMode:     UModeStaggered,
+		StaggerUpstreams: n,
+		StaggerDelay:     delay,
+	})
+}
+
+// newCountingUpstream returns an upstream with addr, which counts the requests
+// in reqs and responds to them with rcode after delay, or fails if rcode is
+// negative.
+func newCountingUpstream(
+	addr string,
+	reqs *atomic.Int32,
+	delay time.Duration,
+	rcode int,
+) (u upstream.Upstream) {
+	return &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			reqs.Add(1)
+			time.Sleep(delay)
+
+			if rcode < 0 {
+				return nil, errors.Error("test error")
+			}
+
+			return (&dns.Msg{}).SetRcode(m, rcode), nil
+		},
+		onAddress: func() (a string) { return addr },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_exchangeStaggered(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+	t.Run("fast_first", func(t *testing.T) {
+		var fastReqs, slowReqs atomic.Int32
+		fast := newCountingUpstream("fast", &fastReqs, 0, dns.RcodeSuccess)
+		slow := newCountingUpstream("slow", &slowReqs, 0, dns.RcodeSuccess)
+
+		p := newStaggeredProxy(t, []upstream.Upstream{slow, fast}, 0, time.Hour)
+		p.updateRTT("fast", time.Millisecond)
+		p.updateRTT("slow", time.Second)
+
+		resp, u, attempts, err := p.exchangeStaggered(req, []upstream.Upstream{slow, fast})
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Equal(t, "fast", u.Address())
+		assert.Equal(t, 1, attempts)
+		assert.Equal(t, int32(1), fastReqs.Load())
+		assert.Zero(t, slowReqs.Load())
+	})
+
+	t.Run("staggered", func(t *testing.T) {
+		var hangingReqs, okReqs atomic.Int32
+		hanging := newCountingUpstream("hanging", &hangingReqs, time.Second, dns.RcodeSuccess)
+		ok := newCountingUpstream("ok", &okReqs, 0, dns.RcodeSuccess)
+
+		ups := []upstream.Upstream{hanging, ok}
+		p := newStaggeredProxy(t, ups, 0, 10*time.Millisecond)
+		p.updateRTT("hanging", time.Millisecond)
+		p.updateRTT("ok", time.Second)
+
+		start := time.Now()
+		_, u, attempts, err := p.exchangeStaggered(req, ups)
+		require.NoError(t, err)
+
+		assert.Less(t, time.Since(start), time.Second)
+		assert.Equal(t, "ok", u.Address())
+		assert.Equal(t, 2, attempts)
+	})
+
+	t.Run("failed_first", func(t *testing.T) {
+		var failingReqs, servFailReqs, okReqs, unusedReqs atomic.Int32
+		failing := newCountingUpstream("failing", &failingReqs, 0, -1)
+		servFail := newCountingUpstream("servfail", &servFailReqs, 0, dns.RcodeServerFailure)
+		ok := newCountingUpstream("ok", &okReqs, 0, dns.RcodeSuccess)
+		unused := newCountingUpstream("unused", &unusedReqs, 0, dns.RcodeSuccess)
+
+		ups := []upstream.Upstream{failing, servFail, ok, unused}
+		p := newStaggeredProxy(t, ups, 3, time.Hour)
+		for i, u := range ups {
+			p.updateRTT(u.Address(), time.Duration(i+1)*time.Millisecond)
+		}
+
+		_, u, attempts, err := p.exchangeStaggered(req, ups)
+		require.NoError(t, err)
+
+		assert.Equal(t, "ok", u.Address())
+		assert.Equal(t, 3, attempts)
+		assert.Zero(t, unusedReqs.Load())
+	})
+
+	t.Run("invalid_only", func(t *testing.T) {
+		var failingReqs, servFailReqs atomic.Int32
+		failing := newCountingUpstream("failing", &failingReqs, 0, -1)
+		servFail := newCountingUpstream("servfail", &servFailReqs, 0, dns.RcodeServerFailure)
+
+		ups := []upstream.Upstream{failing, servFail}
+		p := newStaggeredProxy(t, ups, 0, time.Hour)
+
+		resp, u, attempts, err := p.exchangeStaggered(req, ups)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+		assert.Equal(t, "servfail", u.Address())
+		assert.Equal(t, 2, attempts)
+	})
+
+	t.Run("all_failed", func(t *testing.T) {
+		var reqs atomic.Int32
+		ups := []upstream.Upstream{
+			newCountingUpstream("failing_1", &reqs, 0, -1),
+			newCountingUpstream("failing_2", &reqs, 0, -1),
+		}
+
+		p := newStaggeredProxy(t, ups, 0, time.Hour)
+
+		_, _, attempts, err := p.exchangeStaggered(req, ups)
+		assert.ErrorContains(t, err, "staggered exchange")
+		assert.Equal(t, 2, attempts)
+	})
+}
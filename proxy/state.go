@@ -0,0 +1,476 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/bruceluk/dnsproxy/fastip"
+)
+
+// stateMagic is the magic string the exported state starts with.
+const stateMagic = "DPXS"
+
+// stateVersion is the version of the format of the exported state.  It must be
+// incremented on any incompatible change of the format.
+const stateVersion uint8 = 1
+
+// stateSectionHdrLen is the length of the header of a section of the exported
+// state: its type and the length of its payload.
+const stateSectionHdrLen = 1 + 4
+
+// errBadState is returned when the exported state is malformed.
+const errBadState errors.Error = "malformed state"
+
+// stateSection is the type of a section of the exported state.
+type stateSection uint8
+
+const (
+	// stateSectionCache contains the items of the general cache.
+	stateSectionCache stateSection = iota + 1
+
+	// stateSectionCacheWithSubnet contains the items of the cache for the
+	// requests with EDNS Client Subnet.
+	stateSectionCacheWithSubnet
+
+	// stateSectionRTT contains the round-trip time statistics of the
+	// upstreams.
+	stateSectionRTT
+
+	// stateSectionFastestAddr contains the cached ping results of the fastest
+	// address algorithm.
+	stateSectionFastestAddr
+
+	// stateSectionRatelimit contains the latest requests of the rate-limited
+	// subnets.
+	stateSectionRatelimit
+)
+
+// String implements the [fmt.Stringer] interface for stateSection.
+func (s stateSection) String() (str string) {
+	switch s {
+	case stateSectionCache:
+		return "cache"
+	case stateSectionCacheWithSubnet:
+		return "cache_with_subnet"
+	case stateSectionRTT:
+		return "rtt"
+	case stateSectionFastestAddr:
+		return "fastest_addr"
+	case stateSectionRatelimit:
+		return "ratelimit"
+	default:
+		return fmt.Sprintf("!bad_state_section_%d", uint8(s))
+	}
+}
+
+// ExportState writes the runtime state of p to w, so that another instance can
+// start with it using [Proxy.ImportState] instead of from scratch.  The state
+// includes the cached responses, the round-trip time statistics of the
+// upstreams, the cached ping results of the fastest address algorithm, and the
+// state of the rate limiter.  The caches of [CustomUpstreamConfig] aren't
+// included.  It's safe for concurrent use.
+//
+// The state is written in a versioned binary format: the "DPXS" magic string,
+// the version byte, and the sections, each consisting of the section type byte,
+// the big-endian uint32 length of the payload, and the payload itself.
+func (p *Proxy) ExportState(w io.Writer) (err error) {
+	buf := append([]byte(stateMagic), stateVersion)
+
+	if c := p.cache; c != nil {
+		buf = appendStateSection(buf, stateSectionCache, exportCacheStore(c.items))
+		if c.itemsWithSubnet != nil {
+			buf = appendStateSection(
+				buf,
+				stateSectionCacheWithSubnet,
+				exportCacheStore(c.itemsWithSubnet),
+			)
+		}
+	}
+
+	buf = appendStateSection(buf, stateSectionRTT, p.exportRTT())
+
+	if p.fastestAddr != nil {
+		buf = appendStateSection(buf, stateSectionFastestAddr, exportFastestAddr(p.fastestAddr))
+	}
+
+	if p.Ratelimit > 0 {
+		buf = appendStateSection(buf, stateSectionRatelimit, p.exportRatelimit())
+	}
+
+	_, err = w.Write(buf)
+
+	// Don't wrap the error since it's informative enough as is.
+	return err
+}
+
+// ImportState reads the runtime state written by [Proxy.ExportState] from r
+// and adds it to the state of p.  It's intended to be called before p is
+// started.  The sections p has nothing to import to, e.g. the cache when it's
+// disabled, are skipped, as well as the unknown ones.  If an error is returned,
+// the state may have been imported partially.
+func (p *Proxy) ImportState(r io.Reader) (err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading state: %w", err)
+	}
+
+	if !bytes.HasPrefix(data, []byte(stateMagic)) || len(data) < len(stateMagic)+1 {
+		return fmt.Errorf("%w: bad magic", errBadState)
+	}
+
+	data = data[len(stateMagic):]
+	if v := data[0]; v != stateVersion {
+		return fmt.Errorf("unsupported state version %d", v)
+	}
+
+	for data = data[1:]; len(data) > 0; {
+		if len(data) < stateSectionHdrLen {
+			return fmt.Errorf("%w: truncated section header", errBadState)
+		}
+
+		sec := stateSection(data[0])
+		l := binary.BigEndian.Uint32(data[1:])
+		data = data[stateSectionHdrLen:]
+		if uint64(len(data)) < uint64(l) {
+			return fmt.Errorf("section %s: %w: truncated payload", sec, errBadState)
+		}
+
+		err = p.importStateSection(sec, &stateDecoder{data: data[:l]})
+		if err != nil {
+			return fmt.Errorf("section %s: %w", sec, err)
+		}
+
+		data = data[l:]
+	}
+
+	return nil
+}
+
+// importStateSection imports the section of type sec from d.
+func (p *Proxy) importStateSection(sec stateSection, d *stateDecoder) (err error) {
+	switch sec {
+	case stateSectionCache:
+		if p.cache != nil {
+			return importCacheStore(p.cache.items, d)
+		}
+	case stateSectionCacheWithSubnet:
+		if p.cache != nil && p.cache.itemsWithSubnet != nil {
+			return importCacheStore(p.cache.itemsWithSubnet, d)
+		}
+	case stateSectionRTT:
+		return p.importRTT(d)
+	case stateSectionFastestAddr:
+		if p.fastestAddr != nil {
+			return importFastestAddr(p.fastestAddr, d)
+		}
+	case stateSectionRatelimit:
+		if p.Ratelimit > 0 {
+			return p.importRatelimit(d)
+		}
+	default:
+		// Skip the sections added by the later compatible versions.
+	}
+
+	return nil
+}
+
+// appendStateSection appends the section of type sec with payload to buf.
+func appendStateSection(buf []byte, sec stateSection, payload []byte) (res []byte) {
+	buf = append(buf, byte(sec))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+
+	return append(buf, payload...)
+}
+
+// stateEncoder encodes the records of a section of the exported state.
+type stateEncoder struct {
+	buf []byte
+}
+
+// uint appends v as a uvarint.
+func (e *stateEncoder) uint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+// int appends v as a varint.
+func (e *stateEncoder) int(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+// float appends v as a big-endian uint64.
+func (e *stateEncoder) float(v float64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v))
+}
+
+// bytes appends b prefixed with its length.
+func (e *stateEncoder) bytes(b []byte) {
+	e.uint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// stateDecoder decodes the records of a section of the exported state.  Once
+// it fails, it returns zero values and keeps the first error.
+type stateDecoder struct {
+	err  error
+	data []byte
+}
+
+// more returns true if there is more data to decode and no error occurred.
+func (d *stateDecoder) more() (ok bool) {
+	return d.err == nil && len(d.data) > 0
+}
+
+// uint decodes a uvarint.
+func (d *stateDecoder) uint() (v uint64) {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = fmt.Errorf("%w: bad uvarint", errBadState)
+
+		return 0
+	}
+
+	d.data = d.data[n:]
+
+	return v
+}
+
+// int decodes a varint.
+func (d *stateDecoder) int() (v int64) {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = fmt.Errorf("%w: bad varint", errBadState)
+
+		return 0
+	}
+
+	d.data = d.data[n:]
+
+	return v
+}
+
+// float decodes a big-endian uint64 as a float64.
+func (d *stateDecoder) float() (v float64) {
+	if d.err != nil {
+		return 0
+	} else if len(d.data) < 8 {
+		d.err = fmt.Errorf("%w: truncated float", errBadState)
+
+		return 0
+	}
+
+	v = math.Float64frombits(binary.BigEndian.Uint64(d.data))
+	d.data = d.data[8:]
+
+	return v
+}
+
+// bytes decodes the bytes prefixed with their length.  b is a copy, so it
+// doesn't retain the whole state.
+func (d *stateDecoder) bytes() (b []byte) {
+	l := d.uint()
+	if d.err != nil {
+		return nil
+	} else if uint64(len(d.data)) < l {
+		d.err = fmt.Errorf("%w: truncated bytes", errBadState)
+
+		return nil
+	}
+
+	b = bytes.Clone(d.data[:l])
+	d.data = d.data[l:]
+
+	return b
+}
+
+// exportCacheStore returns the items of s encoded as a section payload.
+func exportCacheStore(s *cacheStore) (payload []byte) {
+	e := &stateEncoder{}
+	s.export(func(key string, val []byte, frequent bool) {
+		e.bytes([]byte(key))
+		e.bytes(val)
+
+		var flags uint64
+		if frequent {
+			flags = 1
+		}
+
+		e.uint(flags)
+	})
+
+	return e.buf
+}
+
+// importCacheStore restores the items from d into s.
+func importCacheStore(s *cacheStore, d *stateDecoder) (err error) {
+	for d.more() {
+		key, val, flags := d.bytes(), d.bytes(), d.uint()
+		if d.err == nil {
+			s.restore(string(key), val, flags&1 != 0)
+		}
+	}
+
+	return d.err
+}
+
+// exportRTT returns the round-trip time statistics of the upstreams encoded as
+// a section payload.
+func (p *Proxy) exportRTT() (payload []byte) {
+	p.rttLock.Lock()
+	defer p.rttLock.Unlock()
+
+	e := &stateEncoder{}
+	for addr, stat := range p.upstreamRTTStats {
+		e.bytes([]byte(addr))
+		e.float(stat.rttSum)
+		e.float(stat.reqNum)
+	}
+
+	return e.buf
+}
+
+// importRTT restores the round-trip time statistics of the upstreams from d.
+func (p *Proxy) importRTT(d *stateDecoder) (err error) {
+	p.rttLock.Lock()
+	defer p.rttLock.Unlock()
+
+	if p.upstreamRTTStats == nil {
+		p.upstreamRTTStats = map[string]upstreamRTTStats{}
+	}
+
+	for d.more() {
+		addr, rttSum, reqNum := d.bytes(), d.float(), d.float()
+		if d.err == nil {
+			p.upstreamRTTStats[string(addr)] = upstreamRTTStats{
+				rttSum: rttSum,
+				reqNum: reqNum,
+			}
+		}
+	}
+
+	return d.err
+}
+
+// exportFastestAddr returns the cached ping results of f encoded as a section
+// payload.
+func exportFastestAddr(f *fastip.FastestAddr) (payload []byte) {
+	e := &stateEncoder{}
+	for _, ent := range f.CacheEntries() {
+		e.bytes(ent.Addr.AsSlice())
+		e.int(ent.Expire.Unix())
+		e.uint(uint64(ent.Latency.Milliseconds()))
+
+		var flags uint64
+		if ent.Failed {
+			flags = 1
+		}
+
+		e.uint(flags)
+	}
+
+	return e.buf
+}
+
+// importFastestAddr restores the cached ping results from d into f.
+func importFastestAddr(f *fastip.FastestAddr, d *stateDecoder) (err error) {
+	var ents []*fastip.CacheEntry
+	for d.more() {
+		ip, expire, latency, flags := d.bytes(), d.int(), d.uint(), d.uint()
+		if d.err != nil {
+			break
+		}
+
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			return fmt.Errorf("%w: bad address %v", errBadState, ip)
+		}
+
+		ents = append(ents, &fastip.CacheEntry{
+			Expire:  time.Unix(expire, 0),
+			Addr:    addr,
+			Latency: time.Duration(latency) * time.Millisecond,
+			Failed:  flags&1 != 0,
+		})
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f.RestoreCache(ents)
+
+	return nil
+}
+
+// exportRatelimit returns the latest requests of the rate-limited subnets
+// encoded as a section payload.
+func (p *Proxy) exportRatelimit() (payload []byte) {
+	p.ratelimitLock.Lock()
+	defer p.ratelimitLock.Unlock()
+
+	e := &stateEncoder{}
+	if p.ratelimitBuckets == nil {
+		return e.buf
+	}
+
+	now := time.Now()
+	for subnet, item := range p.ratelimitBuckets.Items() {
+		l, ok := item.Object.(*subnetLimiter)
+		if !ok {
+			continue
+		}
+
+		times := l.recent(now)
+		if len(times) == 0 {
+			continue
+		}
+
+		e.bytes([]byte(subnet))
+		e.uint(uint64(len(times)))
+		for _, t := range times {
+			e.int(t.UnixNano())
+		}
+	}
+
+	return e.buf
+}
+
+// importRatelimit restores the latest requests of the rate-limited subnets
+// from d.
+func (p *Proxy) importRatelimit(d *stateDecoder) (err error) {
+	for d.more() {
+		subnet, n := d.bytes(), d.uint()
+		times := make([]time.Time, 0, min(n, uint64(p.Ratelimit)))
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			times = append(times, time.Unix(0, d.int()))
+		}
+
+		if d.err != nil {
+			break
+		}
+
+		l, ok := p.limiterForIP(string(subnet)).(*subnetLimiter)
+		if !ok {
+			continue
+		}
+
+		for _, t := range times {
+			l.try(t)
+		}
+	}
+
+	return d.err
+}
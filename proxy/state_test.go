@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/fastip"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newStateTestProxy returns a new proxy with all the state ExportState covers
+// enabled.
+func newStateTestProxy(t *testing.T) (p *Proxy) {
+	t.Helper()
+
+	return mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{upstreamWithAddr},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		UpstreamMode:           UModeFastestAddr,
+		Ratelimit:              1,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+	})
+}
+
+func TestProxy_ExportState(t *testing.T) {
+	src := newStateTestProxy(t)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	reply := (&dns.Msg{
+		Answer: []dns.RR{newRR(t, "example.org.", dns.TypeA, 3600, net.IP{192, 0, 2, 1})},
+	}).SetReply(req)
+	src.cache.set(reply, upstreamWithAddr, false)
+
+	src.updateRTT(testUpsAddr, 10*time.Millisecond)
+
+	pinged := netip.MustParseAddr("192.0.2.1")
+	src.fastestAddr.RestoreCache([]*fastip.CacheEntry{{
+		Expire:  time.Now().Add(time.Hour),
+		Addr:    pinged,
+		Latency: 5 * time.Millisecond,
+	}})
+
+	client := netip.MustParseAddr("198.51.100.1")
+	require.False(t, src.isRatelimited(client))
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, src.ExportState(buf))
+
+	dst := newStateTestProxy(t)
+	require.NoError(t, dst.ImportState(buf))
+
+	ci, expired, _ := dst.cache.get(req, false)
+	require.NotNil(t, ci)
+
+	assert.False(t, expired)
+	assert.Equal(t, testUpsAddr, ci.u)
+	require.Len(t, ci.m.Answer, 1)
+
+	assert.Equal(t, src.calcWeights(src.UpstreamConfig.Upstreams), dst.calcWeights(src.UpstreamConfig.Upstreams))
+
+	ents := dst.fastestAddr.CacheEntries()
+	require.Len(t, ents, 1)
+
+	assert.Equal(t, pinged, ents[0].Addr)
+	assert.Equal(t, 5*time.Millisecond, ents[0].Latency)
+
+	assert.True(t, dst.isRatelimited(client))
+}
+
+func TestProxy_ImportState_disabled(t *testing.T) {
+	src := newStateTestProxy(t)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	reply := (&dns.Msg{
+		Answer: []dns.RR{newRR(t, "example.org.", dns.TypeA, 3600, net.IP{192, 0, 2, 1})},
+	}).SetReply(req)
+	src.cache.set(reply, upstreamWithAddr, false)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, src.ExportState(buf))
+
+	dst := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{upstreamWithAddr},
+		},
+		TrustedProxies: defaultTrustedProxies,
+	})
+
+	require.NoError(t, dst.ImportState(buf))
+
+	assert.Nil(t, dst.cache)
+}
+
+func TestProxy_ImportState_bad(t *testing.T) {
+	p := newStateTestProxy(t)
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		data       []byte
+	}{{
+		name:       "empty",
+		wantErrMsg: "malformed state: bad magic",
+		data:       nil,
+	}, {
+		name:       "bad_magic",
+		wantErrMsg: "malformed state: bad magic",
+		data:       []byte("ABCD\x01"),
+	}, {
+		name:       "bad_version",
+		wantErrMsg: "unsupported state version 2",
+		data:       []byte(stateMagic + "\x02"),
+	}, {
+		name:       "truncated_header",
+		wantErrMsg: "malformed state: truncated section header",
+		data:       []byte(stateMagic + "\x01\x03\x00"),
+	}, {
+		name:       "truncated_payload",
+		wantErrMsg: "section rtt: malformed state: truncated payload",
+		data:       []byte(stateMagic + "\x01\x03\x00\x00\x00\x10\x00"),
+	}, {
+		name:       "bad_payload",
+		wantErrMsg: "section rtt: malformed state: truncated float",
+		data:       []byte(stateMagic + "\x01\x03\x00\x00\x00\x02\x01a"),
+	}, {
+		name:       "unknown_section",
+		wantErrMsg: "",
+		data:       []byte(stateMagic + "\x01\xff\x00\x00\x00\x01\x00"),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := p.ImportState(bytes.NewReader(tc.data))
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
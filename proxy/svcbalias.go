@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"slices"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// maxSVCBAliasChain is the maximum number of the AliasMode records followed
+// for a single request, which also breaks the alias loops.
+const maxSVCBAliasChain = 8
+
+// resolveSVCBAliases follows the AliasMode SVCB or HTTPS record in the
+// response of d, if any, and adds the records resolved for its target to the
+// additional section, so that the client doesn't need to query the targets
+// itself.  The chain ends with the address records of the last target, if it
+// has no records of the requested type.  See RFC 9460 Section 4.2.
+//
+// Each link of the chain is resolved as a separate request, so that it's
+// cached with its own TTL and re-resolved once it expires, independently of
+// the others.
+func (p *Proxy) resolveSVCBAliases(d *DNSContext) {
+	if !p.ResolveSVCBAliases ||
+		d.Res == nil ||
+		d.Res.Rcode != dns.RcodeSuccess ||
+		d.svcbAliasDepth >= maxSVCBAliasChain {
+		return
+	}
+
+	qtype := d.Req.Question[0].Qtype
+	if qtype != dns.TypeSVCB && qtype != dns.TypeHTTPS {
+		return
+	}
+
+	target := svcbAliasTarget(d.Res.Answer, qtype)
+	if target == "" {
+		return
+	}
+
+	ans, extra := p.resolveSVCBTarget(d, target, qtype)
+	rrs := append(ans, extra...)
+	if !hasRRType(ans, qtype) {
+		for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			ans, _ = p.resolveSVCBTarget(d, target, t)
+			rrs = append(rrs, ans...)
+		}
+	}
+
+	// Skip the records already in the response, which the alias loops lead to.
+	for _, rr := range rrs {
+		if !isDuplicateRR(d.Res.Answer, rr) && !isDuplicateRR(d.Res.Extra, rr) {
+			d.Res.Extra = append(d.Res.Extra, rr)
+		}
+	}
+}
+
+// svcbAliasTarget returns the target name of the first AliasMode record of
+// qtype in rrs, or an empty string if there is none.  The records with the "."
+// target are skipped, since those mean that the service doesn't exist.
+func svcbAliasTarget(rrs []dns.RR, qtype uint16) (target string) {
+	for _, rr := range rrs {
+		var svcb *dns.SVCB
+		switch rr := rr.(type) {
+		case *dns.SVCB:
+			svcb = rr
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		default:
+			continue
+		}
+
+		if svcb.Hdr.Rrtype == qtype && svcb.Priority == 0 && svcb.Target != "." {
+			return svcb.Target
+		}
+	}
+
+	return ""
+}
+
+// resolveSVCBTarget resolves the records of qtype for the target of the alias
+// from the response of d.  ans and extra are the answer and additional
+// sections of the response without the OPT records, and are nil if the
+// request has failed.
+func (p *Proxy) resolveSVCBTarget(
+	d *DNSContext,
+	target string,
+	qtype uint16,
+) (ans, extra []dns.RR) {
+	req := (&dns.Msg{}).SetQuestion(target, qtype)
+	if d.doBit {
+		req.SetEdns0(defaultUDPBufSize, true)
+	}
+
+	// Use TCP, so that the response isn't truncated before it's added to the
+	// one of d, which is truncated afterwards if needed.
+	sub := p.newDNSContext(ProtoTCP, req)
+	sub.Addr = d.Addr
+	sub.IsPrivateClient = d.IsPrivateClient
+	sub.CustomUpstreamConfig = d.CustomUpstreamConfig
+	sub.svcbAliasDepth = d.svcbAliasDepth + 1
+
+	err := p.Resolve(sub)
+	if err != nil {
+		log.Debug("dnsproxy: svcb alias: resolving %s %s: %s", target, dns.Type(qtype), err)
+
+		return nil, nil
+	} else if sub.Res == nil || sub.Res.Rcode != dns.RcodeSuccess {
+		return nil, nil
+	}
+
+	return sub.Res.Answer, filterRRSlice(sub.Res.Extra, true, 0, dns.TypeNone)
+}
+
+// isDuplicateRR returns true if rrs already contain a record equal to rr.
+func isDuplicateRR(rrs []dns.RR, rr dns.RR) (ok bool) {
+	return slices.ContainsFunc(rrs, func(r dns.RR) (dup bool) {
+		return dns.IsDuplicate(r, rr)
+	})
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_svcbAliases(t *testing.T) {
+	const soa = "example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 300"
+
+	zone := map[string][]string{
+		"a.example. HTTPS":   {"a.example. 300 IN HTTPS 0 b.example."},
+		"b.example. HTTPS":   {"b.example. 60 IN HTTPS 0 c.example."},
+		"c.example. A":       {"c.example. 30 IN A 192.0.2.1"},
+		"loop.example. SVCB": {"loop.example. 300 IN SVCB 0 loop.example."},
+		"none.example. SVCB": {"none.example. 300 IN SVCB 0 ."},
+	}
+
+	exchanges := map[string]int{}
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			q := m.Question[0]
+			key := q.Name + " " + dns.Type(q.Qtype).String()
+			exchanges[key]++
+
+			resp = (&dns.Msg{}).SetReply(m)
+			for _, s := range zone[key] {
+				resp.Answer = append(resp.Answer, parseRR(t, s))
+			}
+
+			if len(resp.Answer) == 0 {
+				resp.Ns = append(resp.Ns, parseRR(t, soa))
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr:      []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:     &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:     defaultTrustedProxies,
+		CacheEnabled:       true,
+		ResolveSVCBAliases: true,
+	})
+
+	resolve := func(t *testing.T, name string, qtype uint16) (resp *dns.Msg) {
+		t.Helper()
+
+		d := p.newDNSContext(ProtoUDP, (&dns.Msg{}).SetQuestion(name, qtype))
+		require.NoError(t, p.Resolve(d))
+		require.NotNil(t, d.Res)
+
+		return d.Res
+	}
+
+	wantExtra := []string{
+		"b.example.\t60\tIN\tHTTPS\t0 c.example.",
+		"c.example.\t30\tIN\tA\t192.0.2.1",
+	}
+
+	t.Run("chain", func(t *testing.T) {
+		resp := resolve(t, "a.example.", dns.TypeHTTPS)
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, "a.example.\t300\tIN\tHTTPS\t0 b.example.", resp.Answer[0].String())
+		assert.Equal(t, wantExtra, rrStrings(resp.Extra))
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		resp := resolve(t, "a.example.", dns.TypeHTTPS)
+		require.Len(t, resp.Answer, 1)
+		require.Len(t, resp.Extra, len(wantExtra))
+
+		// Each link is cached with its own TTL.
+		assert.LessOrEqual(t, resp.Answer[0].Header().Ttl, uint32(300))
+		assert.Greater(t, resp.Answer[0].Header().Ttl, uint32(60))
+		assert.LessOrEqual(t, resp.Extra[0].Header().Ttl, uint32(60))
+		assert.LessOrEqual(t, resp.Extra[1].Header().Ttl, uint32(30))
+
+		for key, n := range exchanges {
+			assert.Equal(t, 1, n, key)
+		}
+	})
+
+	t.Run("target", func(t *testing.T) {
+		resp := resolve(t, "b.example.", dns.TypeHTTPS)
+
+		assert.Equal(t, wantExtra[1:], rrStrings(resp.Extra))
+	})
+
+	t.Run("loop", func(t *testing.T) {
+		resp := resolve(t, "loop.example.", dns.TypeSVCB)
+		require.Len(t, resp.Answer, 1)
+
+		assert.Empty(t, resp.Extra)
+		assert.Equal(t, 1, exchanges["loop.example. SVCB"])
+	})
+
+	t.Run("no_service", func(t *testing.T) {
+		resp := resolve(t, "none.example.", dns.TypeSVCB)
+
+		assert.Empty(t, resp.Extra)
+		assert.Equal(t, 1, exchanges["none.example. SVCB"])
+	})
+}
+
+// parseRR returns the record parsed from s.
+func parseRR(t *testing.T, s string) (rr dns.RR) {
+	t.Helper()
+
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+
+	return rr
+}
+
+// rrStrings returns the string representations of rrs.
+func rrStrings(rrs []dns.RR) (strs []string) {
+	for _, rr := range rrs {
+		strs = append(strs, rr.String())
+	}
+
+	return strs
+}
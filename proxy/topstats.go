@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"cmp"
+	"hash/maphash"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// topSketchDepth is the number of rows in the count-min sketch of a
+	// [topCounter].
+	topSketchDepth = 4
+
+	// topSketchWidth is the number of counters in a single row of the
+	// count-min sketch of a [topCounter].
+	topSketchWidth = 2048
+
+	// topDecayPeriod is the number of the counted keys, after which all the
+	// counts of a [topCounter] are halved, so that the old heavy hitters give
+	// way to the current ones.
+	topDecayPeriod = 1 << 20
+)
+
+// TopStatsEntry is a single heavy hitter of [TopStats].
+type TopStatsEntry struct {
+	// Key is the domain name or the client's IP address.
+	Key string
+
+	// Count is the estimated number of the recent requests for Key.  It may
+	// be overestimated, but never underestimated.
+	Count uint64
+}
+
+// TopStats contains the heaviest domains and clients, sorted by the number of
+// requests in descending order.
+type TopStats struct {
+	// Domains are the most requested domain names.
+	Domains []TopStatsEntry
+
+	// Clients are the clients sending the most requests.
+	Clients []TopStatsEntry
+}
+
+// topCounter is a streaming approximate top-K counter based on the count-min
+// sketch.  It takes a constant amount of memory regardless of the number of
+// distinct keys.  It's safe for concurrent use.
+type topCounter struct {
+	// mu protects all the fields below.
+	mu *sync.Mutex
+
+	// top are the estimated counts of the current heavy hitters.  It contains
+	// at most size entries.
+	top map[string]uint64
+
+	// sketch is the count-min sketch of all the counted keys.
+	sketch [topSketchDepth][]uint64
+
+	// seeds are the hashing seeds of each row of sketch.
+	seeds [topSketchDepth]maphash.Seed
+
+	// size is the maximum number of heavy hitters to track.
+	size int
+
+	// counted is the number of keys counted since the last decay.
+	counted uint64
+}
+
+// newTopCounter returns a new *topCounter tracking up to size heavy hitters.
+// size must be positive.
+func newTopCounter(size int) (c *topCounter) {
+	c = &topCounter{
+		mu:   &sync.Mutex{},
+		top:  make(map[string]uint64, size),
+		size: size,
+	}
+
+	for i := range topSketchDepth {
+		c.sketch[i] = make([]uint64, topSketchWidth)
+		c.seeds[i] = maphash.MakeSeed()
+	}
+
+	return c
+}
+
+// add counts a single occurrence of key.
+func (c *topCounter) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	est := uint64(0)
+	for i := range topSketchDepth {
+		cell := &c.sketch[i][maphash.String(c.seeds[i], key)%topSketchWidth]
+		*cell++
+		if i == 0 || *cell < est {
+			est = *cell
+		}
+	}
+
+	c.updateTop(key, est)
+
+	c.counted++
+	if c.counted >= topDecayPeriod {
+		c.decay()
+	}
+}
+
+// updateTop puts key with the estimated count est into the heavy hitters, if
+// it's one of them.  c.mu must be locked.
+func (c *topCounter) updateTop(key string, est uint64) {
+	if _, ok := c.top[key]; ok || len(c.top) < c.size {
+		c.top[key] = est
+
+		return
+	}
+
+	minKey, minCount := "", est
+	for k, n := range c.top {
+		if n < minCount {
+			minKey, minCount = k, n
+		}
+	}
+
+	if minKey != "" {
+		delete(c.top, minKey)
+		c.top[key] = est
+	}
+}
+
+// decay halves all the counts of c.  c.mu must be locked.
+func (c *topCounter) decay() {
+	for _, row := range c.sketch {
+		for j := range row {
+			row[j] /= 2
+		}
+	}
+
+	for k, n := range c.top {
+		if n /= 2; n == 0 {
+			delete(c.top, k)
+		} else {
+			c.top[k] = n
+		}
+	}
+
+	c.counted = 0
+}
+
+// list returns the current heavy hitters sorted by their counts in descending
+// order.
+func (c *topCounter) list() (entries []TopStatsEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries = make([]TopStatsEntry, 0, len(c.top))
+	for k, n := range c.top {
+		entries = append(entries, TopStatsEntry{Key: k, Count: n})
+	}
+
+	slices.SortFunc(entries, func(a, b TopStatsEntry) (res int) {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Key, b.Key))
+	})
+
+	return entries
+}
+
+// topStats tracks the heaviest domains and clients of the proxy.
+type topStats struct {
+	domains *topCounter
+	clients *topCounter
+}
+
+// newTopStats returns a new properly initialized *topStats or nil if the
+// tracking is disabled in c.
+func newTopStats(c *Config) (s *topStats) {
+	if c.TopStatsSize <= 0 {
+		return nil
+	}
+
+	return &topStats{
+		domains: newTopCounter(c.TopStatsSize),
+		clients: newTopCounter(c.TopStatsSize),
+	}
+}
+
+// countTop counts the request of dctx in the heavy hitters, if those are
+// tracked.  dctx.Req must have a single question.
+func (p *Proxy) countTop(dctx *DNSContext) {
+	if p.topStats == nil {
+		return
+	}
+
+	p.topStats.domains.add(strings.ToLower(dctx.Req.Question[0].Name))
+	p.topStats.clients.add(dctx.Addr.Addr().Unmap().String())
+}
+
+// TopStats returns the current heaviest domains and clients.  It returns empty
+// stats if the tracking is disabled, see [Config.TopStatsSize].
+func (p *Proxy) TopStats() (s TopStats) {
+	if p.topStats == nil {
+		return TopStats{}
+	}
+
+	return TopStats{
+		Domains: p.topStats.domains.list(),
+		Clients: p.topStats.clients.list(),
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopCounter(t *testing.T) {
+	const size = 3
+
+	c := newTopCounter(size)
+
+	// Add the noise of many light keys interleaved with the heavy ones.
+	for i := range 1000 {
+		c.add(fmt.Sprintf("light-%d", i))
+
+		if i%10 < 3 {
+			c.add("heavy-a")
+		}
+		if i%10 < 2 {
+			c.add("heavy-b")
+		}
+		if i%10 < 1 {
+			c.add("heavy-c")
+		}
+	}
+
+	entries := c.list()
+	require.Len(t, entries, size)
+
+	keys := make([]string, 0, size)
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	assert.Equal(t, []string{"heavy-a", "heavy-b", "heavy-c"}, keys)
+
+	// The count-min sketch never underestimates.
+	assert.GreaterOrEqual(t, entries[0].Count, uint64(300))
+
+	c.mu.Lock()
+	c.decay()
+	c.mu.Unlock()
+
+	decayed := c.list()
+	require.Len(t, decayed, size)
+
+	assert.Equal(t, entries[0].Count/2, decayed[0].Count)
+}
+
+func TestProxy_TopStats(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	newProxy := func(t *testing.T, size int) (p *Proxy) {
+		t.Helper()
+
+		return mustNew(t, &Config{
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{ups},
+			},
+			TrustedProxies: defaultTrustedProxies,
+			TopStatsSize:   size,
+		})
+	}
+
+	handle := func(t *testing.T, p *Proxy, client, host string) {
+		t.Helper()
+
+		dctx := &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion(host, dns.TypeA),
+			Addr: netip.AddrPortFrom(netip.MustParseAddr(client), 53),
+		}
+
+		require.NoError(t, p.handleDNSRequest(dctx))
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		p := newProxy(t, 0)
+		handle(t, p, "192.0.2.1", "example.org.")
+
+		assert.Equal(t, TopStats{}, p.TopStats())
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		p := newProxy(t, 10)
+		handle(t, p, "192.0.2.1", "EXAMPLE.org.")
+		handle(t, p, "192.0.2.1", "example.org.")
+		handle(t, p, "192.0.2.2", "example.net.")
+
+		assert.Equal(t, TopStats{
+			Domains: []TopStatsEntry{
+				{Key: "example.org.", Count: 2},
+				{Key: "example.net.", Count: 1},
+			},
+			Clients: []TopStatsEntry{
+				{Key: "192.0.2.1", Count: 2},
+				{Key: "192.0.2.2", Count: 1},
+			},
+		}, p.TopStats())
+	})
+}
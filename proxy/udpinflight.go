@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// maxUDPRetransmits is the maximum number of retransmissions of a single query
+// waiting for its resolution.  The further ones are dropped.
+const maxUDPRetransmits = 16
+
+// udpQueryKey identifies a UDP query sent by a client.  The retransmissions of
+// the same query have the same key.
+type udpQueryKey struct {
+	// name is the lowercased question name.
+	name string
+
+	addr   netip.AddrPort
+	id     uint16
+	qtype  uint16
+	qclass uint16
+}
+
+// newUDPQueryKey returns the key of the query from dctx.  ok is false if the
+// query has no question.
+func newUDPQueryKey(dctx *DNSContext) (k udpQueryKey, ok bool) {
+	if len(dctx.Req.Question) == 0 {
+		return udpQueryKey{}, false
+	}
+
+	q := dctx.Req.Question[0]
+
+	return udpQueryKey{
+		name:   strings.ToLower(q.Name),
+		addr:   dctx.Addr,
+		id:     dctx.Req.Id,
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+	}, true
+}
+
+// udpInflight tracks the UDP queries being resolved, so that the client's
+// retransmissions of a query are answered with the result of the resolution
+// already in progress instead of being resolved again.  It's safe for
+// concurrent use.
+type udpInflight struct {
+	// mu protects queries.
+	mu *sync.Mutex
+
+	// queries maps the queries in progress to their retransmissions.
+	queries map[udpQueryKey][]*DNSContext
+}
+
+// newUDPInflight returns a new properly initialized *udpInflight.
+func newUDPInflight() (f *udpInflight) {
+	return &udpInflight{
+		mu:      &sync.Mutex{},
+		queries: map[udpQueryKey][]*DNSContext{},
+	}
+}
+
+// start registers the query with k.  If the query is already in progress,
+// dctx is attached to it as a retransmission and started is false.
+func (f *udpInflight) start(k udpQueryKey, dctx *DNSContext) (started bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	retransmits, ok := f.queries[k]
+	if !ok {
+		f.queries[k] = nil
+
+		return true
+	}
+
+	if len(retransmits) < maxUDPRetransmits {
+		f.queries[k] = append(retransmits, dctx)
+	}
+
+	return false
+}
+
+// finish unregisters the query with k and returns its retransmissions.
+func (f *udpInflight) finish(k udpQueryKey) (retransmits []*DNSContext) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	retransmits = f.queries[k]
+	delete(f.queries, k)
+
+	return retransmits
+}
+
+// respondRetransmits sends the response from dctx to each of retransmits.
+func (p *Proxy) respondRetransmits(dctx *DNSContext, retransmits []*DNSContext) {
+	if len(retransmits) == 0 || dctx.Res == nil {
+		return
+	}
+
+	log.Debug("dnsproxy: answering %d udp retransmissions from %s", len(retransmits), dctx.Addr)
+
+	for _, r := range retransmits {
+		r.Res = dctx.Res.Copy()
+		r.Res.Id = r.Req.Id
+		p.respond(r)
+	}
+}
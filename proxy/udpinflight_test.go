@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_udpRetransmissions(t *testing.T) {
+	var exchanges atomic.Uint32
+	unblock := make(chan struct{})
+
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+			<-unblock
+
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	conn, err := net.Dial("udp", p.Addr(ProtoUDP).String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	packed, err := req.Pack()
+	require.NoError(t, err)
+
+	const copies = 3
+	for range copies {
+		_, err = conn.Write(packed)
+		require.NoError(t, err)
+	}
+
+	// Wait for all the copies to be received.
+	require.Eventually(t, func() (ok bool) {
+		p.udpInflight.mu.Lock()
+		defer p.udpInflight.mu.Unlock()
+
+		for _, retransmits := range p.udpInflight.queries {
+			return len(retransmits) == copies-1
+		}
+
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	close(unblock)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for range copies {
+		n, readErr := conn.Read(buf)
+		require.NoError(t, readErr)
+
+		resp := &dns.Msg{}
+		require.NoError(t, resp.Unpack(buf[:n]))
+
+		assert.Equal(t, req.Id, resp.Id)
+	}
+
+	assert.Equal(t, uint32(1), exchanges.Load())
+}
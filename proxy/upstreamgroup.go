@@ -0,0 +1,415 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// DefaultUpstreamGroup is the name of the [UpstreamGroup] used for the requests
+// not matching any [UpstreamRoute].
+const DefaultUpstreamGroup = "default"
+
+// UpstreamGroup is a named group of upstreams with its own upstream mode,
+// weights, priorities, and fallbacks.
+type UpstreamGroup struct {
+	// Name is the unique name of the group.  It must not be empty.
+	Name string
+
+	// Upstreams are the upstreams of the group.  It must not be empty.
+	Upstreams []*GroupUpstream
+
+	// Fallbacks are used when all the Upstreams fail.  If empty,
+	// [Config.Fallbacks] are used.
+	Fallbacks []upstream.Upstream
+
+	// Mode is the upstream mode of the group.  The priorities of the
+	// Upstreams are used in all the modes except [UModeParallel] and the A and
+	// AAAA requests in [UModeFastestAddr], and their weights are used in
+	// [UModeLoadBalance], [UModeWeighted], and for the requests other than A
+	// and AAAA in [UModeFastestAddr].
+	Mode UpstreamModeType
+}
+
+// GroupUpstream is an upstream within an [UpstreamGroup].
+type GroupUpstream struct {
+	// Upstream is the upstream itself.  It must not be nil.
+	Upstream upstream.Upstream
+
+	// Weight is the relative share of the requests sent to Upstream among the
+	// upstreams with the same priority, which is further adjusted by the
+	// measured round-trip times.  Zero means 1, and it must not be negative.
+	Weight float64
+
+	// Priority is the priority of Upstream.  The upstreams with lower values
+	// are used first, and the ones with the next value are only used if all of
+	// those have failed.
+	Priority uint
+}
+
+// UpstreamRoute routes the requests to an [UpstreamGroup].  The routes are
+// matched in order, and the first matching one is used.
+type UpstreamRoute struct {
+	// Group is the name of the group the matching requests are routed to.
+	Group string
+
+	// Domains are the domain names the requests for which and for their
+	// subdomains match the route.  If empty, the requests for any domain name
+	// match.
+	Domains []string
+
+	// ClientSubnets are the subnets of the clients the requests from which
+	// match the route.  If empty, the requests from any client match.
+	ClientSubnets []netip.Prefix
+}
+
+const (
+	// errNoDefaultGroup is returned when the upstream groups are configured
+	// without the default one.
+	errNoDefaultGroup errors.Error = "no " + DefaultUpstreamGroup + " group"
+
+	// errUpstreamsAndGroups is returned when both the upstream groups and the
+	// general upstreams are configured.
+	errUpstreamsAndGroups errors.Error = "upstream groups can't be used with upstreams"
+)
+
+// upstreamTier is the set of the upstreams of a group with the same priority.
+type upstreamTier struct {
+	// ups are the upstreams.
+	ups []upstream.Upstream
+
+	// weights are the static weights of ups with the same indexes.
+	weights []float64
+}
+
+// upstreamGroup is the compiled [UpstreamGroup].
+type upstreamGroup struct {
+	*UpstreamGroup
+
+	// tiers are the upstreams of the group sorted by priority.
+	tiers []*upstreamTier
+
+	// ups are all the upstreams of the group sorted by priority.
+	ups []upstream.Upstream
+}
+
+// newUpstreamGroup validates g and returns the compiled group.
+func newUpstreamGroup(g *UpstreamGroup) (ug *upstreamGroup, err error) {
+	if len(g.Upstreams) == 0 {
+		return nil, upstream.ErrNoUpstreams
+	} else if g.Mode > UModeStaggered {
+		return nil, fmt.Errorf("bad mode %s", g.Mode)
+	}
+
+	sorted := slices.Clone(g.Upstreams)
+	slices.SortStableFunc(sorted, func(a, b *GroupUpstream) (res int) {
+		return cmp.Compare(a.Priority, b.Priority)
+	})
+
+	ug = &upstreamGroup{
+		UpstreamGroup: g,
+		ups:           make([]upstream.Upstream, 0, len(sorted)),
+	}
+
+	var tier *upstreamTier
+	for i, gu := range sorted {
+		if gu == nil || gu.Upstream == nil {
+			return nil, fmt.Errorf("upstream at index %d is nil", i)
+		} else if gu.Weight < 0 {
+			return nil, fmt.Errorf("upstream %s: negative weight %v", gu.Upstream.Address(), gu.Weight)
+		}
+
+		if i == 0 || gu.Priority != sorted[i-1].Priority {
+			tier = &upstreamTier{}
+			ug.tiers = append(ug.tiers, tier)
+		}
+
+		tier.ups = append(tier.ups, gu.Upstream)
+		tier.weights = append(tier.weights, cmp.Or(gu.Weight, 1))
+		ug.ups = append(ug.ups, gu.Upstream)
+	}
+
+	return ug, nil
+}
+
+// upstreamRoute is the compiled [UpstreamRoute].
+type upstreamRoute struct {
+	// group is the group the matching requests are routed to.
+	group *upstreamGroup
+
+	// domains are the lowercased FQDNs of the route.  It's nil if any domain
+	// name matches.
+	domains *container.MapSet[string]
+
+	// subnets are the client subnets of the route.  It's nil if any client
+	// matches.
+	subnets netutil.SliceSubnetSet
+}
+
+// match returns true if the request for fqdn, which must be lowercased, from
+// addr matches r.
+func (r *upstreamRoute) match(fqdn string, addr netip.Addr) (ok bool) {
+	if r.subnets != nil && !r.subnets.Contains(addr) {
+		return false
+	}
+
+	if r.domains == nil {
+		return true
+	}
+
+	for ; fqdn != ""; _, fqdn, _ = strings.Cut(fqdn, ".") {
+		if r.domains.Has(fqdn) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// upstreamRouter selects the upstream groups for the requests.
+type upstreamRouter struct {
+	// def is the default group.
+	def *upstreamGroup
+
+	// groups are the compiled groups in the configured order.
+	groups []*upstreamGroup
+
+	// routes are the compiled routes in the configured order.
+	routes []*upstreamRoute
+}
+
+// newUpstreamRouter validates the upstream groups and routes of c and returns
+// the router for them, or nil if there are none.
+func newUpstreamRouter(c *Config) (r *upstreamRouter, err error) {
+	if len(c.UpstreamGroups) == 0 {
+		if len(c.UpstreamRoutes) > 0 {
+			return nil, errors.Error("upstream routes require upstream groups")
+		}
+
+		return nil, nil
+	}
+
+	if c.UpstreamConfig != nil && !errors.Is(c.UpstreamConfig.validate(), upstream.ErrNoUpstreams) {
+		return nil, errUpstreamsAndGroups
+	}
+
+	r = &upstreamRouter{}
+	byName := make(map[string]*upstreamGroup, len(c.UpstreamGroups))
+	for i, g := range c.UpstreamGroups {
+		if g == nil || g.Name == "" {
+			return nil, fmt.Errorf("group at index %d: empty name", i)
+		} else if byName[g.Name] != nil {
+			return nil, fmt.Errorf("group %q: duplicated name", g.Name)
+		}
+
+		var ug *upstreamGroup
+		ug, err = newUpstreamGroup(g)
+		if err != nil {
+			return nil, fmt.Errorf("group %q: %w", g.Name, err)
+		}
+
+		byName[g.Name] = ug
+		r.groups = append(r.groups, ug)
+	}
+
+	r.def = byName[DefaultUpstreamGroup]
+	if r.def == nil {
+		return nil, errNoDefaultGroup
+	}
+
+	for i, route := range c.UpstreamRoutes {
+		var ur *upstreamRoute
+		ur, err = newUpstreamRoute(route, byName)
+		if err != nil {
+			return nil, fmt.Errorf("route at index %d: %w", i, err)
+		}
+
+		r.routes = append(r.routes, ur)
+	}
+
+	return r, nil
+}
+
+// newUpstreamRoute validates route and returns the compiled one using the
+// groups by their names.
+func newUpstreamRoute(
+	route *UpstreamRoute,
+	groups map[string]*upstreamGroup,
+) (r *upstreamRoute, err error) {
+	if route == nil {
+		return nil, errors.Error("route is nil")
+	}
+
+	r = &upstreamRoute{
+		group: groups[route.Group],
+	}
+	if r.group == nil {
+		return nil, fmt.Errorf("no group %q", route.Group)
+	}
+
+	if len(route.Domains) > 0 {
+		r.domains = container.NewMapSet[string]()
+		for _, d := range route.Domains {
+			d = strings.ToLower(strings.TrimSuffix(d, "."))
+			err = netutil.ValidateDomainName(d)
+			if err != nil {
+				// Don't wrap the error since it's informative enough as is.
+				return nil, err
+			}
+
+			r.domains.Add(dns.Fqdn(d))
+		}
+	}
+
+	if len(route.ClientSubnets) > 0 {
+		r.subnets = netutil.SliceSubnetSet(slices.Clone(route.ClientSubnets))
+	}
+
+	return r, nil
+}
+
+// initUpstreamRouter compiles the upstream groups and routes of p, if any, and
+// replaces the empty upstream configuration with the one containing the
+// upstreams of all the groups.
+func (p *Proxy) initUpstreamRouter() (err error) {
+	p.upstreamRouter, err = newUpstreamRouter(&p.Config)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	} else if p.upstreamRouter != nil {
+		p.UpstreamConfig = p.upstreamRouter.upstreamConfig()
+	}
+
+	return nil
+}
+
+// route returns the group for the request for host from addr.
+func (r *upstreamRouter) route(host string, addr netip.Addr) (g *upstreamGroup) {
+	fqdn := strings.ToLower(dns.Fqdn(host))
+	for _, route := range r.routes {
+		if route.match(fqdn, addr) {
+			return route.group
+		}
+	}
+
+	return r.def
+}
+
+// upstreamConfig returns the upstream configuration containing the upstreams
+// of all the groups.  It's used for warming up, probing, and closing them.
+func (r *upstreamRouter) upstreamConfig() (conf *UpstreamConfig) {
+	conf = &UpstreamConfig{}
+	for _, g := range r.groups {
+		conf.Upstreams = append(conf.Upstreams, g.ups...)
+	}
+
+	return conf
+}
+
+// fallbackUpstreams returns the upstreams of the fallbacks of all the groups.
+// Those aren't included into [upstreamRouter.upstreamConfig], since they
+// shouldn't be warmed up or probed.
+func (r *upstreamRouter) fallbackUpstreams() (ups []upstream.Upstream) {
+	for _, g := range r.groups {
+		ups = append(ups, g.Fallbacks...)
+	}
+
+	return ups
+}
+
+// usesFastestAddr returns true if any group of r uses [UModeFastestAddr].
+func (r *upstreamRouter) usesFastestAddr() (ok bool) {
+	return r != nil && slices.ContainsFunc(r.groups, func(g *upstreamGroup) (ok bool) {
+		return g.Mode == UModeFastestAddr
+	})
+}
+
+// exchangeGroup resolves req using the upstreams of g in its mode.  In the
+// load-balancing mode, the upstreams with the next priority are only used if
+// all the ones with the previous priority have failed.
+func (p *Proxy) exchangeGroup(
+	req *dns.Msg,
+	g *upstreamGroup,
+) (resp *dns.Msg, u upstream.Upstream, attempts int, err error) {
+	mode := p.upstreamMode(req, g.Mode)
+	switch mode {
+	case UModeParallel:
+		resp, u, err = p.exchangeParallel(req, g.ups)
+
+		return resp, u, len(g.ups), err
+	case UModeStaggered:
+		return p.exchangeStaggered(req, g.ups)
+	case UModeFastestAddr:
+		switch req.Question[0].Qtype {
+		case dns.TypeA, dns.TypeAAAA:
+			resp, u, err = p.fastestAddr.ExchangeFastest(req, g.ups)
+
+			return resp, u, len(g.ups), err
+		default:
+			// Go on to the load-balancing mode.
+		}
+	default:
+		// Go on to the load-balancing mode.
+	}
+
+	if p.hedger != nil {
+		p.hedger.deposit()
+	}
+
+	var errs []error
+	for _, tier := range g.tiers {
+		var n int
+		resp, u, n, err = p.exchangeTier(req, tier, mode)
+		attempts += n
+		if err == nil {
+			return resp, u, attempts, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return nil, nil, attempts, fmt.Errorf("group %q: %w", g.Name, errors.Join(errs...))
+}
+
+// exchangeTier resolves req using the upstreams of tier in mode.
+func (p *Proxy) exchangeTier(
+	req *dns.Msg,
+	tier *upstreamTier,
+	mode UpstreamModeType,
+) (resp *dns.Msg, u upstream.Upstream, attempts int, err error) {
+	b := p.balancers[mode]
+	switch {
+	case mode == UModeWeighted:
+		// Use the weights of the group instead of [Config.UpstreamWeights].
+		return p.exchangeWeighted(req, tier.ups, slices.Clone(tier.weights))
+	case b != nil:
+		return p.exchangeBalanced(req, tier.ups, b)
+	default:
+		weights := p.calcWeights(tier.ups)
+		for i, w := range tier.weights {
+			weights[i] *= w
+		}
+
+		return p.exchangeWeighted(req, tier.ups, weights)
+	}
+}
+
+// selectFallbacks returns the fallback upstreams for host.  The fallbacks of
+// g, if it's not nil and has any, take precedence over [Config.Fallbacks].
+func (p *Proxy) selectFallbacks(host string, g *upstreamGroup) (ups []upstream.Upstream) {
+	if g != nil && len(g.Fallbacks) > 0 {
+		return g.Fallbacks
+	} else if p.Fallbacks == nil {
+		return nil
+	}
+
+	return p.Fallbacks.getUpstreamsForDomain(host)
+}
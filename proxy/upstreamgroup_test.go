@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFailingUpstream returns an [upstream.Upstream] with addr that always fails
+// to exchange.
+func newFailingUpstream(addr string) (u *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(_ *dns.Msg) (resp *dns.Msg, err error) {
+			return nil, errors.Error("test error")
+		},
+		onAddress: func() (a string) { return addr },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_replyFromUpstream_groups(t *testing.T) {
+	def := newDelayedUpstream("default", 0)
+	family := newDelayedUpstream("family", 0)
+	corp := newDelayedUpstream("corp", 0)
+	corpFallback := newDelayedUpstream("corp-fallback", 0)
+	primary := newFailingUpstream("primary")
+	secondary := newDelayedUpstream("secondary", 0)
+
+	p := mustNew(t, &Config{
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TrustedProxies: defaultTrustedProxies,
+		UpstreamGroups: []*UpstreamGroup{{
+			Name:      DefaultUpstreamGroup,
+			Upstreams: []*GroupUpstream{{Upstream: def}},
+		}, {
+			Name:      "family",
+			Upstreams: []*GroupUpstream{{Upstream: family}},
+		}, {
+			Name:      "corp",
+			Upstreams: []*GroupUpstream{{Upstream: newFailingUpstream("corp-failing")}},
+			Fallbacks: []upstream.Upstream{corpFallback},
+		}, {
+			Name: "tiers",
+			Upstreams: []*GroupUpstream{{
+				Upstream: secondary,
+				Priority: 1,
+			}, {
+				Upstream: primary,
+				Weight:   10,
+			}},
+		}, {
+			Name:      "parallel",
+			Upstreams: []*GroupUpstream{{Upstream: corp}},
+			Mode:      UModeParallel,
+		}},
+		UpstreamRoutes: []*UpstreamRoute{{
+			Group:   "corp",
+			Domains: []string{"corp.example"},
+		}, {
+			Group:   "tiers",
+			Domains: []string{"tiers.example"},
+		}, {
+			Group:   "parallel",
+			Domains: []string{"parallel.example"},
+		}, {
+			Group:         "family",
+			ClientSubnets: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		}},
+	})
+	require.Len(t, p.UpstreamConfig.Upstreams, 6)
+
+	defaultClient := netip.MustParseAddrPort("198.51.100.1:53")
+	familyClient := netip.MustParseAddrPort("192.0.2.1:53")
+
+	testCases := []struct {
+		want   upstream.Upstream
+		addr   netip.AddrPort
+		name   string
+		host   string
+		source Source
+	}{{
+		want:   def,
+		addr:   defaultClient,
+		name:   "default",
+		host:   "example.org.",
+		source: SourceUpstream,
+	}, {
+		want:   family,
+		addr:   familyClient,
+		name:   "client",
+		host:   "example.org.",
+		source: SourceUpstream,
+	}, {
+		want:   corpFallback,
+		addr:   familyClient,
+		name:   "group_fallback",
+		host:   "www.CORP.example.",
+		source: SourceFallback,
+	}, {
+		want:   secondary,
+		addr:   defaultClient,
+		name:   "priority",
+		host:   "tiers.example.",
+		source: SourceUpstream,
+	}, {
+		want:   corp,
+		addr:   defaultClient,
+		name:   "parallel",
+		host:   "parallel.example.",
+		source: SourceUpstream,
+	}, {
+		want:   def,
+		addr:   defaultClient,
+		name:   "not_subdomain",
+		host:   "notcorp.example.",
+		source: SourceUpstream,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA),
+				Addr: tc.addr,
+			}
+
+			ok, err := p.replyFromUpstream(d)
+			require.NoError(t, err)
+			require.True(t, ok)
+
+			assert.Same(t, tc.want, d.Upstream)
+			assert.Equal(t, tc.source, d.Provenance.Source)
+		})
+	}
+}
+
+func TestNewUpstreamRouter(t *testing.T) {
+	u := newDelayedUpstream("upstream", 0)
+	defGroup := &UpstreamGroup{
+		Name:      DefaultUpstreamGroup,
+		Upstreams: []*GroupUpstream{{Upstream: u}},
+	}
+
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &Config{},
+		name:       "none",
+		wantErrMsg: "",
+	}, {
+		conf: &Config{
+			UpstreamRoutes: []*UpstreamRoute{{Group: DefaultUpstreamGroup}},
+		},
+		name:       "routes_without_groups",
+		wantErrMsg: "upstream routes require upstream groups",
+	}, {
+		conf: &Config{
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+			UpstreamGroups: []*UpstreamGroup{defGroup},
+		},
+		name:       "with_upstreams",
+		wantErrMsg: string(errUpstreamsAndGroups),
+	}, {
+		conf: &Config{
+			UpstreamGroups: []*UpstreamGroup{{
+				Name:      "family",
+				Upstreams: []*GroupUpstream{{Upstream: u}},
+			}},
+		},
+		name:       "no_default",
+		wantErrMsg: string(errNoDefaultGroup),
+	}, {
+		conf: &Config{
+			UpstreamGroups: []*UpstreamGroup{defGroup, defGroup},
+		},
+		name:       "duplicated",
+		wantErrMsg: `group "default": duplicated name`,
+	}, {
+		conf: &Config{
+			UpstreamGroups: []*UpstreamGroup{{Name: DefaultUpstreamGroup}},
+		},
+		name:       "empty_group",
+		wantErrMsg: `group "default": ` + upstream.ErrNoUpstreams.Error(),
+	}, {
+		conf: &Config{
+			UpstreamGroups: []*UpstreamGroup{{
+				Name:      DefaultUpstreamGroup,
+				Upstreams: []*GroupUpstream{{Upstream: u, Weight: -1}},
+			}},
+		},
+		name:       "negative_weight",
+		wantErrMsg: `group "default": upstream upstream: negative weight -1`,
+	}, {
+		conf: &Config{
+			UpstreamGroups: []*UpstreamGroup{defGroup},
+			UpstreamRoutes: []*UpstreamRoute{{Group: "family"}},
+		},
+		name:       "unknown_group",
+		wantErrMsg: `route at index 0: no group "family"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newUpstreamRouter(tc.conf)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
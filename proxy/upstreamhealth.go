@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultHealthCheckFailures is the default number of the consecutive
+	// failures after which an upstream is ejected, see
+	// [Config.HealthCheckFailures].
+	defaultHealthCheckFailures = 3
+
+	// defaultEjectionBackoff is the default time an upstream is ejected for
+	// the first time, see [Config.EjectionBackoff].
+	defaultEjectionBackoff = 10 * time.Second
+
+	// defaultEjectionBackoffMax is the default maximum time an upstream is
+	// ejected for, see [Config.EjectionBackoffMax].
+	defaultEjectionBackoffMax = 5 * time.Minute
+)
+
+// UpstreamState is the health state of an upstream, see
+// [Config.HealthCheckInterval].
+type UpstreamState uint8
+
+// UpstreamState values.
+const (
+	// UpstreamStateHealthy means that the upstream is used for the requests.
+	UpstreamStateHealthy UpstreamState = iota
+
+	// UpstreamStateEjected means that the upstream isn't used for the
+	// requests, unless all the other upstreams are ejected as well.
+	UpstreamStateEjected
+)
+
+// String implements the [fmt.Stringer] interface for UpstreamState.
+func (s UpstreamState) String() (str string) {
+	switch s {
+	case UpstreamStateHealthy:
+		return "healthy"
+	case UpstreamStateEjected:
+		return "ejected"
+	default:
+		return fmt.Sprintf("!bad_upstream_state_%d", s)
+	}
+}
+
+// UpstreamStateChange describes the transition of an upstream to another
+// health state.
+type UpstreamStateChange struct {
+	// Err is the last error of the upstream for [UpstreamStateEjected], and
+	// nil for [UpstreamStateHealthy].
+	Err error
+
+	// Until is the time until which the upstream isn't probed for
+	// [UpstreamStateEjected], and zero for [UpstreamStateHealthy].
+	Until time.Time
+
+	// Address is the address of the upstream.
+	Address string
+
+	// State is the new state of the upstream.
+	State UpstreamState
+}
+
+// upstreamHealthEntry is the health state of a single upstream.
+type upstreamHealthEntry struct {
+	// until is the time until which the ejected upstream isn't probed.
+	until time.Time
+
+	// failures is the number of the consecutive failures.
+	failures uint
+
+	// ejections is the number of the consecutive ejections without the
+	// upstream being re-admitted.
+	ejections uint
+}
+
+// upstreamHealth tracks the failures of the upstreams and ejects the failing
+// ones, so that those aren't used for the requests until they pass a health
+// probe.  The time until the next probe of an ejected upstream doubles with
+// each failed one.  It's safe for concurrent use.
+type upstreamHealth struct {
+	// mu protects entries.
+	mu *sync.Mutex
+
+	// entries are the states of the upstreams by their addresses.
+	entries map[string]*upstreamHealthEntry
+
+	// onChange, if not nil, is called on the state transitions.
+	onChange func(c *UpstreamStateChange)
+
+	// failures is the number of the consecutive failures after which an
+	// upstream is ejected.
+	failures uint
+
+	// initial is the time an upstream is ejected for the first time.
+	initial time.Duration
+
+	// max is the maximum time an upstream is ejected for.
+	max time.Duration
+}
+
+// newUpstreamHealth returns a new properly initialized *upstreamHealth or nil
+// if the health checks are disabled in c.
+func newUpstreamHealth(c *Config) (h *upstreamHealth) {
+	if c.HealthCheckInterval <= 0 {
+		return nil
+	}
+
+	failures := c.HealthCheckFailures
+	if failures == 0 {
+		failures = defaultHealthCheckFailures
+	}
+
+	initial := c.EjectionBackoff
+	if initial <= 0 {
+		initial = defaultEjectionBackoff
+	}
+
+	maxBackoff := c.EjectionBackoffMax
+	if maxBackoff <= 0 {
+		maxBackoff = max(defaultEjectionBackoffMax, initial)
+	}
+
+	return &upstreamHealth{
+		mu:       &sync.Mutex{},
+		entries:  map[string]*upstreamHealthEntry{},
+		onChange: c.OnUpstreamStateChange,
+		failures: failures,
+		initial:  min(initial, maxBackoff),
+		max:      maxBackoff,
+	}
+}
+
+// validateUpstreamHealth returns an error if the upstream health checks
+// configuration of c is invalid.
+func (c *Config) validateUpstreamHealth() (err error) {
+	switch {
+	case c.HealthCheckInterval < 0:
+		return errors.Error("negative interval")
+	case c.EjectionBackoff < 0:
+		return errors.Error("negative ejection backoff")
+	case c.EjectionBackoffMax > 0 && c.EjectionBackoff > c.EjectionBackoffMax:
+		return fmt.Errorf(
+			"ejection backoff %s greater than max %s",
+			c.EjectionBackoff,
+			c.EjectionBackoffMax,
+		)
+	default:
+		return nil
+	}
+}
+
+// record updates the state of the upstream with addr after it has been
+// requested at now and failed with err, if not nil.
+func (h *upstreamHealth) record(addr string, err error, now time.Time) {
+	if errors.Is(err, upstream.ErrIterativeQType) {
+		// The iterative resolver hasn't been requested at all.
+		return
+	}
+
+	c := h.update(addr, err, now)
+	if c == nil {
+		return
+	}
+
+	if c.State == UpstreamStateEjected {
+		log.Info("dnsproxy: upstream %s ejected until %s: %s", addr, c.Until.Format(time.RFC3339), err)
+	} else {
+		log.Info("dnsproxy: upstream %s re-admitted", addr)
+	}
+
+	if h.onChange != nil {
+		h.onChange(c)
+	}
+}
+
+// update updates the state of the upstream with addr and returns the
+// transition, if any.
+func (h *upstreamHealth) update(addr string, err error, now time.Time) (c *UpstreamStateChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e := h.entries[addr]
+	if err == nil {
+		if e == nil {
+			return nil
+		}
+
+		delete(h.entries, addr)
+		if e.ejections == 0 {
+			return nil
+		}
+
+		return &UpstreamStateChange{
+			Address: addr,
+			State:   UpstreamStateHealthy,
+		}
+	}
+
+	if e == nil {
+		e = &upstreamHealthEntry{}
+		h.entries[addr] = e
+	}
+
+	e.failures++
+	switch {
+	case e.ejections > 0:
+		if now.Before(e.until) {
+			return nil
+		}
+
+		// The upstream has failed the probe after the backoff, so eject it
+		// for longer.
+		e.ejections++
+		e.until = now.Add(h.backoff(e.ejections))
+		log.Debug("dnsproxy: upstream %s still failing, ejected until %s", addr, e.until)
+
+		return nil
+	case e.failures >= h.failures:
+		e.ejections = 1
+		e.until = now.Add(h.initial)
+
+		return &UpstreamStateChange{
+			Err:     err,
+			Until:   e.until,
+			Address: addr,
+			State:   UpstreamStateEjected,
+		}
+	default:
+		return nil
+	}
+}
+
+// backoff returns the time an upstream is ejected for after the specified
+// number of consecutive ejections.
+func (h *upstreamHealth) backoff(ejections uint) (d time.Duration) {
+	d = h.initial
+	for range ejections - 1 {
+		if d >= h.max/2 {
+			return h.max
+		}
+
+		d *= 2
+	}
+
+	return d
+}
+
+// ejected returns true if the upstream with addr is ejected.
+func (h *upstreamHealth) ejected(addr string) (ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e := h.entries[addr]
+
+	return e != nil && e.ejections > 0
+}
+
+// shouldProbe returns true if the upstream with addr should be probed at now,
+// i.e. if it isn't ejected or its backoff is over.
+func (h *upstreamHealth) shouldProbe(addr string, now time.Time) (ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e := h.entries[addr]
+
+	return e == nil || e.ejections == 0 || !now.Before(e.until)
+}
+
+// exclude sets the weights of the ejected upstreams from ups to zero, unless
+// all of them are ejected.  weights must correspond to ups.
+func (h *upstreamHealth) exclude(ups []upstream.Upstream, weights []float64) {
+	ejected := make([]bool, len(ups))
+	healthy := false
+	for i, u := range ups {
+		ejected[i] = h.ejected(u.Address())
+		healthy = healthy || !ejected[i]
+	}
+
+	if !healthy {
+		return
+	}
+
+	for i, ok := range ejected {
+		if ok {
+			weights[i] = 0
+		}
+	}
+}
+
+// filter returns the upstreams from ups which aren't ejected, or ups itself if
+// all of them are.
+func (h *upstreamHealth) filter(ups []upstream.Upstream) (healthy []upstream.Upstream) {
+	for _, u := range ups {
+		if !h.ejected(u.Address()) {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return ups
+	}
+
+	return healthy
+}
+
+// checkUpstreams probes the health of all the upstreams of p each
+// [Config.HealthCheckInterval] until stop is closed.  It's intended to be used
+// as a goroutine.
+func (p *Proxy) checkUpstreams(stop <-chan struct{}) {
+	defer log.OnPanic("dnsproxy: checking upstreams")
+
+	ticker := time.NewTicker(p.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.checkOnce()
+		}
+	}
+}
+
+// checkOnce sends a health probe to each upstream of p, which isn't in the
+// ejection backoff, in parallel and waits for all of them to finish.
+func (p *Proxy) checkOnce() {
+	now := p.time.Now()
+
+	wg := &sync.WaitGroup{}
+	for _, u := range p.allUpstreams() {
+		if !p.upstreamHealth.shouldProbe(u.Address(), now) {
+			continue
+		}
+
+		wg.Add(1)
+		go p.check(u, wg)
+	}
+
+	wg.Wait()
+}
+
+// check sends a health probe, which is a request for the SOA record of the
+// root zone, to u and records the result.  The SERVFAIL responses are
+// considered failures.  It's intended to be used as a goroutine.
+func (p *Proxy) check(u upstream.Upstream, wg *sync.WaitGroup) {
+	defer log.OnPanic("dnsproxy: checking upstream")
+	defer wg.Done()
+
+	req := (&dns.Msg{}).SetQuestion(".", dns.TypeSOA)
+	resp, err := u.Exchange(req)
+	if err == nil && resp.Rcode == dns.RcodeServerFailure {
+		err = errors.Error("servfail")
+	}
+
+	p.upstreamHealth.record(u.Address(), err, p.time.Now())
+}
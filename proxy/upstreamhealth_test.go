@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	var changes []*UpstreamStateChange
+	h := newUpstreamHealth(&Config{
+		HealthCheckInterval:   time.Second,
+		HealthCheckFailures:   2,
+		EjectionBackoff:       time.Second,
+		EjectionBackoffMax:    3 * time.Second,
+		OnUpstreamStateChange: func(c *UpstreamStateChange) { changes = append(changes, c) },
+	})
+	require.NotNil(t, h)
+
+	const addr = "addr"
+	const testErr errors.Error = "test error"
+
+	now := time.Now()
+	h.record(addr, testErr, now)
+	assert.False(t, h.ejected(addr))
+
+	h.record(addr, nil, now)
+	h.record(addr, testErr, now)
+	assert.False(t, h.ejected(addr))
+
+	h.record(addr, testErr, now)
+	assert.True(t, h.ejected(addr))
+	require.Len(t, changes, 1)
+
+	assert.Equal(t, &UpstreamStateChange{
+		Err:     testErr,
+		Until:   now.Add(time.Second),
+		Address: addr,
+		State:   UpstreamStateEjected,
+	}, changes[0])
+
+	assert.False(t, h.shouldProbe(addr, now))
+
+	for _, want := range []time.Duration{
+		2 * time.Second,
+		3 * time.Second,
+		3 * time.Second,
+	} {
+		now = now.Add(time.Hour)
+		require.True(t, h.shouldProbe(addr, now))
+
+		h.record(addr, testErr, now)
+		assert.False(t, h.shouldProbe(addr, now.Add(want-1)))
+		assert.True(t, h.shouldProbe(addr, now.Add(want)))
+	}
+
+	require.Len(t, changes, 1)
+
+	h.record(addr, nil, now)
+	assert.False(t, h.ejected(addr))
+	require.Len(t, changes, 2)
+
+	assert.Equal(t, &UpstreamStateChange{
+		Address: addr,
+		State:   UpstreamStateHealthy,
+	}, changes[1])
+
+	h.record(addr, upstream.ErrIterativeQType, now)
+	h.record(addr, upstream.ErrIterativeQType, now)
+	assert.False(t, h.ejected(addr))
+
+	assert.Nil(t, newUpstreamHealth(&Config{}))
+}
+
+func TestProxy_checkUpstreams(t *testing.T) {
+	const failingAddr = "failing"
+
+	var healthy atomic.Bool
+	failing := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			if healthy.Load() {
+				return (&dns.Msg{}).SetReply(m), nil
+			}
+
+			return (&dns.Msg{}).SetRcode(m, dns.RcodeServerFailure), nil
+		},
+		onAddress: func() (addr string) { return failingAddr },
+		onClose:   func() (err error) { return nil },
+	}
+
+	var working atomic.Int32
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			working.Add(1)
+
+			return (&dns.Msg{}).SetReply(m), nil
+		},
+		onAddress: func() (addr string) { return "working" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	changes := make(chan *UpstreamStateChange, 2)
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{failing, ups},
+		},
+		TrustedProxies:        defaultTrustedProxies,
+		HealthCheckInterval:   time.Hour,
+		HealthCheckFailures:   1,
+		EjectionBackoff:       time.Nanosecond,
+		OnUpstreamStateChange: func(c *UpstreamStateChange) { changes <- c },
+	})
+
+	p.checkOnce()
+
+	c, _ := testutil.RequireReceive(t, changes, time.Second)
+	assert.Equal(t, failingAddr, c.Address)
+	assert.Equal(t, UpstreamStateEjected, c.State)
+
+	working.Store(0)
+	for range 10 {
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)}
+		_, err := p.replyFromUpstream(d)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, int32(10), working.Load())
+
+	healthy.Store(true)
+	p.checkOnce()
+
+	c, _ = testutil.RequireReceive(t, changes, time.Second)
+	assert.Equal(t, failingAddr, c.Address)
+	assert.Equal(t, UpstreamStateHealthy, c.State)
+}
+
+func TestConfig_validateUpstreamHealth(t *testing.T) {
+	testCases := []struct {
+		name       string
+		conf       *Config
+		wantErrMsg string
+	}{{
+		name:       "disabled",
+		conf:       &Config{},
+		wantErrMsg: "",
+	}, {
+		name: "negative_interval",
+		conf: &Config{
+			HealthCheckInterval: -time.Second,
+		},
+		wantErrMsg: "negative interval",
+	}, {
+		name: "negative_backoff",
+		conf: &Config{
+			HealthCheckInterval: time.Second,
+			EjectionBackoff:     -time.Second,
+		},
+		wantErrMsg: "negative ejection backoff",
+	}, {
+		name: "backoff_greater_than_max",
+		conf: &Config{
+			HealthCheckInterval: time.Second,
+			EjectionBackoff:     time.Minute,
+			EjectionBackoffMax:  time.Second,
+		},
+		wantErrMsg: "ejection backoff 1m0s greater than max 1s",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validateUpstreamHealth())
+		})
+	}
+}
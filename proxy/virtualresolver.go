@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// VirtualResolver is a resolver hosted on the same listeners as the others and
+// selected by the server name the client presents: the one from the TLS
+// handshake for DNS-over-TLS and the host from the Host header or the
+// :authority pseudo-header for DNS-over-HTTPS.  It allows serving several
+// tenants with their own certificates, upstreams, and filtering.
+type VirtualResolver struct {
+	// TLSConfig is the TLS configuration with the certificate for ServerName.
+	// If nil, [Config.TLSConfig] is used.
+	TLSConfig *tls.Config
+
+	// UpstreamConfig is the upstream configuration used for the requests to
+	// this resolver.  If nil, the upstreams of the proxy are used.  It may be
+	// overridden by the [BeforeRequestHandler] for a particular request.
+	UpstreamConfig *CustomUpstreamConfig
+
+	// BeforeRequestHandler, if not nil, handles the requests to this resolver
+	// after [Config.BeforeRequestHandler].  It's typically used to apply the
+	// filtering profile of the tenant.
+	BeforeRequestHandler BeforeRequestHandler
+
+	// ServerName is the server name of the resolver.  It must be a valid
+	// hostname and is matched case-insensitively.  Wildcards aren't supported.
+	ServerName string
+}
+
+// validateVirtualResolvers returns an error if any of vrs is invalid or if the
+// server names are not unique.
+func validateVirtualResolvers(vrs []*VirtualResolver) (err error) {
+	var errs []error
+	names := make(map[string]int, len(vrs))
+	for i, vr := range vrs {
+		err = validateVirtualResolver(vr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("virtual resolver at index %d: %w", i, err))
+
+			continue
+		}
+
+		name := strings.ToLower(vr.ServerName)
+		if prev, ok := names[name]; ok {
+			errs = append(errs, fmt.Errorf(
+				"virtual resolver at index %d: server name %q: duplicates index %d",
+				i,
+				vr.ServerName,
+				prev,
+			))
+		} else {
+			names[name] = i
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateVirtualResolver returns an error if vr is invalid.
+func validateVirtualResolver(vr *VirtualResolver) (err error) {
+	if vr == nil {
+		return errors.Error("virtual resolver is nil")
+	}
+
+	err = netutil.ValidateHostname(vr.ServerName)
+	if err != nil {
+		return fmt.Errorf("server name: %w", err)
+	}
+
+	return nil
+}
+
+// newVirtualResolvers returns the virtual resolvers from vrs mapped by their
+// lowercased server names.  vrs must be valid.
+func newVirtualResolvers(vrs []*VirtualResolver) (m map[string]*VirtualResolver) {
+	if len(vrs) == 0 {
+		return nil
+	}
+
+	m = make(map[string]*VirtualResolver, len(vrs))
+	for _, vr := range vrs {
+		m[strings.ToLower(vr.ServerName)] = vr
+	}
+
+	return m
+}
+
+// listenTLSConfig returns a copy of [Config.TLSConfig] for the listeners.  If
+// nextProtos are not empty, they replace the ALPN protocols.  The certificates
+// of the virtual resolvers, if any, are selected by the TLS server name.
+func (p *Proxy) listenTLSConfig(nextProtos ...string) (conf *tls.Config) {
+	conf = p.TLSConfig.Clone()
+	if len(nextProtos) > 0 {
+		conf.NextProtos = nextProtos
+	}
+
+	if len(p.virtualResolvers) == 0 {
+		return conf
+	}
+
+	vrConfs := make(map[string]*tls.Config, len(p.virtualResolvers))
+	for name, vr := range p.virtualResolvers {
+		if vr.TLSConfig == nil {
+			continue
+		}
+
+		vrConf := vr.TLSConfig.Clone()
+		if len(nextProtos) > 0 {
+			vrConf.NextProtos = nextProtos
+		}
+
+		vrConfs[name] = vrConf
+	}
+
+	next := conf.GetConfigForClient
+	conf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (c *tls.Config, err error) {
+		if c = vrConfs[strings.ToLower(hello.ServerName)]; c != nil {
+			return c, nil
+		}
+
+		if next != nil {
+			return next(hello)
+		}
+
+		// Use the default configuration.
+		return nil, nil
+	}
+
+	return conf
+}
+
+// setVirtualResolver sets the virtual resolver with serverName to d, if any.
+func (p *Proxy) setVirtualResolver(d *DNSContext, serverName string) {
+	vr := p.virtualResolvers[strings.ToLower(serverName)]
+	if vr == nil {
+		return
+	}
+
+	d.VirtualResolver = vr
+	if vr.UpstreamConfig != nil {
+		d.CustomUpstreamConfig = vr.UpstreamConfig
+	}
+}
+
+// connServerName returns the server name presented by the client of conn, if
+// it's a TLS connection.  It must be called after the handshake.
+func connServerName(conn net.Conn) (name string) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	return tlsConn.ConnectionState().ServerName
+}
+
+// requestServerName returns the host from the Host header of r.  For HTTP/2 and
+// HTTP/3 it's the host from the :authority pseudo-header.
+func requestServerName(r *http.Request) (name string) {
+	name, err := netutil.SplitHost(r.Host)
+	if err != nil {
+		return ""
+	}
+
+	return name
+}
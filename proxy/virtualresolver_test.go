@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_virtualResolvers(t *testing.T) {
+	const tenantName = "dns.tenant.example"
+
+	defaultIP, tenantIP := net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}
+
+	defaultTLS, _ := newTLSConfig(t)
+	tenantTLS, _ := newTLSConfig(t)
+
+	blocker := &testBeforeRequestHandler{
+		onHandleBefore: func(p *Proxy, dctx *DNSContext) (err error) {
+			if dctx.Req.Question[0].Name != "blocked.example." {
+				return nil
+			}
+
+			return &BeforeRequestError{
+				Err:      errors.Error("blocked"),
+				Response: (&dns.Msg{}).SetRcode(dctx.Req, dns.RcodeNameError),
+			}
+		},
+	}
+
+	tenantUps := &UpstreamConfig{Upstreams: []upstream.Upstream{newRaceUpstream("tenant", tenantIP, nil)}}
+	p := mustNew(t, &Config{
+		TLSListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		TLSConfig:     defaultTLS,
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newRaceUpstream("default", defaultIP, nil)},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		VirtualResolvers: []*VirtualResolver{{
+			TLSConfig:            tenantTLS,
+			UpstreamConfig:       NewCustomUpstreamConfig(tenantUps, false, 0, false),
+			BeforeRequestHandler: blocker,
+			ServerName:           "DNS.Tenant.Example",
+		}},
+	})
+
+	ctx := context.Background()
+	err := p.Start(ctx)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	addr := p.Addr(ProtoTLS).String()
+
+	testCases := []struct {
+		wantCert   *tls.Config
+		serverName string
+		name       string
+		host       string
+		wantIP     net.IP
+		wantRcode  int
+	}{{
+		wantCert:   tenantTLS,
+		serverName: tenantName,
+		name:       "tenant",
+		host:       "www.example.",
+		wantIP:     tenantIP,
+		wantRcode:  dns.RcodeSuccess,
+	}, {
+		wantCert:   tenantTLS,
+		serverName: tenantName,
+		name:       "tenant_blocked",
+		host:       "blocked.example.",
+		wantIP:     nil,
+		wantRcode:  dns.RcodeNameError,
+	}, {
+		wantCert:   defaultTLS,
+		serverName: tlsServerName,
+		name:       "default",
+		host:       "www.example.",
+		wantIP:     defaultIP,
+		wantRcode:  dns.RcodeSuccess,
+	}, {
+		wantCert:   defaultTLS,
+		serverName: tlsServerName,
+		name:       "default_not_blocked",
+		host:       "blocked.example.",
+		wantIP:     defaultIP,
+		wantRcode:  dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// #nosec G402 -- The certificate is checked below.
+			conn, err := dns.DialWithTLS("tcp-tls", addr, &tls.Config{
+				ServerName:         tc.serverName,
+				InsecureSkipVerify: true,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+			peerCerts := conn.Conn.(*tls.Conn).ConnectionState().PeerCertificates
+			require.NotEmpty(t, peerCerts)
+			assert.Equal(t, tc.wantCert.Certificates[0].Certificate[0], peerCerts[0].Raw)
+
+			err = conn.WriteMsg((&dns.Msg{}).SetQuestion(tc.host, dns.TypeA))
+			require.NoError(t, err)
+
+			resp, err := conn.ReadMsg()
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			if tc.wantIP == nil {
+				assert.Empty(t, resp.Answer)
+
+				return
+			}
+
+			require.Len(t, resp.Answer, 1)
+			assert.Equal(t, tc.wantIP, resp.Answer[0].(*dns.A).A.To4())
+		})
+	}
+}
+
+func TestValidateVirtualResolvers(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		vrs        []*VirtualResolver
+	}{{
+		name:       "valid",
+		wantErrMsg: "",
+		vrs:        []*VirtualResolver{{ServerName: "a.example"}, {ServerName: "b.example"}},
+	}, {
+		name:       "nil",
+		wantErrMsg: "virtual resolver at index 0: virtual resolver is nil",
+		vrs:        []*VirtualResolver{nil},
+	}, {
+		name: "duplicate",
+		wantErrMsg: `virtual resolver at index 1: server name "A.example": ` +
+			`duplicates index 0`,
+		vrs: []*VirtualResolver{{ServerName: "a.example"}, {ServerName: "A.example"}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateVirtualResolvers(tc.vrs)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestProxy_virtualResolvers_http(t *testing.T) {
+	defaultIP, tenantIP := net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}
+
+	tenantUps := &UpstreamConfig{
+		Upstreams: []upstream.Upstream{newRaceUpstream("tenant", tenantIP, nil)},
+	}
+	p := mustNew(t, &Config{
+		HTTPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newRaceUpstream("default", defaultIP, nil)},
+		},
+		TrustedProxies: defaultTrustedProxies,
+		VirtualResolvers: []*VirtualResolver{{
+			UpstreamConfig: NewCustomUpstreamConfig(tenantUps, false, 0, false),
+			ServerName:     "dns.tenant.example",
+		}},
+	})
+
+	ctx := context.Background()
+	err := p.Start(ctx)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	u := &url.URL{
+		Scheme: "http",
+		Host:   p.Addr(ProtoHTTP).String(),
+		Path:   "/dns-query",
+	}
+
+	testCases := []struct {
+		name   string
+		host   string
+		wantIP net.IP
+	}{{
+		name:   "tenant",
+		host:   "dns.tenant.example",
+		wantIP: tenantIP,
+	}, {
+		name:   "tenant_port",
+		host:   "DNS.Tenant.Example:443",
+		wantIP: tenantIP,
+	}, {
+		name:   "default",
+		host:   "",
+		wantIP: defaultIP,
+	}, {
+		name:   "other",
+		host:   "dns.other.example",
+		wantIP: defaultIP,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			packed, err := (&dns.Msg{}).SetQuestion("www.example.", dns.TypeA).Pack()
+			require.NoError(t, err)
+
+			req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(packed))
+			require.NoError(t, err)
+
+			req.Header.Set("Content-Type", "application/dns-message")
+			if tc.host != "" {
+				req.Host = tc.host
+			}
+
+			httpResp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, httpResp.Body.Close)
+
+			require.Equal(t, http.StatusOK, httpResp.StatusCode)
+
+			body, err := io.ReadAll(httpResp.Body)
+			require.NoError(t, err)
+
+			resp := &dns.Msg{}
+			require.NoError(t, resp.Unpack(body))
+
+			require.Len(t, resp.Answer, 1)
+			assert.Equal(t, tc.wantIP, resp.Answer[0].(*dns.A).A.To4())
+		})
+	}
+}
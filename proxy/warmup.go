@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/upstream"
+)
+
+// warmUpUpstreams establishes the connections to all the upstreams of p.  It's
+// intended to be used as a goroutine.
+func (p *Proxy) warmUpUpstreams() {
+	defer log.OnPanic("dnsproxy: warming up upstreams")
+
+	ups := p.allUpstreams()
+
+	start := p.time.Now()
+	err := upstream.WarmUp(ups)
+	elapsed := p.time.Now().Sub(start)
+
+	if err != nil {
+		log.Info("dnsproxy: warming up %d upstreams: %s; elapsed %s", len(ups), err, elapsed)
+
+		return
+	}
+
+	log.Info("dnsproxy: warmed up %d upstreams in %s", len(ups), elapsed)
+}
+
+// allUpstreams returns all the unique upstreams configured for p, including
+// the private, fallback, and virtual resolver ones.
+func (p *Proxy) allUpstreams() (ups []upstream.Upstream) {
+	confs := []*UpstreamConfig{p.UpstreamConfig, p.PrivateRDNSUpstreamConfig, p.Fallbacks}
+	for _, vr := range p.VirtualResolvers {
+		if vr.UpstreamConfig != nil {
+			confs = append(confs, vr.UpstreamConfig.upstream)
+		}
+	}
+
+	seen := map[upstream.Upstream]struct{}{}
+	add := func(us []upstream.Upstream) {
+		for _, u := range us {
+			if _, ok := seen[u]; !ok {
+				seen[u] = struct{}{}
+				ups = append(ups, u)
+			}
+		}
+	}
+
+	for _, uc := range confs {
+		if uc == nil {
+			continue
+		}
+
+		add(uc.Upstreams)
+		for _, us := range uc.DomainReservedUpstreams {
+			add(us)
+		}
+
+		for _, us := range uc.SpecifiedDomainUpstreams {
+			add(us)
+		}
+	}
+
+	return ups
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_warmUpUpstreams(t *testing.T) {
+	warmed := make(chan string, 10)
+	newUps := func(name string) (u *fakeUpstream) {
+		return &fakeUpstream{
+			onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				warmed <- name
+
+				return (&dns.Msg{}).SetReply(req), nil
+			},
+			onAddress: func() (addr string) { return name },
+			onClose:   func() (err error) { return nil },
+		}
+	}
+
+	general := newUps("general")
+	reserved := newUps("reserved")
+	fallback := newUps("fallback")
+
+	p := mustNew(t, &Config{
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{general},
+			DomainReservedUpstreams: map[string][]upstream.Upstream{
+				"example.": {reserved, general},
+			},
+		},
+		Fallbacks: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{fallback, general},
+		},
+		TrustedProxies:  defaultTrustedProxies,
+		WarmUpUpstreams: true,
+	})
+
+	assert.ElementsMatch(t, []upstream.Upstream{general, reserved, fallback}, p.allUpstreams())
+
+	ctx := context.Background()
+	err := p.Start(ctx)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	var got []string
+	for range 3 {
+		name, ok := testutil.RequireReceive(t, warmed, time.Second)
+		require.True(t, ok)
+
+		got = append(got, name)
+	}
+
+	assert.ElementsMatch(t, []string{"general", "reserved", "fallback"}, got)
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/rand"
+)
+
+// ZeroTTLStats contains the counters of the upstream responses with zero TTLs
+// in the answer section, see [Config.ZeroTTLFloor].
+type ZeroTTLStats struct {
+	// Floored is the number of the responses, which zero TTLs have been raised
+	// to [Config.ZeroTTLFloor].
+	Floored uint64
+
+	// Honored is the number of the responses, which zero TTLs have been kept,
+	// since their names aren't within [Config.ZeroTTLFloorDomains].
+	Honored uint64
+}
+
+// zeroTTLFloor raises the zero TTLs of the upstream responses for the
+// configured domains.  It's safe for concurrent use.
+type zeroTTLFloor struct {
+	// domains is the set of the lowercased FQDNs, which responses, including
+	// the ones for their subdomains, are floored.
+	domains map[string]unit
+
+	// floored counts the floored responses.
+	floored atomic.Uint64
+
+	// honored counts the responses with zero TTLs kept.
+	honored atomic.Uint64
+
+	// floor is the minimum TTL in seconds.
+	floor uint32
+
+	// jitter is the maximum random addition to floor in seconds.
+	jitter uint32
+}
+
+// newZeroTTLFloor returns a new properly initialized *zeroTTLFloor or nil if
+// the flooring is disabled in c.
+func newZeroTTLFloor(c *Config) (f *zeroTTLFloor) {
+	if c.ZeroTTLFloor <= 0 || len(c.ZeroTTLFloorDomains) == 0 {
+		return nil
+	}
+
+	f = &zeroTTLFloor{
+		domains: make(map[string]unit, len(c.ZeroTTLFloorDomains)),
+		floor:   max(uint32(c.ZeroTTLFloor/time.Second), 1),
+		jitter:  uint32(c.ZeroTTLFloorJitter / time.Second),
+	}
+
+	for _, name := range c.ZeroTTLFloorDomains {
+		f.domains[dns.Fqdn(strings.ToLower(name))] = unit{}
+	}
+
+	return f
+}
+
+// validateZeroTTLFloor returns an error if the zero TTL flooring configuration
+// of c is invalid.
+func (c *Config) validateZeroTTLFloor() (err error) {
+	switch {
+	case c.ZeroTTLFloor < 0:
+		return errors.Error("negative floor")
+	case c.ZeroTTLFloorJitter < 0:
+		return errors.Error("negative jitter")
+	}
+
+	for i, name := range c.ZeroTTLFloorDomains {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(name, "."))
+		if err != nil {
+			return fmt.Errorf("domain at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// matches returns true if host, which is a lowercased FQDN, is within the
+// domains of f.
+func (f *zeroTTLFloor) matches(host string) (ok bool) {
+	for name := host; name != ""; _, name, _ = strings.Cut(name, ".") {
+		if _, ok = f.domains[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply raises the zero TTLs in the answer section of resp, which is the
+// response to q, to the floor with a random jitter, if q is for one of the
+// domains of f.  The same TTL is used for all the records, so that the RRsets
+// stay consistent.  f may be nil.
+func (f *zeroTTLFloor) apply(q dns.Question, resp *dns.Msg) {
+	if f == nil || !hasZeroTTL(resp.Answer) {
+		return
+	}
+
+	if !f.matches(strings.ToLower(q.Name)) {
+		f.honored.Add(1)
+
+		return
+	}
+
+	ttl := f.floor
+	if f.jitter > 0 {
+		ttl += uint32(rand.Int63n(int64(f.jitter) + 1))
+	}
+
+	for _, rr := range resp.Answer {
+		if hdr := rr.Header(); hdr.Ttl == 0 && hdr.Rrtype != dns.TypeOPT {
+			hdr.Ttl = ttl
+		}
+	}
+
+	f.floored.Add(1)
+}
+
+// hasZeroTTL returns true if rrs contain a record with zero TTL.
+func hasZeroTTL(rrs []dns.RR) (ok bool) {
+	for _, rr := range rrs {
+		if hdr := rr.Header(); hdr.Ttl == 0 && hdr.Rrtype != dns.TypeOPT {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ZeroTTLStats returns the counters of the responses with zero TTLs.  It
+// returns empty stats if [Config.ZeroTTLFloor] is disabled.
+func (p *Proxy) ZeroTTLStats() (s ZeroTTLStats) {
+	if p.zeroTTLFloor == nil {
+		return ZeroTTLStats{}
+	}
+
+	return ZeroTTLStats{
+		Floored: p.zeroTTLFloor.floored.Load(),
+		Honored: p.zeroTTLFloor.honored.Load(),
+	}
+}
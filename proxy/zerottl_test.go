@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newZeroTTLResp returns a response to the A request for host with the answers
+// having ttls.
+func newZeroTTLResp(host string, ttls ...uint32) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetReply((&dns.Msg{}).SetQuestion(host, dns.TypeA))
+	for _, ttl := range ttls {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IP{192, 0, 2, 1},
+		})
+	}
+
+	return resp
+}
+
+func TestZeroTTLFloor_apply(t *testing.T) {
+	testCases := []struct {
+		name     string
+		host     string
+		ttls     []uint32
+		wantTTLs []uint32
+		floored  bool
+	}{{
+		name:     "domain",
+		host:     "tracker.example.",
+		ttls:     []uint32{0, 0},
+		wantTTLs: []uint32{10, 10},
+		floored:  true,
+	}, {
+		name:     "subdomain",
+		host:     "A.Tracker.example.",
+		ttls:     []uint32{0, 60},
+		wantTTLs: []uint32{10, 60},
+		floored:  true,
+	}, {
+		name:     "other",
+		host:     "example.org.",
+		ttls:     []uint32{0},
+		wantTTLs: []uint32{0},
+		floored:  false,
+	}, {
+		name:     "parent",
+		host:     "example.",
+		ttls:     []uint32{0},
+		wantTTLs: []uint32{0},
+		floored:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newZeroTTLFloor(&Config{
+				ZeroTTLFloor:        10 * time.Second,
+				ZeroTTLFloorDomains: []string{"tracker.example"},
+			})
+			require.NotNil(t, f)
+
+			resp := newZeroTTLResp(tc.host, tc.ttls...)
+			f.apply(resp.Question[0], resp)
+
+			var ttls []uint32
+			for _, rr := range resp.Answer {
+				ttls = append(ttls, rr.Header().Ttl)
+			}
+
+			assert.Equal(t, tc.wantTTLs, ttls)
+
+			if tc.floored {
+				assert.Equal(t, uint64(1), f.floored.Load())
+				assert.Zero(t, f.honored.Load())
+			} else {
+				assert.Zero(t, f.floored.Load())
+				assert.Equal(t, uint64(1), f.honored.Load())
+			}
+		})
+	}
+
+	t.Run("jitter", func(t *testing.T) {
+		f := newZeroTTLFloor(&Config{
+			ZeroTTLFloor:        10 * time.Second,
+			ZeroTTLFloorJitter:  5 * time.Second,
+			ZeroTTLFloorDomains: []string{"tracker.example."},
+		})
+		require.NotNil(t, f)
+
+		for range 100 {
+			resp := newZeroTTLResp("tracker.example.", 0, 0)
+			f.apply(resp.Question[0], resp)
+
+			ttl := resp.Answer[0].Header().Ttl
+			assert.Equal(t, ttl, resp.Answer[1].Header().Ttl)
+			assert.GreaterOrEqual(t, ttl, uint32(10))
+			assert.LessOrEqual(t, ttl, uint32(15))
+		}
+	})
+
+	t.Run("no_zero_ttl", func(t *testing.T) {
+		f := newZeroTTLFloor(&Config{
+			ZeroTTLFloor:        10 * time.Second,
+			ZeroTTLFloorDomains: []string{"tracker.example."},
+		})
+		require.NotNil(t, f)
+
+		resp := newZeroTTLResp("example.org.", 60)
+		f.apply(resp.Question[0], resp)
+
+		assert.Zero(t, f.floored.Load())
+		assert.Zero(t, f.honored.Load())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Nil(t, newZeroTTLFloor(&Config{ZeroTTLFloorDomains: []string{"tracker.example"}}))
+		assert.Nil(t, newZeroTTLFloor(&Config{ZeroTTLFloor: time.Second}))
+	})
+}
+
+func TestProxy_ZeroTTLStats(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			resp = newZeroTTLResp(m.Question[0].Name, 0)
+			resp.Id = m.Id
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UDPListenAddr:       []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:      &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:      defaultTrustedProxies,
+		CacheEnabled:        true,
+		CacheSizeBytes:      testCacheSize,
+		ZeroTTLFloor:        time.Minute,
+		ZeroTTLFloorDomains: []string{"tracker.example"},
+	})
+
+	for _, host := range []string{"tracker.example.", "tracker.example.", "example.org."} {
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion(host, dns.TypeA)}
+		require.NoError(t, p.Resolve(d))
+	}
+
+	// The second request for the floored domain is served from the cache.
+	assert.Equal(t, ZeroTTLStats{Floored: 1, Honored: 1}, p.ZeroTTLStats())
+	assert.Equal(t, uint64(1), p.CacheStats().Hits)
+}
+
+func TestConfig_validateZeroTTLFloor(t *testing.T) {
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf: &Config{
+			ZeroTTLFloor:        time.Second,
+			ZeroTTLFloorJitter:  time.Second,
+			ZeroTTLFloorDomains: []string{"tracker.example."},
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &Config{ZeroTTLFloor: -1},
+		name:       "negative_floor",
+		wantErrMsg: "negative floor",
+	}, {
+		conf:       &Config{ZeroTTLFloorJitter: -1},
+		name:       "negative_jitter",
+		wantErrMsg: "negative jitter",
+	}, {
+		conf: &Config{ZeroTTLFloorDomains: []string{"bad domain"}},
+		name: "bad_domain",
+		wantErrMsg: `domain at index 0: bad domain name "bad domain": ` +
+			`bad top-level domain name label "bad domain": ` +
+			`bad top-level domain name label rune ' '`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validateZeroTTLFloor())
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// persistedUsage is the usage of a client as stored in the file.
+type persistedUsage struct {
+	Hour   time.Time `json:"hour"`
+	Day    time.Time `json:"day"`
+	Hourly uint64    `json:"hourly"`
+	Daily  uint64    `json:"daily"`
+}
+
+// load reads the usages from the file at l.path.  A missing file isn't an
+// error, and the usages from the previous days are skipped.
+func (l *Limiter) load() (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	data, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	clients := map[netip.Addr]*persistedUsage{}
+	err = json.Unmarshal(data, &clients)
+	if err != nil {
+		return fmt.Errorf("decoding: %w", err)
+	}
+
+	day := startOfDay(l.now())
+	for addr, pu := range clients {
+		if !pu.Day.Equal(day) {
+			continue
+		}
+
+		l.clients[addr.Unmap()] = &usage{
+			hour:   pu.Hour,
+			day:    pu.Day,
+			hourly: pu.Hourly,
+			daily:  pu.Daily,
+		}
+	}
+
+	log.Debug("quota: loaded usage of %d clients", len(l.clients))
+
+	return nil
+}
+
+// Save writes the usages to the file the limiter has been created with, if
+// any.
+func (l *Limiter) Save() (err error) {
+	if l.path == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	clients := make(map[netip.Addr]*persistedUsage, len(l.clients))
+	for addr, u := range l.clients {
+		clients[addr] = &persistedUsage{
+			Hour:   u.hour,
+			Day:    u.day,
+			Hourly: u.hourly,
+			Daily:  u.daily,
+		}
+	}
+
+	data, err := json.Marshal(clients)
+	if err != nil {
+		return fmt.Errorf("encoding quota usage: %w", err)
+	}
+
+	// Write the file atomically, so that a crash doesn't reset the usage.
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	_, err = tmp.Write(data)
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("writing quota usage: %w", err), os.Remove(tmp.Name()))
+	}
+
+	return nil
+}
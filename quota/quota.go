@@ -0,0 +1,275 @@
+// Package quota implements the per-client quotas of DNS queries over hourly and
+// daily windows, which are useful for multi-tenant deployments.
+package quota
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	rate "github.com/beefsack/go-rate"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// Action is the behavior for the queries of the clients over their quota.
+type Action uint8
+
+const (
+	// ActionRefuse responds to the queries with REFUSED.
+	ActionRefuse Action = iota
+
+	// ActionThrottle only processes the queries at a reduced rate, see
+	// [Config.ThrottleRate], and drops the rest.
+	ActionThrottle
+)
+
+// String implements the [fmt.Stringer] interface for Action.
+func (a Action) String() (s string) {
+	switch a {
+	case ActionRefuse:
+		return "refuse"
+	case ActionThrottle:
+		return "throttle"
+	default:
+		return fmt.Sprintf("!bad_action_%d", uint8(a))
+	}
+}
+
+// ParseAction parses the action from its string representation as returned by
+// [Action.String].
+func ParseAction(s string) (a Action, err error) {
+	for a = ActionRefuse; a <= ActionThrottle; a++ {
+		if a.String() == s {
+			return a, nil
+		}
+	}
+
+	return ActionRefuse, fmt.Errorf("unknown quota action %q", s)
+}
+
+// defaultThrottleRate is the default number of queries per second processed
+// for a client over its quota with [ActionThrottle].
+const defaultThrottleRate = 1
+
+// Config is the configuration of a [Limiter].
+type Config struct {
+	// Path is the path to the file to persist the usage to, see
+	// [Limiter.Save].  If empty, the usage isn't persisted.
+	Path string
+
+	// Hourly is the maximum number of queries from a client per hour (0 for
+	// no limit).
+	Hourly uint64
+
+	// Daily is the maximum number of queries from a client per day (0 for no
+	// limit).
+	Daily uint64
+
+	// ThrottleRate is the number of queries per second processed for a client
+	// over its quota with [ActionThrottle].  If not positive, 1 is used.
+	ThrottleRate int
+
+	// Action is the behavior for the queries of the clients over their quota.
+	Action Action
+}
+
+// usage is the number of queries of a client within the current windows.
+type usage struct {
+	// throttle limits the rate of the queries over the quota.  It's nil until
+	// the client exceeds its quota.
+	throttle *rate.RateLimiter
+
+	// hour is the start of the current hourly window.
+	hour time.Time
+
+	// day is the start of the current daily window.
+	day time.Time
+
+	hourly uint64
+	daily  uint64
+}
+
+// reset starts new windows for u, if the current ones are over at now.
+func (u *usage) reset(now time.Time) {
+	if hour := now.Truncate(time.Hour); !u.hour.Equal(hour) {
+		u.hour, u.hourly = hour, 0
+	}
+
+	if day := startOfDay(now); !u.day.Equal(day) {
+		u.day, u.daily = day, 0
+		u.throttle = nil
+	}
+}
+
+// startOfDay returns the start of the UTC day of t.
+func startOfDay(t time.Time) (day time.Time) {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// Limiter is a [proxy.BeforeRequestHandler] enforcing the per-client quotas of
+// queries.  The clients are identified by their IP addresses, and the windows
+// are aligned to the UTC hours and days.  It's safe for concurrent use.
+type Limiter struct {
+	// now returns the current time.  It's replaced in tests.
+	now func() (t time.Time)
+
+	// mu protects clients and day.
+	mu *sync.Mutex
+
+	// clients are the usages of the clients.
+	clients map[netip.Addr]*usage
+
+	// day is the start of the day of the last query, used to drop the usages
+	// of the clients inactive since the previous days.
+	day time.Time
+
+	path         string
+	hourly       uint64
+	daily        uint64
+	throttleRate int
+	action       Action
+}
+
+// New returns a new properly initialized *Limiter.  The usage is loaded from
+// [Config.Path], if it exists.  c must not be nil.
+func New(c *Config) (l *Limiter, err error) {
+	l = &Limiter{
+		now:          time.Now,
+		mu:           &sync.Mutex{},
+		clients:      map[netip.Addr]*usage{},
+		path:         c.Path,
+		hourly:       c.Hourly,
+		daily:        c.Daily,
+		throttleRate: c.ThrottleRate,
+		action:       c.Action,
+	}
+
+	if l.throttleRate <= 0 {
+		l.throttleRate = defaultThrottleRate
+	}
+
+	if l.path == "" {
+		return l, nil
+	}
+
+	err = l.load()
+	if err != nil {
+		return nil, fmt.Errorf("loading quota usage: %w", err)
+	}
+
+	return l, nil
+}
+
+const (
+	// errOverQuota is returned for the refused queries.
+	errOverQuota errors.Error = "over quota"
+
+	// errThrottled is returned for the dropped queries.
+	errThrottled errors.Error = "over quota, throttled"
+)
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Limiter)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Limiter.
+func (l *Limiter) HandleBefore(_ *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	addr := dctx.Addr.Addr().Unmap()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u := l.count(addr)
+	if !l.isOver(u) {
+		return nil
+	}
+
+	if l.action == ActionThrottle {
+		if u.throttle == nil {
+			u.throttle = rate.New(l.throttleRate, time.Second)
+		}
+
+		if ok, _ := u.throttle.Try(); ok {
+			return nil
+		}
+
+		// Drop the query, since [proxy.Proxy] doesn't respond to the
+		// queries failed with other errors.
+		return fmt.Errorf("quota: %s: %w", addr, errThrottled)
+	}
+
+	log.Debug("quota: refusing %s: %s", addr, errOverQuota)
+
+	return &proxy.BeforeRequestError{
+		Err:      fmt.Errorf("quota: %s: %w", addr, errOverQuota),
+		Response: newRefused(dctx.Req),
+	}
+}
+
+// count counts the query of the client with addr and returns its usage.
+// l.mu must be locked.
+func (l *Limiter) count(addr netip.Addr) (u *usage) {
+	now := l.now()
+	l.dropInactive(now)
+
+	u, ok := l.clients[addr]
+	if !ok {
+		u = &usage{}
+		l.clients[addr] = u
+	}
+
+	u.reset(now)
+	u.hourly++
+	u.daily++
+
+	return u
+}
+
+// dropInactive drops the usages of the clients inactive since the previous
+// days, once a day.  l.mu must be locked.
+func (l *Limiter) dropInactive(now time.Time) {
+	day := startOfDay(now)
+	if l.day.Equal(day) {
+		return
+	}
+
+	l.day = day
+	for addr, u := range l.clients {
+		if u.day.Before(day) {
+			delete(l.clients, addr)
+		}
+	}
+}
+
+// isOver returns true if u exceeds any of the quotas.
+func (l *Limiter) isOver(u *usage) (ok bool) {
+	return (l.hourly > 0 && u.hourly > l.hourly) || (l.daily > 0 && u.daily > l.daily)
+}
+
+// newRefused returns a new REFUSED response to req.
+func newRefused(req *dns.Msg) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetRcode(req, dns.RcodeRefused)
+	resp.RecursionAvailable = true
+
+	return resp
+}
+
+// Usage returns the numbers of queries from the client with addr within the
+// current hourly and daily windows.
+func (l *Limiter) Usage(addr netip.Addr) (hourly, daily uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u, ok := l.clients[addr.Unmap()]
+	if !ok {
+		return 0, 0
+	}
+
+	u.reset(l.now())
+
+	return u.hourly, u.daily
+}
@@ -0,0 +1,144 @@
+package quota
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestContext returns a new *proxy.DNSContext for a request from addr.
+func newTestContext(addr netip.Addr) (dctx *proxy.DNSContext) {
+	return &proxy.DNSContext{
+		Req:  (&dns.Msg{}).SetQuestion("www.example.com.", dns.TypeA),
+		Addr: netip.AddrPortFrom(addr, 53),
+	}
+}
+
+func TestLimiter_HandleBefore(t *testing.T) {
+	var (
+		client      = netip.MustParseAddr("192.0.2.1")
+		otherClient = netip.MustParseAddr("192.0.2.2")
+	)
+
+	now := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+
+	l, err := New(&Config{
+		Hourly: 2,
+		Daily:  3,
+		Action: ActionRefuse,
+	})
+	require.NoError(t, err)
+
+	l.now = func() (t time.Time) { return now }
+
+	handle := func(t *testing.T, addr netip.Addr) (rcode int, ok bool) {
+		t.Helper()
+
+		err = l.HandleBefore(nil, newTestContext(addr))
+		if err == nil {
+			return 0, true
+		}
+
+		reqErr := testutil.RequireTypeAssert[*proxy.BeforeRequestError](t, err)
+		require.NotNil(t, reqErr.Response)
+
+		return reqErr.Response.Rcode, false
+	}
+
+	for range 2 {
+		_, ok := handle(t, client)
+		require.True(t, ok)
+	}
+
+	rcode, ok := handle(t, client)
+	require.False(t, ok)
+	assert.Equal(t, dns.RcodeRefused, rcode)
+
+	_, ok = handle(t, otherClient)
+	assert.True(t, ok)
+
+	// The hourly quota is over, but the daily one is not.
+	now = now.Add(time.Hour)
+	_, ok = handle(t, client)
+	require.False(t, ok)
+
+	hourly, daily := l.Usage(client)
+	assert.Equal(t, uint64(1), hourly)
+	assert.Equal(t, uint64(4), daily)
+
+	now = now.Add(24 * time.Hour)
+	_, ok = handle(t, client)
+	assert.True(t, ok)
+
+	// The inactive client is dropped on the new day.
+	hourly, daily = l.Usage(otherClient)
+	assert.Zero(t, hourly)
+	assert.Zero(t, daily)
+}
+
+func TestLimiter_HandleBefore_throttle(t *testing.T) {
+	client := netip.MustParseAddr("2001:db8::1")
+
+	l, err := New(&Config{
+		Daily:        1,
+		ThrottleRate: 1,
+		Action:       ActionThrottle,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, l.HandleBefore(nil, newTestContext(client)))
+
+	// The first query over the quota is allowed by the throttle.
+	require.NoError(t, l.HandleBefore(nil, newTestContext(client)))
+
+	err = l.HandleBefore(nil, newTestContext(client))
+	require.ErrorIs(t, err, errThrottled)
+
+	var reqErr *proxy.BeforeRequestError
+	assert.False(t, errors.As(err, &reqErr))
+}
+
+func TestLimiter_Save(t *testing.T) {
+	client := netip.MustParseAddr("192.0.2.1")
+	path := filepath.Join(t.TempDir(), "quota.json")
+
+	c := &Config{
+		Path:  path,
+		Daily: 10,
+	}
+
+	l, err := New(c)
+	require.NoError(t, err)
+
+	for range 3 {
+		require.NoError(t, l.HandleBefore(nil, newTestContext(client)))
+	}
+
+	require.NoError(t, l.Save())
+
+	l, err = New(c)
+	require.NoError(t, err)
+
+	_, daily := l.Usage(client)
+	assert.Equal(t, uint64(3), daily)
+}
+
+func TestParseAction(t *testing.T) {
+	for _, a := range []Action{ActionRefuse, ActionThrottle} {
+		got, err := ParseAction(a.String())
+		require.NoError(t, err)
+
+		assert.Equal(t, a, got)
+	}
+
+	_, err := ParseAction("block")
+	assert.Error(t, err)
+}
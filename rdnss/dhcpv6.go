@@ -0,0 +1,206 @@
+package rdnss
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"net/netip"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/ipv6"
+)
+
+// DHCPv6 constants, see RFC 8415 and RFC 3646.
+const (
+	// dhcpServerPort is the port the DHCPv6 servers listen on.
+	dhcpServerPort = 547
+
+	// dhcpHdrLen is the length of the DHCPv6 message header: the message type
+	// and the transaction ID.
+	dhcpHdrLen = 4
+
+	// msgReply is the type of the DHCPv6 Reply message.
+	msgReply = 7
+
+	// msgInformationRequest is the type of the DHCPv6 Information-request
+	// message.
+	msgInformationRequest = 11
+
+	// optClientID is the DHCPv6 Client Identifier option.
+	optClientID = 1
+
+	// optServerID is the DHCPv6 Server Identifier option.
+	optServerID = 2
+
+	// optDNSServers is the DHCPv6 DNS Recursive Name Server option.
+	optDNSServers = 23
+
+	// duidLL is the type of the DUID based on the link-layer address.
+	duidLL = 3
+
+	// duidUUID is the type of the DUID based on the UUID.
+	duidUUID = 4
+
+	// hwTypeEthernet is the hardware type of the Ethernet.
+	hwTypeEthernet = 1
+)
+
+// allDHCPAgents is the link-local multicast group of the DHCPv6 relay agents
+// and servers.
+var allDHCPAgents = netip.MustParseAddr("ff02::1:2")
+
+// dhcpServer is a stateless DHCPv6 server only responding to the
+// Information-request messages with the DNS servers.
+type dhcpServer struct {
+	// duid is the DUID of the server.
+	duid []byte
+
+	// addrs are the announced addresses.
+	addrs []netip.Addr
+}
+
+// newDHCPServer returns a new DHCPv6 server announcing addrs on iface.
+func newDHCPServer(iface *net.Interface, addrs []netip.Addr) (s *dhcpServer) {
+	var duid []byte
+	if len(iface.HardwareAddr) > 0 {
+		duid = binary.BigEndian.AppendUint16(duid, duidLL)
+		duid = binary.BigEndian.AppendUint16(duid, hwTypeEthernet)
+		duid = append(duid, iface.HardwareAddr...)
+	} else {
+		// Interfaces like tunnels have no hardware address, so use a random
+		// UUID, which is fine since the server keeps no state.
+		uuid := make([]byte, 16)
+		_, _ = rand.Read(uuid)
+
+		duid = binary.BigEndian.AppendUint16(duid, duidUUID)
+		duid = append(duid, uuid...)
+	}
+
+	return &dhcpServer{
+		duid:  duid,
+		addrs: addrs,
+	}
+}
+
+// listenDHCPv6 returns the connection to receive the DHCPv6 requests from
+// iface.
+func listenDHCPv6(iface *net.Interface) (p *ipv6.PacketConn, err error) {
+	c, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: dhcpServerPort})
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	p = ipv6.NewPacketConn(c)
+	err = errors.Join(
+		p.SetControlMessage(ipv6.FlagInterface, true),
+		p.JoinGroup(iface, &net.UDPAddr{IP: allDHCPAgents.AsSlice()}),
+	)
+	if err != nil {
+		return nil, errors.WithDeferred(err, c.Close())
+	}
+
+	return p, nil
+}
+
+// serveDHCPv6 responds to the DHCPv6 requests until the announcer is stopped.
+// It's intended to be used as a goroutine.
+func (a *Announcer) serveDHCPv6() {
+	defer log.OnPanic("rdnss: serving dhcpv6")
+	defer a.wg.Done()
+
+	buf := make([]byte, 1500)
+	for {
+		n, cm, src, err := a.dhcpConn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error("rdnss: reading dhcpv6 request: %s", err)
+			}
+
+			return
+		}
+
+		if cm != nil && cm.IfIndex != a.iface.Index {
+			continue
+		}
+
+		resp, ok := a.dhcp.reply(buf[:n])
+		if !ok {
+			continue
+		}
+
+		_, err = a.dhcpConn.WriteTo(resp, &ipv6.ControlMessage{IfIndex: a.iface.Index}, src)
+		if err != nil {
+			log.Error("rdnss: sending dhcpv6 reply to %s: %s", src, err)
+		}
+	}
+}
+
+// reply returns the Reply to the DHCPv6 request req.  ok is false if req isn't
+// a valid Information-request addressed to this server.
+func (s *dhcpServer) reply(req []byte) (resp []byte, ok bool) {
+	if len(req) < dhcpHdrLen || req[0] != msgInformationRequest {
+		return nil, false
+	}
+
+	var clientID []byte
+	for opts := req[dhcpHdrLen:]; len(opts) > 0; {
+		var code uint16
+		var data []byte
+		code, data, opts, ok = nextOption(opts)
+		if !ok {
+			return nil, false
+		}
+
+		switch code {
+		case optClientID:
+			clientID = data
+		case optServerID:
+			if !bytes.Equal(data, s.duid) {
+				// The request is addressed to another server.
+				return nil, false
+			}
+		}
+	}
+
+	resp = append(resp, msgReply)
+	resp = append(resp, req[1:dhcpHdrLen]...)
+	if clientID != nil {
+		resp = appendOption(resp, optClientID, clientID)
+	}
+
+	resp = appendOption(resp, optServerID, s.duid)
+
+	servers := make([]byte, 0, net.IPv6len*len(s.addrs))
+	for _, addr := range s.addrs {
+		servers = append(servers, addr.AsSlice()...)
+	}
+
+	return appendOption(resp, optDNSServers, servers), true
+}
+
+// nextOption parses the first DHCPv6 option of opts.  ok is false if opts are
+// truncated.
+func nextOption(opts []byte) (code uint16, data, rest []byte, ok bool) {
+	if len(opts) < 4 {
+		return 0, nil, nil, false
+	}
+
+	code = binary.BigEndian.Uint16(opts)
+	l := int(binary.BigEndian.Uint16(opts[2:]))
+	if len(opts) < 4+l {
+		return 0, nil, nil, false
+	}
+
+	return code, opts[4 : 4+l], opts[4+l:], true
+}
+
+// appendOption appends the DHCPv6 option with code and data to b.
+func appendOption(b []byte, code uint16, data []byte) (res []byte) {
+	b = binary.BigEndian.AppendUint16(b, code)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+
+	return append(b, data...)
+}
@@ -0,0 +1,385 @@
+// Package rdnss implements announcing the proxy as the recursive DNS server of
+// the network to the IPv6 clients, so that the IPv6-only clients without
+// DHCPv4 find it automatically.
+//
+// The addresses are announced with the RDNSS option of the unsolicited Router
+// Advertisements, sent periodically and in response to the Router
+// Solicitations, as described in RFC 8106.  The advertisements have zero
+// router lifetime, so the clients don't consider the proxy a default router,
+// and don't change any other configuration of the network.  Optionally, the
+// addresses are also announced with the DNS Recursive Name Server option of the
+// stateless DHCPv6, as described in RFC 3646, for the clients not supporting
+// RDNSS.
+//
+// Both require the raw ICMPv6 socket and the DHCPv6 server port, so the
+// process usually needs to have the CAP_NET_RAW and CAP_NET_BIND_SERVICE
+// capabilities.
+package rdnss
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// DefaultInterval is the default interval between the unsolicited Router
+	// Advertisements.
+	DefaultInterval = 5 * time.Minute
+
+	// raHopLimit is the hop limit of the Router Advertisements required by
+	// RFC 4861.
+	raHopLimit = 255
+
+	// solicitedDelay is the minimum interval between the advertisements sent in
+	// response to the Router Solicitations, see MIN_DELAY_BETWEEN_RAS in RFC
+	// 4861.
+	solicitedDelay = 3 * time.Second
+)
+
+// Well-known link-local multicast groups.
+var (
+	allNodes   = netip.MustParseAddr("ff02::1")
+	allRouters = netip.MustParseAddr("ff02::2")
+)
+
+// Config is the configuration of an [Announcer].
+type Config struct {
+	// Interface is the name of the network interface to announce the
+	// addresses on.  It must not be empty.
+	Interface string
+
+	// Addrs are the IPv6 addresses of the proxy to announce.  If empty, the
+	// global unicast IPv6 addresses of the interface are used, or the
+	// link-local ones if there are none.
+	Addrs []netip.Addr
+
+	// Interval is the interval between the unsolicited Router Advertisements.
+	// If not positive, [DefaultInterval] is used.
+	Interval time.Duration
+
+	// Lifetime is the time the clients may use the announced addresses for
+	// after receiving the announcement.  If not positive, three intervals are
+	// used, as recommended by RFC 8106.
+	Lifetime time.Duration
+
+	// DHCPv6 enables announcing the addresses with the stateless DHCPv6 as
+	// well.  The advertisements have the "other configuration" flag set then.
+	DHCPv6 bool
+}
+
+// Announcer announces the proxy as the recursive DNS server of the network.
+type Announcer struct {
+	// iface is the interface to announce on.
+	iface *net.Interface
+
+	// stop is closed to stop the goroutines.
+	stop chan struct{}
+
+	// wg tracks the goroutines.
+	wg *sync.WaitGroup
+
+	// raConn is the ICMPv6 connection.  It's nil until the announcer is
+	// started.
+	raConn *ipv6.PacketConn
+
+	// dhcpConn is the DHCPv6 server connection.  It's nil until the announcer
+	// is started or if DHCPv6 is disabled.
+	dhcpConn *ipv6.PacketConn
+
+	// dhcp is the DHCPv6 server.  It's nil if DHCPv6 is disabled.
+	dhcp *dhcpServer
+
+	// ra is the marshaled Router Advertisement.
+	ra []byte
+
+	// addrs are the announced addresses.
+	addrs []netip.Addr
+
+	// interval is the interval between the unsolicited Router Advertisements.
+	interval time.Duration
+
+	// lifetime is the lifetime of the announced addresses.
+	lifetime time.Duration
+}
+
+// New returns a new properly initialized *Announcer.  c must not be nil.
+func New(c *Config) (a *Announcer, err error) {
+	if c.Interface == "" {
+		return nil, errors.Error("no interface")
+	}
+
+	iface, err := net.InterfaceByName(c.Interface)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	addrs, err := announcedAddrs(iface, c.Addrs)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", iface.Name, err)
+	}
+
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	lifetime := c.Lifetime
+	if lifetime <= 0 {
+		lifetime = 3 * interval
+	}
+
+	a = &Announcer{
+		iface:    iface,
+		stop:     make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+		ra:       newRouterAdvertisement(addrs, lifetime, c.DHCPv6),
+		addrs:    addrs,
+		interval: interval,
+		lifetime: lifetime,
+	}
+
+	if c.DHCPv6 {
+		a.dhcp = newDHCPServer(iface, addrs)
+	}
+
+	return a, nil
+}
+
+// announcedAddrs validates addrs, if any, or returns the IPv6 addresses of
+// iface to announce.
+func announcedAddrs(iface *net.Interface, addrs []netip.Addr) (res []netip.Addr, err error) {
+	for i, addr := range addrs {
+		if !addr.Is6() || addr.Is4In6() || addr.IsUnspecified() || addr.IsMulticast() {
+			return nil, fmt.Errorf("address at index %d: %s isn't an ipv6 unicast address", i, addr)
+		}
+	}
+
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	ifaceAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("getting addresses: %w", err)
+	}
+
+	var global, linkLocal []netip.Addr
+	for _, ifaceAddr := range ifaceAddrs {
+		n, ok := ifaceAddr.(*net.IPNet)
+		if !ok || n.IP.To4() != nil {
+			continue
+		}
+
+		addr, _ := netip.AddrFromSlice(n.IP)
+		if addr.IsGlobalUnicast() {
+			global = append(global, addr)
+		} else if addr.IsLinkLocalUnicast() {
+			linkLocal = append(linkLocal, addr)
+		}
+	}
+
+	if len(global) > 0 {
+		return global, nil
+	} else if len(linkLocal) > 0 {
+		return linkLocal, nil
+	}
+
+	return nil, errors.Error("no ipv6 addresses")
+}
+
+// Start starts announcing the addresses.
+func (a *Announcer) Start() (err error) {
+	a.raConn, err = listenICMPv6(a.iface)
+	if err != nil {
+		return fmt.Errorf("listening icmpv6: %w", err)
+	}
+
+	if a.dhcp != nil {
+		a.dhcpConn, err = listenDHCPv6(a.iface)
+		if err != nil {
+			return errors.WithDeferred(fmt.Errorf("listening dhcpv6: %w", err), a.raConn.Close())
+		}
+
+		a.wg.Add(1)
+		go a.serveDHCPv6()
+	}
+
+	a.wg.Add(2)
+	go a.advertise()
+	go a.serveSolicitations()
+
+	log.Info("rdnss: announcing %s on %s", a.addrs, a.iface.Name)
+
+	return nil
+}
+
+// listenICMPv6 returns the ICMPv6 connection to send the Router Advertisements
+// on iface and to receive the Router Solicitations from it.
+func listenICMPv6(iface *net.Interface) (p *ipv6.PacketConn, err error) {
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	p = c.IPv6PacketConn()
+
+	var f ipv6.ICMPFilter
+	f.SetAll(true)
+	f.Accept(ipv6.ICMPTypeRouterSolicitation)
+
+	err = errors.Join(
+		p.SetICMPFilter(&f),
+		p.SetControlMessage(ipv6.FlagInterface, true),
+		p.SetMulticastHopLimit(raHopLimit),
+		p.SetHopLimit(raHopLimit),
+		p.SetMulticastLoopback(false),
+		p.JoinGroup(iface, &net.IPAddr{IP: allRouters.AsSlice()}),
+	)
+	if err != nil {
+		return nil, errors.WithDeferred(err, c.Close())
+	}
+
+	return p, nil
+}
+
+// advertise sends the unsolicited Router Advertisements until the announcer is
+// stopped.  It's intended to be used as a goroutine.
+func (a *Announcer) advertise() {
+	defer log.OnPanic("rdnss: advertising")
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		a.sendRA(a.ra, allNodes)
+
+		select {
+		case <-ticker.C:
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// serveSolicitations responds to the Router Solicitations until the announcer
+// is stopped.  It's intended to be used as a goroutine.
+func (a *Announcer) serveSolicitations() {
+	defer log.OnPanic("rdnss: serving solicitations")
+	defer a.wg.Done()
+
+	buf := make([]byte, 1500)
+	var last time.Time
+	for {
+		n, cm, _, err := a.raConn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error("rdnss: reading solicitation: %s", err)
+			}
+
+			return
+		}
+
+		if n == 0 || buf[0] != byte(ipv6.ICMPTypeRouterSolicitation) {
+			continue
+		} else if cm != nil && cm.IfIndex != a.iface.Index {
+			continue
+		}
+
+		// Respond with a multicast advertisement, but not more often than
+		// allowed, since the other clients may be interested in it too.
+		if now := time.Now(); now.Sub(last) >= solicitedDelay {
+			last = now
+			a.sendRA(a.ra, allNodes)
+		}
+	}
+}
+
+// sendRA sends the Router Advertisement ra to dst on the interface.
+func (a *Announcer) sendRA(ra []byte, dst netip.Addr) {
+	cm := &ipv6.ControlMessage{
+		HopLimit: raHopLimit,
+		IfIndex:  a.iface.Index,
+	}
+
+	_, err := a.raConn.WriteTo(ra, cm, &net.IPAddr{IP: dst.AsSlice(), Zone: a.iface.Name})
+	if err != nil {
+		log.Error("rdnss: sending router advertisement: %s", err)
+	}
+}
+
+// Close withdraws the announcement and stops the announcer.
+func (a *Announcer) Close() (err error) {
+	if a.raConn == nil {
+		return nil
+	}
+
+	// Tell the clients to stop using the addresses, see RFC 8106, section
+	// 5.1.
+	a.sendRA(newRouterAdvertisement(a.addrs, 0, a.dhcp != nil), allNodes)
+
+	close(a.stop)
+
+	err = a.raConn.Close()
+	if a.dhcpConn != nil {
+		err = errors.Join(err, a.dhcpConn.Close())
+	}
+
+	a.wg.Wait()
+
+	return err
+}
+
+// Router Advertisement constants, see RFC 4861 and RFC 8106.
+const (
+	// raHdrLen is the length of the Router Advertisement before the options,
+	// including the ICMPv6 header.
+	raHdrLen = 16
+
+	// raFlagOther is the "other configuration" flag of the Router
+	// Advertisement, which tells the clients to use the stateless DHCPv6.
+	raFlagOther = 0x40
+
+	// optRDNSS is the type of the Recursive DNS Server option.
+	optRDNSS = 25
+
+	// optUnitLen is the unit of the lengths of the options.
+	optUnitLen = 8
+)
+
+// newRouterAdvertisement returns the marshaled Router Advertisement announcing
+// addrs for lifetime.  other sets the "other configuration" flag.  The
+// checksum is left zero, since it's calculated by the kernel for the ICMPv6
+// sockets.
+func newRouterAdvertisement(addrs []netip.Addr, lifetime time.Duration, other bool) (ra []byte) {
+	optLen := optUnitLen + net.IPv6len*len(addrs)
+	ra = make([]byte, raHdrLen, raHdrLen+optLen)
+	ra[0] = byte(ipv6.ICMPTypeRouterAdvertisement)
+	if other {
+		ra[5] = raFlagOther
+	}
+
+	// Leave the router lifetime, the reachable time, and the retransmission
+	// timer zero, so that the advertisement doesn't affect the routing and the
+	// neighbor discovery.
+
+	ra = append(ra, optRDNSS, byte(optLen/optUnitLen), 0, 0)
+	ra = binary.BigEndian.AppendUint32(ra, uint32(min(lifetime/time.Second, math.MaxUint32)))
+	for _, addr := range addrs {
+		ra = append(ra, addr.AsSlice()...)
+	}
+
+	return ra
+}
@@ -0,0 +1,170 @@
+package rdnss
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAddr is the common address for tests.
+var testAddr = netip.MustParseAddr("2001:db8::53")
+
+// loopback returns the loopback interface of the machine.
+func loopback(t *testing.T) (iface *net.Interface) {
+	t.Helper()
+
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 {
+			return &ifaces[i]
+		}
+	}
+
+	t.Skip("no loopback interface")
+
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	lo := loopback(t)
+
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &Config{Interface: lo.Name, Addrs: []netip.Addr{testAddr}},
+		name:       "success",
+		wantErrMsg: "",
+	}, {
+		conf:       &Config{Addrs: []netip.Addr{testAddr}},
+		name:       "no_interface",
+		wantErrMsg: "no interface",
+	}, {
+		conf:       &Config{Interface: "nonexistent0", Addrs: []netip.Addr{testAddr}},
+		name:       "unknown_interface",
+		wantErrMsg: "route ip+net: no such network interface",
+	}, {
+		conf: &Config{
+			Interface: lo.Name,
+			Addrs:     []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		},
+		name: "ipv4",
+		wantErrMsg: "interface " + lo.Name + ": address at index 0: " +
+			"192.0.2.1 isn't an ipv6 unicast address",
+	}, {
+		conf: &Config{
+			Interface: lo.Name,
+			Addrs:     []netip.Addr{netip.MustParseAddr("ff02::1")},
+		},
+		name: "multicast",
+		wantErrMsg: "interface " + lo.Name + ": address at index 0: " +
+			"ff02::1 isn't an ipv6 unicast address",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.conf)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestNewRouterAdvertisement(t *testing.T) {
+	other := netip.MustParseAddr("2001:db8::1:53")
+	ra := newRouterAdvertisement([]netip.Addr{testAddr, other}, time.Hour, true)
+
+	want := []byte{
+		// ICMPv6 header: type, code, and checksum.
+		134, 0, 0, 0,
+		// Current hop limit, flags, and router lifetime.
+		0, raFlagOther, 0, 0,
+		// Reachable time.
+		0, 0, 0, 0,
+		// Retransmission timer.
+		0, 0, 0, 0,
+		// RDNSS option: type, length, and reserved.
+		optRDNSS, 5, 0, 0,
+		// Lifetime.
+		0, 0, 0x0e, 0x10,
+	}
+	want = append(want, testAddr.AsSlice()...)
+	want = append(want, other.AsSlice()...)
+
+	assert.Equal(t, want, ra)
+
+	withdrawn := newRouterAdvertisement([]netip.Addr{testAddr}, 0, false)
+	require.Len(t, withdrawn, raHdrLen+optUnitLen+net.IPv6len)
+
+	assert.Zero(t, withdrawn[5])
+	assert.Equal(t, []byte{optRDNSS, 3, 0, 0, 0, 0, 0, 0}, withdrawn[raHdrLen:raHdrLen+optUnitLen])
+}
+
+func TestDHCPServer_reply(t *testing.T) {
+	s := newDHCPServer(&net.Interface{
+		HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+	}, []netip.Addr{testAddr})
+
+	serverID := []byte{0, duidLL, 0, hwTypeEthernet, 0x02, 0, 0, 0, 0, 0x01}
+	require.Equal(t, serverID, s.duid)
+
+	clientID := []byte{0, duidLL, 0, hwTypeEthernet, 0x02, 0, 0, 0, 0, 0x02}
+	req := appendOption([]byte{msgInformationRequest, 1, 2, 3}, optClientID, clientID)
+
+	wantResp := appendOption([]byte{msgReply, 1, 2, 3}, optClientID, clientID)
+	wantResp = appendOption(wantResp, optServerID, serverID)
+	wantResp = appendOption(wantResp, optDNSServers, testAddr.AsSlice())
+
+	testCases := []struct {
+		name     string
+		req      []byte
+		wantResp []byte
+		wantOK   bool
+	}{{
+		name:     "success",
+		req:      req,
+		wantResp: wantResp,
+		wantOK:   true,
+	}, {
+		name:     "own_server_id",
+		req:      appendOption(req, optServerID, serverID),
+		wantResp: wantResp,
+		wantOK:   true,
+	}, {
+		name:     "other_server_id",
+		req:      appendOption(req, optServerID, clientID),
+		wantResp: nil,
+		wantOK:   false,
+	}, {
+		name:     "solicit",
+		req:      append([]byte{1}, req[1:]...),
+		wantResp: nil,
+		wantOK:   false,
+	}, {
+		name:     "truncated_header",
+		req:      req[:2],
+		wantResp: nil,
+		wantOK:   false,
+	}, {
+		name:     "truncated_option",
+		req:      req[:len(req)-1],
+		wantResp: nil,
+		wantOK:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, ok := s.reply(tc.req)
+			require.Equal(t, tc.wantOK, ok)
+
+			assert.Equal(t, tc.wantResp, resp)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package rpz
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// errDropped is returned by [Handler.HandleBefore] for the requests dropped by
+// the policy, so that the proxy leaves them without a response.
+const errDropped errors.Error = "dropped by policy"
+
+// Config is the configuration of a [Handler].
+type Config struct {
+	// MessageConstructor is used to build the NXDOMAIN responses.  If nil,
+	// the responses are built with the plain response code.
+	MessageConstructor proxy.MessageConstructor
+
+	// Zones are the policy zones in the order of precedence.
+	Zones []*Zone
+}
+
+// Handler applies the response policy zones to the requests and the
+// responses.  It's safe for concurrent use.
+type Handler struct {
+	messages proxy.MessageConstructor
+	zones    []*Zone
+}
+
+// New returns a new properly initialized *Handler.  c must not be nil.
+func New(c *Config) (h *Handler) {
+	return &Handler{
+		messages: c.MessageConstructor,
+		zones:    slices.Clone(c.Zones),
+	}
+}
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Handler)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Handler.  It applies the QNAME triggers to the question name, so that the
+// blocked requests never reach the upstreams.
+func (h *Handler) HandleBefore(_ *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	req := dctx.Req
+	if len(req.Question) == 0 {
+		return nil
+	}
+
+	z, rule := h.matchQNAME(strings.ToLower(req.Question[0].Name))
+	if rule == nil || rule.Action == ActionPassthru {
+		return nil
+	}
+
+	log.Debug("rpz: zone %s: %s for %s by %s", z.name, rule.Action, req.Question[0].Name, rule.Owner)
+
+	resp := h.newResp(req, rule)
+	if resp == nil {
+		return fmt.Errorf("rpz: zone %s: %w", z.name, errDropped)
+	}
+
+	return &proxy.BeforeRequestError{
+		Err:      fmt.Errorf("rpz: zone %s: %s by %s", z.name, rule.Action, rule.Owner),
+		Response: resp,
+	}
+}
+
+// matchQNAME returns the first zone with a QNAME trigger for the lowercased
+// FQDN name and the triggered rule.  rule is nil if there is none.
+func (h *Handler) matchQNAME(name string) (z *Zone, rule *Rule) {
+	for _, z = range h.zones {
+		if rule = z.rules.Load().qname.match(name); rule != nil {
+			return z, rule
+		}
+	}
+
+	return nil, nil
+}
+
+// HandleResponse is a [proxy.ResponseHandler] that applies the triggers other
+// than the QNAME ones for the question name to the response in dctx and
+// replaces it accordingly.
+func (h *Handler) HandleResponse(dctx *proxy.DNSContext, err error) {
+	req, resp := dctx.Req, dctx.Res
+	if err != nil || resp == nil || len(req.Question) == 0 {
+		return
+	}
+
+	qname := strings.ToLower(req.Question[0].Name)
+	for _, z := range h.zones {
+		rs := z.rules.Load()
+		if rs.qname.match(qname) != nil {
+			// The question name is passed through by the zone, since the
+			// other actions are applied before resolving.
+			return
+		}
+
+		rule := rs.matchResponse(resp)
+		if rule == nil {
+			continue
+		} else if rule.Action == ActionPassthru {
+			return
+		}
+
+		log.Debug("rpz: zone %s: %s for %s by %s", z.name, rule.Action, qname, rule.Owner)
+
+		dctx.Res = h.newResp(req, rule)
+
+		return
+	}
+}
+
+// newResp returns the response to req according to rule.  It returns nil for
+// [ActionDrop].  rule must not be [ActionPassthru].
+func (h *Handler) newResp(req *dns.Msg, rule *Rule) (resp *dns.Msg) {
+	switch rule.Action {
+	case ActionNXDOMAIN:
+		if h.messages != nil {
+			return h.messages.NewMsgNXDOMAIN(req)
+		}
+
+		resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+	case ActionDrop:
+		return nil
+	default:
+		resp = (&dns.Msg{}).SetReply(req)
+		resp.Answer = localData(req.Question[0], rule.Data)
+	}
+
+	resp.RecursionAvailable = true
+
+	return resp
+}
+
+// localData returns the records from data answering q.  The records of the
+// requested type take precedence over the CNAME ones.
+func localData(q dns.Question, data []dns.RR) (ans []dns.RR) {
+	for _, qtype := range []uint16{q.Qtype, dns.TypeCNAME} {
+		for _, rr := range data {
+			if rr.Header().Rrtype != qtype {
+				continue
+			}
+
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			ans = append(ans, rr)
+		}
+
+		if len(ans) > 0 {
+			return ans
+		}
+	}
+
+	return nil
+}
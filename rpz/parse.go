@@ -0,0 +1,218 @@
+package rpz
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// The labels separating the triggers of the kinds other than QNAME from the
+// zone name.
+const (
+	labelIP       = "rpz-ip"
+	labelNSDNAME  = "rpz-nsdname"
+	labelNSIP     = "rpz-nsip"
+	labelClientIP = "rpz-client-ip"
+)
+
+// The targets of the CNAME records encoding the special actions.
+const (
+	targetNODATA   = "*."
+	targetPassthru = "rpz-passthru."
+	targetDrop     = "rpz-drop."
+)
+
+// readRecords reads the records of the zone named origin in the zone file
+// format from r.
+func readRecords(r io.Reader, origin string) (rrs []dns.RR, err error) {
+	zp := dns.NewZoneParser(r, origin, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+
+	err = zp.Err()
+	if err != nil {
+		return nil, fmt.Errorf("parsing zone: %w", err)
+	}
+
+	return rrs, nil
+}
+
+// buildRuleSet returns the index of the rules encoded by the records of the
+// zone named origin.  The invalid rules are logged and skipped.
+func buildRuleSet(origin string, rrs []dns.RR) (rs *ruleSet) {
+	origin = strings.ToLower(dns.Fqdn(origin))
+
+	owners := map[string][]dns.RR{}
+	var names []string
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if name == origin || !dns.IsSubDomain(origin, name) {
+			// Skip the SOA and NS records of the zone itself.
+			continue
+		}
+
+		if _, ok := owners[name]; !ok {
+			names = append(names, name)
+		}
+
+		owners[name] = append(owners[name], rr)
+	}
+
+	// Sort the names to make the logs reproducible.
+	slices.Sort(names)
+
+	rs = newRuleSet()
+	for _, name := range names {
+		err := rs.add(origin, name, owners[name])
+		if err != nil {
+			log.Debug("rpz: zone %s: skipping rule %s: %s", origin, name, err)
+		}
+	}
+
+	rs.ip.sort()
+	rs.nsip.sort()
+
+	return rs
+}
+
+// add adds the rule with the lowercased owner name and the records rrs within
+// the zone named origin to rs.
+func (rs *ruleSet) add(origin, owner string, rrs []dns.RR) (err error) {
+	trigger := strings.TrimSuffix(owner, "."+origin)
+
+	rule := &Rule{Owner: owner}
+	var key string
+	if key, rule.Trigger, err = parseTrigger(trigger); err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	rule.Action, rule.Data = parseAction(rrs)
+
+	switch rule.Trigger {
+	case TriggerQNAME:
+		rs.qname.add(key, rule)
+	case TriggerNSDNAME:
+		rs.nsdname.add(key, rule)
+	default:
+		var pref netip.Prefix
+		pref, err = parsePrefix(key)
+		if err != nil {
+			return fmt.Errorf("bad %s trigger: %w", rule.Trigger, err)
+		}
+
+		if rule.Trigger == TriggerIP {
+			rs.ip = append(rs.ip, prefixRule{rule: rule, prefix: pref})
+		} else {
+			rs.nsip = append(rs.nsip, prefixRule{rule: rule, prefix: pref})
+		}
+	}
+
+	return nil
+}
+
+// parseTrigger returns the kind of the trigger of the rule with the owner
+// name relative to the zone name, and the key to match against: an FQDN for
+// the name triggers and the reversed labels of the prefix for the address
+// ones.
+func parseTrigger(rel string) (key string, t Trigger, err error) {
+	i := strings.LastIndexByte(rel, '.')
+	if i < 0 {
+		return dns.Fqdn(rel), TriggerQNAME, nil
+	}
+
+	key, label := rel[:i], rel[i+1:]
+	switch label {
+	case labelIP:
+		return key, TriggerIP, nil
+	case labelNSDNAME:
+		return dns.Fqdn(key), TriggerNSDNAME, nil
+	case labelNSIP:
+		return key, TriggerNSIP, nil
+	case labelClientIP:
+		return "", 0, errors.Error("client ip triggers are not supported")
+	default:
+		return dns.Fqdn(rel), TriggerQNAME, nil
+	}
+}
+
+// parsePrefix parses the subnet encoded in the labels of an address trigger,
+// e.g. "32.1.2.0.192" for 192.0.2.1/32 or "128.1.zz.db8.2001" for
+// 2001:db8::1/128.
+func parsePrefix(s string) (pref netip.Prefix, err error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return netip.Prefix{}, fmt.Errorf("too few labels in %q", s)
+	}
+
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("prefix length: %w", err)
+	}
+
+	parts := labels[1:]
+	slices.Reverse(parts)
+
+	var addrStr string
+	if len(parts) == 4 && !slices.Contains(parts, "zz") {
+		addrStr = strings.Join(parts, ".")
+	} else {
+		for i, p := range parts {
+			if p == "zz" {
+				parts[i] = ""
+			}
+		}
+
+		addrStr = strings.Join(parts, ":")
+		if strings.HasPrefix(addrStr, ":") {
+			addrStr = ":" + addrStr
+		}
+
+		if strings.HasSuffix(addrStr, ":") {
+			addrStr += ":"
+		}
+	}
+
+	addr, err := netip.ParseAddr(addrStr)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return netip.Prefix{}, err
+	}
+
+	pref, err = addr.Prefix(bits)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return netip.Prefix{}, err
+	}
+
+	return pref, nil
+}
+
+// parseAction returns the action encoded by the records of a rule, and the
+// records to respond with for [ActionLocalData].
+func parseAction(rrs []dns.RR) (a Action, data []dns.RR) {
+	if len(rrs) == 1 {
+		if cname, ok := rrs[0].(*dns.CNAME); ok {
+			switch strings.ToLower(cname.Target) {
+			case ".":
+				return ActionNXDOMAIN, nil
+			case targetNODATA:
+				return ActionNODATA, nil
+			case targetPassthru:
+				return ActionPassthru, nil
+			case targetDrop:
+				return ActionDrop, nil
+			}
+		}
+	}
+
+	return ActionLocalData, rrs
+}
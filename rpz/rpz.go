@@ -0,0 +1,298 @@
+// Package rpz implements the DNS response policy zones, the interoperable
+// format of the DNS filtering policies described in
+// https://datatracker.ietf.org/doc/html/draft-vixie-dnsop-dns-rpz.
+//
+// The policy rules are the records of a zone, which is loaded from a file or
+// transferred from a primary server.  The owner names of the records are the
+// triggers and the records themselves are the actions.  The supported triggers
+// are:
+//
+//   - QNAME, e.g. example.com.rpz.example or *.example.com.rpz.example, which
+//     matches the question name of the request and the targets of the CNAME
+//     records in the response;
+//   - IP, e.g. 32.1.2.0.192.rpz-ip.rpz.example, which matches the addresses
+//     in the answer section of the response;
+//   - NSDNAME, e.g. ns.example.com.rpz-nsdname.rpz.example, which matches the
+//     names of the name servers in the response;
+//   - NSIP, e.g. 24.0.2.0.192.rpz-nsip.rpz.example, which matches the
+//     addresses of the name servers in the additional section of the response.
+//
+// Since a forwarding proxy doesn't contact the authoritative servers itself,
+// the NSDNAME and NSIP triggers only match the name servers the upstream
+// reports in the response.
+//
+// The supported actions are:
+//
+//   - NXDOMAIN, CNAME to the root name;
+//   - NODATA, CNAME to *.;
+//   - PASSTHRU, CNAME to rpz-passthru., which exempts the request from the
+//     following rules and zones;
+//   - DROP, CNAME to rpz-drop., which leaves the request without a response;
+//   - Local-Data, any other records, which are returned instead of the
+//     response with the owner name replaced by the question name.  A CNAME
+//     record is returned as is, without resolving its target.
+package rpz
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Action is the action of a policy rule.
+type Action uint8
+
+const (
+	// ActionNXDOMAIN responds with NXDOMAIN.
+	ActionNXDOMAIN Action = iota
+
+	// ActionNODATA responds with an empty answer.
+	ActionNODATA
+
+	// ActionPassthru exempts the request from the policy.
+	ActionPassthru
+
+	// ActionDrop leaves the request without a response.
+	ActionDrop
+
+	// ActionLocalData responds with the records of the rule.
+	ActionLocalData
+)
+
+// String implements the [fmt.Stringer] interface for Action.
+func (a Action) String() (s string) {
+	switch a {
+	case ActionNXDOMAIN:
+		return "nxdomain"
+	case ActionNODATA:
+		return "nodata"
+	case ActionPassthru:
+		return "passthru"
+	case ActionDrop:
+		return "drop"
+	case ActionLocalData:
+		return "local-data"
+	default:
+		return fmt.Sprintf("!bad_action_%d", uint8(a))
+	}
+}
+
+// Trigger is the kind of the condition of a policy rule.
+type Trigger uint8
+
+const (
+	// TriggerQNAME matches the question name or the CNAME targets.
+	TriggerQNAME Trigger = iota
+
+	// TriggerIP matches the addresses in the answer.
+	TriggerIP
+
+	// TriggerNSDNAME matches the names of the name servers.
+	TriggerNSDNAME
+
+	// TriggerNSIP matches the addresses of the name servers.
+	TriggerNSIP
+)
+
+// String implements the [fmt.Stringer] interface for Trigger.
+func (t Trigger) String() (s string) {
+	switch t {
+	case TriggerQNAME:
+		return "qname"
+	case TriggerIP:
+		return "ip"
+	case TriggerNSDNAME:
+		return "nsdname"
+	case TriggerNSIP:
+		return "nsip"
+	default:
+		return fmt.Sprintf("!bad_trigger_%d", uint8(t))
+	}
+}
+
+// Rule is a single policy rule.
+type Rule struct {
+	// Owner is the lowercased owner name of the records of the rule within
+	// the policy zone.
+	Owner string
+
+	// Data are the records returned for [ActionLocalData].  It's nil for the
+	// other actions.
+	Data []dns.RR
+
+	// Trigger is the kind of the condition of the rule.
+	Trigger Trigger
+
+	// Action is the action of the rule.
+	Action Action
+}
+
+// nameRules are the rules triggered by domain names.
+type nameRules struct {
+	// exact are the rules for the names themselves, keyed by the lowercased
+	// FQDNs.
+	exact map[string]*Rule
+
+	// wildcard are the rules for the strict subdomains of the names, keyed by
+	// the lowercased FQDNs.
+	wildcard map[string]*Rule
+}
+
+// newNameRules returns a new empty *nameRules.
+func newNameRules() (r *nameRules) {
+	return &nameRules{
+		exact:    map[string]*Rule{},
+		wildcard: map[string]*Rule{},
+	}
+}
+
+// add adds rule for name, which is either an FQDN or a wildcard starting with
+// "*.".
+func (r *nameRules) add(name string, rule *Rule) {
+	if suffix, ok := strings.CutPrefix(name, "*."); ok {
+		r.wildcard[suffix] = rule
+	} else {
+		r.exact[name] = rule
+	}
+}
+
+// match returns the rule for the lowercased FQDN name, or nil if there is
+// none.  The exact rules take precedence over the wildcard ones, and the
+// longer wildcards take precedence over the shorter ones.
+func (r *nameRules) match(name string) (rule *Rule) {
+	if rule = r.exact[name]; rule != nil {
+		return rule
+	}
+
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if rule = r.wildcard[name[off:]]; rule != nil {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// prefixRule is a rule triggered by the addresses within a subnet.
+type prefixRule struct {
+	rule   *Rule
+	prefix netip.Prefix
+}
+
+// prefixRules are the rules triggered by addresses.
+type prefixRules []prefixRule
+
+// sort sorts r so that the longer prefixes go first.
+func (r prefixRules) sort() {
+	slices.SortStableFunc(r, func(a, b prefixRule) (res int) {
+		return cmp.Compare(b.prefix.Bits(), a.prefix.Bits())
+	})
+}
+
+// match returns the rule with the longest prefix containing addr, or nil if
+// there is none.  r must be sorted.
+func (r prefixRules) match(addr netip.Addr) (rule *Rule) {
+	addr = addr.Unmap()
+	for _, pr := range r {
+		if pr.prefix.Contains(addr) {
+			return pr.rule
+		}
+	}
+
+	return nil
+}
+
+// ruleSet is the index of the rules of a single policy zone.
+type ruleSet struct {
+	qname   *nameRules
+	nsdname *nameRules
+	ip      prefixRules
+	nsip    prefixRules
+}
+
+// newRuleSet returns a new empty *ruleSet.
+func newRuleSet() (rs *ruleSet) {
+	return &ruleSet{
+		qname:   newNameRules(),
+		nsdname: newNameRules(),
+	}
+}
+
+// matchResponse returns the rule triggered by resp, except for the question
+// name, or nil if there is none.  The triggers are checked in the order of
+// precedence: the CNAME targets, the answer addresses, the name server names,
+// and the name server addresses.
+func (rs *ruleSet) matchResponse(resp *dns.Msg) (rule *Rule) {
+	for _, rr := range resp.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			if rule = rs.qname.match(strings.ToLower(cname.Target)); rule != nil {
+				return rule
+			}
+		}
+	}
+
+	if len(rs.ip) > 0 {
+		for _, rr := range resp.Answer {
+			if addr, ok := rrAddr(rr); ok {
+				if rule = rs.ip.match(addr); rule != nil {
+					return rule
+				}
+			}
+		}
+	}
+
+	for _, rr := range slices.Concat(resp.Answer, resp.Ns) {
+		if ns, ok := rr.(*dns.NS); ok {
+			if rule = rs.nsdname.match(strings.ToLower(ns.Ns)); rule != nil {
+				return rule
+			}
+		}
+	}
+
+	return rs.matchNSIP(resp)
+}
+
+// matchNSIP returns the rule triggered by the addresses of the name servers
+// in resp, or nil if there is none.
+func (rs *ruleSet) matchNSIP(resp *dns.Msg) (rule *Rule) {
+	if len(rs.nsip) == 0 {
+		return nil
+	}
+
+	servers := map[string]struct{}{}
+	for _, rr := range slices.Concat(resp.Answer, resp.Ns) {
+		if ns, ok := rr.(*dns.NS); ok {
+			servers[strings.ToLower(ns.Ns)] = struct{}{}
+		}
+	}
+
+	for _, rr := range resp.Extra {
+		if _, ok := servers[strings.ToLower(rr.Header().Name)]; !ok {
+			continue
+		}
+
+		if addr, ok := rrAddr(rr); ok {
+			if rule = rs.nsip.match(addr); rule != nil {
+				return rule
+			}
+		}
+	}
+
+	return nil
+}
+
+// rrAddr returns the address of rr if it's an A or AAAA record.
+func rrAddr(rr dns.RR) (addr netip.Addr, ok bool) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return netip.AddrFromSlice(rr.A.To4())
+	case *dns.AAAA:
+		return netip.AddrFromSlice(rr.AAAA)
+	default:
+		return netip.Addr{}, false
+	}
+}
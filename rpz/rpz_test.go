@@ -0,0 +1,324 @@
+package rpz
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZone is the policy zone used in tests.
+const testZone = `$ORIGIN rpz.example.
+$TTL 300
+@                                    SOA ns.rpz.example. admin.rpz.example. 1 3600 600 86400 300
+@                                    NS  ns.rpz.example.
+blocked.example                      CNAME .
+*.blocked.example                    CNAME .
+empty.example                        CNAME *.
+allowed.blocked.example              CNAME rpz-passthru.
+dropped.example                      CNAME rpz-drop.
+local.example                        A     192.0.2.10
+local.example                        TXT   "walled garden"
+alias.example                        CNAME garden.example.
+32.1.2.0.192.rpz-ip                  CNAME .
+24.0.2.0.198.rpz-ip                  CNAME *.
+128.1.zz.db8.2001.rpz-ip             CNAME .
+ns.evil.example.rpz-nsdname          CNAME .
+32.100.113.0.203.rpz-nsip            CNAME .
+8.0.0.0.10.rpz-client-ip             CNAME .
+`
+
+// newTestHandler returns a new *Handler with the policy zone from testZone.
+func newTestHandler(t *testing.T) (h *Handler) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "rpz.zone")
+	require.NoError(t, os.WriteFile(path, []byte(testZone), 0o600))
+
+	z, err := NewZone(&ZoneConfig{
+		Name: "rpz.example",
+		File: path,
+	})
+	require.NoError(t, err)
+	require.NoError(t, z.Refresh(context.Background()))
+
+	return New(&Config{
+		Zones: []*Zone{z},
+	})
+}
+
+func TestParsePrefix(t *testing.T) {
+	testCases := []struct {
+		in      string
+		want    netip.Prefix
+		wantErr bool
+	}{{
+		in:   "32.1.2.0.192",
+		want: netip.MustParsePrefix("192.0.2.1/32"),
+	}, {
+		in:   "24.0.2.0.198",
+		want: netip.MustParsePrefix("198.0.2.0/24"),
+	}, {
+		in:   "128.1.zz.db8.2001",
+		want: netip.MustParsePrefix("2001:db8::1/128"),
+	}, {
+		in:   "48.zz.db8.2001",
+		want: netip.MustParsePrefix("2001:db8::/48"),
+	}, {
+		in:      "33.1.2.0.192",
+		wantErr: true,
+	}, {
+		in:      "32",
+		wantErr: true,
+	}, {
+		in:      "x.1.2.0.192",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			pref, err := parsePrefix(tc.in)
+			if tc.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, pref)
+		})
+	}
+}
+
+func TestHandler_HandleBefore(t *testing.T) {
+	h := newTestHandler(t)
+
+	testCases := []struct {
+		name      string
+		host      string
+		qtype     uint16
+		wantRcode int
+		wantAns   []string
+		wantPass  bool
+		wantDrop  bool
+	}{{
+		name:      "nxdomain",
+		host:      "blocked.example.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		name:      "wildcard",
+		host:      "sub.Blocked.example.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		name:     "passthru",
+		host:     "allowed.blocked.example.",
+		qtype:    dns.TypeA,
+		wantPass: true,
+	}, {
+		name:      "nodata",
+		host:      "empty.example.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:     "drop",
+		host:     "dropped.example.",
+		qtype:    dns.TypeA,
+		wantDrop: true,
+	}, {
+		name:      "local_data",
+		host:      "local.example.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   []string{"local.example.\t300\tIN\tA\t192.0.2.10"},
+	}, {
+		name:      "local_data_other_type",
+		host:      "local.example.",
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "local_data_cname",
+		host:      "alias.example.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   []string{"alias.example.\t300\tIN\tCNAME\tgarden.example."},
+	}, {
+		name:     "no_match",
+		host:     "example.org.",
+		qtype:    dns.TypeA,
+		wantPass: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &proxy.DNSContext{
+				Req: (&dns.Msg{}).SetQuestion(tc.host, tc.qtype),
+			}
+
+			err := h.HandleBefore(nil, dctx)
+			if tc.wantPass {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+
+			befErr := &proxy.BeforeRequestError{}
+			if tc.wantDrop {
+				assert.ErrorIs(t, err, errDropped)
+				assert.False(t, errors.As(err, &befErr))
+
+				return
+			}
+
+			require.ErrorAs(t, err, &befErr)
+
+			resp := befErr.Response
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+
+			var ans []string
+			for _, rr := range resp.Answer {
+				ans = append(ans, rr.String())
+			}
+			assert.Equal(t, tc.wantAns, ans)
+		})
+	}
+}
+
+func TestHandler_HandleResponse(t *testing.T) {
+	h := newTestHandler(t)
+
+	rr := func(s string) (r dns.RR) {
+		r, err := dns.NewRR(s)
+		require.NoError(t, err)
+
+		return r
+	}
+
+	testCases := []struct {
+		resp      *dns.Msg
+		name      string
+		host      string
+		wantRcode int
+		wantKeep  bool
+	}{{
+		resp: &dns.Msg{
+			Answer: []dns.RR{rr("a.example. 60 IN A 192.0.2.1")},
+		},
+		name:      "ip",
+		host:      "a.example.",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		resp: &dns.Msg{
+			Answer: []dns.RR{rr("a.example. 60 IN A 198.0.2.77")},
+		},
+		name:      "ip_subnet_nodata",
+		host:      "a.example.",
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		resp: &dns.Msg{
+			Answer: []dns.RR{rr("a.example. 60 IN AAAA 2001:db8::1")},
+		},
+		name:      "ipv6",
+		host:      "a.example.",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		resp: &dns.Msg{
+			Answer: []dns.RR{
+				rr("a.example. 60 IN CNAME x.blocked.example."),
+				rr("x.blocked.example. 60 IN A 192.0.2.2"),
+			},
+		},
+		name:      "cname_target",
+		host:      "a.example.",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		resp: &dns.Msg{
+			Answer: []dns.RR{rr("a.example. 60 IN A 192.0.2.2")},
+			Ns:     []dns.RR{rr("example. 60 IN NS ns.evil.example.")},
+		},
+		name:      "nsdname",
+		host:      "a.example.",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		resp: &dns.Msg{
+			Answer: []dns.RR{rr("a.example. 60 IN A 192.0.2.2")},
+			Ns:     []dns.RR{rr("example. 60 IN NS ns.example.")},
+			Extra:  []dns.RR{rr("ns.example. 60 IN A 203.0.113.100")},
+		},
+		name:      "nsip",
+		host:      "a.example.",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		resp: &dns.Msg{
+			Answer: []dns.RR{rr("a.example. 60 IN A 192.0.2.2")},
+			Extra:  []dns.RR{rr("other.example. 60 IN A 203.0.113.100")},
+		},
+		name:     "nsip_not_ns",
+		host:     "a.example.",
+		wantKeep: true,
+	}, {
+		resp: &dns.Msg{
+			Answer: []dns.RR{rr("allowed.blocked.example. 60 IN A 192.0.2.1")},
+		},
+		name:     "passthru_qname",
+		host:     "allowed.blocked.example.",
+		wantKeep: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			resp := tc.resp.SetReply(req)
+			dctx := &proxy.DNSContext{
+				Req: req,
+				Res: resp,
+			}
+
+			h.HandleResponse(dctx, nil)
+			if tc.wantKeep {
+				assert.Same(t, resp, dctx.Res)
+
+				return
+			}
+
+			require.NotNil(t, dctx.Res)
+			assert.NotSame(t, resp, dctx.Res)
+			assert.Equal(t, tc.wantRcode, dctx.Res.Rcode)
+			assert.Empty(t, dctx.Res.Answer)
+		})
+	}
+}
+
+func TestBuildRuleSet_precedence(t *testing.T) {
+	rrs, err := readRecords(strings.NewReader(`$ORIGIN rpz.example.
+$TTL 300
+*.example                  CNAME .
+*.sub.example              CNAME *.
+exact.sub.example          CNAME rpz-passthru.
+16.0.0.168.192.rpz-ip      CNAME .
+24.0.2.168.192.rpz-ip      CNAME *.
+`), "rpz.example.")
+	require.NoError(t, err)
+
+	rs := buildRuleSet("rpz.example.", rrs)
+
+	assert.Equal(t, ActionNXDOMAIN, rs.qname.match("a.example.").Action)
+	assert.Equal(t, ActionNODATA, rs.qname.match("a.sub.example.").Action)
+	assert.Equal(t, ActionPassthru, rs.qname.match("exact.sub.example.").Action)
+	assert.Nil(t, rs.qname.match("example."))
+
+	assert.Equal(t, ActionNODATA, rs.ip.match(netip.MustParseAddr("192.168.2.1")).Action)
+	assert.Equal(t, ActionNXDOMAIN, rs.ip.match(netip.MustParseAddr("192.168.3.1")).Action)
+	assert.Nil(t, rs.ip.match(netip.MustParseAddr("192.0.2.1")))
+}
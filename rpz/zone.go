@@ -0,0 +1,298 @@
+package rpz
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// DefaultTransferTimeout is the default timeout of a zone transfer.
+const DefaultTransferTimeout = 30 * time.Second
+
+// ZoneConfig is the configuration of a [Zone].
+type ZoneConfig struct {
+	// Name is the name of the policy zone.  It must not be empty.
+	Name string
+
+	// File is the path to the zone file to load the zone from.  Either File
+	// or Primary must be set.
+	File string
+
+	// Primary is the address of the server to transfer the zone from, e.g.
+	// "192.0.2.1:53".  The zone is transferred with IXFR once it's loaded,
+	// falling back to AXFR if the server doesn't support it.
+	Primary string
+
+	// TransferTimeout is the timeout of a zone transfer.  If not positive,
+	// [DefaultTransferTimeout] is used.
+	TransferTimeout time.Duration
+}
+
+// Zone is a response policy zone, which can be refreshed at runtime.  It's safe
+// for concurrent use.
+type Zone struct {
+	// refreshMu serializes the refreshes and protects records and serial.
+	refreshMu *sync.Mutex
+
+	// rules is the current index of the rules.
+	rules *atomic.Pointer[ruleSet]
+
+	// records are the records of the zone keyed by their normalized textual
+	// representations, see [recordKey].  It's only used for the transfers.
+	records map[string]dns.RR
+
+	name    string
+	file    string
+	primary string
+	timeout time.Duration
+
+	// serial is the serial of the transferred zone.  It's only valid if
+	// records is not nil.
+	serial uint32
+}
+
+// NewZone returns a new *Zone with no rules until the first successful
+// [Zone.Refresh].  c must not be nil.
+func NewZone(c *ZoneConfig) (z *Zone, err error) {
+	switch {
+	case c.Name == "":
+		return nil, errors.Error("no zone name")
+	case (c.File == "") == (c.Primary == ""):
+		return nil, fmt.Errorf("zone %s: exactly one of file and primary must be set", c.Name)
+	}
+
+	z = &Zone{
+		refreshMu: &sync.Mutex{},
+		rules:     &atomic.Pointer[ruleSet]{},
+		name:      strings.ToLower(dns.Fqdn(c.Name)),
+		file:      c.File,
+		primary:   c.Primary,
+		timeout:   c.TransferTimeout,
+	}
+
+	if z.timeout <= 0 {
+		z.timeout = DefaultTransferTimeout
+	}
+
+	z.rules.Store(newRuleSet())
+
+	return z, nil
+}
+
+// Name returns the lowercased FQDN of the zone.
+func (z *Zone) Name() (name string) {
+	return z.name
+}
+
+// Refresh reloads the zone from the file or transfers its changes from the
+// primary server.  If that fails, the current rules are kept.  It implements
+// the mgmt.Refresher interface.
+func (z *Zone) Refresh(ctx context.Context) (err error) {
+	z.refreshMu.Lock()
+	defer z.refreshMu.Unlock()
+
+	if z.file != "" {
+		err = z.load()
+	} else {
+		err = z.transfer(ctx)
+	}
+
+	if err != nil {
+		return fmt.Errorf("rpz: zone %s: %w", z.name, err)
+	}
+
+	return nil
+}
+
+// load reads the zone from the file.  z.refreshMu must be locked.
+func (z *Zone) load() (err error) {
+	// #nosec G304 -- Trust the path explicitly given by the user.
+	f, err := os.Open(z.file)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	rrs, err := readRecords(f, z.name)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	z.rules.Store(buildRuleSet(z.name, rrs))
+
+	log.Info("rpz: zone %s: loaded %d records", z.name, len(rrs))
+
+	return nil
+}
+
+// transfer transfers the zone from the primary server, incrementally if it's
+// already been transferred.  z.refreshMu must be locked.
+func (z *Zone) transfer(ctx context.Context) (err error) {
+	changed := false
+	if z.records != nil {
+		req := (&dns.Msg{}).SetIxfr(z.name, z.serial, ".", ".")
+		changed, err = z.transferWith(ctx, req)
+		if err == nil && !changed {
+			log.Debug("rpz: zone %s: serial %d is up to date", z.name, z.serial)
+
+			return nil
+		} else if err != nil {
+			log.Debug("rpz: zone %s: ixfr: %s; falling back to axfr", z.name, err)
+		}
+	}
+
+	if !changed {
+		_, err = z.transferWith(ctx, (&dns.Msg{}).SetAxfr(z.name))
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+	}
+
+	recs := make([]dns.RR, 0, len(z.records))
+	for _, rr := range z.records {
+		recs = append(recs, rr)
+	}
+
+	z.rules.Store(buildRuleSet(z.name, recs))
+
+	log.Info("rpz: zone %s: transferred serial %d with %d records", z.name, z.serial, len(recs))
+
+	return nil
+}
+
+// transferWith sends the transfer request req to the primary server and applies
+// the received records to z.  changed is false if the zone is up to date.
+// z.refreshMu must be locked.
+func (z *Zone) transferWith(ctx context.Context, req *dns.Msg) (changed bool, err error) {
+	qtype := dns.TypeToString[req.Question[0].Qtype]
+
+	rrs, err := z.exchangeTransfer(ctx, req)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", qtype, err)
+	}
+
+	changed, err = z.apply(rrs)
+	if err != nil {
+		return false, fmt.Errorf("applying %s: %w", qtype, err)
+	}
+
+	return changed, nil
+}
+
+// exchangeTransfer sends the transfer request req to the primary server and
+// returns all the received records.
+func (z *Zone) exchangeTransfer(ctx context.Context, req *dns.Msg) (rrs []dns.RR, err error) {
+	ctx, cancel := context.WithTimeout(ctx, z.timeout)
+	defer cancel()
+
+	conn, err := (&dns.Client{Net: "tcp"}).DialContext(ctx, z.primary)
+	if err != nil {
+		return nil, fmt.Errorf("dialing: %w", err)
+	}
+
+	deadline, _ := ctx.Deadline()
+	tr := &dns.Transfer{
+		Conn:         conn,
+		DialTimeout:  z.timeout,
+		ReadTimeout:  time.Until(deadline),
+		WriteTimeout: time.Until(deadline),
+	}
+
+	// The transfer closes the connection itself once it's done.
+	envs, err := tr.In(req, z.primary)
+	if err != nil {
+		return nil, errors.WithDeferred(err, tr.Close())
+	}
+
+	for env := range envs {
+		if env.Error != nil {
+			err = env.Error
+		} else if err == nil {
+			rrs = append(rrs, env.RR...)
+		}
+	}
+
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	} else if len(rrs) == 0 {
+		return nil, errors.Error("empty transfer")
+	}
+
+	return rrs, nil
+}
+
+// apply applies the records of a complete or an incremental transfer to the
+// records of z.  changed is false if the zone is up to date.  z.refreshMu
+// must be locked.
+func (z *Zone) apply(rrs []dns.RR) (changed bool, err error) {
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return false, fmt.Errorf("first record is %s, not soa", dns.TypeToString[rrs[0].Header().Rrtype])
+	}
+
+	if len(rrs) == 1 {
+		if z.records != nil && soa.Serial == z.serial {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("unexpected single soa with serial %d", soa.Serial)
+	}
+
+	if last, isSOA := rrs[len(rrs)-1].(*dns.SOA); !isSOA || last.Serial != soa.Serial {
+		return false, errors.Error("transfer doesn't end with the soa")
+	}
+
+	if old, isSOA := rrs[1].(*dns.SOA); isSOA && z.records != nil && old.Serial == z.serial {
+		z.applyIncremental(rrs[1 : len(rrs)-1])
+	} else {
+		z.records = map[string]dns.RR{}
+		for _, rr := range rrs[:len(rrs)-1] {
+			z.records[recordKey(rr)] = rr
+		}
+	}
+
+	z.serial = soa.Serial
+
+	return true, nil
+}
+
+// applyIncremental applies the sequences of the deleted and the added records
+// of an incremental transfer, each starting with a SOA record, to the records
+// of z.  z.refreshMu must be locked.
+func (z *Zone) applyIncremental(rrs []dns.RR) {
+	deleting := false
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.SOA); ok {
+			// The SOA record of the zone itself doesn't encode any rules, so
+			// it isn't tracked.
+			deleting = !deleting
+		} else if deleting {
+			delete(z.records, recordKey(rr))
+		} else {
+			z.records[recordKey(rr)] = rr
+		}
+	}
+}
+
+// recordKey returns the key of rr within the records of a zone, which doesn't
+// depend on the TTL and the case of the owner name.
+func recordKey(rr dns.RR) (key string) {
+	rr = dns.Copy(rr)
+	hdr := rr.Header()
+	hdr.Ttl = 0
+	hdr.Name = strings.ToLower(hdr.Name)
+
+	return rr.String()
+}
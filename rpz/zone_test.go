@@ -0,0 +1,155 @@
+package rpz
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// startTransferServer starts a TCP DNS server responding to the zone transfer
+// requests with the records returned by onTransfer and returns its address.
+// The server responds with NOTIMP if onTransfer returns no records.
+func startTransferServer(
+	t *testing.T,
+	onTransfer func(req *dns.Msg) (rrs []dns.RR),
+) (addr string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			rrs := onTransfer(req)
+			if len(rrs) == 0 {
+				_ = w.WriteMsg((&dns.Msg{}).SetRcode(req, dns.RcodeNotImplemented))
+
+				return
+			}
+
+			ch := make(chan *dns.Envelope, 1)
+			ch <- &dns.Envelope{RR: rrs}
+			close(ch)
+
+			_ = (&dns.Transfer{}).Out(w, req, ch)
+			w.Hijack()
+			_ = w.Close()
+		}),
+	}
+
+	go func() {
+		pt := testutil.PanicT{}
+		require.NoError(pt, srv.ActivateAndServe())
+	}()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	return l.Addr().String()
+}
+
+func TestZone_Refresh_transfer(t *testing.T) {
+	rr := func(s string) (r dns.RR) {
+		r, err := dns.NewRR("$ORIGIN rpz.example.\n" + s)
+		require.NoError(t, err)
+
+		return r
+	}
+
+	soa := func(serial uint32) (r dns.RR) {
+		s := rr("@ 300 IN SOA ns.rpz.example. admin.rpz.example. 1 3600 600 86400 300").(*dns.SOA)
+		s.Serial = serial
+
+		return s
+	}
+
+	var (
+		blocked = rr("blocked.example 300 IN CNAME .")
+		empty   = rr("empty.example 300 IN CNAME *.")
+		local   = rr("local.example 300 IN A 192.0.2.10")
+	)
+
+	reqTypes := make(chan uint16, 4)
+	ixfrSupported := &atomic.Bool{}
+	addr := startTransferServer(t, func(req *dns.Msg) (rrs []dns.RR) {
+		qtype := req.Question[0].Qtype
+		reqTypes <- qtype
+
+		if qtype != dns.TypeIXFR {
+			return []dns.RR{soa(1), blocked, empty, soa(1)}
+		} else if ixfrSupported.Load() {
+			old := req.Ns[0].(*dns.SOA).Serial
+			if old == 2 {
+				return []dns.RR{soa(2)}
+			}
+
+			// Delete blocked.example and add local.example.
+			return []dns.RR{soa(2), soa(1), blocked, soa(2), local, soa(2)}
+		}
+
+		return nil
+	})
+
+	z, err := NewZone(&ZoneConfig{
+		Name:            "rpz.example",
+		Primary:         addr,
+		TransferTimeout: testTimeout,
+	})
+	require.NoError(t, err)
+
+	assertReqType := func(want uint16) {
+		t.Helper()
+
+		got, _ := testutil.RequireReceive(t, reqTypes, testTimeout)
+		assert.Equal(t, want, got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*testTimeout)
+	t.Cleanup(cancel)
+
+	require.NoError(t, z.Refresh(ctx))
+	assertReqType(dns.TypeAXFR)
+	assert.Equal(t, uint32(1), z.serial)
+	assert.NotNil(t, z.rules.Load().qname.match("blocked.example."))
+
+	// The server doesn't support IXFR, so the zone is transferred entirely.
+	require.NoError(t, z.Refresh(ctx))
+	assertReqType(dns.TypeIXFR)
+	assertReqType(dns.TypeAXFR)
+
+	ixfrSupported.Store(true)
+
+	require.NoError(t, z.Refresh(ctx))
+	assertReqType(dns.TypeIXFR)
+	assert.Equal(t, uint32(2), z.serial)
+
+	rs := z.rules.Load()
+	assert.Nil(t, rs.qname.match("blocked.example."))
+	assert.NotNil(t, rs.qname.match("empty.example."))
+	assert.NotNil(t, rs.qname.match("local.example."))
+
+	// Up to date.
+	require.NoError(t, z.Refresh(ctx))
+	assertReqType(dns.TypeIXFR)
+	assert.Same(t, rs, z.rules.Load())
+}
+
+func TestNewZone(t *testing.T) {
+	_, err := NewZone(&ZoneConfig{Name: "rpz.example"})
+	assert.Error(t, err)
+
+	_, err = NewZone(&ZoneConfig{Name: "rpz.example", File: "a", Primary: "b"})
+	assert.Error(t, err)
+
+	_, err = NewZone(&ZoneConfig{File: "a"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,308 @@
+// Package slo implements monitoring of the service level objectives of DNS
+// request processing, such as the 95th percentile of latency and the ratio of
+// failed requests, over a sliding time window.
+package slo
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultWindow is the default length of the sliding window.
+	defaultWindow = 1 * time.Minute
+
+	// numSlots is the number of slots the window is divided into.  The
+	// objectives are evaluated each time the window moves by a slot.
+	numSlots = 10
+
+	// numLatencyBuckets is the number of latency histogram buckets.  The upper
+	// bound of the bucket i is 2^i milliseconds, the last bucket is unbounded.
+	numLatencyBuckets = 17
+)
+
+// Objective is the name of a service level objective.
+type Objective string
+
+const (
+	// ObjectiveLatencyP95 is the objective on the 95th percentile of request
+	// latency.
+	ObjectiveLatencyP95 Objective = "latency_p95"
+
+	// ObjectiveErrorRatio is the objective on the ratio of failed requests.
+	ObjectiveErrorRatio Objective = "error_ratio"
+)
+
+// Alert describes a change of the state of an objective.
+type Alert struct {
+	// Time is the time of the evaluation.
+	Time time.Time `json:"time"`
+
+	// Objective is the objective whose state has changed.
+	Objective Objective `json:"objective"`
+
+	// Value is the measured value.  For [ObjectiveLatencyP95] it's in
+	// seconds.
+	Value float64 `json:"value"`
+
+	// Threshold is the configured threshold.  For [ObjectiveLatencyP95] it's
+	// in seconds.
+	Threshold float64 `json:"threshold"`
+
+	// Requests is the number of requests within the window.
+	Requests uint64 `json:"requests"`
+
+	// Breached is true if the objective is breached and false if it has
+	// recovered.
+	Breached bool `json:"breached"`
+}
+
+// Config is the configuration of a [Monitor].
+type Config struct {
+	// OnAlert is called synchronously when an objective gets breached or
+	// recovers.  It may be nil.
+	OnAlert func(a *Alert)
+
+	// WebhookURL is the URL the alerts are sent to with HTTP POST requests
+	// containing JSON-encoded [Alert].  Empty string disables the webhook.
+	WebhookURL string
+
+	// Window is the length of the sliding window.  If not positive, a default
+	// value of one minute is used.
+	Window time.Duration
+
+	// LatencyP95 is the threshold for the 95th percentile of request latency.
+	// Zero disables the objective.
+	LatencyP95 time.Duration
+
+	// ErrorRatio is the threshold for the ratio of failed requests, between 0
+	// and 1.  Zero disables the objective.
+	ErrorRatio float64
+
+	// MinRequests is the minimum number of requests within the window for the
+	// objectives to be evaluated.
+	MinRequests uint64
+}
+
+// slot contains the statistics of requests within a part of the window.
+type slot struct {
+	// latencies is the histogram of request latencies.
+	latencies [numLatencyBuckets]uint64
+
+	// start is the start time of the slot.
+	start time.Time
+
+	// total is the number of requests.
+	total uint64
+
+	// failed is the number of failed requests.
+	failed uint64
+}
+
+// Monitor collects the statistics of processed requests and evaluates the
+// objectives.  It's safe for concurrent use.
+type Monitor struct {
+	// mu protects slots, cur, and breached.
+	mu *sync.Mutex
+
+	// now returns the current time.
+	now func() (now time.Time)
+
+	// webhook sends the alerts, if configured.
+	webhook *webhook
+
+	onAlert func(a *Alert)
+
+	// breached are the currently breached objectives.
+	breached map[Objective]bool
+
+	// slots is the ring of window slots.
+	slots []*slot
+
+	// cur is the index of the current slot in slots.
+	cur int
+
+	slotDur     time.Duration
+	latencyP95  time.Duration
+	errorRatio  float64
+	minRequests uint64
+}
+
+// New returns a new properly initialized *Monitor.  c must not be nil.
+func New(c *Config) (m *Monitor, err error) {
+	if c.ErrorRatio < 0 || c.ErrorRatio > 1 {
+		return nil, fmt.Errorf("error ratio: value %v out of range [0, 1]", c.ErrorRatio)
+	} else if c.LatencyP95 < 0 {
+		return nil, fmt.Errorf("latency p95: negative value %s", c.LatencyP95)
+	}
+
+	window := c.Window
+	if window <= 0 {
+		window = defaultWindow
+	}
+
+	m = &Monitor{
+		mu:          &sync.Mutex{},
+		now:         time.Now,
+		onAlert:     c.OnAlert,
+		breached:    map[Objective]bool{},
+		slots:       make([]*slot, numSlots),
+		slotDur:     window / numSlots,
+		latencyP95:  c.LatencyP95,
+		errorRatio:  c.ErrorRatio,
+		minRequests: c.MinRequests,
+	}
+
+	for i := range m.slots {
+		m.slots[i] = &slot{}
+	}
+
+	if c.WebhookURL != "" {
+		m.webhook, err = newWebhook(c.WebhookURL)
+		if err != nil {
+			return nil, fmt.Errorf("webhook: %w", err)
+		}
+	}
+
+	return m, nil
+}
+
+// HandleResponse is a [proxy.ResponseHandler] that records the result of the
+// request processing from dctx.
+func (m *Monitor) HandleResponse(dctx *proxy.DNSContext, err error) {
+	failed := err != nil || dctx.Res == nil || dctx.Res.Rcode == dns.RcodeServerFailure
+	m.Record(dctx.QueryDuration, failed)
+}
+
+// Record records a processed request with the given latency.
+func (m *Monitor) Record(latency time.Duration, failed bool) {
+	now := m.now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.slots[m.cur]
+	if now.Sub(s.start) >= m.slotDur {
+		m.evaluate(now)
+
+		m.cur = (m.cur + 1) % len(m.slots)
+		s = m.slots[m.cur]
+		*s = slot{start: now.Truncate(m.slotDur)}
+	}
+
+	s.total++
+	if failed {
+		s.failed++
+	}
+
+	s.latencies[latencyBucket(latency)]++
+}
+
+// latencyBucket returns the index of the histogram bucket for d.
+func latencyBucket(d time.Duration) (i int) {
+	for bound := time.Millisecond; i < numLatencyBuckets-1 && d > bound; bound *= 2 {
+		i++
+	}
+
+	return i
+}
+
+// bucketBound returns the upper bound of the histogram bucket i.
+func bucketBound(i int) (d time.Duration) {
+	return time.Millisecond << i
+}
+
+// evaluate checks the objectives against the statistics within the window
+// ending at now.  m.mu must be locked.
+func (m *Monitor) evaluate(now time.Time) {
+	var sum slot
+	windowStart := now.Add(-m.slotDur * time.Duration(len(m.slots)))
+	for _, s := range m.slots {
+		if s.start.Before(windowStart) {
+			continue
+		}
+
+		sum.total += s.total
+		sum.failed += s.failed
+		for i, n := range s.latencies {
+			sum.latencies[i] += n
+		}
+	}
+
+	if sum.total == 0 || sum.total < m.minRequests {
+		return
+	}
+
+	if m.latencyP95 > 0 {
+		p95 := percentile(&sum, 0.95)
+		m.setState(now, &sum, ObjectiveLatencyP95, p95.Seconds(), m.latencyP95.Seconds())
+	}
+
+	if m.errorRatio > 0 {
+		ratio := float64(sum.failed) / float64(sum.total)
+		m.setState(now, &sum, ObjectiveErrorRatio, ratio, m.errorRatio)
+	}
+}
+
+// percentile returns the approximate latency percentile p from the histogram
+// of s.
+func percentile(s *slot, p float64) (d time.Duration) {
+	target := uint64(float64(s.total) * p)
+
+	var cum uint64
+	for i, n := range s.latencies {
+		cum += n
+		if cum > target || cum == s.total {
+			return bucketBound(i)
+		}
+	}
+
+	return bucketBound(numLatencyBuckets - 1)
+}
+
+// setState updates the state of the objective obj and sends an alert if it
+// has changed.  m.mu must be locked.
+func (m *Monitor) setState(now time.Time, s *slot, obj Objective, val, threshold float64) {
+	breached := val > threshold
+	if m.breached[obj] == breached {
+		return
+	}
+
+	m.breached[obj] = breached
+
+	a := &Alert{
+		Time:      now,
+		Objective: obj,
+		Value:     val,
+		Threshold: threshold,
+		Requests:  s.total,
+		Breached:  breached,
+	}
+
+	if breached {
+		log.Info("slo: %s breached: %v > %v", obj, val, threshold)
+	} else {
+		log.Info("slo: %s recovered: %v <= %v", obj, val, threshold)
+	}
+
+	if m.onAlert != nil {
+		m.onAlert(a)
+	}
+
+	if m.webhook != nil {
+		go m.webhook.send(a)
+	}
+}
+
+// Breached returns true if the objective obj is currently breached.
+func (m *Monitor) Breached(obj Objective) (ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.breached[obj]
+}
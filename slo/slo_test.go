@@ -0,0 +1,116 @@
+package slo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitor_Record(t *testing.T) {
+	var alerts []*Alert
+	m, err := New(&Config{
+		OnAlert:     func(a *Alert) { alerts = append(alerts, a) },
+		Window:      10 * time.Second,
+		LatencyP95:  100 * time.Millisecond,
+		ErrorRatio:  0.1,
+		MinRequests: 10,
+	})
+	require.NoError(t, err)
+
+	now := time.Unix(1_000_000, 0)
+	m.now = func() (t time.Time) { return now }
+
+	// Fill a slot with fast and successful requests.
+	for range 20 {
+		m.Record(time.Millisecond, false)
+	}
+
+	now = now.Add(time.Second)
+	m.Record(time.Millisecond, false)
+	assert.Empty(t, alerts)
+
+	// Add slow and failing requests.
+	for range 20 {
+		m.Record(time.Second, true)
+	}
+
+	now = now.Add(time.Second)
+	m.Record(time.Millisecond, false)
+
+	require.Len(t, alerts, 2)
+	assert.Equal(t, ObjectiveLatencyP95, alerts[0].Objective)
+	assert.True(t, alerts[0].Breached)
+	assert.Equal(t, ObjectiveErrorRatio, alerts[1].Objective)
+	assert.True(t, alerts[1].Breached)
+	assert.True(t, m.Breached(ObjectiveErrorRatio))
+
+	// Let the bad slots leave the window.
+	now = now.Add(20 * time.Second)
+	for range 20 {
+		m.Record(time.Millisecond, false)
+	}
+
+	now = now.Add(time.Second)
+	m.Record(time.Millisecond, false)
+
+	require.Len(t, alerts, 4)
+	assert.False(t, alerts[2].Breached)
+	assert.False(t, alerts[3].Breached)
+	assert.False(t, m.Breached(ObjectiveLatencyP95))
+}
+
+func TestMonitor_webhook(t *testing.T) {
+	alertCh := make(chan *Alert, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := &Alert{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(a))
+
+		alertCh <- a
+	}))
+	t.Cleanup(srv.Close)
+
+	m, err := New(&Config{
+		WebhookURL: srv.URL,
+		ErrorRatio: 0.5,
+	})
+	require.NoError(t, err)
+
+	now := time.Unix(1_000_000, 0)
+	m.now = func() (t time.Time) { return now }
+
+	m.Record(0, true)
+	m.Record(0, true)
+
+	now = now.Add(time.Minute / numSlots)
+	m.Record(0, false)
+
+	select {
+	case a := <-alertCh:
+		assert.Equal(t, ObjectiveErrorRatio, a.Objective)
+		assert.True(t, a.Breached)
+		assert.Equal(t, 1.0, a.Value)
+	case <-time.After(time.Second):
+		t.Fatal("no alert sent")
+	}
+}
+
+func TestNew_errors(t *testing.T) {
+	_, err := New(&Config{ErrorRatio: 2})
+	assert.Error(t, err)
+
+	_, err = New(&Config{WebhookURL: "ftp://example.com"})
+	assert.Error(t, err)
+}
+
+func TestLatencyBucket(t *testing.T) {
+	assert.Equal(t, 0, latencyBucket(0))
+	assert.Equal(t, 0, latencyBucket(time.Millisecond))
+	assert.Equal(t, 1, latencyBucket(2*time.Millisecond))
+	assert.Equal(t, 7, latencyBucket(100*time.Millisecond))
+	assert.Equal(t, numLatencyBuckets-1, latencyBucket(time.Hour))
+}
@@ -0,0 +1,69 @@
+package slo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// webhookTimeout is the timeout for sending a single alert.
+const webhookTimeout = 10 * time.Second
+
+// webhook sends alerts to an HTTP endpoint.
+type webhook struct {
+	client *http.Client
+	url    string
+}
+
+// newWebhook returns a new webhook sending alerts to rawURL.
+func newWebhook(rawURL string) (w *webhook, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("bad url scheme %q", u.Scheme)
+	}
+
+	return &webhook{
+		client: &http.Client{Timeout: webhookTimeout},
+		url:    u.String(),
+	}, nil
+}
+
+// send posts a to the webhook URL.  It's intended to be used as a goroutine.
+func (w *webhook) send(a *Alert) {
+	defer log.OnPanic("slo webhook")
+
+	err := w.post(a)
+	if err != nil {
+		log.Error("slo: sending alert for %s: %s", a.Objective, err)
+	}
+}
+
+// post posts a to the webhook URL.
+func (w *webhook) post(a *Alert) (err error) {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("encoding alert: %w", err)
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() { _, _ = io.Copy(io.Discard, resp.Body); _ = resp.Body.Close() }()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,379 @@
+// Package tunnel implements the detection of the likely DNS tunneling, that is
+// the data exfiltration and command-and-control traffic encoded into the DNS
+// queries, and the actions against the offending clients.
+package tunnel
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	rate "github.com/beefsack/go-rate"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Action is the behavior for the queries of the client and domain pairs
+// considered tunneling.
+type Action uint8
+
+const (
+	// ActionLog only logs the offending pairs and processes their queries as
+	// usual.
+	ActionLog Action = iota
+
+	// ActionThrottle only processes the queries of the offending pairs at a
+	// reduced rate, see [Config.ThrottleRate], and drops the rest.
+	ActionThrottle
+
+	// ActionBlock responds to the queries of the offending pairs with REFUSED.
+	ActionBlock
+)
+
+// String implements the [fmt.Stringer] interface for Action.
+func (a Action) String() (s string) {
+	switch a {
+	case ActionLog:
+		return "log"
+	case ActionThrottle:
+		return "throttle"
+	case ActionBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("!bad_action_%d", uint8(a))
+	}
+}
+
+// ParseAction parses the action from its string representation as returned by
+// [Action.String].
+func ParseAction(s string) (a Action, err error) {
+	for a = ActionLog; a <= ActionBlock; a++ {
+		if a.String() == s {
+			return a, nil
+		}
+	}
+
+	return ActionLog, fmt.Errorf("unknown tunnel action %q", s)
+}
+
+const (
+	// defaultThrottleRate is the default number of queries per second
+	// processed for an offending pair with [ActionThrottle].
+	defaultThrottleRate = 1
+
+	// defaultDuration is the default time an offending pair stays flagged
+	// after its last suspicious query.
+	defaultDuration = 10 * time.Minute
+
+	// minEntropyLen is the minimum length of the subdomain part of a name to
+	// check its entropy, since the entropy of the short strings is always low
+	// and doesn't tell anything.
+	minEntropyLen = 24
+)
+
+// Config is the configuration of a [Detector].
+type Config struct {
+	// MaxLabelLen is the maximum length of a label in the queried names (0
+	// for no limit).
+	MaxLabelLen int
+
+	// MinEntropy is the Shannon entropy in bits per character of the
+	// subdomain part of the queried names, at and above which the names are
+	// considered encoding data (0 for no limit).  Only the subdomain parts of
+	// at least 24 characters are checked.
+	MinEntropy float64
+
+	// MaxTXTPerMinute is the maximum number of TXT and NULL queries from a
+	// client per minute (0 for no limit).
+	MaxTXTPerMinute uint64
+
+	// ThrottleRate is the number of queries per second processed for an
+	// offending pair with [ActionThrottle].  If not positive, 1 is used.
+	ThrottleRate int
+
+	// Duration is the time an offending pair stays flagged after its last
+	// suspicious query.  If not positive, 10 minutes is used.
+	Duration time.Duration
+
+	// Action is the behavior for the queries of the offending pairs.
+	Action Action
+}
+
+// pair is a client and domain pair.
+type pair struct {
+	// domain is the registered domain of the queried names, e.g. "example.com"
+	// for "data.tunnel.example.com".
+	domain string
+
+	client netip.Addr
+}
+
+// flagged is the state of an offending pair.
+type flagged struct {
+	// throttle limits the rate of the queries of the pair.  It's nil unless
+	// the action is [ActionThrottle].
+	throttle *rate.RateLimiter
+
+	// until is the time after which the pair isn't considered offending.
+	until time.Time
+}
+
+// txtUsage is the number of TXT and NULL queries of a client within the
+// current minute.
+type txtUsage struct {
+	minute time.Time
+	count  uint64
+}
+
+// Detector is a [proxy.BeforeRequestHandler] detecting the likely DNS
+// tunneling by the long labels, the high-entropy subdomains, and the volume of
+// TXT and NULL queries.  The offending queries flag the pair of the client IP
+// address and the registered domain, and the queries of the flagged pairs are
+// handled according to [Config.Action].  It's safe for concurrent use.
+type Detector struct {
+	// now returns the current time.  It's replaced in tests.
+	now func() (t time.Time)
+
+	// mu protects flagged, txt, and sweep.
+	mu *sync.Mutex
+
+	// flagged are the states of the offending pairs.
+	flagged map[pair]*flagged
+
+	// txt are the TXT and NULL query counts of the clients.
+	txt map[netip.Addr]*txtUsage
+
+	// sweep is the start of the minute of the last removal of the stale
+	// states.
+	sweep time.Time
+
+	maxLabelLen     int
+	minEntropy      float64
+	maxTXTPerMinute uint64
+	throttleRate    int
+	duration        time.Duration
+	action          Action
+}
+
+// New returns a new properly initialized *Detector.  c must not be nil.
+func New(c *Config) (d *Detector) {
+	d = &Detector{
+		now:             time.Now,
+		mu:              &sync.Mutex{},
+		flagged:         map[pair]*flagged{},
+		txt:             map[netip.Addr]*txtUsage{},
+		maxLabelLen:     c.MaxLabelLen,
+		minEntropy:      c.MinEntropy,
+		maxTXTPerMinute: c.MaxTXTPerMinute,
+		throttleRate:    c.ThrottleRate,
+		duration:        c.Duration,
+		action:          c.Action,
+	}
+
+	if d.throttleRate <= 0 {
+		d.throttleRate = defaultThrottleRate
+	}
+
+	if d.duration <= 0 {
+		d.duration = defaultDuration
+	}
+
+	return d
+}
+
+const (
+	// errBlocked is returned for the refused queries.
+	errBlocked errors.Error = "likely dns tunneling"
+
+	// errThrottled is returned for the dropped queries.
+	errThrottled errors.Error = "likely dns tunneling, throttled"
+)
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Detector)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Detector.
+func (d *Detector) HandleBefore(_ *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	if len(dctx.Req.Question) == 0 {
+		return nil
+	}
+
+	q := dctx.Req.Question[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	p := pair{
+		domain: registeredDomain(name),
+		client: dctx.Addr.Addr().Unmap(),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	d.removeStale(now)
+
+	f := d.check(p, name, q.Qtype, now)
+	if f == nil || d.action == ActionLog {
+		return nil
+	}
+
+	if d.action == ActionThrottle {
+		if ok, _ := f.throttle.Try(); ok {
+			return nil
+		}
+
+		// Drop the query, since [proxy.Proxy] doesn't respond to the
+		// queries failed with other errors.
+		return fmt.Errorf("tunnel: %s: %s: %w", p.client, p.domain, errThrottled)
+	}
+
+	return &proxy.BeforeRequestError{
+		Err:      fmt.Errorf("tunnel: %s: %s: %w", p.client, p.domain, errBlocked),
+		Response: newRefused(dctx.Req),
+	}
+}
+
+// check checks the query for name of qtype from p and returns the state of p,
+// if it's flagged.  d.mu must be locked.
+func (d *Detector) check(p pair, name string, qtype uint16, now time.Time) (f *flagged) {
+	f, ok := d.flagged[p]
+	if ok && !now.Before(f.until) {
+		delete(d.flagged, p)
+		f, ok = nil, false
+	}
+
+	reason := d.suspicion(p, name, qtype, now)
+	if reason == "" {
+		return f
+	}
+
+	if !ok {
+		log.Info("tunnel: %s: %s: likely dns tunneling: %s", p.client, p.domain, reason)
+
+		f = &flagged{}
+		if d.action == ActionThrottle {
+			f.throttle = rate.New(d.throttleRate, time.Second)
+		}
+
+		d.flagged[p] = f
+	}
+
+	f.until = now.Add(d.duration)
+
+	return f
+}
+
+// suspicion returns the reason why the query for name of qtype from p looks
+// like tunneling, or an empty string if it doesn't.  d.mu must be locked.
+func (d *Detector) suspicion(p pair, name string, qtype uint16, now time.Time) (reason string) {
+	if qtype == dns.TypeTXT || qtype == dns.TypeNULL {
+		u, ok := d.txt[p.client]
+		if minute := now.Truncate(time.Minute); !ok || !u.minute.Equal(minute) {
+			u = &txtUsage{minute: minute}
+			d.txt[p.client] = u
+		}
+
+		u.count++
+		if d.maxTXTPerMinute > 0 && u.count > d.maxTXTPerMinute {
+			return fmt.Sprintf("%d txt and null queries per minute", u.count)
+		}
+	}
+
+	if d.maxLabelLen > 0 {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) > d.maxLabelLen {
+				return fmt.Sprintf("label of %d characters", len(label))
+			}
+		}
+	}
+
+	if d.minEntropy > 0 {
+		sub := strings.TrimSuffix(strings.TrimSuffix(name, p.domain), ".")
+		sub = strings.ReplaceAll(sub, ".", "")
+		if len(sub) < minEntropyLen {
+			return ""
+		}
+
+		if e := entropy(sub); e >= d.minEntropy {
+			return fmt.Sprintf("subdomain entropy of %.2f bits", e)
+		}
+	}
+
+	return ""
+}
+
+// removeStale removes the states of the pairs no longer flagged and the TXT
+// query counts of the previous minutes, once a minute.  d.mu must be locked.
+func (d *Detector) removeStale(now time.Time) {
+	minute := now.Truncate(time.Minute)
+	if d.sweep.Equal(minute) {
+		return
+	}
+
+	d.sweep = minute
+	for p, f := range d.flagged {
+		if !now.Before(f.until) {
+			delete(d.flagged, p)
+		}
+	}
+
+	for addr, u := range d.txt {
+		if u.minute.Before(minute) {
+			delete(d.txt, addr)
+		}
+	}
+}
+
+// Flagged returns true if the client with addr is currently flagged for the
+// queries under domain, which is the registered domain, e.g. "example.com".
+func (d *Detector) Flagged(addr netip.Addr, domain string) (ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, ok := d.flagged[pair{domain: domain, client: addr.Unmap()}]
+
+	return ok && d.now().Before(f.until)
+}
+
+// registeredDomain returns the registered domain of name, i.e. the public
+// suffix plus one label, or name itself if there is none.
+func registeredDomain(name string) (domain string) {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		// The error is only returned for the public suffixes themselves and
+		// the malformed names, so group those by the name itself.
+		return name
+	}
+
+	return domain
+}
+
+// entropy returns the Shannon entropy of s in bits per character.
+func entropy(s string) (e float64) {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+
+	n := float64(len(s))
+	for _, c := range counts {
+		freq := float64(c) / n
+		e -= freq * math.Log2(freq)
+	}
+
+	return e
+}
+
+// newRefused returns a new REFUSED response to req.
+func newRefused(req *dns.Msg) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetRcode(req, dns.RcodeRefused)
+	resp.RecursionAvailable = true
+
+	return resp
+}
@@ -0,0 +1,159 @@
+package tunnel
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestContext returns a new *proxy.DNSContext for a request for name of
+// qtype from addr.
+func newTestContext(addr netip.Addr, name string, qtype uint16) (dctx *proxy.DNSContext) {
+	return &proxy.DNSContext{
+		Req:  (&dns.Msg{}).SetQuestion(name, qtype),
+		Addr: netip.AddrPortFrom(addr, 53),
+	}
+}
+
+func TestDetector_HandleBefore(t *testing.T) {
+	var (
+		client      = netip.MustParseAddr("192.0.2.1")
+		otherClient = netip.MustParseAddr("192.0.2.2")
+	)
+
+	const (
+		longName    = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.tunnel.example."
+		entropyName = "mzxw6ytboi4dqnzwgq2tgmrrgi3dsobq.tunnel.example."
+		plainName   = "www.tunnel.example."
+	)
+
+	testCases := []struct {
+		name  string
+		qname string
+		want  bool
+	}{{
+		name:  "plain",
+		qname: plainName,
+		want:  false,
+	}, {
+		name:  "long_label",
+		qname: longName,
+		want:  true,
+	}, {
+		name:  "high_entropy",
+		qname: entropyName,
+		want:  true,
+	}, {
+		name:  "low_entropy",
+		qname: "prod.eu-west-1.api.gateway.services.example.",
+		want:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := New(&Config{
+				MaxLabelLen: 50,
+				MinEntropy:  4,
+				Action:      ActionBlock,
+			})
+
+			err := d.HandleBefore(nil, newTestContext(client, tc.qname, dns.TypeA))
+			if !tc.want {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			reqErr := testutil.RequireTypeAssert[*proxy.BeforeRequestError](t, err)
+			require.NotNil(t, reqErr.Response)
+			assert.Equal(t, dns.RcodeRefused, reqErr.Response.Rcode)
+			assert.ErrorIs(t, err, errBlocked)
+
+			// The pair stays flagged for the other names of the domain, but
+			// not for the other clients and domains.
+			err = d.HandleBefore(nil, newTestContext(client, plainName, dns.TypeA))
+			assert.Error(t, err)
+
+			err = d.HandleBefore(nil, newTestContext(otherClient, plainName, dns.TypeA))
+			assert.NoError(t, err)
+
+			err = d.HandleBefore(nil, newTestContext(client, "www.example.org.", dns.TypeA))
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDetector_HandleBefore_txt(t *testing.T) {
+	client := netip.MustParseAddr("192.0.2.1")
+	now := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+
+	d := New(&Config{
+		MaxTXTPerMinute: 3,
+		Duration:        5 * time.Minute,
+		Action:          ActionThrottle,
+		ThrottleRate:    1,
+	})
+	d.now = func() (t time.Time) { return now }
+
+	for range 3 {
+		require.NoError(t, d.HandleBefore(nil, newTestContext(client, "t.example.", dns.TypeTXT)))
+	}
+
+	assert.False(t, d.Flagged(client, "t.example"))
+
+	// The first query over the limit is processed within the throttling rate,
+	// and the next one is dropped.
+	require.NoError(t, d.HandleBefore(nil, newTestContext(client, "t.example.", dns.TypeNULL)))
+	assert.True(t, d.Flagged(client, "t.example"))
+
+	err := d.HandleBefore(nil, newTestContext(client, "t.example.", dns.TypeA))
+	assert.ErrorIs(t, err, errThrottled)
+
+	var reqErr *proxy.BeforeRequestError
+	assert.False(t, errors.As(err, &reqErr))
+
+	// The counts are reset every minute, and the pair is unflagged after the
+	// duration.
+	now = now.Add(5 * time.Minute)
+	assert.False(t, d.Flagged(client, "t.example"))
+
+	require.NoError(t, d.HandleBefore(nil, newTestContext(client, "t.example.", dns.TypeTXT)))
+	assert.Empty(t, d.flagged)
+	assert.Len(t, d.txt, 1)
+}
+
+func TestDetector_HandleBefore_log(t *testing.T) {
+	client := netip.MustParseAddr("192.0.2.1")
+	name := strings.Repeat("a", 60) + ".tunnel.example."
+
+	d := New(&Config{
+		MaxLabelLen: 50,
+		Action:      ActionLog,
+	})
+
+	for range 3 {
+		require.NoError(t, d.HandleBefore(nil, newTestContext(client, name, dns.TypeA)))
+	}
+
+	assert.True(t, d.Flagged(client, "tunnel.example"))
+}
+
+func TestParseAction(t *testing.T) {
+	for _, a := range []Action{ActionLog, ActionThrottle, ActionBlock} {
+		got, err := ParseAction(a.String())
+		require.NoError(t, err)
+
+		assert.Equal(t, a, got)
+	}
+
+	_, err := ParseAction("drop")
+	assert.Error(t, err)
+}
@@ -31,6 +31,9 @@ type dnsCrypt struct {
 	// verifyCert is a callback that verifies the resolver's certificate.
 	verifyCert func(cert *dnscrypt.Cert) (err error)
 
+	// cache, if not nil, stores the resolver properties across restarts.
+	cache *DNSCryptCache
+
 	// timeout is the timeout for the DNS requests.
 	timeout time.Duration
 }
@@ -41,6 +44,7 @@ func newDNSCrypt(addr *url.URL, opts *Options) (u *dnsCrypt) {
 		mu:         &sync.RWMutex{},
 		addr:       addr,
 		verifyCert: opts.VerifyDNSCryptCertificate,
+		cache:      opts.DNSCryptCache,
 		timeout:    opts.Timeout,
 	}
 }
@@ -86,6 +90,10 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (resp *dns.Msg, err error) {
 		client, resolverInfo = p.client, p.resolverInfo
 	}()
 
+	if client == nil {
+		client, resolverInfo = p.restoreClient()
+	}
+
 	// Check the client and server info are set and the certificate is not
 	// expired, since any of these cases require a client reset.
 	//
@@ -119,6 +127,35 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (resp *dns.Msg, err error) {
 	return resp, err
 }
 
+// restoreClient sets the DNSCrypt client and server properties from the cache,
+// if there are valid ones there, and returns them.
+func (p *dnsCrypt) restoreClient() (client *dnscrypt.Client, ri *dnscrypt.ResolverInfo) {
+	addr := p.Address()
+
+	ri = p.cache.get(addr)
+	if ri == nil {
+		return nil, nil
+	}
+
+	if p.verifyCert != nil {
+		err := p.verifyCert(ri.ResolverCert)
+		if err != nil {
+			log.Debug("dnscrypt %s: verifying cached certificate: %s", addr, err)
+
+			return nil, nil
+		}
+	}
+
+	client = &dnscrypt.Client{Timeout: p.timeout, Net: networkUDP}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.client, p.resolverInfo = client, ri
+
+	return client, ri
+}
+
 // resetClient renews the DNSCrypt client and server properties and also sets
 // those to nil on fail.
 func (p *dnsCrypt) resetClient() (client *dnscrypt.Client, ri *dnscrypt.ResolverInfo, err error) {
@@ -129,6 +166,7 @@ func (p *dnsCrypt) resetClient() (client *dnscrypt.Client, ri *dnscrypt.Resolver
 		defer p.mu.Unlock()
 
 		p.client, p.resolverInfo = client, ri
+		p.cache.set(addr, ri)
 	}()
 
 	// Use UDP for DNSCrypt upstreams by default.
@@ -0,0 +1,237 @@
+package upstream
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/dnscrypt/v2"
+)
+
+// DNSCryptCache is a cache of the resolver certificates and the shared keys of
+// the DNSCrypt upstreams.  If persisted to disk, it allows the DNSCrypt
+// upstreams to send the first query after a restart without fetching the
+// certificate first.  The entries are keyed by the upstream address, i.e. the
+// DNS stamp, which also contains the provider public key.  It's safe for
+// concurrent use.
+type DNSCryptCache struct {
+	// mu protects infos.
+	mu *sync.Mutex
+
+	// infos are the resolver information keyed by the upstream address.
+	infos map[string]*dnscrypt.ResolverInfo
+
+	path string
+}
+
+// NewDNSCryptCache returns a new *DNSCryptCache.  If path is not empty, the
+// entries are loaded from the file at path, if it exists, and
+// [DNSCryptCache.Save] writes them there.
+func NewDNSCryptCache(path string) (c *DNSCryptCache, err error) {
+	c = &DNSCryptCache{
+		mu:    &sync.Mutex{},
+		infos: map[string]*dnscrypt.ResolverInfo{},
+		path:  path,
+	}
+
+	if path == "" {
+		return c, nil
+	}
+
+	err = c.load()
+	if err != nil {
+		return nil, fmt.Errorf("loading dnscrypt resolvers: %w", err)
+	}
+
+	return c, nil
+}
+
+// persistedResolver is the serialized form of a DNSCrypt resolver information.
+type persistedResolver struct {
+	ServerAddress   string `json:"server_address"`
+	ProviderName    string `json:"provider_name"`
+	ServerPublicKey []byte `json:"server_public_key"`
+	Cert            []byte `json:"cert"`
+	SecretKey       []byte `json:"secret_key"`
+	PublicKey       []byte `json:"public_key"`
+	SharedKey       []byte `json:"shared_key"`
+}
+
+// toResolverInfo converts r into a resolver information.  It returns an error
+// if r is malformed or its certificate isn't valid at now.
+func (r *persistedResolver) toResolverInfo(now time.Time) (ri *dnscrypt.ResolverInfo, err error) {
+	ri = &dnscrypt.ResolverInfo{
+		ServerPublicKey: r.ServerPublicKey,
+		ServerAddress:   r.ServerAddress,
+		ProviderName:    r.ProviderName,
+		ResolverCert:    &dnscrypt.Cert{},
+	}
+
+	if len(r.ServerPublicKey) != ed25519.PublicKeySize ||
+		len(r.SecretKey) != len(ri.SecretKey) ||
+		len(r.PublicKey) != len(ri.PublicKey) ||
+		len(r.SharedKey) != len(ri.SharedKey) {
+		return nil, errors.Error("bad key length")
+	}
+
+	copy(ri.SecretKey[:], r.SecretKey)
+	copy(ri.PublicKey[:], r.PublicKey)
+	copy(ri.SharedKey[:], r.SharedKey)
+
+	err = ri.ResolverCert.Deserialize(r.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("decoding certificate: %w", err)
+	}
+
+	if !ri.ResolverCert.VerifySignature(ri.ServerPublicKey) {
+		return nil, errors.Error("bad certificate signature")
+	}
+
+	if !isCertValid(ri.ResolverCert, now) {
+		return nil, errors.Error("certificate expired")
+	}
+
+	return ri, nil
+}
+
+// isCertValid returns true if cert is valid at now.
+func isCertValid(cert *dnscrypt.Cert, now time.Time) (ok bool) {
+	unix := now.Unix()
+
+	return int64(cert.NotBefore) <= unix && unix <= int64(cert.NotAfter)
+}
+
+// load reads the entries from the file at c.path.  A missing file isn't an
+// error, and the invalid and expired entries are skipped.
+func (c *DNSCryptCache) load() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	resolvers := map[string]*persistedResolver{}
+	err = json.Unmarshal(data, &resolvers)
+	if err != nil {
+		return fmt.Errorf("decoding: %w", err)
+	}
+
+	now := time.Now()
+	for addr, r := range resolvers {
+		ri, riErr := r.toResolverInfo(now)
+		if riErr != nil {
+			log.Debug("dnscrypt cache: restoring %q: %s", addr, riErr)
+
+			continue
+		}
+
+		c.infos[addr] = ri
+	}
+
+	log.Debug("dnscrypt cache: loaded %d resolvers", len(c.infos))
+
+	return nil
+}
+
+// Save writes the entries to the file the cache has been created with, if
+// any.  The expired entries are dropped.
+func (c *DNSCryptCache) Save() (err error) {
+	if c.path == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	resolvers := map[string]*persistedResolver{}
+	for addr, ri := range c.infos {
+		if !isCertValid(ri.ResolverCert, now) {
+			continue
+		}
+
+		cert, serErr := ri.ResolverCert.Serialize()
+		if serErr != nil {
+			continue
+		}
+
+		resolvers[addr] = &persistedResolver{
+			ServerAddress:   ri.ServerAddress,
+			ProviderName:    ri.ProviderName,
+			ServerPublicKey: ri.ServerPublicKey,
+			Cert:            cert,
+			SecretKey:       ri.SecretKey[:],
+			PublicKey:       ri.PublicKey[:],
+			SharedKey:       ri.SharedKey[:],
+		}
+	}
+
+	data, err := json.Marshal(resolvers)
+	if err != nil {
+		return fmt.Errorf("encoding dnscrypt resolvers: %w", err)
+	}
+
+	// Write the file atomically, since it contains the secret keys and a
+	// partial file is useless anyway.
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	_, err = tmp.Write(data)
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("writing dnscrypt resolvers: %w", err), os.Remove(tmp.Name()))
+	}
+
+	return nil
+}
+
+// get returns the resolver information for addr, if it's cached and its
+// certificate is still valid.  c may be nil.
+func (c *DNSCryptCache) get(addr string) (ri *dnscrypt.ResolverInfo) {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ri = c.infos[addr]
+	if ri == nil || !isCertValid(ri.ResolverCert, time.Now()) {
+		return nil
+	}
+
+	return ri
+}
+
+// set stores ri for addr, or removes the entry if ri is nil.  c may be nil.
+func (c *DNSCryptCache) set(addr string, ri *dnscrypt.ResolverInfo) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ri == nil {
+		delete(c.infos, addr)
+	} else {
+		c.infos[addr] = ri
+	}
+}
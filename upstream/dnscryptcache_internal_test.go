@@ -0,0 +1,64 @@
+package upstream
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSCryptCache(t *testing.T) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	require.NoError(t, err)
+
+	h := dnsCryptHandlerFunc(func(w dnscrypt.ResponseWriter, r *dns.Msg) (err error) {
+		return w.WriteMsg(respondToTestMessage(r))
+	})
+	stamp := startTestDNSCryptServer(t, rc, h)
+	addr := stamp.String()
+	path := filepath.Join(t.TempDir(), "dnscrypt.json")
+
+	// exchange creates a new upstream using a cache loaded from path, makes a
+	// single exchange, and returns true if the cached resolver information has
+	// been used.
+	exchange := func(t *testing.T) (restored bool) {
+		t.Helper()
+
+		c, err := NewDNSCryptCache(path)
+		require.NoError(t, err)
+
+		cached := c.get(addr)
+
+		u, err := AddressToUpstream(addr, &Options{
+			Timeout:       timeout,
+			DNSCryptCache: c,
+		})
+		require.NoError(t, err)
+
+		checkUpstream(t, u, addr)
+		require.NoError(t, u.Close())
+		require.NoError(t, c.Save())
+
+		dc := testutil.RequireTypeAssert[*dnsCrypt](t, u)
+
+		return cached != nil && dc.resolverInfo == cached
+	}
+
+	assert.False(t, exchange(t))
+	assert.True(t, exchange(t))
+
+	t.Run("corrupted", func(t *testing.T) {
+		err = os.WriteFile(path, []byte(`{"`+addr+`":{"cert":"AAAA"}}`), 0o600)
+		require.NoError(t, err)
+
+		c, err := NewDNSCryptCache(path)
+		require.NoError(t, err)
+
+		assert.Nil(t, c.get(addr))
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
@@ -37,8 +38,8 @@ const (
 	// implementation, see https://github.com/bruceluk/dnsproxy/issues/278.
 	dohMaxConnsPerHost = 2
 
-	// dohMaxIdleConns controls the maximum number of connections being idle
-	// at the same time.
+	// dohMaxIdleConns is the default maximum number of connections being
+	// idle at the same time, see [Options.MaxIdleConns].
 	dohMaxIdleConns = 2
 )
 
@@ -70,12 +71,29 @@ type dnsOverHTTPS struct {
 	// quicConfMu protects quicConf.
 	quicConfMu *sync.Mutex
 
+	// altSvc is the HTTP/3 alternative service discovered from the Alt-Svc
+	// header of the HTTP/1.1 and HTTP/2 responses.  It's protected by
+	// clientMu.
+	altSvc *altSvcH3
+
+	// altSvcBroken is the time until which altSvc isn't used since connecting
+	// to it failed.  It's protected by clientMu.
+	altSvcBroken time.Time
+
 	// addrRedacted is the redacted string representation of addr.  It is saved
 	// separately to reduce allocations during logging and error reporting.
 	addrRedacted string
 
 	// timeout is used in HTTP client and for H3 probes.
 	timeout time.Duration
+
+	// maxIdleConns is the maximum number of the idle HTTP/1.1 and HTTP/2
+	// connections.
+	maxIdleConns int
+
+	// discoverH3 is true if the HTTP/3 alternative services advertised by the
+	// server should be used.
+	discoverH3 bool
 }
 
 // newDoH returns the DNS-over-HTTPS Upstream.
@@ -100,13 +118,10 @@ func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 		},
 		quicConfMu: &sync.Mutex{},
 		tlsConf: &tls.Config{
-			ServerName:   addr.Hostname(),
-			RootCAs:      opts.RootCAs,
-			CipherSuites: opts.CipherSuites,
-			// Use the default capacity for the LRU cache.  It may be useful to
-			// store several caches since the user may be routed to different
-			// servers in case there's load balancing on the server-side.
-			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+			ServerName:         addr.Hostname(),
+			RootCAs:            opts.RootCAs,
+			CipherSuites:       opts.CipherSuites,
+			ClientSessionCache: opts.TLSSessionCache.forProto("https"),
 			MinVersion:         tls.VersionTLS12,
 			// #nosec G402 -- TLS certificate verification could be disabled by
 			// configuration.
@@ -117,7 +132,13 @@ func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 		clientMu:     &sync.Mutex{},
 		addrRedacted: addr.Redacted(),
 		timeout:      opts.Timeout,
+		maxIdleConns: dohMaxIdleConns,
+		discoverH3:   opts.HTTP3AltSvc,
 	}
+	if opts.MaxIdleConns > 0 {
+		ups.maxIdleConns = opts.MaxIdleConns
+	}
+
 	for _, v := range httpVersions {
 		ups.tlsConf.NextProtos = append(ups.tlsConf.NextProtos, string(v))
 	}
@@ -270,6 +291,10 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(
 	}
 	defer log.OnCloserError(httpResp.Body, log.DEBUG)
 
+	if p.discoverH3 && !isHTTP3(client) {
+		p.observeAltSvc(client, httpResp.Header.Get("Alt-Svc"))
+	}
+
 	body, err := io.ReadAll(httpResp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("reading %s: %w", p.addrRedacted, err)
@@ -352,6 +377,58 @@ func (p *dnsOverHTTPS) resetClient(resetErr error) (client *http.Client, err err
 	return p.client, err
 }
 
+// observeAltSvc handles val, the value of the Alt-Svc header of the response
+// received with client over HTTP/1.1 or HTTP/2.  Once the HTTP/3 alternative
+// service is discovered, client is dropped so that the next request re-creates
+// the client using it.
+func (p *dnsOverHTTPS) observeAltSvc(client *http.Client, val string) {
+	if val == "" {
+		return
+	}
+
+	now := time.Now()
+	svc, cleared := parseAltSvcH3(val, p.addr.Hostname(), now)
+
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	if cleared {
+		p.altSvc = nil
+
+		return
+	} else if svc == nil {
+		return
+	}
+
+	p.altSvc = svc
+	if now.Before(p.altSvcBroken) || p.client != client {
+		return
+	}
+
+	log.Debug("switching %s to HTTP/3 on port %d advertised by alt-svc", p.addrRedacted, svc.port)
+
+	p.client = nil
+
+	// Only close the idle connections, since the requests in progress still
+	// use the others.
+	client.CloseIdleConnections()
+}
+
+// altSvcPort returns the port of the HTTP/3 alternative service to use or zero
+// if there is none.  clientMu is expected to be locked.
+func (p *dnsOverHTTPS) altSvcPort() (port uint16) {
+	now := time.Now()
+	if p.altSvc == nil || now.Before(p.altSvcBroken) {
+		return 0
+	} else if now.After(p.altSvc.expire) {
+		p.altSvc = nil
+
+		return 0
+	}
+
+	return p.altSvc.port
+}
+
 // getQUICConfig returns the QUIC config in a thread-safe manner.  Note, that
 // this method returns a pointer, it is forbidden to change its properties.
 func (p *dnsOverHTTPS) getQUICConfig() (c *quic.Config) {
@@ -435,6 +512,20 @@ func (p *dnsOverHTTPS) createTransport() (t http.RoundTripper, err error) {
 	// connection is established successfully, we'll be using HTTP3 for this
 	// upstream.
 	tlsConf := p.tlsConf.Clone()
+	if port := p.altSvcPort(); port != 0 {
+		t, err = p.createTransportAltSvc(tlsConf, dialContext, port)
+		if err == nil {
+			log.Debug("using HTTP/3 for this upstream: advertised by alt-svc")
+
+			return t, nil
+		}
+
+		// Most probably, QUIC is blocked on the network, so don't try it for
+		// a while and fall back to HTTP/2.
+		log.Debug("using HTTP/2 for this upstream: alt-svc: %v", err)
+		p.altSvcBroken = time.Now().Add(altSvcBrokenTimeout)
+	}
+
 	transportH3, err := p.createTransportH3(tlsConf, dialContext)
 	if err == nil {
 		log.Debug("using HTTP/3 for this upstream: QUIC was faster")
@@ -448,12 +539,13 @@ func (p *dnsOverHTTPS) createTransport() (t http.RoundTripper, err error) {
 	}
 
 	transport := &http.Transport{
-		TLSClientConfig:    tlsConf,
-		DisableCompression: true,
-		DialContext:        dialContext,
-		IdleConnTimeout:    transportDefaultIdleConnTimeout,
-		MaxConnsPerHost:    dohMaxConnsPerHost,
-		MaxIdleConns:       dohMaxIdleConns,
+		TLSClientConfig:     tlsConf,
+		DisableCompression:  true,
+		DialContext:         dialContext,
+		IdleConnTimeout:     transportDefaultIdleConnTimeout,
+		MaxConnsPerHost:     dohMaxConnsPerHost,
+		MaxIdleConns:        p.maxIdleConns,
+		MaxIdleConnsPerHost: p.maxIdleConns,
 		// Since we have a custom DialContext, we need to use this field to make
 		// golang http.Client attempt to use HTTP/2. Otherwise, it would only be
 		// used when negotiated on the TLS level.
@@ -540,7 +632,48 @@ func (p *dnsOverHTTPS) createTransportH3(
 		return nil, err
 	}
 
-	rt := &http3.RoundTripper{
+	return p.newTransportH3(addr, tlsConfig), nil
+}
+
+// createTransportAltSvc tries to create an HTTP/3 transport for the alternative
+// service of this upstream listening on port.  Unlike
+// [dnsOverHTTPS.createTransportH3], it doesn't race QUIC against TLS, since the
+// server has advertised HTTP/3, but only checks that QUIC isn't blocked.
+func (p *dnsOverHTTPS) createTransportAltSvc(
+	tlsConfig *tls.Config,
+	dialContext bootstrap.DialHandler,
+	port uint16,
+) (roundTripper http.RoundTripper, err error) {
+	addr, err := resolveUDPAddr(dialContext, p.addrRedacted)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	addr = net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+
+	probeTLSCfg := probeTLSConfig(tlsConfig)
+	probeTLSCfg.NextProtos = []string{string(HTTPVersion3)}
+
+	ch := make(chan error, 1)
+	p.probeQUIC(addr, probeTLSCfg, ch)
+	err = <-ch
+	if err != nil {
+		return nil, err
+	}
+
+	return p.newTransportH3(addr, tlsConfig), nil
+}
+
+// newTransportH3 returns an HTTP/3 transport which connects to addr.  The
+// connections are resumed with 0-RTT whenever the server allows it.
+func (p *dnsOverHTTPS) newTransportH3(addr string, tlsConfig *tls.Config) (rt *http3Transport) {
+	baseTransport := &http3.RoundTripper{
 		Dial: func(
 			ctx context.Context,
 
@@ -558,7 +691,7 @@ func (p *dnsOverHTTPS) createTransportH3(
 		QUICConfig:         p.getQUICConfig(),
 	}
 
-	return &http3Transport{baseTransport: rt}, nil
+	return &http3Transport{baseTransport: baseTransport}
 }
 
 // probeH3 runs a test to check whether QUIC is faster than TLS for this
@@ -568,40 +701,17 @@ func (p *dnsOverHTTPS) probeH3(
 	tlsConfig *tls.Config,
 	dialContext bootstrap.DialHandler,
 ) (addr string, err error) {
-	// We're using bootstrapped address instead of what's passed to the function
-	// it does not create an actual connection, but it helps us determine
-	// what IP is actually reachable (when there are v4/v6 addresses).
-	rawConn, err := dialContext(context.Background(), "udp", "")
+	addr, err = resolveUDPAddr(dialContext, p.addrRedacted)
 	if err != nil {
-		return "", fmt.Errorf("failed to dial: %w", err)
+		return "", err
 	}
-	// It's never actually used.
-	_ = rawConn.Close()
-
-	udpConn, ok := rawConn.(*net.UDPConn)
-	if !ok {
-		return "", fmt.Errorf("not a UDP connection to %s", p.addrRedacted)
-	}
-
-	addr = udpConn.RemoteAddr().String()
 
 	// Avoid spending time on probing if this upstream only supports HTTP/3.
 	if p.supportsH3() && !p.supportsHTTP() {
 		return addr, nil
 	}
 
-	// Use a new *tls.Config with empty session cache for probe connections.
-	// Surprisingly, this is really important since otherwise it invalidates
-	// the existing cache.
-	// TODO(ameshkov): figure out why the sessions cache invalidates here.
-	probeTLSCfg := tlsConfig.Clone()
-	probeTLSCfg.ClientSessionCache = nil
-
-	// Do not expose probe connections to the callbacks that are passed to
-	// the bootstrap options to avoid side-effects.
-	// TODO(ameshkov): consider exposing, somehow mark that this is a probe.
-	probeTLSCfg.VerifyPeerCertificate = nil
-	probeTLSCfg.VerifyConnection = nil
+	probeTLSCfg := probeTLSConfig(tlsConfig)
 
 	// Run probeQUIC and probeTLS in parallel and see which one is faster.
 	chQUIC := make(chan error, 1)
@@ -629,6 +739,46 @@ func (p *dnsOverHTTPS) probeH3(
 	}
 }
 
+// resolveUDPAddr returns the bootstrapped address of the upstream, which
+// redacted address is addrRedacted, to establish the QUIC connections to.
+func resolveUDPAddr(dialContext bootstrap.DialHandler, addrRedacted string) (addr string, err error) {
+	// We're using bootstrapped address instead of what's passed to the function
+	// it does not create an actual connection, but it helps us determine
+	// what IP is actually reachable (when there are v4/v6 addresses).
+	rawConn, err := dialContext(context.Background(), "udp", "")
+	if err != nil {
+		return "", fmt.Errorf("failed to dial: %w", err)
+	}
+	// It's never actually used.
+	_ = rawConn.Close()
+
+	udpConn, ok := rawConn.(*net.UDPConn)
+	if !ok {
+		return "", fmt.Errorf("not a UDP connection to %s", addrRedacted)
+	}
+
+	return udpConn.RemoteAddr().String(), nil
+}
+
+// probeTLSConfig returns a copy of tlsConfig to be used for the probe
+// connections.
+func probeTLSConfig(tlsConfig *tls.Config) (probeTLSCfg *tls.Config) {
+	// Use a new *tls.Config with empty session cache for probe connections.
+	// Surprisingly, this is really important since otherwise it invalidates
+	// the existing cache.
+	// TODO(ameshkov): figure out why the sessions cache invalidates here.
+	probeTLSCfg = tlsConfig.Clone()
+	probeTLSCfg.ClientSessionCache = nil
+
+	// Do not expose probe connections to the callbacks that are passed to
+	// the bootstrap options to avoid side-effects.
+	// TODO(ameshkov): consider exposing, somehow mark that this is a probe.
+	probeTLSCfg.VerifyPeerCertificate = nil
+	probeTLSCfg.VerifyConnection = nil
+
+	return probeTLSCfg
+}
+
 // probeQUIC attempts to establish a QUIC connection to the specified address.
 // We run probeQUIC and probeTLS in parallel and see which one is faster.
 func (p *dnsOverHTTPS) probeQUIC(addr string, tlsConfig *tls.Config, ch chan error) {
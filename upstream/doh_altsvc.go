@@ -0,0 +1,88 @@
+package upstream
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// altSvcDefaultMaxAge is the freshness lifetime of an alternative service
+	// advertised without the "ma" parameter, see RFC 7838 Section 3.1.
+	altSvcDefaultMaxAge = 24 * time.Hour
+
+	// altSvcBrokenTimeout is the time during which the HTTP/3 alternative
+	// service of a DNS-over-HTTPS upstream isn't used after connecting to it
+	// failed, e.g. since QUIC is blocked on the network.
+	altSvcBrokenTimeout = 5 * time.Minute
+)
+
+// altSvcH3 is the HTTP/3 alternative service of a DNS-over-HTTPS upstream
+// advertised in the Alt-Svc header of its HTTP/1.1 and HTTP/2 responses.
+//
+// See RFC 7838 and RFC 9114 Section 3.1.1.
+type altSvcH3 struct {
+	// expire is the time after which the alternative service is no longer
+	// used.
+	expire time.Time
+
+	// port is the UDP port of the alternative service.
+	port uint16
+}
+
+// parseAltSvcH3 returns the first HTTP/3 alternative service found in val,
+// which is the value of the Alt-Svc header received from host at now.  Only
+// the alternative services of the same host are considered, since the
+// certificate of another one can't be verified against the upstream's address.
+// svc is nil if there is none.  cleared is true if val invalidates all the
+// previously advertised alternative services.
+func parseAltSvcH3(val, host string, now time.Time) (svc *altSvcH3, cleared bool) {
+	val = strings.TrimSpace(val)
+	if val == "clear" {
+		return nil, true
+	}
+
+	for _, alt := range strings.Split(val, ",") {
+		params := strings.Split(alt, ";")
+		proto, authority, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !ok || proto != string(HTTPVersion3) {
+			continue
+		}
+
+		altHost, portStr, err := net.SplitHostPort(strings.Trim(authority, `"`))
+		if err != nil || (altHost != "" && !strings.EqualFold(altHost, host)) {
+			continue
+		}
+
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			continue
+		}
+
+		return &altSvcH3{
+			expire: now.Add(altSvcMaxAge(params[1:])),
+			port:   uint16(port),
+		}, false
+	}
+
+	return nil, false
+}
+
+// altSvcMaxAge returns the freshness lifetime of an alternative service from
+// its params.
+func altSvcMaxAge(params []string) (ma time.Duration) {
+	for _, p := range params {
+		key, val, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || key != "ma" {
+			continue
+		}
+
+		sec, err := strconv.ParseUint(strings.Trim(val, `"`), 10, 32)
+		if err == nil {
+			return time.Duration(sec) * time.Second
+		}
+	}
+
+	return altSvcDefaultMaxAge
+}
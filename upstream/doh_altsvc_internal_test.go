@@ -0,0 +1,64 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAltSvcH3(t *testing.T) {
+	const host = "dns.example"
+
+	now := time.Now()
+
+	testCases := []struct {
+		want        *altSvcH3
+		name        string
+		val         string
+		wantCleared bool
+	}{{
+		want:        nil,
+		name:        "empty",
+		val:         "",
+		wantCleared: false,
+	}, {
+		want:        nil,
+		name:        "clear",
+		val:         "clear",
+		wantCleared: true,
+	}, {
+		want:        &altSvcH3{expire: now.Add(altSvcDefaultMaxAge), port: 443},
+		name:        "same_host",
+		val:         `h3=":443"`,
+		wantCleared: false,
+	}, {
+		want:        &altSvcH3{expire: now.Add(time.Hour), port: 8443},
+		name:        "max_age",
+		val:         `h2=":443", h3="dns.example:8443"; ma=3600; persist=1`,
+		wantCleared: false,
+	}, {
+		want:        nil,
+		name:        "other_host",
+		val:         `h3="other.example:443"`,
+		wantCleared: false,
+	}, {
+		want:        nil,
+		name:        "draft_version",
+		val:         `h3-29=":443"`,
+		wantCleared: false,
+	}, {
+		want:        nil,
+		name:        "bad_port",
+		val:         `h3=":0", h3=":http"`,
+		wantCleared: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, cleared := parseAltSvcH3(tc.val, host, now)
+			assert.Equal(t, tc.want, svc)
+			assert.Equal(t, tc.wantCleared, cleared)
+		})
+	}
+}
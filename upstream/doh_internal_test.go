@@ -18,6 +18,7 @@ import (
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -311,6 +312,62 @@ func TestUpstreamDoH_0RTT(t *testing.T) {
 	require.True(t, conns[1].is0RTT())
 }
 
+func TestUpstreamDoH_altSvc(t *testing.T) {
+	// altSvcHandler advertises HTTP/3 on the same port in the responses sent
+	// over the other versions.
+	dohHandler := createDoHHandler()
+	altSvcHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			_, port, _ := net.SplitHostPort(r.Host)
+			w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%s"; ma=60`, port))
+		}
+
+		dohHandler.ServeHTTP(w, r)
+	})
+
+	testCases := []struct {
+		name         string
+		http3Enabled bool
+		wantH3       bool
+	}{{
+		name:         "switch_to_http3",
+		http3Enabled: true,
+		wantH3:       true,
+	}, {
+		name:         "quic_blocked",
+		http3Enabled: false,
+		wantH3:       false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := startDoHServer(t, testDoHServerOptions{
+				http3Enabled: tc.http3Enabled,
+				handler:      altSvcHandler,
+			})
+
+			address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+			u, err := AddressToUpstream(address, &Options{
+				InsecureSkipVerify: true,
+				HTTP3AltSvc:        true,
+				Timeout:            time.Second,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			doh := u.(*dnsOverHTTPS)
+
+			checkUpstream(t, u, address)
+			require.NotNil(t, doh.altSvc)
+
+			checkUpstream(t, u, address)
+			require.NotNil(t, doh.client)
+			assert.Equal(t, tc.wantH3, isHTTP3(doh.client))
+			assert.Equal(t, !tc.wantH3, doh.altSvcBroken.After(time.Now()))
+		})
+	}
+}
+
 // testDoHServerOptions allows customizing testDoHServer behavior.
 type testDoHServerOptions struct {
 	// handler is an HTTP handler that should be used by the server.  The
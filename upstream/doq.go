@@ -48,8 +48,21 @@ const (
 
 // compatProtoDQ is a list of ALPN tokens used by a QUIC connection.
 // NextProtoDQ is the latest draft version supported by dnsproxy, but it also
-// includes previous drafts.
-var compatProtoDQ = []string{NextProtoDQ, "doq-i00", "dq", "doq-i02"}
+// includes previous drafts.  The tokens are sorted from the newest version to
+// the oldest one.
+var compatProtoDQ = []string{NextProtoDQ, "doq-i11", "doq-i02", "doq-i00", "dq"}
+
+// isUnprefixedProtoDQ returns true if the DoQ version with the ALPN token proto
+// sends the DNS messages without the 2-octet length prefix.  The prefix has
+// been introduced in the draft version 03.
+func isUnprefixedProtoDQ(proto string) (ok bool) {
+	switch proto {
+	case "doq-i02", "doq-i00", "dq":
+		return true
+	default:
+		return false
+	}
+}
 
 // dnsOverQUIC implements the [Upstream] interface for the DNS-over-QUIC
 // protocol (spec: https://www.rfc-editor.org/rfc/rfc9250.html).
@@ -89,6 +102,10 @@ type dnsOverQUIC struct {
 
 	// timeout is the timeout for the upstream connection.
 	timeout time.Duration
+
+	// disable0RTT makes the connections wait for the handshake to complete
+	// before sending the queries.
+	disable0RTT bool
 }
 
 // newDoQ returns the DNS-over-QUIC Upstream.
@@ -104,13 +121,10 @@ func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
 			Tracer:          opts.QUICTracer,
 		},
 		tlsConf: &tls.Config{
-			ServerName:   addr.Hostname(),
-			RootCAs:      opts.RootCAs,
-			CipherSuites: opts.CipherSuites,
-			// Use the default capacity for the LRU cache.  It may be useful to
-			// store several caches since the user may be routed to different
-			// servers in case there's load balancing on the server-side.
-			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+			ServerName:         addr.Hostname(),
+			RootCAs:            opts.RootCAs,
+			CipherSuites:       opts.CipherSuites,
+			ClientSessionCache: opts.TLSSessionCache.forProto("quic"),
 			MinVersion:         tls.VersionTLS12,
 			// #nosec G402 -- TLS certificate verification could be disabled by
 			// configuration.
@@ -123,6 +137,7 @@ func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
 		connMu:       &sync.Mutex{},
 		bytesPoolMu:  &sync.Mutex{},
 		timeout:      opts.Timeout,
+		disable0RTT:  opts.DisableDoQ0RTT,
 	}
 
 	runtime.SetFinalizer(u, (*dnsOverQUIC).Close)
@@ -158,6 +173,14 @@ func (p *dnsOverQUIC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 
 	// Make the first attempt to send the DNS query.
 	resp, err = p.exchangeQUIC(m, conn)
+	if early, ok := conn.(quic.EarlyConnection); ok && errors.Is(err, quic.Err0RTTRejected) {
+		// The server has rejected the query sent in the 0-RTT data, so send
+		// it again once the handshake is complete instead of reconnecting.
+		log.Debug("dnsproxy: 0-rtt rejected by %s; retrying after handshake", p.addr)
+
+		conn = early.NextConnection()
+		resp, err = p.exchangeQUIC(m, conn)
+	}
 
 	// Failure to use a cached connection should be handled gracefully as this
 	// connection could have been closed by the server or simply be broken due
@@ -228,7 +251,12 @@ func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn quic.Connection) (resp *dn
 		}
 	}
 
-	_, err = stream.Write(proxyutil.AddPrefix(buf))
+	unprefixed := isUnprefixedProtoDQ(conn.ConnectionState().TLS.NegotiatedProtocol)
+	if !unprefixed {
+		buf = proxyutil.AddPrefix(buf)
+	}
+
+	_, err = stream.Write(buf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to write to a QUIC stream: %w", err)
 	}
@@ -242,7 +270,7 @@ func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn quic.Connection) (resp *dn
 		log.Debug("dnsproxy: closing quic stream: %s", err)
 	}
 
-	return p.readMsg(stream)
+	return p.readMsg(stream, unprefixed)
 }
 
 // getBytesPool returns (creates if needed) a pool we store byte buffers in.
@@ -347,7 +375,15 @@ func (p *dnsOverQUIC) openConnection() (conn quic.Connection, err error) {
 	ctx, cancel := p.withDeadline(context.Background())
 	defer cancel()
 
-	conn, err = quic.DialAddrEarly(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+	// The TLS sessions are resumed either way, but without 0-RTT the queries
+	// aren't sent until the handshake is complete, so that those can't be
+	// replayed.
+	if p.disable0RTT {
+		conn, err = quic.DialAddr(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+	} else {
+		conn, err = quic.DialAddrEarly(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+	}
+
 	if err != nil {
 		return nil, fmt.Errorf("dialing quic connection to %s: %w", p.addr, err)
 	}
@@ -383,8 +419,9 @@ func (p *dnsOverQUIC) closeConnWithError(conn quic.Connection, err error) {
 	}
 }
 
-// readMsg reads the incoming DNS message from the QUIC stream.
-func (p *dnsOverQUIC) readMsg(stream quic.Stream) (m *dns.Msg, err error) {
+// readMsg reads the incoming DNS message from the QUIC stream.  unprefixed is
+// true if the message isn't prefixed with its length, as in the old drafts.
+func (p *dnsOverQUIC) readMsg(stream quic.Stream, unprefixed bool) (m *dns.Msg, err error) {
 	pool := p.getBytesPool()
 	bufPtr := pool.Get().(*[]byte)
 
@@ -403,8 +440,13 @@ func (p *dnsOverQUIC) readMsg(stream quic.Stream) (m *dns.Msg, err error) {
 	// specified in [RFC1035].
 	// IMPORTANT: Note, that we ignore this prefix here as this implementation
 	// does not support receiving multiple messages over a single connection.
+	msgBuf := respBuf[2:]
+	if unprefixed {
+		msgBuf = respBuf[:n]
+	}
+
 	m = new(dns.Msg)
-	err = m.Unpack(respBuf[2:])
+	err = m.Unpack(msgBuf)
 	if err != nil {
 		return nil, fmt.Errorf("unpacking response from %s: %w", p.addr, err)
 	}
@@ -76,6 +76,34 @@ func TestUpstreamDoQ(t *testing.T) {
 	checkRaceCondition(u)
 }
 
+func TestUpstreamDoQ_drafts(t *testing.T) {
+	for _, proto := range compatProtoDQ {
+		t.Run(proto, func(t *testing.T) {
+			tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+			tlsConf.NextProtos = []string{"doq-i12", proto}
+
+			srv := startDoQServer(t, tlsConf, 0)
+
+			address := fmt.Sprintf("quic://%s", srv.addr)
+			var lastState tls.ConnectionState
+			u, err := AddressToUpstream(address, &Options{
+				VerifyConnection: func(state tls.ConnectionState) error {
+					lastState = state
+
+					return nil
+				},
+				RootCAs: rootCAs,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			checkUpstream(t, u, address)
+
+			assert.Equal(t, proto, lastState.NegotiatedProtocol)
+		})
+	}
+}
+
 func TestUpstream_Exchange_quicServerCloseConn(t *testing.T) {
 	// Use the same tlsConf for all servers to preserve the data necessary for
 	// 0-RTT connections.
@@ -174,48 +202,65 @@ func TestUpstreamDoQ_0RTT(t *testing.T) {
 
 	srv := startDoQServer(t, tlsConf, 0)
 
-	tracer := &quicTracer{}
-	address := fmt.Sprintf("quic://%s", srv.addr)
-	u, err := AddressToUpstream(address, &Options{
-		QUICTracer: tracer.TracerForConnection,
-		RootCAs:    rootCAs,
-	})
-	require.NoError(t, err)
-	testutil.CleanupAndRequireSuccess(t, u.Close)
+	testCases := []struct {
+		name        string
+		disable0RTT bool
+	}{{
+		name:        "enabled",
+		disable0RTT: false,
+	}, {
+		name:        "disabled",
+		disable0RTT: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tracer := &quicTracer{}
+			address := fmt.Sprintf("quic://%s", srv.addr)
+			u, err := AddressToUpstream(address, &Options{
+				QUICTracer:     tracer.TracerForConnection,
+				RootCAs:        rootCAs,
+				DisableDoQ0RTT: tc.disable0RTT,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			uq := u.(*dnsOverQUIC)
+			req := createTestMessage()
 
-	uq := u.(*dnsOverQUIC)
-	req := createTestMessage()
+			// Trigger connection to a QUIC server.
+			resp, err := uq.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
 
-	// Trigger connection to a QUIC server.
-	resp, err := uq.Exchange(req)
-	require.NoError(t, err)
-	requireResponse(t, req, resp)
+			// Close the active connection to make sure we'll reconnect.
+			func() {
+				uq.connMu.Lock()
+				defer uq.connMu.Unlock()
 
-	// Close the active connection to make sure we'll reconnect.
-	func() {
-		uq.connMu.Lock()
-		defer uq.connMu.Unlock()
+				err = uq.conn.CloseWithError(QUICCodeNoError, "")
+				require.NoError(t, err)
 
-		err = uq.conn.CloseWithError(QUICCodeNoError, "")
-		require.NoError(t, err)
-
-		uq.conn = nil
-	}()
+				uq.conn = nil
+			}()
 
-	// Trigger second connection.
-	resp, err = uq.Exchange(req)
-	require.NoError(t, err)
-	requireResponse(t, req, resp)
+			// Trigger second connection.
+			resp, err = uq.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
 
-	// Check traced connections info.
-	conns := tracer.getConnectionsInfo()
-	require.Len(t, conns, 2)
+			// Check traced connections info.
+			conns := tracer.getConnectionsInfo()
+			require.Len(t, conns, 2)
 
-	// Examine the first connection (no 0-RTT there).
-	require.False(t, conns[0].is0RTT())
+			// Examine the first connection (no 0-RTT there).
+			require.False(t, conns[0].is0RTT())
 
-	// Examine the second connection (the one that used 0-RTT).
-	require.True(t, conns[1].is0RTT())
+			// Examine the second connection, which uses 0-RTT unless it's
+			// disabled.
+			require.Equal(t, !tc.disable0RTT, conns[1].is0RTT())
+		})
+	}
 }
 
 // testDoHServer is an instance of a test DNS-over-QUIC server.
@@ -277,7 +322,8 @@ func (s *testDoQServer) handleQUICConnection(conn quic.EarlyConnection) {
 		}
 
 		go func() {
-			qErr := s.handleQUICStream(stream)
+			unprefixed := isUnprefixedProtoDQ(conn.ConnectionState().TLS.NegotiatedProtocol)
+			qErr := s.handleQUICStream(stream, unprefixed)
 			if qErr != nil {
 				log.Error("test doq: handling from %s: %s", conn.RemoteAddr(), qErr)
 
@@ -288,12 +334,12 @@ func (s *testDoQServer) handleQUICConnection(conn quic.EarlyConnection) {
 }
 
 // handleQUICStream handles new QUIC streams, reads DNS messages and responds to
-// them.
-func (s *testDoQServer) handleQUICStream(stream quic.Stream) (err error) {
+// them.  unprefixed is true if the messages aren't prefixed with their length.
+func (s *testDoQServer) handleQUICStream(stream quic.Stream, unprefixed bool) (err error) {
 	defer log.OnCloserError(stream, log.DEBUG)
 
 	buf := make([]byte, dns.MaxMsgSize+2)
-	_, err = stream.Read(buf)
+	n, err := stream.Read(buf)
 	if err != nil && err != io.EOF {
 		return err
 	}
@@ -301,8 +347,13 @@ func (s *testDoQServer) handleQUICStream(stream quic.Stream) (err error) {
 	stream.CancelRead(0)
 
 	req := &dns.Msg{}
-	packetLen := binary.BigEndian.Uint16(buf[:2])
-	err = req.Unpack(buf[2 : packetLen+2])
+	if unprefixed {
+		err = req.Unpack(buf[:n])
+	} else {
+		packetLen := binary.BigEndian.Uint16(buf[:2])
+		err = req.Unpack(buf[2 : packetLen+2])
+	}
+
 	if err != nil {
 		return err
 	}
@@ -314,7 +365,10 @@ func (s *testDoQServer) handleQUICStream(stream quic.Stream) (err error) {
 		return err
 	}
 
-	buf = proxyutil.AddPrefix(buf)
+	if !unprefixed {
+		buf = proxyutil.AddPrefix(buf)
+	}
+
 	_, err = stream.Write(buf)
 
 	return err
@@ -362,9 +416,11 @@ func (s *testDoQServer) closeConns() (err error) {
 
 // startDoQServer starts a test DoQ server.
 // startDoQServer starts a test DoQ server.  Note that it adds its own shutdown
-// to cleanup of t.
+// to cleanup of t.  If tlsConf has no ALPN tokens, only [NextProtoDQ] is used.
 func startDoQServer(t *testing.T, tlsConf *tls.Config, port int) (s *testDoQServer) {
-	tlsConf.NextProtos = []string{NextProtoDQ}
+	if len(tlsConf.NextProtos) == 0 {
+		tlsConf.NextProtos = []string{NextProtoDQ}
+	}
 
 	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", port))
 	require.NoError(t, err)
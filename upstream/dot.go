@@ -45,6 +45,10 @@ type dnsOverTLS struct {
 	// This leads to weak performance for all exchanges coming across such
 	// connections.
 	conns []net.Conn
+
+	// maxIdleConns is the maximum number of connections in conns.  Zero means
+	// no limit.
+	maxIdleConns int
 }
 
 // newDoT returns the DNS-over-TLS Upstream.
@@ -55,13 +59,10 @@ func newDoT(addr *url.URL, opts *Options) (ups Upstream, err error) {
 		addr:      addr,
 		getDialer: newDialerInitializer(addr, opts),
 		tlsConf: &tls.Config{
-			ServerName:   addr.Hostname(),
-			RootCAs:      opts.RootCAs,
-			CipherSuites: opts.CipherSuites,
-			// Use the default capacity for the LRU cache.  It may be useful to
-			// store several caches since the user may be routed to different
-			// servers in case there's load balancing on the server-side.
-			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+			ServerName:         addr.Hostname(),
+			RootCAs:            opts.RootCAs,
+			CipherSuites:       opts.CipherSuites,
+			ClientSessionCache: opts.TLSSessionCache.forProto("tls"),
 			MinVersion:         tls.VersionTLS12,
 			// #nosec G402 -- TLS certificate verification could be disabled by
 			// configuration.
@@ -69,7 +70,8 @@ func newDoT(addr *url.URL, opts *Options) (ups Upstream, err error) {
 			VerifyPeerCertificate: opts.VerifyServerCertificate,
 			VerifyConnection:      opts.VerifyConnection,
 		},
-		connsMu: &sync.Mutex{},
+		connsMu:      &sync.Mutex{},
+		maxIdleConns: opts.MaxIdleConns,
 	}
 
 	runtime.SetFinalizer(tlsUps, (*dnsOverTLS).Close)
@@ -179,10 +181,21 @@ func (p *dnsOverTLS) conn(h bootstrap.DialHandler) (conn net.Conn, err error) {
 	return conn, nil
 }
 
+// putBack returns conn to the pool for reuse, or closes it if the pool is
+// full.
 func (p *dnsOverTLS) putBack(conn net.Conn) {
 	p.connsMu.Lock()
 	defer p.connsMu.Unlock()
 
+	if p.maxIdleConns > 0 && len(p.conns) >= p.maxIdleConns {
+		err := conn.Close()
+		if err != nil {
+			log.Debug("dot upstream: closing excess conn: %s", err)
+		}
+
+		return
+	}
+
 	p.conns = append(p.conns, conn)
 }
 
@@ -296,3 +296,22 @@ func BenchmarkDoTUpstream(b *testing.B) {
 		})
 	})
 }
+
+func TestDNSOverTLS_putBack_maxIdleConns(t *testing.T) {
+	p := &dnsOverTLS{
+		connsMu:      &sync.Mutex{},
+		maxIdleConns: 1,
+	}
+
+	kept, _ := net.Pipe()
+	excess, peer := net.Pipe()
+
+	p.putBack(kept)
+	p.putBack(excess)
+
+	require.Len(t, p.conns, 1)
+	assert.Same(t, kept, p.conns[0])
+
+	_, err := peer.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,104 @@
+package upstream
+
+import (
+	"net/netip"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// staticECSUpstream is an [Upstream] sending the queries with a static EDNS
+// Client Subnet instead of the one of the client, see RFC 7871.
+type staticECSUpstream struct {
+	// Upstream is the underlying upstream.
+	Upstream
+
+	// subnet is the subnet sent in the queries.  It's masked.
+	subnet netip.Prefix
+}
+
+// newStaticECSUpstream returns a new upstream sending subnet to u.  subnet must
+// be valid.
+func newStaticECSUpstream(u Upstream, subnet netip.Prefix) (su *staticECSUpstream) {
+	return &staticECSUpstream{
+		Upstream: u,
+		subnet:   subnet.Masked(),
+	}
+}
+
+// type check
+var _ Upstream = (*staticECSUpstream)(nil)
+
+// Exchange implements the [Upstream] interface for *staticECSUpstream.  req
+// isn't modified.  The option of resp is replaced with the one of req, if any,
+// with zero scope, since the response doesn't depend on the subnet of the
+// client and is valid for any of them.
+func (u *staticECSUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	reqECS := ecsOption(req)
+
+	resp, err = u.Upstream.Exchange(u.withStaticECS(req))
+	if resp == nil {
+		return resp, err
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return resp, err
+	}
+
+	opt.Option = slices.DeleteFunc(opt.Option, isECSOption)
+	if reqECS != nil {
+		ecs := *reqECS
+		ecs.SourceScope = 0
+		opt.Option = append(opt.Option, &ecs)
+	}
+
+	return resp, err
+}
+
+// withStaticECS returns a copy of req with the EDNS Client Subnet option set to
+// u.subnet.  The OPT record is added if req has none.
+func (u *staticECSUpstream) withStaticECS(req *dns.Msg) (sent *dns.Msg) {
+	sent = req.Copy()
+
+	opt := sent.IsEdns0()
+	if opt == nil {
+		sent.SetEdns0(dns.DefaultMsgSize, false)
+		opt = sent.IsEdns0()
+	}
+
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(u.subnet.Bits()),
+		Address:       u.subnet.Addr().AsSlice(),
+	}
+	if u.subnet.Addr().Is6() {
+		ecs.Family = 2
+	}
+
+	opt.Option = append(slices.DeleteFunc(opt.Option, isECSOption), ecs)
+
+	return sent
+}
+
+// ecsOption returns the EDNS Client Subnet option of m, if any.
+func ecsOption(m *dns.Msg) (ecs *dns.EDNS0_SUBNET) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+
+	return nil
+}
+
+// isECSOption returns true if o is an EDNS Client Subnet option.
+func isECSOption(o dns.EDNS0) (ok bool) {
+	return o.Option() == dns.EDNS0SUBNET
+}
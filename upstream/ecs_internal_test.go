@@ -0,0 +1,76 @@
+package upstream
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticECSUpstream_Exchange(t *testing.T) {
+	var sent *dns.EDNS0_SUBNET
+	ups := &recordingUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			sent = ecsOption(req)
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.SetEdns0(dns.DefaultMsgSize, false)
+			if sent != nil {
+				ecs := *sent
+				ecs.SourceScope = sent.SourceNetmask
+				resp.IsEdns0().Option = append(resp.IsEdns0().Option, &ecs)
+			}
+
+			return resp, nil
+		},
+	}
+
+	u := newStaticECSUpstream(ups, netip.MustParsePrefix("198.51.100.42/24"))
+
+	t.Run("no_ecs", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+
+		require.NotNil(t, sent)
+		assert.Equal(t, uint16(1), sent.Family)
+		assert.Equal(t, uint8(24), sent.SourceNetmask)
+		assert.Equal(t, net.IP{198, 51, 100, 0}, sent.Address)
+
+		// The original request isn't modified.
+		assert.Nil(t, req.IsEdns0())
+		assert.Nil(t, ecsOption(resp))
+	})
+
+	t.Run("client_ecs", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        2,
+			SourceNetmask: 56,
+			Address:       net.ParseIP("2001:db8::"),
+		})
+
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+
+		require.NotNil(t, sent)
+		assert.Equal(t, uint8(24), sent.SourceNetmask)
+		assert.Equal(t, net.IP{198, 51, 100, 0}, sent.Address)
+
+		// The response carries the subnet of the client with zero scope.
+		got := ecsOption(resp)
+		require.NotNil(t, got)
+
+		assert.Equal(t, uint8(56), got.SourceNetmask)
+		assert.Equal(t, uint8(0), got.SourceScope)
+		assert.Equal(t, net.ParseIP("2001:db8::"), got.Address)
+
+		assert.Equal(t, uint8(56), ecsOption(req).SourceNetmask)
+	})
+}
@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// ednsRecheckIvl is the time after which the queries with EDNS are sent again to
+// an upstream that has previously failed to process them, in case it has been
+// upgraded since.
+const ednsRecheckIvl = 1 * time.Hour
+
+// ednsFallbackUpstream is an [Upstream] that retries the queries without EDNS
+// when the underlying upstream doesn't support it, and then sends the queries
+// without EDNS to it for a while, see RFC 6891 Section 7.
+type ednsFallbackUpstream struct {
+	// Upstream is the underlying upstream.
+	Upstream
+
+	// noEDNSUntil is the Unix time in nanoseconds until which the queries are
+	// sent without EDNS.  It's zero if the upstream is considered supporting
+	// EDNS.
+	noEDNSUntil *atomic.Int64
+
+	// now returns the current time.
+	now func() (t time.Time)
+}
+
+// newEDNSFallbackUpstream returns a new upstream falling back to the queries
+// without EDNS for u.
+func newEDNSFallbackUpstream(u Upstream) (fu *ednsFallbackUpstream) {
+	return &ednsFallbackUpstream{
+		Upstream:    u,
+		noEDNSUntil: &atomic.Int64{},
+		now:         time.Now,
+	}
+}
+
+// type check
+var _ Upstream = (*ednsFallbackUpstream)(nil)
+
+// Exchange implements the [Upstream] interface for *ednsFallbackUpstream.  req
+// isn't modified.
+func (u *ednsFallbackUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if req.IsEdns0() == nil {
+		return u.Upstream.Exchange(req)
+	}
+
+	now := u.now()
+	if now.UnixNano() < u.noEDNSUntil.Load() {
+		return u.Upstream.Exchange(withoutEDNS(req))
+	}
+
+	resp, err = u.Upstream.Exchange(req)
+	if err != nil || !isEDNSUnsupported(resp) {
+		return resp, err
+	}
+
+	log.Debug("upstream %s: edns not supported; retrying without it", u.Address())
+
+	noEDNSResp, noEDNSErr := u.Upstream.Exchange(withoutEDNS(req))
+	if noEDNSErr != nil || isEDNSUnsupported(noEDNSResp) {
+		// The failure isn't caused by EDNS, so return the original response.
+		return resp, err
+	}
+
+	u.noEDNSUntil.Store(now.Add(ednsRecheckIvl).UnixNano())
+
+	return noEDNSResp, nil
+}
+
+// isEDNSUnsupported returns true if resp means that the upstream has failed to
+// process the query with EDNS.  Such upstreams respond with FORMERR or NOTIMP
+// without the OPT record, since those don't know it.
+func isEDNSUnsupported(resp *dns.Msg) (ok bool) {
+	if resp == nil || resp.IsEdns0() != nil {
+		return false
+	}
+
+	return resp.Rcode == dns.RcodeFormatError || resp.Rcode == dns.RcodeNotImplemented
+}
+
+// withoutEDNS returns a shallow copy of req without the OPT record.
+func withoutEDNS(req *dns.Msg) (noEDNS *dns.Msg) {
+	noEDNS = &dns.Msg{}
+	*noEDNS = *req
+	noEDNS.Extra = slices.DeleteFunc(slices.Clone(req.Extra), func(rr dns.RR) (del bool) {
+		return rr.Header().Rrtype == dns.TypeOPT
+	})
+
+	return noEDNS
+}
@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEDNSFallbackUpstream_Exchange(t *testing.T) {
+	var withEDNS, withoutEDNS int
+	rcode := dns.RcodeFormatError
+	ups := &recordingUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			if req.IsEdns0() == nil {
+				withoutEDNS++
+
+				return resp, nil
+			}
+
+			withEDNS++
+
+			return resp.SetRcode(req, rcode), nil
+		},
+	}
+
+	now := time.Now()
+	u := newEDNSFallbackUpstream(ups)
+	u.now = func() (t time.Time) { return now }
+
+	newReq := func() (req *dns.Msg) {
+		return (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA).SetEdns0(1232, true)
+	}
+
+	req := newReq()
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 1, withEDNS)
+	assert.Equal(t, 1, withoutEDNS)
+
+	// The original request isn't modified.
+	assert.NotNil(t, req.IsEdns0())
+
+	// The upstream is remembered as not supporting EDNS.
+	_, err = u.Exchange(newReq())
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, withEDNS)
+	assert.Equal(t, 2, withoutEDNS)
+
+	// It's checked again after a while.
+	now = now.Add(ednsRecheckIvl)
+	rcode = dns.RcodeSuccess
+
+	_, err = u.Exchange(newReq())
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, withEDNS)
+	assert.Equal(t, 2, withoutEDNS)
+
+	t.Run("opt_in_response", func(t *testing.T) {
+		fu := newEDNSFallbackUpstream(&recordingUpstream{
+			onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				require.NotNil(t, req.IsEdns0())
+
+				resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNotImplemented)
+
+				return resp.SetEdns0(1232, false), nil
+			},
+		})
+
+		resp, err = fu.Exchange(newReq())
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeNotImplemented, resp.Rcode)
+	})
+
+	t.Run("no_edns", func(t *testing.T) {
+		fu := newEDNSFallbackUpstream(&recordingUpstream{
+			onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				return (&dns.Msg{}).SetRcode(req, dns.RcodeFormatError), nil
+			},
+		})
+
+		resp, err = fu.Exchange(newReq())
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeFormatError, resp.Rcode)
+		assert.Zero(t, fu.noEDNSUntil.Load())
+	})
+}
@@ -0,0 +1,70 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bruceluk/dnsproxy/internal/bootstrap"
+	proxynetutil "github.com/bruceluk/dnsproxy/internal/netutil"
+)
+
+// FastOpen enables TCP Fast Open for the TCP connections to the upstreams,
+// where the platform supports it, and counts the connections, which data
+// within the SYN has been accepted by the server.  It's safe for concurrent
+// use.
+type FastOpen struct {
+	// hits is the number of the connections with the data within the SYN
+	// accepted.
+	hits atomic.Uint64
+}
+
+// NewFastOpen returns a new properly initialized *FastOpen.
+func NewFastOpen() (f *FastOpen) {
+	return &FastOpen{}
+}
+
+// Hits returns the number of the connections, which data within the SYN has
+// been accepted by the server.
+func (f *FastOpen) Hits() (n uint64) {
+	return f.hits.Load()
+}
+
+// wrapDial returns the handler dialing with dial and counting the TCP
+// connections with the data within the SYN accepted.
+func (f *FastOpen) wrapDial(dial bootstrap.DialHandler) (wrapped bootstrap.DialHandler) {
+	return func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+		conn, err = dial(ctx, network, addr)
+		if err != nil || !strings.HasPrefix(network, networkTCP) {
+			return conn, err
+		}
+
+		return &fastOpenConn{Conn: conn, fastOpen: f}, nil
+	}
+}
+
+// fastOpenConn is a TCP connection, which checks if its data within the SYN
+// has been accepted once the first response is received.
+type fastOpenConn struct {
+	net.Conn
+
+	// fastOpen counts the connections with the data within the SYN accepted.
+	fastOpen *FastOpen
+
+	// checked is true if the connection has already been checked.
+	checked atomic.Bool
+}
+
+// type check
+var _ net.Conn = (*fastOpenConn)(nil)
+
+// Read implements the [net.Conn] interface for *fastOpenConn.
+func (c *fastOpenConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 && c.checked.CompareAndSwap(false, true) && proxynetutil.FastOpenUsed(c.Conn) {
+		c.fastOpen.hits.Add(1)
+	}
+
+	return n, err
+}
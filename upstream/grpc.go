@@ -0,0 +1,260 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/internal/bootstrap"
+	"github.com/bruceluk/dnsproxy/internal/dnsgrpc"
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+)
+
+// dnsOverGRPC implements the [Upstream] interface for the DNS-over-gRPC
+// protocol, see package dnsgrpc.
+type dnsOverGRPC struct {
+	// getDialer either returns an initialized dial handler or creates a new
+	// one.
+	getDialer DialerInitializer
+
+	// addr is the DNS-over-gRPC server URL.
+	addr *url.URL
+
+	// tlsConf is the configuration of TLS.  It's nil if the upstream doesn't
+	// use TLS.
+	tlsConf *tls.Config
+
+	// clientMu protects client.
+	clientMu *sync.Mutex
+
+	// client sends the requests.  It's created lazily on the first exchange.
+	client *http.Client
+
+	// url is the URL of the Query method.
+	url string
+
+	// opts are the options of the upstream.
+	opts *Options
+}
+
+// newDoGRPC returns the DNS-over-gRPC Upstream.  The "grpcs" scheme means
+// gRPC over TLS and the "grpc" one means gRPC over HTTP/2 with prior knowledge
+// without TLS.
+func newDoGRPC(addr *url.URL, opts *Options) (u Upstream, err error) {
+	ups := &dnsOverGRPC{
+		addr:     addr,
+		clientMu: &sync.Mutex{},
+		opts:     opts,
+	}
+
+	httpURL := &url.URL{Scheme: "http", Path: dnsgrpc.Path}
+	if addr.Scheme == "grpcs" {
+		addPort(addr, defaultPortGRPCS)
+
+		httpURL.Scheme = "https"
+		ups.tlsConf = &tls.Config{
+			ServerName:         addr.Hostname(),
+			RootCAs:            opts.RootCAs,
+			CipherSuites:       opts.CipherSuites,
+			ClientSessionCache: opts.TLSSessionCache.forProto("grpcs"),
+			MinVersion:         tls.VersionTLS12,
+			NextProtos:         []string{http2.NextProtoTLS},
+			// #nosec G402 -- TLS certificate verification could be disabled by
+			// configuration.
+			InsecureSkipVerify:    opts.InsecureSkipVerify,
+			VerifyPeerCertificate: opts.VerifyServerCertificate,
+			VerifyConnection:      opts.VerifyConnection,
+		}
+	} else {
+		addPort(addr, defaultPortGRPC)
+	}
+
+	httpURL.Host = addr.Host
+	ups.url = httpURL.String()
+	ups.getDialer = newDialerInitializer(addr, opts)
+
+	runtime.SetFinalizer(ups, (*dnsOverGRPC).Close)
+
+	return ups, nil
+}
+
+// type check
+var _ Upstream = (*dnsOverGRPC)(nil)
+
+// Address implements the [Upstream] interface for *dnsOverGRPC.
+func (p *dnsOverGRPC) Address() (addr string) { return p.addr.String() }
+
+// Exchange implements the [Upstream] interface for *dnsOverGRPC.
+func (p *dnsOverGRPC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	client, err := p.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("initializing grpc client: %w", err)
+	}
+
+	logBegin(p.Address(), networkTCP, m)
+	defer func() { logFinish(p.Address(), networkTCP, err) }()
+
+	return p.exchangeClient(client, m)
+}
+
+// exchangeClient sends req to the server using client.
+func (p *dnsOverGRPC) exchangeClient(client *http.Client, req *dns.Msg) (resp *dns.Msg, err error) {
+	httpReq, err := p.newRequest(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", p.addr, err)
+	}
+	defer log.OnCloserError(httpResp.Body, log.DEBUG)
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected status %d, got %d from %s", http.StatusOK, httpResp.StatusCode, p.addr)
+	}
+
+	data, err := dnsgrpc.ReadFrame(httpResp.Body)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("reading response from %s: %w", p.addr, err)
+	}
+
+	// Read the rest of the body to receive the trailers.
+	_, _ = io.Copy(io.Discard, httpResp.Body)
+
+	err = checkGRPCStatus(httpResp)
+	if err != nil {
+		return nil, fmt.Errorf("response from %s: %w", p.addr, err)
+	}
+
+	resp = &dns.Msg{}
+	err = resp.Unpack(data)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking response from %s: %w", p.addr, err)
+	}
+
+	if resp.Id != req.Id {
+		err = dns.ErrId
+	}
+
+	return resp, err
+}
+
+// newRequest returns the HTTP request calling the Query method with req.
+func (p *dnsOverGRPC) newRequest(req *dns.Msg) (httpReq *http.Request, err error) {
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	body := bytes.NewReader(dnsgrpc.AppendFrame(nil, packed))
+	httpReq, err = http.NewRequest(http.MethodPost, p.url, body)
+	if err != nil {
+		return nil, fmt.Errorf("creating grpc request to %s: %w", p.addr, err)
+	}
+
+	httpReq.Header.Set("Content-Type", dnsgrpc.ContentType)
+	httpReq.Header.Set("Te", "trailers")
+	if p.opts.Timeout > 0 {
+		httpReq.Header.Set("Grpc-Timeout", strconv.FormatInt(p.opts.Timeout.Milliseconds(), 10)+"m")
+	}
+
+	return httpReq, nil
+}
+
+// checkGRPCStatus returns an error if the gRPC status of resp isn't OK.  The
+// status is taken from the trailers or, for the responses without a body, from
+// the headers.  resp.Body must be read till the end.
+func checkGRPCStatus(resp *http.Response) (err error) {
+	hdr := resp.Trailer
+	if hdr.Get(dnsgrpc.HdrStatus) == "" {
+		hdr = resp.Header
+	}
+
+	st := hdr.Get(dnsgrpc.HdrStatus)
+	if st == "" {
+		return errors.Error("no grpc status")
+	} else if st != dnsgrpc.StatusOK.String() {
+		return fmt.Errorf("grpc status %s: %s", st, hdr.Get(dnsgrpc.HdrMessage))
+	}
+
+	return nil
+}
+
+// getClient returns the client of the upstream, creating it if necessary.
+func (p *dnsOverGRPC) getClient() (client *http.Client, err error) {
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	if p.client != nil {
+		return p.client, nil
+	}
+
+	dial, err := p.getDialer()
+	if err != nil {
+		return nil, fmt.Errorf("bootstrapping %s: %w", p.addr, err)
+	}
+
+	p.client = &http.Client{
+		Transport: &http2.Transport{
+			DialTLSContext:     p.newDialTLSContext(dial),
+			AllowHTTP:          p.tlsConf == nil,
+			ReadIdleTimeout:    transportDefaultReadIdleTimeout,
+			DisableCompression: true,
+		},
+		Timeout: p.opts.Timeout,
+	}
+
+	return p.client, nil
+}
+
+// newDialTLSContext returns the function dialing the connections for
+// [http2.Transport] using dial.  The TLS configuration passed by the transport
+// is ignored in favor of the one of the upstream, and TLS is only used if the
+// upstream requires it.
+func (p *dnsOverGRPC) newDialTLSContext(
+	dial bootstrap.DialHandler,
+) (f func(ctx context.Context, network, addr string, _ *tls.Config) (conn net.Conn, err error)) {
+	return func(ctx context.Context, network, addr string, _ *tls.Config) (conn net.Conn, err error) {
+		conn, err = dial(ctx, network, addr)
+		if err != nil || p.tlsConf == nil {
+			// Don't wrap the error since it's informative enough as is.
+			return conn, err
+		}
+
+		tlsConn := tls.Client(conn, p.tlsConf.Clone())
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			return nil, errors.WithDeferred(fmt.Errorf("tls handshake: %w", err), conn.Close())
+		}
+
+		return tlsConn, nil
+	}
+}
+
+// Close implements the [Upstream] interface for *dnsOverGRPC.
+func (p *dnsOverGRPC) Close() (err error) {
+	runtime.SetFinalizer(p, nil)
+
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	if p.client != nil {
+		p.client.CloseIdleConnections()
+		p.client = nil
+	}
+
+	return nil
+}
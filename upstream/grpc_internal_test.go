@@ -0,0 +1,93 @@
+package upstream
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/internal/dnsgrpc"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestUpstreamGRPC(t *testing.T) {
+	addr := startGRPCServer(t, func(w http.ResponseWriter, r *http.Request) {
+		data, err := dnsgrpc.ReadFrame(r.Body)
+		require.NoError(t, err)
+
+		m := &dns.Msg{}
+		require.NoError(t, m.Unpack(data))
+
+		if m.Question[0].Name == "error.example." {
+			w.Header().Set(dnsgrpc.HdrStatus, dnsgrpc.StatusInternal.String())
+			w.Header().Set(dnsgrpc.HdrMessage, "test error")
+			w.WriteHeader(http.StatusOK)
+
+			return
+		}
+
+		packed, err := respondToTestMessage(m).Pack()
+		require.NoError(t, err)
+
+		w.Header().Set("Content-Type", dnsgrpc.ContentType)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(dnsgrpc.AppendFrame(nil, packed))
+		require.NoError(t, err)
+
+		w.Header().Set(http.TrailerPrefix+dnsgrpc.HdrStatus, dnsgrpc.StatusOK.String())
+	})
+
+	address := "grpc://" + addr
+	u, err := AddressToUpstream(address, &Options{Timeout: timeout})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	t.Run("success", func(t *testing.T) {
+		req := createTestMessage()
+
+		resp, uErr := u.Exchange(req)
+		require.NoError(t, uErr)
+
+		requireResponse(t, req, resp)
+	})
+
+	t.Run("error_status", func(t *testing.T) {
+		req := createHostTestMessage("error.example")
+
+		_, uErr := u.Exchange(req)
+		testutil.AssertErrorMsg(t, "response from "+address+": grpc status 13: test error", uErr)
+	})
+}
+
+// startGRPCServer starts an h2c server calling f for the requests of the
+// Query method and returns its address.
+func startGRPCServer(t *testing.T, f http.HandlerFunc) (addr string) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+dnsgrpc.Path, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, dnsgrpc.ContentType, r.Header.Get("Content-Type"))
+		assert.Equal(t, "trailers", r.Header.Get("Te"))
+		assert.Equal(t, strconv.FormatInt(timeout.Milliseconds(), 10)+"m", r.Header.Get("Grpc-Timeout"))
+
+		f(w, r)
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		Handler:           h2c.NewHandler(mux, &http2.Server{}),
+		ReadHeaderTimeout: timeout,
+	}
+	go func() { _ = srv.Serve(l) }()
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	return l.Addr().String()
+}
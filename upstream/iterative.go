@@ -0,0 +1,511 @@
+package upstream
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// DefaultRootServers are the IPv4 and IPv6 addresses of the DNS root servers,
+// see https://www.iana.org/domains/root/servers.
+var DefaultRootServers = []netip.Addr{
+	netip.MustParseAddr("198.41.0.4"),
+	netip.MustParseAddr("170.247.170.2"),
+	netip.MustParseAddr("192.33.4.12"),
+	netip.MustParseAddr("199.7.91.13"),
+	netip.MustParseAddr("192.203.230.10"),
+	netip.MustParseAddr("192.5.5.241"),
+	netip.MustParseAddr("192.112.36.4"),
+	netip.MustParseAddr("198.97.190.53"),
+	netip.MustParseAddr("192.36.148.17"),
+	netip.MustParseAddr("192.58.128.30"),
+	netip.MustParseAddr("193.0.14.129"),
+	netip.MustParseAddr("199.7.83.42"),
+	netip.MustParseAddr("202.12.27.33"),
+	netip.MustParseAddr("2001:503:ba3e::2:30"),
+	netip.MustParseAddr("2801:1b8:10::b"),
+	netip.MustParseAddr("2001:500:2::c"),
+	netip.MustParseAddr("2001:500:2d::d"),
+	netip.MustParseAddr("2001:500:a8::e"),
+	netip.MustParseAddr("2001:500:2f::f"),
+	netip.MustParseAddr("2001:500:12::d0d"),
+	netip.MustParseAddr("2001:500:1::53"),
+	netip.MustParseAddr("2001:7fe::53"),
+	netip.MustParseAddr("2001:503:c27::2:30"),
+	netip.MustParseAddr("2001:7fd::1"),
+	netip.MustParseAddr("2001:500:9f::42"),
+	netip.MustParseAddr("2001:dc3::35"),
+}
+
+// DefaultIterativeQTypes are the types of the questions resolved by the
+// iterative resolver by default.
+var DefaultIterativeQTypes = []uint16{
+	dns.TypeA,
+	dns.TypeAAAA,
+	dns.TypeCNAME,
+	dns.TypePTR,
+}
+
+// ErrIterativeQType is returned by the iterative resolver for the questions it
+// isn't configured to resolve.
+const ErrIterativeQType errors.Error = "question type is not resolved iteratively"
+
+const (
+	// defaultIterativeTimeout is the default timeout of a single query to an
+	// authoritative server.
+	defaultIterativeTimeout = 2 * time.Second
+
+	// maxIterativeReferrals is the maximum number of referrals followed while
+	// resolving a single name.
+	maxIterativeReferrals = 16
+
+	// maxIterativeDepth is the maximum depth of the nested resolutions, which
+	// are needed to follow CNAMEs and to resolve the nameservers without glue.
+	maxIterativeDepth = 8
+
+	// maxIterativeTries is the maximum number of the servers of a zone of each
+	// address family tried before giving up, so that the resolution doesn't
+	// fail on the hosts without IPv4 or IPv6 connectivity.
+	maxIterativeTries = 3
+)
+
+// IterativeOptions are the options of the iterative resolver.
+type IterativeOptions struct {
+	// Roots are the addresses of the root servers.  If empty,
+	// [DefaultRootServers] are used.
+	Roots []netip.Addr
+
+	// QTypes are the types of the questions to resolve.  The other questions
+	// fail with [ErrIterativeQType].  If empty, [DefaultIterativeQTypes] are
+	// used.
+	QTypes []uint16
+
+	// Timeout is the timeout of a single query to an authoritative server.  If
+	// not positive, a default value of 2s is used.
+	Timeout time.Duration
+}
+
+// iterative implements the [Upstream] interface by resolving the questions
+// itself, starting from the root servers.  It's a minimal resolver meant as the
+// last resort fallback: it doesn't cache anything and doesn't validate DNSSEC.
+type iterative struct {
+	udp    *dns.Client
+	tcp    *dns.Client
+	qtypes *container.MapSet[uint16]
+	roots  []netip.Addr
+
+	// port is the port of the authoritative servers.  It's only changed in
+	// tests.
+	port uint16
+}
+
+// NewIterative returns a new Upstream resolving the questions iteratively from
+// the root servers.  opts may be nil.
+func NewIterative(opts *IterativeOptions) (u Upstream) {
+	if opts == nil {
+		opts = &IterativeOptions{}
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultIterativeTimeout
+	}
+
+	roots := opts.Roots
+	if len(roots) == 0 {
+		roots = DefaultRootServers
+	}
+
+	qtypes := opts.QTypes
+	if len(qtypes) == 0 {
+		qtypes = DefaultIterativeQTypes
+	}
+
+	return &iterative{
+		udp:    &dns.Client{Net: networkUDP, Timeout: timeout},
+		tcp:    &dns.Client{Net: networkTCP, Timeout: timeout},
+		qtypes: container.NewMapSet(qtypes...),
+		roots:  roots,
+		port:   defaultPortPlain,
+	}
+}
+
+// type check
+var _ Upstream = (*iterative)(nil)
+
+// Address implements the [Upstream] interface for *iterative.
+func (r *iterative) Address() (addr string) {
+	return "iterative"
+}
+
+// Close implements the [Upstream] interface for *iterative.
+func (r *iterative) Close() (err error) {
+	return nil
+}
+
+// Exchange implements the [Upstream] interface for *iterative.
+func (r *iterative) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("iterative: %w", errQuestion)
+	}
+
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET || !r.qtypes.Has(q.Qtype) {
+		return nil, fmt.Errorf("iterative: %s: %w", dns.Type(q.Qtype), ErrIterativeQType)
+	}
+
+	q.Name = dns.Fqdn(strings.ToLower(q.Name))
+	res, err := r.resolve(q, 0)
+	if err != nil {
+		return nil, fmt.Errorf("iterative: resolving %s: %w", q.Name, err)
+	}
+
+	resp = (&dns.Msg{}).SetRcode(req, res.Rcode)
+	resp.RecursionAvailable = true
+	resp.Answer = res.Answer
+	resp.Ns = res.Ns
+
+	return resp, nil
+}
+
+// resolve resolves q following the referrals from the root servers.
+func (r *iterative) resolve(q dns.Question, depth int) (resp *dns.Msg, err error) {
+	if depth > maxIterativeDepth {
+		return nil, errors.Error("too deep")
+	}
+
+	zone, servers := ".", r.roots
+	for range maxIterativeReferrals {
+		resp, err = r.queryZone(servers, q)
+		if err != nil {
+			return nil, fmt.Errorf("querying %q servers: %w", zone, err)
+		}
+
+		var nsNames []string
+		zone, nsNames, err = referral(resp, q.Name, zone)
+		if err != nil {
+			return nil, err
+		} else if len(nsNames) == 0 {
+			resp.Answer = chainAnswers(resp.Answer, q.Name)
+
+			return r.followCNAME(resp, q, depth)
+		}
+
+		servers, err = r.nsAddrs(resp, zone, nsNames, depth)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %q servers: %w", zone, err)
+		}
+	}
+
+	return nil, errors.Error("too many referrals")
+}
+
+// referral returns the zone and the names of its servers, if resp is a
+// referral to a zone deeper than the current one.  nsNames are empty if resp
+// is the final response.
+func referral(resp *dns.Msg, qname, cur string) (zone string, nsNames []string, err error) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return cur, nil, nil
+	}
+
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if ok && dns.IsSubDomain(ns.Hdr.Name, qname) {
+			zone = strings.ToLower(ns.Hdr.Name)
+			nsNames = append(nsNames, strings.ToLower(ns.Ns))
+		}
+	}
+
+	if len(nsNames) == 0 || (resp.Authoritative && zone == cur) {
+		// The authoritative response without data.
+		return cur, nil, nil
+	} else if dns.CountLabel(zone) <= dns.CountLabel(cur) {
+		return "", nil, fmt.Errorf("bad referral from %q to %q", cur, zone)
+	}
+
+	return zone, nsNames, nil
+}
+
+// nsAddrs returns the addresses of the servers of zone from the glue records in
+// resp or resolves them if there are none.
+func (r *iterative) nsAddrs(
+	resp *dns.Msg,
+	zone string,
+	nsNames []string,
+	depth int,
+) (addrs []netip.Addr, err error) {
+	addrs = glueAddrs(resp, zone, nsNames)
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	var errs []error
+	for _, name := range nsNames {
+		addrs, err = r.resolveAddrs(name, depth+1)
+		if err != nil {
+			errs = append(errs, err)
+		} else if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, errors.Error("no addresses")
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// glueAddrs returns the addresses of the nameservers from the additional
+// section of resp.  Only the glue for the names within zone is accepted, since
+// the servers of the parent zone aren't authoritative for the other names, so
+// the records for them may be used to poison the resolution.
+func glueAddrs(resp *dns.Msg, zone string, nsNames []string) (addrs []netip.Addr) {
+	names := container.NewMapSet(nsNames...)
+	for _, rr := range resp.Extra {
+		name := strings.ToLower(rr.Header().Name)
+		if !names.Has(name) || !dns.IsSubDomain(zone, name) {
+			continue
+		}
+
+		if addr, ok := rrAddr(rr); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// rrAddr returns the address from rr, if it's an A or AAAA record.
+func rrAddr(rr dns.RR) (addr netip.Addr, ok bool) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		addr, ok = netip.AddrFromSlice(rr.A)
+	case *dns.AAAA:
+		addr, ok = netip.AddrFromSlice(rr.AAAA)
+	}
+
+	return addr.Unmap(), ok
+}
+
+// resolveAddrs resolves the IPv4 and IPv6 addresses of the nameserver name.
+func (r *iterative) resolveAddrs(name string, depth int) (addrs []netip.Addr, err error) {
+	var errs []error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, qErr := r.resolve(dns.Question{
+			Name:   name,
+			Qtype:  qtype,
+			Qclass: dns.ClassINET,
+		}, depth)
+		if qErr != nil {
+			errs = append(errs, qErr)
+
+			continue
+		}
+
+		for _, rr := range resp.Answer {
+			if addr, ok := rrAddr(rr); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// followCNAME returns resp with the answer completed by resolving the target of
+// the CNAME chain, if resp ends with a CNAME pointing outside the zone.
+func (r *iterative) followCNAME(resp *dns.Msg, q dns.Question, depth int) (res *dns.Msg, err error) {
+	if resp.Rcode != dns.RcodeSuccess || q.Qtype == dns.TypeCNAME {
+		return resp, nil
+	}
+
+	target := cnameTarget(resp.Answer, q.Name, q.Qtype)
+	if target == "" {
+		return resp, nil
+	}
+
+	sub, err := r.resolve(dns.Question{
+		Name:   target,
+		Qtype:  q.Qtype,
+		Qclass: q.Qclass,
+	}, depth+1)
+	if err != nil {
+		return nil, fmt.Errorf("following cname to %q: %w", target, err)
+	}
+
+	sub.Answer = append(resp.Answer, sub.Answer...)
+
+	return sub, nil
+}
+
+// chainAnswers returns the records from ans, which owner names are on the CNAME
+// chain starting at name, so that the unrelated records, which may be used to
+// poison the resolution, are dropped.
+func chainAnswers(ans []dns.RR, name string) (filtered []dns.RR) {
+	chain := container.NewMapSet(strings.ToLower(name))
+
+	// Limit the iterations to protect from the CNAME loops, as each iteration
+	// either adds a name to the chain or stops.
+	for range len(ans) {
+		grown := false
+		for _, rr := range ans {
+			cname, ok := rr.(*dns.CNAME)
+			if !ok || !chain.Has(strings.ToLower(cname.Hdr.Name)) {
+				continue
+			}
+
+			if target := strings.ToLower(cname.Target); !chain.Has(target) {
+				chain.Add(target)
+				grown = true
+			}
+		}
+
+		if !grown {
+			break
+		}
+	}
+
+	for _, rr := range ans {
+		if chain.Has(strings.ToLower(rr.Header().Name)) {
+			filtered = append(filtered, rr)
+		}
+	}
+
+	return filtered
+}
+
+// cnameTarget returns the last target of the CNAME chain starting at name in
+// ans, if ans has no records of qtype for it.  Otherwise, it returns an empty
+// string.
+func cnameTarget(ans []dns.RR, name string, qtype uint16) (target string) {
+	// Limit the iterations to protect from the CNAME loops.  Each CNAME in ans
+	// may only be followed once, and the last target is checked as well.
+	for range len(ans) + 1 {
+		next, found := chainStep(ans, name, qtype)
+		if found {
+			return ""
+		} else if next == "" {
+			return target
+		}
+
+		name, target = next, next
+	}
+
+	return ""
+}
+
+// chainStep returns the CNAME target for name in ans.  found is true if ans
+// contains a record of qtype for name.
+func chainStep(ans []dns.RR, name string, qtype uint16) (next string, found bool) {
+	for _, rr := range ans {
+		hdr := rr.Header()
+		if !strings.EqualFold(hdr.Name, name) {
+			continue
+		} else if hdr.Rrtype == qtype {
+			return "", true
+		} else if cname, ok := rr.(*dns.CNAME); ok {
+			next = strings.ToLower(cname.Target)
+		}
+	}
+
+	return next, false
+}
+
+// queryZone sends q to the servers of a zone until one of them responds.
+func (r *iterative) queryZone(servers []netip.Addr, q dns.Question) (resp *dns.Msg, err error) {
+	req := &dns.Msg{}
+	req.SetQuestion(q.Name, q.Qtype)
+	req.RecursionDesired = false
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	var errs []error
+	for _, srv := range tryOrder(servers) {
+		addr := netip.AddrPortFrom(srv, r.port)
+
+		resp, err = r.exchange(req, addr.String())
+		if err == nil {
+			return resp, nil
+		}
+
+		log.Debug("iterative: querying %s: %s", addr, err)
+
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// tryOrder returns up to maxIterativeTries servers of each address family from
+// servers starting from the random ones, alternating the families.
+func tryOrder(servers []netip.Addr) (ordered []netip.Addr) {
+	var v4, v6 []netip.Addr
+	for _, srv := range servers {
+		if srv.Is4() {
+			v4 = append(v4, srv)
+		} else {
+			v6 = append(v6, srv)
+		}
+	}
+
+	v4, v6 = randomTries(v4), randomTries(v6)
+	for i := range max(len(v4), len(v6)) {
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+	}
+
+	return ordered
+}
+
+// randomTries returns up to maxIterativeTries of servers starting from the
+// random one.
+func randomTries(servers []netip.Addr) (tries []netip.Addr) {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	// #nosec G404 -- The choice of the server doesn't need to be
+	// cryptographically secure.
+	start := rand.IntN(len(servers))
+	for i := range min(len(servers), maxIterativeTries) {
+		tries = append(tries, servers[(start+i)%len(servers)])
+	}
+
+	return tries
+}
+
+// exchange sends req to addr over UDP and retries over TCP if the response is
+// truncated.  It returns an error if the server failed to respond properly.
+func (r *iterative) exchange(req *dns.Msg, addr string) (resp *dns.Msg, err error) {
+	resp, _, err = r.udp.Exchange(req, addr)
+	if err == nil && resp.Truncated {
+		resp, _, err = r.tcp.Exchange(req, addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		return resp, nil
+	default:
+		return nil, fmt.Errorf("bad rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+}
@@ -0,0 +1,161 @@
+package upstream
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startZoneServer starts a UDP DNS server on addr answering with the records
+// from zone, which maps the question names to the responses.  It returns the
+// port of the server.
+func startZoneServer(t *testing.T, addr netip.AddrPort, zone map[string]*dns.Msg) (port uint16) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp, ok := zone[req.Question[0].Name]
+			if !ok {
+				resp = &dns.Msg{}
+				resp.Rcode = dns.RcodeNameError
+			}
+
+			resp = resp.Copy()
+			resp.SetRcode(req, resp.Rcode)
+
+			_ = w.WriteMsg(resp)
+		}),
+	}
+
+	go func() {
+		pt := testutil.PanicT{}
+		require.NoError(pt, srv.ActivateAndServe())
+	}()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestIterative_Exchange(t *testing.T) {
+	var (
+		rootAddr  = netip.MustParseAddr("127.0.0.1")
+		exAddr    = netip.MustParseAddr("127.0.0.2")
+		otherAddr = netip.MustParseAddr("127.0.0.3")
+	)
+
+	rr := func(s string) (r dns.RR) {
+		r, err := dns.NewRR(s)
+		require.NoError(t, err)
+
+		return r
+	}
+
+	exReferral := &dns.Msg{
+		Ns:    []dns.RR{rr("example. 3600 IN NS ns.example.")},
+		Extra: []dns.RR{rr("ns.example. 3600 IN A " + exAddr.String())},
+	}
+
+	// The servers of other. have no glue and are resolved separately.
+	otherReferral := &dns.Msg{
+		Ns: []dns.RR{rr("other. 3600 IN NS ns.example.")},
+	}
+
+	// The glue for the servers of third. is out of the zone, so it must be
+	// ignored.
+	thirdReferral := &dns.Msg{
+		Ns:    []dns.RR{rr("third. 3600 IN NS ns.example.")},
+		Extra: []dns.RR{rr("ns.example. 3600 IN A 127.0.0.4")},
+	}
+
+	port := startZoneServer(t, netip.AddrPortFrom(rootAddr, 0), map[string]*dns.Msg{
+		"www.example.":   exReferral,
+		"extra.example.": exReferral,
+		"ns.example.":    exReferral,
+		"host.other.":    otherReferral,
+		"host.third.":    thirdReferral,
+	})
+
+	startZoneServer(t, netip.AddrPortFrom(exAddr, port), map[string]*dns.Msg{
+		"www.example.": {Answer: []dns.RR{rr("www.example. 60 IN CNAME host.other.")}},
+		"extra.example.": {Answer: []dns.RR{
+			rr("extra.example. 60 IN A 192.0.2.2"),
+			rr("victim.example. 60 IN A 192.0.2.3"),
+		}},
+		"ns.example.": {Answer: []dns.RR{rr("ns.example. 60 IN A " + otherAddr.String())}},
+	})
+
+	startZoneServer(t, netip.AddrPortFrom(otherAddr, port), map[string]*dns.Msg{
+		"host.other.": {Answer: []dns.RR{rr("host.other. 60 IN A 192.0.2.1")}},
+		"host.third.": {Answer: []dns.RR{rr("host.third. 60 IN A 192.0.2.4")}},
+	})
+
+	u := NewIterative(&IterativeOptions{
+		Roots: []netip.Addr{rootAddr},
+	})
+	u.(*iterative).port = port
+
+	t.Run("cname", func(t *testing.T) {
+		resp, err := u.Exchange((&dns.Msg{}).SetQuestion("WWW.example.", dns.TypeA))
+		require.NoError(t, err)
+
+		require.Len(t, resp.Answer, 2)
+
+		assert.Equal(t, "host.other.", resp.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, net.IP{192, 0, 2, 1}, resp.Answer[1].(*dns.A).A.To4())
+		assert.True(t, resp.RecursionAvailable)
+	})
+
+	t.Run("unrelated_answer", func(t *testing.T) {
+		resp, err := u.Exchange((&dns.Msg{}).SetQuestion("extra.example.", dns.TypeA))
+		require.NoError(t, err)
+
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, "extra.example.", resp.Answer[0].Header().Name)
+	})
+
+	t.Run("out_of_zone_glue", func(t *testing.T) {
+		resp, err := u.Exchange((&dns.Msg{}).SetQuestion("host.third.", dns.TypeA))
+		require.NoError(t, err)
+
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, net.IP{192, 0, 2, 4}, resp.Answer[0].(*dns.A).A.To4())
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		resp, err := u.Exchange((&dns.Msg{}).SetQuestion("none.", dns.TypeA))
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+
+	t.Run("qtype", func(t *testing.T) {
+		_, err := u.Exchange((&dns.Msg{}).SetQuestion("www.example.", dns.TypeTXT))
+		assert.ErrorIs(t, err, ErrIterativeQType)
+	})
+}
+
+func TestTryOrder(t *testing.T) {
+	assert.Len(t, tryOrder(DefaultRootServers), 2*maxIterativeTries)
+
+	order := tryOrder([]netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("192.0.2.2"),
+	})
+	require.Len(t, order, 3)
+
+	assert.True(t, order[0].Is4())
+	assert.True(t, order[1].Is6())
+	assert.True(t, order[2].Is4())
+}
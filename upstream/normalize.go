@@ -0,0 +1,109 @@
+package upstream
+
+import (
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// Normalization is the configuration of the normalization of the queries sent
+// to an upstream.  Normalized queries carry nothing specific to the client
+// that has sent the original request.
+type Normalization struct {
+	// KeepEDNSOptions are the codes of the EDNS options kept in the queries,
+	// all the other options are removed.  If nil, only the EDNS Client Subnet
+	// option is kept, since it's set by the proxy itself.
+	KeepEDNSOptions []uint16
+
+	// DisableCompression disables the compression of domain names in the
+	// queries.  Some broken servers fail to parse compressed queries.
+	DisableCompression bool
+}
+
+// defaultKeptEDNSOptions are the EDNS options kept in the normalized queries
+// by default.
+var defaultKeptEDNSOptions = []uint16{dns.EDNS0SUBNET}
+
+// normalizingUpstream is an [Upstream] that normalizes the queries before
+// sending them to the underlying upstream.
+type normalizingUpstream struct {
+	// Upstream is the underlying upstream.
+	Upstream
+
+	keepOpts           []uint16
+	disableCompression bool
+}
+
+// newNormalizingUpstream returns a new upstream normalizing the queries
+// according to n before sending them to u.  n must not be nil.
+func newNormalizingUpstream(u Upstream, n *Normalization) (nu *normalizingUpstream) {
+	keepOpts := n.KeepEDNSOptions
+	if keepOpts == nil {
+		keepOpts = defaultKeptEDNSOptions
+	}
+
+	return &normalizingUpstream{
+		Upstream:           u,
+		keepOpts:           keepOpts,
+		disableCompression: n.DisableCompression,
+	}
+}
+
+// type check
+var _ Upstream = (*normalizingUpstream)(nil)
+
+// Exchange implements the [Upstream] interface for *normalizingUpstream.  req
+// isn't modified, the ID of the response is set to the one of req.
+func (u *normalizingUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	resp, err = u.Upstream.Exchange(u.normalize(req))
+	if resp != nil {
+		resp.Id = req.Id
+	}
+
+	return resp, err
+}
+
+// normalize returns a normalized copy of req.  The header gets a new random ID
+// and only the flags meaningful for queries.  The OPT record keeps its UDP
+// size, DO bit, and only the allowed options, the other additional records are
+// removed.
+func (u *normalizingUpstream) normalize(req *dns.Msg) (norm *dns.Msg) {
+	norm = &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:                dns.Id(),
+			Opcode:            req.Opcode,
+			RecursionDesired:  req.RecursionDesired,
+			AuthenticatedData: req.AuthenticatedData,
+			CheckingDisabled:  req.CheckingDisabled,
+		},
+		Compress: !u.disableCompression,
+		Question: slices.Clone(req.Question),
+	}
+
+	if req.Opcode != dns.OpcodeQuery {
+		// The other opcodes, such as UPDATE, may use the other sections.
+		norm.Answer = slices.Clone(req.Answer)
+		norm.Ns = slices.Clone(req.Ns)
+	}
+
+	if opt := req.IsEdns0(); opt != nil {
+		normOpt := &dns.OPT{
+			Hdr: dns.RR_Header{
+				Name:   ".",
+				Rrtype: dns.TypeOPT,
+			},
+		}
+		normOpt.SetUDPSize(opt.UDPSize())
+		normOpt.SetDo(opt.Do())
+
+		for _, o := range opt.Option {
+			if slices.Contains(u.keepOpts, o.Option()) {
+				normOpt.Option = append(normOpt.Option, o)
+			}
+		}
+
+		norm.Extra = []dns.RR{normOpt}
+	}
+
+	return norm
+}
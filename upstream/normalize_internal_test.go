@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingUpstream is an [Upstream] for tests that calls onExchange.
+type recordingUpstream struct {
+	onExchange func(req *dns.Msg) (resp *dns.Msg, err error)
+}
+
+// type check
+var _ Upstream = (*recordingUpstream)(nil)
+
+// Exchange implements the [Upstream] interface for *recordingUpstream.
+func (u *recordingUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.onExchange(req)
+}
+
+// Address implements the [Upstream] interface for *recordingUpstream.
+func (u *recordingUpstream) Address() (addr string) { return "test" }
+
+// Close implements the [Upstream] interface for *recordingUpstream.
+func (u *recordingUpstream) Close() (err error) { return nil }
+
+func TestNormalizingUpstream_Exchange(t *testing.T) {
+	var sent *dns.Msg
+	ups := &recordingUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			sent = req
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+	}
+
+	u := newNormalizingUpstream(ups, &Normalization{
+		DisableCompression: true,
+	})
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	req.Id = 1234
+	req.Authoritative = true
+	req.Zero = true
+	req.CheckingDisabled = true
+	req.SetEdns0(1232, true)
+
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: "0123456789abcdef",
+	}, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.IP{192, 0, 2, 0},
+	}, &dns.EDNS0_PADDING{
+		Padding: make([]byte, 16),
+	})
+	req.Extra = append(req.Extra, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{"extra"},
+	})
+
+	origStr := req.String()
+
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, origStr, req.String())
+	assert.Equal(t, req.Id, resp.Id)
+
+	require.NotNil(t, sent)
+
+	assert.False(t, sent.Compress)
+	assert.False(t, sent.Authoritative)
+	assert.False(t, sent.Zero)
+	assert.True(t, sent.CheckingDisabled)
+	assert.True(t, sent.RecursionDesired)
+
+	require.Len(t, sent.Extra, 1)
+
+	sentOpt := sent.IsEdns0()
+	require.NotNil(t, sentOpt)
+
+	assert.Equal(t, uint16(1232), sentOpt.UDPSize())
+	assert.True(t, sentOpt.Do())
+
+	require.Len(t, sentOpt.Option, 1)
+
+	assert.Equal(t, uint16(dns.EDNS0SUBNET), sentOpt.Option[0].Option())
+}
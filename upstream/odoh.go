@@ -0,0 +1,427 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/internal/odoh"
+	"github.com/miekg/dns"
+)
+
+const (
+	// queryKeyODoHProxy is the URL query key of the oblivious proxy of the
+	// ODoH upstreams.
+	queryKeyODoHProxy = "proxy"
+
+	// odohDefaultPath is the path of the target's DNS endpoint used when the
+	// upstream URL has none.
+	odohDefaultPath = "/dns-query"
+
+	// odohConfigTTL is the time the target's configuration is used for when
+	// the target doesn't specify it with Cache-Control.
+	odohConfigTTL = time.Hour
+
+	// odohMaxBodyLen is the maximum length of the bodies of the responses of
+	// the target and the proxy.
+	odohMaxBodyLen = 64 * 1024
+)
+
+// errODoHKeyRejected is returned when the target refuses to decrypt the query
+// since the key it's encrypted with is unknown, which is most probably caused
+// by the target's key rotation.
+const errODoHKeyRejected errors.Error = "target rejected the key"
+
+// dnsOverODoH implements the [Upstream] interface for the Oblivious DNS over
+// HTTPS protocol.  The queries are encrypted to the public key of the target
+// and relayed through the oblivious proxy, so that the target doesn't learn the
+// client's address and the proxy doesn't learn the queries.
+//
+// See RFC 9230.
+type dnsOverODoH struct {
+	// target is the URL of the target's DNS endpoint.
+	target *url.URL
+
+	// relay is the URL the encrypted queries are sent to, either the proxy's
+	// one with the target specified in the query, or target itself.
+	relay *url.URL
+
+	// targetClient fetches the target's configurations.
+	targetClient *odohClient
+
+	// relayClient sends the encrypted queries to relay.
+	relayClient *odohClient
+
+	// configMu protects config and configExpire.
+	configMu *sync.Mutex
+
+	// config is the target's configuration currently used.
+	config *odoh.Config
+
+	// configExpire is the time config should be fetched again after.
+	configExpire time.Time
+
+	// addrRedacted is the redacted string representation of the upstream's
+	// address.
+	addrRedacted string
+}
+
+// newODoH returns the Oblivious DNS over HTTPS Upstream.  The oblivious proxy
+// is taken from the "proxy" query parameter of addr, which is an HTTPS URL.
+// Without it, the queries are sent to the target directly, which only hides
+// them from the on-path observers.
+func newODoH(addr *url.URL, opts *Options) (u Upstream, err error) {
+	q := addr.Query()
+	for k := range q {
+		if k != queryKeyODoHProxy {
+			return nil, fmt.Errorf("unknown parameter %q in %s", k, addr.Redacted())
+		}
+	}
+
+	ups := &dnsOverODoH{
+		target:       &url.URL{Scheme: "https", Host: addr.Host, Path: addr.Path},
+		configMu:     &sync.Mutex{},
+		addrRedacted: addr.Redacted(),
+	}
+	if ups.target.Path == "" {
+		ups.target.Path = odohDefaultPath
+	}
+
+	addPort(ups.target, defaultPortDoH)
+	ups.targetClient = newODoHClient(ups.target, opts)
+
+	proxyStr := q.Get(queryKeyODoHProxy)
+	if proxyStr == "" {
+		ups.relay, ups.relayClient = ups.target, ups.targetClient
+	} else {
+		ups.relay, err = odohRelayURL(proxyStr, ups.target)
+		if err != nil {
+			return nil, fmt.Errorf("parsing proxy of %s: %w", ups.addrRedacted, err)
+		}
+
+		ups.relayClient = newODoHClient(ups.relay, opts)
+	}
+
+	runtime.SetFinalizer(ups, (*dnsOverODoH).Close)
+
+	return ups, nil
+}
+
+// odohRelayURL returns the URL of the oblivious proxy proxyStr relaying the
+// queries to target.
+func odohRelayURL(proxyStr string, target *url.URL) (relay *url.URL, err error) {
+	relay, err = url.Parse(proxyStr)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	} else if relay.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", relay.Scheme)
+	}
+
+	err = validateUpstreamURL(relay)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	addPort(relay, defaultPortDoH)
+
+	targetHost := target.Host
+	if target.Port() == strconv.Itoa(defaultPortDoH) {
+		targetHost = target.Hostname()
+	}
+
+	rq := relay.Query()
+	rq.Set(odoh.ParamTargetHost, targetHost)
+	rq.Set(odoh.ParamTargetPath, target.Path)
+	relay.RawQuery = rq.Encode()
+
+	return relay, nil
+}
+
+// type check
+var _ Upstream = (*dnsOverODoH)(nil)
+
+// Address implements the [Upstream] interface for *dnsOverODoH.
+func (p *dnsOverODoH) Address() (addr string) { return p.addrRedacted }
+
+// Exchange implements the [Upstream] interface for *dnsOverODoH.
+func (p *dnsOverODoH) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	// Use the zero ID same as for DNS-over-HTTPS, so that the queries don't
+	// differ more than necessary.
+	id := m.Id
+	m.Id = 0
+	defer func() {
+		m.Id = id
+		if resp != nil {
+			resp.Id = id
+		}
+	}()
+
+	logBegin(p.addrRedacted, networkTCP, m)
+	defer func() { logFinish(p.addrRedacted, networkTCP, err) }()
+
+	conf, err := p.getConfig(nil)
+	if err != nil {
+		return nil, fmt.Errorf("getting config of %s: %w", p.addrRedacted, err)
+	}
+
+	resp, err = p.exchangeConfig(conf, m)
+	if errors.Is(err, errODoHKeyRejected) {
+		log.Debug("odoh: %s: %s, refetching config", p.addrRedacted, err)
+
+		conf, err = p.getConfig(conf)
+		if err != nil {
+			return nil, fmt.Errorf("refetching config of %s: %w", p.addrRedacted, err)
+		}
+
+		resp, err = p.exchangeConfig(conf, m)
+	}
+
+	return resp, err
+}
+
+// exchangeConfig encrypts req with the target's configuration conf, relays it,
+// and decrypts the response.
+func (p *dnsOverODoH) exchangeConfig(conf *odoh.Config, req *dns.Msg) (resp *dns.Msg, err error) {
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	query, qctx, err := odoh.EncryptQuery(conf, packed)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting query: %w", err)
+	}
+
+	client, err := p.relayClient.get()
+	if err != nil {
+		return nil, fmt.Errorf("initializing http client: %w", err)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, p.relay.String(), bytes.NewReader(query))
+	if err != nil {
+		return nil, fmt.Errorf("creating http request to %s: %w", p.addrRedacted, err)
+	}
+
+	httpReq.Header.Set("Content-Type", odoh.ContentType)
+	httpReq.Header.Set("Accept", odoh.ContentType)
+	httpReq.Header.Set("User-Agent", "")
+
+	body, _, err := p.do(client, httpReq)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	packed, err = qctx.DecryptResponse(body)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting response from %s: %w", p.addrRedacted, err)
+	}
+
+	resp = &dns.Msg{}
+	err = resp.Unpack(packed)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking response from %s: %w", p.addrRedacted, err)
+	}
+
+	if resp.Id != req.Id {
+		err = dns.ErrId
+	}
+
+	return resp, err
+}
+
+// do sends httpReq using client and returns the body and the header of the
+// response.  It returns [errODoHKeyRejected] if the target responds with 401.
+func (p *dnsOverODoH) do(
+	client *http.Client,
+	httpReq *http.Request,
+) (body []byte, hdr http.Header, err error) {
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("requesting %s: %w", p.addrRedacted, err)
+	}
+	defer log.OnCloserError(httpResp.Body, log.DEBUG)
+
+	body, err = io.ReadAll(io.LimitReader(httpResp.Body, odohMaxBodyLen))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %w", p.addrRedacted, err)
+	}
+
+	switch httpResp.StatusCode {
+	case http.StatusOK:
+		return body, httpResp.Header, nil
+	case http.StatusUnauthorized:
+		return nil, nil, errODoHKeyRejected
+	default:
+		return nil, nil, fmt.Errorf(
+			"expected status %d, got %d from %s",
+			http.StatusOK,
+			httpResp.StatusCode,
+			p.addrRedacted,
+		)
+	}
+}
+
+// getConfig returns the target's configuration, fetching it if it's absent,
+// expired, or is rejected, which is the configuration the target has refused
+// to decrypt the query with.  rejected may be nil.
+func (p *dnsOverODoH) getConfig(rejected *odoh.Config) (conf *odoh.Config, err error) {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	now := time.Now()
+	if p.config != nil && p.config != rejected && now.Before(p.configExpire) {
+		return p.config, nil
+	}
+
+	client, err := p.targetClient.get()
+	if err != nil {
+		return nil, fmt.Errorf("initializing http client: %w", err)
+	}
+
+	u := &url.URL{Scheme: p.target.Scheme, Host: p.target.Host, Path: odoh.ConfigsPath}
+	httpReq, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating http request to %s: %w", p.addrRedacted, err)
+	}
+
+	httpReq.Header.Set("User-Agent", "")
+
+	body, hdr, err := p.do(client, httpReq)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	confs, err := odoh.ParseConfigs(body)
+	if err != nil {
+		return nil, fmt.Errorf("parsing configs: %w", err)
+	}
+
+	p.config = confs[0]
+	p.configExpire = now.Add(maxAge(hdr.Get("Cache-Control"), odohConfigTTL))
+
+	return p.config, nil
+}
+
+// maxAge returns the max-age directive of the Cache-Control header value cc or
+// def if there is none.
+func maxAge(cc string, def time.Duration) (d time.Duration) {
+	for _, dir := range strings.Split(cc, ",") {
+		val, ok := strings.CutPrefix(strings.TrimSpace(dir), "max-age=")
+		if !ok {
+			continue
+		}
+
+		sec, err := strconv.ParseUint(val, 10, 32)
+		if err == nil {
+			return time.Duration(sec) * time.Second
+		}
+	}
+
+	return def
+}
+
+// Close implements the [Upstream] interface for *dnsOverODoH.
+func (p *dnsOverODoH) Close() (err error) {
+	runtime.SetFinalizer(p, nil)
+
+	p.targetClient.close()
+	p.relayClient.close()
+
+	return nil
+}
+
+// odohClient lazily creates the HTTP client connecting to a single server.
+type odohClient struct {
+	// getDialer either returns an initialized dial handler or creates a new
+	// one.
+	getDialer DialerInitializer
+
+	// tlsConf is the configuration of TLS.
+	tlsConf *tls.Config
+
+	// mu protects client.
+	mu *sync.Mutex
+
+	// client is created on the first request.
+	client *http.Client
+
+	// timeout is the timeout of the HTTP client.
+	timeout time.Duration
+}
+
+// newODoHClient returns a new client for the server of u, which must have a
+// port.
+func newODoHClient(u *url.URL, opts *Options) (c *odohClient) {
+	return &odohClient{
+		getDialer: newDialerInitializer(u, opts),
+		tlsConf: &tls.Config{
+			ServerName:         u.Hostname(),
+			RootCAs:            opts.RootCAs,
+			CipherSuites:       opts.CipherSuites,
+			ClientSessionCache: opts.TLSSessionCache.forProto("odoh"),
+			MinVersion:         tls.VersionTLS12,
+			// #nosec G402 -- TLS certificate verification could be disabled by
+			// configuration.
+			InsecureSkipVerify:    opts.InsecureSkipVerify,
+			VerifyPeerCertificate: opts.VerifyServerCertificate,
+			VerifyConnection:      opts.VerifyConnection,
+		},
+		mu:      &sync.Mutex{},
+		timeout: opts.Timeout,
+	}
+}
+
+// get returns the HTTP client, creating it if necessary.
+func (c *odohClient) get() (client *http.Client, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	dialContext, err := c.getDialer()
+	if err != nil {
+		return nil, fmt.Errorf("bootstrapping %s: %w", c.tlsConf.ServerName, err)
+	}
+
+	c.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:    c.tlsConf,
+			DisableCompression: true,
+			DialContext:        dialContext,
+			IdleConnTimeout:    transportDefaultIdleConnTimeout,
+			MaxConnsPerHost:    dohMaxConnsPerHost,
+			MaxIdleConns:       dohMaxIdleConns,
+			ForceAttemptHTTP2:  true,
+		},
+		Timeout: c.timeout,
+	}
+
+	return c.client, nil
+}
+
+// close closes the idle connections of the client, if any.
+func (c *odohClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != nil {
+		c.client.CloseIdleConnections()
+		c.client = nil
+	}
+}
@@ -0,0 +1,205 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/internal/hpke"
+	"github.com/bruceluk/dnsproxy/internal/odoh"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testODoHTarget is a test ODoH target which key may be rotated.
+type testODoHTarget struct {
+	// mu protects conf and sk.
+	mu   *sync.Mutex
+	conf *odoh.Config
+	sk   *ecdh.PrivateKey
+
+	// configsFetched is the number of the configurations requests.
+	configsFetched atomic.Uint32
+
+	// queries is the number of the decrypted queries.
+	queries atomic.Uint32
+}
+
+// rotate replaces the key of the target.
+func (tgt *testODoHTarget) rotate(t *testing.T) {
+	t.Helper()
+
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tgt.mu.Lock()
+	defer tgt.mu.Unlock()
+
+	tgt.sk = sk
+	tgt.conf = &odoh.Config{
+		PublicKey: sk.PublicKey().Bytes(),
+		Suite: hpke.Suite{
+			KEM:  hpke.KEMX25519HKDFSHA256,
+			KDF:  hpke.KDFHKDFSHA256,
+			AEAD: hpke.AEADAES128GCM,
+		},
+	}
+}
+
+// ServeHTTP implements the [http.Handler] interface for *testODoHTarget.
+func (tgt *testODoHTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tgt.mu.Lock()
+	conf, sk := tgt.conf, tgt.sk
+	tgt.mu.Unlock()
+
+	if r.URL.Path == odoh.ConfigsPath {
+		tgt.configsFetched.Add(1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write(odoh.MarshalConfigs(conf))
+
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	msg, rctx, err := odoh.DecryptQuery(conf, sk, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+
+		return
+	}
+
+	tgt.queries.Add(1)
+
+	req := &dns.Msg{}
+	err = req.Unpack(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	msg, err = respondToTestMessage(req).Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	data, err := rctx.EncryptResponse(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", odoh.ContentType)
+	_, _ = w.Write(data)
+}
+
+// newTestODoHProxy returns the handler of a test oblivious proxy which counts
+// the relayed queries.
+func newTestODoHProxy(relayed *atomic.Uint32) (h http.HandlerFunc) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			// #nosec G402 -- The target uses a self-signed certificate.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		u := &url.URL{
+			Scheme: "https",
+			Host:   q.Get(odoh.ParamTargetHost),
+			Path:   q.Get(odoh.ParamTargetPath),
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		resp, err := client.Post(u.String(), odoh.ContentType, bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		relayed.Add(1)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	}
+}
+
+// startTestTLSServer starts an HTTPS server with h and returns its address.
+func startTestTLSServer(t *testing.T, h http.Handler) (addr string) {
+	t.Helper()
+
+	tlsConf, _ := createServerTLSConfig(t, "127.0.0.1")
+
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS = tlsConf
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv.Listener.Addr().String()
+}
+
+func TestUpstream_odoh(t *testing.T) {
+	tgt := &testODoHTarget{mu: &sync.Mutex{}}
+	tgt.rotate(t)
+
+	relayed := &atomic.Uint32{}
+	targetAddr := startTestTLSServer(t, tgt)
+	proxyAddr := startTestTLSServer(t, newTestODoHProxy(relayed))
+
+	address := fmt.Sprintf("odoh://%s/dns-query?proxy=https://%s/proxy", targetAddr, proxyAddr)
+	u, err := AddressToUpstream(address, &Options{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	checkUpstream(t, u, address)
+	checkUpstream(t, u, address)
+
+	assert.Equal(t, uint32(1), tgt.configsFetched.Load())
+	assert.Equal(t, uint32(2), tgt.queries.Load())
+	assert.Equal(t, uint32(2), relayed.Load())
+
+	t.Run("key_rotation", func(t *testing.T) {
+		tgt.rotate(t)
+
+		checkUpstream(t, u, address)
+
+		assert.Equal(t, uint32(2), tgt.configsFetched.Load())
+		assert.Equal(t, uint32(3), tgt.queries.Load())
+	})
+
+	t.Run("bad_param", func(t *testing.T) {
+		_, err = AddressToUpstream("odoh://"+targetAddr+"/dns-query?relay=1", nil)
+		assert.Error(t, err)
+
+		_, err = AddressToUpstream("odoh://"+targetAddr+"/dns-query?proxy=http://"+proxyAddr, nil)
+		assert.Error(t, err)
+	})
+}
@@ -182,3 +182,39 @@ func LookupParallel(
 ) (addrs []netip.Addr, err error) {
 	return ParallelResolver(resolvers).LookupNetIP(ctx, "ip", host)
 }
+
+// WarmUp exchanges a request for the root name servers with each of ups in
+// parallel, which makes them resolve their hostnames using the bootstrap,
+// perform the TLS or QUIC handshakes, and fetch the DNSCrypt certificates, so
+// that the subsequent requests don't wait for that.  Any response is
+// considered successful.  It returns the joined errors of the upstreams that
+// failed.
+func WarmUp(ups []Upstream) (err error) {
+	req := (&dns.Msg{}).SetQuestion(".", dns.TypeNS)
+
+	errCh := make(chan error, len(ups))
+	for _, u := range ups {
+		go func() {
+			defer log.OnPanic("upstream: warming up")
+
+			_, exchErr := exchangeAndLog(u, req)
+			if errors.Is(exchErr, ErrIterativeQType) {
+				// The iterative upstream has no connections to establish.
+				exchErr = nil
+			} else if exchErr != nil {
+				exchErr = fmt.Errorf("warming up %s: %w", u.Address(), exchErr)
+			}
+
+			errCh <- exchErr
+		}()
+	}
+
+	var errs []error
+	for range ups {
+		if exchErr := <-errCh; exchErr != nil {
+			errs = append(errs, exchErr)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -189,3 +189,19 @@ func TestExchangeAll(t *testing.T) {
 	ip = resp.Answer[0].(*dns.A).A
 	assert.Equal(t, delayedAnsAddr.AsSlice(), []byte(ip))
 }
+
+func TestWarmUp(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		err := WarmUp([]Upstream{&testUpstream{}, &testUpstream{empty: true}})
+		assert.NoError(t, err)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		err := WarmUp([]Upstream{&testUpstream{}, &testUpstream{err: true}})
+		assert.ErrorContains(t, err, "upstream error")
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		assert.NoError(t, WarmUp(nil))
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -42,10 +43,36 @@ type plainDNS struct {
 
 	// timeout is the timeout for DNS requests.
 	timeout time.Duration
+
+	// maxUDPSize, if not zero, is the maximum UDP payload size advertised in
+	// the queries.
+	maxUDPSize uint16
+
+	// spoof, if not nil, detects the spoofed responses over UDP.
+	spoof *SpoofDetector
+
+	// pool, if not nil, is the pool of the UDP sockets reused across the
+	// queries.  It's only used when spoof is nil, since the spoofing detection
+	// keeps reading from the socket after the exchange.
+	pool *udpPool
+
+	// udpOnly disables falling back to TCP.
+	udpOnly bool
 }
 
+const (
+	// queryKeyTransport is the URL query key of the transport hint for plain
+	// upstreams.  Its value is either [networkUDP] or [networkTCP].
+	queryKeyTransport = "transport"
+
+	// queryKeyUDPSize is the URL query key of the maximum UDP payload size
+	// advertised to plain upstreams.
+	queryKeyUDPSize = "udp-size"
+)
+
 // newPlain returns the plain DNS Upstream.  addr.Scheme should be either "udp"
-// or "tcp".
+// or "tcp".  The transport hints, described in [AddressToUpstream], are parsed
+// from the query of addr, which is removed afterwards.
 func newPlain(addr *url.URL, opts *Options) (u *plainDNS, err error) {
 	switch addr.Scheme {
 	case networkUDP, networkTCP:
@@ -54,14 +81,73 @@ func newPlain(addr *url.URL, opts *Options) (u *plainDNS, err error) {
 		return nil, fmt.Errorf("unsupported url scheme: %s", addr.Scheme)
 	}
 
+	u = &plainDNS{
+		net:     addr.Scheme,
+		timeout: opts.Timeout,
+		spoof:   opts.SpoofDetector,
+	}
+
+	err = u.setHints(addr.Query())
+	if err != nil {
+		return nil, fmt.Errorf("parsing hints of %s: %w", addr, err)
+	}
+
+	addr.RawQuery = ""
+	if u.net == networkTCP {
+		addr.Scheme = networkTCP
+	}
+
 	addPort(addr, defaultPortPlain)
 
-	return &plainDNS{
-		addr:      addr,
-		getDialer: newDialerInitializer(addr, opts),
-		net:       addr.Scheme,
-		timeout:   opts.Timeout,
-	}, nil
+	if u.net == networkUDP && u.spoof == nil && opts.UDPPoolSize > 0 {
+		u.pool = newUDPPool(opts.UDPPoolSize)
+	}
+
+	u.addr = addr
+	u.getDialer = newDialerInitializer(addr, opts)
+
+	return u, nil
+}
+
+// setHints sets the transport hints from q to p.
+func (p *plainDNS) setHints(q url.Values) (err error) {
+	for k := range q {
+		switch k {
+		case queryKeyTransport, queryKeyUDPSize:
+			// Go on.
+		default:
+			return fmt.Errorf("unknown hint %q", k)
+		}
+	}
+
+	switch tr := q.Get(queryKeyTransport); tr {
+	case "":
+		// Go on.
+	case networkTCP:
+		p.net = networkTCP
+	case networkUDP:
+		if p.net != networkUDP {
+			return fmt.Errorf("%s: %q conflicts with scheme %q", queryKeyTransport, tr, p.net)
+		}
+
+		p.udpOnly = true
+	default:
+		return fmt.Errorf("%s: unsupported value %q", queryKeyTransport, tr)
+	}
+
+	if sizeStr := q.Get(queryKeyUDPSize); sizeStr != "" {
+		var size uint64
+		size, err = strconv.ParseUint(sizeStr, 10, 16)
+		if err != nil {
+			return fmt.Errorf("%s: %w", queryKeyUDPSize, err)
+		} else if size < dns.MinMsgSize {
+			return fmt.Errorf("%s: %d is less than %d", queryKeyUDPSize, size, dns.MinMsgSize)
+		}
+
+		p.maxUDPSize = uint16(size)
+	}
+
+	return nil
 }
 
 // type check
@@ -140,9 +226,17 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 
 	addr := p.Address()
 
-	resp, err = p.dialExchange(p.net, dial, req)
-	if p.net != networkUDP {
-		// The network is already TCP.
+	switch {
+	case p.net == networkUDP && p.spoof != nil:
+		resp, err = p.exchangeWatched(dial, p.limitUDPSize(req))
+	case p.net == networkUDP && p.pool != nil:
+		resp, err = p.exchangePooled(dial, p.limitUDPSize(req))
+	default:
+		resp, err = p.dialExchange(p.net, dial, p.limitUDPSize(req))
+	}
+
+	if p.net != networkUDP || p.udpOnly {
+		// The network is already TCP or falling back to it is disabled.
 		return resp, err
 	}
 
@@ -168,9 +262,27 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	return resp, err
 }
 
+// limitUDPSize returns req with the advertised UDP payload size limited to
+// p.maxUDPSize.  req itself is returned if it's already within the limit.
+func (p *plainDNS) limitUDPSize(req *dns.Msg) (limited *dns.Msg) {
+	opt := req.IsEdns0()
+	if p.maxUDPSize == 0 || opt == nil || opt.UDPSize() <= p.maxUDPSize {
+		return req
+	}
+
+	limited = req.Copy()
+	limited.IsEdns0().SetUDPSize(p.maxUDPSize)
+
+	return limited
+}
+
 // Close implements the [Upstream] interface for *plainDNS.
 func (p *plainDNS) Close() (err error) {
-	return nil
+	if p.pool == nil {
+		return nil
+	}
+
+	return p.pool.close()
 }
 
 // errQuestion is returned when a message has malformed question section.
@@ -36,6 +36,30 @@ func TestUpstream_plainDNS(t *testing.T) {
 	}
 }
 
+func TestUpstream_plainDNS_fastOpen(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		err := w.WriteMsg(respondToTestMessage(req))
+
+		pt := testutil.PanicT{}
+		require.NoError(pt, err)
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	fo := NewFastOpen()
+	addr := fmt.Sprintf("tcp://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{FastOpen: fo})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	// The server doesn't enable TCP Fast Open, so the data is sent after the
+	// handshake.
+	for range 3 {
+		checkUpstream(t, u, addr)
+	}
+
+	assert.Zero(t, fo.Hits())
+}
+
 func TestUpstream_plainDNS_badID(t *testing.T) {
 	req := createTestMessage()
 	badIDResp := respondToTestMessage(req)
@@ -138,6 +162,133 @@ func TestUpstream_plainDNS_fallbackToTCP(t *testing.T) {
 	}
 }
 
+func TestUpstream_plainDNS_hints(t *testing.T) {
+	req := createTestMessage()
+	req.SetEdns0(4096, false)
+
+	goodResp := respondToTestMessage(req)
+
+	truncResp := goodResp.Copy()
+	truncResp.Truncated = true
+
+	var udpReqNum, tcpReqNum atomic.Uint32
+	var udpSize atomic.Uint32
+	srv := startDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := goodResp
+		if w.RemoteAddr().Network() == networkUDP {
+			udpReqNum.Add(1)
+			udpSize.Store(uint32(r.IsEdns0().UDPSize()))
+			resp = truncResp
+		} else {
+			tcpReqNum.Add(1)
+		}
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	testCases := []struct {
+		name        string
+		query       string
+		wantAddr    string
+		wantUDP     int
+		wantTCP     int
+		wantUDPSize int
+		wantTrunc   bool
+	}{{
+		name:        "none",
+		query:       "",
+		wantAddr:    "127.0.0.1:%d",
+		wantUDP:     1,
+		wantTCP:     1,
+		wantUDPSize: 4096,
+		wantTrunc:   false,
+	}, {
+		name:        "tcp",
+		query:       "transport=tcp",
+		wantAddr:    "tcp://127.0.0.1:%d",
+		wantUDP:     0,
+		wantTCP:     1,
+		wantUDPSize: 0,
+		wantTrunc:   false,
+	}, {
+		name:        "udp",
+		query:       "transport=udp",
+		wantAddr:    "127.0.0.1:%d",
+		wantUDP:     1,
+		wantTCP:     0,
+		wantUDPSize: 4096,
+		wantTrunc:   true,
+	}, {
+		name:        "udp_size",
+		query:       "transport=udp&udp-size=1232",
+		wantAddr:    "127.0.0.1:%d",
+		wantUDP:     1,
+		wantTCP:     0,
+		wantUDPSize: 1232,
+		wantTrunc:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			udpReqNum.Store(0)
+			tcpReqNum.Store(0)
+			udpSize.Store(0)
+
+			addr := fmt.Sprintf("udp://127.0.0.1:%d?%s", srv.port, tc.query)
+			u, err := AddressToUpstream(addr, &Options{
+				// Use a shorter timeout to speed up the test.
+				Timeout: 100 * time.Millisecond,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			assert.Equal(t, fmt.Sprintf(tc.wantAddr, srv.port), u.Address())
+
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+
+			assert.Equal(t, tc.wantTrunc, resp.Truncated)
+			assert.Equal(t, tc.wantUDP, int(udpReqNum.Load()))
+			assert.Equal(t, tc.wantTCP, int(tcpReqNum.Load()))
+			assert.Equal(t, tc.wantUDPSize, int(udpSize.Load()))
+
+			// The request must not be modified.
+			assert.Equal(t, uint16(4096), req.IsEdns0().UDPSize())
+		})
+	}
+}
+
+func TestUpstream_plainDNS_badHints(t *testing.T) {
+	testCases := []struct {
+		addr       string
+		wantErrMsg string
+	}{{
+		addr:       "udp://1.1.1.1?foo=bar",
+		wantErrMsg: `parsing hints of udp://1.1.1.1?foo=bar: unknown hint "foo"`,
+	}, {
+		addr: "tcp://1.1.1.1?transport=udp",
+		wantErrMsg: `parsing hints of tcp://1.1.1.1?transport=udp: ` +
+			`transport: "udp" conflicts with scheme "tcp"`,
+	}, {
+		addr: "udp://1.1.1.1?transport=quic",
+		wantErrMsg: `parsing hints of udp://1.1.1.1?transport=quic: ` +
+			`transport: unsupported value "quic"`,
+	}, {
+		addr: "udp://1.1.1.1?udp-size=100",
+		wantErrMsg: `parsing hints of udp://1.1.1.1?udp-size=100: ` +
+			`udp-size: 100 is less than 512`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.addr, func(t *testing.T) {
+			_, err := AddressToUpstream(tc.addr, nil)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
 // testDNSServer is a simple DNS server that can be used in unit-tests.
 type testDNSServer struct {
 	udpListener net.PacketConn
@@ -0,0 +1,59 @@
+package upstream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MinPortRangeLen is the minimum number of ports in a [PortRange] parsed by
+// [ParsePortRange].  The narrower ranges make the source ports of the queries
+// too predictable for an attacker spoofing the responses, see RFC 5452
+// Section 9.2.
+const MinPortRangeLen = 1024
+
+// PortRange is an inclusive range of the local ports.
+type PortRange struct {
+	// First is the first port of the range.
+	First uint16
+
+	// Last is the last port of the range.  It must not be less than First.
+	Last uint16
+}
+
+// ParsePortRange parses the port range from s in the "first-last" form, e.g.
+// "40000-49999".  The range must contain at least [MinPortRangeLen] ports.
+func ParsePortRange(s string) (r *PortRange, err error) {
+	firstStr, lastStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("port range %q: no separator", s)
+	}
+
+	first, err := strconv.ParseUint(firstStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("port range %q: first port: %w", s, err)
+	}
+
+	last, err := strconv.ParseUint(lastStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("port range %q: last port: %w", s, err)
+	}
+
+	if first == 0 {
+		return nil, fmt.Errorf("port range %q: first port must be positive", s)
+	} else if last < first {
+		return nil, fmt.Errorf("port range %q: last port is less than first", s)
+	} else if n := last - first + 1; n < MinPortRangeLen {
+		return nil, fmt.Errorf("port range %q: %d ports is less than %d", s, n, MinPortRangeLen)
+	}
+
+	return &PortRange{
+		First: uint16(first),
+		Last:  uint16(last),
+	}, nil
+}
+
+// String implements the [fmt.Stringer] interface for *PortRange.
+func (r *PortRange) String() (s string) {
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
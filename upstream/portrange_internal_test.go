@@ -0,0 +1,89 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePortRange(t *testing.T) {
+	testCases := []struct {
+		want       *PortRange
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		want:       &PortRange{First: 40000, Last: 49999},
+		name:       "valid",
+		in:         "40000-49999",
+		wantErrMsg: "",
+	}, {
+		want:       &PortRange{First: 1, Last: 65535},
+		name:       "full",
+		in:         "1-65535",
+		wantErrMsg: "",
+	}, {
+		want:       nil,
+		name:       "single",
+		in:         "40000",
+		wantErrMsg: `port range "40000": no separator`,
+	}, {
+		want:       nil,
+		name:       "reversed",
+		in:         "49999-40000",
+		wantErrMsg: `port range "49999-40000": last port is less than first`,
+	}, {
+		want:       nil,
+		name:       "narrow",
+		in:         "40000-40099",
+		wantErrMsg: `port range "40000-40099": 100 ports is less than 1024`,
+	}, {
+		want:       nil,
+		name:       "zero",
+		in:         "0-2000",
+		wantErrMsg: `port range "0-2000": first port must be positive`,
+	}, {
+		want: nil,
+		name: "bad_port",
+		in:   "40000-70000",
+		wantErrMsg: `port range "40000-70000": last port: strconv.ParseUint: ` +
+			`parsing "70000": value out of range`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := ParsePortRange(tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, r)
+		})
+	}
+}
+
+func TestUpstream_plainDNS_portRange(t *testing.T) {
+	r := &PortRange{First: 42000, Last: 43023}
+
+	ports := make(chan int, 1)
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		ports <- w.RemoteAddr().(*net.UDPAddr).Port
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{UDPPortRange: r})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	checkUpstream(t, u, addr)
+
+	port := <-ports
+	assert.GreaterOrEqual(t, port, int(r.First))
+	assert.LessOrEqual(t, port, int(r.Last))
+}
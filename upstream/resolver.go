@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/AdguardTeam/golibs/container"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/bruceluk/dnsproxy/internal/bootstrap"
@@ -40,20 +41,46 @@ type ConsequentResolver = bootstrap.ConsequentResolver
 type UpstreamResolver struct {
 	// Upstream is used for lookups.  It must not be nil.
 	Upstream
+
+	// boot is the bootstrap resolving the hostname of Upstream, if any.  It's
+	// used to detect the bootstrap cycles.
+	boot Resolver
 }
 
+// ErrBootstrapCycle is returned by [NewUpstreamResolver] when the hostname of
+// the bootstrap could only be resolved by itself, directly or through the
+// other bootstraps.
+const ErrBootstrapCycle errors.Error = "bootstrap cycle"
+
 // NewUpstreamResolver creates an upstream that can be used as bootstrap
 // [Resolver].  resolverAddress format is the same as in the
 // [AddressToUpstream].  If the upstream can't be used as a bootstrap, the
 // returned error will have the underlying type of [NotBootstrapError], and r
 // itself will be fully usable.  Closing r.Upstream is caller's responsibility.
+//
+// Only the Bootstrap, Timeout, HTTPVersions, VerifyServerCertificate,
+// VerifyConnection, RootCAs, CipherSuites, InsecureSkipVerify, and PreferIPv6
+// fields of opts are used, the others are ignored.  In particular,
+// InsecureSkipVerify and RootCAs apply to the encrypted bootstraps the same
+// way as to the upstreams.
+//
+// The upstreams with a hostname, e.g. an encrypted one, are only considered
+// valid bootstraps if opts.Bootstrap is set, since it resolves the hostname.
+// If opts.Bootstrap depends on a bootstrap with the same address, directly or
+// through the bootstraps of its own bootstraps, e.g. A is resolved by B, which
+// is resolved by A, the error is [ErrBootstrapCycle] and r is nil.
 func NewUpstreamResolver(resolverAddress string, opts *Options) (r *UpstreamResolver, err error) {
 	upsOpts := &Options{}
 
-	// TODO(ameshkov):  Aren't other options needed here?
 	if opts != nil {
+		upsOpts.Bootstrap = opts.Bootstrap
 		upsOpts.Timeout = opts.Timeout
+		upsOpts.HTTPVersions = opts.HTTPVersions
 		upsOpts.VerifyServerCertificate = opts.VerifyServerCertificate
+		upsOpts.VerifyConnection = opts.VerifyConnection
+		upsOpts.RootCAs = opts.RootCAs
+		upsOpts.CipherSuites = opts.CipherSuites
+		upsOpts.InsecureSkipVerify = opts.InsecureSkipVerify
 		upsOpts.PreferIPv6 = opts.PreferIPv6
 	}
 
@@ -65,7 +92,69 @@ func NewUpstreamResolver(resolverAddress string, opts *Options) (r *UpstreamReso
 		return nil, err
 	}
 
-	return &UpstreamResolver{Upstream: ups}, validateBootstrap(ups)
+	r = &UpstreamResolver{Upstream: ups}
+	if upsOpts.Bootstrap == nil {
+		return r, validateBootstrap(ups)
+	}
+
+	path := bootstrapPath(upsOpts.Bootstrap, ups.Address(), container.NewMapSet[*UpstreamResolver]())
+	if path != nil {
+		err = fmt.Errorf(
+			"%w: %s",
+			ErrBootstrapCycle,
+			strings.Join(append([]string{ups.Address()}, path...), " -> "),
+		)
+
+		return nil, errors.WithDeferred(err, ups.Close())
+	}
+
+	r.boot = upsOpts.Bootstrap
+
+	return r, nil
+}
+
+// bootstrapPath returns the addresses of the bootstraps on the way from boot to
+// the one with addr, if boot depends on it, recursively.  seen are the visited
+// resolvers, so that each of them is only checked once.
+func bootstrapPath(
+	boot Resolver,
+	addr string,
+	seen *container.MapSet[*UpstreamResolver],
+) (path []string) {
+	var next []Resolver
+	switch boot := boot.(type) {
+	case *UpstreamResolver:
+		if seen.Has(boot) {
+			return nil
+		}
+
+		seen.Add(boot)
+		if boot.Address() == addr {
+			return []string{addr}
+		}
+
+		if subPath := bootstrapPath(boot.boot, addr, seen); subPath != nil {
+			return append([]string{boot.Address()}, subPath...)
+		}
+
+		return nil
+	case *CachingResolver:
+		next = []Resolver{boot.resolver}
+	case ParallelResolver:
+		next = boot
+	case ConsequentResolver:
+		next = boot
+	default:
+		return nil
+	}
+
+	for _, r := range next {
+		if path = bootstrapPath(r, addr, seen); path != nil {
+			return path
+		}
+	}
+
+	return nil
 }
 
 // NotBootstrapError is returned by [AddressToUpstream] when the parsed upstream
@@ -0,0 +1,223 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bluele/gcache"
+)
+
+// defaultSessionCacheSize is the default maximum number of sessions stored in
+// a [TLSSessionCache].
+const defaultSessionCacheSize = 256
+
+// TLSSessionCache is a TLS client session cache shared by the encrypted
+// upstreams.  Since the sessions are keyed by the server name, the upstreams
+// with the same host resume each other's sessions, and, if the cache is
+// persisted to disk, the sessions survive restarts.  This saves a round trip
+// on every reconnect and also allows 0-RTT for the QUIC-based upstreams.
+//
+// The sessions of different protocols are kept apart, since the servers are
+// unlikely to accept them interchangeably.  It's safe for concurrent use.
+type TLSSessionCache struct {
+	// mu protects saving and loading of the cache.
+	mu *sync.Mutex
+
+	cache gcache.Cache
+	path  string
+}
+
+// NewTLSSessionCache returns a new *TLSSessionCache storing up to size
+// sessions.  If size isn't positive, a default value is used.  If path is not
+// empty, the sessions are loaded from the file at path, if it exists, and
+// [TLSSessionCache.Save] writes them there.
+func NewTLSSessionCache(size int, path string) (c *TLSSessionCache, err error) {
+	if size <= 0 {
+		size = defaultSessionCacheSize
+	}
+
+	c = &TLSSessionCache{
+		mu:    &sync.Mutex{},
+		cache: gcache.New(size).LRU().Build(),
+		path:  path,
+	}
+
+	if path == "" {
+		return c, nil
+	}
+
+	err = c.load()
+	if err != nil {
+		return nil, fmt.Errorf("loading tls sessions: %w", err)
+	}
+
+	return c, nil
+}
+
+// persistedSession is the serialized form of a TLS session.
+type persistedSession struct {
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+// load reads the sessions from the file at c.path.  A missing file isn't an
+// error, and the invalid sessions are skipped.
+func (c *TLSSessionCache) load() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	sessions := map[string]*persistedSession{}
+	err = json.Unmarshal(data, &sessions)
+	if err != nil {
+		return fmt.Errorf("decoding: %w", err)
+	}
+
+	for key, s := range sessions {
+		state, parseErr := tls.ParseSessionState(s.State)
+		if parseErr != nil {
+			log.Debug("tls session cache: parsing session for %q: %s", key, parseErr)
+
+			continue
+		}
+
+		cs, resErr := tls.NewResumptionState(s.Ticket, state)
+		if resErr != nil {
+			log.Debug("tls session cache: restoring session for %q: %s", key, resErr)
+
+			continue
+		}
+
+		c.set(key, cs)
+	}
+
+	log.Debug("tls session cache: loaded %d sessions", c.cache.Len(false))
+
+	return nil
+}
+
+// Save writes the sessions to the file the cache has been created with, if
+// any.
+func (c *TLSSessionCache) Save() (err error) {
+	if c.path == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sessions := map[string]*persistedSession{}
+	for k, v := range c.cache.GetALL(true) {
+		cs := v.(*tls.ClientSessionState)
+
+		ticket, state, resErr := cs.ResumptionState()
+		if resErr != nil || state == nil {
+			continue
+		}
+
+		stateData, encErr := state.Bytes()
+		if encErr != nil {
+			continue
+		}
+
+		sessions[k.(string)] = &persistedSession{
+			Ticket: ticket,
+			State:  stateData,
+		}
+	}
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return fmt.Errorf("encoding tls sessions: %w", err)
+	}
+
+	// Write the file atomically, since the sessions are secret and a partial
+	// file is useless anyway.
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	_, err = tmp.Write(data)
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("writing tls sessions: %w", err), os.Remove(tmp.Name()))
+	}
+
+	return nil
+}
+
+// set stores cs under key.
+func (c *TLSSessionCache) set(key string, cs *tls.ClientSessionState) {
+	err := c.cache.Set(key, cs)
+	if err != nil {
+		// Shouldn't happen, since we don't set a serialization function.
+		panic(fmt.Errorf("tls session cache: setting item: %w", err))
+	}
+}
+
+// forProto returns a [tls.ClientSessionCache] storing the sessions of the
+// protocol proto within c.  If c is nil, it returns a new LRU cache private to
+// the caller.
+func (c *TLSSessionCache) forProto(proto string) (cache tls.ClientSessionCache) {
+	if c == nil {
+		// Use the default capacity for the LRU cache.  It may be useful to
+		// store several caches since the user may be routed to different
+		// servers in case there's load balancing on the server-side.
+		return tls.NewLRUClientSessionCache(0)
+	}
+
+	return &protoSessionCache{
+		cache:  c,
+		prefix: proto + "|",
+	}
+}
+
+// protoSessionCache is a view of a [TLSSessionCache] for a single protocol.
+type protoSessionCache struct {
+	cache  *TLSSessionCache
+	prefix string
+}
+
+// type check
+var _ tls.ClientSessionCache = (*protoSessionCache)(nil)
+
+// Get implements the [tls.ClientSessionCache] interface for
+// *protoSessionCache.
+func (c *protoSessionCache) Get(sessionKey string) (cs *tls.ClientSessionState, ok bool) {
+	v, err := c.cache.cache.Get(c.prefix + sessionKey)
+	if err != nil {
+		return nil, false
+	}
+
+	return v.(*tls.ClientSessionState), true
+}
+
+// Put implements the [tls.ClientSessionCache] interface for
+// *protoSessionCache.
+func (c *protoSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	if cs == nil {
+		c.cache.cache.Remove(c.prefix + sessionKey)
+
+		return
+	}
+
+	c.cache.set(c.prefix+sessionKey, cs)
+}
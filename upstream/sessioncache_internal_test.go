@@ -0,0 +1,54 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSSessionCache(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		pt := testutil.PanicT{}
+		require.NoError(pt, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	// exchange creates a new upstream using a cache loaded from path, makes a
+	// single exchange, and returns true if the session has been resumed.
+	exchange := func(t *testing.T) (resumed bool) {
+		t.Helper()
+
+		c, err := NewTLSSessionCache(0, path)
+		require.NoError(t, err)
+
+		didResume := &atomic.Bool{}
+		u, err := AddressToUpstream(addr, &Options{
+			VerifyConnection: func(state tls.ConnectionState) (err error) {
+				didResume.Store(state.DidResume)
+
+				return nil
+			},
+			TLSSessionCache:    c,
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err)
+
+		checkUpstream(t, u, addr)
+		require.NoError(t, u.Close())
+		require.NoError(t, c.Save())
+
+		return didResume.Load()
+	}
+
+	assert.False(t, exchange(t))
+	assert.True(t, exchange(t))
+}
@@ -0,0 +1,179 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/internal/bootstrap"
+	"github.com/miekg/dns"
+)
+
+// SpoofDetector detects the likely spoofed responses of the plain UDP
+// upstreams.  After receiving the first response, the upstream keeps reading
+// from its socket for a short time window.  A second response with the same ID
+// but different content is a strong signal of an injection, since the
+// injected response usually arrives before the one from the actual server.
+// It's safe for concurrent use.
+type SpoofDetector struct {
+	// mu protects counts.
+	mu *sync.Mutex
+
+	// counts are the numbers of the detected spoofing attempts keyed by the
+	// upstream address.
+	counts map[string]uint64
+
+	// window is the time to wait for the other responses after the first one.
+	window time.Duration
+
+	// preferLater makes the upstreams wait for the whole window and return the
+	// later response, if any.
+	preferLater bool
+}
+
+// NewSpoofDetector returns a new *SpoofDetector waiting for the other responses
+// for window, which must be positive.  If preferLater is true, the upstreams
+// return the later of the different responses, which is more likely to come
+// from the actual server, at the cost of delaying every UDP response by window.
+// Otherwise, the first response is returned immediately and the socket is
+// watched in the background.
+func NewSpoofDetector(window time.Duration, preferLater bool) (d *SpoofDetector) {
+	return &SpoofDetector{
+		mu:          &sync.Mutex{},
+		counts:      map[string]uint64{},
+		window:      window,
+		preferLater: preferLater,
+	}
+}
+
+// Counts returns the numbers of the detected spoofing attempts keyed by the
+// upstream address.  The upstreams without those aren't included.
+func (d *SpoofDetector) Counts() (counts map[string]uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return maps.Clone(d.counts)
+}
+
+// record accounts a spoofing attempt for the request with question q to the
+// upstream with address addr.
+func (d *SpoofDetector) record(addr string, q *dns.Question) {
+	log.Info("plain %s: different responses for %s, possibly spoofed", addr, q)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.counts[addr]++
+}
+
+// watch reads the responses to req from conn until the window ends and
+// returns the last one, which differs from the first response packed into
+// first, or nil if there is no such response.  conn is closed afterwards.
+func (d *SpoofDetector) watch(addr string, conn *dns.Conn, req *dns.Msg, first []byte) (later *dns.Msg) {
+	defer log.OnPanic("plain: watching for spoofed responses")
+	defer func() {
+		err := conn.Close()
+		if err != nil {
+			log.Debug("plain %s: closing watched conn: %s", addr, err)
+		}
+	}()
+
+	err := conn.SetReadDeadline(time.Now().Add(d.window))
+	if err != nil {
+		log.Debug("plain %s: setting watch deadline: %s", addr, err)
+
+		return nil
+	}
+
+	for {
+		var resp *dns.Msg
+		resp, err = conn.ReadMsg()
+		if netErr := net.Error(nil); errors.As(err, &netErr) {
+			// Most likely, the window has ended.
+			return later
+		} else if err != nil {
+			// Skip the malformed messages.
+			continue
+		}
+
+		if isDifferentResponse(req, resp, first) {
+			d.record(addr, &req.Question[0])
+			later = resp
+		}
+	}
+}
+
+// isDifferentResponse returns true if resp is a valid response to req
+// differing from the response packed into first.
+func isDifferentResponse(req, resp *dns.Msg, first []byte) (ok bool) {
+	if resp.Id != req.Id || validatePlainResponse(req, resp) != nil {
+		return false
+	}
+
+	data, err := resp.Pack()
+
+	return err == nil && !bytes.Equal(data, first)
+}
+
+// exchangeWatched performs a DNS exchange over UDP with the specified dial
+// handler and watches the socket for the other responses with p.spoof.
+func (p *plainDNS) exchangeWatched(
+	dial bootstrap.DialHandler,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	addr := p.Address()
+
+	logBegin(addr, networkUDP, req)
+	defer func() { logFinish(addr, networkUDP, err) }()
+
+	conn := &dns.Conn{UDPSize: dns.MinMsgSize}
+	conn.Conn, err = dial(context.Background(), networkUDP, "")
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s over %s: %w", p.addr.Host, networkUDP, err)
+	}
+
+	client := &dns.Client{Timeout: p.timeout}
+	resp, _, err = client.ExchangeWithConn(req, conn)
+	if err != nil {
+		err = fmt.Errorf("exchanging with %s over %s: %w", addr, networkUDP, err)
+
+		return resp, errors.WithDeferred(err, conn.Close())
+	}
+
+	err = validatePlainResponse(req, resp)
+	if err != nil {
+		return resp, errors.WithDeferred(err, conn.Close())
+	}
+
+	// Pack the response and copy the question before returning, since the
+	// caller may modify the messages while the socket is being watched.
+	first, packErr := resp.Pack()
+	if packErr != nil {
+		log.Debug("plain %s: packing response: %s", addr, packErr)
+
+		return resp, conn.Close()
+	}
+
+	watched := &dns.Msg{
+		MsgHdr:   dns.MsgHdr{Id: req.Id},
+		Question: []dns.Question{req.Question[0]},
+	}
+
+	if !p.spoof.preferLater {
+		go p.spoof.watch(addr, conn, watched, first)
+
+		return resp, nil
+	}
+
+	if later := p.spoof.watch(addr, conn, watched, first); later != nil {
+		return later, nil
+	}
+
+	return resp, nil
+}
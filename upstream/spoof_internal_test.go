@@ -0,0 +1,99 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoofDetector(t *testing.T) {
+	spoofedIP, realIP := net.IP{192, 0, 2, 1}, net.IP{8, 8, 8, 8}
+
+	// newServer starts a test server responding to each request twice, first
+	// with the first IP address, then with the second one.
+	newServer := func(t *testing.T, first, second net.IP) (addr string) {
+		t.Helper()
+
+		srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			pt := testutil.PanicT{}
+
+			for _, ip := range []net.IP{first, second} {
+				resp := respondToTestMessage(req)
+				resp.Answer[0].(*dns.A).A = ip
+
+				require.NoError(pt, w.WriteMsg(resp))
+			}
+		})
+		testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+		return fmt.Sprintf("127.0.0.1:%d", srv.port)
+	}
+
+	const window = 100 * time.Millisecond
+
+	testCases := []struct {
+		name        string
+		second      net.IP
+		wantIP      net.IP
+		wantCount   uint64
+		preferLater bool
+	}{{
+		name:        "spoofed",
+		second:      realIP,
+		wantIP:      spoofedIP,
+		wantCount:   1,
+		preferLater: false,
+	}, {
+		name:        "spoofed_prefer_later",
+		second:      realIP,
+		wantIP:      realIP,
+		wantCount:   1,
+		preferLater: true,
+	}, {
+		name:        "duplicate",
+		second:      spoofedIP,
+		wantIP:      spoofedIP,
+		wantCount:   0,
+		preferLater: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := newServer(t, spoofedIP, tc.second)
+			d := NewSpoofDetector(window, tc.preferLater)
+
+			u, err := AddressToUpstream(addr, &Options{
+				Timeout:       timeout,
+				SpoofDetector: d,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			req := createTestMessage()
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			require.Len(t, resp.Answer, 1)
+
+			a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+			assert.Equal(t, tc.wantIP.To4(), a.A.To4())
+
+			if tc.wantCount == 0 {
+				// Wait for the window to end to make sure nothing is counted.
+				time.Sleep(2 * window)
+				assert.Empty(t, d.Counts())
+
+				return
+			}
+
+			assert.Eventually(t, func() (ok bool) {
+				return d.Counts()[addr] == tc.wantCount
+			}, 2*window, window/10)
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package upstream
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/ameshkov/dnsstamps"
+)
+
+// Stamp is the human-readable description of a DNS stamp, see
+// https://dnscrypt.info/stamps-specifications.
+type Stamp struct {
+	// Address is the address of the upstream in the format accepted by
+	// [AddressToUpstream].  It's the stamp itself for the DNSCrypt stamps,
+	// since those have no other representation.
+	Address string
+
+	// ServerAddr is the IP address of the server used to bootstrap the
+	// upstream.  It's invalid if the stamp doesn't specify it.
+	ServerAddr netip.Addr
+
+	// Hashes are the hexadecimal SHA256 digests of the certificates in the
+	// validation chain of the server.
+	Hashes []string
+
+	// DNSSEC is true if the server validates DNSSEC.
+	DNSSEC bool
+
+	// NoLog is true if the server doesn't log the requests.
+	NoLog bool
+
+	// NoFilter is true if the server doesn't intentionally block domains.
+	NoFilter bool
+}
+
+// DecodeStamp parses the DNS stamp s, which must start with "sdns://", the same
+// way [AddressToUpstream] does.
+func DecodeStamp(s string) (st *Stamp, err error) {
+	stamp, err := dnsstamps.NewServerStampFromString(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", s, err)
+	}
+
+	st = &Stamp{
+		DNSSEC:   stamp.Props&dnsstamps.ServerInformalPropertyDNSSEC != 0,
+		NoLog:    stamp.Props&dnsstamps.ServerInformalPropertyNoLog != 0,
+		NoFilter: stamp.Props&dnsstamps.ServerInformalPropertyNoFilter != 0,
+	}
+
+	for _, h := range stamp.Hashes {
+		st.Hashes = append(st.Hashes, hex.EncodeToString(h))
+	}
+
+	// TODO(e.burkov):  Port?
+	if stamp.ServerAddrStr != "" {
+		host, _, sErr := netutil.SplitHostPort(stamp.ServerAddrStr)
+		if sErr != nil {
+			host = stamp.ServerAddrStr
+		}
+
+		st.ServerAddr, err = netip.ParseAddr(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server stamp address %s", stamp.ServerAddrStr)
+		}
+	}
+
+	var u *url.URL
+	switch stamp.Proto {
+	case dnsstamps.StampProtoTypePlain:
+		u = &url.URL{Scheme: "udp", Host: stamp.ServerAddrStr}
+	case dnsstamps.StampProtoTypeDNSCrypt:
+		st.Address = s
+
+		return st, nil
+	case dnsstamps.StampProtoTypeDoH:
+		u = &url.URL{Scheme: "https", Host: stamp.ProviderName, Path: stamp.Path}
+	case dnsstamps.StampProtoTypeDoQ:
+		u = &url.URL{Scheme: "quic", Host: stamp.ProviderName, Path: stamp.Path}
+	case dnsstamps.StampProtoTypeTLS:
+		u = &url.URL{Scheme: "tls", Host: stamp.ProviderName}
+	default:
+		return nil, fmt.Errorf("unsupported stamp protocol %s", &stamp.Proto)
+	}
+
+	st.Address = u.String()
+
+	return st, nil
+}
+
+// EncodeStamp returns the DNS stamp described by st.  st.Address is parsed the
+// same way [AddressToUpstream] does, but only the plain DNS, DNS-over-TLS,
+// DNS-over-HTTPS, and DNS-over-QUIC upstreams can be encoded.  The stamps of
+// plain DNS upstreams require an IP address.  st must not be nil.
+func EncodeStamp(st *Stamp) (s string, err error) {
+	u, err := parseUpstreamURL(st.Address)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return "", err
+	} else if u.Scheme == "sdns" {
+		return "", errors.Error("address is already a stamp")
+	}
+
+	stamp := dnsstamps.ServerStamp{
+		ProviderName: u.Host,
+	}
+
+	if st.DNSSEC {
+		stamp.Props |= dnsstamps.ServerInformalPropertyDNSSEC
+	}
+
+	if st.NoLog {
+		stamp.Props |= dnsstamps.ServerInformalPropertyNoLog
+	}
+
+	if st.NoFilter {
+		stamp.Props |= dnsstamps.ServerInformalPropertyNoFilter
+	}
+
+	for i, h := range st.Hashes {
+		var hash []byte
+		hash, err = hex.DecodeString(h)
+		if err != nil {
+			return "", fmt.Errorf("hash at index %d: %w", i, err)
+		}
+
+		stamp.Hashes = append(stamp.Hashes, hash)
+	}
+
+	host, _, err := netutil.SplitHostPort(u.Host)
+	if err != nil {
+		host = strings.Trim(u.Host, "[]")
+	}
+
+	serverAddr := st.ServerAddr
+	if ip, pErr := netip.ParseAddr(host); pErr == nil && !serverAddr.IsValid() {
+		serverAddr = ip
+	}
+
+	if serverAddr.IsValid() {
+		stamp.ServerAddrStr = serverAddr.String()
+		if serverAddr.Is6() {
+			stamp.ServerAddrStr = "[" + stamp.ServerAddrStr + "]"
+		}
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		if !serverAddr.IsValid() {
+			return "", errors.Error("plain dns stamps require an ip address")
+		}
+
+		stamp.Proto, stamp.ProviderName = dnsstamps.StampProtoTypePlain, ""
+		if port := u.Port(); port != "" {
+			stamp.ServerAddrStr = net.JoinHostPort(serverAddr.String(), port)
+		}
+	case "tls":
+		stamp.Proto = dnsstamps.StampProtoTypeTLS
+	case "https":
+		stamp.Proto, stamp.Path = dnsstamps.StampProtoTypeDoH, u.Path
+	case "quic":
+		stamp.Proto = dnsstamps.StampProtoTypeDoQ
+	default:
+		return "", fmt.Errorf("unsupported stamp url scheme: %s", u.Scheme)
+	}
+
+	return stamp.String(), nil
+}
@@ -0,0 +1,129 @@
+package upstream_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/bruceluk/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeStamp(t *testing.T) {
+	const dnscrypt = "sdns://AQMAAAAAAAAAETk0LjE0MC4xNC4xNDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20"
+
+	testCases := []struct {
+		want  *upstream.Stamp
+		name  string
+		stamp string
+	}{{
+		want: &upstream.Stamp{
+			Address:    "udp://8.8.8.8:53",
+			ServerAddr: netip.MustParseAddr("8.8.8.8"),
+			DNSSEC:     true,
+			NoLog:      true,
+			NoFilter:   true,
+		},
+		name:  "plain",
+		stamp: "sdns://AAcAAAAAAAAABzguOC44Ljg",
+	}, {
+		want: &upstream.Stamp{
+			Address: "tls://dns.adguard.com",
+		},
+		name:  "dot",
+		stamp: "sdns://AwAAAAAAAAAAAAAPZG5zLmFkZ3VhcmQuY29t",
+	}, {
+		want: &upstream.Stamp{
+			Address:    dnscrypt,
+			ServerAddr: netip.MustParseAddr("94.140.14.14"),
+			DNSSEC:     true,
+			NoLog:      true,
+		},
+		name:  "dnscrypt",
+		stamp: dnscrypt,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			st, err := upstream.DecodeStamp(tc.stamp)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, st)
+		})
+	}
+
+	t.Run("bad", func(t *testing.T) {
+		_, err := upstream.DecodeStamp("sdns://!")
+		assert.Error(t, err)
+	})
+}
+
+func TestEncodeStamp(t *testing.T) {
+	testCases := []struct {
+		st   *upstream.Stamp
+		name string
+	}{{
+		st: &upstream.Stamp{
+			Address:    "udp://192.0.2.1:5353",
+			ServerAddr: netip.MustParseAddr("192.0.2.1"),
+			DNSSEC:     true,
+		},
+		name: "plain",
+	}, {
+		st: &upstream.Stamp{
+			Address:    "https://dns.example:8443/dns-query",
+			ServerAddr: netip.MustParseAddr("2001:db8::1"),
+			Hashes:     []string{"0011", "aabb"},
+			NoLog:      true,
+		},
+		name: "doh",
+	}, {
+		st: &upstream.Stamp{
+			Address:    "tls://dns.example",
+			ServerAddr: netip.MustParseAddr("192.0.2.1"),
+		},
+		name: "dot",
+	}, {
+		st: &upstream.Stamp{
+			Address:  "quic://dns.example:853",
+			NoFilter: true,
+		},
+		name: "doq",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := upstream.EncodeStamp(tc.st)
+			require.NoError(t, err)
+
+			st, err := upstream.DecodeStamp(s)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.st, st)
+		})
+	}
+
+	badCases := []struct {
+		st   *upstream.Stamp
+		name string
+	}{{
+		st:   &upstream.Stamp{Address: "udp://dns.example:53"},
+		name: "plain_hostname",
+	}, {
+		st:   &upstream.Stamp{Address: "h3://dns.example/dns-query"},
+		name: "h3",
+	}, {
+		st:   &upstream.Stamp{Address: "sdns://AwAAAAAAAAAAAAAPZG5zLmFkZ3VhcmQuY29t"},
+		name: "stamp",
+	}, {
+		st:   &upstream.Stamp{Address: "tls://dns.example", Hashes: []string{"zz"}},
+		name: "bad_hash",
+	}}
+
+	for _, tc := range badCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := upstream.EncodeStamp(tc.st)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/internal/bootstrap"
+	"github.com/miekg/dns"
+)
+
+const (
+	// udpPoolIdleTimeout is the time after which an idle pooled socket is
+	// closed instead of being reused.  It's the usual timeout of the UDP
+	// conntrack entries without replies, after which the NAT routers may map
+	// the socket to another port anyway.
+	udpPoolIdleTimeout = 30 * time.Second
+
+	// udpPoolMaxUses is the number of queries after which a pooled socket is
+	// recycled, so that its source port doesn't stay the same for long and
+	// still adds to the entropy against the response spoofing.
+	udpPoolMaxUses = 1000
+)
+
+// pooledConn is a UDP socket of a [udpPool].
+type pooledConn struct {
+	// conn is the socket connected to the upstream.
+	conn *dns.Conn
+
+	// lastUsed is the time the socket was returned to the pool.
+	lastUsed time.Time
+
+	// uses is the number of queries sent over the socket.
+	uses uint
+}
+
+// udpPool is a bounded pool of the UDP sockets connected to a plain upstream,
+// which are reused across the queries instead of opening a socket per query.
+// It reduces the number of ephemeral ports in use and the conntrack entries
+// created on the NAT routers.  It's safe for concurrent use.
+type udpPool struct {
+	// now returns the current time.  It's replaced in tests.
+	now func() (t time.Time)
+
+	// mu protects idle and closed.
+	mu *sync.Mutex
+
+	// idle are the sockets not used by any query, the most recently used
+	// last.
+	idle []*pooledConn
+
+	// slots limits the number of the open sockets.
+	slots chan struct{}
+
+	// closed is true if the pool is closed.
+	closed bool
+}
+
+// newUDPPool returns a new *udpPool of at most size sockets.  size must be
+// positive.
+func newUDPPool(size int) (pool *udpPool) {
+	return &udpPool{
+		now:   time.Now,
+		mu:    &sync.Mutex{},
+		slots: make(chan struct{}, size),
+	}
+}
+
+// get returns an idle socket or dials a new one with dial, waiting for a free
+// slot until ctx is done.  pc must be returned with [udpPool.put].
+func (pool *udpPool) get(ctx context.Context, dial bootstrap.DialHandler) (pc *pooledConn, err error) {
+	select {
+	case pool.slots <- struct{}{}:
+		// Go on.
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for pooled socket: %w", ctx.Err())
+	}
+
+	pc = pool.takeIdle()
+	if pc != nil {
+		return pc, nil
+	}
+
+	conn, err := dial(ctx, networkUDP, "")
+	if err != nil {
+		<-pool.slots
+
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return &pooledConn{conn: &dns.Conn{Conn: conn, UDPSize: dns.MinMsgSize}}, nil
+}
+
+// takeIdle returns the most recently used idle socket, if any, closing the
+// ones that should be recycled.
+func (pool *udpPool) takeIdle() (pc *pooledConn) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	now := pool.now()
+	for len(pool.idle) > 0 {
+		last := len(pool.idle) - 1
+		pc, pool.idle = pool.idle[last], pool.idle[:last]
+		if now.Sub(pc.lastUsed) < udpPoolIdleTimeout {
+			return pc
+		}
+
+		closePooled(pc)
+	}
+
+	return nil
+}
+
+// put returns pc taken by [udpPool.get] to the pool.  pc is closed instead if
+// broken is true, i.e. the exchange over it has failed, so that the late
+// responses don't arrive to it, or if it has been used enough.
+func (pool *udpPool) put(pc *pooledConn, broken bool) {
+	defer func() { <-pool.slots }()
+
+	pc.uses++
+	pc.lastUsed = pool.now()
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if broken || pool.closed || pc.uses >= udpPoolMaxUses {
+		closePooled(pc)
+
+		return
+	}
+
+	pool.idle = append(pool.idle, pc)
+}
+
+// close closes the idle sockets and makes the pool close the sockets returned
+// to it afterwards.
+func (pool *udpPool) close() (err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.closed = true
+
+	var errs []error
+	for _, pc := range pool.idle {
+		errs = append(errs, pc.conn.Close())
+	}
+
+	pool.idle = nil
+
+	return errors.Join(errs...)
+}
+
+// closePooled closes pc and logs the error, if any.
+func closePooled(pc *pooledConn) {
+	err := pc.conn.Close()
+	if err != nil {
+		log.Debug("plain: closing pooled socket: %s", err)
+	}
+}
+
+// exchangePooled performs a DNS exchange over UDP with a socket from p.pool,
+// dialing it with the specified dial handler if needed.
+func (p *plainDNS) exchangePooled(
+	dial bootstrap.DialHandler,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	addr := p.Address()
+
+	logBegin(addr, networkUDP, req)
+	defer func() { logFinish(addr, networkUDP, err) }()
+
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	resp, reused, err := p.exchangePooledOnce(ctx, dial, req)
+	if reused && isExpectedConnErr(err) && !isTimeout(err) {
+		// The socket is likely stale, e.g. has received an ICMP error for a
+		// previous query, so try another one.
+		log.Debug("plain %s: pooled socket: %s; retrying", addr, err)
+
+		resp, _, err = p.exchangePooledOnce(ctx, dial, req)
+	}
+
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return resp, err
+	}
+
+	return resp, validatePlainResponse(req, resp)
+}
+
+// exchangePooledOnce sends req over a socket from p.pool.  reused is true if
+// the socket has already been used for other queries.
+func (p *plainDNS) exchangePooledOnce(
+	ctx context.Context,
+	dial bootstrap.DialHandler,
+	req *dns.Msg,
+) (resp *dns.Msg, reused bool, err error) {
+	pc, err := p.pool.get(ctx, dial)
+	if err != nil {
+		return nil, false, fmt.Errorf("dialing %s over %s: %w", p.addr.Host, networkUDP, err)
+	}
+
+	reused = pc.uses > 0
+
+	// Send the query with a random ID, since the sockets are shared by the
+	// queries of different clients, which may use the same IDs, e.g. 0 over
+	// DNS-over-HTTPS.  The responses with other IDs, including the late ones
+	// to the previous queries over the socket, are skipped by the client.
+	pooledReq := &dns.Msg{}
+	*pooledReq = *req
+	pooledReq.Id = dns.Id()
+
+	client := &dns.Client{Timeout: p.timeout}
+	resp, _, err = client.ExchangeWithConn(pooledReq, pc.conn)
+	p.pool.put(pc, err != nil)
+	if err != nil {
+		return resp, reused, fmt.Errorf("exchanging with %s over %s: %w", p.Address(), networkUDP, err)
+	}
+
+	resp.Id = req.Id
+
+	return resp, reused, nil
+}
@@ -0,0 +1,117 @@
+package upstream
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstream_plainDNS_udpPool(t *testing.T) {
+	const poolSize = 2
+
+	var (
+		mu    sync.Mutex
+		ports = map[string]struct{}{}
+		ids   = map[uint16]struct{}{}
+	)
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		ports[w.RemoteAddr().String()] = struct{}{}
+		ids[req.Id] = struct{}{}
+		mu.Unlock()
+
+		pt := testutil.PanicT{}
+
+		// Send a response with another ID first, which must be skipped.
+		stale := respondToTestMessage(req)
+		stale.Id++
+		stale.Answer = nil
+		require.NoError(pt, w.WriteMsg(stale))
+
+		require.NoError(pt, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Timeout:     time.Second,
+		UDPPoolSize: poolSize,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	const queries = 20
+
+	wg := &sync.WaitGroup{}
+	for range queries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := createTestMessage()
+			req.Id = 0
+
+			resp, exchErr := u.Exchange(req)
+			require.NoError(testutil.PanicT{}, exchErr)
+
+			requireResponse(testutil.PanicT{}, req, resp)
+		}()
+	}
+
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.LessOrEqual(t, len(ports), poolSize)
+	assert.Greater(t, len(ids), 1)
+}
+
+func TestUDPPool_recycle(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Timeout:     time.Second,
+		UDPPoolSize: 1,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	p := testutil.RequireTypeAssert[*plainDNS](t, u)
+
+	now := time.Now()
+	p.pool.now = func() (t time.Time) { return now }
+
+	checkUpstream(t, u, addr)
+	require.Len(t, p.pool.idle, 1)
+
+	first := p.pool.idle[0]
+
+	checkUpstream(t, u, addr)
+	require.Len(t, p.pool.idle, 1)
+
+	assert.Same(t, first, p.pool.idle[0])
+	assert.Equal(t, uint(2), first.uses)
+
+	// The idle sockets are recycled after the timeout.
+	now = now.Add(udpPoolIdleTimeout)
+
+	checkUpstream(t, u, addr)
+	require.Len(t, p.pool.idle, 1)
+
+	assert.NotSame(t, first, p.pool.idle[0])
+
+	require.NoError(t, u.Close())
+	assert.Empty(t, p.pool.idle)
+}
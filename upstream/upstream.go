@@ -20,8 +20,8 @@ import (
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/ameshkov/dnscrypt/v2"
-	"github.com/ameshkov/dnsstamps"
 	"github.com/bruceluk/dnsproxy/internal/bootstrap"
+	proxynetutil "github.com/bruceluk/dnsproxy/internal/netutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/logging"
@@ -77,6 +77,38 @@ type Options struct {
 	// CipherSuites is a custom list of TLSv1.2 ciphers.
 	CipherSuites []uint16
 
+	// Normalization, if not nil, makes the upstreams normalize the queries
+	// before sending them.  Use different options for the upstreams requiring
+	// different normalization.
+	Normalization *Normalization
+
+	// TLSSessionCache, if not nil, is the TLS session cache shared by the
+	// encrypted upstreams.  Otherwise, each upstream has its own cache.
+	TLSSessionCache *TLSSessionCache
+
+	// DNSCryptCache, if not nil, is the cache of the certificates and the
+	// shared keys of the DNSCrypt upstreams.
+	DNSCryptCache *DNSCryptCache
+
+	// SpoofDetector, if not nil, detects the spoofed responses of the plain
+	// UDP upstreams.
+	SpoofDetector *SpoofDetector
+
+	// UDPPortRange, if not nil, is the range of the local ports the UDP
+	// sockets of the upstreams are bound to, so that the firewalls can only
+	// allow those.  The port of each socket is chosen randomly.  It's
+	// supported on Unix and Windows, and isn't used for the sockets of
+	// DNS-over-QUIC, DNS-over-HTTP/3, and DNSCrypt upstreams.
+	UDPPortRange *PortRange
+
+	// UDPPoolSize, if positive, is the maximum number of the UDP sockets each
+	// plain UDP upstream keeps open and reuses across the queries instead of
+	// opening a socket per query, which reduces the ephemeral port exhaustion
+	// and the conntrack pressure on the NAT routers.  The queries wait for a
+	// free socket when all of them are in use.  It's ignored when
+	// SpoofDetector is set.
+	UDPPoolSize int
+
 	// Bootstrap is used to resolve upstreams' hostnames.  If nil, the
 	// [net.DefaultResolver] will be used.
 	Bootstrap Resolver
@@ -89,9 +121,58 @@ type Options struct {
 	// bootstrap DNS requests.  Zero value disables the timeout.
 	Timeout time.Duration
 
+	// SocketMark, if not zero, is the SO_MARK set on the sockets of the
+	// upstreams, so that the policy routing can tell them apart.  It's only
+	// supported on Linux.  The sockets of DNS-over-QUIC, DNS-over-HTTP/3, and
+	// DNSCrypt upstreams aren't marked.
+	SocketMark uint32
+
+	// DSCP, if not zero, is the Differentiated Services Code Point set on the
+	// packets sent to the upstreams, the same ones as for SocketMark.  It must
+	// not be greater than 63.
+	DSCP uint8
+
+	// FastOpen, if not nil, enables TCP Fast Open for the TCP connections to
+	// the upstreams, i.e. the ones of the plain DNS over TCP, DNS-over-TLS,
+	// and DNS-over-HTTPS upstreams, and counts its hits.
+	FastOpen *FastOpen
+
+	// MaxIdleConns is the maximum number of the idle connections kept for
+	// reuse by each DNS-over-TLS and DNS-over-HTTPS upstream.  The connections
+	// returned to the full pool are closed.  Zero means the default, which is
+	// unlimited for DNS-over-TLS and 2 for DNS-over-HTTPS.  It doesn't change
+	// the number of the active DNS-over-HTTPS connections to a host.
+	MaxIdleConns int
+
 	// InsecureSkipVerify disables verifying the server's certificate.
 	InsecureSkipVerify bool
 
+	// HTTP3AltSvc makes the DNS-over-HTTPS upstreams switch to HTTP/3 once
+	// the server advertises it in the Alt-Svc header of its HTTP/1.1 or
+	// HTTP/2 responses, even if HTTPVersions doesn't contain [HTTPVersion3].
+	// The upstream falls back to the other versions for a while if QUIC
+	// appears to be blocked.
+	HTTP3AltSvc bool
+
+	// DisableDoQ0RTT makes the DNS-over-QUIC upstreams wait for the handshake
+	// to complete before sending the queries, so that those aren't sent in the
+	// 0-RTT data, which may be replayed by an attacker.  The TLS sessions are
+	// still resumed.
+	DisableDoQ0RTT bool
+
+	// ECSSubnet, if valid, is the EDNS Client Subnet sent to the upstreams
+	// instead of the subnet of the client, so that the responses are tailored
+	// for the network of the proxy itself, e.g. the one of the egress NAT.  The
+	// responses are then valid for any client, so their options get the zero
+	// scope.
+	ECSSubnet netip.Prefix
+
+	// EDNSFallback makes the upstreams retry the queries without EDNS when
+	// those are responded with FORMERR or NOTIMP lacking the OPT record, and
+	// then send the queries without EDNS to such upstreams for an hour.  It's
+	// intended for the ancient servers unaware of EDNS.
+	EDNSFallback bool
+
 	// PreferIPv6 tells the bootstrapper to prefer IPv6 addresses for an
 	// upstream.
 	PreferIPv6 bool
@@ -102,15 +183,29 @@ func (o *Options) Clone() (clone *Options) {
 	return &Options{
 		Bootstrap:                 o.Bootstrap,
 		Timeout:                   o.Timeout,
+		SocketMark:                o.SocketMark,
+		DSCP:                      o.DSCP,
+		FastOpen:                  o.FastOpen,
+		MaxIdleConns:              o.MaxIdleConns,
 		HTTPVersions:              o.HTTPVersions,
 		VerifyServerCertificate:   o.VerifyServerCertificate,
 		VerifyConnection:          o.VerifyConnection,
 		VerifyDNSCryptCertificate: o.VerifyDNSCryptCertificate,
 		InsecureSkipVerify:        o.InsecureSkipVerify,
+		HTTP3AltSvc:               o.HTTP3AltSvc,
 		PreferIPv6:                o.PreferIPv6,
 		QUICTracer:                o.QUICTracer,
 		RootCAs:                   o.RootCAs,
 		CipherSuites:              o.CipherSuites,
+		TLSSessionCache:           o.TLSSessionCache,
+		DNSCryptCache:             o.DNSCryptCache,
+		SpoofDetector:             o.SpoofDetector,
+		UDPPoolSize:               o.UDPPoolSize,
+		UDPPortRange:              o.UDPPortRange,
+		Normalization:             o.Normalization,
+		EDNSFallback:              o.EDNSFallback,
+		ECSSubnet:                 o.ECSSubnet,
+		DisableDoQ0RTT:            o.DisableDoQ0RTT,
 	}
 }
 
@@ -141,6 +236,12 @@ const (
 	// defaultPortDoT is the default port for DNS-over-TLS.
 	defaultPortDoT = 853
 
+	// defaultPortGRPC is the default port for DNS-over-gRPC without TLS.
+	defaultPortGRPC = 80
+
+	// defaultPortGRPCS is the default port for DNS-over-gRPC over TLS.
+	defaultPortGRPCS = 443
+
 	// defaultPortDoQ is the default port for DNS-over-QUIC.  Prior to version
 	// -10 of the draft experiments were directed to use ports 8853, 784.
 	//
@@ -156,6 +257,8 @@ const (
 //   - udp://name.server:53 or name.server:53 for plain DNS using domain name;
 //   - tcp://5.3.5.3:53 for plain DNS-over-TCP using IP address;
 //   - tcp://name.server:53 for plain DNS-over-TCP using domain name;
+//   - udp://5.3.5.3:53?transport=udp&udp-size=1232 for plain DNS with
+//     transport hints;
 //   - tls://5.3.5.3:853 for DNS-over-TLS using IP address;
 //   - tls://name.server:853 for DNS-over-TLS using domain name;
 //   - https://5.3.5.3:443/dns-query for DNS-over-HTTPS using IP address;
@@ -163,11 +266,22 @@ const (
 //   - quic://5.3.5.3:853 for DNS-over-QUIC using IP address;
 //   - quic://name.server:853 for DNS-over-QUIC using domain name;
 //   - h3://dns.google for DNS-over-HTTPS that only works with HTTP/3;
+//   - grpcs://name.server:443 for DNS-over-gRPC over TLS;
+//   - grpc://name.server:8053 for DNS-over-gRPC without TLS;
+//   - odoh://name.server/dns-query?proxy=https://proxy.server/proxy for
+//     Oblivious DNS over HTTPS relayed through the oblivious proxy;
 //   - sdns://... for DNS stamp, see https://dnscrypt.info/stamps-specifications.
 //
 // If addr doesn't have port specified, the default port of the appropriate
 // protocol will be used.
 //
+// The URLs of plain DNS upstreams may contain the transport hints working
+// around the broken servers in the query:
+//
+//   - transport=tcp makes the upstream use TCP only, same as the "tcp" scheme;
+//   - transport=udp makes the upstream never fall back to TCP;
+//   - udp-size=N limits the UDP payload size advertised in the queries to N.
+//
 // opts are applied to the u and shouldn't be modified afterwards, nil value is
 // valid.
 //
@@ -177,7 +291,37 @@ func AddressToUpstream(addr string, opts *Options) (u Upstream, err error) {
 		opts = &Options{}
 	}
 
-	var uu *url.URL
+	uu, err := parseUpstreamURL(addr)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return nil, err
+	}
+
+	u, err = urlToUpstream(uu, opts)
+	if err != nil {
+		return u, err
+	}
+
+	if opts.Normalization != nil {
+		u = newNormalizingUpstream(u, opts.Normalization)
+	}
+
+	if opts.EDNSFallback {
+		u = newEDNSFallbackUpstream(u)
+	}
+
+	// Set the subnet before falling back to the queries without EDNS, which
+	// removes the option along with the OPT record.
+	if opts.ECSSubnet.IsValid() {
+		u = newStaticECSUpstream(u, opts.ECSSubnet)
+	}
+
+	return u, nil
+}
+
+// parseUpstreamURL parses and validates the upstream address addr in the
+// format accepted by [AddressToUpstream].
+func parseUpstreamURL(addr string) (uu *url.URL, err error) {
 	if strings.Contains(addr, "://") {
 		uu, err = url.Parse(addr)
 		if err != nil {
@@ -196,7 +340,7 @@ func AddressToUpstream(addr string, opts *Options) (u Upstream, err error) {
 		return nil, err
 	}
 
-	return urlToUpstream(uu, opts)
+	return uu, nil
 }
 
 // validateUpstreamURL returns an error if the upstream URL is not valid.
@@ -251,6 +395,10 @@ func urlToUpstream(uu *url.URL, opts *Options) (u Upstream, err error) {
 		return newDoT(uu, opts)
 	case "h3", "https":
 		return newDoH(uu, opts)
+	case "grpc", "grpcs":
+		return newDoGRPC(uu, opts)
+	case "odoh":
+		return newODoH(uu, opts)
 	default:
 		return nil, fmt.Errorf("unsupported url scheme: %s", sch)
 	}
@@ -258,41 +406,25 @@ func urlToUpstream(uu *url.URL, opts *Options) (u Upstream, err error) {
 
 // parseStamp converts a DNS stamp to an Upstream.
 func parseStamp(upsURL *url.URL, opts *Options) (u Upstream, err error) {
-	stamp, err := dnsstamps.NewServerStampFromString(upsURL.String())
+	st, err := DecodeStamp(upsURL.String())
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse %s: %w", upsURL, err)
+		// Don't wrap the error, because it's informative enough as is.
+		return nil, err
 	}
 
-	// TODO(e.burkov):  Port?
-	if stamp.ServerAddrStr != "" {
-		host, _, sErr := netutil.SplitHostPort(stamp.ServerAddrStr)
-		if sErr != nil {
-			host = stamp.ServerAddrStr
-		}
-
-		var ip netip.Addr
-		ip, err = netip.ParseAddr(host)
-		if err != nil {
-			return nil, fmt.Errorf("invalid server stamp address %s", stamp.ServerAddrStr)
-		}
-
-		opts.Bootstrap = StaticResolver{ip}
+	if st.ServerAddr.IsValid() {
+		opts.Bootstrap = StaticResolver{st.ServerAddr}
 	}
 
-	switch stamp.Proto {
-	case dnsstamps.StampProtoTypePlain:
-		return newPlain(&url.URL{Scheme: "udp", Host: stamp.ServerAddrStr}, opts)
-	case dnsstamps.StampProtoTypeDNSCrypt:
+	uu, err := url.Parse(st.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse stamp address %s: %w", st.Address, err)
+	} else if uu.Scheme == "sdns" {
+		// The DNSCrypt stamps have no other representation.
 		return newDNSCrypt(upsURL, opts), nil
-	case dnsstamps.StampProtoTypeDoH:
-		return newDoH(&url.URL{Scheme: "https", Host: stamp.ProviderName, Path: stamp.Path}, opts)
-	case dnsstamps.StampProtoTypeDoQ:
-		return newDoQ(&url.URL{Scheme: "quic", Host: stamp.ProviderName, Path: stamp.Path}, opts)
-	case dnsstamps.StampProtoTypeTLS:
-		return newDoT(&url.URL{Scheme: "tls", Host: stamp.ProviderName}, opts)
-	default:
-		return nil, fmt.Errorf("unsupported stamp protocol %s", &stamp.Proto)
 	}
+
+	return urlToUpstream(uu, opts)
 }
 
 // addPort appends port to u if it's absent.
@@ -363,9 +495,18 @@ type DialerInitializer func() (handler bootstrap.DialHandler, err error)
 // newDialerInitializer creates an initializer of the dialer that will dial the
 // addresses resolved from u using opts.
 func newDialerInitializer(u *url.URL, opts *Options) (di DialerInitializer) {
+	control := proxynetutil.DialControl(opts.SocketMark, opts.DSCP)
+	if opts.FastOpen != nil {
+		control = proxynetutil.DialControlFastOpen(control)
+	}
+
+	if r := opts.UDPPortRange; r != nil {
+		control = proxynetutil.PortRangeControl(r.First, r.Last, control)
+	}
+
 	if _, err := netip.ParseAddrPort(u.Host); err == nil {
 		// Don't resolve the address of the server since it's already an IP.
-		handler := bootstrap.NewDialContext(opts.Timeout, u.Host)
+		handler := opts.wrapDial(bootstrap.NewDialContext(opts.Timeout, control, u.Host))
 
 		return func() (h bootstrap.DialHandler, dialerErr error) {
 			return handler, nil
@@ -379,6 +520,21 @@ func newDialerInitializer(u *url.URL, opts *Options) (di DialerInitializer) {
 	}
 
 	return func() (h bootstrap.DialHandler, err error) {
-		return bootstrap.ResolveDialContext(u, opts.Timeout, boot, opts.PreferIPv6)
+		h, err = bootstrap.ResolveDialContext(u, opts.Timeout, boot, opts.PreferIPv6, control)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, err
+		}
+
+		return opts.wrapDial(h), nil
 	}
 }
+
+// wrapDial returns dial wrapped to count the hits of o.FastOpen, if any.
+func (o *Options) wrapDial(dial bootstrap.DialHandler) (wrapped bootstrap.DialHandler) {
+	if o.FastOpen == nil {
+		return dial
+	}
+
+	return o.FastOpen.wrapDial(dial)
+}
@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
@@ -431,6 +432,77 @@ func TestUpstreamsInvalidBootstrap(t *testing.T) {
 	})
 }
 
+func TestNewUpstreamResolver_hostname(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, m *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(m)))
+	})
+
+	addr := fmt.Sprintf("tls://dot.example:%d", srv.port)
+
+	t.Run("no_bootstrap", func(t *testing.T) {
+		r, err := NewUpstreamResolver(addr, &Options{Timeout: timeout})
+		testutil.CleanupAndRequireSuccess(t, r.Close)
+
+		nbErr := NotBootstrapError{}
+		assert.ErrorAs(t, err, &nbErr)
+	})
+
+	t.Run("bootstrap", func(t *testing.T) {
+		r, err := NewUpstreamResolver(addr, &Options{
+			Bootstrap:          StaticResolver{netip.MustParseAddr("127.0.0.1")},
+			Timeout:            timeout,
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, r.Close)
+
+		addrs, err := r.LookupNetIP(context.Background(), "ip4", "example.org")
+		require.NoError(t, err)
+
+		assert.Equal(t, []netip.Addr{netip.MustParseAddr("8.8.8.8")}, addrs)
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		const (
+			addrA = "tls://a.example"
+			addrB = "tls://b.example"
+		)
+
+		b, err := NewUpstreamResolver(addrB, &Options{
+			Bootstrap: StaticResolver{netip.MustParseAddr("127.0.0.1")},
+			Timeout:   timeout,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, b.Close)
+
+		a, err := NewUpstreamResolver(addrA, &Options{
+			Bootstrap: ParallelResolver{NewCachingResolver(b)},
+			Timeout:   timeout,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, a.Close)
+
+		r, err := NewUpstreamResolver(addrB, &Options{
+			Bootstrap: ConsequentResolver{a},
+			Timeout:   timeout,
+		})
+		assert.Nil(t, r)
+		assert.ErrorIs(t, err, ErrBootstrapCycle)
+		testutil.AssertErrorMsg(
+			t,
+			"bootstrap cycle: tls://b.example:853 -> tls://a.example:853 -> tls://b.example:853",
+			err,
+		)
+
+		r, err = NewUpstreamResolver(addrA, &Options{
+			Bootstrap: a,
+			Timeout:   timeout,
+		})
+		assert.Nil(t, r)
+		assert.ErrorIs(t, err, ErrBootstrapCycle)
+	})
+}
+
 func TestAddressToUpstream_StaticResolver(t *testing.T) {
 	h := func(w dns.ResponseWriter, m *dns.Msg) {
 		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(m)))
@@ -0,0 +1,235 @@
+package zone
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// data is an immutable snapshot of the zone contents.
+type data struct {
+	// soa is the SOA record of the zone.
+	soa *dns.SOA
+
+	// records are all the records of the zone except the SOA by their keys, see
+	// [rrKey].
+	records map[string]dns.RR
+
+	// names are the record sets by their lowercased owner names and types.  The
+	// empty non-terminals have an empty map.
+	names map[string]map[uint16][]dns.RR
+
+	// cuts are the lowercased names of the delegations below the apex.
+	cuts *container.MapSet[string]
+}
+
+// newData returns the zone data with origin, soa, and records.  records must
+// not contain the SOA.
+func newData(origin string, soa *dns.SOA, records map[string]dns.RR) (d *data, err error) {
+	d = &data{
+		soa:     soa,
+		records: records,
+		names:   map[string]map[uint16][]dns.RR{},
+		cuts:    container.NewMapSet[string](),
+	}
+
+	d.add(origin, soa)
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(origin, name) {
+			return nil, fmt.Errorf("record %q is out of zone", rr)
+		}
+
+		d.add(origin, rr)
+		if rr.Header().Rrtype == dns.TypeNS && name != origin {
+			d.cuts.Add(name)
+		}
+	}
+
+	return d, nil
+}
+
+// add adds rr to the record sets of d, as well as the empty non-terminals
+// between it and origin.
+func (d *data) add(origin string, rr dns.RR) {
+	name := strings.ToLower(rr.Header().Name)
+
+	sets := d.names[name]
+	if sets == nil {
+		sets = map[uint16][]dns.RR{}
+		d.names[name] = sets
+	}
+
+	typ := rr.Header().Rrtype
+	sets[typ] = append(sets[typ], rr)
+
+	for name != origin {
+		_, name, _ = strings.Cut(name, ".")
+		if _, ok := d.names[name]; !ok {
+			d.names[name] = map[uint16][]dns.RR{}
+		}
+	}
+}
+
+// rrKey returns the key of rr identifying it regardless of the TTL and the
+// case of the owner name.
+func rrKey(rr dns.RR) (key string) {
+	rr = dns.Copy(rr)
+	hdr := rr.Header()
+	hdr.Name = strings.ToLower(hdr.Name)
+	hdr.Ttl = 0
+
+	return rr.String()
+}
+
+// errIncremental is returned when the incremental transfer can't be applied,
+// so the full one should be used.
+const errIncremental errors.Error = "incremental transfer not applicable"
+
+// applyTransfer returns the zone data received with the transfer rrs applied
+// to cur, which may be nil.  It returns cur if the zone hasn't changed.
+func applyTransfer(origin string, cur *data, rrs []dns.RR) (next *data, err error) {
+	if len(rrs) == 0 {
+		return nil, errors.Error("empty transfer")
+	}
+
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, errors.Error("transfer doesn't start with soa")
+	} else if cur != nil && !serialNewer(soa.Serial, cur.soa.Serial) {
+		return cur, nil
+	}
+
+	if len(rrs) == 1 {
+		// The primary may respond with its SOA alone to an incremental
+		// transfer request, see RFC 1995, section 4.
+		return nil, fmt.Errorf("%w: only soa received", errIncremental)
+	}
+
+	if last, isSOA := rrs[len(rrs)-1].(*dns.SOA); !isSOA || last.Serial != soa.Serial {
+		return nil, errors.Error("transfer doesn't end with soa")
+	}
+
+	if old, isSOA := rrs[1].(*dns.SOA); isSOA && len(rrs) > 2 && old.Serial != soa.Serial {
+		return applyIncremental(origin, cur, soa, rrs[1:len(rrs)-1])
+	}
+
+	records := make(map[string]dns.RR, len(rrs)-2)
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		records[rrKey(rr)] = rr
+	}
+
+	return newData(origin, soa, records)
+}
+
+// applyIncremental returns cur with the differences from an incremental
+// transfer applied.  diffs are the records between the first and the last SOA
+// of the transfer.
+func applyIncremental(origin string, cur *data, soa *dns.SOA, diffs []dns.RR) (next *data, err error) {
+	if cur == nil || diffs[0].(*dns.SOA).Serial != cur.soa.Serial {
+		return nil, fmt.Errorf("%w: serial mismatch", errIncremental)
+	}
+
+	records := maps.Clone(cur.records)
+	deleting := false
+	for _, rr := range diffs {
+		if _, ok := rr.(*dns.SOA); ok {
+			// Each difference sequence starts with the old SOA followed by the
+			// deleted records and then the new SOA followed by the added ones.
+			deleting = !deleting
+		} else if deleting {
+			delete(records, rrKey(rr))
+		} else {
+			records[rrKey(rr)] = rr
+		}
+	}
+
+	return newData(origin, soa, records)
+}
+
+// serialNewer returns true if the serial a is newer than b according to the
+// serial number arithmetic, see RFC 1982.
+func serialNewer(a, b uint32) (ok bool) {
+	return int32(a-b) > 0
+}
+
+// answer returns the authoritative response to req from d.  req must have a
+// single question within the zone with origin.  It returns nil if the name is
+// delegated.
+func (d *data) answer(origin string, req *dns.Msg) (resp *dns.Msg) {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	for n := name; n != origin; _, n, _ = strings.Cut(n, ".") {
+		if d.cuts.Has(n) {
+			return nil
+		}
+	}
+
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+
+	sets, ok := d.names[name]
+	if !ok {
+		sets, ok = d.wildcard(origin, name)
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = []dns.RR{d.negativeSOA()}
+
+			return resp
+		}
+	}
+
+	rrs := sets[q.Qtype]
+	if len(rrs) == 0 {
+		rrs = sets[dns.TypeCNAME]
+	}
+
+	if q.Qtype == dns.TypeANY {
+		rrs = nil
+		for _, set := range sets {
+			rrs = append(rrs, set...)
+		}
+	}
+
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		resp.Answer = append(resp.Answer, rr)
+	}
+
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{d.negativeSOA()}
+	}
+
+	return resp
+}
+
+// wildcard returns the record sets of the wildcard matching the nonexistent
+// name, if any.
+func (d *data) wildcard(origin, name string) (sets map[uint16][]dns.RR, ok bool) {
+	encloser := name
+	for encloser != origin {
+		_, encloser, _ = strings.Cut(encloser, ".")
+		if _, ok = d.names[encloser]; ok {
+			break
+		}
+	}
+
+	sets, ok = d.names["*."+encloser]
+
+	return sets, ok
+}
+
+// negativeSOA returns the SOA record for the negative responses, see RFC 2308.
+func (d *data) negativeSOA() (soa *dns.SOA) {
+	soa = dns.Copy(d.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+
+	return soa
+}
@@ -0,0 +1,399 @@
+// Package zone implements serving the zones locally as a secondary nameserver.
+// The zones are transferred from their primary nameservers with AXFR and kept
+// current with IXFR, on the schedule set by their SOA records and on the NOTIFY
+// messages from the primaries, optionally authenticated with TSIG.
+package zone
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultTimeout is the default timeout of the transfers.
+	DefaultTimeout = 10 * time.Second
+
+	// minRefreshInterval is the minimum interval between the refreshes, which
+	// protects the primary from the zones with too low SOA timers.
+	minRefreshInterval = 10 * time.Second
+
+	// tsigFudge is the allowed time difference with the primary in seconds.
+	tsigFudge = 300
+)
+
+// TSIG is the key to authenticate the transfers with, see RFC 8945.
+type TSIG struct {
+	// Name is the name of the key.  It must not be empty.
+	Name string
+
+	// Algorithm is the name of the algorithm of the key, such as
+	// [dns.HmacSHA256], which is used if it's empty.
+	Algorithm string
+
+	// Secret is the base64-encoded secret of the key.  It must not be empty.
+	Secret string
+}
+
+// Config is the configuration of a [Secondary].
+type Config struct {
+	// TSIG, if not nil, is the key to authenticate the transfers with.
+	TSIG *TSIG
+
+	// Name is the name of the zone.  It must not be empty or the root zone.
+	Name string
+
+	// Primary is the address of the primary nameserver of the zone.  The
+	// NOTIFY messages are only accepted from its IP address.  It must be
+	// valid.
+	Primary netip.AddrPort
+
+	// Timeout is the timeout of the transfers.  If not positive,
+	// [DefaultTimeout] is used.
+	Timeout time.Duration
+}
+
+// Secondary serves a zone transferred from its primary nameserver.  It must be
+// set as the [proxy.Config.BeforeRequestHandler] of the proxy.  Before the zone
+// is transferred and after it expires, the requests within it are answered
+// with SERVFAIL.
+type Secondary struct {
+	// data is the current contents of the zone.  It's nil if the zone isn't
+	// transferred yet or has expired.
+	data atomic.Pointer[data]
+
+	// tsig is the key to authenticate the transfers with.  It's nil if the
+	// transfers aren't authenticated.
+	tsig *TSIG
+
+	// notify receives the signals to refresh the zone immediately.
+	notify chan struct{}
+
+	// stop is closed to stop the refreshing.
+	stop chan struct{}
+
+	// wg tracks the refreshing goroutine.
+	wg *sync.WaitGroup
+
+	// origin is the lowercased FQDN of the zone.
+	origin string
+
+	// primary is the address of the primary nameserver.
+	primary netip.AddrPort
+
+	// timeout is the timeout of the transfers.
+	timeout time.Duration
+}
+
+// New returns a new properly initialized *Secondary.  c must not be nil.
+func New(c *Config) (s *Secondary, err error) {
+	origin := dns.CanonicalName(c.Name)
+	if origin == "." {
+		return nil, errors.Error("zone name must not be empty or root")
+	} else if _, ok := dns.IsDomainName(origin); !ok {
+		return nil, fmt.Errorf("bad zone name %q", c.Name)
+	} else if !c.Primary.IsValid() {
+		return nil, fmt.Errorf("zone %s: no primary", origin)
+	}
+
+	tsig, err := newTSIG(c.TSIG)
+	if err != nil {
+		return nil, fmt.Errorf("zone %s: tsig: %w", origin, err)
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	return &Secondary{
+		tsig:    tsig,
+		notify:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		wg:      &sync.WaitGroup{},
+		origin:  origin,
+		primary: netip.AddrPortFrom(c.Primary.Addr().Unmap(), c.Primary.Port()),
+		timeout: timeout,
+	}, nil
+}
+
+// newTSIG validates k and returns its normalized copy.  It returns nil if k is
+// nil.
+func newTSIG(k *TSIG) (norm *TSIG, err error) {
+	if k == nil {
+		return nil, nil
+	} else if k.Name == "" {
+		return nil, errors.Error("no key name")
+	} else if k.Secret == "" {
+		return nil, errors.Error("no secret")
+	}
+
+	_, err = base64.StdEncoding.DecodeString(k.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("secret: %w", err)
+	}
+
+	alg := dns.CanonicalName(k.Algorithm)
+	switch alg {
+	case ".":
+		alg = dns.HmacSHA256
+	case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", k.Algorithm)
+	}
+
+	return &TSIG{
+		Name:      dns.CanonicalName(k.Name),
+		Algorithm: alg,
+		Secret:    k.Secret,
+	}, nil
+}
+
+// Start starts keeping the zone current.  The first transfer is performed in
+// background.
+func (s *Secondary) Start() {
+	s.wg.Add(1)
+	go s.refreshLoop()
+}
+
+// Close stops keeping the zone current.  The zone is still served.
+func (s *Secondary) Close() (err error) {
+	close(s.stop)
+	s.wg.Wait()
+
+	return nil
+}
+
+// refreshLoop refreshes the zone according to its SOA timers and on the
+// notifications until s is closed.  It's intended to be used as a goroutine.
+func (s *Secondary) refreshLoop() {
+	defer log.OnPanic("zone: refreshing")
+	defer s.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var lastSuccess time.Time
+	for {
+		select {
+		case <-timer.C:
+		case <-s.notify:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-s.stop:
+			return
+		}
+
+		timer.Reset(s.refresh(&lastSuccess))
+	}
+}
+
+// refresh refreshes the zone and returns the interval until the next refresh.
+// lastSuccess is the time of the last successful refresh, which is updated.
+func (s *Secondary) refresh(lastSuccess *time.Time) (next time.Duration) {
+	err := s.transfer()
+	if err == nil {
+		*lastSuccess = time.Now()
+
+		return max(time.Duration(s.data.Load().soa.Refresh)*time.Second, minRefreshInterval)
+	}
+
+	log.Error("zone %s: refreshing: %s", s.origin, err)
+
+	cur := s.data.Load()
+	if cur == nil {
+		return minRefreshInterval
+	}
+
+	if time.Since(*lastSuccess) > time.Duration(cur.soa.Expire)*time.Second {
+		log.Error("zone %s: expired", s.origin)
+		s.data.Store(nil)
+
+		return minRefreshInterval
+	}
+
+	return max(time.Duration(cur.soa.Retry)*time.Second, minRefreshInterval)
+}
+
+// transfer updates the zone from the primary, incrementally if possible.
+func (s *Secondary) transfer() (err error) {
+	cur := s.data.Load()
+
+	req := &dns.Msg{}
+	if cur == nil {
+		req.SetAxfr(s.origin)
+	} else {
+		req.SetIxfr(s.origin, cur.soa.Serial, cur.soa.Ns, cur.soa.Mbox)
+	}
+
+	rrs, err := s.receive(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	next, err := applyTransfer(s.origin, cur, rrs)
+	if errors.Is(err, errIncremental) {
+		log.Debug("zone %s: %s; falling back to axfr", s.origin, err)
+
+		rrs, err = s.receive((&dns.Msg{}).SetAxfr(s.origin))
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+
+		next, err = applyTransfer(s.origin, nil, rrs)
+	}
+
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	if next != cur {
+		s.data.Store(next)
+		log.Info("zone %s: transferred serial %d, %d records", s.origin, next.soa.Serial, len(next.records)+1)
+	}
+
+	return nil
+}
+
+// receive performs the transfer requested with req and returns the received
+// records.
+func (s *Secondary) receive(req *dns.Msg) (rrs []dns.RR, err error) {
+	t := &dns.Transfer{
+		DialTimeout:  s.timeout,
+		ReadTimeout:  s.timeout,
+		WriteTimeout: s.timeout,
+	}
+
+	if s.tsig != nil {
+		t.TsigSecret = map[string]string{s.tsig.Name: s.tsig.Secret}
+		req.SetTsig(s.tsig.Name, s.tsig.Algorithm, tsigFudge, time.Now().Unix())
+	}
+
+	envs, err := t.In(req, s.primary.String())
+	if err != nil {
+		if t.Conn != nil {
+			err = errors.WithDeferred(err, t.Close())
+		}
+
+		return nil, fmt.Errorf("requesting transfer: %w", err)
+	}
+
+	// Read all the envelopes to let the transfer goroutine finish.
+	for env := range envs {
+		if env.Error != nil {
+			err = env.Error
+		} else if err == nil {
+			rrs = append(rrs, env.RR...)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("receiving transfer: %w", err)
+	}
+
+	return rrs, nil
+}
+
+// type check
+var _ proxy.BeforeRequestHandler = (*Secondary)(nil)
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Secondary.  It answers the requests within the zone and accepts the
+// notifications about its changes.
+func (s *Secondary) HandleBefore(_ *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	req := dctx.Req
+	if len(req.Question) != 1 || req.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+
+	name := strings.ToLower(req.Question[0].Name)
+	if !dns.IsSubDomain(s.origin, name) {
+		return nil
+	}
+
+	switch req.Opcode {
+	case dns.OpcodeNotify:
+		if name != s.origin {
+			return nil
+		}
+
+		return s.handleNotify(dctx)
+	case dns.OpcodeQuery:
+		return s.handleQuery(req)
+	default:
+		return nil
+	}
+}
+
+// handleNotify accepts the notification about the change of the zone from the
+// primary.
+func (s *Secondary) handleNotify(dctx *proxy.DNSContext) (err error) {
+	resp := (&dns.Msg{}).SetReply(dctx.Req)
+	if dctx.Addr.Addr().Unmap() != s.primary.Addr() {
+		resp.Rcode = dns.RcodeRefused
+
+		return &proxy.BeforeRequestError{
+			Err:      fmt.Errorf("zone %s: notify from %s refused", s.origin, dctx.Addr),
+			Response: resp,
+		}
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+		// The refresh is already pending.
+	}
+
+	resp.Authoritative = true
+
+	return &proxy.BeforeRequestError{
+		Err:      fmt.Errorf("zone %s: notify accepted", s.origin),
+		Response: resp,
+	}
+}
+
+// handleQuery answers the query req within the zone.
+func (s *Secondary) handleQuery(req *dns.Msg) (err error) {
+	switch qt := req.Question[0].Qtype; qt {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		resp := (&dns.Msg{}).SetRcode(req, dns.RcodeRefused)
+
+		return &proxy.BeforeRequestError{
+			Err:      fmt.Errorf("zone %s: %s refused", s.origin, dns.TypeToString[qt]),
+			Response: resp,
+		}
+	}
+
+	cur := s.data.Load()
+	if cur == nil {
+		return &proxy.BeforeRequestError{
+			Err:      fmt.Errorf("zone %s: not loaded", s.origin),
+			Response: (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure),
+		}
+	}
+
+	resp := cur.answer(s.origin, req)
+	if resp == nil {
+		// The name is delegated, so resolve it as usual.
+		return nil
+	}
+
+	return &proxy.BeforeRequestError{
+		Err:      fmt.Errorf("zone %s: answered", s.origin),
+		Response: resp,
+	}
+}
@@ -0,0 +1,446 @@
+package zone
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bruceluk/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// Common test values.
+const (
+	testOrigin     = "example.internal."
+	testTSIGName   = "transfer."
+	testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+// newRR is a helper that parses rr.
+func newRR(t *testing.T, rr string) (res dns.RR) {
+	t.Helper()
+
+	res, err := dns.NewRR(rr)
+	require.NoError(t, err)
+
+	return res
+}
+
+// newSOA is a helper that returns the SOA of the test zone with serial.
+func newSOA(t *testing.T, serial uint32) (soa *dns.SOA) {
+	t.Helper()
+
+	soa = newRR(t, "example.internal. 3600 IN SOA ns.example.internal. admin.example.internal. 1 3600 600 86400 60").(*dns.SOA)
+	soa.Serial = serial
+
+	return soa
+}
+
+// testPrimary is a primary nameserver serving the transfers of the test zone.
+type testPrimary struct {
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// axfr is the response to the full transfer requests.
+	axfr []dns.RR
+
+	// ixfr is the response to the incremental transfer requests.  The full
+	// transfer is used if it's nil.
+	ixfr []dns.RR
+
+	// requests are the types of the received transfer requests.
+	requests []uint16
+}
+
+// type check
+var _ dns.Handler = (*testPrimary)(nil)
+
+// ServeDNS implements the [dns.Handler] interface for *testPrimary.
+func (p *testPrimary) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	defer w.Hijack()
+
+	if req.IsTsig() == nil || w.TsigStatus() != nil {
+		_ = w.WriteMsg((&dns.Msg{}).SetRcode(req, dns.RcodeNotAuth))
+
+		return
+	}
+
+	p.mu.Lock()
+	qt := req.Question[0].Qtype
+	p.requests = append(p.requests, qt)
+	rrs := p.axfr
+	if qt == dns.TypeIXFR && p.ixfr != nil {
+		rrs = p.ixfr
+	}
+	p.mu.Unlock()
+
+	ch := make(chan *dns.Envelope, 1)
+	ch <- &dns.Envelope{RR: rrs}
+	close(ch)
+
+	_ = (&dns.Transfer{}).Out(w, req, ch)
+}
+
+// set sets the responses of p.
+func (p *testPrimary) set(axfr, ixfr []dns.RR) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.axfr, p.ixfr, p.requests = axfr, ixfr, nil
+}
+
+// startPrimary starts serving p and returns its address.
+func startPrimary(t *testing.T, p *testPrimary) (addr netip.AddrPort) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          l,
+		Handler:           p,
+		TsigSecret:        map[string]string{testTSIGName: testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go func() { _ = srv.ActivateAndServe() }()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	_, _ = testutil.RequireReceive(t, started, testTimeout)
+
+	return netip.MustParseAddrPort(l.Addr().String())
+}
+
+// query returns the response of s to the request for name of type qt from the
+// client at addr.  It returns nil if s passes the request further.
+func query(t *testing.T, s *Secondary, name string, qt uint16, addr netip.AddrPort) (resp *dns.Msg) {
+	t.Helper()
+
+	dctx := &proxy.DNSContext{
+		Req:  (&dns.Msg{}).SetQuestion(name, qt),
+		Addr: addr,
+	}
+
+	err := s.HandleBefore(nil, dctx)
+	if err == nil {
+		return nil
+	}
+
+	befReqErr := &proxy.BeforeRequestError{}
+	require.ErrorAs(t, err, &befReqErr)
+
+	return befReqErr.Response
+}
+
+func TestSecondary(t *testing.T) {
+	soa1 := newSOA(t, 1)
+	soa2 := newSOA(t, 2)
+	www := newRR(t, "www.example.internal. 300 IN A 192.0.2.1")
+	mail := newRR(t, "mail.example.internal. 300 IN A 192.0.2.2")
+
+	p := &testPrimary{mu: &sync.Mutex{}}
+	p.set([]dns.RR{soa1, www, soa1}, nil)
+
+	primary := startPrimary(t, p)
+	client := netip.MustParseAddrPort("192.0.2.100:53")
+
+	s, err := New(&Config{
+		TSIG: &TSIG{
+			Name:   testTSIGName,
+			Secret: testTSIGSecret,
+		},
+		Name:    "Example.Internal",
+		Primary: primary,
+		Timeout: testTimeout,
+	})
+	require.NoError(t, err)
+
+	resp := query(t, s, "www.example.internal.", dns.TypeA, client)
+	require.NotNil(t, resp)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	s.Start()
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	require.Eventually(t, func() bool {
+		return s.data.Load() != nil
+	}, testTimeout, testTimeout/100)
+
+	resp = query(t, s, "WWW.example.internal.", dns.TypeA, client)
+	require.NotNil(t, resp)
+	require.Len(t, resp.Answer, 1)
+
+	assert.True(t, resp.Authoritative)
+	assert.Equal(t, "WWW.example.internal.", resp.Answer[0].Header().Name)
+
+	assert.Nil(t, query(t, s, "www.example.org.", dns.TypeA, client))
+
+	resp = query(t, s, testOrigin, dns.TypeAXFR, client)
+	require.NotNil(t, resp)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+
+	t.Run("notify_refused", func(t *testing.T) {
+		req := (&dns.Msg{}).SetNotify(testOrigin)
+		err = s.HandleBefore(nil, &proxy.DNSContext{Req: req, Addr: client})
+
+		befReqErr := &proxy.BeforeRequestError{}
+		require.ErrorAs(t, err, &befReqErr)
+
+		assert.Equal(t, dns.RcodeRefused, befReqErr.Response.Rcode)
+	})
+
+	t.Run("notify_ixfr", func(t *testing.T) {
+		p.set([]dns.RR{soa2, www, mail, soa2}, []dns.RR{soa2, soa1, soa2, mail, soa2})
+
+		req := (&dns.Msg{}).SetNotify(testOrigin)
+		err = s.HandleBefore(nil, &proxy.DNSContext{Req: req, Addr: primary})
+
+		befReqErr := &proxy.BeforeRequestError{}
+		require.ErrorAs(t, err, &befReqErr)
+
+		assert.Equal(t, dns.RcodeSuccess, befReqErr.Response.Rcode)
+		assert.Equal(t, dns.OpcodeNotify, befReqErr.Response.Opcode)
+
+		require.Eventually(t, func() bool {
+			return query(t, s, "mail.example.internal.", dns.TypeA, client).Rcode == dns.RcodeSuccess
+		}, testTimeout, testTimeout/100)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		assert.Equal(t, []uint16{dns.TypeIXFR}, p.requests)
+		assert.Len(t, s.data.Load().records, 2)
+	})
+}
+
+func TestSecondary_transfer(t *testing.T) {
+	soa1 := newSOA(t, 1)
+	soa2 := newSOA(t, 2)
+	soa3 := newSOA(t, 3)
+	www := newRR(t, "www.example.internal. 300 IN A 192.0.2.1")
+	mail := newRR(t, "mail.example.internal. 300 IN A 192.0.2.2")
+
+	p := &testPrimary{mu: &sync.Mutex{}}
+	s, err := New(&Config{
+		TSIG:    &TSIG{Name: testTSIGName, Secret: testTSIGSecret},
+		Name:    testOrigin,
+		Primary: startPrimary(t, p),
+		Timeout: testTimeout,
+	})
+	require.NoError(t, err)
+
+	p.set([]dns.RR{soa1, www, soa1}, nil)
+	require.NoError(t, s.transfer())
+
+	// The primary has no history, so it responds with the full zone.
+	p.set([]dns.RR{soa2, mail, soa2}, nil)
+	require.NoError(t, s.transfer())
+
+	assert.Equal(t, []uint16{dns.TypeIXFR}, p.requests)
+	assert.Equal(t, []string{rrKey(mail)}, keys(s.data.Load().records))
+
+	// The differences don't start from the current serial, so the full
+	// transfer is requested.
+	p.set([]dns.RR{soa3, www, soa3}, []dns.RR{soa3, soa1, soa3, www, soa3})
+	require.NoError(t, s.transfer())
+
+	assert.Equal(t, []uint16{dns.TypeIXFR, dns.TypeAXFR}, p.requests)
+	assert.Equal(t, []string{rrKey(www)}, keys(s.data.Load().records))
+
+	// Up to date.
+	p.set(nil, []dns.RR{soa3})
+	require.NoError(t, s.transfer())
+
+	assert.Equal(t, uint32(3), s.data.Load().soa.Serial)
+
+	t.Run("bad_tsig", func(t *testing.T) {
+		bad, bErr := New(&Config{
+			TSIG:    &TSIG{Name: testTSIGName, Secret: "YmFk"},
+			Name:    testOrigin,
+			Primary: s.primary,
+			Timeout: testTimeout,
+		})
+		require.NoError(t, bErr)
+
+		assert.Error(t, bad.transfer())
+		assert.Nil(t, bad.data.Load())
+	})
+}
+
+// keys returns the keys of records.
+func keys(records map[string]dns.RR) (ks []string) {
+	for k := range records {
+		ks = append(ks, k)
+	}
+
+	return ks
+}
+
+func TestData_answer(t *testing.T) {
+	soa := newSOA(t, 1)
+	records := map[string]dns.RR{}
+	for _, rr := range []string{
+		"www.example.internal. 300 IN A 192.0.2.1",
+		"www.example.internal. 300 IN A 192.0.2.2",
+		"alias.example.internal. 300 IN CNAME www.example.internal.",
+		"a.b.example.internal. 300 IN TXT \"deep\"",
+		"*.wild.example.internal. 300 IN A 192.0.2.3",
+		"sub.example.internal. 300 IN NS ns.sub.example.internal.",
+	} {
+		parsed := newRR(t, rr)
+		records[rrKey(parsed)] = parsed
+	}
+
+	d, err := newData(testOrigin, soa, records)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantRcode int
+		wantAns   int
+		wantNil   bool
+	}{{
+		name:      "answer",
+		qname:     "www.example.internal.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   2,
+	}, {
+		name:      "nodata",
+		qname:     "www.example.internal.",
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   0,
+	}, {
+		name:      "nxdomain",
+		qname:     "none.example.internal.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+		wantAns:   0,
+	}, {
+		name:      "cname",
+		qname:     "alias.example.internal.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   1,
+	}, {
+		name:      "empty_non_terminal",
+		qname:     "b.example.internal.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   0,
+	}, {
+		name:      "wildcard",
+		qname:     "x.y.wild.example.internal.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   1,
+	}, {
+		name:      "apex",
+		qname:     testOrigin,
+		qtype:     dns.TypeSOA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   1,
+	}, {
+		name:    "delegated",
+		qname:   "www.sub.example.internal.",
+		qtype:   dns.TypeA,
+		wantNil: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.qname, tc.qtype)
+			resp := d.answer(testOrigin, req)
+			if tc.wantNil {
+				require.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			require.Len(t, resp.Answer, tc.wantAns)
+
+			if tc.wantAns == 0 {
+				require.Len(t, resp.Ns, 1)
+
+				assert.Equal(t, uint32(60), resp.Ns[0].Header().Ttl)
+			} else {
+				assert.Equal(t, tc.qname, resp.Answer[0].Header().Name)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	primary := netip.MustParseAddrPort("192.0.2.1:53")
+
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &Config{Name: "", Primary: primary},
+		name:       "root",
+		wantErrMsg: "zone name must not be empty or root",
+	}, {
+		conf:       &Config{Name: testOrigin},
+		name:       "no_primary",
+		wantErrMsg: "zone example.internal.: no primary",
+	}, {
+		conf: &Config{
+			TSIG:    &TSIG{Name: testTSIGName, Secret: "!"},
+			Name:    testOrigin,
+			Primary: primary,
+		},
+		name: "bad_secret",
+		wantErrMsg: "zone example.internal.: tsig: secret: " +
+			"illegal base64 data at input byte 0",
+	}, {
+		conf: &Config{
+			TSIG:    &TSIG{Name: testTSIGName, Secret: testTSIGSecret, Algorithm: "md5"},
+			Name:    testOrigin,
+			Primary: primary,
+		},
+		name:       "bad_algorithm",
+		wantErrMsg: `zone example.internal.: tsig: unsupported algorithm "md5"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.conf)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestApplyTransfer_errors(t *testing.T) {
+	soa1 := newSOA(t, 1)
+	soa2 := newSOA(t, 2)
+	www := newRR(t, "www.example.internal. 300 IN A 192.0.2.1")
+
+	_, err := applyTransfer(testOrigin, nil, []dns.RR{soa2, soa1, soa2, www, soa2})
+	assert.True(t, errors.Is(err, errIncremental))
+
+	_, err = applyTransfer(testOrigin, nil, []dns.RR{soa1, www})
+	testutil.AssertErrorMsg(t, "transfer doesn't end with soa", err)
+
+	out := newRR(t, "www.example.org. 300 IN A 192.0.2.1")
+	_, err = applyTransfer(testOrigin, nil, []dns.RR{soa1, out, soa1})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is out of zone")
+}